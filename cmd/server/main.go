@@ -1,16 +1,35 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/nat"
 	"github.com/NHAS/reverse_ssh/internal/server"
+	"github.com/NHAS/reverse_ssh/internal/server/audit"
+	"github.com/NHAS/reverse_ssh/internal/server/eventbus"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
+	"github.com/NHAS/reverse_ssh/internal/server/reaper"
+	"github.com/NHAS/reverse_ssh/internal/server/research"
+	"github.com/NHAS/reverse_ssh/internal/server/sourcefilter"
+	"github.com/NHAS/reverse_ssh/internal/server/storage"
+	"github.com/NHAS/reverse_ssh/internal/server/suspend"
+	"github.com/NHAS/reverse_ssh/internal/server/systemd"
+	"github.com/NHAS/reverse_ssh/internal/server/tracing"
+	"github.com/NHAS/reverse_ssh/internal/server/webserver"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 )
@@ -18,9 +37,25 @@ import (
 func printHelp() {
 
 	fmt.Println("usage: ", filepath.Base(os.Args[0]), "[options] listen_address")
+	fmt.Println("\nUnder systemd socket activation listen_address can be left out, the server listens on the sockets it is passed instead. A socket with FileDescriptorName=derp is used for the DERP relay")
 	fmt.Println("\nOptions:")
 	fmt.Println("  Data")
 	fmt.Println("\t--datadir\t\tDirectory to search for keys, config files, and to store compile cache (defaults to working directory)")
+	fmt.Println("\t--storage\t\tOffload client builds to object storage instead of the datadir, s3://bucket/prefix[?endpoint=host:port&region=r&insecure]. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. Also set by RSSH_STORAGE")
+	fmt.Println("\t--storage-expire\tDays until offloaded objects are deleted by the bucket, replaces the bucket's lifecycle configuration")
+	fmt.Println("  Events and tracing")
+	fmt.Println("\t--event-bus\t\tPublish server events (connections, commands, downloads, builds, alerts) to nats://[user:pass@|token@]host[:port] or kafka://[user:pass@]broker[:port][,broker...], add ?tls to connect with TLS. Also set by RSSH_EVENT_BUS")
+	fmt.Println("\t--event-topic\t\tNATS subject or Kafka topic events are published to, {type} is replaced with the event type (default rssh.{type}). Also set by RSSH_EVENT_TOPIC")
+	fmt.Println("\t--event-schema\t\tHow events are serialised: json (default), cloudevents or raw. Also set by RSSH_EVENT_SCHEMA")
+	fmt.Println("\t--otlp-endpoint\t\tExport OpenTelemetry spans for connection setup, channels, forwards, builds and DERP connections over OTLP/HTTP, e.g http://collector:4318. Also set by RSSH_OTLP_ENDPOINT")
+	fmt.Println("\t--otlp-sample\t\tFraction of traces exported, between 0 and 1 (default 1). Also set by RSSH_OTLP_SAMPLE")
+	fmt.Println("  Key escrow")
+	fmt.Println("\t--split-key		Split the server key into n shares, k of which are needed to start the server, e.g --split-key 3/5. Prints the shares, removes the plain key and exits")
+	fmt.Println("\t--key-shares		Comma separated files holding key shares to unlock an escrowed server key, any still needed are asked for on the console")
+	fmt.Println("  Legal hold")
+	fmt.Println("\t--legal-hold\t\tMake the audit logs (watch.log, access.log, console.log) write once, every write is hash chained and the logs are made append only where possible")
+	fmt.Println("\t--anchor-interval\tHow often, under legal hold, the audit log hashes are sent to webhooks and anchors.log (default 1h)")
+	fmt.Println("\t--verify-logs\t\tCheck the audit logs against their hash chains and exit")
 	fmt.Println("  Authorisation")
 	fmt.Println("\t--insecure\t\tIgnore authorized_controllee_keys file and allow any RSSH client to connect")
 	fmt.Println("\t--openproxy\t\tAllow any ssh client to do a dynamic remote forward (-R) and effectively allowing anyone to open a port on localhost on the server")
@@ -31,10 +66,43 @@ func printHelp() {
 	fmt.Println("\t--webserver\t\t(Depreciated) Enable webserver on the listen_address port")
 	fmt.Println("\t--enable-client-downloads\t\tEnable webserver and raw TCP to download clients")
 	fmt.Println("\t--ts\t\t\tForce TS relay transport bootstrap on startup")
+	fmt.Println("\t--derp-listen\t\tRun a DERP relay for the TS relay transport on this address, e.g :8443, instead of using tailscale's public relays. Also set by RSSH_DERP_LISTEN")
+	fmt.Println("\t--derp-address\t\tAddress clients reach the DERP relay on, defaults to the external address host with the --derp-listen port. Uses --tlscert and --tlskey if given, otherwise a self signed certificate")
+	fmt.Println("\t--derp-map-ttl\t\tHow long a fetched DERP map is used before fetching it again (default 24h). Maps are kept in <datadir>/derpmaps, and an out of date one is used if fetching fails. Also set by RSSH_DERP_MAP_TTL")
+	fmt.Println("\t--derp-home-regions\tHow many of the nearest DERP regions the TS relay transport stays connected to, clients fail over between them (default 3, at most 8). Also set by RSSH_DERP_HOME_REGIONS")
+	fmt.Println("\t--relay-peer-rate\tRelayed data each TS relay client may send a second before it is cut off and ignored for 10 minutes, e.g 64M (default 32M). Also set by RSSH_RELAY_PEER_RATE")
+	fmt.Println("\t--nat-idle-timeout\tClose TS relay sessions the client has sent nothing on for this long, e.g 10m (default never). Sessions on a direct path are not affected. Also set by RSSH_NAT_IDLE_TIMEOUT")
+	fmt.Println("\t--nat-keepalive\tSend on every TS relay session this often, so NATs and relays on the way keep it open, e.g 25s (default off). Also set by RSSH_NAT_KEEPALIVE")
+	fmt.Println("\t--relay-compression\tCompress TS relay data with snappy or zstd when the client has the codec and it helps (default none). Also set by RSSH_RELAY_COMPRESSION")
+	fmt.Println("\t--stun-servers\t\tComma separated host[:port] STUN servers the TS relay transport finds public addresses with, instead of the DERP map's. Put in client tokens too. Also set by RSSH_STUN_SERVERS")
+	fmt.Println("\t--legacy-toolchain\tGOROOT of the go toolchain used by link --legacy, e.g a go build patched to still run on Windows 7. Also set by RSSH_LEGACY_TOOLCHAIN")
+	fmt.Println("\t--unknown-path\t\tWhat the webserver answers for paths that are not download links: 404 (default), tarpit (a slow 404), or redirect:<url> to send them to a decoy. Also set by RSSH_UNKNOWN_PATH")
+	fmt.Println("\t--allow-clients\t\tComma separated networks (CIDRs) or addresses connections are accepted from, all others are dropped as they are accepted. Loopback is always accepted")
+	fmt.Println("\t--deny-clients\t\tComma separated networks (CIDRs) or addresses connections are dropped from as they are accepted, before anything is read from them")
+	fmt.Println("\t--download-rate\t\tDownloads each source address may make per minute (default unlimited)")
+	fmt.Println("\t--download-allow\tComma separated networks (CIDRs) or addresses that may download, all others are refused")
+	fmt.Println("\t--download-block-ua\tRefuse downloads from user agents matching this regex, on its own blocks common crawlers and scanners")
+	fmt.Println("\t--download-require-header\tRefuse downloads without this header, e.g --download-require-header X-Token:abc")
 	fmt.Println("\t--external_address\tIf the external IP and port of the RSSH server is different from the listening address, set that here")
+	fmt.Println("\t--research\t\tRecord the TLS (JA3/JA4), SSH (banner and hassh) and HTTP fingerprints of every connection to the listener, authenticated or not, in <datadir>/research.log")
+	fmt.Println("\t--asn-lookup\t\tResolve client source addresses to an ASN and country (via public DNS) when detecting clients moving networks")
 	fmt.Println("\t--timeout\t\tSet rssh client timeout (when a client is considered disconnected) defaults, in seconds, defaults to 5, if set to 0 timeout is disabled")
+	fmt.Println("\t--exit-duplicates\tTell the newer of two clients running on the same machine with the same key (e.g persistence that fired twice) to exit, otherwise they are only marked in ls")
+	fmt.Println("\t--reap-interval\t\tHow often forwards and channels nothing can use any more are closed, and stale listeners removed (default 1m). 0 turns it off")
+	fmt.Println("\t--listener-ttl\t\tRemove listeners saved for a client that has not connected for this long (default 720h). 0 keeps them forever")
+	fmt.Println("\t--idle-suspend\t\tPark connect sessions after no keystrokes or output for this long, e.g 30m, the operator's next key carries on with them (default never). Also set by RSSH_IDLE_SUSPEND")
+	fmt.Println("\t--keepalive-max\t\tLongest keepalive interval, in seconds, clients may negotiate if their NAT allows it (default 300). Set to the --timeout value to disable")
+	fmt.Println("\t--strict-crypto\t\tOnly use FIPS 140-3 approved ssh algorithms, refuses to start the ts relay. Run with GODEBUG=fips140=on to use the go FIPS module")
+	fmt.Println("  Admission control")
+	fmt.Println("\t--accept-queue\t\tMaximum connections waiting on protocol detection before new connections are dropped (default 1000)")
+	fmt.Println("\t--max-handshakes\tMaximum concurrent ssh handshakes (default unlimited)")
+	fmt.Println("\t--max-handshakes-per-source\tMaximum concurrent ssh handshakes from a single IP address (default unlimited)")
+	fmt.Println("\t--reserved-handshakes\tHandshake slots (out of --max-handshakes) kept for addresses that have authenticated in the last 24 hours (default 10%)")
+	fmt.Println("\t--handshake-timeout\tSeconds a connection has to finish authenticating before it is dropped (default unlimited)")
 	fmt.Println("  Utility")
 	fmt.Println("\t--fingerprint\t\tPrint fingerprint and exit. (Will generate server key if none exists)")
+	fmt.Println("\t--console-socket\tServe the console on a local socket (<datadir>/console/console.sock, or a named pipe on Windows) that only the server's user can open")
+	fmt.Println("\t--console\t\tOpen the console of the server running in --datadir with --console-socket, without going through the network. Arguments after it are run as a command instead, e.g --console ls")
 	fmt.Println("\t--log-level\t\tChange logging output levels (will set default log level for generated clients), [INFO,WARNING,ERROR,FATAL,DISABLED]")
 	fmt.Println("\t--console-label\t\tChange console label.  (Default: catcher)")
 
@@ -42,22 +110,66 @@ func printHelp() {
 
 func serverValidFlags() map[string]bool {
 	return map[string]bool{
-		"insecure":                true,
-		"tls":                     true,
-		"tlscert":                 true,
-		"tlskey":                  true,
-		"external_address":        true,
-		"fingerprint":             true,
-		"webserver":               true, // deprecated
-		"enable-client-downloads": true,
-		"ts":                      true,
-		"datadir":                 true,
-		"h":                       true,
-		"help":                    true,
-		"timeout":                 true,
-		"openproxy":               true,
-		"log-level":               true,
-		"console-label":           true,
+		"insecure":                  true,
+		"tls":                       true,
+		"tlscert":                   true,
+		"tlskey":                    true,
+		"external_address":          true,
+		"fingerprint":               true,
+		"console":                   true,
+		"console-socket":            true,
+		"webserver":                 true, // deprecated
+		"enable-client-downloads":   true,
+		"ts":                        true,
+		"asn-lookup":                true,
+		"research":                  true,
+		"datadir":                   true,
+		"h":                         true,
+		"help":                      true,
+		"timeout":                   true,
+		"openproxy":                 true,
+		"log-level":                 true,
+		"console-label":             true,
+		"keepalive-max":             true,
+		"exit-duplicates":           true,
+		"reap-interval":             true,
+		"listener-ttl":              true,
+		"idle-suspend":              true,
+		"accept-queue":              true,
+		"max-handshakes":            true,
+		"max-handshakes-per-source": true,
+		"reserved-handshakes":       true,
+		"handshake-timeout":         true,
+		"strict-crypto":             true,
+		"split-key":                 true,
+		"unknown-path":              true,
+		"download-rate":             true,
+		"download-allow":            true,
+		"download-block-ua":         true,
+		"allow-clients":             true,
+		"deny-clients":              true,
+		"download-require-header":   true,
+		"key-shares":                true,
+		"legal-hold":                true,
+		"anchor-interval":           true,
+		"verify-logs":               true,
+		"storage":                   true,
+		"storage-expire":            true,
+		"derp-listen":               true,
+		"derp-address":              true,
+		"legacy-toolchain":          true,
+		"stun-servers":              true,
+		"event-bus":                 true,
+		"event-topic":               true,
+		"event-schema":              true,
+		"otlp-endpoint":             true,
+		"otlp-sample":               true,
+		"derp-map-ttl":              true,
+		"derp-home-regions":         true,
+		"relay-peer-rate":           true,
+		"relay-compression":         true,
+		"nat-idle-timeout":          true,
+		"nat-keepalive":             true,
 	}
 }
 
@@ -130,9 +242,317 @@ func inferConnectBackAddress(listenAddress string) string {
 	return listenAddress
 }
 
+// nonNegativeIntFlag returns the value of a flag that must be a non-negative number, or 0 if it isnt set
+func nonNegativeIntFlag(options terminal.ParsedLine, name string) (int, error) {
+	value, err := options.GetArgString(name)
+	if err != nil {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("--%s must be a number 0 or above, got %q", name, value)
+	}
+
+	return n, nil
+}
+
+// configureStorage sets up object storage offloading from --storage, if it is given
+// configureTracing starts exporting spans if there is an otlp endpoint, the returned function flushes them
+func configureTracing(options terminal.ParsedLine) (func(context.Context) error, error) {
+	endpoint, err := options.GetArgString("otlp-endpoint")
+	if err != nil {
+		endpoint = os.Getenv("RSSH_OTLP_ENDPOINT")
+	}
+
+	sample, err := options.GetArgString("otlp-sample")
+	if err != nil {
+		sample = os.Getenv("RSSH_OTLP_SAMPLE")
+	}
+
+	if endpoint == "" {
+		if options.IsSet("otlp-sample") {
+			return nil, fmt.Errorf("--otlp-sample needs --otlp-endpoint")
+		}
+		return func(context.Context) error { return nil }, nil
+	}
+
+	ratio := 1.0
+	if sample != "" {
+		ratio, err = strconv.ParseFloat(sample, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("--otlp-sample must be between 0 and 1, got %q", sample)
+		}
+	}
+
+	stop, err := tracing.Start(context.Background(), endpoint, ratio)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Exporting traces to %s", endpoint)
+
+	return stop, nil
+}
+
+func configureEventBus(options terminal.ParsedLine) error {
+	uri, err := options.GetArgString("event-bus")
+	if err != nil {
+		uri = os.Getenv("RSSH_EVENT_BUS")
+	}
+
+	topic, err := options.GetArgString("event-topic")
+	if err != nil {
+		topic = os.Getenv("RSSH_EVENT_TOPIC")
+	}
+
+	schema, err := options.GetArgString("event-schema")
+	if err != nil {
+		schema = os.Getenv("RSSH_EVENT_SCHEMA")
+	}
+
+	if uri == "" {
+		if options.IsSet("event-topic") || options.IsSet("event-schema") {
+			return fmt.Errorf("--event-topic and --event-schema need --event-bus")
+		}
+		return nil
+	}
+
+	publisher, err := eventbus.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	return eventbus.Configure(publisher, topic, schema)
+}
+
+func configureStorage(options terminal.ParsedLine) error {
+	uri, err := options.GetArgString("storage")
+	if err != nil {
+		uri = os.Getenv("RSSH_STORAGE")
+	}
+
+	if uri == "" {
+		if options.IsSet("storage-expire") {
+			return fmt.Errorf("--storage-expire needs --storage")
+		}
+		return nil
+	}
+
+	backend, err := storage.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	days, err := nonNegativeIntFlag(options, "storage-expire")
+	if err != nil {
+		return err
+	}
+
+	if days > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := backend.SetExpiry(ctx, days); err != nil {
+			return fmt.Errorf("unable to set object expiry on %s: %w", backend, err)
+		}
+	}
+
+	storage.SetOffload(backend)
+	log.Printf("Offloading client builds to %s", backend)
+
+	return nil
+}
+
+// configureDERPRelay sets up the embedded DERP relay from --derp-listen, or from a socket passed in by systemd, if either is given
+func configureDERPRelay(options terminal.ParsedLine, listenAddress, connectBackAddress, tlscert, tlskey string, socket net.Listener) error {
+	listen, err := options.GetArgString("derp-listen")
+	if err != nil {
+		listen = os.Getenv("RSSH_DERP_LISTEN")
+	}
+	if socket != nil {
+		listen = socket.Addr().String()
+	}
+	if listen == "" {
+		return nil
+	}
+
+	if internal.StrictCrypto {
+		return errors.New("--derp-listen cannot be used with --strict-crypto, the ts relay transport uses non-approved cryptography")
+	}
+
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("--derp-listen %q is not host:port: %w", listen, err)
+	}
+
+	address, err := options.GetArgString("derp-address")
+	if err != nil {
+		if connectBackAddress == "" {
+			connectBackAddress = inferConnectBackAddress(listenAddress)
+		}
+
+		host, _, err := net.SplitHostPort(connectBackAddress)
+		if err != nil {
+			host = connectBackAddress
+		}
+		address = net.JoinHostPort(host, port)
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("--derp-address %q is not host:port: %w", address, err)
+	}
+
+	server.EnableDERPRelay(server.DERPRelayConfig{
+		Listen:      listen,
+		Listener:    socket,
+		Address:     address,
+		TLSCertPath: tlscert,
+		TLSKeyPath:  tlskey,
+	})
+
+	return nil
+}
+
+// auditLogs are the logs kept write once under --legal-hold
+func auditLogs(dataDir string) []string {
+	return []string{
+		filepath.Join(dataDir, "watch.log"),
+		filepath.Join(dataDir, "access.log"),
+		filepath.Join(dataDir, "anchors.log"),
+		filepath.Join(dataDir, "console.log"),
+	}
+}
+
+// verifyLogs checks every audit log against its chain, returning false if any has been changed
+func verifyLogs(dataDir string) bool {
+	ok := true
+	for _, path := range auditLogs(dataDir) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		head, err := audit.Verify(path)
+		if err != nil {
+			fmt.Printf("FAILED %s: %s\n", path, err)
+			ok = false
+			continue
+		}
+
+		fmt.Printf("OK     %s: %d bytes, sha256 %s\n", path, head.Offset, head.SHA256)
+	}
+
+	// The console log is chained line by line too, whether or not it was written under legal hold
+	consoleLog := filepath.Join(dataDir, "console.log")
+	if _, err := os.Stat(consoleLog); err == nil {
+		n, err := audit.VerifyConsoleLog(consoleLog)
+		if err != nil {
+			fmt.Printf("FAILED %s: %s\n", consoleLog, err)
+			return false
+		}
+		fmt.Printf("OK     %s: %d entries\n", consoleLog, n)
+	}
+
+	return ok
+}
+
+// splitKeyFlag parses --split-key k/n
+func splitKeyFlag(options terminal.ParsedLine) (threshold, count int, err error) {
+	value, err := options.GetArgString("split-key")
+	if err != nil {
+		return 0, 0, fmt.Errorf("--split-key needs k/n, e.g --split-key 3/5")
+	}
+
+	k, n, ok := strings.Cut(value, "/")
+	threshold, kErr := strconv.Atoi(k)
+	count, nErr := strconv.Atoi(n)
+	if !ok || kErr != nil || nErr != nil || threshold < 1 || threshold > count || count > 255 {
+		return 0, 0, fmt.Errorf("--split-key must be k/n where 1 <= k <= n <= 255, got %q", value)
+	}
+
+	if threshold == 1 {
+		log.Println("[WARNING] --split-key with k of 1 means any single share unlocks the server key")
+	}
+
+	return threshold, count, nil
+}
+
+func downloadFilterConfig(options terminal.ParsedLine) (f webserver.DownloadFilter, err error) {
+	if f.RatePerMinute, err = nonNegativeIntFlag(options, "download-rate"); err != nil {
+		return f, err
+	}
+
+	if allow, err := options.GetArgString("download-allow"); err == nil {
+		if f.Allow, err = webserver.ParseNetworks(allow); err != nil {
+			return f, fmt.Errorf("--download-allow: %w", err)
+		}
+	}
+
+	if options.IsSet("download-block-ua") {
+		pattern, err := options.GetArgString("download-block-ua")
+		if err != nil {
+			pattern = webserver.DefaultBotPattern
+		}
+
+		if f.BlockUserAgents, err = regexp.Compile(pattern); err != nil {
+			return f, fmt.Errorf("--download-block-ua is not a valid regex: %w", err)
+		}
+	}
+
+	if header, err := options.GetArgString("download-require-header"); err == nil {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return f, fmt.Errorf("--download-require-header must be Name:value, got %q", header)
+		}
+		f.RequireHeader, f.RequireHeaderValue = strings.TrimSpace(name), strings.TrimSpace(value)
+	}
+
+	return f, nil
+}
+
+func admissionConfig(options terminal.ParsedLine) (c server.AdmissionConfig, err error) {
+	if c.AcceptQueue, err = nonNegativeIntFlag(options, "accept-queue"); err != nil {
+		return c, err
+	}
+
+	if c.MaxHandshakes, err = nonNegativeIntFlag(options, "max-handshakes"); err != nil {
+		return c, err
+	}
+
+	if c.MaxHandshakesPerSource, err = nonNegativeIntFlag(options, "max-handshakes-per-source"); err != nil {
+		return c, err
+	}
+
+	c.ReservedHandshakes = c.MaxHandshakes / 10
+	if options.IsSet("reserved-handshakes") {
+		if c.ReservedHandshakes, err = nonNegativeIntFlag(options, "reserved-handshakes"); err != nil {
+			return c, err
+		}
+
+		if c.MaxHandshakes == 0 || c.ReservedHandshakes >= c.MaxHandshakes {
+			return c, fmt.Errorf("--reserved-handshakes must be less than --max-handshakes")
+		}
+	}
+
+	handshakeTimeout, err := nonNegativeIntFlag(options, "handshake-timeout")
+	if err != nil {
+		return c, err
+	}
+	c.HandshakeTimeout = time.Duration(handshakeTimeout) * time.Second
+
+	return c, nil
+}
+
 func main() {
 
-	options, err := terminal.ParseLineValidFlags(strings.Join(os.Args, " "), 0, serverValidFlags())
+	// Everything after --console is the command to run on the console, not server options
+	args, consoleCommand := os.Args, ""
+	for i, arg := range os.Args {
+		if arg == "--console" {
+			args, consoleCommand = os.Args[:i+1], strings.Join(os.Args[i+1:], " ")
+			break
+		}
+	}
+
+	options, err := terminal.ParseLineValidFlags(strings.Join(args, " "), 0, serverValidFlags())
 
 	if err != nil {
 		fmt.Println(err)
@@ -185,23 +605,115 @@ func main() {
 		logger.SetLogLevel(urg)
 	}
 
+	if options.IsSet("verify-logs") {
+		if !verifyLogs(dataDir) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	privateKeyPath := filepath.Join(dataDir, "id_ed25519")
+
 	if options.IsSet("fingerprint") {
-		private, err := server.CreateOrLoadServerKeys(filepath.Join(dataDir, "id_ed25519"))
+		// Works without unlocking an escrowed key
+		publicKey, err := hostkey.PublicKey(privateKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(internal.FingerprintSHA256Hex(publicKey))
+		return
+	}
+
+	if options.IsSet("console") {
+		// The public key is readable without unlocking an escrowed key
+		publicKey, err := hostkey.PublicKey(privateKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		code, err := server.AttachConsole(dataDir, publicKey, consoleCommand)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(code)
+	}
+
+	var shareFiles []string
+	if shares, err := options.GetArgString("key-shares"); err == nil {
+		for _, path := range strings.Split(shares, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				shareFiles = append(shareFiles, path)
+			}
+		}
+	}
+
+	if options.IsSet("split-key") {
+		threshold, count, err := splitKeyFlag(options)
+		if err != nil {
+			fmt.Println(err)
+			printHelp()
+			return
+		}
+
+		// Splitting again (e.g to change k or n, or replace a lost share) needs the key unlocked first
+		if hostkey.Escrowed(privateKeyPath) {
+			if _, err := hostkey.Load(privateKeyPath, shareFiles, true); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		shares, err := hostkey.Split(privateKeyPath, threshold, count)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		fmt.Println(internal.FingerprintSHA256Hex(private.PublicKey()))
+		fmt.Printf("Server key escrowed to %s, %d of these %d shares are needed to start the server.\n", hostkey.EscrowPath(privateKeyPath), threshold, count)
+		fmt.Println("Give each to a different operator, they are not stored anywhere else. Any older shares no longer work.")
+		for _, share := range shares {
+			fmt.Println(share)
+		}
 		return
 	}
 
-	if len(options.Arguments) < 1 {
+	if hostkey.Escrowed(privateKeyPath) {
+		if _, err := hostkey.Load(privateKeyPath, shareFiles, true); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sockets, err := systemd.Sockets()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Sockets named derp (FileDescriptorName=derp) are for the DERP relay, the rest are listened on like the listen address
+	var activated []net.Listener
+	var derpSocket net.Listener
+	for _, socket := range sockets {
+		if socket.Name == "derp" {
+			derpSocket = socket.Listener
+			continue
+		}
+		activated = append(activated, socket.Listener)
+	}
+	server.SetActivatedListeners(activated)
+
+	if len(options.Arguments) < 1 && len(activated) == 0 {
 		fmt.Println("Missing listening address")
 		printHelp()
 		return
 	}
 
-	listenAddress := options.Arguments[len(options.Arguments)-1].Value()
+	var listenAddress string
+	if len(activated) > 0 {
+		listenAddress = activated[0].Addr().String()
+		if len(options.Arguments) > 0 {
+			log.Printf("Listening on %s passed by systemd instead of %s", listenAddress, options.Arguments[len(options.Arguments)-1].Value())
+		}
+	} else {
+		listenAddress = options.Arguments[len(options.Arguments)-1].Value()
+	}
 
 	var timeout int = 5
 	if timeoutString, err := options.GetArgString("timeout"); err == nil {
@@ -223,6 +735,23 @@ func main() {
 		}
 	}
 
+	admission, err := admissionConfig(options)
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+
+	keepaliveMax := 300
+	if options.IsSet("keepalive-max") {
+		keepaliveMax, err = nonNegativeIntFlag(options, "keepalive-max")
+		if err != nil {
+			fmt.Println(err)
+			printHelp()
+			return
+		}
+	}
+
 	insecure := options.IsSet("insecure")
 	openproxy := options.IsSet("openproxy")
 
@@ -241,12 +770,90 @@ func main() {
 	tlskey, _ := options.GetArgString("tlskey")
 
 	enabledDownloads := options.IsSet("webserver") || options.IsSet("enable-client-downloads")
+
+	unknownPath, err := options.GetArgString("unknown-path")
+	if err != nil {
+		unknownPath = os.Getenv("RSSH_UNKNOWN_PATH")
+	}
+
+	unknownPathPolicy, err := webserver.ParseUnknownPathPolicy(unknownPath)
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+	webserver.SetUnknownPathPolicy(unknownPathPolicy)
+
+	if err := configureStorage(options); err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+
+	if err := configureEventBus(options); err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+
+	stopTracing, err := configureTracing(options)
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := stopTracing(ctx); err != nil {
+			log.Println("unable to flush spans:", err)
+		}
+	}()
+
+	downloadFilter, err := downloadFilterConfig(options)
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+	webserver.SetDownloadFilter(downloadFilter)
+
+	allowClients, _ := options.GetArgString("allow-clients")
+	denyClients, _ := options.GetArgString("deny-clients")
+	if err := sourcefilter.SetFixed(strings.Split(allowClients, ","), strings.Split(denyClients, ",")); err != nil {
+		fmt.Println("--allow-clients/--deny-clients:", err)
+		printHelp()
+		return
+	}
+
+	legacyToolchain, err := options.GetArgString("legacy-toolchain")
+	if err != nil {
+		legacyToolchain = os.Getenv("RSSH_LEGACY_TOOLCHAIN")
+	}
+	if err := webserver.SetLegacyToolchain(legacyToolchain); err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
 	forceTSRelay := options.IsSet("ts")
+	lookupASN := options.IsSet("asn-lookup")
 
 	if options.IsSet("webserver") {
 		log.Println("[WARNING] --webserver is deprecated, use --enable-client-downloads")
 	}
 
+	internal.StrictCrypto = options.IsSet("strict-crypto")
+	if internal.StrictCrypto {
+		if forceTSRelay {
+			log.Fatal("--ts cannot be used with --strict-crypto, the ts relay transport uses non-approved cryptography")
+		}
+
+		if !internal.FIPSModuleEnabled() {
+			log.Println("[WARNING] --strict-crypto is set but the go cryptography module is not in FIPS mode, set GODEBUG=fips140=on")
+		}
+	}
+
 	connectBackAddress, err := options.GetArgString("external_address")
 
 	autogeneratedConnectBack := false
@@ -257,5 +864,169 @@ func main() {
 
 	log.Println("connect back: ", connectBackAddress)
 
-	server.Run(listenAddress, dataDir, connectBackAddress, autogeneratedConnectBack, tlscert, tlskey, insecure, enabledDownloads, tls, openproxy, forceTSRelay, timeout)
+	if err := configureDERPRelay(options, listenAddress, connectBackAddress, tlscert, tlskey, derpSocket); err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+
+	stunList, err := options.GetArgString("stun-servers")
+	if err != nil {
+		stunList = os.Getenv("RSSH_STUN_SERVERS")
+	}
+	stunServers, err := nat.ParseSTUNServers(stunList)
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+	server.SetSTUNServers(stunServers)
+
+	derpMapTTL := nat.DefaultDERPMapTTL
+	ttl, err := options.GetArgString("derp-map-ttl")
+	if err != nil {
+		ttl = os.Getenv("RSSH_DERP_MAP_TTL")
+	}
+	if ttl != "" {
+		derpMapTTL, err = time.ParseDuration(ttl)
+		if err != nil || derpMapTTL <= 0 {
+			fmt.Printf("--derp-map-ttl must be a positive duration, e.g 12h, got %q\n", ttl)
+			printHelp()
+			return
+		}
+	}
+	nat.SetDERPMapCache(filepath.Join(dataDir, "derpmaps"), derpMapTTL)
+
+	homeRegions, err := options.GetArgString("derp-home-regions")
+	if err != nil {
+		homeRegions = os.Getenv("RSSH_DERP_HOME_REGIONS")
+	}
+	if homeRegions != "" {
+		regions, err := strconv.Atoi(homeRegions)
+		if err != nil || regions < 1 || regions > nat.MaxDERPHomeRegions {
+			fmt.Printf("--derp-home-regions must be between 1 and %d, got %q\n", nat.MaxDERPHomeRegions, homeRegions)
+			printHelp()
+			return
+		}
+		server.SetDERPHomeRegions(regions)
+	}
+
+	peerRate, err := options.GetArgString("relay-peer-rate")
+	if err != nil {
+		peerRate = os.Getenv("RSSH_RELAY_PEER_RATE")
+	}
+	if peerRate != "" {
+		bytesPerSecond, err := webserver.ParseSizeBudget(peerRate)
+		if err != nil || bytesPerSecond > math.MaxInt32 {
+			fmt.Printf("--relay-peer-rate must be a size a second, e.g 64M, got %q\n", peerRate)
+			printHelp()
+			return
+		}
+		server.SetRelayPeerRate(int(bytesPerSecond))
+	}
+
+	compression, err := options.GetArgString("relay-compression")
+	if err != nil {
+		compression = os.Getenv("RSSH_RELAY_COMPRESSION")
+	}
+	if err := nat.ValidateRelayCompression(compression); err != nil {
+		fmt.Println(err)
+		printHelp()
+		return
+	}
+	server.SetRelayCompression(compression)
+
+	var relayIdleTimeout time.Duration
+	idleTimeout, err := options.GetArgString("nat-idle-timeout")
+	if err != nil {
+		idleTimeout = os.Getenv("RSSH_NAT_IDLE_TIMEOUT")
+	}
+	if idleTimeout != "" {
+		relayIdleTimeout, err = time.ParseDuration(idleTimeout)
+		if err != nil || relayIdleTimeout <= 0 {
+			fmt.Printf("--nat-idle-timeout must be a positive duration, e.g 10m, got %q\n", idleTimeout)
+			printHelp()
+			return
+		}
+	}
+
+	var relayKeepalive time.Duration
+	keepalive, err := options.GetArgString("nat-keepalive")
+	if err != nil {
+		keepalive = os.Getenv("RSSH_NAT_KEEPALIVE")
+	}
+	if keepalive != "" {
+		relayKeepalive, err = time.ParseDuration(keepalive)
+		if err != nil || relayKeepalive <= 0 {
+			fmt.Printf("--nat-keepalive must be a positive duration, e.g 25s, got %q\n", keepalive)
+			printHelp()
+			return
+		}
+	}
+	server.SetRelaySessionTimers(relayIdleTimeout, relayKeepalive)
+	server.SetExitDuplicates(options.IsSet("exit-duplicates"))
+
+	server.SetConsoleSocket(options.IsSet("console-socket"))
+
+	if interval, err := options.GetArgString("reap-interval"); err == nil {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 0 {
+			fmt.Printf("--reap-interval must be a duration, e.g 5m, or 0 to turn it off, got %q\n", interval)
+			printHelp()
+			return
+		}
+		server.SetReapInterval(d)
+	}
+
+	if ttl, err := options.GetArgString("listener-ttl"); err == nil {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 0 {
+			fmt.Printf("--listener-ttl must be a duration, e.g 168h, or 0 to keep listeners forever, got %q\n", ttl)
+			printHelp()
+			return
+		}
+		reaper.SetListenerTTL(d)
+	}
+
+	idleSuspend, err := options.GetArgString("idle-suspend")
+	if err != nil {
+		idleSuspend = os.Getenv("RSSH_IDLE_SUSPEND")
+	}
+	if idleSuspend != "" {
+		d, err := time.ParseDuration(idleSuspend)
+		if err != nil || d < 0 {
+			fmt.Printf("--idle-suspend must be a duration, e.g 30m, or 0 to never suspend shells, got %q\n", idleSuspend)
+			printHelp()
+			return
+		}
+		suspend.SetAfter(d)
+	}
+
+	if options.IsSet("research") {
+		research.Enable(filepath.Join(dataDir, "research.log"))
+		log.Println("Research mode: recording how every connection to the listener introduces itself to research.log")
+	}
+
+	if options.IsSet("legal-hold") {
+		if interval, err := options.GetArgString("anchor-interval"); err == nil {
+			d, err := time.ParseDuration(interval)
+			if err != nil || d <= 0 {
+				fmt.Printf("--anchor-interval must be a positive duration, e.g 1h, got %q\n", interval)
+				printHelp()
+				return
+			}
+			audit.SetAnchorInterval(d)
+		}
+
+		if err := audit.EnableLegalHold(auditLogs(dataDir)...); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Legal hold: audit logs are write once and hash chained")
+	}
+
+	// Shut down cleanly on ctrl+c or when stopped by a service manager
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server.Run(ctx, listenAddress, dataDir, connectBackAddress, autogeneratedConnectBack, tlscert, tlskey, insecure, enabledDownloads, tls, openproxy, forceTSRelay, lookupASN, timeout, keepaliveMax, admission)
 }
@@ -0,0 +1,100 @@
+// Package chaos injects transport failures, so reconnection, relay resumption and keepalive handling can be tested.
+// It only does anything in builds with the rssh_chaos tag, which read the faults to inject from RSSH_CHAOS, e.g
+//
+//	RSSH_CHAOS=derp-disconnect=0.01,signal-delay=1:250ms,keepalive-drop=0.2,listener-stall=0.1:3s,seed=42
+//
+// Each fault is name=probability[:duration]. The probability is checked every time the fault could happen,
+// and with a seed the same sequence of events fails the same way every run
+package chaos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Fault string
+
+const (
+	// Drop a DERP relay connection, checked for every frame read from the relay
+	DERPDisconnect Fault = "derp-disconnect"
+	// Hold ts relay signal frames (handshakes, data and acks) for the duration before sending them
+	SignalDelay Fault = "signal-delay"
+	// Skip sending a keepalive to a client
+	KeepaliveDrop Fault = "keepalive-drop"
+	// Stop accepting ssh connections for the duration, checked for every connection accepted
+	ListenerStall Fault = "listener-stall"
+)
+
+// Tag is the build tag that turns fault injection on. Servers built with it add it to the clients they build
+const Tag = "rssh_chaos"
+
+var faults = map[Fault]bool{
+	DERPDisconnect: true,
+	SignalDelay:    true,
+	KeepaliveDrop:  true,
+	ListenerStall:  true,
+}
+
+type rule struct {
+	probability float64
+	duration    time.Duration
+}
+
+type config struct {
+	rules map[Fault]rule
+	seed  int64
+}
+
+func parse(value string) (c config, err error) {
+	c.rules = map[Fault]rule{}
+	c.seed = time.Now().UnixNano()
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, setting, ok := strings.Cut(part, "=")
+		if !ok {
+			return c, fmt.Errorf("chaos setting %q is not name=value", part)
+		}
+
+		if name == "seed" {
+			c.seed, err = strconv.ParseInt(setting, 10, 64)
+			if err != nil {
+				return c, fmt.Errorf("chaos seed %q is not a number", setting)
+			}
+			continue
+		}
+
+		if !faults[Fault(name)] {
+			return c, fmt.Errorf("unknown chaos fault %q", name)
+		}
+
+		probability, duration, hasDuration := strings.Cut(setting, ":")
+
+		var r rule
+		r.probability, err = strconv.ParseFloat(probability, 64)
+		if err != nil || r.probability < 0 || r.probability > 1 {
+			return c, fmt.Errorf("chaos fault %s probability must be between 0 and 1, got %q", name, probability)
+		}
+
+		if hasDuration {
+			r.duration, err = time.ParseDuration(duration)
+			if err != nil || r.duration < 0 {
+				return c, fmt.Errorf("chaos fault %s duration %q is not valid", name, duration)
+			}
+		}
+
+		if (Fault(name) == SignalDelay || Fault(name) == ListenerStall) && r.duration == 0 {
+			return c, fmt.Errorf("chaos fault %s needs a duration, e.g %s=1:500ms", name, name)
+		}
+
+		c.rules[Fault(name)] = r
+	}
+
+	return c, nil
+}
@@ -0,0 +1,27 @@
+package chaos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c, err := parse("derp-disconnect=0.05, signal-delay=1:250ms,seed=42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.seed != 42 || c.rules[DERPDisconnect].probability != 0.05 || c.rules[SignalDelay].duration != 250*time.Millisecond {
+		t.Fatalf("parsed as %+v", c)
+	}
+
+	if c, err := parse(""); err != nil || len(c.rules) != 0 {
+		t.Fatalf("empty config gave %+v %v", c, err)
+	}
+
+	for _, bad := range []string{"derp-disconnect=2", "listener-stall=0.5", "keepalive-drop", "packet-loss=0.1", "seed=x"} {
+		if _, err := parse(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
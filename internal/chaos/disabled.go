@@ -0,0 +1,13 @@
+//go:build !rssh_chaos
+
+package chaos
+
+const Enabled = false
+
+// Fail reports whether f should happen now, never without the rssh_chaos tag
+func Fail(f Fault) bool {
+	return false
+}
+
+// Delay sleeps for f's duration if it should happen now, never without the rssh_chaos tag
+func Delay(f Fault) {}
@@ -0,0 +1,62 @@
+//go:build rssh_chaos
+
+package chaos
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const Enabled = true
+
+var (
+	lck    sync.Mutex
+	random *rand.Rand
+	rules  map[Fault]rule
+)
+
+func init() {
+	c, err := parse(os.Getenv("RSSH_CHAOS"))
+	if err != nil {
+		log.Fatalf("RSSH_CHAOS: %s", err)
+	}
+
+	random = rand.New(rand.NewSource(c.seed))
+	rules = c.rules
+
+	if len(rules) > 0 {
+		log.Printf("chaos: injecting %q with seed %d", os.Getenv("RSSH_CHAOS"), c.seed)
+	}
+}
+
+func roll(f Fault) (rule, bool) {
+	r, ok := rules[f]
+	if !ok {
+		return r, false
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	return r, random.Float64() < r.probability
+}
+
+// Fail reports whether f should happen now
+func Fail(f Fault) bool {
+	_, hit := roll(f)
+	if hit {
+		log.Printf("chaos: %s", f)
+	}
+	return hit
+}
+
+// Delay sleeps for f's duration if it should happen now
+func Delay(f Fault) {
+	if r, hit := roll(f); hit {
+		log.Printf("chaos: %s for %s", f, r.duration)
+		time.Sleep(r.duration)
+	}
+}
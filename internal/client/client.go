@@ -3,8 +3,10 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,14 +18,21 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/clock"
 	"github.com/NHAS/reverse_ssh/internal/client/connection"
 	"github.com/NHAS/reverse_ssh/internal/client/handlers"
 	"github.com/NHAS/reverse_ssh/internal/client/keys"
+	"github.com/NHAS/reverse_ssh/internal/client/mesh"
+	"github.com/NHAS/reverse_ssh/internal/client/qos"
 	"github.com/NHAS/reverse_ssh/internal/nat"
+	"github.com/NHAS/reverse_ssh/internal/resumable"
+	"github.com/NHAS/reverse_ssh/internal/secure"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/namedpipe"
 	"github.com/bodgit/ntlmssp"
 	"golang.org/x/crypto/ssh"
 	socks "golang.org/x/net/proxy"
@@ -83,7 +92,13 @@ func GetProxyDetails(proxy string) (string, error) {
 			proxyURL.Host += ":80"
 		}
 	}
-	return proxyURL.Scheme + "://" + proxyURL.Host, nil
+	// Kept for proxies that take basic (or socks5) authentication
+	userinfo := ""
+	if proxyURL.User != nil {
+		userinfo = proxyURL.User.String() + "@"
+	}
+
+	return proxyURL.Scheme + "://" + userinfo + proxyURL.Host, nil
 }
 
 func ScanRequest(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -105,8 +120,8 @@ func ScanRequest(data []byte, atEOF bool) (advance int, token []byte, err error)
 func Connect(addr, proxy string, timeout time.Duration, hostKerberos bool, staticNTLMCreds *ntlmssp.Client) (conn net.Conn, err error) {
 
 	if len(proxy) != 0 {
-		log.Println("Setting HTTP proxy address as: ", proxy)
 		proxyURL, _ := url.Parse(proxy) // Already parsed
+		log.Println("Setting HTTP proxy address as: ", proxyURL.Redacted())
 
 		if proxyURL.Scheme == "http" || proxyURL.Scheme == "https" {
 
@@ -132,11 +147,21 @@ func Connect(addr, proxy string, timeout time.Duration, hostKerberos bool, stati
 				tcpC.SetKeepAlivePeriod(2 * time.Hour)
 			}
 
-			// First attempt without auth
+			// A proxy that never answers the CONNECT would otherwise hang the client
+			if timeout > 0 {
+				proxyCon.SetDeadline(time.Now().Add(timeout))
+			}
+
+			// First attempt without auth, unless the proxy url has credentials for basic auth
 			req := []string{
 				fmt.Sprintf("CONNECT %s HTTP/1.1", addr),
 				fmt.Sprintf("Host: %s", addr),
 			}
+			if proxyURL.User != nil {
+				password, _ := proxyURL.User.Password()
+				credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+				req = append(req, fmt.Sprintf("Proxy-Authorization: Basic %s", credentials))
+			}
 
 			err = WriteHTTPReq(req, proxyCon)
 			if err != nil {
@@ -253,10 +278,18 @@ func Connect(addr, proxy string, timeout time.Duration, hostKerberos bool, stati
 
 			log.Println("Proxy accepted CONNECT request, connection set up!")
 
+			proxyCon.SetDeadline(time.Time{})
+
 			return proxyCon, nil
 		}
 		if proxyURL.Scheme == "socks" || proxyURL.Scheme == "socks5" {
-			dial, err := socks.SOCKS5("tcp", proxyURL.Host, nil, nil)
+			var auth *socks.Auth
+			if proxyURL.User != nil {
+				password, _ := proxyURL.User.Password()
+				auth = &socks.Auth{User: proxyURL.User.Username(), Password: password}
+			}
+
+			dial, err := socks.SOCKS5("tcp", proxyURL.Host, auth, &net.Dialer{Timeout: timeout})
 			if err != nil {
 				return nil, fmt.Errorf("reading from socks failed: %s", err)
 			}
@@ -283,6 +316,32 @@ func Connect(addr, proxy string, timeout time.Duration, hostKerberos bool, stati
 	return
 }
 
+// proxyDialer sends the ts relay transport's DERP connections through the proxy the other transports use
+func proxyDialer(settings *Settings) nat.Dialer {
+	proxy, hostKerberos, ntlm := settings.ProxyAddr, settings.ProxyUseHostKerberos, settings.ntlm
+	connectTimeout := settings.ConnectTimeout
+
+	// Connect does not take a context, so the proxy gets until ctx's deadline
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		timeout := connectTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+
+		conn, err := Connect(address, proxy, timeout, hostKerberos, ntlm)
+		if err != nil {
+			return nil, err
+		}
+
+		if ctx.Err() != nil {
+			conn.Close()
+			return nil, ctx.Err()
+		}
+
+		return conn, nil
+	}
+}
+
 func getCaseInsensitiveEnv(envs ...string) (ret []string) {
 
 	lower := map[string]bool{}
@@ -313,7 +372,64 @@ type Settings struct {
 
 	ConnectTimeout time.Duration
 
-	ntlm *ntlmssp.Client
+	// Optional second server to stay connected to at the same time as Addr, so losing one server doesnt lose the client.
+	// Everything other than the address, fingerprint and key is shared with the primary
+	SecondaryAddr        string
+	SecondaryFingerprint string
+	SecondaryPrivateKey  ssh.Signer
+
+	// Other ways to reach the same server, in order of preference. The client moves down the list when Addr cant be reached or its link stays poor,
+	// and back once a more preferred one answers again, see transport.go
+	Fallbacks []string
+
+	// When the server cant be reached, try connecting back through another client relaying for us (see mesh on the server).
+	// MeshPeers are tried first, then relays found with mDNS
+	Mesh      bool
+	MeshPeers []string
+
+	// Only negotiate FIPS 140-3 approved algorithms, and refuse the ts relay transport
+	StrictCrypto bool
+
+	// SHA256 hex fingerprint of the key that signed the client binary, the binary is checked against it when set, see integrity.go
+	IntegrityKey string
+
+	// DERP map baked in by link --derp-map, used by the ts relay transport instead of fetching one. See nat.EncodeEmbeddedDERPMap
+	DERPMap string
+
+	// Base64 ssh certificate for the embedded key, minted by link --cert. It is only offered with the embedded key
+	Certificate string
+
+	ntlm      *ntlmssp.Client
+	ntlmCreds string
+
+	// Overrides the embedded private key when set
+	privateKey ssh.Signer
+}
+
+const (
+	linkPrimary   = "primary"
+	linkSecondary = "secondary"
+)
+
+// secondary creates the settings for the secondary link, it needs its own ntlm client as the negotiation state isnt shareable
+func (s *Settings) secondary() (*Settings, error) {
+	secondary := *s
+	secondary.Addr = s.SecondaryAddr
+	secondary.Fingerprint = s.SecondaryFingerprint
+	secondary.privateKey = s.SecondaryPrivateKey
+
+	secondary.SecondaryAddr = ""
+	secondary.Fallbacks = nil
+	secondary.SecondaryFingerprint = ""
+	secondary.SecondaryPrivateKey = nil
+
+	if s.ntlmCreds != "" {
+		if err := secondary.SetNTLMProxyCreds(s.ntlmCreds); err != nil {
+			return nil, err
+		}
+	}
+
+	return &secondary, nil
 }
 
 func (s *Settings) SetNTLMProxyCreds(creds string) error {
@@ -330,20 +446,107 @@ func (s *Settings) SetNTLMProxyCreds(creds string) error {
 
 	if err != nil {
 		s.ntlm = nil
+		return err
+	}
+
+	s.ntlmCreds = creds
+
+	return nil
+}
+
+// connectContext bounds connecting to the server by the connect timeout, 0 leaves it to the transport
+func connectContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Server connections currently up, see Connected
+var connectedLinks atomic.Int32
 
-	return err
+// Connected is whether the client has a connection to at least one server
+func Connected() bool {
+	return connectedLinks.Load() > 0
+}
+
+// retryAfter waits before the next connection attempt, false if the client is stopping instead
+func retryAfter(ctx context.Context) bool {
+	select {
+	case <-time.After(10 * time.Second):
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 func Run(settings *Settings) {
+	RunContext(context.Background(), settings)
+}
 
-	sshPriv, sysinfoError := keys.GetPrivateKey()
-	if sysinfoError != nil {
-		log.Fatal("Getting private key failed: ", sysinfoError)
+// RunContext is Run, but disconnects and returns when ctx is done, for when the client is embedded in something else
+func RunContext(ctx context.Context, settings *Settings) {
+	startIntegrityChecks(settings.IntegrityKey)
+
+	if settings.DERPMap != "" {
+		if err := nat.SetEmbeddedDERPMap(settings.DERPMap); err != nil {
+			log.Println("Ignoring embedded derp map: ", err)
+		}
+	}
+
+	if settings.SecondaryAddr == "" {
+		runLink(ctx, settings, "")
+		return
+	}
+
+	secondary, err := settings.secondary()
+	if err != nil {
+		log.Fatal("Unable to create secondary server settings: ", err)
 	}
 
+	if _, scheme := determineConnectionType(secondary.Addr); scheme == "stdio" {
+		log.Fatal("The secondary server cannot use the stdio transport")
+	}
+
+	go runLink(ctx, secondary, linkSecondary)
+	runLink(ctx, settings, linkPrimary)
+}
+
+// authSigners is what to offer the server, the certificate signer then the plain key it is for
+func authSigners(preferred, key ssh.Signer) []ssh.Signer {
+	if preferred == key {
+		return []ssh.Signer{key}
+	}
+	return []ssh.Signer{preferred, key}
+}
+
+// runLink keeps a connection to a single server alive, role is reported to the server so it can show which link of a multi-homed client it has
+func runLink(ctx context.Context, settings *Settings, role string) {
+
 	l := logger.NewLog("client")
 
+	sshPriv := settings.privateKey
+	// What we log in with, the certificate for the embedded key first if there is one, so a server that has the key itself still lets us in
+	// once it expires. Our own jump server always uses the plain key
+	authSigner := sshPriv
+	if sshPriv == nil {
+		var err error
+		sshPriv, err = keys.GetPrivateKey()
+		if err != nil {
+			log.Fatal("Getting private key failed: ", err)
+		}
+
+		authSigner = sshPriv
+		if settings.Certificate != "" {
+			certSigner, err := keys.CertificateSigner(sshPriv, settings.Certificate)
+			if err != nil {
+				l.Warning("Not using the embedded certificate: %s", err)
+			} else {
+				authSigner = certSigner
+			}
+		}
+	}
+
 	var err error
 	settings.ProxyAddr, err = GetProxyDetails(settings.ProxyAddr)
 	if err != nil {
@@ -365,22 +568,27 @@ func Run(settings *Settings) {
 		l.Warning("Couldnt get host name: %s", sysinfoError)
 	}
 
+	// Key of the server we are connected to, signs the relay maps it pushes
+	var serverKey ssh.PublicKey
+
 	config := &ssh.ClientConfig{
 		Timeout: settings.ConnectTimeout,
 		User:    fmt.Sprintf("%s.%s", username, hostname),
 		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(sshPriv),
+			ssh.PublicKeys(authSigners(authSigner, sshPriv)...),
 		},
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 			if settings.Fingerprint == "" { // If a server key isnt supplied, fail open. Potentially should change this for more paranoid people
 				l.Warning("No server key specified, allowing connection to %s", settings.Addr)
+				serverKey = key
 				return nil
 			}
 
-			if internal.FingerprintSHA256Hex(key) != settings.Fingerprint {
+			if !secure.EqualString(internal.FingerprintSHA256Hex(key), settings.Fingerprint) {
 				return fmt.Errorf("server public key invalid, expected: %s, got: %s", settings.Fingerprint, internal.FingerprintSHA256Hex(key))
 			}
 
+			serverKey = key
 			return nil
 		},
 		ClientVersion: "SSH-" + internal.Version + "-" + runtime.GOOS + "_" + runtime.GOARCH,
@@ -390,66 +598,154 @@ func Run(settings *Settings) {
 		config.ClientVersion = "SSH-" + settings.VersionString
 	}
 
-	realAddr, scheme := determineConnectionType(settings.Addr)
-	if scheme == nat.Scheme {
-		if _, err := nat.ParseDestination(settings.Addr); err != nil {
-			log.Fatalf("Invalid TS destination %q: %v", settings.Addr, err)
+	transports := newTransportSelector(settings.Addr, settings.Fallbacks)
+	for _, destination := range transports.destinations {
+		_, scheme := determineConnectionType(destination)
+		if scheme == "stdio" && len(transports.destinations) > 1 {
+			log.Fatalf("Cannot use %q with fallbacks, the stdio transport cannot be moved from", destination)
+		}
+
+		if scheme == nat.Scheme {
+			if settings.StrictCrypto {
+				log.Fatalf("Cannot connect to %q with strict crypto, the ts relay transport uses non-approved cryptography", destination)
+			}
+
+			if _, err := nat.ParseDestination(destination); err != nil {
+				log.Fatalf("Invalid TS destination %q: %v", destination, err)
+			}
 		}
 	}
 
+	if settings.StrictCrypto {
+		if err := internal.CheckStrictKey(sshPriv.PublicKey()); err != nil {
+			log.Fatalf("Private key cannot be used with strict crypto: %s", err)
+		}
+
+		if !internal.FIPSModuleEnabled() {
+			l.Warning("Strict crypto is set but the go cryptography module is not in FIPS mode")
+		}
+
+		internal.RestrictAlgorithms(&config.Config)
+		config.HostKeyAlgorithms = internal.StrictKeyAlgorithms()
+	}
+
 	// fetch the environment variables, but the first proxy is done from the supplied proxyAddr arg
+	// Kept across reconnects so we remember what the network path allows
+	keepalives := &keepaliveProber{}
+
 	potentialProxies := getCaseInsensitiveEnv("http_proxy", "https_proxy")
 	triedProxyIndex := 0
 	initialProxyAddr := settings.ProxyAddr
-	for {
+
+	// nextEnvProxy moves on to the next proxy from the environment after a failed connection, it is false when there are none
+	nextEnvProxy := func() bool {
+		if len(potentialProxies) == 0 {
+			return false
+		}
+
+		if len(potentialProxies) <= triedProxyIndex {
+			log.Printf("Unable to connect via proxies (from env), retrying with proxy as %q: %v", potentialProxies, initialProxyAddr)
+			triedProxyIndex = 0
+			settings.ProxyAddr = initialProxyAddr
+			return true
+		}
+		proxy := potentialProxies[triedProxyIndex]
+		triedProxyIndex++
+
+		log.Println("Trying to proxy via env variable (", proxy, ")")
+
+		var err error
+		settings.ProxyAddr, err = GetProxyDetails(proxy)
+		if err != nil {
+			log.Println("Could not parse the env proxy value: ", proxy)
+		}
+		// dont wait 10 seconds, just immediately try each proxy
+		return true
+	}
+
+	for ctx.Err() == nil {
+		addr := transports.addr()
+		realAddr, scheme := determineConnectionType(addr)
+
 		var conn net.Conn
+		// Set when connected through a peer, relays hand connections to the server as they are so no transport is layered on top
+		viaPeer := false
 		if scheme == nat.Scheme {
-			log.Println("Connecting to", settings.Addr)
-			conn, err = nat.Dial(settings.Addr, settings.ConnectTimeout)
+			log.Println("Connecting to", addr)
+			dialCtx, cancel := connectContext(ctx, settings.ConnectTimeout)
+			if settings.ProxyAddr != "" {
+				dialCtx = nat.WithDialer(dialCtx, proxyDialer(settings))
+			}
+			conn, err = nat.DialContext(dialCtx, addr)
+			cancel()
+			if errors.Is(err, nat.ErrTokenExpired) {
+				log.Printf("Not connecting to %s again: %v\n", addr, err)
+				if !transports.drop() {
+					return
+				}
+				continue
+			}
 			if err != nil {
 				log.Printf("Unable to connect TS relay: %v\n", err)
-				time.Sleep(10 * time.Second)
+				if nextEnvProxy() {
+					continue
+				}
+				if !transports.failed(ctx) {
+					return
+				}
+				continue
+			}
+		} else if scheme == "smb" {
+			log.Println("Connecting to", addr)
+			conn, err = namedpipe.Dial(realAddr, settings.ConnectTimeout)
+			if err != nil {
+				log.Printf("Unable to connect to relay pipe: %v\n", err)
+				if !transports.failed(ctx) {
+					return
+				}
 				continue
 			}
 		} else if scheme != "stdio" {
-			log.Println("Connecting to", settings.Addr)
+			log.Println("Connecting to", addr)
 
 			// First create raw TCP connection
 			conn, err = Connect(realAddr, settings.ProxyAddr, settings.ConnectTimeout, settings.ProxyUseHostKerberos, settings.ntlm)
 			if err != nil {
 
 				if errMsg := err.Error(); strings.Contains(errMsg, "missing port in address") {
-					log.Fatalf("Unable to connect to TCP invalid address: %q, %s", settings.Addr, errMsg)
+					log.Fatalf("Unable to connect to TCP invalid address: %q, %s", addr, errMsg)
 				}
 
 				log.Printf("Unable to connect directly TCP: %v\n", err)
 
-				if len(potentialProxies) > 0 {
-					if len(potentialProxies) <= triedProxyIndex {
-						log.Printf("Unable to connect via proxies (from env), retrying with proxy as %q: %v", potentialProxies, initialProxyAddr)
-						triedProxyIndex = 0
-						settings.ProxyAddr = initialProxyAddr
-						continue
+				if settings.Mesh {
+					conn, err = dialPeer(settings.MeshPeers, settings.ConnectTimeout)
+					if err == nil {
+						viaPeer = true
+					} else {
+						log.Printf("Unable to connect through a peer: %v\n", err)
 					}
-					proxy := potentialProxies[triedProxyIndex]
-					triedProxyIndex++
-
-					log.Println("Trying to proxy via env variable (", proxy, ")")
+				}
+			}
 
-					settings.ProxyAddr, err = GetProxyDetails(proxy)
-					if err != nil {
-						log.Println("Could not parse the env proxy value: ", proxy)
-					}
-					// dont wait 10 seconds, just immediately try each proxy
+			if err != nil {
+				if nextEnvProxy() {
 					continue
 				}
 
-				time.Sleep(10 * time.Second)
+				if !transports.failed(ctx) {
+					return
+				}
 				continue
 			}
 
+			transport := scheme
+			if viaPeer {
+				transport = "ssh"
+			}
+
 			// Add on transports as we go
-			if scheme == "tls" || scheme == "wss" || scheme == "https" {
+			if transport == "tls" || transport == "wss" || transport == "https" {
 
 				sniServerName := settings.SNI
 				if len(settings.SNI) == 0 {
@@ -463,23 +759,33 @@ func Run(settings *Settings) {
 				clientTlsConn := tls.Client(conn, &tls.Config{
 					InsecureSkipVerify: true,
 					ServerName:         sniServerName,
+					ClientSessionCache: tlsSessionCache,
+					Time:               clock.Now,
 				})
 				err = clientTlsConn.Handshake()
 				if err != nil {
 					log.Printf("Unable to connect TLS: %s\n", err)
-					<-time.After(10 * time.Second)
+					if !transports.failed(ctx) {
+						return
+					}
 					continue
 				}
 
+				if clientTlsConn.ConnectionState().DidResume {
+					log.Println("Resumed previous TLS session")
+				}
+
 				conn = clientTlsConn
 			}
 
-			switch scheme {
+			switch transport {
 			case "wss", "ws":
 				c, err := websocket.NewConfig("ws://"+realAddr+"/ws", "ws://"+realAddr)
 				if err != nil {
 					log.Println("Could not create websockets configuration: ", err)
-					<-time.After(10 * time.Second)
+					if !transports.failed(ctx) {
+						return
+					}
 
 					continue
 				}
@@ -487,7 +793,9 @@ func Run(settings *Settings) {
 				wsConn, err := websocket.NewClient(c, conn)
 				if err != nil {
 					log.Printf("Unable to connect WS: %s\n", err)
-					<-time.After(10 * time.Second)
+					if !transports.failed(ctx) {
+						return
+					}
 					continue
 
 				}
@@ -497,13 +805,15 @@ func Run(settings *Settings) {
 				conn = wsConn
 			case "http", "https":
 
-				conn, err = NewHTTPConn(scheme+"://"+realAddr, func() (net.Conn, error) {
+				conn, err = NewHTTPConn(scheme+"://"+realAddr, authSigner.PublicKey(), func() (net.Conn, error) {
 					return Connect(realAddr, settings.ProxyAddr, settings.ConnectTimeout, settings.ProxyUseHostKerberos, settings.ntlm)
 				})
 
 				if err != nil {
 					log.Printf("Unable to connect HTTP: %s\n", err)
-					<-time.After(10 * time.Second)
+					if !transports.failed(ctx) {
+						return
+					}
 					continue
 				}
 
@@ -517,7 +827,7 @@ func Run(settings *Settings) {
 		// After this the timeout gets updated by the server
 		realConn := &internal.TimeoutConn{Conn: conn, Timeout: 4 * time.Minute}
 
-		sshConn, chans, reqs, err := ssh.NewClientConn(realConn, settings.Addr, config)
+		sshConn, chans, reqs, err := ssh.NewClientConn(realConn, addr, config)
 		if err != nil {
 			realConn.Close()
 
@@ -528,7 +838,9 @@ func Run(settings *Settings) {
 				return
 			}
 
-			<-time.After(10 * time.Second)
+			if !transports.failed(ctx) {
+				return
+			}
 			continue
 		}
 
@@ -537,8 +849,20 @@ func Run(settings *Settings) {
 			triedProxyIndex = 0
 		}
 
-		log.Println("Successfully connnected", settings.Addr)
+		log.Println("Successfully connnected", addr)
+
+		connectedLinks.Add(1)
+		// Stopping closes the connection, which ends the channel loop below
+		stopClosing := context.AfterFunc(ctx, func() { sshConn.Close() })
 
+		trackForTamper(sshConn)
+		go syncClock(sshConn)
+
+		transports.connected(sshConn)
+		stopMonitor := transports.monitor(sshConn, probeDestination(settings))
+
+		connServerKey := serverKey
+		connProxy := settings.ProxyAddr
 		go func() {
 
 			for req := range reqs {
@@ -559,6 +883,10 @@ func Run(settings *Settings) {
 
 					realConn.Timeout = time.Duration(timeout*2) * time.Second
 
+					if next, ok := keepalives.observe(time.Duration(timeout) * time.Second); ok {
+						go negotiateKeepalive(sshConn, realConn, keepalives, next)
+					}
+
 				case "log-level":
 					u, err := logger.StrToUrgency(string(req.Payload))
 					if err != nil {
@@ -586,12 +914,134 @@ func Run(settings *Settings) {
 					f := struct {
 						RemoteForwards []string
 					}{
-						RemoteForwards: handlers.GetServerRemoteForwards(),
+						RemoteForwards: handlers.GetServerRemoteForwards(sshConn),
 					}
 
 					// Use ssh.Marshal instead of json.Marshal so that garble doesnt cook things
 					req.Reply(true, ssh.Marshal(f))
 
+				case "query-mesh@rssh":
+					req.Reply(true, ssh.Marshal(struct{ Networks []string }{Networks: mesh.Networks()}))
+
+				case "mesh-announce@rssh":
+					var announcement struct {
+						Port     uint32
+						Announce bool
+					}
+
+					if err := ssh.Unmarshal(req.Payload, &announcement); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					if !announcement.Announce {
+						mesh.Withdraw(announcement.Port)
+						req.Reply(true, nil)
+						continue
+					}
+
+					if err := mesh.Announce(sshConn, announcement.Port); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					req.Reply(true, nil)
+
+				case "qos-set@rssh":
+					var rule struct {
+						Match string
+						Class string
+					}
+
+					if err := ssh.Unmarshal(req.Payload, &rule); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					var err error
+					if rule.Class == "" {
+						err = qos.RemoveRule(rule.Match)
+					} else {
+						var class qos.Class
+						class, err = qos.ParseClass(rule.Class)
+						if err == nil {
+							err = qos.SetRule(rule.Match, class)
+						}
+					}
+
+					if err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					req.Reply(true, nil)
+
+				case "known-hosts@rssh":
+					var known struct{ Hosts []string }
+					if err := ssh.Unmarshal(req.Payload, &known); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					if err := handlers.KnownHosts.Set(known.Hosts); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					req.Reply(true, nil)
+
+				case "query-qos@rssh":
+					req.Reply(true, ssh.Marshal(struct{ Rules []string }{Rules: qos.Rules()}))
+
+				case "derp-map@rssh":
+					var signed nat.SignedDERPMap
+					if err := ssh.Unmarshal(req.Payload, &signed); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					if err := nat.ApplySignedDERPMap(connServerKey, signed); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					req.Reply(true, nil)
+
+				case "query-derp-map@rssh":
+					req.Reply(true, []byte(nat.DERPMapSource()))
+
+				case "query-proxy@rssh":
+					// The proxy this connection went through, or failing that the one the environment says to use, so the server can make web requests like we would
+					proxy := connProxy
+					if proxy == "" && len(potentialProxies) > 0 {
+						proxy, _ = GetProxyDetails(potentialProxies[0])
+					}
+
+					if proxy == "" {
+						req.Reply(false, nil)
+						continue
+					}
+
+					req.Reply(true, []byte(proxy))
+
+				case "query-link-role":
+					if role == "" {
+						req.Reply(false, nil)
+						continue
+					}
+
+					// Deliberately only the role, telling one server where the other lives would defeat the point
+					req.Reply(true, ssh.Marshal(struct{ Role string }{Role: role}))
+
+				case "query-instance@rssh":
+					machine := machineFingerprint()
+					if machine == "" {
+						req.Reply(false, nil)
+						continue
+					}
+
+					req.Reply(true, ssh.Marshal(struct{ Machine, Instance string }{Machine: machine, Instance: instanceID}))
+
 				case "cancel-tcpip-forward":
 					var rf internal.RemoteForwardRequest
 
@@ -626,14 +1076,40 @@ func Run(settings *Settings) {
 		//Do not register new client callbacks here, they are actually within the JumpHandler
 		//session is handled here as a legacy hangerover from allowing a client who has directly connected to the servers console to run the connect command
 		//Otherwise anything else should be done via jumphost syntax -J
+		// Shells and jumps the server opens as resumable outlive this connection, and are resumed on the next
+		resumableHandlers := map[string]func(newChannel ssh.NewChannel, log logger.Logger){
+			"session": handlers.Session(connection.NewSession(sshConn)),
+			"jump":    handlers.JumpHandler(sshPriv, sshConn),
+		}
+
 		err = connection.RegisterChannelCallbacks(chans, clientLog, map[string]func(newChannel ssh.NewChannel, log logger.Logger){
-			"session":        handlers.Session(connection.NewSession(sshConn)),
-			"jump":           handlers.JumpHandler(sshPriv, sshConn),
-			"log-to-console": handlers.LogToConsole,
+			"session":                   resumableHandlers["session"],
+			"jump":                      resumableHandlers["jump"],
+			"log-to-console":            handlers.LogToConsole,
+			"speedtest@rssh":            handlers.SpeedTest,
+			"sync@rssh":                 handlers.Sync,
+			resumable.ChannelType:       resumable.Handler(sshConn, resumableHandlers),
+			resumable.ResumeChannelType: resumable.Resumer(sshConn),
 		})
 
+		stopClosing()
+		stopMonitor()
+		connectedLinks.Add(-1)
+
 		sshConn.Close()
-		handlers.StopAllRemoteForwards()
+		handlers.StopAllRemoteForwards(sshConn)
+		mesh.WithdrawAll(sshConn)
+		qos.Forget(sshConn)
+		keepalives.disconnected()
+
+		if ctx.Err() != nil {
+			log.Println("Client stopped, disconnected from", addr)
+			return
+		}
+
+		if transports.switching() {
+			continue
+		}
 
 		if err != nil {
 			log.Printf("Server disconnected unexpectedly: %s\n", err)
@@ -642,7 +1118,9 @@ func Run(settings *Settings) {
 				return
 			}
 
-			<-time.After(10 * time.Second)
+			if !retryAfter(ctx) {
+				return
+			}
 			continue
 		}
 
@@ -650,6 +1128,87 @@ func Run(settings *Settings) {
 
 }
 
+// dialPeer tries each static peer, then anything answering on mdns, until one accepts a connection
+func dialPeer(static []string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 || timeout > 10*time.Second {
+		timeout = 10 * time.Second
+	}
+
+	peers := append([]string{}, static...)
+
+	discovered, err := mesh.Discover(2 * time.Second)
+	if err != nil {
+		log.Println("Unable to look for peers with mdns: ", err)
+	}
+	peers = append(peers, discovered...)
+
+	if len(peers) == 0 {
+		return nil, errors.New("no peers known or found")
+	}
+
+	for _, peer := range peers {
+		conn, err := net.DialTimeout("tcp", peer, timeout)
+		if err != nil {
+			log.Printf("Unable to connect to peer %s: %v\n", peer, err)
+			continue
+		}
+
+		log.Println("Connecting through peer", peer)
+		return conn, nil
+	}
+
+	return nil, fmt.Errorf("none of %d peers accepted a connection", len(peers))
+}
+
+// Shared between reconnects (and the http polling transport) so we can resume tls sessions rather than doing full handshakes
+var tlsSessionCache = tls.NewLRUClientSessionCache(16)
+
+// negotiateKeepalive asks the server to send keepalives less often, the server may clamp or refuse the request
+func negotiateKeepalive(sshConn ssh.Conn, realConn *internal.TimeoutConn, keepalives *keepaliveProber, interval time.Duration) {
+	ok, payload, err := sshConn.SendRequest("keepalive-interval@rssh", true, []byte(strconv.Itoa(int(interval.Seconds()))))
+	if err != nil {
+		return
+	}
+
+	if !ok {
+		keepalives.rejected()
+		return
+	}
+
+	accepted, err := strconv.Atoi(string(payload))
+	if err != nil {
+		keepalives.rejected()
+		return
+	}
+
+	acceptedInterval := time.Duration(accepted) * time.Second
+	keepalives.accepted(interval, acceptedInterval)
+
+	realConn.Timeout = acceptedInterval * 2
+
+	log.Printf("Keepalive interval is now %s", acceptedInterval)
+}
+
+// syncClock asks the server for its time, so time based features do not depend on the target's clock being right
+func syncClock(sshConn ssh.Conn) {
+	sent := time.Now()
+	ok, payload, err := sshConn.SendRequest("time@rssh", true, []byte(strconv.FormatInt(sent.UnixNano(), 10)))
+	received := time.Now()
+	if err != nil || !ok {
+		return
+	}
+
+	serverTime, err := strconv.ParseInt(string(payload), 10, 64)
+	if err != nil {
+		return
+	}
+
+	offset := clock.Observe(time.Unix(0, serverTime), sent, received)
+	if offset.Abs() > time.Minute {
+		log.Printf("Local clock is %s out from the server's, using the server's time", offset.Round(time.Second))
+	}
+}
+
 var matchSchemeDefinition = regexp.MustCompile(`.*\:\/\/`)
 
 func determineConnectionType(addr string) (resultingAddr, transport string) {
@@ -670,6 +1229,11 @@ func determineConnectionType(addr string) (resultingAddr, transport string) {
 		return u.Path + ":22", "ssh"
 	}
 
+	if u.Scheme == "smb" {
+		// smb://host/pipe_name, a named pipe on another client that relays to the server
+		return namedpipe.RemotePath(u.Host, strings.Trim(u.Path, "/")), u.Scheme
+	}
+
 	if u.Port() == "" {
 		// Set default port if none specified
 		switch u.Scheme {
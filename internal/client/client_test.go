@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSecondarySettings(t *testing.T) {
+	primary := &Settings{
+		Addr:                 "primary.example:443",
+		Fingerprint:          "aaaa",
+		ProxyAddr:            "http://proxy.example:8080",
+		SecondaryAddr:        "wss://secondary.example:443",
+		SecondaryFingerprint: "bbbb",
+	}
+
+	if err := primary.SetNTLMProxyCreds(`DOMAIN\user:pass`); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary, err := primary.secondary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secondary.Addr != primary.SecondaryAddr || secondary.Fingerprint != primary.SecondaryFingerprint {
+		t.Fatalf("secondary did not take secondary address/fingerprint: %q %q", secondary.Addr, secondary.Fingerprint)
+	}
+
+	if secondary.ProxyAddr != primary.ProxyAddr {
+		t.Fatalf("secondary should share the primary proxy, got %q", secondary.ProxyAddr)
+	}
+
+	if secondary.SecondaryAddr != "" {
+		t.Fatal("secondary settings should not themselves have a secondary")
+	}
+
+	if secondary.ntlm == nil || secondary.ntlm == primary.ntlm {
+		t.Fatal("secondary should have its own ntlm client")
+	}
+}
+
+func TestProxyDialerBasicAuth(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	go func() {
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		user, password, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth()
+		if req.Method != http.MethodConnect || !ok || user != "user" || password != "p@ss" {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n")
+			return
+		}
+
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}()
+
+	proxyAddr, err := GetProxyDetails("http://user:p%40ss@" + proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := proxyDialer(&Settings{ProxyAddr: proxyAddr, ConnectTimeout: time.Second})(ctx, target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "hello")
+
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "hello" {
+		t.Fatalf("got %q (%v) back through the proxy", echo, err)
+	}
+}
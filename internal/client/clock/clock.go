@@ -0,0 +1,37 @@
+// Package clock is the client's idea of the time, the local clock corrected by the offset to the server's clock.
+//
+// Targets often have clocks that are hours or years out, so anything on the client that depends on the wall clock should use Now rather than time.Now.
+// The offset is measured each time the client connects, until then it is 0 and Now is the local clock.
+package clock
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var offset atomic.Int64
+
+// Now is the local time corrected by the offset to the server's clock
+func Now() time.Time {
+	return time.Now().Add(Offset())
+}
+
+// Offset is how far the server's clock is ahead of the local one
+func Offset() time.Duration {
+	return time.Duration(offset.Load())
+}
+
+// Observe sets the offset from the server's time, sent and received are when the request was sent and its reply carrying serverTime arrived.
+// The server is assumed to have read its clock half way through the round trip
+func Observe(serverTime, sent, received time.Time) time.Duration {
+	// sent and received carry monotonic readings, so the round trip does not include the local clock being changed
+	rtt := received.Sub(sent)
+	if rtt < 0 {
+		rtt = 0
+	}
+
+	// Round strips the monotonic reading, so this compares wall clocks
+	o := serverTime.Add(rtt / 2).Sub(received.Round(0))
+	offset.Store(int64(o))
+	return o
+}
@@ -0,0 +1,25 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	defer offset.Store(0)
+
+	sent := time.Now()
+	received := sent.Add(200 * time.Millisecond)
+
+	// The server read its clock 100ms after the request was sent, and is 3 years ahead
+	serverTime := sent.Round(0).AddDate(3, 0, 0).Add(100 * time.Millisecond)
+
+	o := Observe(serverTime, sent, received)
+	if want := serverTime.Sub(sent.Round(0).Add(100 * time.Millisecond)); o != want {
+		t.Fatalf("offset = %s, want %s", o, want)
+	}
+
+	if skew := Now().Sub(time.Now().AddDate(3, 0, 0)); skew.Abs() > time.Second {
+		t.Fatalf("Now is %s from the server's time", skew)
+	}
+}
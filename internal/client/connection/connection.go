@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 
@@ -21,6 +22,9 @@ type Session struct {
 
 	// Remote forwards sent by user, used to just close user specific remote forwards
 	SupportedRemoteForwards map[internal.RemoteForwardRequest]bool //(set)
+
+	// Sent by the server with a jump session, lets modules ask for the operator's vault credentials while it lasts
+	VaultGrant string
 }
 
 func NewSession(connection ssh.Conn) *Session {
@@ -31,6 +35,38 @@ func NewSession(connection ssh.Conn) *Session {
 	}
 }
 
+// Credential asks the server for the operator's vault credential called name, it is only kept in memory by the caller
+func (s *Session) Credential(name string) (user, secret string, err error) {
+	if s.VaultGrant == "" {
+		return "", "", errors.New("the vault is only available to modules started through the server with ssh -J")
+	}
+
+	ok, reply, err := s.ServerConnection.SendRequest("vault@rssh", true, ssh.Marshal(struct {
+		Grant string
+		Name  string
+	}{Grant: s.VaultGrant, Name: name}))
+	if err != nil {
+		return "", "", err
+	}
+
+	if !ok {
+		if len(reply) == 0 {
+			return "", "", errors.New("server does not support the vault")
+		}
+		return "", "", errors.New(string(reply))
+	}
+
+	var credential struct {
+		User   string
+		Secret string
+	}
+	if err := ssh.Unmarshal(reply, &credential); err != nil {
+		return "", "", err
+	}
+
+	return credential.User, credential.Secret, nil
+}
+
 func RegisterChannelCallbacks(chans <-chan ssh.NewChannel, log logger.Logger, handlers map[string]func(newChannel ssh.NewChannel, log logger.Logger)) error {
 	// Service the incoming Channel channel in go routine
 	for newChannel := range chans {
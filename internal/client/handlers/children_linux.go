@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// hasChildren is whether pid has child processes, or they cannot be listed
+func hasChildren(pid int) bool {
+	tasks, err := filepath.Glob(filepath.Join("/proc", strconv.Itoa(pid), "task", "*", "children"))
+	if err != nil || len(tasks) == 0 {
+		return true
+	}
+
+	for _, task := range tasks {
+		children, err := os.ReadFile(task)
+		if err != nil || strings.TrimSpace(string(children)) != "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestHasChildren(t *testing.T) {
+	parent := exec.Command("sh", "-c", "sleep 5 & read line")
+	stdin, err := parent.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Start(); err != nil {
+		t.Skip("no sh to test with:", err)
+	}
+	defer func() {
+		stdin.Close()
+		parent.Process.Kill()
+		parent.Wait()
+	}()
+
+	waitFor := func(want bool) bool {
+		for i := 0; i < 100; i++ {
+			if hasChildren(parent.Process.Pid) == want {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !waitFor(true) {
+		t.Fatal("a shell running a background job should have children")
+	}
+
+	lone := exec.Command("sh", "-c", "read line")
+	loneIn, err := lone.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lone.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		loneIn.Close()
+		lone.Wait()
+	}()
+
+	if hasChildren(lone.Process.Pid) {
+		t.Error("a shell waiting for input should have no children")
+	}
+
+	if !hasChildren(1 << 30) {
+		t.Error("a process that cannot be looked at should be treated as having children")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package handlers
+
+// hasChildren is whether pid has child processes, there is no cheap way to list them here so it is assumed to
+func hasChildren(pid int) bool {
+	return true
+}
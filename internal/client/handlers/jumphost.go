@@ -11,6 +11,27 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// jumpServerConfig is for the ssh server operators reach through the rssh server, which has already authenticated them before opening the jump channel.
+// So any key is accepted, and so is keyboard-interactive with no questions. Operators often have ssh set to prefer keyboard-interactive for hosts behind MFA,
+// without it they were refused here before their onward connection (whose prompts are passed through untouched over direct-tcpip) could start
+func jumpServerConfig(sshPriv ssh.Signer) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					"pubkey-fp": internal.FingerprintSHA1Hex(key),
+				},
+			}, nil
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}
+	config.AddHostKey(sshPriv)
+
+	return config
+}
+
 func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.NewChannel, log logger.Logger) {
 
 	return func(newChannel ssh.NewChannel, log logger.Logger) {
@@ -22,17 +43,6 @@ func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.Ne
 		go ssh.DiscardRequests(requests)
 		defer jumpHandle.Close()
 
-		config := &ssh.ServerConfig{
-			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-				return &ssh.Permissions{
-					Extensions: map[string]string{
-						"pubkey-fp": internal.FingerprintSHA1Hex(key),
-					},
-				}, nil
-			},
-		}
-		config.AddHostKey(sshPriv)
-
 		p1, p2 := net.Pipe()
 		go io.Copy(jumpHandle, p2)
 		go func() {
@@ -42,7 +52,7 @@ func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.Ne
 			p1.Close()
 		}()
 
-		conn, chans, reqs, err := ssh.NewServerConn(p1, config)
+		conn, chans, reqs, err := ssh.NewServerConn(p1, jumpServerConfig(sshPriv))
 		if err != nil {
 			log.Error("%s", err.Error())
 			return
@@ -53,6 +63,7 @@ func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.Ne
 		clientLog.Info("New SSH connection, version %s", conn.ClientVersion())
 
 		session := connection.NewSession(serverConn)
+		session.VaultGrant = string(newChannel.ExtraData())
 
 		go func(in <-chan *ssh.Request) {
 			for r := range in {
@@ -86,8 +97,9 @@ func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.Ne
 
 		err = connection.RegisterChannelCallbacks(chans, clientLog, map[string]func(newChannel ssh.NewChannel, log logger.Logger){
 			"session":         Session(session),
-			"direct-tcpip":    LocalForward,
+			"direct-tcpip":    LocalForward(session),
 			"tun@openssh.com": Tun,
+			"direct-udp@rssh": UDPForward,
 		})
 
 		if err != nil {
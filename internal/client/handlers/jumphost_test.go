@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// channelConn lets an ssh connection run over the jump channel, as the operator's ssh does
+type channelConn struct {
+	ssh.Channel
+}
+
+func (channelConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (channelConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (channelConn) SetDeadline(t time.Time) error      { return nil }
+func (channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+type prompt struct {
+	Name, Instruction string
+	Questions         []string
+	Echos             []bool
+}
+
+// An operator jumps through a client (ssh -J rssh,client user@third) to a host that asks for a password and an MFA code
+func TestJumpKeyboardInteractivePassthrough(t *testing.T) {
+	want := prompt{
+		Name:        "third",
+		Instruction: "Two factor authentication",
+		Questions:   []string{"Password: ", "Verification code: "},
+		Echos:       []bool{false, true},
+	}
+
+	thirdConfig := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge(want.Name, want.Instruction, want.Questions, want.Echos)
+			if err != nil {
+				return nil, err
+			}
+
+			if !reflect.DeepEqual(answers, []string{"hunter2", "123456"}) {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	thirdConfig.AddHostKey(newSigner(t))
+
+	third, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+
+	go func() {
+		for {
+			c, err := third.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				conn, chans, reqs, err := ssh.NewServerConn(c, thirdConfig)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					nc.Reject(ssh.Prohibited, "")
+				}
+			}()
+		}
+	}()
+
+	// The rssh server to rssh client link, the server opens jump channels on it
+	link, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.Close()
+
+	serverSide, err := net.Dial("tcp", link.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientSide, err := link.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConfig := &ssh.ServerConfig{NoClientAuth: true}
+	clientConfig.AddHostKey(newSigner(t))
+
+	go func() {
+		conn, chans, reqs, err := ssh.NewServerConn(clientSide, clientConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		jump := JumpHandler(newSigner(t), conn)
+		for nc := range chans {
+			go jump(nc, logger.NewLog("test"))
+		}
+	}()
+
+	rsshServer, chans, reqs, err := ssh.NewClientConn(serverSide, "client", &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsshServer.Close()
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for nc := range chans {
+			nc.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	jumpChannel, jumpRequests, err := rsshServer.OpenChannel("jump", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(jumpRequests)
+
+	// The operator's ssh is set to only use keyboard-interactive, the client should let them through without asking anything
+	operatorConn, operatorChans, operatorReqs, err := ssh.NewClientConn(channelConn{jumpChannel}, "client", &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth: []ssh.AuthMethod{
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				if len(questions) != 0 {
+					t.Errorf("the client should not ask the operator anything, asked %q", questions)
+				}
+				return make([]string, len(questions)), nil
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatalf("keyboard-interactive login to the client failed: %v", err)
+	}
+	operator := ssh.NewClient(operatorConn, operatorChans, operatorReqs)
+	defer operator.Close()
+
+	onward, err := operator.Dial("tcp", third.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer onward.Close()
+
+	var got prompt
+	thirdConn, _, _, err := ssh.NewClientConn(onward, third.Addr().String(), &ssh.ClientConfig{
+		User:            "operator",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth: []ssh.AuthMethod{
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				got = prompt{name, instruction, questions, echos}
+				return []string{"hunter2", "123456"}, nil
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatalf("keyboard-interactive login to the third host failed: %v", err)
+	}
+	thirdConn.Close()
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("prompts were changed on the way through, got %+v want %+v", got, want)
+	}
+}
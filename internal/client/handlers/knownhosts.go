@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host keys of onward ssh servers reached through direct-tcpip, managed by the server with known-hosts.
+// The first key exchange of an ssh connection is in the clear, so the key the target presents can be read from the forward as it passes.
+// A key that differs from the pinned one of its type cuts the forward before the operator's client gets it, new keys are reported for the server to record
+type knownHosts struct {
+	mu sync.Mutex
+
+	// Nothing is checked until a server sends its list, older servers never do
+	enforced bool
+	keys     map[string][]ssh.PublicKey
+}
+
+var KnownHosts = &knownHosts{}
+
+const (
+	knownHostNew      = "new"
+	knownHostMismatch = "mismatch"
+)
+
+// KnownHostReport is sent to the server in a known-host@rssh request
+type KnownHostReport struct {
+	Host   string
+	Key    string
+	Status string
+}
+
+// Set replaces the known hosts with lines of "host keytype base64"
+func (k *knownHosts) Set(lines []string) error {
+	keys := map[string][]ssh.PublicKey{}
+	for _, line := range lines {
+		host, key, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			return fmt.Errorf("invalid known host line %q", line)
+		}
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return fmt.Errorf("invalid key for %s: %w", host, err)
+		}
+
+		host = knownhosts.Normalize(host)
+		keys[host] = append(keys[host], pub)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.enforced = true
+	k.keys = keys
+
+	return nil
+}
+
+func (k *knownHosts) isEnforced() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.enforced
+}
+
+// check compares key to the ones known for host, a host seen with a key of a new type is recorded rather than refused
+func (k *knownHosts) check(host string, key ssh.PublicKey) (status string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	host = knownhosts.Normalize(host)
+	for _, known := range k.keys[host] {
+		if known.Type() != key.Type() {
+			continue
+		}
+
+		if bytes.Equal(known.Marshal(), key.Marshal()) {
+			return ""
+		}
+		return knownHostMismatch
+	}
+
+	k.keys[host] = append(k.keys[host], key)
+	return knownHostNew
+}
+
+// verifyOnward wraps what the target sends on a forward to host, reports go to the server
+func (k *knownHosts) verifyOnward(host string, target io.Reader, serverConn ssh.Conn, l logger.Logger) io.Reader {
+	if !k.isEnforced() {
+		return target
+	}
+
+	return &hostKeyCheck{
+		src: target,
+		verify: func(key ssh.PublicKey) error {
+			status := k.check(host, key)
+			if status == "" {
+				return nil
+			}
+
+			go serverConn.SendRequest("known-host@rssh", false, ssh.Marshal(KnownHostReport{
+				Host:   knownhosts.Normalize(host),
+				Key:    strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+				Status: status,
+			}))
+
+			if status == knownHostMismatch {
+				l.Error("host key for %s does not match the pinned key, got %s %s", host, key.Type(), internal.FingerprintSHA256Hex(key))
+				return errors.New("host key mismatch")
+			}
+
+			l.Info("recorded new host key for %s, %s %s", host, key.Type(), internal.FingerprintSHA256Hex(key))
+			return nil
+		},
+		scratch: make([]byte, 32*1024),
+	}
+}
+
+const (
+	// What is read looking for the host key before the forward is left alone
+	maxBannerLines = 20
+	maxBannerLine  = 8 * 1024
+	maxKexPacket   = 256 * 1024
+
+	msgNewKeys = 21
+	// Key exchange replies that start with the host key, 31 is also the group exchange group which is not a key
+	msgKexReply    = 31
+	msgKexGexReply = 33
+)
+
+// hostKeyCheck passes the target's banner and key exchange packets through, holding back the reply that carries the host key until it is verified.
+// Anything that is not ssh, or a key exchange it does not understand, is passed through untouched
+type hostKeyCheck struct {
+	src    io.Reader
+	verify func(key ssh.PublicKey) error
+
+	// Read from src and not yet looked at, and what can be handed on
+	pending []byte
+	ready   []byte
+	scratch []byte
+
+	bannerDone bool
+	midLine    bool
+	lines      int
+
+	decided bool
+	failed  error
+	srcErr  error
+}
+
+func (h *hostKeyCheck) Read(p []byte) (int, error) {
+	for len(h.ready) == 0 {
+		if h.failed != nil {
+			return 0, h.failed
+		}
+
+		if h.decided {
+			return h.src.Read(p)
+		}
+
+		if h.srcErr != nil {
+			return 0, h.srcErr
+		}
+
+		n, err := h.src.Read(h.scratch)
+		h.pending = append(h.pending, h.scratch[:n]...)
+		h.srcErr = err
+
+		h.advance()
+
+		// The target went away part way through, hand on what it sent
+		if h.srcErr != nil && h.failed == nil {
+			h.pass()
+		}
+	}
+
+	n := copy(p, h.ready)
+	h.ready = h.ready[n:]
+	return n, nil
+}
+
+// pass stops looking, everything from here on is handed on
+func (h *hostKeyCheck) pass() {
+	h.decided = true
+	h.ready = append(h.ready, h.pending...)
+	h.pending = nil
+}
+
+func (h *hostKeyCheck) release(n int) {
+	h.ready = append(h.ready, h.pending[:n]...)
+	h.pending = h.pending[n:]
+}
+
+func (h *hostKeyCheck) advance() {
+	for !h.decided && h.failed == nil {
+		if !h.bannerDone {
+			i := bytes.IndexByte(h.pending, '\n')
+			if i < 0 {
+				// Only the version line is waited for, anything else may be a protocol where the other end waits on an unfinished line
+				if h.midLine || !couldBeVersion(h.pending) {
+					h.midLine = true
+					h.release(len(h.pending))
+				} else if len(h.pending) > maxBannerLine {
+					h.pass()
+				}
+				return
+			}
+
+			line := h.pending[:i+1]
+			h.bannerDone = !h.midLine && bytes.HasPrefix(line, []byte("SSH-"))
+			h.midLine = false
+			h.release(i + 1)
+
+			h.lines++
+			if !h.bannerDone && h.lines >= maxBannerLines {
+				h.pass()
+			}
+			continue
+		}
+
+		if len(h.pending) < 5 {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint32(h.pending))
+		if length < 2 || length > maxKexPacket {
+			h.pass()
+			return
+		}
+
+		if len(h.pending) < 4+length {
+			return
+		}
+
+		payloadLength := length - int(h.pending[4]) - 1
+		if payloadLength < 1 {
+			h.pass()
+			return
+		}
+		payload := h.pending[5 : 5+payloadLength]
+
+		switch payload[0] {
+		case msgNewKeys:
+			// The exchange finished without a key this understands
+			h.pass()
+			return
+		case msgKexReply, msgKexGexReply:
+			if key, err := leadingHostKey(payload[1:]); err == nil {
+				if err := h.verify(key); err != nil {
+					h.failed = err
+					return
+				}
+				h.pass()
+				return
+			}
+		}
+
+		h.release(4 + length)
+	}
+}
+
+func couldBeVersion(b []byte) bool {
+	n := min(len(b), 4)
+	return bytes.Equal(b[:n], []byte("SSH-")[:n])
+}
+
+// leadingHostKey reads the host key string key exchange replies start with
+func leadingHostKey(b []byte) (ssh.PublicKey, error) {
+	if len(b) < 4 {
+		return nil, errors.New("too short")
+	}
+
+	length := binary.BigEndian.Uint32(b)
+	if uint64(length) > uint64(len(b)-4) {
+		return nil, errors.New("too short")
+	}
+
+	return ssh.ParsePublicKey(b[4 : 4+length])
+}
@@ -7,11 +7,19 @@ import (
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/connection"
+	"github.com/NHAS/reverse_ssh/internal/client/qos"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
 )
 
-func LocalForward(newChannel ssh.NewChannel, l logger.Logger) {
+func LocalForward(session *connection.Session) func(newChannel ssh.NewChannel, l logger.Logger) {
+	return func(newChannel ssh.NewChannel, l logger.Logger) {
+		localForward(session, newChannel, l)
+	}
+}
+
+func localForward(session *connection.Session, newChannel ssh.NewChannel, l logger.Logger) {
 	a := newChannel.ExtraData()
 
 	var drtMsg internal.ChannelOpenDirectMsg
@@ -49,7 +57,10 @@ func LocalForward(newChannel ssh.NewChannel, l logger.Logger) {
 		defer tcpConn.Close()
 		defer connection.Close()
 
-		io.Copy(connection, tcpConn)
+		// Onward ssh connections have their host key checked against the ones the server pinned
+		target := KnownHosts.verifyOnward(dest, tcpConn, session.ServerConnection, l)
+
+		io.Copy(qos.For(session.ServerConnection).Writer(connection, qos.ClassFor(drtMsg.Raddr, drtMsg.Rport)), target)
 
 	}()
 
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+// processOptions are what the session asked for the process it starts, through env and process-options@rssh requests
+type processOptions struct {
+	env []string
+	internal.ProcessOptions
+}
+
+func (o *processOptions) environ() []string {
+	return append(os.Environ(), o.env...)
+}
+
+func (o *processOptions) apply(cmd *exec.Cmd) error {
+	cmd.Env = o.environ()
+	cmd.Dir = o.Dir
+
+	return setCredential(cmd, o.ProcessOptions)
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+func setCredential(cmd *exec.Cmd, options internal.ProcessOptions) error {
+	if !options.SetUid && !options.SetGid {
+		return nil
+	}
+
+	if os.Geteuid() != 0 {
+		return errors.New("changing uid or gid needs the client to be running as root")
+	}
+
+	credential := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if options.SetUid {
+		credential.Uid = options.Uid
+
+		// Without a gid, use the primary group of the user rather than keeping root's
+		if !options.SetGid {
+			u, err := user.LookupId(strconv.FormatUint(uint64(options.Uid), 10))
+			if err != nil {
+				return fmt.Errorf("unable to find the group of uid %d, set a gid as well: %w", options.Uid, err)
+			}
+
+			gid, err := strconv.ParseUint(u.Gid, 10, 32)
+			if err != nil {
+				return fmt.Errorf("uid %d has an invalid group %q", options.Uid, u.Gid)
+			}
+			credential.Gid = uint32(gid)
+		}
+	}
+
+	if options.SetGid {
+		credential.Gid = options.Gid
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = credential
+
+	return nil
+}
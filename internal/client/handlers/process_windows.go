@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package handlers
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+var errNoCredential = errors.New("changing uid or gid is not supported on windows")
+
+func setCredential(cmd *exec.Cmd, options internal.ProcessOptions) error {
+	if options.SetUid || options.SetGid {
+		return errNoCredential
+	}
+	return nil
+}
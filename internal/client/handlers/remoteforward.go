@@ -10,12 +10,16 @@ import (
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/client/connection"
+	"github.com/NHAS/reverse_ssh/internal/client/qos"
+	"github.com/NHAS/reverse_ssh/pkg/namedpipe"
 	"golang.org/x/crypto/ssh"
 )
 
 type remoteforward struct {
 	Listener net.Listener
 	User     *connection.Session
+	// The server connection that requested the forward, a client may be connected to more than one server
+	Conn ssh.Conn
 }
 
 var (
@@ -23,12 +27,12 @@ var (
 	currentRemoteForwards    = map[internal.RemoteForwardRequest]remoteforward{}
 )
 
-func GetServerRemoteForwards() (out []string) {
+func GetServerRemoteForwards(sshConn ssh.Conn) (out []string) {
 	currentRemoteForwardsLck.RLock()
 	defer currentRemoteForwardsLck.RUnlock()
 
 	for a, c := range currentRemoteForwards {
-		if c.User == nil {
+		if c.User == nil && c.Conn == sshConn {
 			out = append(out, a.String())
 		}
 	}
@@ -36,15 +40,18 @@ func GetServerRemoteForwards() (out []string) {
 	return out
 }
 
-func StopAllRemoteForwards() {
+func StopAllRemoteForwards(sshConn ssh.Conn) {
 	currentRemoteForwardsLck.Lock()
 	defer currentRemoteForwardsLck.Unlock()
 
-	for _, forward := range currentRemoteForwards {
+	for rf, forward := range currentRemoteForwards {
+		if forward.Conn != sshConn {
+			continue
+		}
+
 		go forward.Listener.Close()
+		delete(currentRemoteForwards, rf)
 	}
-
-	clear(currentRemoteForwards)
 }
 
 func StopRemoteForward(rf internal.RemoteForwardRequest) error {
@@ -71,7 +78,13 @@ func StartRemoteForward(session *connection.Session, r *ssh.Request, sshConn ssh
 		r.Reply(false, []byte(fmt.Sprintf("Unable to open remote forward: %s", err.Error())))
 		return
 	}
-	l, err := net.Listen("tcp", net.JoinHostPort(rf.BindAddr, fmt.Sprintf("%d", rf.BindPort)))
+	var l net.Listener
+	if namedpipe.IsPipe(rf.BindAddr) {
+		// Lets clients that cant reach the server directly connect back through this one over SMB
+		l, err = namedpipe.Listen(rf.BindAddr)
+	} else {
+		l, err = net.Listen("tcp", net.JoinHostPort(rf.BindAddr, fmt.Sprintf("%d", rf.BindPort)))
+	}
 	if err != nil {
 		r.Reply(false, []byte(fmt.Sprintf("Unable to open remote forward: %s", err.Error())))
 		return
@@ -88,20 +101,26 @@ func StartRemoteForward(session *connection.Session, r *ssh.Request, sshConn ssh
 
 	//https://datatracker.ietf.org/doc/html/rfc4254
 	responseData := []byte{}
-	if rf.BindPort == 0 {
-		port := uint32(l.Addr().(*net.TCPAddr).Port)
-		responseData = ssh.Marshal(port)
+	if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok && rf.BindPort == 0 {
+		port := uint32(tcpAddr.Port)
+		responseData = ssh.Marshal(struct{ Port uint32 }{port})
 		rf.BindPort = port
 	}
 	r.Reply(true, responseData)
 
 	log.Println("Started listening on: ", l.Addr())
 
+	owner := sshConn
+	if session != nil {
+		owner = session.ServerConnection
+	}
+
 	currentRemoteForwardsLck.Lock()
 
 	currentRemoteForwards[rf] = remoteforward{
 		Listener: l,
 		User:     session,
+		Conn:     owner,
 	}
 	currentRemoteForwardsLck.Unlock()
 
@@ -111,32 +130,39 @@ func StartRemoteForward(session *connection.Session, r *ssh.Request, sshConn ssh
 		if err != nil {
 			return
 		}
-		go handleData(rf, proxyCon, sshConn)
+		go handleData(rf, proxyCon, sshConn, owner)
 	}
 
 }
 
-func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh.Conn) error {
+// handleData relays a connection accepted on a remote forward, owner is the server connection the data ends up going over
+func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn, owner ssh.Conn) error {
 
 	log.Println("Accepted new connection: ", proxyCon.RemoteAddr())
 
-	originatorAddress, originatorPort, err := net.SplitHostPort(proxyCon.LocalAddr().String())
-	if err != nil {
-		return err
-	}
-
-	originatorPortInt, err := strconv.ParseInt(originatorPort, 10, 32)
-	if err != nil {
-		return err
-	}
-
 	drtMsg := internal.ChannelOpenDirectMsg{
-
 		Raddr: rf.BindAddr,
 		Rport: rf.BindPort,
+	}
+
+	if _, isPipe := proxyCon.LocalAddr().(namedpipe.Addr); isPipe {
+		// Pipes dont have ports
+		drtMsg.Laddr = proxyCon.LocalAddr().String()
+	} else {
+		originatorAddress, originatorPort, err := net.SplitHostPort(proxyCon.LocalAddr().String())
+		if err != nil {
+			proxyCon.Close()
+			return err
+		}
+
+		originatorPortInt, err := strconv.ParseInt(originatorPort, 10, 32)
+		if err != nil {
+			proxyCon.Close()
+			return err
+		}
 
-		Laddr: originatorAddress,
-		Lport: uint32(originatorPortInt),
+		drtMsg.Laddr = originatorAddress
+		drtMsg.Lport = uint32(originatorPortInt)
 	}
 
 	b := ssh.Marshal(&drtMsg)
@@ -144,7 +170,8 @@ func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh
 	source, reqs, err := sshConn.OpenChannel("forwarded-tcpip", b)
 	if err != nil {
 		log.Println("Opening forwarded-tcpip channel to server failed: ", err)
-
+		proxyCon.Close()
+		return err
 	}
 	defer source.Close()
 
@@ -155,7 +182,7 @@ func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh
 	go func() {
 		defer source.Close()
 		defer proxyCon.Close()
-		io.Copy(source, proxyCon)
+		io.Copy(qos.For(owner).Writer(source, qos.ClassFor(rf.BindAddr, rf.BindPort)), proxyCon)
 
 	}()
 
@@ -9,11 +9,14 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/text/unicode/norm"
 )
 
 func scpError(severity int, reason string, connection io.Writer) {
@@ -61,7 +64,21 @@ func scp(commandParts []string, connection ssh.Channel, log logger.Logger) error
 
 }
 
-func readProtocolControl(connection ssh.Channel) (string, uint32, uint64, string, error) {
+// localName is a file name from the other end as it is created here. Names are utf-8 on the wire, and are normalised to NFC so
+// decomposed names, as macOS sends, are not created as a different file that looks the same
+func localName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		// Windows converts names to utf-16, which would quietly replace the invalid bytes
+		if runtime.GOOS == "windows" {
+			return "", fmt.Errorf("file name %q is not valid utf-8", name)
+		}
+		return name, nil
+	}
+
+	return norm.NFC.String(name), nil
+}
+
+func readProtocolControl(connection io.ReadWriter) (string, uint32, uint64, string, error) {
 	control, err := bufio.NewReader(connection).ReadString('\n')
 	if err != nil {
 		log.Println(err)
@@ -84,8 +101,10 @@ func readProtocolControl(connection ssh.Channel) (string, uint32, uint64, string
 
 	mode, _ := strconv.ParseInt(parts[0][1:], 8, 32)
 	size, _ := strconv.ParseInt(parts[1], 10, 64)
-	filename := parts[len(parts)-1]
-	filename = filename[:len(filename)-1]
+	filename, err := localName(strings.TrimSuffix(parts[len(parts)-1], "\n"))
+	if err != nil {
+		return "", 0, 0, "", err
+	}
 
 	switch parts[0][0] {
 	case 'D':
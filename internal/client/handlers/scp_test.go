@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+type controlConn struct {
+	io.Reader
+	io.Writer
+}
+
+func TestReadProtocolControlNames(t *testing.T) {
+	for control, want := range map[string]string{
+		"C0644 5 報告書.txt\n":           "報告書.txt",
+		"C0644 5 😀 with spaces.png\n": "😀 with spaces.png",
+		"D0755 1 한국어\n":               "한국어",
+		// Decomposed, as macOS names files
+		"C0644 5 cafe\u0301.txt\n": "caf\u00e9.txt",
+	} {
+		conn := &controlConn{Reader: bytes.NewBufferString(control), Writer: io.Discard}
+
+		_, _, _, name, err := readProtocolControl(conn)
+		if err != nil {
+			t.Fatalf("%q: %s", control, err)
+		}
+
+		if name != want {
+			t.Errorf("%q: expected name %q got %q", control, want, name)
+		}
+	}
+}
@@ -48,13 +48,15 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 			connection.Close()
 		}()
 
+		var options processOptions
+
 		for req := range requests {
 			log.Info("Session got request: %q", req.Type)
 			switch req.Type {
 
 			case "subsystem":
 
-				err := subsystems.RunSubsystems(connection, req)
+				err := subsystems.RunSubsystems(connection, req, session.Credential)
 				if err != nil {
 					log.Error("subsystem encountered an error: %s", err.Error())
 					fmt.Fprintf(connection, "subsystem error: %q", err.Error())
@@ -102,10 +104,10 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 				}
 
 				if session.Pty != nil {
-					runCommandWithPty(argv, command, line.Chunks[1:], session.Pty, requests, log, connection)
+					runCommandWithPty(argv, command, line.Chunks[1:], &options, session.Pty, requests, log, connection)
 					return
 				}
-				runCommand(argv, command, line.Chunks[1:], connection)
+				runCommand(argv, command, line.Chunks[1:], &options, connection)
 
 				return
 			case "shell":
@@ -118,7 +120,7 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 				if err != nil || shellPath.Cmd == "" {
 
 					//This blocks so will keep the channel from defer closing
-					shell(session.Pty, connection, requests, log)
+					shell(session.Pty, &options, connection, requests, log)
 					return
 				}
 				parts := strings.Split(shellPath.Cmd, " ")
@@ -138,7 +140,7 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 						argv = u.Query().Get("argv")
 					}
 
-					runCommandWithPty(argv, command, parts[1:], session.Pty, requests, log, connection)
+					runCommandWithPty(argv, command, parts[1:], &options, session.Pty, requests, log, connection)
 				}
 				return
 				//Yes, this is here for a reason future me. Despite the RFC saying "Only one of shell,subsystem, exec can occur per channel" pty-req actually proceeds all of them
@@ -152,6 +154,24 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 				}
 				session.Pty = &pty
 
+				req.Reply(true, nil)
+			case "env":
+				var env internal.EnvRequest
+				if err := ssh.Unmarshal(req.Payload, &env); err != nil || env.Name == "" {
+					log.Warning("Got undecodable env request: %v", err)
+					req.Reply(false, nil)
+					continue
+				}
+
+				options.env = append(options.env, env.Name+"="+env.Value)
+				req.Reply(true, nil)
+			case "process-options@rssh":
+				if err := ssh.Unmarshal(req.Payload, &options.ProcessOptions); err != nil {
+					log.Warning("Got undecodable process options: %s", err)
+					req.Reply(false, nil)
+					continue
+				}
+
 				req.Reply(true, nil)
 			default:
 				log.Warning("Got an unknown request %s", req.Type)
@@ -164,7 +184,7 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 	}
 }
 
-func runCommand(argv string, command string, args []string, connection ssh.Channel) {
+func runCommand(argv string, command string, args []string, options *processOptions, connection ssh.Channel) {
 	//Set a path if no path is set to search
 	if len(os.Getenv("PATH")) == 0 {
 		if runtime.GOOS != "windows" {
@@ -179,6 +199,11 @@ func runCommand(argv string, command string, args []string, connection ssh.Chann
 		cmd.Args[0] = argv
 	}
 
+	if err := options.apply(cmd); err != nil {
+		fmt.Fprintf(connection, "%s", err.Error())
+		return
+	}
+
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		fmt.Fprintf(connection, "%s", err.Error())
@@ -5,6 +5,7 @@ package handlers
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
@@ -17,6 +18,7 @@ import (
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"github.com/creack/pty"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
 )
 
 var (
@@ -124,7 +126,7 @@ func init() {
 
 }
 
-func runCommandWithPty(argv string, command string, args []string, ptyReq *internal.PtyReq, requests <-chan *ssh.Request, log logger.Logger, connection ssh.Channel) {
+func runCommandWithPty(argv string, command string, args []string, options *processOptions, ptyReq *internal.PtyReq, requests <-chan *ssh.Request, log logger.Logger, connection ssh.Channel) {
 
 	if ptyReq == nil {
 		log.Error("Requested to run a command with a pty, but did not start a pty")
@@ -137,7 +139,12 @@ func runCommandWithPty(argv string, command string, args []string, ptyReq *inter
 		shell.Args[0] = argv
 	}
 
-	shell.Env = os.Environ()
+	if err := options.apply(shell); err != nil {
+		log.Warning("Unable to start %s: %s", command, err)
+		fmt.Fprintf(connection, "%s", err.Error())
+		connection.Close()
+		return
+	}
 
 	close := func() {
 		connection.Close()
@@ -189,6 +196,10 @@ func runCommandWithPty(argv string, command string, args []string, ptyReq *inter
 					}
 				}
 
+			case "idle@rssh":
+				// The server only parks a session whose shell is sat at its prompt
+				req.Reply(shellIdle(shell, shellIO), nil)
+
 			default:
 				log.Warning("Unknown request %s", req.Type)
 				if req.WantReply {
@@ -204,7 +215,7 @@ func runCommandWithPty(argv string, command string, args []string, ptyReq *inter
 }
 
 // This basically handles exactly like a SSH server would
-func shell(ptyReq *internal.PtyReq, connection ssh.Channel, requests <-chan *ssh.Request, log logger.Logger) {
+func shell(ptyReq *internal.PtyReq, options *processOptions, connection ssh.Channel, requests <-chan *ssh.Request, log logger.Logger) {
 
 	path := ""
 	if len(shells) != 0 {
@@ -212,10 +223,33 @@ func shell(ptyReq *internal.PtyReq, connection ssh.Channel, requests <-chan *ssh
 	}
 
 	if ptyReq != nil {
-		runCommandWithPty("", path, nil, ptyReq, requests, log, connection)
+		runCommandWithPty("", path, nil, options, ptyReq, requests, log, connection)
 		return
 	}
 
-	runCommand("", path, nil, connection)
+	runCommand("", path, nil, options, connection)
+
+}
+
+// shellIdle is whether the shell is waiting at its prompt, with nothing running in the foreground or the background
+func shellIdle(shell *exec.Cmd, shellIO io.ReadWriteCloser) bool {
+	shellf, ok := shellIO.(*os.File)
+	if !ok || shell.Process == nil {
+		return false
+	}
+
+	rc, err := shellf.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	foreground := -1
+	rc.Control(func(fd uintptr) {
+		foreground, err = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+	})
+	if err != nil || foreground != shell.Process.Pid {
+		return false
+	}
 
+	return !hasChildren(shell.Process.Pid)
 }
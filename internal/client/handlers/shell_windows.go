@@ -20,10 +20,10 @@ import (
 )
 
 // The basic windows shell handler, as there arent any good golang libraries to work with windows conpty
-func shell(ptyReq *internal.PtyReq, connection ssh.Channel, requests <-chan *ssh.Request, log logger.Logger) {
+func shell(ptyReq *internal.PtyReq, options *processOptions, connection ssh.Channel, requests <-chan *ssh.Request, log logger.Logger) {
 
 	if ptyReq == nil {
-		basicShell(connection, requests, log)
+		basicShell(options, connection, requests, log)
 		return
 	}
 
@@ -35,45 +35,51 @@ func shell(ptyReq *internal.PtyReq, connection ssh.Channel, requests <-chan *ssh
 		}
 	}
 
-	runCommandWithPty("", path, nil, ptyReq, requests, log, connection)
+	runCommandWithPty("", path, nil, options, ptyReq, requests, log, connection)
 
 	connection.Close()
 
 }
 
-func runCommandWithPty(argv, command string, args []string, pty *internal.PtyReq, requests <-chan *ssh.Request, log logger.Logger, connection ssh.Channel) {
+func runCommandWithPty(argv, command string, args []string, options *processOptions, pty *internal.PtyReq, requests <-chan *ssh.Request, log logger.Logger, connection ssh.Channel) {
+
+	if err := setCredential(nil, options.ProcessOptions); err != nil {
+		fmt.Fprintf(connection, "%s", err.Error())
+		return
+	}
 
 	fullCommand := command + " " + strings.Join(args, " ")
 	vsn := windows.RtlGetVersion()
 	if vsn.MajorVersion < 10 || vsn.BuildNumber < 17763 {
 
 		log.Info("Windows version too old for Conpty (%d, %d), using basic shell", vsn.MajorVersion, vsn.BuildNumber)
-		runWithWinPty(fullCommand, connection, requests, log, pty)
+		runWithWinPty(fullCommand, options, connection, requests, log, pty)
 
 	} else {
-		err := runWithConpty(argv, fullCommand, connection, requests, log, pty)
+		err := runWithConpty(argv, fullCommand, options, connection, requests, log, pty)
 		if err != nil {
 			log.Error("unable to run with conpty, falling back to winpty: %v", err)
-			runWithWinPty(fullCommand, connection, requests, log, pty)
+			runWithWinPty(fullCommand, options, connection, requests, log, pty)
 		}
 	}
 }
 
-func runWithWinPty(command string, connection ssh.Channel, reqs <-chan *ssh.Request, log logger.Logger, ptyReq *internal.PtyReq) error {
+func runWithWinPty(command string, options *processOptions, connection ssh.Channel, reqs <-chan *ssh.Request, log logger.Logger, ptyReq *internal.PtyReq) error {
 
 	path, err := exec.LookPath(command)
 	if err != nil {
 		return err
 	}
 
-	options := winpty.Options{
+	winptyOptions := winpty.Options{
 		Command:     path,
-		Env:         os.Environ(),
+		Env:         options.environ(),
+		Dir:         options.Dir,
 		InitialCols: ptyReq.Columns,
 		InitialRows: ptyReq.Rows,
 	}
 
-	winpty, err := winpty.OpenWithOptions(options)
+	winpty, err := winpty.OpenWithOptions(winptyOptions)
 	if err != nil {
 		log.Info("Winpty failed. %s", err)
 		return err
@@ -90,6 +96,10 @@ func runWithWinPty(command string, connection ssh.Channel, reqs <-chan *ssh.Requ
 				w, h := internal.ParseDims(req.Payload)
 				winpty.SetSize(w, h)
 
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
 			}
 		}
 
@@ -106,7 +116,7 @@ func runWithWinPty(command string, connection ssh.Channel, reqs <-chan *ssh.Requ
 	return nil
 }
 
-func runWithConpty(argv, command string, connection ssh.Channel, reqs <-chan *ssh.Request, log logger.Logger, ptyReq *internal.PtyReq) error {
+func runWithConpty(argv, command string, options *processOptions, connection ssh.Channel, reqs <-chan *ssh.Request, log logger.Logger, ptyReq *internal.PtyReq) error {
 
 	cpty, err := conpty.New(int16(ptyReq.Columns), int16(ptyReq.Rows))
 	if err != nil {
@@ -128,7 +138,8 @@ func runWithConpty(argv, command string, connection ssh.Channel, reqs <-chan *ss
 		path,
 		argvParts,
 		&syscall.ProcAttr{
-			Env: os.Environ(),
+			Env: options.environ(),
+			Dir: options.Dir,
 		},
 	)
 	if err != nil {
@@ -149,6 +160,10 @@ func runWithConpty(argv, command string, connection ssh.Channel, reqs <-chan *ss
 				w, h := internal.ParseDims(req.Payload)
 				cpty.Resize(uint16(w), uint16(h))
 
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
 			}
 		}
 
@@ -167,7 +182,7 @@ func runWithConpty(argv, command string, connection ssh.Channel, reqs <-chan *ss
 	return nil
 }
 
-func basicShell(connection ssh.Channel, reqs <-chan *ssh.Request, log logger.Logger) {
+func basicShell(options *processOptions, connection ssh.Channel, reqs <-chan *ssh.Request, log logger.Logger) {
 
 	cmd := exec.Command("powershell.exe", "-NoProfile", "-WindowStyle", "hidden", "-NoLogo")
 	cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -175,6 +190,11 @@ func basicShell(connection ssh.Channel, reqs <-chan *ssh.Request, log logger.Log
 		CreationFlags: syscall.STARTF_USESTDHANDLES,
 	}
 
+	if err := options.apply(cmd); err != nil {
+		fmt.Fprint(connection, err.Error())
+		return
+	}
+
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		log.Error("%s", err)
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+const maxSpeedTestSeconds = 60
+
+// SpeedTest either soaks up what the server sends and reports how much arrived, or sends as much as it can for the requested time
+func SpeedTest(newChannel ssh.NewChannel, log logger.Logger) {
+	var request internal.SpeedTestRequest
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &request); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, fmt.Sprintf("invalid speedtest request: %s", err))
+		return
+	}
+
+	if request.Seconds == 0 || request.Seconds > maxSpeedTestSeconds {
+		newChannel.Reject(ssh.Prohibited, fmt.Sprintf("speedtest duration must be between 1 and %d seconds", maxSpeedTestSeconds))
+		return
+	}
+
+	if request.Direction != internal.SpeedTestToClient && request.Direction != internal.SpeedTestFromClient {
+		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown speedtest direction %q", request.Direction))
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Warning("failed to accept speedtest channel: %s", err)
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	if request.Direction == internal.SpeedTestToClient {
+		n, _ := io.Copy(io.Discard, channel)
+
+		var received [8]byte
+		binary.BigEndian.PutUint64(received[:], uint64(n))
+		channel.Write(received[:])
+		return
+	}
+
+	sent, err := internal.SpeedTestSend(channel, time.Duration(request.Seconds)*time.Second)
+	if err != nil {
+		log.Warning("speedtest stopped after %d bytes: %s", sent, err)
+		return
+	}
+	channel.CloseWrite()
+
+	// Wait for the server to finish counting
+	io.Copy(io.Discard, channel)
+}
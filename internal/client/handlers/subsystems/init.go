@@ -2,6 +2,7 @@ package subsystems
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"golang.org/x/crypto/ssh"
@@ -13,20 +14,45 @@ var subsystems = map[string]subsystem{
 	"list": new(list),
 }
 
+// Refused once the client binary fails its integrity check, as someone may be instrumenting it
+var riskyModules = map[string]bool{
+	"mssql":   true,
+	"winrm":   true,
+	"smb":     true,
+	"service": true,
+	"setuid":  true,
+	"setgid":  true,
+}
+
+var riskyDisabled atomic.Bool
+
+// DisableRiskyModules refuses the protocol modules and privilege changing subsystems from now on
+func DisableRiskyModules() {
+	riskyDisabled.Store(true)
+}
+
+// Credentials gets a credential from the operator's vault on the server by name
+type Credentials func(name string) (user, secret string, err error)
+
 type subsystem interface {
-	Execute(arguments terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request) error
+	Execute(arguments terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, credentials Credentials) error
 }
 
-func RunSubsystems(connection ssh.Channel, req *ssh.Request) error {
+func RunSubsystems(connection ssh.Channel, req *ssh.Request, credentials Credentials) error {
 	if len(req.Payload) < 4 {
 		return fmt.Errorf("Payload size is too small <4, not enough space for token")
 
 	}
 
 	line := terminal.ParseLine(string(req.Payload[4:]), 0)
+	if riskyDisabled.Load() && riskyModules[line.Command.Value()] {
+		req.Reply(false, []byte("Refused, the client binary failed its integrity check"))
+		return fmt.Errorf("refused %q, the client binary failed its integrity check", line.Command.Value())
+	}
+
 	if subsys, ok := subsystems[line.Command.Value()]; ok {
 
-		return subsys.Execute(line, connection, req)
+		return subsys.Execute(line, connection, req, credentials)
 	}
 
 	req.Reply(false, []byte("Unknown subsystem"))
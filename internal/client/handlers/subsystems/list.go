@@ -9,7 +9,7 @@ import (
 
 type list bool
 
-func (l *list) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request) error {
+func (l *list) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, _ Credentials) error {
 	subsystemReq.Reply(true, nil)
 
 	for k := range subsystems {
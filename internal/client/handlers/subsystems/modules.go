@@ -0,0 +1,89 @@
+//go:build rssh_mssql || rssh_winrm || rssh_smb
+
+package subsystems
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+)
+
+// Helpers for the optional protocol modules, which are interactive over a subsystem channel.
+// ssh -s does not ask for a pty, so the operator's own terminal does the line editing and we get whole lines
+
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func newPrompter(rw io.ReadWriter) *prompter {
+	return &prompter{in: bufio.NewReader(rw), out: rw}
+}
+
+// readLine shows prompt and reads one line, false when the operator has gone
+func (p *prompter) readLine(prompt string) (string, bool) {
+	fmt.Fprint(p.out, prompt)
+
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false
+	}
+	return strings.TrimRight(line, "\r\n"), true
+}
+
+// moduleTarget is the host (and optional port) the module connects to, it has to come before any flags
+func moduleTarget(line terminal.ParsedLine, defaultPort string) (string, error) {
+	if len(line.Arguments) == 0 || (len(line.FlagsOrdered) > 0 && line.FlagsOrdered[0].Start() < line.Arguments[0].Start()) {
+		return "", errors.New("the host must be the first argument")
+	}
+
+	host := line.Arguments[0].Value()
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+	}
+	return host, nil
+}
+
+// flagValue joins the arguments of the first of names that is set, so -q select 1 is "select 1"
+func flagValue(line terminal.ParsedLine, names ...string) (string, bool) {
+	for _, name := range names {
+		if values, err := line.GetArgsString(name); err == nil {
+			return strings.Join(values, " "), true
+		}
+	}
+	return "", false
+}
+
+// moduleCredentials reads -u and -p, asking for the password when only a user is given.
+// --cred takes them from the operator's vault instead, -u still overrides the user it has
+func moduleCredentials(line terminal.ParsedLine, p *prompter, credentials Credentials) (user, password string, ok bool) {
+	user, _ = flagValue(line, "u", "user")
+
+	if name, ok := flagValue(line, "cred"); ok {
+		vaultUser, secret, err := credentials(name)
+		if err != nil {
+			fmt.Fprintf(p.out, "Unable to get credential %q: %s\n", name, err)
+			return "", "", false
+		}
+
+		if user == "" {
+			user = vaultUser
+		}
+		return user, secret, true
+	}
+
+	password, hasPassword := flagValue(line, "p", "password")
+
+	if user != "" && !hasPassword {
+		fmt.Fprintln(p.out, "No -p given, the password will be shown as you type it")
+		password, ok = p.readLine("Password: ")
+		return user, password, ok
+	}
+
+	return user, password, true
+}
@@ -0,0 +1,185 @@
+//go:build rssh_mssql
+
+package subsystems
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules/mssql"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	subsystems["mssql"] = new(mssqlModule)
+}
+
+type mssqlModule bool
+
+const mssqlUsage = `mssql <host[:port]> -u <user> [-p <password> | --cred <name>] [--windows] [-d <database>] [-q <query>]
+  --cred     use a credential from your vault on the server
+  --windows  log in with a windows account (DOMAIN\user) rather than a sql login
+  -q         run one query and exit
+`
+
+// Shortcuts for the usual first looks around a sql server
+var mssqlShortcuts = []struct {
+	name, description, query string
+}{
+	{":whoami", "login, database user and whether it is sysadmin", "SELECT SYSTEM_USER AS login, USER_NAME() AS db_user, IS_SRVROLEMEMBER('sysadmin') AS sysadmin, @@SERVERNAME AS server"},
+	{":dbs", "databases and whether you can use them", "SELECT name, HAS_DBACCESS(name) AS accessible FROM sys.databases ORDER BY name"},
+	{":tables", "tables in the current database", "SELECT TABLE_SCHEMA, TABLE_NAME, TABLE_TYPE FROM INFORMATION_SCHEMA.TABLES ORDER BY 1, 2"},
+	{":links", "linked servers", "EXEC sp_linkedservers"},
+	{":impersonate", "logins you may be able to EXECUTE AS", "SELECT DISTINCT p.name FROM sys.server_permissions s JOIN sys.server_principals p ON s.grantor_principal_id = p.principal_id WHERE s.permission_name = 'IMPERSONATE'"},
+}
+
+func (m *mssqlModule) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, credentials Credentials) error {
+	subsystemReq.Reply(true, nil)
+
+	p := newPrompter(connection)
+
+	address, err := moduleTarget(line, "1433")
+	if err != nil {
+		fmt.Fprintf(connection, "%s\n%s", err, mssqlUsage)
+		return nil
+	}
+
+	user, password, ok := moduleCredentials(line, p, credentials)
+	if !ok {
+		return nil
+	}
+	if user == "" {
+		fmt.Fprint(connection, mssqlUsage)
+		return nil
+	}
+
+	database, _ := flagValue(line, "d", "database")
+
+	conn, err := mssql.Connect(mssql.Config{
+		Address:  address,
+		User:     user,
+		Password: password,
+		Windows:  line.IsSet("windows"),
+		Database: database,
+	})
+	if err != nil {
+		fmt.Fprintf(connection, "Unable to connect to %s: %s\n", address, err)
+		return nil
+	}
+	defer conn.Close()
+
+	if query, ok := flagValue(line, "q"); ok {
+		runMSSQL(connection, conn, query)
+		return nil
+	}
+
+	fmt.Fprintf(connection, "Connected to %s (%s)\n", address, conn.Version())
+	fmt.Fprint(connection, "End queries with ; or a line with only GO. :help for shortcuts, :quit to leave\n")
+
+	var batch []string
+	for {
+		prompt := conn.Database() + "> "
+		if len(batch) > 0 {
+			prompt = "... "
+		}
+
+		input, ok := p.readLine(prompt)
+		if !ok {
+			return nil
+		}
+
+		trimmed := strings.TrimSpace(input)
+		if len(batch) == 0 && strings.HasPrefix(trimmed, ":") {
+			if !mssqlShortcut(connection, conn, trimmed) {
+				return nil
+			}
+			continue
+		}
+
+		if strings.EqualFold(trimmed, "go") {
+			runMSSQL(connection, conn, strings.Join(batch, "\n"))
+			batch = nil
+			continue
+		}
+
+		if trimmed == "" && len(batch) == 0 {
+			continue
+		}
+
+		batch = append(batch, input)
+		if strings.HasSuffix(trimmed, ";") {
+			runMSSQL(connection, conn, strings.Join(batch, "\n"))
+			batch = nil
+		}
+	}
+}
+
+// mssqlShortcut runs a :command, false means the operator is done
+func mssqlShortcut(out io.Writer, conn *mssql.Conn, input string) bool {
+	command, argument, _ := strings.Cut(input, " ")
+	argument = strings.TrimSpace(argument)
+
+	switch command {
+	case ":quit", ":exit":
+		return false
+	case ":help":
+		for _, s := range mssqlShortcuts {
+			fmt.Fprintf(out, "%-13s %s\n", s.name, s.description)
+		}
+		fmt.Fprintf(out, "%-13s %s\n", ":use <db>", "change database")
+		fmt.Fprintf(out, "%-13s %s\n", ":xp <command>", "run a command with xp_cmdshell, which has to be enabled")
+		fmt.Fprintf(out, "%-13s %s\n", ":quit", "disconnect")
+	case ":use":
+		runMSSQL(out, conn, "USE ["+strings.ReplaceAll(argument, "]", "]]")+"]")
+	case ":xp":
+		runMSSQL(out, conn, "EXEC xp_cmdshell N'"+strings.ReplaceAll(argument, "'", "''")+"'")
+	default:
+		for _, s := range mssqlShortcuts {
+			if s.name == command {
+				runMSSQL(out, conn, s.query)
+				return true
+			}
+		}
+		fmt.Fprintf(out, "Unknown shortcut %q, see :help\n", command)
+	}
+
+	return true
+}
+
+func runMSSQL(out io.Writer, conn *mssql.Conn, query string) {
+	batch, err := conn.Query(query)
+	if batch != nil {
+		for _, message := range batch.Messages {
+			fmt.Fprintln(out, message)
+		}
+
+		for _, result := range batch.Results {
+			if len(result.Columns) > 0 {
+				columns := make([]string, len(result.Columns))
+				for i, c := range result.Columns {
+					columns[i] = c
+					if c == "" {
+						columns[i] = fmt.Sprintf("(column %d)", i+1)
+					}
+				}
+
+				t, _ := table.NewTable("", columns...)
+				for _, row := range result.Rows {
+					t.AddValues(row...)
+				}
+				t.Fprint(out)
+			}
+
+			if result.HasRowsAffected {
+				fmt.Fprintf(out, "(%d rows affected)\n", result.RowsAffected)
+			}
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", err)
+	}
+}
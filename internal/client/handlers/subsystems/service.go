@@ -16,7 +16,7 @@ import (
 
 type service bool
 
-func (s *service) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request) error {
+func (s *service) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, _ Credentials) error {
 	subsystemReq.Reply(true, nil)
 
 	name, err := line.GetArgString("name")
@@ -13,7 +13,7 @@ import (
 
 type setgid bool
 
-func (su *setgid) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request) error {
+func (su *setgid) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, _ Credentials) error {
 
 	subsystemReq.Reply(true, nil)
 
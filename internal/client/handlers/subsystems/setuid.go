@@ -13,7 +13,7 @@ import (
 
 type setuid bool
 
-func (su *setuid) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request) error {
+func (su *setuid) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, _ Credentials) error {
 	subsystemReq.Reply(true, nil)
 
 	if len(line.Arguments) != 1 {
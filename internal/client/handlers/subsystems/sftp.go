@@ -11,7 +11,7 @@ import (
 
 type subSftp bool
 
-func (s *subSftp) Execute(_ terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request) error {
+func (s *subSftp) Execute(_ terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, _ Credentials) error {
 	server, err := sftp.NewServer(connection)
 	if err != nil {
 		subsystemReq.Reply(false, []byte(err.Error()))
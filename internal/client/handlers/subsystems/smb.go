@@ -0,0 +1,248 @@
+//go:build rssh_smb
+
+package subsystems
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules/smb"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	subsystems["smb"] = new(smbModule)
+}
+
+type smbModule bool
+
+// Files bigger than this are cut short by cat, it is for reading configs and scripts not copying data
+const smbCatLimit = 1 << 20
+
+const smbUsage = `smb <host[:port]> [-u <DOMAIN\user>] [-p <password> | --cred <name>] [-c <command>]
+  without -u an anonymous session is tried
+  --cred  use a credential from your vault on the server
+  -c  run one command (e.g "shares" or "ls C$/Users") and exit
+`
+
+const smbHelp = `shares         list shares, including hidden ones
+use <share>    connect to a share
+ls [path]      list a directory
+cd <path>      change directory, .. goes up
+cat <file>     print a file (up to 1MiB)
+quit           disconnect
+paths may include the share, e.g ls C$/Windows
+`
+
+type smbState struct {
+	session *smb.Session
+	host    string
+
+	tree *smb.Tree
+	cwd  string
+}
+
+func (s *smbModule) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, credentials Credentials) error {
+	subsystemReq.Reply(true, nil)
+
+	p := newPrompter(connection)
+
+	address, err := moduleTarget(line, "445")
+	if err != nil {
+		fmt.Fprintf(connection, "%s\n%s", err, smbUsage)
+		return nil
+	}
+
+	user, password, ok := moduleCredentials(line, p, credentials)
+	if !ok {
+		return nil
+	}
+
+	session, err := smb.Dial(smb.Config{
+		Address:  address,
+		User:     user,
+		Password: password,
+	})
+	if err != nil {
+		fmt.Fprintf(connection, "Unable to connect to %s: %s\n", address, err)
+		return nil
+	}
+	defer session.Close()
+
+	host, _, _ := net.SplitHostPort(address)
+	state := &smbState{session: session, host: host}
+	defer state.unmount()
+
+	if command, ok := flagValue(line, "c"); ok {
+		state.run(connection, command)
+		return nil
+	}
+
+	if session.Guest {
+		fmt.Fprintln(connection, "Logged in as guest")
+	}
+	fmt.Fprintf(connection, "Connected to %s, help for commands\n", address)
+
+	for {
+		input, ok := p.readLine(state.prompt())
+		if !ok {
+			return nil
+		}
+
+		if !state.run(connection, input) {
+			return nil
+		}
+	}
+}
+
+func (s *smbState) prompt() string {
+	if s.tree == nil {
+		return `\\` + s.host + "> "
+	}
+	return `\\` + s.host + `\` + s.tree.Share + `\` + strings.ReplaceAll(s.cwd, "/", `\`) + "> "
+}
+
+func (s *smbState) unmount() {
+	if s.tree != nil {
+		s.tree.Close()
+		s.tree = nil
+	}
+}
+
+// resolve turns a path the operator typed into a tree and a path in it, switching share if the path starts with one
+func (s *smbState) resolve(p string) (*smb.Tree, string, error) {
+	p = strings.ReplaceAll(p, `\`, "/")
+
+	if s.tree == nil || strings.Contains(strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0], "$") {
+		share, rest, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+		if share == "" {
+			return nil, "", fmt.Errorf("no share selected, use <share> or give one in the path e.g C$/Users")
+		}
+
+		if err := s.use(share); err != nil {
+			return nil, "", err
+		}
+		p = "/" + rest
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(s.cwd, p)
+	}
+	return s.tree, strings.TrimPrefix(path.Clean("/"+p), "/"), nil
+}
+
+func (s *smbState) use(share string) error {
+	if s.tree != nil && strings.EqualFold(s.tree.Share, share) {
+		return nil
+	}
+
+	tree, err := s.session.Mount(share)
+	if err != nil {
+		return err
+	}
+
+	s.unmount()
+	s.tree = tree
+	s.cwd = ""
+	return nil
+}
+
+// run runs one command, false means the operator is done
+func (s *smbState) run(out io.Writer, input string) bool {
+	command, argument, _ := strings.Cut(strings.TrimSpace(input), " ")
+	argument = strings.TrimSpace(argument)
+
+	var err error
+	switch command {
+	case "":
+	case "quit", "exit":
+		return false
+	case "help", "?":
+		fmt.Fprint(out, smbHelp)
+
+	case "shares":
+		var shares []smb.Share
+		shares, err = s.session.Shares()
+		if err == nil {
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			for _, share := range shares {
+				hidden := ""
+				if share.Hidden {
+					hidden = "hidden"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", share.Name, share.Type, hidden, share.Comment)
+			}
+			w.Flush()
+		}
+
+	case "use":
+		err = s.use(argument)
+
+	case "ls", "dir":
+		var (
+			tree  *smb.Tree
+			p     string
+			files []smb.File
+		)
+		tree, p, err = s.resolve(argument)
+		if err == nil {
+			files, err = tree.List(p)
+		}
+		if err == nil {
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			for _, f := range files {
+				kind, size := "-", fmt.Sprintf("%d", f.Size)
+				if f.IsDir {
+					kind, size = "d", ""
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", kind, size, f.Modified.Format("2006-01-02 15:04"), f.Name)
+			}
+			w.Flush()
+		}
+
+	case "cd":
+		var (
+			tree *smb.Tree
+			p    string
+		)
+		tree, p, err = s.resolve(argument)
+		if err == nil {
+			// Make sure it is a directory we can list before moving into it
+			if _, err = tree.List(p); err == nil {
+				s.cwd = p
+			}
+		}
+
+	case "cat", "type":
+		var (
+			tree      *smb.Tree
+			p         string
+			content   []byte
+			truncated bool
+		)
+		tree, p, err = s.resolve(argument)
+		if err == nil {
+			content, truncated, err = tree.ReadFile(p, smbCatLimit)
+		}
+		if err == nil {
+			out.Write(content)
+			if truncated {
+				fmt.Fprintf(out, "\n[cut short at %d bytes]", smbCatLimit)
+			}
+			fmt.Fprintln(out)
+		}
+
+	default:
+		fmt.Fprintf(out, "Unknown command %q, see help\n", command)
+	}
+
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", err)
+	}
+	return true
+}
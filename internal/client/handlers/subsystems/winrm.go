@@ -0,0 +1,106 @@
+//go:build rssh_winrm
+
+package subsystems
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules"
+	"github.com/NHAS/reverse_ssh/internal/client/modules/winrm"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	subsystems["winrm"] = new(winrmModule)
+}
+
+type winrmModule bool
+
+const winrmUsage = `winrm <host[:port]> -u <DOMAIN\user> [-p <password> | --cred <name>] [--https] [-c <command>]
+  --cred   use a credential from your vault on the server, -u is then optional
+  --https  use https (port 5986), otherwise messages are sealed with NTLM over http (port 5985)
+  -c       run one command and exit
+`
+
+func (w *winrmModule) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request, credentials Credentials) error {
+	subsystemReq.Reply(true, nil)
+
+	p := newPrompter(connection)
+
+	scheme, port := "http", "5985"
+	if line.IsSet("https") {
+		scheme, port = "https", "5986"
+	}
+
+	address, err := moduleTarget(line, port)
+	if err != nil {
+		fmt.Fprintf(connection, "%s\n%s", err, winrmUsage)
+		return nil
+	}
+
+	user, password, ok := moduleCredentials(line, p, credentials)
+	if !ok {
+		return nil
+	}
+	if user == "" {
+		fmt.Fprint(connection, winrmUsage)
+		return nil
+	}
+
+	client, err := winrm.Connect(winrm.Config{
+		Endpoint: scheme + "://" + address + "/wsman",
+		User:     user,
+		Password: password,
+	})
+	if err != nil {
+		fmt.Fprintf(connection, "Unable to connect to %s: %s\n", address, err)
+		return nil
+	}
+	defer client.Close()
+
+	if command, ok := flagValue(line, "c"); ok {
+		runWinRM(connection, client, command)
+		return nil
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	fmt.Fprintf(connection, "Connected to %s, each line is run with cmd.exe on its own (so cd does not carry over)\n", address)
+	fmt.Fprint(connection, ":ps <script> runs powershell, :quit to leave\n")
+
+	for {
+		input, ok := p.readLine(host + "> ")
+		if !ok {
+			return nil
+		}
+
+		input = strings.TrimSpace(input)
+		switch {
+		case input == "":
+		case input == ":quit" || input == ":exit":
+			return nil
+		case input == ":help":
+			fmt.Fprint(connection, ":ps <script>  run powershell, e.g :ps Get-Process | Select -First 5\n:quit         disconnect\n")
+		case strings.HasPrefix(input, ":ps "):
+			script := modules.UTF16LE(strings.TrimPrefix(input, ":ps "))
+			runWinRM(connection, client, "powershell -NoProfile -NonInteractive -EncodedCommand "+base64.StdEncoding.EncodeToString(script))
+		default:
+			runWinRM(connection, client, input)
+		}
+	}
+}
+
+func runWinRM(connection ssh.Channel, client *winrm.Client, command string) {
+	code, err := client.Run(command, connection, connection.Stderr())
+	if err != nil {
+		fmt.Fprintf(connection, "%s\n", err)
+		return
+	}
+
+	if code != 0 {
+		fmt.Fprintf(connection, "(exit code %d)\n", code)
+	}
+}
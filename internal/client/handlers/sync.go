@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/NHAS/reverse_ssh/internal/dirsync"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// Sync serves the client's side of a sync, the server opens one of these for each of its parallel transfers
+func Sync(newChannel ssh.NewChannel, log logger.Logger) {
+	var request dirsync.Request
+	if err := json.Unmarshal(newChannel.ExtraData(), &request); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, fmt.Sprintf("invalid sync request: %s", err))
+		return
+	}
+
+	if request.Root == "" {
+		newChannel.Reject(ssh.ConnectionFailed, "sync request has no path")
+		return
+	}
+
+	if err := dirsync.CheckPatterns(request.Exclude); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Warning("failed to accept sync channel: %s", err)
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	if err := dirsync.Serve(channel, dirsync.NewLocal(request.Root, request.Exclude)); err != nil {
+		log.Warning("sync of %s stopped: %s", request.Root, err)
+	}
+}
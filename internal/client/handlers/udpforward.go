@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// UDPForward relays datagrams between a direct-udp@rssh channel and a udp destination, used by the nc command
+func UDPForward(newChannel ssh.NewChannel, l logger.Logger) {
+	var drtMsg internal.ChannelOpenDirectMsg
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &drtMsg); err != nil {
+		l.Warning("Unable to unmarshal udp destination %s", err)
+		newChannel.Reject(ssh.ResourceShortage, "Unable to unmarshal udp destination")
+		return
+	}
+
+	dest := net.JoinHostPort(drtMsg.Raddr, fmt.Sprintf("%d", drtMsg.Rport))
+	udpConn, err := net.Dial("udp", dest)
+	if err != nil {
+		l.Warning("Unable to dial udp destination: %s", err)
+		newChannel.Reject(ssh.ConnectionFailed, "Unable to connect to "+dest)
+		return
+	}
+	defer udpConn.Close()
+
+	connection, requests, err := newChannel.Accept()
+	if err != nil {
+		l.Warning("Unable to accept new channel %s", err)
+		return
+	}
+	defer connection.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	go func() {
+		defer connection.Close()
+
+		buf := make([]byte, internal.MaxDatagramSize)
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				return
+			}
+
+			if err := internal.WriteDatagram(connection, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		datagram, err := internal.ReadDatagram(connection)
+		if err != nil {
+			return
+		}
+
+		// Nothing listening (ICMP port unreachable) shows up as an error here, keep going as udp would
+		udpConn.Write(datagram)
+	}
+}
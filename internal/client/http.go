@@ -14,8 +14,9 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/NHAS/reverse_ssh/internal/client/keys"
+	"github.com/NHAS/reverse_ssh/internal/client/clock"
 	"github.com/NHAS/reverse_ssh/pkg/mux"
+	"golang.org/x/crypto/ssh"
 )
 
 type HTTPConn struct {
@@ -32,7 +33,7 @@ type HTTPConn struct {
 	client *http.Client
 }
 
-func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn, error) {
+func NewHTTPConn(address string, publicKey ssh.PublicKey, connector func() (net.Conn, error)) (*HTTPConn, error) {
 
 	result := &HTTPConn{
 		done:       make(chan interface{}),
@@ -48,6 +49,8 @@ func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn,
 			},
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: true,
+				ClientSessionCache: tlsSessionCache,
+				Time:               clock.Now,
 			},
 		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -55,12 +58,7 @@ func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn,
 		},
 	}
 
-	s, err := keys.GetPrivateKey()
-	if err != nil {
-		return nil, err
-	}
-
-	publicKeyBytes := s.PublicKey().Marshal()
+	publicKeyBytes := publicKey.Marshal()
 
 	resp, err := result.client.Head(address + "/push?key=" + hex.EncodeToString(publicKeyBytes))
 	if err != nil {
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// instanceID is different every time the client is started, so the server can tell two copies on one machine apart
+var instanceID = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// machineFingerprint identifies the machine without giving away its machine id, empty if there isnt one
+func machineFingerprint() string {
+	id := strings.TrimSpace(machineID())
+	if id == "" {
+		return ""
+	}
+
+	h := sha256.Sum256([]byte("rssh machine " + id))
+	return hex.EncodeToString(h[:16])
+}
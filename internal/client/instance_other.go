@@ -0,0 +1,14 @@
+//go:build !windows
+
+package client
+
+import "os"
+
+func machineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id", "/etc/hostid"} {
+		if id, err := os.ReadFile(path); err == nil && len(id) > 0 {
+			return string(id)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/client/handlers/subsystems"
+	"github.com/NHAS/reverse_ssh/internal/integrity"
+	"golang.org/x/crypto/ssh"
+)
+
+const integrityCheckInterval = 15 * time.Minute
+
+var (
+	integrityOnce sync.Once
+
+	tamperLock sync.Mutex
+	// Why the binary failed its check, empty while it passes
+	tamperReason string
+	// Connections to tell when the binary fails its check
+	tamperConns = map[ssh.Conn]bool{}
+)
+
+// startIntegrityChecks checks the client binary against the signature the server added when it built it, at startup and every 15 minutes
+func startIntegrityChecks(key string) {
+	if key == "" {
+		return
+	}
+
+	integrityOnce.Do(func() {
+		checkIntegrity(key)
+
+		go func() {
+			for range time.Tick(integrityCheckInterval) {
+				checkIntegrity(key)
+			}
+		}()
+	})
+}
+
+func checkIntegrity(key string) {
+	// Still readable on linux if the binary was deleted after it started
+	path := "/proc/self/exe"
+	if runtime.GOOS != "linux" {
+		var err error
+		path, err = os.Executable()
+		if err != nil {
+			log.Printf("Unable to find the client binary to check it: %s", err)
+			return
+		}
+	}
+
+	err := integrity.Verify(path, key)
+	if err == nil {
+		return
+	}
+
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		log.Printf("Unable to read the client binary to check it: %s", err)
+		return
+	}
+
+	tamperLock.Lock()
+	defer tamperLock.Unlock()
+	if tamperReason != "" {
+		return
+	}
+
+	tamperReason = err.Error()
+	log.Printf("Client binary failed its integrity check, refusing risky modules: %s", tamperReason)
+	subsystems.DisableRiskyModules()
+
+	for conn := range tamperConns {
+		go reportTamper(conn, tamperReason)
+	}
+}
+
+// trackForTamper tells the server now if the binary has already failed its check, or later if it does while connected
+func trackForTamper(conn ssh.Conn) {
+	tamperLock.Lock()
+	tamperConns[conn] = true
+	if tamperReason != "" {
+		go reportTamper(conn, tamperReason)
+	}
+	tamperLock.Unlock()
+
+	go func() {
+		conn.Wait()
+
+		tamperLock.Lock()
+		delete(tamperConns, conn)
+		tamperLock.Unlock()
+	}()
+}
+
+func reportTamper(conn ssh.Conn, reason string) {
+	conn.SendRequest("tamper@rssh", false, []byte(reason))
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How many keepalives have to arrive at an interval before it is trusted
+	keepaliveProbeSurvivals = 3
+	// Stop searching once the gap between the longest working and shortest failing interval is this small
+	keepaliveProbeResolution = 15 * time.Second
+	// Ask for at most this, the server will clamp it further
+	keepaliveProbeMax = 30 * time.Minute
+	// A failure may have been the server going away rather than the NAT, so eventually try longer intervals again
+	keepaliveFailureExpiry = 6 * time.Hour
+)
+
+// keepaliveProber searches for the longest keepalive interval the network path (usually a NAT) will keep an idle connection open for.
+// It only moves up once an interval has been survived a few times, and binary searches back down when a connection dies at an unproven interval
+type keepaliveProber struct {
+	sync.Mutex
+
+	// Longest interval known to work, and shortest interval known to fail (0 if none have)
+	good, bad time.Duration
+	badSince  time.Time
+
+	// Largest interval the server will allow, 0 if unknown
+	limit time.Duration
+
+	target time.Duration
+
+	// Per connection state
+	survived int
+	asked    bool
+}
+
+// observe is called for every keepalive the server sends, if it returns true the server should be asked for the returned interval
+func (k *keepaliveProber) observe(interval time.Duration) (time.Duration, bool) {
+	k.Lock()
+	defer k.Unlock()
+
+	if interval <= 0 {
+		// Server has timeouts disabled, nothing to tune
+		return 0, false
+	}
+
+	if k.good == 0 {
+		// Whatever the server starts with is what it would use without us, so assume it works
+		k.good = interval
+		k.target = interval
+	}
+
+	if !k.asked && k.target != interval {
+		// New connection, go straight back to where we were
+		k.asked = true
+		return k.target, true
+	}
+
+	if interval != k.target {
+		// Waiting on the server to apply our request
+		return 0, false
+	}
+
+	k.survived++
+	if k.survived < keepaliveProbeSurvivals {
+		return 0, false
+	}
+	k.survived = 0
+
+	if k.target > k.good {
+		k.good = k.target
+	}
+
+	next := k.next()
+	if next <= k.target {
+		return 0, false
+	}
+
+	k.target = next
+	k.asked = true
+
+	return next, true
+}
+
+func (k *keepaliveProber) next() time.Duration {
+	if k.bad != 0 && time.Since(k.badSince) > keepaliveFailureExpiry {
+		k.bad = 0
+	}
+
+	upper := keepaliveProbeMax
+	if k.limit > 0 {
+		upper = min(upper, k.limit)
+	}
+
+	if k.bad == 0 {
+		return min(k.good*2, upper)
+	}
+
+	upper = min(upper, k.bad)
+	if upper-k.good < keepaliveProbeResolution {
+		return k.good
+	}
+
+	return (k.good + (upper-k.good)/2).Truncate(time.Second)
+}
+
+// accepted records the interval the server agreed to, which may be less than we asked for
+func (k *keepaliveProber) accepted(requested, accepted time.Duration) {
+	k.Lock()
+	defer k.Unlock()
+
+	if accepted < requested {
+		k.limit = accepted
+	}
+
+	k.target = accepted
+}
+
+// rejected is called when the server doesnt support or allow negotiating keepalives
+func (k *keepaliveProber) rejected() {
+	k.Lock()
+	defer k.Unlock()
+
+	k.limit = k.good
+	k.target = k.good
+}
+
+// disconnected should be called whenever the connection to the server is lost
+func (k *keepaliveProber) disconnected() {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.target > k.good {
+		// Died while trying an interval we hadnt proven, so assume the NAT dropped us
+		k.bad = k.target
+		k.badSince = time.Now()
+		k.target = k.good
+	}
+
+	k.survived = 0
+	k.asked = false
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// survive feeds the prober enough keepalives at interval for it to trust it, returning any request it makes
+func survive(k *keepaliveProber, interval time.Duration) (next time.Duration, ok bool) {
+	for i := 0; i < keepaliveProbeSurvivals; i++ {
+		next, ok = k.observe(interval)
+		if ok {
+			return next, ok
+		}
+	}
+
+	return 0, false
+}
+
+func TestKeepaliveProberGrowsAndBacksOff(t *testing.T) {
+	k := &keepaliveProber{}
+
+	next, ok := survive(k, 30*time.Second)
+	if !ok || next != 60*time.Second {
+		t.Fatalf("expected to ask for 60s after surviving 30s, got %s %v", next, ok)
+	}
+	k.accepted(next, next)
+
+	next, ok = survive(k, 60*time.Second)
+	if !ok || next != 120*time.Second {
+		t.Fatalf("expected to ask for 120s after surviving 60s, got %s %v", next, ok)
+	}
+	k.accepted(next, next)
+
+	// NAT drops us at 120s
+	k.disconnected()
+
+	// On reconnect the server starts at its default again, we should go straight back to what worked
+	next, ok = k.observe(30 * time.Second)
+	if !ok || next != 60*time.Second {
+		t.Fatalf("expected to ask for last good 60s on reconnect, got %s %v", next, ok)
+	}
+	k.accepted(next, next)
+
+	next, ok = survive(k, 60*time.Second)
+	if !ok || next != 90*time.Second {
+		t.Fatalf("expected to search between 60s and 120s, got %s %v", next, ok)
+	}
+
+	// Keep surviving, the search should converge below the failed interval
+	for i := 0; ok; i++ {
+		if i > 10 {
+			t.Fatal("keepalive search did not converge")
+		}
+
+		if next >= 120*time.Second {
+			t.Fatalf("asked for %s which is at or above the failed interval", next)
+		}
+
+		k.accepted(next, next)
+		next, ok = survive(k, next)
+	}
+
+	if 120*time.Second-k.good >= keepaliveProbeResolution {
+		t.Fatalf("search stopped at %s, further than the resolution from the failure", k.good)
+	}
+}
+
+func TestKeepaliveProberServerLimits(t *testing.T) {
+	k := &keepaliveProber{}
+
+	next, ok := survive(k, 5*time.Second)
+	if !ok {
+		t.Fatal("expected a request")
+	}
+
+	// Server clamps us
+	k.accepted(next, 8*time.Second)
+	if next, ok = survive(k, 8*time.Second); ok {
+		t.Fatalf("should not ask beyond the server limit, asked for %s", next)
+	}
+
+	old := &keepaliveProber{}
+	if _, ok := survive(old, 5*time.Second); !ok {
+		t.Fatal("expected a request")
+	}
+
+	// Servers that dont support negotiation
+	old.rejected()
+	if next, ok = survive(old, 5*time.Second); ok {
+		t.Fatalf("should stop asking once rejected, asked for %s", next)
+	}
+}
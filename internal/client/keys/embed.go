@@ -2,10 +2,12 @@ package keys
 
 import (
 	_ "embed"
+	"encoding/base64"
 	"fmt"
 	"log"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/secure"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -13,7 +15,10 @@ import (
 var privateKey string
 
 func GetPrivateKey() (ssh.Signer, error) {
-	sshPriv, err := ssh.ParsePrivateKey([]byte(privateKey))
+	pemBytes := []byte(privateKey)
+	defer secure.Zero(pemBytes)
+
+	sshPriv, err := ssh.ParsePrivateKey(pemBytes)
 	if err != nil {
 		log.Println("Unable to load embedded private key: ", err)
 		bs, err := internal.GeneratePrivateKey()
@@ -22,6 +27,7 @@ func GetPrivateKey() (ssh.Signer, error) {
 		}
 
 		sshPriv, err = ssh.ParsePrivateKey(bs)
+		secure.Zero(bs)
 		if err != nil {
 			return nil, err
 		}
@@ -31,7 +37,10 @@ func GetPrivateKey() (ssh.Signer, error) {
 }
 
 func SetPrivateKey(key string) error {
-	_, err := ssh.ParsePrivateKey([]byte(key))
+	pemBytes := []byte(key)
+	defer secure.Zero(pemBytes)
+
+	_, err := ssh.ParsePrivateKey(pemBytes)
 	if err != nil {
 		return fmt.Errorf("private key invalid: %w", err)
 	}
@@ -40,8 +49,31 @@ func SetPrivateKey(key string) error {
 	return nil
 }
 
+// CertificateSigner logs in with signer's key as the base64 ssh certificate encoded, which must be for that key
+func CertificateSigner(signer ssh.Signer, encoded string) (ssh.Signer, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("certificate invalid: %w", err)
+	}
+
+	key, err := ssh.ParsePublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("certificate invalid: %w", err)
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("certificate invalid: got a %s key", key.Type())
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
 func AuthorisedKeysLine() (string, error) {
-	priv, err := ssh.ParsePrivateKey([]byte(privateKey))
+	pemBytes := []byte(privateKey)
+	defer secure.Zero(pemBytes)
+
+	priv, err := ssh.ParsePrivateKey(pemBytes)
 	if err != nil {
 		return "", fmt.Errorf("private key invalid: %w", err)
 	}
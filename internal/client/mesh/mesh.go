@@ -0,0 +1,296 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The mDNS service relays are announced as
+const service = "_rssh._tcp.local."
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Networks lists the interface addresses (in CIDR form) other hosts could reach this one on, so the server can work out who can relay for who
+func Networks() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var networks []string
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok || n.IP.IsLoopback() || n.IP.IsLinkLocalUnicast() || n.IP.IsMulticast() {
+			continue
+		}
+
+		networks = append(networks, n.String())
+	}
+
+	return networks
+}
+
+var (
+	lck sync.Mutex
+	// Relay port to the server connection that asked for it to be announced
+	announced = map[uint32]any{}
+	responder *net.UDPConn
+)
+
+// Announce starts answering mDNS queries for relays with port, owner is used to withdraw everything a server asked for when it goes away
+func Announce(owner any, port uint32) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if responder == nil {
+		conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+		if err != nil {
+			return fmt.Errorf("unable to listen for mdns queries: %w", err)
+		}
+
+		responder = conn
+		go respond(conn)
+	}
+
+	announced[port] = owner
+
+	return nil
+}
+
+func Withdraw(port uint32) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	delete(announced, port)
+	stopIfIdle()
+}
+
+func WithdrawAll(owner any) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	for port, o := range announced {
+		if o == owner {
+			delete(announced, port)
+		}
+	}
+	stopIfIdle()
+}
+
+// stopIfIdle must be called with lck held
+func stopIfIdle() {
+	if len(announced) == 0 && responder != nil {
+		responder.Close()
+		responder = nil
+	}
+}
+
+func announcedPorts() []uint32 {
+	lck.Lock()
+	defer lck.Unlock()
+
+	var ports []uint32
+	for port := range announced {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i] < ports[j]
+	})
+
+	return ports
+}
+
+func respond(conn *net.UDPConn) {
+	buff := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+
+		id, ok := isQuery(buff[:n])
+		if !ok {
+			continue
+		}
+
+		ports := announcedPorts()
+		if len(ports) == 0 {
+			continue
+		}
+
+		answer, err := buildAnswer(id, ports)
+		if err != nil {
+			continue
+		}
+
+		// Queries that dont come from the mdns port are one shot (legacy unicast) queriers, and only listen for a direct reply
+		to := mdnsGroup
+		if from.Port != mdnsGroup.Port {
+			to = from
+		}
+
+		conn.WriteToUDP(answer, to)
+	}
+}
+
+func serviceName() dnsmessage.Name {
+	return dnsmessage.MustNewName(service)
+}
+
+func isQuery(msg []byte) (uint16, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.Response {
+		return 0, false
+	}
+
+	for {
+		q, err := p.Question()
+		if err != nil {
+			return 0, false
+		}
+
+		if (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL) && strings.EqualFold(q.Name.String(), service) {
+			return h.ID, true
+		}
+	}
+}
+
+func buildQuery() ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err := b.Question(dnsmessage.Question{Name: serviceName(), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+
+	return b.Finish()
+}
+
+// buildAnswer describes each relay port as its own service instance, there are deliberately no address records (so the hostname isnt broadcast), the querier uses the address the answer came from
+func buildAnswer(id uint16, ports []uint32) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	for _, port := range ports {
+		instance, err := dnsmessage.NewName("relay-" + strconv.Itoa(int(port)) + "." + service)
+		if err != nil {
+			return nil, err
+		}
+
+		header := dnsmessage.ResourceHeader{Name: serviceName(), Class: dnsmessage.ClassINET, TTL: 120}
+		if err := b.PTRResource(header, dnsmessage.PTRResource{PTR: instance}); err != nil {
+			return nil, err
+		}
+
+		header.Name = instance
+		if err := b.SRVResource(header, dnsmessage.SRVResource{Port: uint16(port), Target: instance}); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+func relayPorts(msg []byte) ([]uint32, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !h.Response {
+		return nil, errors.New("not a response")
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	var ports []uint32
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return ports, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if rh.Type != dnsmessage.TypeSRV || !strings.HasSuffix(strings.ToLower(rh.Name.String()), service) {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		srv, err := p.SRVResource()
+		if err != nil {
+			return nil, err
+		}
+
+		// Anyone on the network can answer, dont go dialing nonsense
+		if srv.Port != 0 {
+			ports = append(ports, uint32(srv.Port))
+		}
+	}
+}
+
+// Discover asks the local network for relays, returning the address:port of each one that answers within timeout
+func Discover(timeout time.Duration) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query, err := buildQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var (
+		relays []string
+		seen   = map[string]bool{}
+		buff   = make([]byte, 9000)
+	)
+	for {
+		n, from, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			// Deadline reached
+			return relays, nil
+		}
+
+		ports, err := relayPorts(buff[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, port := range ports {
+			relay := net.JoinHostPort(from.IP.String(), strconv.Itoa(int(port)))
+			if !seen[relay] {
+				seen[relay] = true
+				relays = append(relays, relay)
+			}
+		}
+	}
+}
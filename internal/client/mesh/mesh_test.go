@@ -0,0 +1,59 @@
+package mesh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryAnswerRoundTrip(t *testing.T) {
+	query, err := buildQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := isQuery(query); !ok {
+		t.Fatal("query for relays was not recognised")
+	}
+
+	answer, err := buildAnswer(7, []uint32{2222, 3333})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := isQuery(answer); ok {
+		t.Fatal("answer should not be treated as a query")
+	}
+
+	ports, err := relayPorts(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ports, []uint32{2222, 3333}) {
+		t.Fatalf("expected ports [2222 3333] got %v", ports)
+	}
+}
+
+func FuzzMDNS(f *testing.F) {
+	query, _ := buildQuery()
+	answer, _ := buildAnswer(7, []uint32{2222, 3333})
+
+	f.Add(query)
+	f.Add(answer)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		isQuery(msg)
+
+		ports, err := relayPorts(msg)
+		if err != nil {
+			return
+		}
+
+		for _, port := range ports {
+			if port == 0 || port > 65535 {
+				t.Fatalf("invalid relay port %d accepted", port)
+			}
+		}
+	})
+}
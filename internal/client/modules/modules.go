@@ -0,0 +1,42 @@
+// Package modules holds the helpers shared by the optional protocol modules (mssql, winrm, smb) that are only built into a
+// client when asked for, e.g link --modules mssql,smb
+package modules
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+)
+
+// SplitUser splits DOMAIN\user or user@domain into its parts, a bare user has no domain
+func SplitUser(user string) (domain, username string) {
+	if d, u, ok := strings.Cut(user, `\`); ok {
+		return d, u
+	}
+
+	if u, d, ok := strings.Cut(user, "@"); ok {
+		return d, u
+	}
+
+	return "", user
+}
+
+// UTF16LE encodes s as the little endian UTF-16 windows protocols use, without a terminator
+func UTF16LE(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+// FromUTF16LE decodes little endian UTF-16, a trailing odd byte is dropped
+func FromUTF16LE(b []byte) string {
+	chars := make([]uint16, len(b)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(chars))
+}
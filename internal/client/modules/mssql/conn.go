@@ -0,0 +1,468 @@
+// Package mssql is a small TDS 7.4 client, enough to log in (sql or windows auth) and run ad-hoc batches.
+// Values come back already formatted as text, as they are only ever shown to an operator
+package mssql
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules"
+	"github.com/bodgit/ntlmssp"
+)
+
+const (
+	packetSQLBatch = 0x01
+	packetLogin7   = 0x10
+	packetSSPI     = 0x11
+	packetPrelogin = 0x12
+
+	statusEOM = 0x01
+
+	headerSize        = 8
+	defaultPacketSize = 4096
+
+	// Largest reply read, packets are joined until the end of message so a server could otherwise send forever
+	maxMessageSize = 128 * 1024 * 1024
+
+	tdsVersion = 0x74000004
+)
+
+// Encryption values in the prelogin exchange
+const (
+	encryptOff    = 0x00
+	encryptOn     = 0x01
+	encryptNotSup = 0x02
+	encryptReq    = 0x03
+)
+
+type Config struct {
+	// host:port, the port is normally 1433
+	Address string
+
+	// User may be DOMAIN\user or user@domain when Windows is set
+	User, Password string
+	Windows        bool
+
+	Database string
+
+	Timeout time.Duration
+}
+
+type Conn struct {
+	raw net.Conn
+
+	// Where packets are read and written, the tls connection when the whole session is encrypted
+	rw io.ReadWriter
+
+	packetSize  int
+	transaction uint64
+
+	database string
+	version  string
+}
+
+// ServerError is an ERROR token, the server rejected the login or the batch
+type ServerError struct {
+	Number  int32
+	State   uint8
+	Class   uint8
+	Message string
+	Line    int32
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("Msg %d, Level %d, State %d, Line %d: %s", e.Number, e.Class, e.State, e.Line, e.Message)
+}
+
+func Connect(config Config) (*Conn, error) {
+	if config.Timeout == 0 {
+		config.Timeout = 15 * time.Second
+	}
+
+	host, _, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := net.DialTimeout("tcp", config.Address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		raw:        raw,
+		rw:         raw,
+		packetSize: defaultPacketSize,
+	}
+
+	raw.SetDeadline(time.Now().Add(config.Timeout))
+	if err := c.login(host, config); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+func (c *Conn) login(host string, config Config) error {
+	if err := c.writeMessage(packetPrelogin, prelogin()); err != nil {
+		return err
+	}
+
+	_, reply, err := c.readMessage()
+	if err != nil {
+		return fmt.Errorf("prelogin failed: %w", err)
+	}
+
+	encryption, err := preloginEncryption(reply)
+	if err != nil {
+		return err
+	}
+
+	if encryption != encryptNotSup {
+		handshake := &handshakeConn{Conn: c.raw, handshaking: true, c: c}
+
+		// Servers mostly have self signed certificates, and TDS 7 cannot do TLS 1.3
+		tlsConn := tls.Client(handshake, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         host,
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         tls.VersionTLS12,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("tls handshake failed: %w", err)
+		}
+		handshake.handshaking = false
+
+		c.rw = tlsConn
+	}
+
+	var ntlm *ntlmssp.Client
+	var sspi []byte
+	if config.Windows {
+		domain, user := modules.SplitUser(config.User)
+		ntlm, err = ntlmssp.NewClient(ntlmssp.SetDomain(domain), ntlmssp.SetUserInfo(user, config.Password), ntlmssp.SetVersion(ntlmssp.DefaultVersion()))
+		if err != nil {
+			return err
+		}
+
+		sspi, err = ntlm.Authenticate(nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := c.writeMessage(packetLogin7, login7(host, config, sspi)); err != nil {
+		return err
+	}
+
+	// With ENCRYPT_OFF only the login packet is encrypted
+	if encryption == encryptOff {
+		c.rw = c.raw
+	}
+
+	for {
+		_, reply, err := c.readMessage()
+		if err != nil {
+			return fmt.Errorf("login failed: %w", err)
+		}
+
+		result, err := c.parse(reply)
+		if err != nil {
+			return err
+		}
+
+		if result.loggedIn {
+			return nil
+		}
+
+		if result.sspi == nil || ntlm == nil {
+			return errors.New("server did not accept the login")
+		}
+
+		authenticate, err := ntlm.Authenticate(result.sspi, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := c.writeMessage(packetSSPI, authenticate); err != nil {
+			return err
+		}
+	}
+}
+
+// Query runs a batch, which may hold several statements and so give several results
+func (c *Conn) Query(sql string) (*Batch, error) {
+	headers := make([]byte, 22)
+	binary.LittleEndian.PutUint32(headers[0:], 22)
+	binary.LittleEndian.PutUint32(headers[4:], 18)
+	// Transaction descriptor header, so BEGIN TRAN carries over to the next batch
+	binary.LittleEndian.PutUint16(headers[8:], 2)
+	binary.LittleEndian.PutUint64(headers[10:], c.transaction)
+	binary.LittleEndian.PutUint32(headers[18:], 1)
+
+	if err := c.writeMessage(packetSQLBatch, append(headers, modules.UTF16LE(sql)...)); err != nil {
+		return nil, err
+	}
+
+	_, reply, err := c.readMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.parse(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result.batch, result.err
+}
+
+// Database is the current database, it changes with USE
+func (c *Conn) Database() string {
+	return c.database
+}
+
+// Version is the server product and version from the login acknowledgement
+func (c *Conn) Version() string {
+	return c.version
+}
+
+func (c *Conn) Close() error {
+	return c.raw.Close()
+}
+
+func (c *Conn) writeMessage(packetType byte, payload []byte) error {
+	max := c.packetSize - headerSize
+
+	id := byte(1)
+	for {
+		chunk := payload
+		status := byte(statusEOM)
+		if len(chunk) > max {
+			chunk = chunk[:max]
+			status = 0
+		}
+		payload = payload[len(chunk):]
+
+		packet := make([]byte, headerSize, headerSize+len(chunk))
+		packet[0] = packetType
+		packet[1] = status
+		binary.BigEndian.PutUint16(packet[2:], uint16(headerSize+len(chunk)))
+		packet[6] = id
+		packet = append(packet, chunk...)
+
+		if _, err := c.rw.Write(packet); err != nil {
+			return err
+		}
+
+		if status == statusEOM {
+			return nil
+		}
+		id++
+	}
+}
+
+func (c *Conn) readMessage() (byte, []byte, error) {
+	var (
+		message    []byte
+		packetType byte
+	)
+
+	for {
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(c.rw, header); err != nil {
+			return 0, nil, err
+		}
+
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < headerSize {
+			return 0, nil, fmt.Errorf("invalid packet length %d", length)
+		}
+
+		payload := make([]byte, length-headerSize)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return 0, nil, err
+		}
+
+		if len(message)+len(payload) > maxMessageSize {
+			return 0, nil, fmt.Errorf("reply is larger than %d bytes", maxMessageSize)
+		}
+
+		packetType = header[0]
+		message = append(message, payload...)
+
+		if header[1]&statusEOM != 0 {
+			return packetType, message, nil
+		}
+	}
+}
+
+func prelogin() []byte {
+	type option struct {
+		token byte
+		data  []byte
+	}
+
+	options := []option{
+		{0x00, []byte{0x10, 0x00, 0x00, 0x00, 0x00, 0x00}}, // version
+		{0x01, []byte{encryptOff}},                         // encryption, on for login, or more if the server needs it
+		{0x02, []byte{0x00}},                               // instance, the default
+		{0x03, binary.BigEndian.AppendUint32(nil, uint32(os.Getpid()))},
+		{0x04, []byte{0x00}}, // no MARS
+	}
+
+	offset := len(options)*5 + 1
+
+	var header, data []byte
+	for _, o := range options {
+		header = append(header, o.token)
+		header = binary.BigEndian.AppendUint16(header, uint16(offset+len(data)))
+		header = binary.BigEndian.AppendUint16(header, uint16(len(o.data)))
+		data = append(data, o.data...)
+	}
+	header = append(header, 0xff)
+
+	return append(header, data...)
+}
+
+func preloginEncryption(reply []byte) (byte, error) {
+	for i := 0; i+5 <= len(reply) && reply[i] != 0xff; i += 5 {
+		if reply[i] != 0x01 {
+			continue
+		}
+
+		offset := int(binary.BigEndian.Uint16(reply[i+1:]))
+		if offset >= len(reply) {
+			break
+		}
+		return reply[offset], nil
+	}
+
+	return 0, errors.New("server prelogin reply had no encryption option, it may not be sql server")
+}
+
+func login7(host string, config Config, sspi []byte) []byte {
+	const fixedSize = 94
+
+	hostname, _ := os.Hostname()
+
+	optionFlags2 := byte(0x03) // init lang fatal, odbc
+	user, password := config.User, config.Password
+	if config.Windows {
+		optionFlags2 |= 0x80
+		user, password = "", ""
+	}
+
+	fixed := make([]byte, fixedSize)
+	binary.LittleEndian.PutUint32(fixed[4:], tdsVersion)
+	binary.LittleEndian.PutUint32(fixed[8:], defaultPacketSize)
+	binary.LittleEndian.PutUint32(fixed[12:], 0x07000000)
+	binary.LittleEndian.PutUint32(fixed[16:], uint32(os.Getpid()))
+	fixed[24] = 0xa0 // use db, set lang
+	fixed[25] = optionFlags2
+	binary.LittleEndian.PutUint32(fixed[32:], 0x0409)
+
+	var data []byte
+	position := 36
+	field := func(b []byte, length int) {
+		binary.LittleEndian.PutUint16(fixed[position:], uint16(fixedSize+len(data)))
+		binary.LittleEndian.PutUint16(fixed[position+2:], uint16(length))
+		data = append(data, b...)
+		position += 4
+	}
+	text := func(s string) {
+		field(modules.UTF16LE(s), len([]rune(s)))
+	}
+
+	text(hostname)
+	text(user)
+	field(scramble(password), len([]rune(password)))
+	text("rssh")
+	text(host)
+	field(nil, 0) // extension
+	text("rssh")
+	text("") // language
+	text(config.Database)
+	position += 6 // client id
+	field(sspi, len(sspi))
+	text("") // attach db file
+	text("") // change password
+
+	message := append(fixed, data...)
+	binary.LittleEndian.PutUint32(message[0:], uint32(len(message)))
+	return message
+}
+
+// scramble is the password "encryption" TDS uses, swapped nibbles xored with 0xA5
+func scramble(password string) []byte {
+	b := modules.UTF16LE(password)
+	for i := range b {
+		b[i] = (b[i]<<4 | b[i]>>4) ^ 0xa5
+	}
+	return b
+}
+
+// handshakeConn carries the tls handshake inside prelogin packets, as TDS 7 requires, then gets out of the way
+type handshakeConn struct {
+	net.Conn
+	c *Conn
+
+	handshaking bool
+	pending     bytes.Buffer
+	unread      []byte
+}
+
+func (h *handshakeConn) Write(b []byte) (int, error) {
+	if !h.handshaking {
+		return h.Conn.Write(b)
+	}
+
+	// Each flight goes out in one packet when the tls client waits for a reply
+	return h.pending.Write(b)
+}
+
+func (h *handshakeConn) Read(b []byte) (int, error) {
+	if !h.handshaking {
+		return h.Conn.Read(b)
+	}
+
+	if h.pending.Len() > 0 {
+		// The tls connection is not in use yet, so this goes straight out on the socket
+		err := h.c.writeMessage(packetPrelogin, h.pending.Bytes())
+		h.pending.Reset()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(h.unread) == 0 {
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(h.Conn, header); err != nil {
+			return 0, err
+		}
+
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < headerSize {
+			return 0, errors.New("invalid packet length " + strconv.Itoa(length))
+		}
+
+		h.unread = make([]byte, length-headerSize)
+		if _, err := io.ReadFull(h.Conn, h.unread); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, h.unread)
+	h.unread = h.unread[n:]
+	return n, nil
+}
@@ -0,0 +1,18 @@
+package mssql
+
+import (
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte{tokenDone, doneCount, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0})
+	f.Add(join(nvarcharMax, []byte{tokenRow, 2, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 'h', 0, 0, 0, 0, 0}))
+	f.Add(join(nvarcharMax, []byte{tokenNBCRow, 1}))
+	f.Add([]byte{tokenColMetadata, 1, 0, 0, 0, 0, 0, 0, 0, 0x2b, 7, 0, tokenRow, 10, 0, 0, 0, 0, 0, 1, 0, 0, 0x3c, 0})
+	f.Add([]byte{tokenLoginAck, 10, 0, 1, 4, 0, 0, 0x74, 0, 0, 0, 0, 0})
+	f.Add([]byte{tokenFeatureExtAck, 1, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		(&Conn{}).parse(reply)
+	})
+}
@@ -0,0 +1,608 @@
+package mssql
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules"
+)
+
+const (
+	tokenReturnStatus  = 0x79
+	tokenColMetadata   = 0x81
+	tokenTabName       = 0xa4
+	tokenColInfo       = 0xa5
+	tokenOrder         = 0xa9
+	tokenError         = 0xaa
+	tokenInfo          = 0xab
+	tokenReturnValue   = 0xac
+	tokenLoginAck      = 0xad
+	tokenFeatureExtAck = 0xae
+	tokenRow           = 0xd1
+	tokenNBCRow        = 0xd2
+	tokenEnvChange     = 0xe3
+	tokenSSPI          = 0xed
+	tokenDone          = 0xfd
+	tokenDoneProc      = 0xfe
+	tokenDoneInProc    = 0xff
+
+	doneCount = 0x10
+)
+
+// Result is one result set, or just a row count for statements that do not return rows
+type Result struct {
+	Columns []string
+	Rows    [][]string
+
+	RowsAffected    uint64
+	HasRowsAffected bool
+}
+
+type Batch struct {
+	Results []Result
+
+	// PRINT output and informational messages, e.g "Changed database context to 'master'."
+	Messages []string
+}
+
+type parsed struct {
+	batch Batch
+	err   error
+
+	loggedIn bool
+	sspi     []byte
+}
+
+type column struct {
+	name string
+
+	typ              byte
+	size             int
+	precision, scale byte
+	plp              bool
+}
+
+// reader reads little endian values, after the first short read everything is zero and err is set.
+// Lengths come from the server, so a short read never allocates what was asked for
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		if r.err == nil {
+			r.err = errors.New("reply was cut short")
+		}
+		return make([]byte, min(max(n, 0), 8))
+	}
+
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *reader) u8() byte {
+	return r.next(1)[0]
+}
+
+func (r *reader) u16() uint16 {
+	return binary.LittleEndian.Uint16(r.next(2))
+}
+
+func (r *reader) u32() uint32 {
+	return binary.LittleEndian.Uint32(r.next(4))
+}
+
+func (r *reader) u64() uint64 {
+	return binary.LittleEndian.Uint64(r.next(8))
+}
+
+// bVarchar is a string with a one byte length in characters
+func (r *reader) bVarchar() string {
+	return modules.FromUTF16LE(r.next(2 * int(r.u8())))
+}
+
+func (r *reader) usVarchar() string {
+	return modules.FromUTF16LE(r.next(2 * int(r.u16())))
+}
+
+func (c *Conn) parse(b []byte) (*parsed, error) {
+	var (
+		p       parsed
+		r       = &reader{b: b}
+		columns []column
+		current *Result
+	)
+
+	finish := func(status uint16, count uint64) {
+		if current == nil && status&doneCount == 0 {
+			return
+		}
+
+		if current == nil {
+			current = &Result{}
+		}
+
+		current.RowsAffected = count
+		current.HasRowsAffected = status&doneCount != 0
+		p.batch.Results = append(p.batch.Results, *current)
+		current = nil
+	}
+
+	for len(r.b) > 0 && r.err == nil {
+		token := r.u8()
+
+		switch token {
+		case tokenColMetadata:
+			count := r.u16()
+			columns = nil
+			if count != 0xffff {
+				for i := 0; i < int(count) && r.err == nil; i++ {
+					r.u32() // user type
+					r.u16() // flags
+					col := readTypeInfo(r)
+					if col.typ == 0x1f && r.err == nil {
+						// Null columns take no room in a row, so a short reply could otherwise fill memory with empty rows
+						r.err = errors.New("result has a column with no type")
+					}
+					col.name = r.bVarchar()
+					columns = append(columns, col)
+				}
+			}
+
+			current = &Result{}
+			for _, col := range columns {
+				current.Columns = append(current.Columns, col.name)
+			}
+
+		case tokenRow, tokenNBCRow:
+			var nulls []byte
+			if token == tokenNBCRow {
+				nulls = r.next((len(columns) + 7) / 8)
+			}
+			if r.err != nil {
+				break
+			}
+
+			row := make([]string, len(columns))
+			for i, col := range columns {
+				if nulls != nil && nulls[i/8]&(1<<(i%8)) != 0 {
+					row[i] = "NULL"
+					continue
+				}
+				row[i] = readValue(r, col)
+			}
+
+			if current == nil {
+				current = &Result{}
+			}
+			current.Rows = append(current.Rows, row)
+
+		case tokenDone, tokenDoneProc, tokenDoneInProc:
+			status := r.u16()
+			r.u16() // current command
+			finish(status, r.u64())
+
+		case tokenError, tokenInfo:
+			r.u16() // length
+			number := int32(r.u32())
+			state := r.u8()
+			class := r.u8()
+			message := r.usVarchar()
+			r.bVarchar() // server name
+			r.bVarchar() // procedure name
+			line := int32(r.u32())
+
+			if token == tokenInfo {
+				p.batch.Messages = append(p.batch.Messages, message)
+				continue
+			}
+
+			if p.err == nil {
+				p.err = &ServerError{Number: number, State: state, Class: class, Message: message, Line: line}
+			}
+
+		case tokenLoginAck:
+			ack := &reader{b: r.next(int(r.u16()))}
+			ack.u8()  // interface
+			ack.u32() // tds version
+			program := ack.bVarchar()
+			version := ack.next(4)
+			c.version = fmt.Sprintf("%s %d.%d.%d", strings.TrimRight(program, "\x00"), version[0], version[1], int(version[2])<<8|int(version[3]))
+			p.loggedIn = true
+
+		case tokenEnvChange:
+			c.envChange(&reader{b: r.next(int(r.u16()))})
+
+		case tokenSSPI:
+			p.sspi = r.next(int(r.u16()))
+
+		case tokenReturnStatus:
+			r.u32()
+
+		case tokenReturnValue:
+			r.u16() // ordinal
+			r.bVarchar()
+			r.u8()  // status
+			r.u32() // user type
+			r.u16() // flags
+			readValue(r, readTypeInfo(r))
+
+		case tokenFeatureExtAck:
+			for r.err == nil {
+				if r.u8() == 0xff {
+					break
+				}
+				r.next(int(r.u32()))
+			}
+
+		case tokenOrder, tokenTabName, tokenColInfo:
+			r.next(int(r.u16()))
+
+		default:
+			return nil, fmt.Errorf("unsupported token 0x%02x in reply", token)
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Login errors have no DONE after them
+	if current != nil {
+		p.batch.Results = append(p.batch.Results, *current)
+	}
+
+	if !p.loggedIn && p.err != nil && p.sspi == nil {
+		return nil, p.err
+	}
+
+	return &p, nil
+}
+
+func (c *Conn) envChange(r *reader) {
+	switch r.u8() {
+	case 1:
+		c.database = r.bVarchar()
+	case 4:
+		if size, err := strconv.Atoi(r.bVarchar()); err == nil && size > headerSize {
+			c.packetSize = size
+		}
+	case 8:
+		if b := r.next(int(r.u8())); len(b) == 8 {
+			c.transaction = binary.LittleEndian.Uint64(b)
+		}
+	case 9, 10:
+		c.transaction = 0
+	}
+}
+
+func readTypeInfo(r *reader) column {
+	col := column{typ: r.u8()}
+
+	switch col.typ {
+	case 0x1f: // null
+	case 0x30, 0x32: // tinyint, bit
+		col.size = 1
+	case 0x34: // smallint
+		col.size = 2
+	case 0x38, 0x3a, 0x3b, 0x7a: // int, smalldatetime, real, smallmoney
+		col.size = 4
+	case 0x7f, 0x3c, 0x3d, 0x3e: // bigint, money, datetime, float
+		col.size = 8
+
+	case 0x24, 0x26, 0x68, 0x6d, 0x6e, 0x6f: // guid, intn, bitn, floatn, moneyn, datetimen
+		col.size = int(r.u8())
+	case 0x37, 0x3f, 0x6a, 0x6c: // decimal, numeric
+		col.size = int(r.u8())
+		col.precision = r.u8()
+		col.scale = r.u8()
+	case 0x28: // date
+	case 0x29, 0x2a, 0x2b: // time, datetime2, datetimeoffset
+		col.scale = r.u8()
+
+	case 0xa5, 0xad: // varbinary, binary
+		col.size = int(r.u16())
+		col.plp = col.size == 0xffff
+	case 0xa7, 0xaf, 0xe7, 0xef: // varchar, char, nvarchar, nchar
+		col.size = int(r.u16())
+		col.plp = col.size == 0xffff
+		r.next(5) // collation
+	case 0xf1: // xml
+		if r.u8() == 1 {
+			r.bVarchar()
+			r.bVarchar()
+			r.usVarchar()
+		}
+		col.plp = true
+	case 0xf0: // clr types, e.g hierarchyid
+		col.size = int(r.u16())
+		r.bVarchar()
+		r.bVarchar()
+		r.bVarchar()
+		r.usVarchar()
+		col.plp = true
+
+	case 0x23, 0x63, 0x22: // text, ntext, image
+		col.size = int(r.u32())
+		if col.typ != 0x22 {
+			r.next(5)
+		}
+		for parts := r.u8(); parts > 0; parts-- {
+			r.usVarchar()
+		}
+	case 0x62: // sql_variant
+		col.size = int(r.u32())
+
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unsupported column type 0x%02x", col.typ)
+		}
+	}
+
+	return col
+}
+
+func readValue(r *reader, col column) string {
+	var data []byte
+
+	switch {
+	case col.plp:
+		length := r.u64()
+		if length == math.MaxUint64 {
+			return "NULL"
+		}
+
+		for r.err == nil {
+			chunk := r.u32()
+			if chunk == 0 {
+				break
+			}
+			data = append(data, r.next(int(chunk))...)
+		}
+
+	case col.typ == 0x1f:
+		return "NULL"
+
+	case col.typ == 0xa5 || col.typ == 0xad || col.typ == 0xa7 || col.typ == 0xaf || col.typ == 0xe7 || col.typ == 0xef:
+		length := r.u16()
+		if length == 0xffff {
+			return "NULL"
+		}
+		data = r.next(int(length))
+
+	case col.typ == 0x23 || col.typ == 0x63 || col.typ == 0x22:
+		pointer := r.u8()
+		if pointer == 0 {
+			return "NULL"
+		}
+		r.next(int(pointer) + 8) // text pointer and timestamp
+		data = r.next(int(r.u32()))
+
+	case col.typ == 0x62:
+		length := r.u32()
+		if length == 0 {
+			return "NULL"
+		}
+		return formatVariant(r.next(int(length)))
+
+	case col.size > 0 && !isByteLen(col.typ):
+		data = r.next(col.size)
+
+	default:
+		length := r.u8()
+		if length == 0 {
+			return "NULL"
+		}
+		data = r.next(int(length))
+	}
+
+	if r.err != nil {
+		return ""
+	}
+
+	return format(col, data)
+}
+
+func isByteLen(typ byte) bool {
+	switch typ {
+	case 0x24, 0x26, 0x68, 0x6d, 0x6e, 0x6f, 0x37, 0x3f, 0x6a, 0x6c, 0x28, 0x29, 0x2a, 0x2b:
+		return true
+	}
+	return false
+}
+
+func format(col column, b []byte) string {
+	switch col.typ {
+	case 0x30, 0x34, 0x38, 0x7f, 0x26: // integers
+		switch len(b) {
+		case 1:
+			return strconv.Itoa(int(b[0]))
+		case 2:
+			return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b))))
+		case 4:
+			return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b))))
+		case 8:
+			return strconv.FormatInt(int64(binary.LittleEndian.Uint64(b)), 10)
+		}
+
+	case 0x32, 0x68: // bit
+		if b[0] != 0 {
+			return "1"
+		}
+		return "0"
+
+	case 0x3b, 0x3e, 0x6d: // real, float
+		switch len(b) {
+		case 4:
+			return strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 'g', -1, 32)
+		case 8:
+			return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)), 'g', -1, 64)
+		}
+
+	case 0x3c, 0x7a, 0x6e: // money
+		switch len(b) {
+		case 4:
+			return formatScaled(big.NewInt(int64(int32(binary.LittleEndian.Uint32(b)))), 4)
+		case 8:
+			value := int64(int32(binary.LittleEndian.Uint32(b)))<<32 | int64(binary.LittleEndian.Uint32(b[4:]))
+			return formatScaled(big.NewInt(value), 4)
+		}
+
+	case 0x3a, 0x3d, 0x6f: // smalldatetime, datetime
+		base := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+		switch len(b) {
+		case 4:
+			return base.AddDate(0, 0, int(binary.LittleEndian.Uint16(b))).
+				Add(time.Duration(binary.LittleEndian.Uint16(b[2:])) * time.Minute).Format("2006-01-02 15:04:05")
+		case 8:
+			// Ticks are 1/300 of a second
+			ticks := time.Duration(binary.LittleEndian.Uint32(b[4:]))
+			return base.AddDate(0, 0, int(int32(binary.LittleEndian.Uint32(b)))).
+				Add(ticks * time.Second / 300).Format("2006-01-02 15:04:05.000")
+		}
+
+	case 0x28: // date
+		return formatDate(b)
+
+	case 0x29: // time
+		return formatTime(b, col.scale)
+
+	case 0x2a: // datetime2
+		if len(b) > 3 {
+			return formatDate(b[len(b)-3:]) + " " + formatTime(b[:len(b)-3], col.scale)
+		}
+
+	case 0x2b: // datetimeoffset, stored as utc
+		if len(b) > 5 {
+			offset := int(int16(binary.LittleEndian.Uint16(b[len(b)-2:])))
+			utc := parseDate(b[len(b)-5 : len(b)-2]).Add(timeOfDay(b[:len(b)-5], col.scale))
+			local := utc.In(time.FixedZone("", offset*60))
+
+			fraction := ""
+			if col.scale > 0 && col.scale <= 9 {
+				fraction = "." + fmt.Sprintf("%09d", local.Nanosecond())[:col.scale]
+			}
+			return local.Format("2006-01-02 15:04:05") + fraction + local.Format(" -07:00")
+		}
+
+	case 0x37, 0x3f, 0x6a, 0x6c: // decimal, numeric
+		magnitude := make([]byte, len(b)-1)
+		for i := range magnitude {
+			magnitude[i] = b[len(b)-1-i]
+		}
+		value := new(big.Int).SetBytes(magnitude)
+		if b[0] == 0 {
+			value.Neg(value)
+		}
+		return formatScaled(value, int(col.scale))
+
+	case 0x24: // uniqueidentifier, the first three groups are little endian
+		if len(b) == 16 {
+			return strings.ToUpper(fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+				binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:]))
+		}
+
+	case 0xe7, 0xef, 0x63, 0xf1: // nvarchar, nchar, ntext, xml
+		return modules.FromUTF16LE(b)
+
+	case 0xa7, 0xaf, 0x23: // varchar, char, text
+		if utf8.Valid(b) {
+			return string(b)
+		}
+
+		// Most collations are a windows code page, latin1 gets close enough
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	}
+
+	return "0x" + strings.ToUpper(hex.EncodeToString(b))
+}
+
+func formatVariant(b []byte) string {
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return "0x" + strings.ToUpper(hex.EncodeToString(b))
+	}
+
+	col := column{typ: b[0]}
+	properties, data := b[2:2+int(b[1])], b[2+int(b[1]):]
+
+	switch col.typ {
+	case 0x37, 0x3f, 0x6a, 0x6c:
+		if len(properties) == 2 {
+			col.precision, col.scale = properties[0], properties[1]
+		}
+	case 0x29, 0x2a, 0x2b:
+		if len(properties) == 1 {
+			col.scale = properties[0]
+		}
+	}
+
+	if len(data) == 0 {
+		return "NULL"
+	}
+
+	return format(col, data)
+}
+
+func formatScaled(value *big.Int, scale int) string {
+	s := new(big.Int).Abs(value).String()
+	if scale > 0 {
+		if len(s) <= scale {
+			s = strings.Repeat("0", scale-len(s)+1) + s
+		}
+		s = s[:len(s)-scale] + "." + s[len(s)-scale:]
+	}
+
+	if value.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func parseDate(b []byte) time.Time {
+	days := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+	return time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, days)
+}
+
+func formatDate(b []byte) string {
+	if len(b) != 3 {
+		return "0x" + hex.EncodeToString(b)
+	}
+	return parseDate(b).Format("2006-01-02")
+}
+
+// timeOfDay reads a time value, in units of 10^-scale seconds
+func timeOfDay(b []byte, scale byte) time.Duration {
+	var units uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		units = units<<8 | uint64(b[i])
+	}
+
+	for ; scale < 9; scale++ {
+		units *= 10
+	}
+	return time.Duration(units)
+}
+
+func formatTime(b []byte, scale byte) string {
+	t := time.Time{}.Add(timeOfDay(b, scale))
+
+	s := t.Format("15:04:05")
+	if scale > 0 && scale <= 9 {
+		s += "." + fmt.Sprintf("%09d", t.Nanosecond())[:scale]
+	}
+	return s
+}
@@ -0,0 +1,64 @@
+package mssql
+
+import (
+	"testing"
+)
+
+// One nvarchar(max) column named a
+var nvarcharMax = []byte{tokenColMetadata, 1, 0, 0, 0, 0, 0, 0, 0, 0xe7, 0xff, 0xff, 0, 0, 0, 0, 0, 1, 'a', 0}
+
+func join(parts ...[]byte) (b []byte) {
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+func TestParseLengths(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		reply   []byte
+		wantErr bool
+	}{
+		{"done", []byte{tokenDone, doneCount, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0}, false},
+		{"done cut short", []byte{tokenDone, doneCount, 0}, true},
+		{"sspi longer than the reply", []byte{tokenSSPI, 0xff, 0xff, 1, 2}, true},
+		{"env change longer than the reply", []byte{tokenEnvChange, 0x10, 0, 1}, true},
+		{"login ack cut short", []byte{tokenLoginAck, 2, 0, 0x74, 0}, false},
+		{"feature ack with a 4GB length", []byte{tokenFeatureExtAck, 1, 0xff, 0xff, 0xff, 0xff}, true},
+		{"more columns than the reply", []byte{tokenColMetadata, 0xfe, 0xff}, true},
+		{"plp chunk with a 4GB length", join(nvarcharMax, []byte{tokenRow, 0x10, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}), true},
+		{"null bitmap cut short", join(nvarcharMax, []byte{tokenNBCRow}), true},
+		{"text with a 4GB length", []byte{tokenColMetadata, 1, 0, 0, 0, 0, 0, 0, 0, 0x22, 0, 0, 0, 0, 0, 0, tokenRow, 16, 0xff, 0xff, 0xff, 0xff}, true},
+		{"rows of untyped columns", join([]byte{tokenColMetadata, 2, 0}, []byte{0, 0, 0, 0, 0, 0, 0x1f, 0}, []byte{0, 0, 0, 0, 0, 0, 0x1f, 0}, []byte{tokenRow, tokenRow}), true},
+		{"datetimeoffset scale above 9", []byte{tokenColMetadata, 1, 0, 0, 0, 0, 0, 0, 0, 0x2b, 0xff, 0, tokenRow, 6, 1, 0, 0, 0, 0, 0}, false},
+		{"variant with properties past its end", []byte{tokenColMetadata, 1, 0, 0, 0, 0, 0, 0, 0, 0x62, 0x10, 0, 0, 0, 0, tokenRow, 3, 0, 0, 0, 0x2b, 0xff, 0}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := (&Conn{}).parse(test.reply)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected an error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPreloginEncryption(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		reply   []byte
+		want    byte
+		wantErr bool
+	}{
+		{"encryption option", []byte{0x01, 0, 6, 0, 1, 0xff, encryptReq}, encryptReq, false},
+		{"offset past the end", []byte{0x01, 0xff, 0xff, 0, 1, 0xff}, 0, true},
+		{"option cut short", []byte{0x01, 0}, 0, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := preloginEncryption(test.reply)
+			if (err != nil) != test.wantErr || got != test.want {
+				t.Fatalf("expected %d (error %v), got %d (%v)", test.want, test.wantErr, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package smb
+
+import (
+	"testing"
+)
+
+func FuzzParseDirectory(f *testing.F) {
+	entry := directoryEntry("a.txt", 10)
+	f.Add(directoryReply(uint32(len(entry)), entry))
+	f.Add(directoryReply(0xffffffff, entry))
+	f.Add([]byte{9, 0, 72})
+
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		parseDirectory(reply)
+	})
+}
+
+func FuzzReadData(f *testing.F) {
+	f.Add([]byte{17, 0, 80, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 'h', 'i'})
+	f.Add([]byte{17, 0, 80, 0, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		data, err := readData(reply)
+		if err == nil && len(data) > len(reply) {
+			t.Fatalf("read %d bytes from a %d byte reply", len(data), len(reply))
+		}
+	})
+}
+
+func FuzzReadRPC(f *testing.F) {
+	response := append(make([]byte, 8), "stub"...)
+	f.Add(rpcFragment(rpcResponse, rpcLastFragment, 28, response), 7)
+	f.Add(append(rpcFragment(rpcResponse, rpcFirstFragment, 28, response), rpcFragment(rpcFault, rpcLastFragment, 28, response)...), 30)
+	f.Add(rpcFragment(rpcResponse, rpcLastFragment, 0, response), 100)
+
+	f.Fuzz(func(t *testing.T, stream []byte, chunk int) {
+		if chunk <= 0 {
+			chunk = 1
+		}
+
+		// Bounded so a stream of unfinished fragments ends
+		reads := 0
+		readRPC(func() ([]byte, error) {
+			reads++
+			if reads > 1000 || len(stream) == 0 {
+				return nil, nil
+			}
+
+			n := min(chunk, len(stream))
+			b := stream[:n]
+			stream = stream[n:]
+			return b, nil
+		})
+	})
+}
+
+func FuzzParseShareEnum(f *testing.F) {
+	f.Add(shareEnumReply(2, [2]string{"C$", "Default share"}, [2]string{"public", ""}))
+	f.Add(shareEnumReply(0xffffffff, [2]string{"C$", ""}))
+	f.Add([]byte{0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, stub []byte) {
+		shares, err := parseShareEnum(stub)
+		if err == nil && len(shares)*12 > len(stub) {
+			t.Fatalf("%d shares from a %d byte reply", len(shares), len(stub))
+		}
+	})
+}
+
+func FuzzAuthenticate(f *testing.F) {
+	challenge := append([]byte{}, ntlmSignature...)
+	challenge = append(challenge, 2, 0, 0, 0)
+	challenge = append(challenge, make([]byte, 28)...)
+	challenge = append(challenge, 16, 0, 16, 0, 48, 0, 0, 0)
+
+	f.Add(append(challenge, 7, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0))
+	f.Add(challenge)
+
+	f.Fuzz(func(t *testing.T, challenge []byte) {
+		n := &ntlmClient{user: "User", domain: "Domain", password: "Password"}
+		n.authenticate(challenge)
+	})
+}
@@ -0,0 +1,211 @@
+package smb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/client/clock"
+	"github.com/NHAS/reverse_ssh/internal/client/modules"
+	"golang.org/x/crypto/md4"
+)
+
+// This is NTLMv2 without sealing, only what a SMB login needs. The ntlmssp package keeps the session key to itself
+// and SMB signing (required by domain controllers and newer windows) is keyed with it
+
+const (
+	ntlmNegotiateFlags = 0x00000001 | // unicode
+		0x00000004 | // request target
+		0x00000010 | // sign
+		0x00000200 | // ntlm
+		0x00008000 | // always sign
+		0x00080000 | // extended session security
+		0x00800000 | // target info
+		0x20000000 | // 128
+		0x40000000 | // key exchange
+		0x80000000 // 56
+
+	ntlmKeyExchange = 0x40000000
+
+	avTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+type ntlmClient struct {
+	domain, user, password string
+
+	sessionKey []byte
+}
+
+func (n *ntlmClient) negotiate() []byte {
+	b := append([]byte{}, ntlmSignature...)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, ntlmNegotiateFlags)
+	// empty domain and workstation
+	return append(b, make([]byte, 16)...)
+}
+
+func (n *ntlmClient) authenticate(challenge []byte) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.HasPrefix(challenge, ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("server sent an invalid NTLM challenge")
+	}
+
+	flags := binary.LittleEndian.Uint32(challenge[20:]) & ntlmNegotiateFlags
+	serverChallenge := challenge[24:32]
+
+	infoLength := uint64(binary.LittleEndian.Uint16(challenge[40:]))
+	infoOffset := uint64(binary.LittleEndian.Uint32(challenge[44:]))
+	if infoOffset > uint64(len(challenge)) || infoLength > uint64(len(challenge))-infoOffset {
+		return nil, errors.New("server sent an invalid NTLM challenge")
+	}
+	targetInfo := challenge[infoOffset : infoOffset+infoLength]
+
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+
+	timestamp, fromServer := avPair(targetInfo, avTimestamp)
+	if !fromServer {
+		timestamp = binary.LittleEndian.AppendUint64(nil, uint64(clock.Now().UnixNano()/100+116444736000000000))
+	}
+
+	ntResponse, sessionBaseKey := ntlmV2(n.password, n.user, n.domain, serverChallenge, clientChallenge, timestamp, targetInfo)
+
+	// With a server timestamp the LM response must be empty
+	lmResponse := make([]byte, 24)
+	if !fromServer {
+		lmResponse = lmV2(n.password, n.user, n.domain, serverChallenge, clientChallenge)
+	}
+
+	n.sessionKey = sessionBaseKey
+	var encryptedKey []byte
+	if flags&ntlmKeyExchange != 0 {
+		n.sessionKey = make([]byte, 16)
+		rand.Read(n.sessionKey)
+
+		cipher, err := rc4.NewCipher(sessionBaseKey)
+		if err != nil {
+			return nil, err
+		}
+		encryptedKey = make([]byte, 16)
+		cipher.XORKeyStream(encryptedKey, n.sessionKey)
+	}
+
+	const headerSize = 64
+
+	header := append([]byte{}, ntlmSignature...)
+	header = binary.LittleEndian.AppendUint32(header, 3)
+
+	var payload []byte
+	for _, field := range [][]byte{lmResponse, ntResponse, modules.UTF16LE(n.domain), modules.UTF16LE(n.user), nil, encryptedKey} {
+		header = binary.LittleEndian.AppendUint16(header, uint16(len(field)))
+		header = binary.LittleEndian.AppendUint16(header, uint16(len(field)))
+		header = binary.LittleEndian.AppendUint32(header, uint32(headerSize+len(payload)))
+		payload = append(payload, field...)
+	}
+	header = binary.LittleEndian.AppendUint32(header, flags)
+
+	return append(header, payload...), nil
+}
+
+func ntowfV2(password, user, domain string) []byte {
+	h := md4.New()
+	h.Write(modules.UTF16LE(password))
+
+	mac := hmac.New(md5.New, h.Sum(nil))
+	mac.Write(modules.UTF16LE(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmV2 gives the NTLMv2 response and the session base key, MS-NLMP 3.3.2
+func ntlmV2(password, user, domain string, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (response, sessionBaseKey []byte) {
+	key := ntowfV2(password, user, domain)
+
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	mac := hmac.New(md5.New, key)
+	mac.Write(serverChallenge)
+	mac.Write(temp)
+	proof := mac.Sum(nil)
+
+	mac = hmac.New(md5.New, key)
+	mac.Write(proof)
+
+	return append(proof, temp...), mac.Sum(nil)
+}
+
+func lmV2(password, user, domain string, serverChallenge, clientChallenge []byte) []byte {
+	mac := hmac.New(md5.New, ntowfV2(password, user, domain))
+	mac.Write(serverChallenge)
+	mac.Write(clientChallenge)
+	return append(mac.Sum(nil), clientChallenge...)
+}
+
+func avPair(targetInfo []byte, id uint16) ([]byte, bool) {
+	for len(targetInfo) >= 4 {
+		pairID := binary.LittleEndian.Uint16(targetInfo)
+		length := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if pairID == 0 || 4+length > len(targetInfo) {
+			break
+		}
+
+		if pairID == id {
+			return targetInfo[4 : 4+length], true
+		}
+		targetInfo = targetInfo[4+length:]
+	}
+	return nil, false
+}
+
+// SPNEGO wrapping, SMB2 session setup carries the NTLM messages inside these
+
+var (
+	oidSPNEGO  = []byte{0x06, 0x06, 0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}
+	oidNTLMSSP = []byte{0x06, 0x0a, 0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x37, 0x02, 0x02, 0x0a}
+)
+
+func der(tag byte, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+
+	out := []byte{tag}
+	switch length := len(body); {
+	case length < 0x80:
+		out = append(out, byte(length))
+	case length < 0x100:
+		out = append(out, 0x81, byte(length))
+	default:
+		out = append(out, 0x82, byte(length>>8), byte(length))
+	}
+	return append(out, body...)
+}
+
+func negTokenInit(token []byte) []byte {
+	return der(0x60, oidSPNEGO,
+		der(0xa0,
+			der(0x30,
+				der(0xa0, der(0x30, oidNTLMSSP)),
+				der(0xa2, der(0x04, token)))))
+}
+
+func negTokenResp(token []byte) []byte {
+	return der(0xa1, der(0x30, der(0xa2, der(0x04, token))))
+}
+
+// ntlmToken pulls the NTLM message out of a SPNEGO reply, it is always last so the ASN.1 does not need to be walked
+func ntlmToken(blob []byte) ([]byte, error) {
+	i := bytes.Index(blob, ntlmSignature)
+	if i < 0 {
+		return nil, errors.New("server did not send an NTLM challenge, it may only accept kerberos")
+	}
+	return blob[i:], nil
+}
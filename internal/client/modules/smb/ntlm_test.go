@@ -0,0 +1,71 @@
+package smb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vector from MS-NLMP 4.2.4
+func TestNTLMv2(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	targetInfo := decode("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+
+	response, sessionBaseKey := ntlmV2("Password", "User", "Domain", decode("0123456789abcdef"), bytes.Repeat([]byte{0xaa}, 8), make([]byte, 8), targetInfo)
+
+	if proof := response[:16]; !bytes.Equal(proof, decode("68cd0ab851e51c96aabc927bebef6a1c")) {
+		t.Errorf("NTProofStr was %x", proof)
+	}
+
+	if !bytes.Equal(sessionBaseKey, decode("8de40ccadbc14a82f15cb0ad0de95ca3")) {
+		t.Errorf("session base key was %x", sessionBaseKey)
+	}
+
+	if lm := lmV2("Password", "User", "Domain", decode("0123456789abcdef"), bytes.Repeat([]byte{0xaa}, 8)); !bytes.Equal(lm[:16], decode("86c35097ac9cec102554764a57cccc19")) {
+		t.Errorf("LMv2 response was %x", lm[:16])
+	}
+}
+
+func TestAuthenticateChallenge(t *testing.T) {
+	challenge := func(infoLength uint16, infoOffset uint32, targetInfo []byte) []byte {
+		b := append([]byte{}, ntlmSignature...)
+		b = binary.LittleEndian.AppendUint32(b, 2)
+		b = append(b, make([]byte, 28)...)
+		b = binary.LittleEndian.AppendUint16(b, infoLength)
+		b = binary.LittleEndian.AppendUint16(b, infoLength)
+		b = binary.LittleEndian.AppendUint32(b, infoOffset)
+		return append(b, targetInfo...)
+	}
+
+	// A timestamp and the end of the list
+	targetInfo := []byte{7, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0}
+
+	for _, test := range []struct {
+		name      string
+		challenge []byte
+		wantErr   bool
+	}{
+		{"target info", challenge(uint16(len(targetInfo)), 48, targetInfo), false},
+		{"no target info", challenge(0, 48, nil), false},
+		{"too short", challenge(0, 48, nil)[:40], true},
+		{"not a challenge", append([]byte("NTLMSSP\x00\x03\x00\x00\x00"), make([]byte, 40)...), true},
+		{"length past the end", challenge(0xffff, 48, targetInfo), true},
+		{"offset past the end", challenge(4, 0xffffffff, targetInfo), true},
+		{"pair longer than the target info", challenge(8, 48, []byte{7, 0, 0xff, 0xff, 1, 2, 3, 4}), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n := &ntlmClient{user: "User", domain: "Domain", password: "Password"}
+			if _, err := n.authenticate(test.challenge); (err != nil) != test.wantErr {
+				t.Fatalf("expected an error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,561 @@
+// Package smb is a read only SMB 2.0.2/2.1 client, for listing shares and files and reading small files
+package smb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules"
+)
+
+const (
+	commandNegotiate      = 0x00
+	commandSessionSetup   = 0x01
+	commandLogoff         = 0x02
+	commandTreeConnect    = 0x03
+	commandTreeDisconnect = 0x04
+	commandCreate         = 0x05
+	commandClose          = 0x06
+	commandRead           = 0x08
+	commandWrite          = 0x09
+	commandQueryDirectory = 0x0e
+
+	flagAsync  = 0x02
+	flagSigned = 0x08
+
+	headerSize = 64
+
+	sessionGuest = 0x01
+	sessionNull  = 0x02
+
+	securitySigningEnabled  = 0x01
+	securitySigningRequired = 0x02
+
+	attributeDirectory = 0x10
+)
+
+// NTSTATUS values that change what happens next, rather than only being reported
+const (
+	statusSuccess                = 0x00000000
+	statusPending                = 0x00000103
+	statusBufferOverflow         = 0x80000005
+	statusNoMoreFiles            = 0x80000006
+	statusEndOfFile              = 0xc0000011
+	statusMoreProcessingRequired = 0xc0000016
+)
+
+var statusNames = map[uint32]string{
+	0xc0000022: "access denied",
+	0xc000006d: "logon failure, check the user and password",
+	0xc000006e: "account restriction",
+	0xc0000071: "password expired",
+	0xc0000072: "account disabled",
+	0xc0000224: "password must change",
+	0xc000015b: "logon type not granted",
+	0xc0000034: "no such file",
+	0xc000003a: "no such path",
+	0xc00000cc: "no such share",
+	0xc00000ba: "is a directory",
+	0xc0000103: "not a directory",
+	0xc0000043: "sharing violation, the file is open elsewhere",
+	0xc0000203: "session was deleted",
+	0xc00000bb: "not supported",
+}
+
+// StatusError is an NTSTATUS the server replied with
+type StatusError uint32
+
+func (s StatusError) Error() string {
+	if name, ok := statusNames[uint32(s)]; ok {
+		return fmt.Sprintf("%s (0x%08x)", name, uint32(s))
+	}
+	return fmt.Sprintf("NTSTATUS 0x%08x", uint32(s))
+}
+
+type Config struct {
+	// host:port, the port is normally 445
+	Address string
+
+	// DOMAIN\user or user@domain, empty for an anonymous (null) session
+	User, Password string
+
+	Timeout time.Duration
+}
+
+type Session struct {
+	conn net.Conn
+	host string
+
+	dialect    uint16
+	maxRead    uint32
+	messageID  uint64
+	sessionID  uint64
+	signingKey []byte
+
+	// Guest is set when the server let us in as guest or anonymously, which cannot sign
+	Guest bool
+}
+
+type Tree struct {
+	session *Session
+	id      uint32
+
+	Share string
+}
+
+type File struct {
+	Name     string
+	Size     uint64
+	Modified time.Time
+	IsDir    bool
+}
+
+func Dial(config Config) (*Session, error) {
+	if config.Timeout == 0 {
+		config.Timeout = 15 * time.Second
+	}
+
+	host, _, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", config.Address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{conn: conn, host: host}
+
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+	if err := s.login(config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return s, nil
+}
+
+func (s *Session) login(config Config) error {
+	negotiate := make([]byte, 36, 40)
+	binary.LittleEndian.PutUint16(negotiate[0:], 36)
+	binary.LittleEndian.PutUint16(negotiate[2:], 2) // dialect count
+	binary.LittleEndian.PutUint16(negotiate[4:], securitySigningEnabled)
+	rand.Read(negotiate[12:28]) // client guid
+	negotiate = binary.LittleEndian.AppendUint16(negotiate, 0x0202)
+	negotiate = binary.LittleEndian.AppendUint16(negotiate, 0x0210)
+
+	resp, err := s.request(commandNegotiate, 0, negotiate)
+	if err != nil {
+		return err
+	}
+	if resp.status != statusSuccess {
+		return fmt.Errorf("negotiate failed: %w", StatusError(resp.status))
+	}
+
+	reply := resp.body
+	if len(reply) < 64 {
+		return errors.New("negotiate reply too short")
+	}
+
+	securityMode := binary.LittleEndian.Uint16(reply[2:])
+	s.dialect = binary.LittleEndian.Uint16(reply[4:])
+	s.maxRead = min(binary.LittleEndian.Uint32(reply[32:]), 65536)
+	if s.dialect != 0x0202 && s.dialect != 0x0210 {
+		return fmt.Errorf("server picked an unsupported dialect 0x%04x", s.dialect)
+	}
+
+	domain, user := modules.SplitUser(config.User)
+	ntlm := &ntlmClient{domain: domain, user: user, password: config.Password}
+
+	resp, err = s.sessionSetup(negTokenInit(ntlm.negotiate()))
+	if err != nil {
+		return err
+	}
+	if resp.status != statusMoreProcessingRequired {
+		return fmt.Errorf("session setup failed: %w", StatusError(resp.status))
+	}
+
+	challenge, err := ntlmToken(securityBuffer(resp.body, 4))
+	if err != nil {
+		return err
+	}
+
+	authenticate, err := ntlm.authenticate(challenge)
+	if err != nil {
+		return err
+	}
+
+	resp, err = s.sessionSetup(negTokenResp(authenticate))
+	if err != nil {
+		return err
+	}
+	if resp.status != statusSuccess {
+		return fmt.Errorf("login failed: %w", StatusError(resp.status))
+	}
+
+	sessionFlags := binary.LittleEndian.Uint16(resp.body[2:])
+	s.Guest = sessionFlags&(sessionGuest|sessionNull) != 0
+
+	if s.Guest {
+		if securityMode&securitySigningRequired != 0 {
+			return errors.New("server requires signing, which a guest or anonymous login cannot do")
+		}
+		return nil
+	}
+
+	s.signingKey = ntlm.sessionKey
+	return nil
+}
+
+func (s *Session) sessionSetup(token []byte) (*response, error) {
+	setup := make([]byte, 24)
+	binary.LittleEndian.PutUint16(setup[0:], 25)
+	setup[3] = securitySigningEnabled
+	binary.LittleEndian.PutUint16(setup[12:], headerSize+24)
+	binary.LittleEndian.PutUint16(setup[14:], uint16(len(token)))
+
+	resp, err := s.request(commandSessionSetup, 0, append(setup, token...))
+	if err == nil && len(resp.body) < 8 {
+		err = errors.New("session setup reply too short")
+	}
+	return resp, err
+}
+
+// securityBuffer reads an offset (from the start of the header) and length pair at position in a reply body
+func securityBuffer(body []byte, position int) []byte {
+	b, _ := buffer(body, uint64(binary.LittleEndian.Uint16(body[position:])), uint64(binary.LittleEndian.Uint16(body[position+2:])))
+	return b
+}
+
+// buffer is length bytes at offset, from the start of the header, in a reply body. Both come from the server so neither is trusted
+func buffer(body []byte, offset, length uint64) ([]byte, bool) {
+	if offset < headerSize || offset-headerSize > uint64(len(body)) || length > uint64(len(body))-(offset-headerSize) {
+		return nil, false
+	}
+
+	start := int(offset - headerSize)
+	return body[start : start+int(length)], true
+}
+
+type response struct {
+	status uint32
+	treeID uint32
+	body   []byte
+}
+
+func (s *Session) request(command uint16, treeID uint32, body []byte) (*response, error) {
+	header := make([]byte, headerSize)
+	copy(header, "\xfeSMB")
+	binary.LittleEndian.PutUint16(header[4:], headerSize)
+	if s.dialect == 0x0210 {
+		binary.LittleEndian.PutUint16(header[6:], 1) // credit charge
+	}
+	binary.LittleEndian.PutUint16(header[12:], command)
+	binary.LittleEndian.PutUint16(header[14:], 64) // credits requested
+	binary.LittleEndian.PutUint64(header[24:], s.messageID)
+	binary.LittleEndian.PutUint32(header[32:], 0xfeff)
+	binary.LittleEndian.PutUint32(header[36:], treeID)
+	binary.LittleEndian.PutUint64(header[40:], s.sessionID)
+
+	message := append(header, body...)
+	if s.signingKey != nil {
+		binary.LittleEndian.PutUint32(message[16:], flagSigned)
+		mac := hmac.New(sha256.New, s.signingKey)
+		mac.Write(message)
+		copy(message[48:64], mac.Sum(nil))
+	}
+
+	id := s.messageID
+	s.messageID++
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(message)))
+	if _, err := s.conn.Write(append(frame, message...)); err != nil {
+		return nil, err
+	}
+
+	for {
+		frame := make([]byte, 4)
+		if _, err := io.ReadFull(s.conn, frame); err != nil {
+			return nil, err
+		}
+
+		reply := make([]byte, binary.BigEndian.Uint32(frame)&0xffffff)
+		if _, err := io.ReadFull(s.conn, reply); err != nil {
+			return nil, err
+		}
+
+		if len(reply) < headerSize || string(reply[:4]) != "\xfeSMB" {
+			return nil, errors.New("server sent something that is not SMB2, it may only speak SMB1")
+		}
+
+		status := binary.LittleEndian.Uint32(reply[8:])
+		flags := binary.LittleEndian.Uint32(reply[16:])
+
+		// The real reply follows an interim one
+		if status == statusPending && flags&flagAsync != 0 {
+			continue
+		}
+
+		if binary.LittleEndian.Uint64(reply[24:]) != id {
+			continue
+		}
+
+		if command == commandSessionSetup {
+			s.sessionID = binary.LittleEndian.Uint64(reply[40:])
+		}
+
+		return &response{
+			status: status,
+			treeID: binary.LittleEndian.Uint32(reply[36:]),
+			body:   reply[headerSize:],
+		}, nil
+	}
+}
+
+// Mount connects to a share, e.g C$ or IPC$
+func (s *Session) Mount(share string) (*Tree, error) {
+	path := modules.UTF16LE(`\\` + s.host + `\` + share)
+
+	connect := make([]byte, 8)
+	binary.LittleEndian.PutUint16(connect[0:], 9)
+	binary.LittleEndian.PutUint16(connect[4:], headerSize+8)
+	binary.LittleEndian.PutUint16(connect[6:], uint16(len(path)))
+
+	resp, err := s.request(commandTreeConnect, 0, append(connect, path...))
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != statusSuccess {
+		return nil, fmt.Errorf("unable to connect to %s: %w", share, StatusError(resp.status))
+	}
+
+	return &Tree{session: s, id: resp.treeID, Share: share}, nil
+}
+
+func (s *Session) Close() error {
+	s.request(commandLogoff, 0, []byte{4, 0, 0, 0})
+	return s.conn.Close()
+}
+
+func (t *Tree) Close() error {
+	_, err := t.session.request(commandTreeDisconnect, t.id, []byte{4, 0, 0, 0})
+	return err
+}
+
+// open opens a file, directory or pipe relative to the share root
+func (t *Tree) open(path string, access, options uint32) ([]byte, error) {
+	name := modules.UTF16LE(normalise(path))
+
+	create := make([]byte, 56)
+	binary.LittleEndian.PutUint16(create[0:], 57)
+	binary.LittleEndian.PutUint32(create[4:], 2) // impersonation
+	binary.LittleEndian.PutUint32(create[24:], access)
+	binary.LittleEndian.PutUint32(create[32:], 7) // share read, write and delete
+	binary.LittleEndian.PutUint32(create[36:], 1) // open existing
+	binary.LittleEndian.PutUint32(create[40:], options)
+	binary.LittleEndian.PutUint16(create[44:], headerSize+56)
+	binary.LittleEndian.PutUint16(create[46:], uint16(len(name)))
+
+	if len(name) == 0 {
+		// The buffer cannot be empty, even for the root of the share
+		name = []byte{0}
+	}
+
+	resp, err := t.session.request(commandCreate, t.id, append(create, name...))
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != statusSuccess {
+		return nil, fmt.Errorf("unable to open %q: %w", path, StatusError(resp.status))
+	}
+	if len(resp.body) < 80 {
+		return nil, errors.New("create reply too short")
+	}
+
+	return resp.body[64:80], nil
+}
+
+func (t *Tree) close(fileID []byte) {
+	closing := make([]byte, 24)
+	binary.LittleEndian.PutUint16(closing[0:], 24)
+	copy(closing[8:], fileID)
+	t.session.request(commandClose, t.id, closing)
+}
+
+// List lists a directory, "" is the root of the share
+func (t *Tree) List(path string) ([]File, error) {
+	// list directory, read attributes, synchronise
+	fileID, err := t.open(path, 0x00100081, 0x01)
+	if err != nil {
+		return nil, err
+	}
+	defer t.close(fileID)
+
+	pattern := modules.UTF16LE("*")
+
+	var files []File
+	for restart := true; ; restart = false {
+		query := make([]byte, 32)
+		binary.LittleEndian.PutUint16(query[0:], 33)
+		query[2] = 0x01 // FileDirectoryInformation
+		if restart {
+			query[3] = 0x01
+		}
+		copy(query[8:24], fileID)
+		binary.LittleEndian.PutUint16(query[24:], headerSize+32)
+		binary.LittleEndian.PutUint16(query[26:], uint16(len(pattern)))
+		binary.LittleEndian.PutUint32(query[28:], t.session.maxRead)
+
+		resp, err := t.session.request(commandQueryDirectory, t.id, append(query, pattern...))
+		if err != nil {
+			return nil, err
+		}
+		if resp.status == statusNoMoreFiles {
+			return files, nil
+		}
+		if resp.status != statusSuccess {
+			return nil, fmt.Errorf("unable to list %q: %w", path, StatusError(resp.status))
+		}
+
+		listed, err := parseDirectory(resp.body)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, listed...)
+	}
+}
+
+// parseDirectory reads the FileDirectoryInformation entries in a query directory reply
+func parseDirectory(reply []byte) (files []File, err error) {
+	if len(reply) < 8 {
+		return nil, errors.New("directory listing reply is malformed")
+	}
+
+	entries, ok := buffer(reply, uint64(binary.LittleEndian.Uint16(reply[2:])), uint64(binary.LittleEndian.Uint32(reply[4:])))
+	if !ok {
+		return nil, errors.New("directory listing reply is malformed")
+	}
+
+	for len(entries) >= 64 {
+		nameLength := uint64(binary.LittleEndian.Uint32(entries[60:]))
+		if nameLength > uint64(len(entries)-64) {
+			break
+		}
+
+		name := modules.FromUTF16LE(entries[64 : 64+int(nameLength)])
+		if name != "." && name != ".." {
+			files = append(files, File{
+				Name:     name,
+				Size:     binary.LittleEndian.Uint64(entries[40:]),
+				Modified: filetime(binary.LittleEndian.Uint64(entries[24:])),
+				IsDir:    binary.LittleEndian.Uint32(entries[56:])&attributeDirectory != 0,
+			})
+		}
+
+		next := binary.LittleEndian.Uint32(entries[0:])
+		if next == 0 || uint64(next) > uint64(len(entries)) {
+			break
+		}
+		entries = entries[next:]
+	}
+
+	return files, nil
+}
+
+// ReadFile reads up to limit bytes of a file, truncated is set if there was more
+func (t *Tree) ReadFile(path string, limit int) (content []byte, truncated bool, err error) {
+	// read data, read attributes, synchronise
+	fileID, err := t.open(path, 0x00100081, 0x40)
+	if err != nil {
+		return nil, false, err
+	}
+	defer t.close(fileID)
+
+	for len(content) <= limit {
+		chunk, err := t.read(fileID, uint64(len(content)))
+		if err != nil {
+			return nil, false, err
+		}
+		if len(chunk) == 0 {
+			return content, false, nil
+		}
+		content = append(content, chunk...)
+	}
+
+	return content[:limit], true, nil
+}
+
+func (t *Tree) read(fileID []byte, offset uint64) ([]byte, error) {
+	read := make([]byte, 49)
+	binary.LittleEndian.PutUint16(read[0:], 49)
+	read[2] = 0x50
+	binary.LittleEndian.PutUint32(read[4:], t.session.maxRead)
+	binary.LittleEndian.PutUint64(read[8:], offset)
+	copy(read[16:32], fileID)
+
+	resp, err := t.session.request(commandRead, t.id, read)
+	if err != nil {
+		return nil, err
+	}
+	if resp.status == statusEndOfFile {
+		return nil, nil
+	}
+	// Pipes say a message did not fit, the rest comes with the next read
+	if resp.status != statusSuccess && resp.status != statusBufferOverflow {
+		return nil, fmt.Errorf("read failed: %w", StatusError(resp.status))
+	}
+
+	return readData(resp.body)
+}
+
+// readData is the data in a read reply
+func readData(reply []byte) ([]byte, error) {
+	if len(reply) < 8 {
+		return nil, errors.New("read reply is malformed")
+	}
+
+	data, ok := buffer(reply, uint64(reply[2]), uint64(binary.LittleEndian.Uint32(reply[4:])))
+	if !ok {
+		return nil, errors.New("read reply is malformed")
+	}
+	return data, nil
+}
+
+func (t *Tree) write(fileID []byte, data []byte) error {
+	write := make([]byte, 48)
+	binary.LittleEndian.PutUint16(write[0:], 49)
+	binary.LittleEndian.PutUint16(write[2:], headerSize+48)
+	binary.LittleEndian.PutUint32(write[4:], uint32(len(data)))
+	copy(write[16:32], fileID)
+
+	resp, err := t.session.request(commandWrite, t.id, append(write, data...))
+	if err != nil {
+		return err
+	}
+	if resp.status != statusSuccess {
+		return fmt.Errorf("write failed: %w", StatusError(resp.status))
+	}
+	return nil
+}
+
+func normalise(path string) string {
+	return strings.Trim(strings.ReplaceAll(path, "/", `\`), `\`)
+}
+
+// filetime converts windows 100ns intervals since 1601 to a time
+func filetime(ft uint64) time.Time {
+	if ft == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ft-116444736000000000)*100)
+}
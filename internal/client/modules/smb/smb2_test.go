@@ -0,0 +1,81 @@
+package smb
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules"
+)
+
+// directoryReply is a query directory reply body holding entries, with the length field set to length
+func directoryReply(length uint32, entries ...[]byte) []byte {
+	var data []byte
+	for i, entry := range entries {
+		if i < len(entries)-1 {
+			binary.LittleEndian.PutUint32(entry[0:], uint32(len(entry)))
+		}
+		data = append(data, entry...)
+	}
+
+	reply := make([]byte, 8)
+	binary.LittleEndian.PutUint16(reply[0:], 9)
+	binary.LittleEndian.PutUint16(reply[2:], headerSize+8)
+	binary.LittleEndian.PutUint32(reply[4:], length)
+	return append(reply, data...)
+}
+
+func directoryEntry(name string, nameLength uint32) []byte {
+	entry := make([]byte, 64)
+	binary.LittleEndian.PutUint32(entry[60:], nameLength)
+	return append(entry, modules.UTF16LE(name)...)
+}
+
+func TestParseDirectory(t *testing.T) {
+	valid := directoryEntry("a.txt", 10)
+	both := append(append([]byte{}, valid...), directoryEntry("b", 2)...)
+
+	for _, test := range []struct {
+		name    string
+		reply   []byte
+		want    int
+		wantErr bool
+	}{
+		{"two entries", directoryReply(uint32(len(both)), directoryEntry("a.txt", 10), directoryEntry("b", 2)), 2, false},
+		{"no structure", []byte{9, 0, 72}, 0, true},
+		{"length past the end", directoryReply(0xffffffff, valid), 0, true},
+		{"offset inside the header", append([]byte{9, 0, 8, 0, 1, 0, 0, 0}, valid...), 0, true},
+		{"offset past the end", append([]byte{9, 0, 0xff, 0xff, 0, 0, 0, 0}, valid...), 0, true},
+		{"name longer than the entry", directoryReply(uint32(len(valid)), directoryEntry("a.txt", 0xffffffff)), 0, false},
+		{"entry cut short", directoryReply(32, valid), 0, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := parseDirectory(test.reply)
+			if (err != nil) != test.wantErr || len(files) != test.want {
+				t.Fatalf("expected %d files (error %v), got %d (%v)", test.want, test.wantErr, len(files), err)
+			}
+		})
+	}
+}
+
+func TestReadData(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		reply   []byte
+		want    string
+		wantErr bool
+	}{
+		{"data", []byte{17, 0, 80, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 'h', 'i'}, "hi", false},
+		{"empty", []byte{17, 0, 80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, "", false},
+		{"no structure", []byte{17, 0, 80}, "", true},
+		{"length past the end", []byte{17, 0, 80, 0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 'h'}, "", true},
+		{"offset inside the header", []byte{17, 0, 10, 0, 1, 0, 0, 0}, "", true},
+		{"offset past the end", []byte{17, 0, 0xff, 0, 0, 0, 0, 0}, "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := readData(test.reply)
+			if (err != nil) != test.wantErr || string(data) != test.want {
+				t.Fatalf("expected %q (error %v), got %q (%v)", test.want, test.wantErr, data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package smb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules"
+)
+
+// Share listing is a NetrShareEnum DCE/RPC call over the srvsvc named pipe on IPC$
+
+const (
+	rpcRequest  = 0
+	rpcResponse = 2
+	rpcFault    = 3
+	rpcBind     = 11
+	rpcBindAck  = 12
+
+	rpcFirstFragment = 0x01
+	rpcLastFragment  = 0x02
+
+	opNetrShareEnum = 15
+
+	// Shares with this bit set are the hidden administrative ones, C$ ADMIN$ and IPC$
+	shareSpecial = 0x80000000
+
+	// Largest reply joined from fragments, far more than any share listing needs
+	maxRPCReply = 4 * 1024 * 1024
+)
+
+type Share struct {
+	Name    string
+	Type    string
+	Comment string
+	Hidden  bool
+}
+
+var shareTypes = map[uint32]string{
+	0: "disk",
+	1: "printer",
+	2: "device",
+	3: "ipc",
+}
+
+// Shares lists the shares on the server, including the hidden ones
+func (s *Session) Shares() ([]Share, error) {
+	ipc, err := s.Mount("IPC$")
+	if err != nil {
+		return nil, err
+	}
+	defer ipc.Close()
+
+	// read and write data, read attributes, synchronise
+	pipe, err := ipc.open("srvsvc", 0x0012019f, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ipc.close(pipe)
+
+	if err := ipc.write(pipe, rpcBindRequest()); err != nil {
+		return nil, err
+	}
+
+	read := func() ([]byte, error) {
+		return ipc.read(pipe, 0)
+	}
+
+	ack, err := readRPC(read)
+	if err != nil {
+		return nil, err
+	}
+	if ack.ptype != rpcBindAck {
+		return nil, errors.New("srvsvc would not bind")
+	}
+
+	if err := ipc.write(pipe, rpcCall(opNetrShareEnum, shareEnumRequest(s.host))); err != nil {
+		return nil, err
+	}
+
+	reply, err := readRPC(read)
+	if err != nil {
+		return nil, err
+	}
+	if reply.ptype == rpcFault {
+		return nil, fmt.Errorf("share listing faulted: 0x%08x", binary.LittleEndian.Uint32(append(reply.stub, 0, 0, 0, 0)))
+	}
+
+	return parseShareEnum(reply.stub)
+}
+
+type rpcReply struct {
+	ptype byte
+	stub  []byte
+}
+
+// readRPC reads fragments from the pipe until the last one, joining their stubs
+func readRPC(read func() ([]byte, error)) (*rpcReply, error) {
+	var (
+		reply   rpcReply
+		pending []byte
+	)
+
+	for {
+		for len(pending) < 16 || len(pending) < int(binary.LittleEndian.Uint16(pending[8:])) {
+			chunk, err := read()
+			if err != nil {
+				return nil, err
+			}
+			if len(chunk) == 0 {
+				return nil, errors.New("pipe closed mid reply")
+			}
+			pending = append(pending, chunk...)
+		}
+
+		length := int(binary.LittleEndian.Uint16(pending[8:]))
+		if length < 16 {
+			return nil, fmt.Errorf("rpc fragment length %d is shorter than its header", length)
+		}
+		fragment := pending[:length]
+		pending = pending[length:]
+
+		reply.ptype = fragment[2]
+		switch reply.ptype {
+		case rpcResponse, rpcFault:
+			if len(fragment) < 24 {
+				return nil, errors.New("rpc reply too short")
+			}
+			reply.stub = append(reply.stub, fragment[24:]...)
+		default:
+			reply.stub = append(reply.stub, fragment[16:]...)
+		}
+
+		if len(reply.stub) > maxRPCReply {
+			return nil, fmt.Errorf("rpc reply is larger than %d bytes", maxRPCReply)
+		}
+
+		if fragment[3]&rpcLastFragment != 0 {
+			return &reply, nil
+		}
+	}
+}
+
+func rpcHeader(ptype byte, length int) []byte {
+	header := []byte{5, 0, ptype, rpcFirstFragment | rpcLastFragment, 0x10, 0, 0, 0}
+	header = binary.LittleEndian.AppendUint16(header, uint16(length))
+	header = binary.LittleEndian.AppendUint16(header, 0) // auth length
+	return binary.LittleEndian.AppendUint32(header, 1)   // call id
+}
+
+func uuid(s string) []byte {
+	b, _ := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+
+	// The first three groups are little endian on the wire
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+func rpcBindRequest() []byte {
+	var body []byte
+	body = binary.LittleEndian.AppendUint16(body, 4280) // max transmit fragment
+	body = binary.LittleEndian.AppendUint16(body, 4280) // max receive fragment
+	body = binary.LittleEndian.AppendUint32(body, 0)    // association group
+	body = append(body, 1, 0, 0, 0)                     // one context
+	body = binary.LittleEndian.AppendUint16(body, 0)    // context id
+	body = append(body, 1, 0)                           // one transfer syntax
+	body = append(body, uuid("4b324fc8-1670-01d3-1278-5a47bf6ee188")...)
+	body = binary.LittleEndian.AppendUint32(body, 3) // srvsvc version 3.0
+	body = append(body, uuid("8a885d04-1ceb-11c9-9fe8-08002b104860")...)
+	body = binary.LittleEndian.AppendUint32(body, 2) // NDR version 2
+
+	return append(rpcHeader(rpcBind, 16+len(body)), body...)
+}
+
+func rpcCall(opnum uint16, stub []byte) []byte {
+	var body []byte
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(stub))) // allocation hint
+	body = binary.LittleEndian.AppendUint16(body, 0)                 // context id
+	body = binary.LittleEndian.AppendUint16(body, opnum)
+	body = append(body, stub...)
+
+	return append(rpcHeader(rpcRequest, 16+len(body)), body...)
+}
+
+// ndrString is a conformant varying null terminated UTF-16 string, padded to 4 bytes
+func ndrString(s string) []byte {
+	encoded := modules.UTF16LE(s + "\x00")
+	count := uint32(len(encoded) / 2)
+
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, count)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, count)
+	b = append(b, encoded...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func shareEnumRequest(host string) []byte {
+	var stub []byte
+	stub = binary.LittleEndian.AppendUint32(stub, 0x00020000) // server name pointer
+	stub = append(stub, ndrString(`\\`+host)...)
+	stub = binary.LittleEndian.AppendUint32(stub, 1)          // level 1, names types and comments
+	stub = binary.LittleEndian.AppendUint32(stub, 1)          // union arm
+	stub = binary.LittleEndian.AppendUint32(stub, 0x00020004) // container pointer
+	stub = binary.LittleEndian.AppendUint32(stub, 0)          // entries read
+	stub = binary.LittleEndian.AppendUint32(stub, 0)          // null buffer
+	stub = binary.LittleEndian.AppendUint32(stub, 0xffffffff) // preferred maximum length
+	stub = binary.LittleEndian.AppendUint32(stub, 0)          // no resume handle
+	return stub
+}
+
+type ndrReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *ndrReader) u32() uint32 {
+	r.pos = (r.pos + 3) &^ 3
+	if r.err != nil || r.pos+4 > len(r.b) {
+		r.err = errors.New("share listing reply was cut short")
+		return 0
+	}
+
+	v := binary.LittleEndian.Uint32(r.b[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *ndrReader) str() string {
+	r.u32() // max count
+	r.u32() // offset
+	count := uint64(r.u32())
+	if r.err != nil || count > uint64(len(r.b)-r.pos)/2 {
+		r.err = errors.New("share listing reply was cut short")
+		return ""
+	}
+
+	s := modules.FromUTF16LE(r.b[r.pos : r.pos+2*int(count)])
+	r.pos += 2 * int(count)
+	return strings.TrimRight(s, "\x00")
+}
+
+func parseShareEnum(stub []byte) ([]Share, error) {
+	if len(stub) < 4 {
+		return nil, errors.New("share listing reply was cut short")
+	}
+	if code := binary.LittleEndian.Uint32(stub[len(stub)-4:]); code != 0 {
+		return nil, fmt.Errorf("share listing failed with windows error %d", code)
+	}
+
+	r := &ndrReader{b: stub}
+	r.u32() // level
+	r.u32() // union arm
+	if r.u32() == 0 {
+		return nil, nil
+	}
+
+	count := r.u32()
+	if r.u32() == 0 {
+		return nil, nil
+	}
+	r.u32() // array max count
+
+	// Each entry takes 12 bytes, so the count cannot be more than what is left
+	if r.err != nil || uint64(count) > uint64(len(stub)-r.pos)/12 {
+		return nil, errors.New("share listing reply was cut short")
+	}
+
+	type entry struct {
+		name, comment uint32
+		typ           uint32
+	}
+
+	entries := make([]entry, 0, count)
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		entries = append(entries, entry{name: r.u32(), typ: r.u32(), comment: r.u32()})
+	}
+
+	shares := make([]Share, 0, len(entries))
+	for _, e := range entries {
+		var share Share
+		if e.name != 0 {
+			share.Name = r.str()
+		}
+		if e.comment != 0 {
+			share.Comment = r.str()
+		}
+
+		share.Hidden = e.typ&shareSpecial != 0
+		share.Type = shareTypes[e.typ&^shareSpecial]
+		if share.Type == "" {
+			share.Type = fmt.Sprintf("0x%x", e.typ)
+		}
+
+		shares = append(shares, share)
+	}
+
+	return shares, r.err
+}
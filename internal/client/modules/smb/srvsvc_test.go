@@ -0,0 +1,130 @@
+package smb
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func rpcFragment(ptype, flags byte, length uint16, body []byte) []byte {
+	header := []byte{5, 0, ptype, flags, 0x10, 0, 0, 0}
+	header = binary.LittleEndian.AppendUint16(header, length)
+	header = append(header, 0, 0, 1, 0, 0, 0)
+	return append(header, body...)
+}
+
+// pipe hands out chunks, then reports the pipe closed
+func pipe(chunks ...[]byte) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if len(chunks) == 0 {
+			return nil, errors.New("no more reads")
+		}
+		chunk := chunks[0]
+		chunks = chunks[1:]
+		return chunk, nil
+	}
+}
+
+func TestReadRPC(t *testing.T) {
+	response := append(make([]byte, 8), "stub"...)
+	first := rpcFragment(rpcResponse, rpcFirstFragment, 28, response)
+	last := rpcFragment(rpcResponse, rpcLastFragment, 28, response)
+	whole := append(append([]byte{}, first...), last...)
+
+	for _, test := range []struct {
+		name    string
+		chunks  [][]byte
+		want    string
+		wantErr bool
+	}{
+		{"two fragments in one read", [][]byte{whole}, "stubstub", false},
+		{"fragment split across reads", [][]byte{whole[:5], whole[5:20], whole[20:]}, "stubstub", false},
+		{"bind ack", [][]byte{rpcFragment(rpcBindAck, rpcLastFragment, 18, []byte{1, 2})}, "\x01\x02", false},
+		{"zero fragment length", [][]byte{rpcFragment(rpcResponse, rpcLastFragment, 0, response)}, "", true},
+		{"fragment length inside the header", [][]byte{rpcFragment(rpcResponse, rpcLastFragment, 3, response)}, "", true},
+		{"response shorter than its header", [][]byte{rpcFragment(rpcResponse, rpcLastFragment, 20, response)}, "", true},
+		{"fragment length past what was sent", [][]byte{rpcFragment(rpcResponse, rpcLastFragment, 0xffff, response)}, "", true},
+		{"pipe closed", [][]byte{whole[:10], {}}, "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reply, err := readRPC(pipe(test.chunks...))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected an error %v, got %v", test.wantErr, err)
+			}
+			if err == nil && string(reply.stub) != test.want {
+				t.Fatalf("expected the stub %q, got %q", test.want, reply.stub)
+			}
+		})
+	}
+}
+
+func TestReadRPCSizeLimit(t *testing.T) {
+	fragment := rpcFragment(rpcResponse, 0, 0xffff, make([]byte, 0xffff-16))
+	_, err := readRPC(func() ([]byte, error) {
+		return fragment, nil
+	})
+	if err == nil {
+		t.Fatal("a reply that never ends should be refused once it is too large")
+	}
+}
+
+// shareEnumReply is a NetrShareEnum level 1 reply stub listing disk shares, each a name and comment
+func shareEnumReply(count uint32, shares ...[2]string) []byte {
+	var stub []byte
+	u32 := func(v uint32) {
+		stub = binary.LittleEndian.AppendUint32(stub, v)
+	}
+
+	u32(1)          // level
+	u32(1)          // union arm
+	u32(0x00020000) // container pointer
+	u32(count)
+	u32(0x00020004) // array pointer
+	u32(count)
+	for range shares {
+		u32(0x00020008) // name pointer
+		u32(0)
+		u32(0x0002000c) // comment pointer
+	}
+	for _, share := range shares {
+		stub = append(stub, ndrString(share[0])...)
+		stub = append(stub, ndrString(share[1])...)
+	}
+	u32(uint32(len(shares))) // total entries
+	u32(0)                   // no resume handle
+	u32(0)                   // status
+	return stub
+}
+
+func TestParseShareEnum(t *testing.T) {
+	valid := shareEnumReply(2, [2]string{"C$", "Default share"}, [2]string{"public", ""})
+
+	badString := shareEnumReply(1, [2]string{"C$", ""})
+	binary.LittleEndian.PutUint32(badString[44:], 0xffffffff)
+
+	for _, test := range []struct {
+		name    string
+		stub    []byte
+		want    int
+		wantErr bool
+	}{
+		{"two shares", valid, 2, false},
+		{"empty", nil, 0, true},
+		{"windows error", []byte{5, 0, 0, 0}, 0, true},
+		{"count past the end", shareEnumReply(0xffffffff, [2]string{"C$", ""}), 0, true},
+		{"string longer than the reply", badString, 0, true},
+		{"cut short", append(valid[:30:30], 0, 0, 0, 0), 0, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			shares, err := parseShareEnum(test.stub)
+			if (err != nil) != test.wantErr || (!test.wantErr && len(shares) != test.want) {
+				t.Fatalf("expected %d shares (error %v), got %d (%v)", test.want, test.wantErr, len(shares), err)
+			}
+		})
+	}
+
+	shares, _ := parseShareEnum(valid)
+	if shares[0].Name != "C$" || shares[0].Comment != "Default share" || shares[1].Name != "public" {
+		t.Errorf("shares were read wrongly: %+v", shares)
+	}
+}
@@ -0,0 +1,378 @@
+// Package winrm runs commands over WS-Management with NTLM, sealing messages itself on plain http as windows requires
+package winrm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/client/modules"
+	"github.com/bodgit/ntlmssp"
+)
+
+const (
+	soapContentType   = "application/soap+xml;charset=UTF-8"
+	encryptedBoundary = "Encrypted Boundary"
+	encryptedProtocol = "application/HTTP-SPNEGO-session-encrypted"
+	encryptedType     = `multipart/encrypted;protocol="` + encryptedProtocol + `";boundary="` + encryptedBoundary + `"`
+
+	// Largest reply read, output comes back in small pieces so a real one is nowhere near this
+	maxReplySize = 16 * 1024 * 1024
+)
+
+type Config struct {
+	// e.g http://10.0.0.5:5985/wsman
+	Endpoint string
+
+	// DOMAIN\user or user@domain, a bare user is a local account
+	User, Password string
+
+	Timeout time.Duration
+}
+
+type Client struct {
+	config Config
+
+	http *http.Client
+	ntlm *ntlmssp.Client
+
+	// Plain http needs every message sealed with the NTLM session, https does not
+	seal bool
+
+	shellID string
+}
+
+// Connect logs in and opens a cmd shell, commands run in it one after the other
+func Connect(config Config) (*Client, error) {
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+
+	c := &Client{
+		config: config,
+		seal:   strings.HasPrefix(strings.ToLower(config.Endpoint), "http://"),
+		http: &http.Client{
+			// NTLM authenticates the connection, so there must only ever be one
+			Transport: &http.Transport{
+				DialContext:     (&net.Dialer{Timeout: config.Timeout}).DialContext,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				MaxConnsPerHost: 1,
+			},
+			Timeout: config.Timeout + operationTimeout,
+		},
+	}
+
+	if err := c.authenticate(); err != nil {
+		return nil, err
+	}
+
+	reply, err := c.call(actionCreate, "", []option{{"WINRS_NOPROFILE", "FALSE"}, {"WINRS_CODEPAGE", "65001"}},
+		`<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create shell: %w", err)
+	}
+
+	shell := reply.find("ShellId")
+	if shell == nil {
+		return nil, errors.New("server did not return a shell id")
+	}
+	c.shellID = shell.text
+
+	return c, nil
+}
+
+// Run runs command with cmd.exe in the shell, copying its output as it arrives
+func (c *Client) Run(command string, stdout, stderr io.Writer) (int, error) {
+	reply, err := c.call(actionCommand, c.shellID, []option{{"WINRS_CONSOLEMODE_STDIN", "TRUE"}, {"WINRS_SKIP_CMD_SHELL", "FALSE"}},
+		"<rsp:CommandLine><rsp:Command>"+escape(command)+"</rsp:Command></rsp:CommandLine>")
+	if err != nil {
+		return -1, err
+	}
+
+	id := reply.find("CommandId")
+	if id == nil {
+		return -1, errors.New("server did not return a command id")
+	}
+	defer c.call(actionSignal, c.shellID, nil,
+		`<rsp:Signal CommandId="`+escape(id.text)+`"><rsp:Code>http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate</rsp:Code></rsp:Signal>`)
+
+	for {
+		reply, err := c.call(actionReceive, c.shellID, nil,
+			`<rsp:Receive><rsp:DesiredStream CommandId="`+escape(id.text)+`">stdout stderr</rsp:DesiredStream></rsp:Receive>`)
+		if err != nil {
+			var fault *Fault
+			if errors.As(err, &fault) && fault.TimedOut {
+				// Nothing was written before the operation timeout, ask again
+				continue
+			}
+			return -1, err
+		}
+
+		for _, stream := range reply.findAll("Stream") {
+			output, err := base64.StdEncoding.DecodeString(stream.text)
+			if err != nil {
+				continue
+			}
+
+			if stream.attrs["Name"] == "stderr" {
+				stderr.Write(output)
+			} else {
+				stdout.Write(output)
+			}
+		}
+
+		state := reply.find("CommandState")
+		if state != nil && strings.HasSuffix(state.attrs["State"], "/Done") {
+			code := -1
+			if exit := state.find("ExitCode"); exit != nil {
+				code, _ = strconv.Atoi(exit.text)
+			}
+			return code, nil
+		}
+	}
+}
+
+// Close deletes the shell on the server
+func (c *Client) Close() error {
+	_, err := c.call(actionDelete, c.shellID, nil, "")
+	c.http.CloseIdleConnections()
+	return err
+}
+
+func (c *Client) authenticate() error {
+	domain, user := modules.SplitUser(c.config.User)
+
+	var err error
+	c.ntlm, err = ntlmssp.NewClient(ntlmssp.SetDomain(domain), ntlmssp.SetUserInfo(user, c.config.Password), ntlmssp.SetVersion(ntlmssp.DefaultVersion()))
+	if err != nil {
+		return err
+	}
+
+	negotiate, err := c.ntlm.Authenticate(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.post(nil, soapContentType, "Negotiate "+base64.StdEncoding.EncodeToString(negotiate))
+	if err != nil {
+		return err
+	}
+
+	var challenge []byte
+	for _, header := range resp.Header.Values("WWW-Authenticate") {
+		if token, ok := strings.CutPrefix(header, "Negotiate "); ok {
+			challenge, err = base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				return fmt.Errorf("bad challenge from server: %w", err)
+			}
+		}
+	}
+
+	if challenge == nil {
+		return fmt.Errorf("server did not offer negotiate authentication (status %s)", resp.Status)
+	}
+
+	var bindings *ntlmssp.ChannelBindings
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		bindings = channelBindings(resp.TLS.PeerCertificates[0])
+	}
+
+	authenticate, err := c.ntlm.Authenticate(challenge, bindings)
+	if err != nil {
+		return err
+	}
+
+	resp, err = c.post(nil, soapContentType, "Negotiate "+base64.StdEncoding.EncodeToString(authenticate))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("login failed, check the user and password (winrm needs the user to be an administrator or in Remote Management Users)")
+	}
+
+	if c.seal && c.ntlm.SecuritySession() == nil {
+		return errors.New("server did not agree to seal messages, try https")
+	}
+
+	return nil
+}
+
+// post sends one request on the authenticated connection, reading all of the reply so the connection is kept
+func (c *Client) post(body []byte, contentType, authorization string) (*response, error) {
+	req, err := http.NewRequest(http.MethodPost, c.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxReplySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxReplySize {
+		return nil, fmt.Errorf("reply is larger than %d bytes", maxReplySize)
+	}
+
+	return &response{Response: resp, body: content}, nil
+}
+
+type response struct {
+	*http.Response
+	body []byte
+}
+
+func (c *Client) call(action, shellID string, options []option, body string) (*node, error) {
+	message := []byte(envelope(c.config.Endpoint, action, shellID, options, body))
+
+	contentType := soapContentType
+	if c.seal {
+		var err error
+		message, err = c.wrap(message)
+		if err != nil {
+			return nil, err
+		}
+		contentType = encryptedType
+	}
+
+	resp, err := c.post(message, contentType, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errors.New("server dropped the login, reconnect")
+	}
+
+	reply := resp.body
+	if c.seal && strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/encrypted") {
+		reply, err = c.unwrap(reply)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(reply) == 0 {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("server replied %s", resp.Status)
+		}
+		return &node{}, nil
+	}
+
+	root, err := parseXML(reply)
+	if err != nil {
+		return nil, fmt.Errorf("server replied %s with invalid xml: %w", resp.Status, err)
+	}
+
+	if fault := root.find("Fault"); fault != nil {
+		return nil, newFault(fault)
+	}
+
+	return root, nil
+}
+
+// wrap seals a message as MS-WSMV describes, the layout has to be exact as windows does not parse it as real mime
+func (c *Client) wrap(message []byte) ([]byte, error) {
+	sealed, signature, err := c.ntlm.SecuritySession().Wrap(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "--%s\r\n\tContent-Type: %s\r\n\tOriginalContent: type=%s;Length=%d\r\n", encryptedBoundary, encryptedProtocol, soapContentType, len(message))
+	fmt.Fprintf(&b, "--%s\r\n\tContent-Type: application/octet-stream\r\n", encryptedBoundary)
+	binary.Write(&b, binary.LittleEndian, uint32(len(signature)))
+	b.Write(signature)
+	b.Write(sealed)
+	fmt.Fprintf(&b, "--%s--\r\n", encryptedBoundary)
+
+	return b.Bytes(), nil
+}
+
+func (c *Client) unwrap(body []byte) ([]byte, error) {
+	sealed, signature, err := sealedParts(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ntlm.SecuritySession().Unwrap(sealed, signature)
+}
+
+// sealedParts splits a sealed reply into the sealed message and its signature, both lengths are the server's so are checked against what was sent
+func sealedParts(body []byte) (sealed, signature []byte, err error) {
+	_, after, ok := bytes.Cut(body, []byte("Length="))
+	if !ok {
+		return nil, nil, errors.New("sealed reply has no length")
+	}
+
+	end := bytes.IndexAny(after, "\r\n")
+	if end < 0 {
+		return nil, nil, errors.New("sealed reply has no length")
+	}
+
+	length, err := strconv.ParseUint(string(after[:end]), 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sealed reply has a bad length: %w", err)
+	}
+
+	_, data, ok := bytes.Cut(after, []byte("application/octet-stream\r\n"))
+	if !ok || len(data) < 4 {
+		return nil, nil, errors.New("sealed reply has no data")
+	}
+
+	signatureLength := uint64(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if signatureLength > uint64(len(data)) || length > uint64(len(data))-signatureLength {
+		return nil, nil, errors.New("sealed reply is cut short")
+	}
+
+	return data[signatureLength : signatureLength+length], data[:signatureLength], nil
+}
+
+// channelBindings ties the login to the tls connection (RFC 5929 tls-server-end-point), for servers that harden https logins
+func channelBindings(cert *x509.Certificate) *ntlmssp.ChannelBindings {
+	hash := crypto.SHA256
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		hash = crypto.SHA512
+	}
+
+	h := hash.New()
+	h.Write(cert.Raw)
+
+	return &ntlmssp.ChannelBindings{
+		ApplicationData: append([]byte(ntlmssp.TLSServerEndPoint+":"), h.Sum(nil)...),
+	}
+}
+
+func messageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("uuid:%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,42 @@
+package winrm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// sealedReply is laid out as windows sends it, with the lengths given rather than worked out
+func sealedReply(length string, signatureLength uint32, data string) []byte {
+	b := fmt.Appendf(nil, "--%s\r\n\tContent-Type: %s\r\n\tOriginalContent: type=%s;Length=%s\r\n", encryptedBoundary, encryptedProtocol, soapContentType, length)
+	b = fmt.Appendf(b, "--%s\r\n\tContent-Type: application/octet-stream\r\n", encryptedBoundary)
+	b = binary.LittleEndian.AppendUint32(b, signatureLength)
+	b = append(b, data...)
+	return fmt.Appendf(b, "--%s--\r\n", encryptedBoundary)
+}
+
+func TestSealedParts(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		body              []byte
+		sealed, signature string
+		wantErr           bool
+	}{
+		{"sealed", sealedReply("5", 4, "SIGNhello"), "hello", "SIGN", false},
+		{"no length", []byte("--Encrypted Boundary\r\n"), "", "", true},
+		{"negative length", sealedReply("-5", 4, "SIGNhello"), "", "", true},
+		{"length past the end", sealedReply("4294967295", 4, "SIGNhello"), "", "", true},
+		{"signature past the end", sealedReply("5", 0xffffffff, "SIGNhello"), "", "", true},
+		{"no data", []byte("Length=5\r\napplication/octet-stream\r\n\x04"), "", "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sealed, signature, err := sealedParts(test.body)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected an error %v, got %v", test.wantErr, err)
+			}
+			if string(sealed) != test.sealed || string(signature) != test.signature {
+				t.Fatalf("expected %q signed %q, got %q signed %q", test.sealed, test.signature, sealed, signature)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package winrm
+
+import (
+	"testing"
+)
+
+func FuzzSealedParts(f *testing.F) {
+	f.Add(sealedReply("5", 4, "SIGNhello"))
+	f.Add(sealedReply("4294967295", 0xffffffff, "SIGNhello"))
+	f.Add([]byte("Length=5\r\napplication/octet-stream\r\n"))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		sealed, signature, err := sealedParts(body)
+		if err == nil && len(sealed)+len(signature) > len(body) {
+			t.Fatalf("%d bytes from a %d byte reply", len(sealed)+len(signature), len(body))
+		}
+	})
+}
+
+func FuzzParseXML(f *testing.F) {
+	f.Add([]byte(`<s:Envelope><s:Body><s:Fault><s:Text>denied</s:Text></s:Fault></s:Body></s:Envelope>`))
+	f.Add([]byte(`<a><b x="1">text</b><Stream Name="stdout">aGk=</Stream></a>`))
+	f.Add([]byte(`<a><b>`))
+
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		root, err := parseXML(reply)
+		if err != nil {
+			return
+		}
+
+		if fault := root.find("Fault"); fault != nil {
+			newFault(fault)
+		}
+		root.findAll("Stream")
+	})
+}
@@ -0,0 +1,179 @@
+package winrm
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	actionCreate  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	actionDelete  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	actionCommand = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command"
+	actionReceive = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive"
+	actionSignal  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Signal"
+
+	resourceCmd = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd"
+
+	// How long a receive waits for output before the server gives up with a timeout fault
+	operationTimeout = 20 * time.Second
+
+	// Deepest nesting accepted in a reply, WS-Management ones are a dozen or so deep and nodes are searched recursively
+	maxDepth = 64
+)
+
+type option struct {
+	name, value string
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func envelope(to, action, shellID string, options []option, body string) string {
+	var b strings.Builder
+
+	b.WriteString(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" ` +
+		`xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" xmlns:p="http://schemas.microsoft.com/wbem/wsman/1/wsman.xsd" ` +
+		`xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><s:Header>`)
+
+	fmt.Fprintf(&b, `<a:To>%s</a:To>`, escape(to))
+	b.WriteString(`<a:ReplyTo><a:Address s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>`)
+	b.WriteString(`<w:MaxEnvelopeSize s:mustUnderstand="true">153600</w:MaxEnvelopeSize>`)
+	fmt.Fprintf(&b, `<a:MessageID>%s</a:MessageID>`, messageID())
+	b.WriteString(`<w:Locale xml:lang="en-US" s:mustUnderstand="false"/><p:DataLocale xml:lang="en-US" s:mustUnderstand="false"/>`)
+	fmt.Fprintf(&b, `<w:OperationTimeout>PT%dS</w:OperationTimeout>`, int(operationTimeout.Seconds()))
+	fmt.Fprintf(&b, `<w:ResourceURI s:mustUnderstand="true">%s</w:ResourceURI>`, resourceCmd)
+	fmt.Fprintf(&b, `<a:Action s:mustUnderstand="true">%s</a:Action>`, action)
+
+	if shellID != "" {
+		fmt.Fprintf(&b, `<w:SelectorSet><w:Selector Name="ShellId">%s</w:Selector></w:SelectorSet>`, escape(shellID))
+	}
+
+	if len(options) > 0 {
+		b.WriteString(`<w:OptionSet>`)
+		for _, o := range options {
+			fmt.Fprintf(&b, `<w:Option Name="%s">%s</w:Option>`, escape(o.name), escape(o.value))
+		}
+		b.WriteString(`</w:OptionSet>`)
+	}
+
+	b.WriteString(`</s:Header><s:Body>`)
+	b.WriteString(body)
+	b.WriteString(`</s:Body></s:Envelope>`)
+
+	return b.String()
+}
+
+// node is a parsed xml element, looked up by local name as the namespace prefixes vary between windows versions
+type node struct {
+	name     string
+	attrs    map[string]string
+	text     string
+	children []*node
+}
+
+func parseXML(b []byte) (*node, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+
+	root := &node{}
+	stack := []*node{root}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if len(stack) == 1 && len(root.children) > 0 {
+				return root, nil
+			}
+			return nil, err
+		}
+
+		top := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) > maxDepth {
+				return nil, fmt.Errorf("reply is nested more than %d deep", maxDepth)
+			}
+
+			n := &node{name: t.Name.Local, attrs: map[string]string{}}
+			for _, a := range t.Attr {
+				n.attrs[a.Name.Local] = a.Value
+			}
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			top.text = strings.TrimSpace(top.text)
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			top.text += string(t)
+		}
+	}
+}
+
+func (n *node) find(name string) *node {
+	for _, child := range n.children {
+		if child.name == name {
+			return child
+		}
+		if found := child.find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (n *node) findAll(name string) (found []*node) {
+	for _, child := range n.children {
+		if child.name == name {
+			found = append(found, child)
+		}
+		found = append(found, child.findAll(name)...)
+	}
+	return found
+}
+
+// Fault is a SOAP fault from the server, e.g access denied or a timeout while waiting for output
+type Fault struct {
+	Code     string
+	Message  string
+	TimedOut bool
+}
+
+func (f *Fault) Error() string {
+	if f.Code != "" {
+		return fmt.Sprintf("%s (%s)", f.Message, f.Code)
+	}
+	return f.Message
+}
+
+func newFault(fault *node) *Fault {
+	f := &Fault{}
+
+	if subcode := fault.find("Subcode"); subcode != nil {
+		if value := subcode.find("Value"); value != nil {
+			f.TimedOut = strings.HasSuffix(value.text, "TimedOut")
+		}
+	}
+
+	if detail := fault.find("WSManFault"); detail != nil {
+		f.Code = detail.attrs["Code"]
+		if message := detail.find("Message"); message != nil {
+			f.Message = message.text
+		}
+	}
+
+	if f.Message == "" {
+		if text := fault.find("Text"); text != nil {
+			f.Message = text.text
+		}
+	}
+
+	if f.Message == "" {
+		f.Message = "unknown fault"
+	}
+
+	return f
+}
@@ -0,0 +1,39 @@
+package winrm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseXML(t *testing.T) {
+	fault := `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><s:Fault><s:Code><s:Subcode><s:Value>w:TimedOut</s:Value></s:Subcode></s:Code>` +
+		`<s:Detail><f:WSManFault xmlns:f="http://schemas.microsoft.com/wbem/wsman/1/wsmanfault" Code="2150858793"><f:Message>The operation timed out</f:Message></f:WSManFault></s:Detail></s:Fault></s:Body></s:Envelope>`
+
+	for _, test := range []struct {
+		name    string
+		reply   string
+		wantErr bool
+	}{
+		{"fault", fault, false},
+		{"cut short", fault[:len(fault)/2], true},
+		{"empty", "", true},
+		{"nested too deep", strings.Repeat("<a>", maxDepth+1) + strings.Repeat("</a>", maxDepth+1), true},
+		{"nested as deep as allowed", strings.Repeat("<a>", maxDepth) + strings.Repeat("</a>", maxDepth), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseXML([]byte(test.reply)); (err != nil) != test.wantErr {
+				t.Fatalf("expected an error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+
+	root, err := parseXML([]byte(fault))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFault(root.find("Fault"))
+	if !f.TimedOut || f.Code != "2150858793" || f.Message != "The operation timed out" {
+		t.Errorf("fault was read wrongly: %+v", f)
+	}
+}
@@ -0,0 +1,263 @@
+package qos
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type Class int
+
+const (
+	Bulk Class = iota
+	Normal
+	High
+)
+
+var classNames = [...]string{Bulk: "bulk", Normal: "normal", High: "high"}
+
+// Share of the connection each class gets when they are all busy
+var weights = [...]int{Bulk: 1, Normal: 4, High: 16}
+
+const (
+	// Writes are split into chunks of this size so a big write cant hold the connection for long
+	quantum = 16 * 1024
+	// A write that is stuck (usually waiting for the other side to open its window) only holds up the rest for this long
+	maxHold = 100 * time.Millisecond
+)
+
+func (c Class) String() string {
+	if c < Bulk || c > High {
+		return "unknown"
+	}
+	return classNames[c]
+}
+
+func ParseClass(s string) (Class, error) {
+	for c, name := range classNames {
+		if strings.EqualFold(s, name) {
+			return Class(c), nil
+		}
+	}
+
+	return Normal, fmt.Errorf("unknown class %q, must be one of %s", s, strings.Join(classNames[:], ", "))
+}
+
+// Scheduler shares one connection between writers by class, using smooth weighted round robin between classes that are waiting and first come first served within a class
+type Scheduler struct {
+	lck     sync.Mutex
+	busy    bool
+	waiting [len(classNames)][]chan struct{}
+	current [len(classNames)]int
+}
+
+func (s *Scheduler) acquire(c Class) (release func()) {
+	s.lck.Lock()
+	if !s.busy {
+		s.busy = true
+		s.lck.Unlock()
+	} else {
+		turn := make(chan struct{})
+		s.waiting[c] = append(s.waiting[c], turn)
+		s.lck.Unlock()
+
+		<-turn
+	}
+
+	var once sync.Once
+	timer := time.AfterFunc(maxHold, func() {
+		once.Do(s.next)
+	})
+
+	return func() {
+		timer.Stop()
+		once.Do(s.next)
+	}
+}
+
+// next hands the connection to the next waiting writer
+func (s *Scheduler) next() {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	total, best := 0, -1
+	for c := range s.waiting {
+		if len(s.waiting[c]) == 0 {
+			continue
+		}
+
+		s.current[c] += weights[c]
+		total += weights[c]
+		if best == -1 || s.current[c] > s.current[best] {
+			best = c
+		}
+	}
+
+	if best == -1 {
+		s.busy = false
+		return
+	}
+
+	s.current[best] -= total
+
+	turn := s.waiting[best][0]
+	s.waiting[best] = s.waiting[best][1:]
+	close(turn)
+}
+
+type writer struct {
+	w     io.Writer
+	s     *Scheduler
+	class Class
+}
+
+func (w *writer) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b[:min(len(b), quantum)]
+
+		release := w.s.acquire(w.class)
+		written, err := w.w.Write(chunk)
+		release()
+
+		n += written
+		if err != nil {
+			return n, err
+		}
+
+		b = b[written:]
+	}
+
+	return n, nil
+}
+
+// Writer wraps w so its writes take their turn with everything else sent through this scheduler
+func (s *Scheduler) Writer(w io.Writer, c Class) io.Writer {
+	return &writer{w: w, s: s, class: c}
+}
+
+var (
+	schedulersLck sync.Mutex
+	schedulers    = map[ssh.Conn]*Scheduler{}
+)
+
+// For returns the scheduler for data being sent to a server
+func For(serverConn ssh.Conn) *Scheduler {
+	schedulersLck.Lock()
+	defer schedulersLck.Unlock()
+
+	s, ok := schedulers[serverConn]
+	if !ok {
+		s = &Scheduler{}
+		schedulers[serverConn] = s
+	}
+
+	return s
+}
+
+func Forget(serverConn ssh.Conn) {
+	schedulersLck.Lock()
+	defer schedulersLck.Unlock()
+
+	delete(schedulers, serverConn)
+}
+
+var (
+	rulesLck sync.RWMutex
+	// Match (host:port, :port or host) to class
+	rules = map[string]Class{}
+)
+
+func splitMatch(match string) (host, port string, err error) {
+	if strings.Contains(match, ":") {
+		host, port, err = net.SplitHostPort(match)
+		if err != nil {
+			return "", "", err
+		}
+
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", fmt.Errorf("invalid port %q", port)
+		}
+	} else {
+		host = match
+	}
+
+	if host == "*" {
+		host = ""
+	}
+
+	if host == "" && port == "" {
+		return "", "", fmt.Errorf("invalid match %q, expected host:port, :port or host", match)
+	}
+
+	return host, port, nil
+}
+
+// SetRule sets the class for forwards to (or listening on) match, which is host:port, :port for any host, or a host for any port
+func SetRule(match string, c Class) error {
+	host, port, err := splitMatch(match)
+	if err != nil {
+		return err
+	}
+
+	rulesLck.Lock()
+	defer rulesLck.Unlock()
+
+	rules[net.JoinHostPort(host, port)] = c
+
+	return nil
+}
+
+func RemoveRule(match string) error {
+	host, port, err := splitMatch(match)
+	if err != nil {
+		return err
+	}
+
+	rulesLck.Lock()
+	defer rulesLck.Unlock()
+
+	key := net.JoinHostPort(host, port)
+	if _, ok := rules[key]; !ok {
+		return fmt.Errorf("no rule for %q", match)
+	}
+
+	delete(rules, key)
+
+	return nil
+}
+
+// Rules lists each rule as "match class"
+func Rules() []string {
+	rulesLck.RLock()
+	defer rulesLck.RUnlock()
+
+	var out []string
+	for match, c := range rules {
+		out = append(out, match+" "+c.String())
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// ClassFor finds the class for an address, an exact rule wins over a port rule, which wins over a host rule. Anything without a rule is normal
+func ClassFor(host string, port uint32) Class {
+	rulesLck.RLock()
+	defer rulesLck.RUnlock()
+
+	p := strconv.Itoa(int(port))
+	for _, key := range []string{net.JoinHostPort(host, p), net.JoinHostPort("", p), net.JoinHostPort(host, "")} {
+		if c, ok := rules[key]; ok {
+			return c
+		}
+	}
+
+	return Normal
+}
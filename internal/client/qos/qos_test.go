@@ -0,0 +1,81 @@
+package qos
+
+import "testing"
+
+func TestWeightedTurns(t *testing.T) {
+	s := &Scheduler{busy: true}
+
+	for i := 0; i < 40; i++ {
+		for _, c := range []Class{High, Bulk} {
+			s.waiting[c] = append(s.waiting[c], make(chan struct{}))
+		}
+	}
+
+	count := map[Class]int{}
+	for i := 0; i < weights[High]+weights[Bulk]; i++ {
+		before := map[Class]int{High: len(s.waiting[High]), Bulk: len(s.waiting[Bulk])}
+		s.next()
+
+		for c, n := range before {
+			if len(s.waiting[c]) != n {
+				count[c]++
+			}
+		}
+	}
+
+	if count[High] != weights[High] || count[Bulk] != weights[Bulk] {
+		t.Fatalf("expected %d high and %d bulk turns, got %v", weights[High], weights[Bulk], count)
+	}
+}
+
+func TestClassFor(t *testing.T) {
+	defer func() {
+		rules = map[string]Class{}
+	}()
+
+	for match, c := range map[string]Class{
+		":3389":          High,
+		"10.0.0.5":       Bulk,
+		"10.0.0.5:445":   High,
+		"*:22":           High,
+		"fileserver:873": Bulk,
+	} {
+		if err := SetRule(match, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, bad := range []string{"", ":notaport", "*"} {
+		if err := SetRule(bad, High); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+
+	tests := []struct {
+		host string
+		port uint32
+		want Class
+	}{
+		{"10.0.0.1", 3389, High},
+		{"10.0.0.5", 3389, High},
+		{"10.0.0.5", 80, Bulk},
+		{"10.0.0.5", 445, High},
+		{"10.0.0.9", 22, High},
+		{"fileserver", 873, Bulk},
+		{"10.0.0.9", 80, Normal},
+	}
+
+	for _, test := range tests {
+		if got := ClassFor(test.host, test.port); got != test.want {
+			t.Errorf("%s:%d expected %s got %s", test.host, test.port, test.want, got)
+		}
+	}
+
+	if err := RemoveRule("*:22"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ClassFor("10.0.0.9", 22); got != Normal {
+		t.Fatalf("expected rule to be removed, got %s", got)
+	}
+}
@@ -0,0 +1,350 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/nat"
+	"github.com/NHAS/reverse_ssh/pkg/namedpipe"
+	"golang.org/x/crypto/ssh"
+)
+
+// Moving between the destination and its fallbacks (see Settings.Fallbacks). The client moves down the list when its transport cant be reached or stays poor,
+// and back up once a more preferred transport has answered for a while
+const (
+	linkProbeInterval = 5 * time.Second
+	linkProbeTimeout  = 5 * time.Second
+
+	// Probes judged together, about 30 seconds of link. It is poor when poorLoss of them were lost or the median round trip is over poorLatency
+	linkQualityWindow = 6
+	poorLoss          = 2
+	poorLatency       = 1500 * time.Millisecond
+
+	// Poor judgements in a row before moving to a fallback, and the least time on a transport before leaving it
+	poorStreak = 3
+	minDwell   = 2 * time.Minute
+
+	// How often more preferred transports are tried while on a fallback, and how many answers in a row before moving back
+	preferredProbeInterval = time.Minute
+	preferredStreak        = 3
+
+	destinationProbeTimeout = 10 * time.Second
+)
+
+type linkSample struct {
+	rtt  time.Duration
+	lost bool
+}
+
+type linkQuality struct {
+	samples []linkSample
+}
+
+func (q *linkQuality) add(rtt time.Duration, lost bool) {
+	q.samples = append(q.samples, linkSample{rtt: rtt, lost: lost})
+	if len(q.samples) > linkQualityWindow {
+		q.samples = q.samples[1:]
+	}
+}
+
+// poor says why the link is poor, empty when it isnt or there is not a full window yet
+func (q *linkQuality) poor() string {
+	if len(q.samples) < linkQualityWindow {
+		return ""
+	}
+
+	lost := 0
+	rtts := []time.Duration{}
+	for _, s := range q.samples {
+		if s.lost {
+			lost++
+			continue
+		}
+		rtts = append(rtts, s.rtt)
+	}
+
+	if lost >= poorLoss {
+		return fmt.Sprintf("%d of %d probes lost", lost, len(q.samples))
+	}
+
+	slices.Sort(rtts)
+	if median := rtts[len(rtts)/2]; median > poorLatency {
+		return fmt.Sprintf("median latency %s", median.Round(time.Millisecond))
+	}
+
+	return ""
+}
+
+// transportChange is sent to the server in a transport-change@rssh request after the client has moved
+type transportChange struct {
+	From   string
+	To     string
+	Reason string
+}
+
+type transportSelector struct {
+	destinations []string
+
+	current int
+	// Why the client moved to current
+	reason string
+	// Where the last connection was made
+	connectedOn int
+
+	// Set by watch when it closes the connection to move
+	mu         sync.Mutex
+	next       int
+	nextReason string
+}
+
+func newTransportSelector(destination string, fallbacks []string) *transportSelector {
+	return &transportSelector{
+		destinations: append([]string{destination}, fallbacks...),
+		next:         -1,
+	}
+}
+
+func (t *transportSelector) addr() string {
+	return t.destinations[t.current]
+}
+
+// failed moves to the next fallback after a connection attempt failed, and waits once every destination has been tried. False when the client is stopping
+func (t *transportSelector) failed(ctx context.Context) bool {
+	if t.current+1 < len(t.destinations) {
+		t.reason = t.destinations[t.current] + " unreachable"
+		t.current++
+		return true
+	}
+
+	if t.current != 0 {
+		t.reason = "every fallback was unreachable, trying from the start"
+		t.current = 0
+	}
+
+	return retryAfter(ctx)
+}
+
+// drop forgets the current destination for good, false if there is nothing left
+func (t *transportSelector) drop() bool {
+	if len(t.destinations) == 1 {
+		return false
+	}
+
+	t.reason = t.destinations[t.current] + " can no longer be used"
+	t.destinations = slices.Delete(t.destinations, t.current, t.current+1)
+	t.current %= len(t.destinations)
+	t.connectedOn = min(t.connectedOn, len(t.destinations)-1)
+
+	return true
+}
+
+// connected tells the server when the client is on a different transport than last time
+func (t *transportSelector) connected(sshConn ssh.Conn) {
+	defer func() { t.connectedOn = t.current }()
+
+	if t.current == t.connectedOn {
+		return
+	}
+
+	log.Printf("Moved from %s to %s: %s", t.destinations[t.connectedOn], t.addr(), t.reason)
+
+	change := transportChange{
+		From:   reportedDestination(t.destinations[t.connectedOn]),
+		To:     reportedDestination(t.addr()),
+		Reason: t.reason,
+	}
+	go sshConn.SendRequest("transport-change@rssh", false, ssh.Marshal(change))
+}
+
+// reportedDestination is how a destination is described to the server, ts destinations are tokens so only the transport is given
+func reportedDestination(addr string) string {
+	if _, scheme := determineConnectionType(addr); scheme == nat.Scheme {
+		return nat.DestinationPrefix + "..."
+	}
+	return addr
+}
+
+// switching moves to where watch decided to go, true if the connection was closed for it
+func (t *transportSelector) switching() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.next < 0 {
+		return false
+	}
+
+	t.current, t.reason = t.next, t.nextReason
+	t.next = -1
+	return true
+}
+
+func (t *transportSelector) moveTo(ctx context.Context, sshConn ssh.Conn, next int, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Stopped while probing, the connection has already ended
+	if ctx.Err() != nil {
+		return
+	}
+	t.next, t.nextReason = next, reason
+
+	sshConn.Close()
+}
+
+// monitor watches the connection until stop is called, there is nothing to do without fallbacks
+func (t *transportSelector) monitor(sshConn ssh.Conn, probe func(ctx context.Context, addr string) error) (stop func()) {
+	if len(t.destinations) < 2 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go t.watch(ctx, sshConn, t.current, slices.Clone(t.destinations), probe)
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		cancel()
+	}
+}
+
+func (t *transportSelector) watch(ctx context.Context, sshConn ssh.Conn, current int, destinations []string, probe func(ctx context.Context, addr string) error) {
+	var (
+		quality linkQuality
+		poorFor int
+
+		// Answers in a row from each more preferred destination
+		answered      = make([]int, current)
+		lastPreferred = time.Now()
+	)
+
+	connectedAt := time.Now()
+
+	ticker := time.NewTicker(linkProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rtt, err := pingServer(ctx, sshConn)
+		if ctx.Err() != nil {
+			return
+		}
+		quality.add(rtt, err != nil)
+
+		if time.Since(connectedAt) < minDwell {
+			continue
+		}
+
+		why := quality.poor()
+		if why == "" {
+			poorFor = 0
+		} else {
+			poorFor++
+		}
+
+		if poorFor >= poorStreak {
+			// Only move to somewhere that answers, otherwise stay and judge again from scratch
+			for i := current + 1; i < len(destinations); i++ {
+				if probe(ctx, destinations[i]) == nil {
+					t.moveTo(ctx, sshConn, i, why)
+					return
+				}
+			}
+			poorFor = 0
+		}
+
+		if current > 0 && time.Since(lastPreferred) >= preferredProbeInterval {
+			lastPreferred = time.Now()
+
+			for i := range current {
+				if probe(ctx, destinations[i]) != nil {
+					answered[i] = 0
+					continue
+				}
+
+				answered[i]++
+				if answered[i] >= preferredStreak {
+					t.moveTo(ctx, sshConn, i, fmt.Sprintf("preferred transport answered %d times in a row", answered[i]))
+					return
+				}
+			}
+		}
+	}
+}
+
+// pingServer times a global request round trip, the server refuses requests it doesnt know which is all we need
+func pingServer(ctx context.Context, sshConn ssh.Conn) (time.Duration, error) {
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := sshConn.SendRequest("ping@rssh", true, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return time.Since(start), err
+	case <-time.After(linkProbeTimeout):
+		return 0, errors.New("probe timed out")
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// probeDestination checks a destination can be reached without starting a session on it.
+// Settings are read now, as the connection loop changes the proxy while it retries
+func probeDestination(settings *Settings) func(ctx context.Context, addr string) error {
+	proxy := settings.ProxyAddr
+	kerberos := settings.ProxyUseHostKerberos
+	ntlm := settings.ntlm
+
+	var relayDialer nat.Dialer
+	if proxy != "" {
+		relayDialer = proxyDialer(settings)
+	}
+
+	timeout := destinationProbeTimeout
+	if settings.ConnectTimeout > 0 {
+		timeout = min(timeout, settings.ConnectTimeout)
+	}
+
+	return func(ctx context.Context, addr string) error {
+		realAddr, scheme := determineConnectionType(addr)
+
+		var (
+			conn net.Conn
+			err  error
+		)
+		switch scheme {
+		case nat.Scheme:
+			dialCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			if relayDialer != nil {
+				dialCtx = nat.WithDialer(dialCtx, relayDialer)
+			}
+			conn, err = nat.DialContext(dialCtx, addr)
+		case "smb":
+			conn, err = namedpipe.Dial(realAddr, timeout)
+		case "stdio":
+			return errors.New("stdio cannot be probed")
+		default:
+			conn, err = Connect(realAddr, proxy, timeout, kerberos, ntlm)
+		}
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+}
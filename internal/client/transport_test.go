@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLinkQualityPoor(t *testing.T) {
+	var q linkQuality
+
+	for range linkQualityWindow - 1 {
+		q.add(5*time.Second, false)
+	}
+	if why := q.poor(); why != "" {
+		t.Fatalf("judged before a full window: %s", why)
+	}
+
+	q.add(20*time.Millisecond, false)
+	if why := q.poor(); !strings.Contains(why, "latency") {
+		t.Fatalf("expected slow round trips to be poor, got %q", why)
+	}
+
+	for range linkQualityWindow {
+		q.add(20*time.Millisecond, false)
+	}
+	if why := q.poor(); why != "" {
+		t.Fatalf("expected a fast link to be fine, got %q", why)
+	}
+
+	// One lost probe is noise, two is a poor link
+	q.add(0, true)
+	if why := q.poor(); why != "" {
+		t.Fatalf("expected a single loss to be tolerated, got %q", why)
+	}
+
+	q.add(0, true)
+	if why := q.poor(); !strings.Contains(why, "2 of 6 probes lost") {
+		t.Fatalf("expected loss to be poor, got %q", why)
+	}
+}
+
+func TestTransportSelectorFallsBackInOrder(t *testing.T) {
+	ts := newTransportSelector("tls://server:443", []string{"wss://server:443", "https://server:443"})
+
+	for _, want := range []string{"wss://server:443", "https://server:443"} {
+		if !ts.failed(context.Background()) {
+			t.Fatal("expected to move on without waiting")
+		}
+		if ts.addr() != want {
+			t.Fatalf("expected to move to %s, got %s", want, ts.addr())
+		}
+	}
+
+	// Every destination failed, it waits and starts again at the top
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ts.failed(ctx) {
+		t.Fatal("expected waiting to stop with the client")
+	}
+	if ts.addr() != "tls://server:443" {
+		t.Fatalf("expected to go back to the destination, got %s", ts.addr())
+	}
+
+	ts.current = 1
+	if !ts.drop() || len(ts.destinations) != 2 || ts.addr() != "https://server:443" {
+		t.Fatalf("expected wss to be dropped and https to be next, got %v at %s", ts.destinations, ts.addr())
+	}
+
+	single := newTransportSelector("tls://server:443", nil)
+	if single.drop() {
+		t.Fatal("expected the only destination not to be dropped")
+	}
+}
+
+func TestReportedDestinationHidesTokens(t *testing.T) {
+	if got := reportedDestination("ts://c2VjcmV0"); strings.Contains(got, "c2VjcmV0") {
+		t.Fatalf("token was reported: %s", got)
+	}
+
+	if got := reportedDestination("wss://server:443"); got != "wss://server:443" {
+		t.Fatalf("expected wss destinations as they are, got %s", got)
+	}
+}
@@ -0,0 +1,303 @@
+// Package dirsync copies directory trees between the server and clients, much like rsync.
+//
+// Both trees are listed, and only files whose size or modification time differ are looked at. Each of those is hashed in chunks on both sides
+// and only the chunks that differ are sent, several files and chunks at once. Chunks go into a partial file beside the destination, which
+// replaces it once complete, so a sync that was cut off carries on from the chunks that made it the next time it is run.
+package dirsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ChunkSize = 1 << 20
+
+	DefaultParallel = 4
+	MaxParallel     = 16
+
+	// Kept beside the file being written until it is complete
+	partSuffix = ".rssh-part"
+
+	// Per file errors kept in Stats, the rest are only counted
+	maxErrors = 10
+)
+
+// Entry is a file or directory in a tree, Path is relative to its root and slash separated. The root itself has an empty path
+type Entry struct {
+	Path    string `json:"path"`
+	Dir     bool   `json:"dir,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Mode    uint32 `json:"mode"`
+	ModTime int64  `json:"mtime,omitempty"`
+}
+
+// Tree is one side of a sync
+type Tree interface {
+	// List is every directory and regular file, parents before their contents. Nothing is listed when the root does not exist
+	List() ([]Entry, error)
+	// Hashes is the hash of each chunk of the file at path, or of what there is of its partial file. Nothing when there is no such file
+	Hashes(path string, part bool) ([][]byte, error)
+	Read(path string, offset int64, length int) ([]byte, error)
+	// Write puts a chunk in path's partial file
+	Write(path string, offset int64, data []byte) error
+	// Commit copies the chunks in keep from the file already at the entry's path into its partial file, then moves the partial file over it
+	Commit(file Entry, keep []int) error
+	Mkdir(dir Entry) error
+}
+
+// Request is the extra data of a sync@rssh channel, the client's side of the sync
+type Request struct {
+	Root    string   `json:"root"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+type Stats struct {
+	Files, Dirs int
+	// Same size and modification time, not looked at
+	Unchanged int
+	// Files written, or only given the source's mode and time when their content matched
+	Updated int
+	Failed  int
+
+	BytesSent int64
+	// Chunks taken from the old destination file or a partial file rather than sent
+	BytesReused int64
+
+	Errors []error
+}
+
+// CheckPatterns makes sure exclude patterns are valid, they are matched against names and relative paths with path.Match
+func CheckPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func chunkCount(size int64) int {
+	return int((size + ChunkSize - 1) / ChunkSize)
+}
+
+func chunkLength(size int64, index int) int {
+	return int(min(ChunkSize, size-int64(index)*ChunkSize))
+}
+
+// Modification times are compared to the second, as not every filesystem keeps more
+func sameTime(a, b int64) bool {
+	return a/int64(time.Second) == b/int64(time.Second)
+}
+
+type transfer struct {
+	file Entry
+	keep []int
+
+	pending atomic.Int32
+	errOnce sync.Once
+	err     error
+}
+
+type chunk struct {
+	transfer *transfer
+	index    int
+}
+
+type syncer struct {
+	src, dst Tree
+	progress func(path string, err error)
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// Sync makes dst hold everything in src, moving up to parallel files and chunks at once. Files only in dst are left alone.
+// progress, which may be nil, is told of each file that was updated or failed
+func Sync(src, dst Tree, parallel int, progress func(path string, err error)) (Stats, error) {
+	parallel = max(1, min(parallel, MaxParallel))
+
+	sources, err := src.List()
+	if err != nil {
+		return Stats{}, fmt.Errorf("unable to list the source: %w", err)
+	}
+	if len(sources) == 0 {
+		return Stats{}, errors.New("the source does not exist")
+	}
+
+	destinations, err := dst.List()
+	if err != nil {
+		return Stats{}, fmt.Errorf("unable to list the destination: %w", err)
+	}
+
+	existing := make(map[string]Entry, len(destinations))
+	for _, e := range destinations {
+		existing[e.Path] = e
+	}
+
+	s := &syncer{src: src, dst: dst, progress: progress}
+
+	var files []Entry
+	for _, e := range sources {
+		old, ok := existing[e.Path]
+
+		if e.Dir {
+			s.stats.Dirs++
+			if ok && old.Dir {
+				continue
+			}
+			if err := dst.Mkdir(e); err != nil {
+				s.failed(e.Path, err)
+			}
+			continue
+		}
+
+		s.stats.Files++
+		if ok && !old.Dir && old.Size == e.Size && sameTime(old.ModTime, e.ModTime) {
+			s.stats.Unchanged++
+			continue
+		}
+		files = append(files, e)
+	}
+
+	pending := make(chan Entry)
+	chunks := make(chan chunk)
+
+	var planners, senders sync.WaitGroup
+	for range parallel {
+		planners.Add(1)
+		go func() {
+			defer planners.Done()
+			for file := range pending {
+				old, ok := existing[file.Path]
+				s.plan(file, ok && !old.Dir, chunks)
+			}
+		}()
+
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for c := range chunks {
+				s.send(c)
+			}
+		}()
+	}
+
+	for _, file := range files {
+		pending <- file
+	}
+	close(pending)
+	planners.Wait()
+	close(chunks)
+	senders.Wait()
+
+	return s.stats, nil
+}
+
+// plan works out which chunks of file have to be sent, and queues them
+func (s *syncer) plan(file Entry, hasOld bool, chunks chan<- chunk) {
+	hashes, err := s.src.Hashes(file.Path, false)
+	if err != nil {
+		s.failed(file.Path, err)
+		return
+	}
+
+	// Neither of these is needed, without them everything is sent
+	var old, part [][]byte
+	if hasOld {
+		old, _ = s.dst.Hashes(file.Path, false)
+	}
+	part, _ = s.dst.Hashes(file.Path, true)
+
+	t := &transfer{file: file}
+
+	var send []int
+	reused := int64(0)
+	for i, hash := range hashes {
+		switch {
+		case i < len(part) && bytes.Equal(part[i], hash):
+			reused += int64(chunkLength(file.Size, i))
+		case i < len(old) && bytes.Equal(old[i], hash):
+			t.keep = append(t.keep, i)
+			reused += int64(chunkLength(file.Size, i))
+		default:
+			send = append(send, i)
+		}
+	}
+
+	s.mu.Lock()
+	s.stats.BytesReused += reused
+	s.mu.Unlock()
+
+	if len(send) == 0 {
+		s.commit(t)
+		return
+	}
+
+	t.pending.Store(int32(len(send)))
+	for _, i := range send {
+		chunks <- chunk{transfer: t, index: i}
+	}
+}
+
+func (s *syncer) send(c chunk) {
+	t := c.transfer
+	offset := int64(c.index) * ChunkSize
+
+	data, err := s.src.Read(t.file.Path, offset, chunkLength(t.file.Size, c.index))
+	if err == nil {
+		err = s.dst.Write(t.file.Path, offset, data)
+	}
+
+	if err != nil {
+		t.errOnce.Do(func() { t.err = err })
+	} else {
+		s.mu.Lock()
+		s.stats.BytesSent += int64(len(data))
+		s.mu.Unlock()
+	}
+
+	// The last chunk of a file to finish finishes the file
+	if t.pending.Add(-1) > 0 {
+		return
+	}
+
+	if t.err != nil {
+		s.failed(t.file.Path, t.err)
+		return
+	}
+	s.commit(t)
+}
+
+func (s *syncer) commit(t *transfer) {
+	if err := s.dst.Commit(t.file, t.keep); err != nil {
+		s.failed(t.file.Path, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.stats.Updated++
+	s.mu.Unlock()
+
+	if s.progress != nil {
+		s.progress(t.file.Path, nil)
+	}
+}
+
+func (s *syncer) failed(path string, err error) {
+	s.mu.Lock()
+	s.stats.Failed++
+	if len(s.stats.Errors) < maxErrors {
+		s.stats.Errors = append(s.stats.Errors, fmt.Errorf("%s: %w", path, err))
+	}
+	s.mu.Unlock()
+
+	if s.progress != nil {
+		s.progress(path, err)
+	}
+}
@@ -0,0 +1,122 @@
+package dirsync
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// remoteTree serves a local tree at root over pipes, as a client would over its sync channels
+func remoteTree(t *testing.T, root string, exclude []string) *Remote {
+	t.Helper()
+
+	remote, err := NewRemote(func() (io.ReadWriteCloser, error) {
+		near, far := net.Pipe()
+		go func() {
+			defer far.Close()
+			Serve(far, NewLocal(root, exclude))
+		}()
+		return near, nil
+	}, DefaultParallel)
+	if err != nil {
+		t.Fatalf("NewRemote() error = %v", err)
+	}
+	t.Cleanup(func() { remote.Close() })
+
+	return remote
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncSendsOnlyWhatChanged(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "kit")
+
+	big := bytes.Repeat([]byte("abcdefgh"), 3*ChunkSize/8+100)
+	writeFile(t, filepath.Join(src, "tools", "big.bin"), big)
+	writeFile(t, filepath.Join(src, "tools", "run.sh"), []byte("#!/bin/sh\necho hi\n"))
+	writeFile(t, filepath.Join(src, "debug.log"), []byte("noise"))
+	writeFile(t, filepath.Join(src, "empty"), nil)
+
+	remote := remoteTree(t, dst, nil)
+
+	stats, err := Sync(NewLocal(src, []string{"*.log"}), remote, DefaultParallel, nil)
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if stats.Updated != 3 || stats.Failed != 0 || stats.BytesSent != int64(len(big))+18 {
+		t.Fatalf("first sync stats = %+v, want 3 files and %d bytes sent", stats, len(big)+18)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, "tools", "big.bin"))
+	if err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("big.bin was not copied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "debug.log")); err == nil {
+		t.Fatal("excluded debug.log was copied")
+	}
+
+	// Unchanged files are not looked at
+	stats, err = Sync(NewLocal(src, []string{"*.log"}), remote, DefaultParallel, nil)
+	if err != nil || stats.Unchanged != 3 || stats.Updated != 0 || stats.BytesSent != 0 {
+		t.Fatalf("second sync = %+v, %v, want everything unchanged", stats, err)
+	}
+
+	// Only the chunk that changed is sent
+	big[ChunkSize+10] = 'X'
+	writeFile(t, filepath.Join(src, "tools", "big.bin"), big)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(src, "tools", "big.bin"), later, later)
+
+	stats, err = Sync(NewLocal(src, nil), remote, DefaultParallel, nil)
+	if err != nil || stats.Updated != 2 || stats.BytesSent != ChunkSize+int64(len("noise")) {
+		t.Fatalf("third sync = %+v, %v, want one chunk and debug.log sent", stats, err)
+	}
+
+	got, _ = os.ReadFile(filepath.Join(dst, "tools", "big.bin"))
+	if !bytes.Equal(got, big) {
+		t.Fatal("big.bin differs after the delta")
+	}
+	info, _ := os.Stat(filepath.Join(dst, "tools", "big.bin"))
+	if info.ModTime().Unix() != later.Unix() || info.Mode().Perm() != 0640 {
+		t.Fatalf("big.bin time %v mode %v, want %v and 0640", info.ModTime(), info.Mode().Perm(), later)
+	}
+}
+
+func TestSyncResumesFromPartialFile(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+
+	content := bytes.Repeat([]byte{1, 2, 3, 4}, ChunkSize/2)
+	writeFile(t, filepath.Join(src, "payload"), content)
+
+	// The first chunk made it before the last sync was cut off
+	writeFile(t, partPath(filepath.Join(dst, "payload")), content[:ChunkSize])
+
+	stats, err := Sync(remoteTree(t, src, nil), NewLocal(dst, nil), 2, nil)
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if stats.BytesSent != ChunkSize || stats.BytesReused != ChunkSize {
+		t.Fatalf("stats = %+v, want one chunk sent and one reused", stats)
+	}
+
+	got, _ := os.ReadFile(filepath.Join(dst, "payload"))
+	if !bytes.Equal(got, content) {
+		t.Fatal("payload differs after resuming")
+	}
+	if _, err := os.Stat(partPath(filepath.Join(dst, "payload"))); err == nil {
+		t.Fatal("partial file was left behind")
+	}
+}
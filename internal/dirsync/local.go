@@ -0,0 +1,253 @@
+package dirsync
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local is a tree on this machine. Symbolic links and special files are not synced, and nothing outside root is ever touched
+type Local struct {
+	root    string
+	exclude []string
+}
+
+func NewLocal(root string, exclude []string) *Local {
+	return &Local{root: filepath.Clean(root), exclude: exclude}
+}
+
+func (l *Local) excluded(rel string) bool {
+	for _, pattern := range l.exclude {
+		if matched, _ := path.Match(pattern, path.Base(rel)); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, rel); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// path is where rel is under root, paths given by the other side can not climb out of it
+func (l *Local) path(rel string) string {
+	cleaned := path.Clean("/" + rel)
+	if cleaned == "/" {
+		return l.root
+	}
+	return filepath.Join(l.root, filepath.FromSlash(cleaned))
+}
+
+func partPath(target string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+partSuffix)
+}
+
+func entryFor(rel string, info fs.FileInfo) Entry {
+	return Entry{
+		Path:    rel,
+		Dir:     info.IsDir(),
+		Size:    info.Size(),
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime().UnixNano(),
+	}
+}
+
+func (l *Local) List() ([]Entry, error) {
+	info, err := os.Stat(l.root)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []Entry{entryFor("", info)}, nil
+	}
+
+	var entries []Entry
+	err = filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if p == l.root {
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entryFor("", info))
+			return nil
+		}
+
+		// What cannot be read is left out rather than stopping everything else
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if strings.HasSuffix(d.Name(), partSuffix) || l.excluded(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		entries = append(entries, entryFor(rel, info))
+		return nil
+	})
+
+	return entries, err
+}
+
+func (l *Local) Hashes(rel string, part bool) ([][]byte, error) {
+	p := l.path(rel)
+	if part {
+		p = partPath(p)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var hashes [][]byte
+	buffer := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(f, buffer)
+		if n > 0 {
+			hash := sha256.Sum256(buffer[:n])
+			hashes = append(hashes, hash[:])
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *Local) Read(rel string, offset int64, length int) ([]byte, error) {
+	f, err := os.Open(l.path(rel))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if n == length {
+		return data, nil
+	}
+	if err == io.EOF {
+		err = errors.New("file got shorter while it was being synced")
+	}
+	return nil, err
+}
+
+func (l *Local) Write(rel string, offset int64, data []byte) error {
+	f, err := os.OpenFile(partPath(l.path(rel)), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt(data, offset); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (l *Local) Commit(file Entry, keep []int) error {
+	target := l.path(file.Path)
+	part := partPath(target)
+
+	// Content that already matches only needs the source's mode and time
+	if _, err := os.Stat(part); errors.Is(err, fs.ErrNotExist) && len(keep) == chunkCount(file.Size) {
+		if info, err := os.Stat(target); err == nil && info.Size() == file.Size {
+			return finish(target, file)
+		}
+	}
+
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := fillFrom(f, target, file.Size, keep); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Truncate(file.Size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(part, target); err != nil {
+		return err
+	}
+	return finish(target, file)
+}
+
+// fillFrom copies the chunks in keep from the file at old into f
+func fillFrom(f *os.File, old string, size int64, keep []int) error {
+	if len(keep) == 0 {
+		return nil
+	}
+
+	source, err := os.Open(old)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	buffer := make([]byte, ChunkSize)
+	for _, i := range keep {
+		offset := int64(i) * ChunkSize
+		length := chunkLength(size, i)
+
+		if n, err := source.ReadAt(buffer[:length], offset); n < length {
+			return err
+		}
+		if _, err := f.WriteAt(buffer[:length], offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func finish(target string, file Entry) error {
+	if err := os.Chmod(target, fs.FileMode(file.Mode)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, time.Now(), time.Unix(0, file.ModTime))
+}
+
+func (l *Local) Mkdir(dir Entry) error {
+	// Whatever the source's mode, the directory has to be writable for its contents to go in
+	return os.MkdirAll(l.path(dir.Path), fs.FileMode(dir.Mode)|0700)
+}
@@ -0,0 +1,281 @@
+package dirsync
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Each connection carries one call at a time: a frame asking for something and the frames answering it. A frame is a length prefixed json
+// header followed by a length prefixed payload, which carries file data without encoding it.
+
+const (
+	maxHeader = 16 << 20
+
+	// Entries in each frame of a listing
+	listBatch = 1000
+)
+
+type message struct {
+	Op      string   `json:"op,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Part    bool     `json:"part,omitempty"`
+	Offset  int64    `json:"offset,omitempty"`
+	Length  int      `json:"length,omitempty"`
+	Entry   *Entry   `json:"entry,omitempty"`
+	Keep    []int    `json:"keep,omitempty"`
+	Entries []Entry  `json:"entries,omitempty"`
+	Hashes  [][]byte `json:"hashes,omitempty"`
+	More    bool     `json:"more,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func writeFrame(w io.Writer, m message, payload []byte) error {
+	header, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 0, 8+len(header)+len(payload))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(header)))
+	frame = append(frame, header...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (m message, payload []byte, err error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return m, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxHeader {
+		return m, nil, fmt.Errorf("sync header of %d bytes is too large", size)
+	}
+
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return m, nil, err
+	}
+	if err := json.Unmarshal(header, &m); err != nil {
+		return m, nil, err
+	}
+
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return m, nil, err
+	}
+
+	size = binary.BigEndian.Uint32(length[:])
+	if size > ChunkSize {
+		return m, nil, fmt.Errorf("sync payload of %d bytes is larger than a chunk", size)
+	}
+
+	payload = make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	return m, payload, err
+}
+
+func errorMessage(err error) message {
+	if err == nil {
+		return message{}
+	}
+	return message{Error: err.Error()}
+}
+
+// Serve answers calls made on conn against tree, until conn is closed
+func Serve(conn io.ReadWriter, tree Tree) error {
+	for {
+		request, payload, err := readFrame(conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		var (
+			response message
+			data     []byte
+		)
+
+		switch request.Op {
+		case "list":
+			entries, err := tree.List()
+			if err != nil {
+				response = errorMessage(err)
+				break
+			}
+
+			for len(entries) > listBatch {
+				if err := writeFrame(conn, message{Entries: entries[:listBatch], More: true}, nil); err != nil {
+					return err
+				}
+				entries = entries[listBatch:]
+			}
+			response.Entries = entries
+
+		case "hashes":
+			response.Hashes, err = tree.Hashes(request.Path, request.Part)
+			if err != nil {
+				response = errorMessage(err)
+			}
+
+		case "read":
+			if request.Length < 0 || request.Length > ChunkSize {
+				response = message{Error: "read is larger than a chunk"}
+				break
+			}
+
+			data, err = tree.Read(request.Path, request.Offset, request.Length)
+			response = errorMessage(err)
+
+		case "write":
+			response = errorMessage(tree.Write(request.Path, request.Offset, payload))
+
+		case "commit", "mkdir":
+			if request.Entry == nil {
+				response = message{Error: "no entry given"}
+				break
+			}
+
+			if request.Op == "commit" {
+				err = tree.Commit(*request.Entry, request.Keep)
+			} else {
+				err = tree.Mkdir(*request.Entry)
+			}
+			response = errorMessage(err)
+
+		default:
+			response = message{Error: fmt.Sprintf("unknown sync call %q", request.Op)}
+		}
+
+		if err := writeFrame(conn, response, data); err != nil {
+			return err
+		}
+	}
+}
+
+// Remote is a tree on the other end of connections that Serve answers on, calls go out on whichever connection is free
+type Remote struct {
+	conns chan io.ReadWriteCloser
+	all   []io.ReadWriteCloser
+
+	// Set when a connection fails, after which every call does
+	mu     sync.Mutex
+	broken error
+}
+
+// NewRemote opens count connections with open
+func NewRemote(open func() (io.ReadWriteCloser, error), count int) (*Remote, error) {
+	count = max(count, 1)
+	r := &Remote{conns: make(chan io.ReadWriteCloser, count)}
+
+	for range count {
+		conn, err := open()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+
+		r.all = append(r.all, conn)
+		r.conns <- conn
+	}
+
+	return r, nil
+}
+
+func (r *Remote) Close() error {
+	for _, conn := range r.all {
+		conn.Close()
+	}
+	return nil
+}
+
+// call sends request and hands each answering frame to handle, which may be nil
+func (r *Remote) call(request message, payload []byte, handle func(message, []byte)) error {
+	conn := <-r.conns
+	defer func() { r.conns <- conn }()
+
+	r.mu.Lock()
+	broken := r.broken
+	r.mu.Unlock()
+	if broken != nil {
+		return broken
+	}
+
+	err := writeFrame(conn, request, payload)
+	for err == nil {
+		var (
+			response message
+			data     []byte
+		)
+		response, data, err = readFrame(conn)
+		if err != nil {
+			break
+		}
+
+		if response.Error != "" {
+			return errors.New(response.Error)
+		}
+
+		if handle != nil {
+			handle(response, data)
+		}
+		if !response.More {
+			return nil
+		}
+	}
+
+	// The connection is out of step with the other side, it cannot be used again
+	err = fmt.Errorf("sync connection failed: %w", err)
+	r.mu.Lock()
+	if r.broken == nil {
+		r.broken = err
+	}
+	r.mu.Unlock()
+
+	return err
+}
+
+func (r *Remote) List() (entries []Entry, err error) {
+	err = r.call(message{Op: "list"}, nil, func(m message, _ []byte) {
+		entries = append(entries, m.Entries...)
+	})
+	return entries, err
+}
+
+func (r *Remote) Hashes(path string, part bool) (hashes [][]byte, err error) {
+	err = r.call(message{Op: "hashes", Path: path, Part: part}, nil, func(m message, _ []byte) {
+		hashes = m.Hashes
+	})
+	return hashes, err
+}
+
+func (r *Remote) Read(path string, offset int64, length int) (data []byte, err error) {
+	err = r.call(message{Op: "read", Path: path, Offset: offset, Length: length}, nil, func(_ message, payload []byte) {
+		data = payload
+	})
+	if err == nil && len(data) != length {
+		return nil, fmt.Errorf("read %d bytes of %s, wanted %d", len(data), path, length)
+	}
+	return data, err
+}
+
+func (r *Remote) Write(path string, offset int64, data []byte) error {
+	return r.call(message{Op: "write", Path: path, Offset: offset}, data, nil)
+}
+
+func (r *Remote) Commit(file Entry, keep []int) error {
+	return r.call(message{Op: "commit", Entry: &file, Keep: keep}, nil, nil)
+}
+
+func (r *Remote) Mkdir(dir Entry) error {
+	return r.call(message{Op: "mkdir", Entry: &dir}, nil, nil)
+}
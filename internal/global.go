@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha1"
@@ -9,10 +10,19 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	mathrand "math/rand/v2"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"github.com/NHAS/reverse_ssh/pkg/namedpipe"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -25,12 +35,64 @@ type ShellStruct struct {
 	Cmd string
 }
 
+// https://tools.ietf.org/html/rfc4254#section-6.4
+type EnvRequest struct {
+	Name  string
+	Value string
+}
+
+// ProcessOptions are sent in a process-options@rssh request before exec or shell, and apply to the process it starts
+type ProcessOptions struct {
+	// Working directory, empty for the client's own
+	Dir string
+
+	SetUid bool
+	Uid    uint32
+	SetGid bool
+	Gid    uint32
+}
+
+const (
+	SpeedTestToClient   = "to-client"
+	SpeedTestFromClient = "from-client"
+)
+
+// SpeedTestRequest is the extra data of a speedtest@rssh channel, the sender of the data closes its write side after Seconds
+type SpeedTestRequest struct {
+	Direction string
+	Seconds   uint32
+}
+
+// SpeedTestSend writes random data for duration, so compression on the way doesnt flatter the result
+func SpeedTestSend(w io.Writer, duration time.Duration) (sent int64, err error) {
+	var seed [32]byte
+	binary.LittleEndian.PutUint64(seed[:], mathrand.Uint64())
+	random := mathrand.NewChaCha8(seed)
+
+	buffer := make([]byte, 32*1024)
+
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		random.Read(buffer)
+		n, err := w.Write(buffer)
+		sent += int64(n)
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
 type RemoteForwardRequest struct {
 	BindAddr string
 	BindPort uint32
 }
 
 func (r *RemoteForwardRequest) String() string {
+	if namedpipe.IsPipe(r.BindAddr) {
+		return r.BindAddr
+	}
 	return net.JoinHostPort(r.BindAddr, fmt.Sprintf("%d", r.BindPort))
 }
 
@@ -42,17 +104,113 @@ type ChannelOpenDirectMsg struct {
 	Lport uint32
 }
 
+// Datagrams on a direct-udp@rssh channel each have a two byte big endian length in front of them
+const MaxDatagramSize = 65535
+
+func WriteDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > MaxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is too large", len(datagram))
+	}
+
+	b := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(b, uint16(len(datagram)))
+	copy(b[2:], datagram)
+
+	_, err := w.Write(b)
+	return err
+}
+
+func ReadDatagram(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	datagram := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, datagram); err != nil {
+		return nil, err
+	}
+
+	return datagram, nil
+}
+
 func GeneratePrivateKey() ([]byte, error) {
 	_, priv, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		return nil, err
 	}
 
+	return encodePrivateKey(priv)
+}
+
+// GenerateVanityPrivateKey generates keys until one has a SHA1 fingerprint starting with prefix (hex), each extra character is 16 times slower
+func GenerateVanityPrivateKey(ctx context.Context, prefix string) ([]byte, error) {
+	prefix = strings.ToLower(prefix)
+	if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil {
+		return nil, fmt.Errorf("vanity prefix %q is not hex", prefix)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan ed25519.PrivateKey, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for attempts := 0; ; attempts++ {
+				// Checking every key would make ctx the bottleneck
+				if attempts%1024 == 0 && ctx.Err() != nil {
+					return
+				}
+
+				public, private, err := ed25519.GenerateKey(rand.Reader)
+				if err != nil {
+					return
+				}
+
+				sshPublic, err := ssh.NewPublicKey(public)
+				if err != nil {
+					return
+				}
+
+				if strings.HasPrefix(FingerprintSHA1Hex(sshPublic), prefix) {
+					select {
+					case found <- private:
+					default:
+						secure.Zero(private)
+					}
+					cancel()
+					return
+				}
+				secure.Zero(private)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case private := <-found:
+		return encodePrivateKey(private)
+	default:
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("no key with fingerprint prefix %q was found in time: %w", prefix, context.Cause(ctx))
+		}
+		return nil, errors.New("unable to generate keys")
+	}
+}
+
+func encodePrivateKey(priv ed25519.PrivateKey) ([]byte, error) {
 	// Convert a generated ed25519 key into a PEM block so that the ssh library can ingest it, bit round about tbh
 	bytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	secure.Zero(priv)
 	if err != nil {
 		return nil, err
 	}
+	defer secure.Zero(bytes)
 
 	privatePem := pem.EncodeToMemory(
 		&pem.Block{
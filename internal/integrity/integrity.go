@@ -0,0 +1,139 @@
+// Package integrity signs built clients and lets a client check its own binary against that signature.
+//
+// The signature is appended to the binary, after anything upx added, as the signature blob, its 4 byte big endian length, then magic.
+// It covers the sha256 of everything before it.
+package integrity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	magic = "RSSHSIG1"
+
+	// Far bigger than any ssh public key and signature
+	maxSignatureSize = 16 * 1024
+)
+
+var ErrUnsigned = errors.New("binary has no integrity signature")
+
+type signature struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// Sign appends a signature of the file at path made with signer
+func Sign(path string, signer ssh.Signer) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	sig, err := sign(signer, h.Sum(nil))
+	if err != nil {
+		return err
+	}
+
+	blob := ssh.Marshal(signature{
+		PublicKey: signer.PublicKey().Marshal(),
+		Signature: ssh.Marshal(sig),
+	})
+
+	trailer := binary.BigEndian.AppendUint32(blob, uint32(len(blob)))
+	trailer = append(trailer, magic...)
+
+	_, err = f.Write(trailer)
+	return err
+}
+
+// sign uses sha256 with rsa keys, rather than the sha1 ssh-rsa signatures Sign gives
+func sign(signer ssh.Signer, digest []byte) (*ssh.Signature, error) {
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, digest, ssh.KeyAlgoRSASHA256)
+	}
+	return signer.Sign(rand.Reader, digest)
+}
+
+// Verify checks the file at path was signed by the key with the sha256 hex fingerprint keyFingerprint, and has not changed since
+func Verify(path string, keyFingerprint string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	if size < int64(len(magic))+4 {
+		return ErrUnsigned
+	}
+
+	tail := make([]byte, len(magic)+4)
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return err
+	}
+	if string(tail[4:]) != magic {
+		return ErrUnsigned
+	}
+
+	blobLen := int64(binary.BigEndian.Uint32(tail[:4]))
+	signed := size - int64(len(tail)) - blobLen
+	if blobLen > maxSignatureSize || signed < 0 {
+		return errors.New("integrity signature is malformed")
+	}
+
+	blob := make([]byte, blobLen)
+	if _, err := f.ReadAt(blob, signed); err != nil {
+		return err
+	}
+
+	var s signature
+	if err := ssh.Unmarshal(blob, &s); err != nil {
+		return fmt.Errorf("integrity signature is malformed: %w", err)
+	}
+
+	publicKey, err := ssh.ParsePublicKey(s.PublicKey)
+	if err != nil {
+		return fmt.Errorf("integrity signature key is malformed: %w", err)
+	}
+
+	if fp := internal.FingerprintSHA256Hex(publicKey); !secure.EqualString(fp, keyFingerprint) {
+		return fmt.Errorf("binary was signed by %s, not the server that built it", fp)
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(s.Signature, &sig); err != nil {
+		return fmt.Errorf("integrity signature is malformed: %w", err)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, signed)); err != nil {
+		return err
+	}
+
+	if err := publicKey.Verify(h.Sum(nil), &sig); err != nil {
+		return errors.New("binary has been changed since it was built")
+	}
+
+	return nil
+}
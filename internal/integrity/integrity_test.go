@@ -0,0 +1,53 @@
+package integrity
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	privateKey, err := internal.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := internal.FingerprintSHA256Hex(signer.PublicKey())
+
+	path := filepath.Join(t.TempDir(), "client")
+	if err := os.WriteFile(path, []byte("\x7fELF pretend client"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(path, fingerprint); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("unsigned binary gave %v, want ErrUnsigned", err)
+	}
+
+	if err := Sign(path, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(path, fingerprint); err != nil {
+		t.Fatalf("signed binary did not verify: %v", err)
+	}
+
+	if err := Verify(path, "not the server"); err == nil {
+		t.Fatal("binary verified against the wrong key")
+	}
+
+	// Patch one byte of the client
+	content, _ := os.ReadFile(path)
+	content[1] = 'X'
+	os.WriteFile(path, content, 0700)
+
+	if err := Verify(path, fingerprint); err == nil || errors.Is(err, ErrUnsigned) {
+		t.Fatalf("patched binary gave %v, want a tamper error", err)
+	}
+}
@@ -0,0 +1,327 @@
+// Package loadtest runs synthetic clients against a server, to measure how the connection path holds up under many clients, churn and forward use.
+//
+// Synthetic clients authenticate like real ones but refuse every channel the server opens. They can reconnect after a set lifetime, open forwards
+// back to the server and time a version exchange through them, and time global requests. Latencies are sampled so long soak runs use bounded memory.
+package loadtest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"golang.org/x/crypto/ssh"
+)
+
+type Config struct {
+	Addr string
+
+	// SHA256 fingerprint of the server key, if empty any key is accepted
+	Fingerprint string
+
+	// Key the clients authenticate with, it must be in the server's authorized_controllee_keys unless the server runs with --insecure
+	Signer ssh.Signer
+
+	Clients int
+
+	// Client starts are spread over RampUp, so the first handshakes are not all at once
+	RampUp time.Duration
+
+	// How long each connection lasts before the client reconnects, 0 keeps connections up for the whole run. Lifetimes vary by up to half either way
+	Lifetime time.Duration
+
+	// How often each client opens a forward to the server, 0 for never
+	ForwardInterval time.Duration
+
+	// How often each client sends a global request to the server, 0 for never
+	RequestInterval time.Duration
+
+	// Dial and handshake timeout
+	Timeout time.Duration
+}
+
+// LoadTest is a running set of synthetic clients
+type LoadTest struct {
+	config Config
+
+	started   time.Time
+	connected atomic.Int64
+
+	mu         sync.Mutex
+	handshakes Stats
+	forwards   Stats
+	requests   Stats
+	drops      int
+	failures   map[string]int
+}
+
+func New(config Config) (*LoadTest, error) {
+	if config.Addr == "" {
+		return nil, errors.New("no server address given")
+	}
+	if config.Signer == nil {
+		return nil, errors.New("no client key given")
+	}
+	if config.Clients < 1 {
+		return nil, errors.New("need at least one client")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	return &LoadTest{
+		config:   config,
+		failures: make(map[string]int),
+	}, nil
+}
+
+// Run starts the clients and waits for them to stop, when ctx is done
+func (l *LoadTest) Run(ctx context.Context) {
+	l.mu.Lock()
+	l.started = time.Now()
+	l.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < l.config.Clients; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+
+			if l.config.RampUp > 0 {
+				select {
+				case <-time.After(l.config.RampUp * time.Duration(n) / time.Duration(l.config.Clients)):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			l.client(ctx, n)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func (l *LoadTest) client(ctx context.Context, n int) {
+	user := fmt.Sprintf("loadtest-%d", n)
+
+	for ctx.Err() == nil {
+		conn, chans, reqs, err := l.connect(ctx, user)
+		if err != nil {
+			// Back off a little, so a server refusing everyone is not hammered
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		l.session(ctx, conn, chans, reqs)
+	}
+}
+
+func (l *LoadTest) connect(ctx context.Context, user string) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(l.config.Signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if l.config.Fingerprint != "" && !secure.EqualString(internal.FingerprintSHA256Hex(key), l.config.Fingerprint) {
+				return fmt.Errorf("server public key invalid, expected: %s, got: %s", l.config.Fingerprint, internal.FingerprintSHA256Hex(key))
+			}
+			return nil
+		},
+		ClientVersion: "SSH-" + internal.Version + "-loadtest",
+		Timeout:       l.config.Timeout,
+	}
+
+	start := time.Now()
+
+	dialer := net.Dialer{Timeout: l.config.Timeout}
+	c, err := dialer.DialContext(ctx, "tcp", l.config.Addr)
+	if err != nil {
+		l.record(ctx, &l.handshakes, 0, err)
+		return nil, nil, nil, err
+	}
+
+	c.SetDeadline(time.Now().Add(l.config.Timeout))
+	conn, chans, reqs, err := ssh.NewClientConn(c, l.config.Addr, config)
+	if err != nil {
+		c.Close()
+		l.record(ctx, &l.handshakes, 0, err)
+		return nil, nil, nil, err
+	}
+	c.SetDeadline(time.Time{})
+
+	l.record(ctx, &l.handshakes, time.Since(start), nil)
+
+	return conn, chans, reqs, nil
+}
+
+// session keeps a connection up for its lifetime, using it as configured
+func (l *LoadTest) session(ctx context.Context, conn ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	defer conn.Close()
+
+	l.connected.Add(1)
+	defer l.connected.Add(-1)
+
+	// Cancelled before the connection is closed, so what is in flight when a lifetime ends is not counted as failing
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	go func() {
+		for newChannel := range chans {
+			newChannel.Reject(ssh.Prohibited, "synthetic client")
+		}
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+
+	var lifetime <-chan time.Time
+	if l.config.Lifetime > 0 {
+		lifetime = time.After(l.config.Lifetime/2 + rand.N(l.config.Lifetime))
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	forwards := ticker(stop, l.config.ForwardInterval)
+	requests := ticker(stop, l.config.RequestInterval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lifetime:
+			return
+		case <-closed:
+			if ctx.Err() == nil {
+				l.mu.Lock()
+				l.drops++
+				l.mu.Unlock()
+			}
+			return
+		case <-forwards:
+			go l.forward(connCtx, conn)
+		case <-requests:
+			go l.request(connCtx, conn)
+		}
+	}
+}
+
+// ticker ticks every interval until stop is closed, starting at a random point in the first interval so clients do not move in step. It never ticks if interval is 0
+func ticker(stop <-chan struct{}, interval time.Duration) <-chan time.Time {
+	if interval <= 0 {
+		return nil
+	}
+
+	ticks := make(chan time.Time)
+	go func() {
+		select {
+		case <-time.After(rand.N(interval)):
+		case <-stop:
+			return
+		}
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case now := <-t.C:
+				select {
+				case ticks <- now:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return ticks
+}
+
+// forward opens a forward back to the server, as if something on the client connected to a forwarded port, and times the server's ssh version coming back through it
+func (l *LoadTest) forward(ctx context.Context, conn ssh.Conn) {
+	start := time.Now()
+
+	ch, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&internal.ChannelOpenDirectMsg{
+		Raddr: "127.0.0.1",
+		Rport: 22,
+		Laddr: "127.0.0.1",
+		Lport: 22,
+	}))
+	if err != nil {
+		l.record(ctx, &l.forwards, 0, err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer ch.Close()
+
+	// Channels have no deadlines
+	timer := time.AfterFunc(l.config.Timeout, func() { ch.Close() })
+	defer timer.Stop()
+
+	if _, err := ch.Write([]byte("SSH-2.0-loadtest\r\n")); err != nil {
+		l.record(ctx, &l.forwards, 0, err)
+		return
+	}
+
+	if _, err := bufio.NewReader(ch).ReadString('\n'); err != nil {
+		l.record(ctx, &l.forwards, 0, fmt.Errorf("no version through forward: %w", err))
+		return
+	}
+
+	l.record(ctx, &l.forwards, time.Since(start), nil)
+}
+
+func (l *LoadTest) request(ctx context.Context, conn ssh.Conn) {
+	start := time.Now()
+
+	ok, _, err := conn.SendRequest("time@rssh", true, []byte(strconv.FormatInt(start.UnixNano(), 10)))
+	if err == nil && !ok {
+		err = errors.New("server refused time@rssh")
+	}
+
+	l.record(ctx, &l.requests, time.Since(start), err)
+}
+
+// record counts an attempt, failures once the run is over are the run stopping and are not counted
+func (l *LoadTest) record(ctx context.Context, s *Stats, latency time.Duration, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s.Attempts++
+	if err != nil {
+		s.Failures++
+		l.failures[err.Error()]++
+		return
+	}
+
+	s.observe(latency)
+}
@@ -0,0 +1,115 @@
+package loadtest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// fakeServer accepts any key, answers time@rssh, and writes an ssh version down forwards like the server's multiplexer would
+func fakeServer(t *testing.T) string {
+	t.Helper()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(newSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+
+				go func() {
+					for req := range reqs {
+						req.Reply(req.Type == "time@rssh", nil)
+					}
+				}()
+
+				for newChannel := range chans {
+					ch, reqs, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go ssh.DiscardRequests(reqs)
+					ch.Write([]byte("SSH-2.0-fake\r\n"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	lt, err := New(Config{
+		Addr:            fakeServer(t),
+		Signer:          newSigner(t),
+		Clients:         5,
+		Lifetime:        200 * time.Millisecond,
+		ForwardInterval: 50 * time.Millisecond,
+		RequestInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lt.Run(ctx)
+
+	r := lt.Report()
+
+	// Every client reconnects at least once a lifetime and a half
+	if r.Handshakes.Attempts <= 5 {
+		t.Fatalf("%d handshakes, want clients to have churned", r.Handshakes.Attempts)
+	}
+
+	for name, s := range map[string]Stats{"handshakes": r.Handshakes, "forwards": r.Forwards, "requests": r.Requests} {
+		if s.Attempts == 0 || s.Failures != 0 {
+			t.Fatalf("%s: %d attempts, %d failed, failures %v", name, s.Attempts, s.Failures, r.Failures)
+		}
+		if s.Percentile(0.5) <= 0 || s.Percentile(0.5) > s.Percentile(1) {
+			t.Fatalf("%s: p50 %s, max %s", name, s.Percentile(0.5), s.Percentile(1))
+		}
+	}
+
+	if r.Drops != 0 {
+		t.Fatalf("%d connections dropped", r.Drops)
+	}
+}
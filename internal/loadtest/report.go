@@ -0,0 +1,159 @@
+package loadtest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Latencies kept per kind of attempt, past this they are sampled
+const maxSamples = 100000
+
+// Stats counts attempts at one thing, and samples how long the successful ones took
+type Stats struct {
+	Attempts int
+	Failures int
+
+	succeeded int
+	samples   []time.Duration
+}
+
+func (s *Stats) observe(latency time.Duration) {
+	s.succeeded++
+	if len(s.samples) < maxSamples {
+		s.samples = append(s.samples, latency)
+		return
+	}
+
+	// Reservoir sampling, every latency is equally likely to be kept
+	if i := rand.N(s.succeeded); i < maxSamples {
+		s.samples[i] = latency
+	}
+}
+
+func (s Stats) FailureRate() float64 {
+	if s.Attempts == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Attempts)
+}
+
+// Percentile is the latency p (0 to 1) of successful attempts took no longer than
+func (s Stats) Percentile(p float64) time.Duration {
+	if len(s.samples) == 0 {
+		return 0
+	}
+
+	sorted := slices.Clone(s.samples)
+	slices.Sort(sorted)
+
+	i := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+type Report struct {
+	Elapsed   time.Duration
+	Clients   int
+	Connected int
+
+	Handshakes Stats
+	Forwards   Stats
+	Requests   Stats
+
+	// Connections that closed before the client meant to close them
+	Drops int
+
+	// How many times each error was seen
+	Failures map[string]int
+}
+
+// Report is a snapshot of the results so far
+func (l *LoadTest) Report() Report {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := Report{
+		Clients:    l.config.Clients,
+		Connected:  int(l.connected.Load()),
+		Handshakes: l.handshakes.clone(),
+		Forwards:   l.forwards.clone(),
+		Requests:   l.requests.clone(),
+		Drops:      l.drops,
+		Failures:   make(map[string]int, len(l.failures)),
+	}
+	if !l.started.IsZero() {
+		r.Elapsed = time.Since(l.started)
+	}
+	for k, v := range l.failures {
+		r.Failures[k] = v
+	}
+
+	return r
+}
+
+func (s Stats) clone() Stats {
+	s.samples = slices.Clone(s.samples)
+	return s
+}
+
+func (r Report) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%d/%d clients connected after %s, %d connections dropped\n", r.Connected, r.Clients, r.Elapsed.Round(time.Second), r.Drops)
+
+	tw := tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tattempts\tfailed\tfail %\tp50\tp90\tp99\tmax")
+	for _, row := range []struct {
+		name  string
+		stats Stats
+	}{
+		{"handshakes", r.Handshakes},
+		{"forwards", r.Forwards},
+		{"requests", r.Requests},
+	} {
+		if row.stats.Attempts == 0 {
+			continue
+		}
+
+		s := row.stats
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f\t%s\t%s\t%s\t%s\n", row.name, s.Attempts, s.Failures, s.FailureRate()*100,
+			round(s.Percentile(0.5)), round(s.Percentile(0.9)), round(s.Percentile(0.99)), round(s.Percentile(1)))
+	}
+	tw.Flush()
+
+	if len(r.Failures) > 0 {
+		type failure struct {
+			err   string
+			count int
+		}
+
+		var failures []failure
+		for err, count := range r.Failures {
+			failures = append(failures, failure{err, count})
+		}
+		sort.Slice(failures, func(i, j int) bool {
+			return failures[i].count > failures[j].count
+		})
+
+		sb.WriteString("Most common failures:\n")
+		for _, f := range failures[:min(len(failures), 5)] {
+			fmt.Fprintf(&sb, "  %d\t%s\n", f.count, f.err)
+		}
+	}
+
+	return sb.String()
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
@@ -5,18 +5,23 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/NHAS/reverse_ssh/internal/chaos"
 	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/websocket"
 )
 
 const (
@@ -25,6 +30,8 @@ const (
 	derpFlushInterval   = 2 * time.Millisecond
 	derpFlushThreshold  = 64 * 1024
 	derpFlushNowSize    = 16 * 1024
+
+	derpWebSocketProtocol = "derp"
 )
 
 type derpPacket struct {
@@ -52,8 +59,44 @@ type derpClientInfo struct {
 	CanAckPings bool `json:"CanAckPings,omitempty"`
 }
 
+// Hosts the DERP upgrade did not work through but websockets did, they go straight to websockets next time
+var derpWebSocketHosts sync.Map
+
+var derpTLSSessions = tls.NewLRUClientSessionCache(32)
+
 func newDERPClient(ctx context.Context, node vderp.Node, privateKey [32]byte) (*derpClient, error) {
-	conn, err := dialDERPHTTP(ctx, node)
+	_, webSocketFirst := derpWebSocketHosts.Load(node.HostName)
+	if webSocketFirst {
+		if client, err := tracedConnectDERP(ctx, node, privateKey, true); err == nil {
+			return client, nil
+		}
+	}
+
+	client, err := tracedConnectDERP(ctx, node, privateKey, false)
+	if err == nil || webSocketFirst || ctx.Err() != nil {
+		return client, err
+	}
+
+	// Some networks only let clean https and websockets out, and break the upgrade to DERP
+	client, wsErr := tracedConnectDERP(ctx, node, privateKey, true)
+	if wsErr != nil {
+		return nil, errors.Join(err, fmt.Errorf("over websocket: %w", wsErr))
+	}
+
+	log.Printf("ts: derp upgrade to %s failed (%v), using websockets instead", node.HostName, err)
+	derpWebSocketHosts.Store(node.HostName, true)
+
+	return client, nil
+}
+
+// connectDERP connects to the node and does the DERP handshake, over websockets if webSocket is set
+func connectDERP(ctx context.Context, node vderp.Node, privateKey [32]byte, webSocket bool) (*derpClient, error) {
+	dial := dialDERPHTTP
+	if webSocket {
+		dial = dialDERPWebSocket
+	}
+
+	conn, err := dial(ctx, node)
 	if err != nil {
 		return nil, err
 	}
@@ -73,19 +116,31 @@ func newDERPClient(ctx context.Context, node vderp.Node, privateKey [32]byte) (*
 	curve25519.ScalarBaseMult(&public, &privateKey)
 	client.publicKey = public
 
+	// A middlebox that breaks the upgrade may instead let it through and never pass anything on
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
 	if err := client.handshake(); err != nil {
 		_ = conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
+
+	if node.PinnedKey != "" && hex.EncodeToString(client.serverPublic[:]) != strings.ToLower(node.PinnedKey) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("derp relay %s did not present its pinned key", node.HostName)
+	}
 
 	go client.flushLoop()
 
 	return client, nil
 }
 
-func dialDERPHTTP(ctx context.Context, node vderp.Node) (net.Conn, error) {
+// dialDERPTransport connects to the node, over TLS unless it is a test node
+func dialDERPTransport(ctx context.Context, node vderp.Node) (net.Conn, string, error) {
 	if strings.TrimSpace(node.HostName) == "" {
-		return nil, fmt.Errorf("derp node hostname is empty")
+		return nil, "", fmt.Errorf("derp node hostname is empty")
 	}
 
 	port := node.DERPPort
@@ -94,23 +149,34 @@ func dialDERPHTTP(ctx context.Context, node vderp.Node) (net.Conn, error) {
 	}
 	address := net.JoinHostPort(node.HostName, fmt.Sprintf("%d", port))
 
-	dialer := net.Dialer{Timeout: 8 * time.Second}
-	rawConn, err := dialer.DialContext(ctx, "tcp", address)
+	rawConn, err := dialTCP(ctx, address, 8*time.Second)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	httpConn := rawConn
-	if !node.InsecureForTests {
-		tlsConn := tls.Client(rawConn, &tls.Config{
-			MinVersion: tls.VersionTLS12,
-			ServerName: node.HostName,
-		})
-		if err := tlsConn.HandshakeContext(ctx); err != nil {
-			_ = rawConn.Close()
-			return nil, err
-		}
-		httpConn = tlsConn
+	if node.InsecureForTests {
+		return rawConn, address, nil
+	}
+
+	tlsConn := tls.Client(rawConn, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: node.HostName,
+		// Self hosted relays usually have self signed certificates, they are checked by their DERP key after the handshake
+		InsecureSkipVerify: node.PinnedKey != "",
+		// Reconnects resume the TLS session rather than doing a full handshake
+		ClientSessionCache: derpTLSSessions,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = rawConn.Close()
+		return nil, "", err
+	}
+	return tlsConn, address, nil
+}
+
+func dialDERPHTTP(ctx context.Context, node vderp.Node) (net.Conn, error) {
+	httpConn, address, err := dialDERPTransport(ctx, node)
+	if err != nil {
+		return nil, err
 	}
 
 	scheme := "https"
@@ -155,6 +221,41 @@ func dialDERPHTTP(ctx context.Context, node vderp.Node) (net.Conn, error) {
 	}, nil
 }
 
+// dialDERPWebSocket carries DERP in binary websocket messages on /derp, as tailscale's relays and DERPServer accept
+func dialDERPWebSocket(ctx context.Context, node vderp.Node) (net.Conn, error) {
+	httpConn, address, err := dialDERPTransport(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "wss"
+	if node.InsecureForTests {
+		scheme = "ws"
+	}
+	config, err := websocket.NewConfig(scheme+"://"+address+"/derp", "https://"+address)
+	if err != nil {
+		_ = httpConn.Close()
+		return nil, err
+	}
+	config.Protocol = []string{derpWebSocketProtocol}
+
+	// The websocket handshake does not take a context
+	if deadline, ok := ctx.Deadline(); ok {
+		httpConn.SetDeadline(deadline)
+	}
+
+	wsConn, err := websocket.NewClient(config, httpConn)
+	if err != nil {
+		_ = httpConn.Close()
+		return nil, fmt.Errorf("derp websocket handshake failed: %w", err)
+	}
+	httpConn.SetDeadline(time.Time{})
+
+	wsConn.PayloadType = websocket.BinaryFrame
+
+	return wsConn, nil
+}
+
 func (c *derpClient) handshake() error {
 	typ, frameLen, err := readDERPFrameHeader(c.br)
 	if err != nil {
@@ -224,6 +325,11 @@ func (c *derpClient) Recv() (derpPacket, error) {
 		if err != nil {
 			return derpPacket{}, err
 		}
+
+		if chaos.Fail(chaos.DERPDisconnect) {
+			c.Close()
+			return derpPacket{}, errors.New("derp connection dropped by chaos")
+		}
 		payload, err := readDERPFramePayload(c.br, frameLen)
 		if err != nil {
 			return derpPacket{}, err
@@ -0,0 +1,307 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+)
+
+// The server stays connected to its nearest few DERP regions rather than one, and advertises all of them in the token.
+// A client dials in on whichever of them is nearest to it, and replies go back out on the region the client was last heard on,
+// so one degraded region only stops the clients using it until they redial.
+
+const (
+	DefaultDERPHomeRegions = 3
+
+	// Most regions a server stays connected to, and so the most a token can name
+	MaxDERPHomeRegions = 8
+)
+
+// derpHome is one DERP region the server is connected to
+type derpHome struct {
+	regionID int
+	node     vderp.Node
+
+	mu     sync.RWMutex
+	client *derpClient
+
+	// For nat status
+	reconnects  uint64
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func (h *derpHome) getClient() *derpClient {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.client
+}
+
+func (h *derpHome) connect(ctx context.Context, private [32]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, derpConnectTimeout)
+	defer cancel()
+
+	client, err := newDERPClient(ctx, h.node, private)
+	if err != nil {
+		return fmt.Errorf("region %d: %w", h.regionID, err)
+	}
+
+	h.mu.Lock()
+	old := h.client
+	h.client = client
+	h.mu.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+
+	return nil
+}
+
+// drop closes client, if it is still the one in use
+func (h *derpHome) drop(client *derpClient) {
+	h.mu.Lock()
+	if h.client == client {
+		h.client = nil
+	}
+	h.mu.Unlock()
+	_ = client.Close()
+}
+
+func (h *derpHome) close() error {
+	h.mu.Lock()
+	client := h.client
+	h.client = nil
+	h.mu.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+// connectDERPHomes connects to the nearest count regions at once, keeping the ones that worked
+func connectDERPHomes(ctx context.Context, derpMap *vderp.Map, count int, private [32]byte) ([]*derpHome, error) {
+	candidates, err := rankedDERPRegions(ctx, derpMap, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unreachable regions are only tried when there is nothing else
+	reachable := 0
+	for reachable < len(candidates) && candidates[reachable].latency < unreachableDERPLatency {
+		reachable++
+	}
+	if reachable > 0 {
+		candidates = candidates[:reachable]
+	}
+	candidates = candidates[:min(count, len(candidates))]
+
+	homes := make([]*derpHome, len(candidates))
+	errs := make([]error, len(candidates))
+
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		homes[i] = &derpHome{regionID: candidate.regionID, node: candidate.node}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = homes[i].connect(ctx, private)
+		}(i)
+	}
+	wg.Wait()
+
+	var connected []*derpHome
+	for i, home := range homes {
+		if errs[i] != nil {
+			log.Printf("ts: derp home %v", errs[i])
+			continue
+		}
+		connected = append(connected, home)
+	}
+
+	if len(connected) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return connected, nil
+}
+
+// recvDERPLoop reads one home's packets, reconnecting it when it drops
+func (s *Service) recvDERPLoop(home *derpHome) {
+	for s.ctx.Err() == nil {
+		client := home.getClient()
+		if client == nil {
+			if !s.retryDERPConnect(home) {
+				return
+			}
+			continue
+		}
+
+		packet, err := client.Recv()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			log.Printf("ts: derp region %d receive failed: %v", home.regionID, err)
+
+			home.recordError(err)
+			home.drop(client)
+			continue
+		}
+
+		// Dropped before decoding, so a banned peer costs as little as possible
+		if s.peerLimits.banned(packet.Source, time.Now()) {
+			continue
+		}
+
+		message, err := s.signalCipherForPeer(packet.Source).decode(packet.Payload)
+		if err != nil {
+			continue
+		}
+
+		// Answer on the region the peer is using
+		s.setPeerHome(packet.Source, home)
+
+		switch message.Type {
+		case signalDialInit:
+			s.handleDialInit(packet.Source, message)
+		case signalData:
+			s.bytesIn.Add(uint64(len(message.Payload)))
+
+			// Relayed streams cannot lose data, so a peer sending too fast is cut off rather than having packets dropped
+			if !s.peerLimits.allowData(packet.Source, len(message.Payload), time.Now()) {
+				s.banPeer(packet.Source, "relay data rate limit exceeded")
+				continue
+			}
+			s.routeRelayData(packet.Source, message.SessionID, message.Payload)
+		case signalDataCompressed:
+			s.bytesIn.Add(uint64(len(message.Payload)))
+
+			if !s.peerLimits.allowData(packet.Source, len(message.Payload), time.Now()) {
+				s.banPeer(packet.Source, "relay data rate limit exceeded")
+				continue
+			}
+
+			payload, err := decompressRelay(message.Payload)
+			if err != nil {
+				log.Printf("ts: session=%x: %v", message.SessionID[:4], err)
+				s.routeRelayClose(packet.Source, message.SessionID)
+				continue
+			}
+			s.routeRelayData(packet.Source, message.SessionID, payload)
+		case signalCompression:
+			s.routeCompression(packet.Source, message.SessionID, message.Payload)
+		case signalClose:
+			s.routeRelayClose(packet.Source, message.SessionID)
+		case signalPathSwitch:
+			s.routePathSwitch(packet.Source, message.SessionID)
+		case signalCandidates:
+			s.routePeerPublic(packet.Source, message.SessionID, message.Payload)
+		case signalWindow:
+			s.routeWindow(packet.Source, message.SessionID, message.Payload)
+		case signalNATType:
+			s.routePeerNAT(packet.Source, message.SessionID, message.Payload)
+		}
+	}
+}
+
+func (s *Service) retryDERPConnect(home *derpHome) bool {
+	for s.ctx.Err() == nil {
+		if err := home.connect(s.ctx, s.derpPrivate); err != nil {
+			log.Printf("ts: derp reconnect failed: %v", err)
+			home.recordError(err)
+
+			select {
+			case <-s.ctx.Done():
+			case <-time.After(derpRetryPeriod):
+			}
+			continue
+		}
+
+		home.mu.Lock()
+		home.reconnects++
+		home.mu.Unlock()
+		return true
+	}
+
+	return false
+}
+
+// rerankLoop measures every region again now and then, so nat status and the next start have current latencies.
+// The homes are named in the tokens clients already have so they are kept, a much nearer region is only reported
+func (s *Service) rerankLoop(derpMapURL string) {
+	ticker := time.NewTicker(derpRerankInterval)
+	defer ticker.Stop()
+
+	reported := 0
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		derpMap, err := FetchDERPMap(s.ctx, derpMapURL)
+		if err != nil {
+			log.Printf("ts: re-ranking derp regions failed: %v", err)
+			continue
+		}
+
+		candidates, err := rankDERPRegions(s.ctx, derpMap, nil, 0)
+		if err != nil {
+			log.Printf("ts: re-ranking derp regions failed: %v", err)
+			continue
+		}
+
+		farthest := time.Duration(0)
+		for _, home := range s.derpHomes {
+			latency := unreachableDERPLatency
+			for _, candidate := range candidates {
+				if candidate.regionID == home.regionID {
+					latency = candidate.latency
+				}
+			}
+			farthest = max(farthest, latency)
+		}
+
+		best := candidates[0]
+		if best.regionID != reported && !slices.ContainsFunc(s.derpHomes, func(h *derpHome) bool { return h.regionID == best.regionID }) &&
+			nearerDERPRegion(best.latency, farthest) {
+			reported = best.regionID
+			log.Printf("ts: derp region %d (%v) is now much nearer than the server's farthest home (%v), it is used after a restart and new tokens", best.regionID, best.latency.Round(time.Millisecond), farthest.Round(time.Millisecond))
+		}
+	}
+}
+
+func (s *Service) setPeerHome(peer [32]byte, home *derpHome) {
+	s.peerHomeMu.Lock()
+	s.peerHomes[peer] = home
+	s.peerHomeMu.Unlock()
+}
+
+// derpClientForPeer is the client for the region peer was last heard on, or any connected one if that region is down
+func (s *Service) derpClientForPeer(peer [32]byte) *derpClient {
+	s.peerHomeMu.Lock()
+	home := s.peerHomes[peer]
+	s.peerHomeMu.Unlock()
+
+	if home != nil {
+		if client := home.getClient(); client != nil {
+			return client
+		}
+	}
+
+	for _, home := range s.derpHomes {
+		if client := home.getClient(); client != nil {
+			return client
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package nat
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+)
+
+// DERP latencies are kept once measured, so dials and the server's homes only probe nodes that have not been measured within derpLatencyTTL.
+// Long lived users measure again every derpRerankInterval (see derp_rehome.go). With a cache file, which the server keeps in its data
+// directory, measurements outlive restarts. Unreachable nodes are never kept, a region that was down is probed again next time.
+
+const (
+	derpLatencyTTL = 30 * time.Minute
+
+	// How often relay sessions and the server measure every region again
+	derpRerankInterval = 5 * time.Minute
+)
+
+type derpLatencySample struct {
+	Latency  time.Duration `json:"latency"`
+	Measured time.Time     `json:"measured"`
+}
+
+var (
+	derpLatencyMu   sync.Mutex
+	derpLatencies   = map[string]derpLatencySample{}
+	derpLatencyFile string
+)
+
+func derpNodeKey(node vderp.Node) string {
+	port := node.DERPPort
+	if port == 0 {
+		port = 443
+	}
+	return net.JoinHostPort(node.HostName, strconv.Itoa(port))
+}
+
+// useDERPLatencyFile loads the measurements kept in path, and keeps new ones there. A missing file is not an error
+func useDERPLatencyFile(path string) error {
+	derpLatencyMu.Lock()
+	defer derpLatencyMu.Unlock()
+
+	derpLatencyFile = path
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var saved map[string]derpLatencySample
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return err
+	}
+
+	for key, sample := range saved {
+		if current, ok := derpLatencies[key]; !ok || sample.Measured.After(current.Measured) {
+			derpLatencies[key] = sample
+		}
+	}
+	return nil
+}
+
+// cachedDERPLatency is node's last latency if it was measured within maxAge
+func cachedDERPLatency(node vderp.Node, maxAge time.Duration) (time.Duration, bool) {
+	derpLatencyMu.Lock()
+	defer derpLatencyMu.Unlock()
+
+	sample, ok := derpLatencies[derpNodeKey(node)]
+	if !ok || time.Since(sample.Measured) > maxAge {
+		return 0, false
+	}
+	return sample.Latency, true
+}
+
+// recordDERPLatencies keeps measurements, writing them to the cache file when there is one
+func recordDERPLatencies(measured map[string]time.Duration) {
+	if len(measured) == 0 {
+		return
+	}
+
+	derpLatencyMu.Lock()
+	defer derpLatencyMu.Unlock()
+
+	now := time.Now()
+	for key, latency := range measured {
+		if latency >= unreachableDERPLatency {
+			delete(derpLatencies, key)
+			continue
+		}
+		derpLatencies[key] = derpLatencySample{Latency: latency, Measured: now}
+	}
+
+	// Nodes that left the map are dropped eventually
+	for key, sample := range derpLatencies {
+		if now.Sub(sample.Measured) > 24*time.Hour {
+			delete(derpLatencies, key)
+		}
+	}
+
+	if derpLatencyFile != "" {
+		if err := writeDERPLatencies(derpLatencyFile, derpLatencies); err != nil {
+			log.Printf("ts: unable to save derp latencies: %v", err)
+		}
+	}
+}
+
+// forgetDERPLatency drops node's measurement, after it failed to connect
+func forgetDERPLatency(node vderp.Node) {
+	derpLatencyMu.Lock()
+	delete(derpLatencies, derpNodeKey(node))
+	derpLatencyMu.Unlock()
+}
+
+func writeDERPLatencies(path string, samples map[string]derpLatencySample) error {
+	content, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".derp_latency")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
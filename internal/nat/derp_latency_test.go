@@ -0,0 +1,132 @@
+package nat
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+)
+
+func resetDERPLatencies(t *testing.T) {
+	t.Cleanup(func() {
+		derpLatencyMu.Lock()
+		derpLatencies = map[string]derpLatencySample{}
+		derpLatencyFile = ""
+		derpLatencyMu.Unlock()
+	})
+
+	derpLatencyMu.Lock()
+	derpLatencies = map[string]derpLatencySample{}
+	derpLatencyFile = ""
+	derpLatencyMu.Unlock()
+}
+
+func TestDERPLatenciesAreReusedAndPersisted(t *testing.T) {
+	resetDERPLatencies(t)
+
+	derpMap := &vderp.Map{
+		Regions: map[int]vderp.Region{
+			1: {RegionID: 1, Nodes: []vderp.Node{{Name: "one", RegionID: 1, HostName: "latency-one.example"}}},
+			2: {RegionID: 2, Nodes: []vderp.Node{{Name: "two", RegionID: 2, HostName: "latency-two.example"}}},
+			3: {RegionID: 3, Nodes: []vderp.Node{{Name: "three", RegionID: 3, HostName: "latency-three.example"}}},
+		},
+	}
+
+	var probes atomic.Int32
+	originalProbe := measureDERPNodeLatencyFunc
+	measureDERPNodeLatencyFunc = func(_ context.Context, node vderp.Node, _ time.Duration) time.Duration {
+		probes.Add(1)
+		switch node.RegionID {
+		case 1:
+			return 40 * time.Millisecond
+		case 2:
+			return 10 * time.Millisecond
+		default:
+			return unreachableDERPLatency
+		}
+	}
+	t.Cleanup(func() {
+		measureDERPNodeLatencyFunc = originalProbe
+	})
+
+	path := filepath.Join(t.TempDir(), "derp_latency.json")
+	if err := useDERPLatencyFile(path); err != nil {
+		t.Fatalf("useDERPLatencyFile() on a missing file error = %v", err)
+	}
+
+	candidates, err := rankedDERPRegions(context.Background(), derpMap, nil)
+	if err != nil {
+		t.Fatalf("rankedDERPRegions() error = %v", err)
+	}
+	if candidates[0].regionID != 2 || probes.Load() != 3 {
+		t.Fatalf("first ranking = region %d after %d probes, want region 2 after 3", candidates[0].regionID, probes.Load())
+	}
+
+	// Only the unreachable region is probed again
+	if _, err := rankedDERPRegions(context.Background(), derpMap, nil); err != nil {
+		t.Fatalf("rankedDERPRegions() error = %v", err)
+	}
+	if probes.Load() != 4 {
+		t.Fatalf("probes = %d after ranking again, want 4", probes.Load())
+	}
+
+	// A restart has the measurements from the file
+	derpLatencyMu.Lock()
+	derpLatencies = map[string]derpLatencySample{}
+	derpLatencyMu.Unlock()
+
+	if err := useDERPLatencyFile(path); err != nil {
+		t.Fatalf("useDERPLatencyFile() error = %v", err)
+	}
+	if latency, ok := cachedDERPLatency(derpMap.Regions[2].Nodes[0], derpLatencyTTL); !ok || latency != 10*time.Millisecond {
+		t.Fatalf("loaded latency = %v, %v, want 10ms", latency, ok)
+	}
+
+	// Re-ranking measures everything
+	if _, err := rankDERPRegions(context.Background(), derpMap, nil, 0); err != nil {
+		t.Fatalf("rankDERPRegions() error = %v", err)
+	}
+	if probes.Load() != 7 {
+		t.Fatalf("probes = %d after re-ranking, want 7", probes.Load())
+	}
+}
+
+func TestNearerDERPRegion(t *testing.T) {
+	for _, c := range []struct {
+		latency, current time.Duration
+		want             bool
+	}{
+		{10 * time.Millisecond, 80 * time.Millisecond, true},
+		{10 * time.Millisecond, unreachableDERPLatency, true},
+		// Not enough faster
+		{60 * time.Millisecond, 80 * time.Millisecond, false},
+		// A large fraction but only a few milliseconds
+		{2 * time.Millisecond, 15 * time.Millisecond, false},
+	} {
+		if got := nearerDERPRegion(c.latency, c.current); got != c.want {
+			t.Errorf("nearerDERPRegion(%v, %v) = %v, want %v", c.latency, c.current, got, c.want)
+		}
+	}
+}
+
+func TestDERPLinkOnlyMovesWhenQuiet(t *testing.T) {
+	first, second := &derpClient{closed: make(chan struct{})}, &derpClient{closed: make(chan struct{})}
+	link := newDERPLink(first, 1, vderp.Node{})
+
+	link.received()
+	if _, ok := link.move(second, 2, vderp.Node{}); ok {
+		t.Fatal("link moved straight after receiving")
+	}
+
+	link.lastRecv.Store(time.Now().Add(-2 * derpRehomeQuiet).UnixNano())
+	old, ok := link.move(second, 2, vderp.Node{})
+	if !ok || old != first || link.current() != second {
+		t.Fatalf("move() = %p, %v, current %p, want %p, true, current %p", old, ok, link.current(), first, second)
+	}
+	if region, _ := link.region(); region != 2 {
+		t.Fatalf("region = %d, want 2", region)
+	}
+}
@@ -22,6 +22,8 @@ const (
 	derpFramePong       derpFrameType = 0x13
 
 	derpMaxFrameSize = 1 << 20
+	// Frames up to this size are allocated in one go, larger ones are read incrementally
+	derpMaxPreallocatedFrame = 64 << 10
 )
 
 func writeDERPFrameHeader(w *bufio.Writer, typ derpFrameType, frameLen uint32) error {
@@ -62,6 +64,18 @@ func readDERPFramePayload(r *bufio.Reader, length uint32) ([]byte, error) {
 	if length > derpMaxFrameSize {
 		return nil, fmt.Errorf("derp frame too large: %d", length)
 	}
+	if length > derpMaxPreallocatedFrame {
+		// The length comes from the relay (or whoever is pretending to be it), so only grow as the data actually arrives
+		payload, err := io.ReadAll(io.LimitReader(r, int64(length)))
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) != int(length) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return payload, nil
+	}
+
 	payload := make([]byte, int(length))
 	if length == 0 {
 		return payload, nil
@@ -0,0 +1,226 @@
+package nat
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+)
+
+// A client's relay session stays on the DERP region it was dialed through, which was the nearest at the time. Every derpRerankInterval the
+// session measures the server's regions again and, when one has become a lot nearer, moves to it: it connects to the new region, waits until
+// nothing has been sent or received for derpRehomeQuiet so nothing in flight on the old region can arrive after what is sent on the new one,
+// and sends from then on through the new region. The server answers on the region a peer was last heard on, so it follows. The old
+// connection is kept for derpRehomeGrace in case anything was still on its way.
+//
+// Only sessions whose token lists the server's regions move, as with older tokens it is not known which regions the server is on.
+
+const (
+	// A region has to be both this much and this fraction nearer before a session moves to it
+	derpRehomeMinGain  = 20 * time.Millisecond
+	derpRehomeMinRatio = 0.7
+
+	derpRehomeQuiet = 2 * time.Second
+	// How long a session waits for a quiet moment before trying again at the next re-rank
+	derpRehomeWait  = time.Minute
+	derpRehomeGrace = 10 * time.Second
+)
+
+// nearerDERPRegion says whether latency is enough better than current to move to
+func nearerDERPRegion(latency, current time.Duration) bool {
+	return current-latency >= derpRehomeMinGain && float64(latency) <= float64(current)*derpRehomeMinRatio
+}
+
+// derpLink is the DERP connection a client's relay session goes through
+type derpLink struct {
+	// Held for each send, so the connection does not change under one
+	sendMu sync.Mutex
+
+	mu       sync.Mutex
+	client   *derpClient
+	regionID int
+	node     vderp.Node
+	retired  []*derpClient
+	closed   bool
+
+	// Unix nanoseconds
+	lastSent, lastRecv atomic.Int64
+}
+
+func newDERPLink(client *derpClient, regionID int, node vderp.Node) *derpLink {
+	return &derpLink{client: client, regionID: regionID, node: node}
+}
+
+func (l *derpLink) send(destination [32]byte, raw []byte) error {
+	l.sendMu.Lock()
+	defer l.sendMu.Unlock()
+
+	l.lastSent.Store(time.Now().UnixNano())
+	return l.current().Send(destination, raw)
+}
+
+func (l *derpLink) received() {
+	l.lastRecv.Store(time.Now().UnixNano())
+}
+
+func (l *derpLink) current() *derpClient {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.client
+}
+
+func (l *derpLink) region() (int, vderp.Node) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.regionID, l.node
+}
+
+func (l *derpLink) quiet(now time.Time) bool {
+	since := now.Add(-derpRehomeQuiet).UnixNano()
+	return l.lastSent.Load() <= since && l.lastRecv.Load() <= since
+}
+
+// move switches sends to client if the session is quiet and not closed, returning the connection it replaced
+func (l *derpLink) move(client *derpClient, regionID int, node vderp.Node) (*derpClient, bool) {
+	// A send in progress means it is not quiet
+	if !l.sendMu.TryLock() {
+		return nil, false
+	}
+	defer l.sendMu.Unlock()
+
+	if !l.quiet(time.Now()) {
+		return nil, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, false
+	}
+
+	old := l.client
+	l.client, l.regionID, l.node = client, regionID, node
+	l.retired = append(l.retired, old)
+	return old, true
+}
+
+func (l *derpLink) close() {
+	l.mu.Lock()
+	l.closed = true
+	clients := append([]*derpClient{l.client}, l.retired...)
+	l.mu.Unlock()
+
+	for _, client := range clients {
+		_ = client.Close()
+	}
+}
+
+// rehomeLoop moves the session to a much nearer region of the server's when one appears, until the session closes.
+// receive reads a connection's packets for the session
+func rehomeLoop(token *Token, relay *relayConn, link *derpLink, derpPrivate [32]byte, receive func(*derpClient) error) {
+	if len(token.Regions) < 2 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-relay.closed
+		cancel()
+	}()
+
+	ticker := time.NewTicker(derpRerankInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if relay.Path() == "direct" {
+			continue
+		}
+
+		if err := rehome(ctx, token, relay, link, derpPrivate, receive); err != nil {
+			log.Printf("ts: session=%x: re-ranking derp regions failed: %v", relay.sessionID[:4], err)
+		}
+	}
+}
+
+func rehome(ctx context.Context, token *Token, relay *relayConn, link *derpLink, derpPrivate [32]byte, receive func(*derpClient) error) error {
+	derpMap, err := FetchDERPMap(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	candidates, err := rankDERPRegions(ctx, derpMap, token.Regions, 0)
+	if err != nil {
+		return err
+	}
+
+	currentRegion, _ := link.region()
+	current := unreachableDERPLatency
+	for _, candidate := range candidates {
+		if candidate.regionID == currentRegion {
+			current = candidate.latency
+		}
+	}
+
+	best := candidates[0]
+	if best.regionID == currentRegion || !nearerDERPRegion(best.latency, current) {
+		return nil
+	}
+
+	client, err := newDERPClient(ctx, best.node, derpPrivate)
+	if err != nil {
+		forgetDERPLatency(best.node)
+		return err
+	}
+	go receive(client)
+
+	wait := time.NewTimer(derpRehomeWait)
+	defer wait.Stop()
+
+	poll := time.NewTicker(derpRehomeQuiet / 4)
+	defer poll.Stop()
+
+	for {
+		if old, ok := link.move(client, best.regionID, best.node); ok {
+			time.AfterFunc(derpRehomeGrace, func() { _ = old.Close() })
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = client.Close()
+			return nil
+		case <-wait.C:
+			// Never quiet, try again at the next re-rank
+			_ = client.Close()
+			return nil
+		case <-poll.C:
+		}
+	}
+
+	// So the server answers on the new region without waiting for data
+	if err := relay.sendControl(signalMessage{
+		Type:      signalWindow,
+		SessionID: relay.sessionID,
+		Payload:   encodeRelayWindow(0),
+	}); err != nil {
+		return err
+	}
+
+	moveRelay(token.ServerDERPPublicKey, best.regionID, best.node)
+
+	log.Printf("ts: session=%x moved from derp region %d (%v) to %d (%v)", relay.sessionID[:4], currentRegion, current.Round(time.Millisecond), best.regionID, best.latency.Round(time.Millisecond))
+	return nil
+}
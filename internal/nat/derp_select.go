@@ -1,8 +1,10 @@
 package nat
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -26,17 +28,42 @@ const (
 var measureDERPNodeLatencyFunc = measureDERPNodeLatency
 
 // pickNearestDERPNode chooses the lowest-latency relay region.
-func pickNearestDERPNode(derpMap *vderp.Map) (int, vderp.Node, error) {
-	candidates, err := orderedDERPRegionCandidatesStable(derpMap)
+func pickNearestDERPNode(ctx context.Context, derpMap *vderp.Map) (int, vderp.Node, error) {
+	candidates, err := rankedDERPRegions(ctx, derpMap, nil)
 	if err != nil {
 		return 0, vderp.Node{}, err
 	}
 
-	rankDERPRegionCandidatesByLatency(candidates)
 	selected := candidates[0]
 	return selected.regionID, selected.node, nil
 }
 
+// rankedDERPRegions is every usable region nearest first, limited to the regions in only when it is not empty. Latencies measured within
+// derpLatencyTTL are used rather than probing again
+func rankedDERPRegions(ctx context.Context, derpMap *vderp.Map, only []int) ([]derpRegionCandidate, error) {
+	return rankDERPRegions(ctx, derpMap, only, derpLatencyTTL)
+}
+
+// rankDERPRegions is rankedDERPRegions, probing every node not measured within maxAge
+func rankDERPRegions(ctx context.Context, derpMap *vderp.Map, only []int, maxAge time.Duration) ([]derpRegionCandidate, error) {
+	candidates, err := orderedDERPRegionCandidatesStable(derpMap)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(only) > 0 {
+		candidates = slices.DeleteFunc(candidates, func(c derpRegionCandidate) bool {
+			return !slices.Contains(only, c.regionID)
+		})
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("derp map has none of the regions %v", only)
+		}
+	}
+
+	rankDERPRegionCandidatesByLatency(ctx, candidates, maxAge)
+	return candidates, nil
+}
+
 func orderedDERPRegionCandidatesStable(derpMap *vderp.Map) ([]derpRegionCandidate, error) {
 	if derpMap == nil || len(derpMap.Regions) == 0 {
 		return nil, fmt.Errorf("derp map has no regions")
@@ -105,7 +132,7 @@ func normaliseDERPNode(node vderp.Node) (vderp.Node, bool) {
 	return node, true
 }
 
-func rankDERPRegionCandidatesByLatency(candidates []derpRegionCandidate) {
+func rankDERPRegionCandidatesByLatency(ctx context.Context, candidates []derpRegionCandidate, maxAge time.Duration) {
 	if len(candidates) <= 1 {
 		return
 	}
@@ -124,12 +151,17 @@ func rankDERPRegionCandidatesByLatency(candidates []derpRegionCandidate) {
 	}
 
 	for i, candidate := range candidates {
+		if latency, ok := cachedDERPLatency(candidate.node, maxAge); ok {
+			candidates[i].latency = latency
+			continue
+		}
+
 		wg.Add(1)
 		go func(index int, node vderp.Node) {
 			defer wg.Done()
 
 			sem <- struct{}{}
-			latency := measureDERPNodeLatencyFunc(node, derpLatencyProbeTimeout)
+			latency := measureDERPNodeLatencyFunc(ctx, node, derpLatencyProbeTimeout)
 			<-sem
 
 			results <- probeResult{index: index, latency: latency}
@@ -139,8 +171,14 @@ func rankDERPRegionCandidatesByLatency(candidates []derpRegionCandidate) {
 	wg.Wait()
 	close(results)
 
+	measured := make(map[string]time.Duration, len(candidates))
 	for result := range results {
 		candidates[result.index].latency = result.latency
+		measured[derpNodeKey(candidates[result.index].node)] = result.latency
+	}
+	// A probe cut short by ctx says nothing about the node
+	if ctx.Err() == nil {
+		recordDERPLatencies(measured)
 	}
 
 	sort.SliceStable(candidates, func(i, j int) bool {
@@ -151,14 +189,14 @@ func rankDERPRegionCandidatesByLatency(candidates []derpRegionCandidate) {
 	})
 }
 
-func measureDERPNodeLatency(node vderp.Node, timeout time.Duration) time.Duration {
+func measureDERPNodeLatency(ctx context.Context, node vderp.Node, timeout time.Duration) time.Duration {
 	port := node.DERPPort
 	if port == 0 {
 		port = 443
 	}
 
 	start := time.Now()
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(node.HostName, fmt.Sprintf("%d", port)), timeout)
+	conn, err := dialTCP(ctx, net.JoinHostPort(node.HostName, fmt.Sprintf("%d", port)), timeout)
 	if err != nil {
 		return unreachableDERPLatency
 	}
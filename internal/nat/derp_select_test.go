@@ -1,6 +1,7 @@
 package nat
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -33,7 +34,7 @@ func TestPickNearestDERPNodeFallsBackToNextUsableRegion(t *testing.T) {
 		},
 	}
 
-	regionID, selected, err := pickNearestDERPNode(derpMap)
+	regionID, selected, err := pickNearestDERPNode(context.Background(), derpMap)
 	if err != nil {
 		t.Fatalf("pickNearestDERPNode() error = %v", err)
 	}
@@ -82,7 +83,7 @@ func TestPickNearestDERPNodePrefersLowestLatency(t *testing.T) {
 	}
 
 	originalProbe := measureDERPNodeLatencyFunc
-	measureDERPNodeLatencyFunc = func(node vderp.Node, _ time.Duration) time.Duration {
+	measureDERPNodeLatencyFunc = func(_ context.Context, node vderp.Node, _ time.Duration) time.Duration {
 		switch node.HostName {
 		case "derp-one.example":
 			return 32 * time.Millisecond
@@ -98,7 +99,7 @@ func TestPickNearestDERPNodePrefersLowestLatency(t *testing.T) {
 		measureDERPNodeLatencyFunc = originalProbe
 	})
 
-	regionID, selected, err := pickNearestDERPNode(derpMap)
+	regionID, selected, err := pickNearestDERPNode(context.Background(), derpMap)
 	if err != nil {
 		t.Fatalf("pickNearestDERPNode() error = %v", err)
 	}
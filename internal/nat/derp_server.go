@@ -0,0 +1,413 @@
+package nat
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	derpServerHandshakeTimeout = 10 * time.Second
+	derpServerKeepAlive        = time.Minute
+
+	// Packets waiting for a slow peer, if it stays full for derpServerSendTimeout the peer is disconnected rather than dropping packets
+	derpServerQueueSize   = 256
+	derpServerSendTimeout = 5 * time.Second
+
+	derpMaxPacketSize = 64 * 1024
+)
+
+// DERPServer is a DERP relay run inside the rssh server, so clients do not need tailscale's public relays
+type DERPServer struct {
+	private [32]byte
+	public  [32]byte
+
+	// Packets are only relayed to or from this key, so the relay cannot be used by anyone else
+	only [32]byte
+
+	mu      sync.Mutex
+	clients map[[32]byte]*derpServerClient
+
+	webSocket websocket.Server
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type derpServerClient struct {
+	key  [32]byte
+	conn net.Conn
+
+	queue chan derpServerFrame
+	done  chan struct{}
+
+	closeOnce sync.Once
+}
+
+type derpServerFrame struct {
+	typ     derpFrameType
+	payload []byte
+}
+
+// NewDERPServer makes a relay with the DERP key private, which only relays packets to and from the key only
+func NewDERPServer(private, only [32]byte) *DERPServer {
+	s := &DERPServer{
+		private: private,
+		only:    only,
+		clients: make(map[[32]byte]*derpServerClient),
+		closed:  make(chan struct{}),
+	}
+	curve25519.ScalarBaseMult(&s.public, &s.private)
+
+	s.webSocket = websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if !slices.Contains(config.Protocol, derpWebSocketProtocol) {
+				return errors.New("not a derp websocket")
+			}
+			config.Protocol = []string{derpWebSocketProtocol}
+			return nil
+		},
+		Handler: s.serveWebSocket,
+	}
+
+	return s
+}
+
+func (s *DERPServer) PublicKey() [32]byte {
+	return s.public
+}
+
+// Serve accepts relay connections on l, over TLS with certificate, until Close is called
+func (s *DERPServer) Serve(l net.Listener, certificate tls.Certificate) error {
+	srv := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: derpServerHandshakeTimeout,
+		TLSConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{certificate},
+		},
+	}
+
+	go func() {
+		<-s.closed
+		srv.Close()
+	}()
+
+	err := srv.ServeTLS(l, "", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// SelfSignedCertificate makes a certificate for a relay with no configured one, clients check the relay by its DERP key instead
+func SelfSignedCertificate(commonName string) (tls.Certificate, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	// Relays addressed by IP, including IPv6 ones, name it as an address rather than a host name
+	if ip := net.ParseIP(commonName); ip != nil {
+		template.DNSNames = nil
+		template.IPAddresses = []net.IP{ip}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, private.Public(), private)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: private}, nil
+}
+
+func (s *DERPServer) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, c := range s.clients {
+			c.close()
+		}
+		s.clients = make(map[[32]byte]*derpServerClient)
+	})
+}
+
+func (s *DERPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/derp" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		s.webSocket.ServeHTTP(w, r)
+		return
+	}
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "DERP") {
+		http.Error(w, "DERP requires connection upgrade", http.StatusUpgradeRequired)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: DERP\r\n\r\n")
+	if _, err := s.accept(conn, rw); err != nil {
+		log.Printf("derp relay: refused %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
+
+// serveWebSocket relays for clients behind networks that break the DERP upgrade, the websocket closes when the handler returns
+func (s *DERPServer) serveWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+
+	client, err := s.accept(ws, bufio.NewReadWriter(bufio.NewReader(ws), bufio.NewWriter(ws)))
+	if err != nil {
+		log.Printf("derp relay: refused %s over websocket: %v", ws.Request().RemoteAddr, err)
+		return
+	}
+
+	<-client.done
+}
+
+func (s *DERPServer) accept(conn net.Conn, rw *bufio.ReadWriter) (*derpServerClient, error) {
+	conn.SetDeadline(time.Now().Add(derpServerHandshakeTimeout))
+
+	if err := writeDERPFrame(rw.Writer, derpFrameServerKey, append([]byte(derpMagic), s.public[:]...)); err != nil {
+		return nil, err
+	}
+
+	typ, frameLen, err := readDERPFrameHeader(rw.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if typ != derpFrameClientInfo || frameLen > 1024 {
+		return nil, fmt.Errorf("expected client info, got frame %d", typ)
+	}
+
+	payload, err := readDERPFramePayload(rw.Reader, frameLen)
+	if err != nil {
+		return nil, err
+	}
+
+	// client_pub(32) + nonce(24) + sealed info
+	if len(payload) < 32+24+box.Overhead {
+		return nil, errors.New("short client info")
+	}
+
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], payload[:32])
+	copy(nonce[:], payload[32:56])
+
+	if _, ok := box.Open(nil, payload[56:], &nonce, &key, &s.private); !ok {
+		return nil, errors.New("client info is not sealed to this relay's key")
+	}
+
+	info, err := json.Marshal(map[string]int{"version": 2})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	if err := writeDERPFrame(rw.Writer, derpFrameServerInfo, box.Seal(nonce[:], info, &nonce, &key, &s.private)); err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	client := &derpServerClient{
+		key:   key,
+		conn:  conn,
+		queue: make(chan derpServerFrame, derpServerQueueSize),
+		done:  make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	// A peer that reconnects replaces its old connection
+	if old := s.clients[key]; old != nil {
+		old.close()
+	}
+	s.clients[key] = client
+	s.mu.Unlock()
+
+	go client.writeLoop(rw.Writer)
+	go s.readLoop(client, rw.Reader)
+
+	return client, nil
+}
+
+func (s *DERPServer) readLoop(client *derpServerClient, r *bufio.Reader) {
+	defer func() {
+		client.close()
+
+		s.mu.Lock()
+		if s.clients[client.key] == client {
+			delete(s.clients, client.key)
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		typ, frameLen, err := readDERPFrameHeader(r)
+		if err != nil {
+			return
+		}
+		if frameLen > 32+derpMaxPacketSize {
+			return
+		}
+
+		payload, err := readDERPFramePayload(r, frameLen)
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case derpFrameSendPacket:
+			if len(payload) < 32 {
+				continue
+			}
+
+			var dst [32]byte
+			copy(dst[:], payload[:32])
+			s.forward(client.key, dst, payload[32:])
+		case derpFramePing:
+			if len(payload) < 8 {
+				continue
+			}
+			client.send(derpFramePong, append([]byte(nil), payload[:8]...))
+		}
+	}
+}
+
+func (s *DERPServer) forward(src, dst [32]byte, packet []byte) {
+	if src != s.only && dst != s.only {
+		return
+	}
+
+	s.mu.Lock()
+	target := s.clients[dst]
+	s.mu.Unlock()
+	if target == nil {
+		return
+	}
+
+	frame := make([]byte, 0, 32+len(packet))
+	frame = append(frame, src[:]...)
+	frame = append(frame, packet...)
+
+	target.send(derpFrameRecvPacket, frame)
+}
+
+// send queues a frame, the relay transport needs every packet in order so a peer that cannot keep up is dropped instead
+func (c *derpServerClient) send(typ derpFrameType, payload []byte) {
+	select {
+	case c.queue <- derpServerFrame{typ: typ, payload: payload}:
+		return
+	case <-c.done:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(derpServerSendTimeout)
+	defer timer.Stop()
+
+	select {
+	case c.queue <- derpServerFrame{typ: typ, payload: payload}:
+	case <-c.done:
+	case <-timer.C:
+		log.Printf("derp relay: %s is not keeping up, disconnecting it", c.conn.RemoteAddr())
+		c.close()
+	}
+}
+
+func (c *derpServerClient) writeLoop(w *bufio.Writer) {
+	keepAlive := time.NewTicker(derpServerKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var frame derpServerFrame
+		select {
+		case <-c.done:
+			return
+		case <-keepAlive.C:
+			frame = derpServerFrame{typ: derpFrameKeepAlive}
+		case frame = <-c.queue:
+		}
+
+		if err := writeDERPFrameHeader(w, frame.typ, uint32(len(frame.payload))); err != nil {
+			c.close()
+			return
+		}
+		if _, err := w.Write(frame.payload); err != nil {
+			c.close()
+			return
+		}
+
+		// Batch up whatever else is already waiting
+		if len(c.queue) == 0 {
+			if err := w.Flush(); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *derpServerClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,243 @@
+package nat
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDialThroughPrivateRelay(t *testing.T) {
+	// Nothing should be fetched when the server runs its own relay
+	t.Setenv(DERPMapURLEnvVar, "http://127.0.0.1:1/unreachable")
+
+	hostKey := []byte("test-key-private-relay")
+	relayPrivate, relayPublic, err := DeriveRelayIdentity(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, servicePublic, err := DeriveDERPIdentity(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := SelfSignedCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := NewDERPServer(relayPrivate, servicePublic)
+	defer relay.Close()
+	go relay.Serve(l, certificate)
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:     mustPickTestAddr(t),
+		HostPrivateKey: hostKey,
+		DisableDirect:  true,
+		PrivateRelay:   &PrivateRelay{Address: l.Addr().String(), Key: relayPublic},
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	token, err := DecodeToken(service.Token())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Relay != l.Addr().String() || token.RelayKey != relayPublic {
+		t.Fatalf("token does not point at the private relay: %+v", token)
+	}
+
+	go echoAcceptedConn(t, service.Listener())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, DestinationPrefix+service.Token())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+
+	payload := []byte("hello-private-relay")
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if string(buf) != string(payload) {
+		t.Fatalf("echo mismatch: got %q, want %q", buf, payload)
+	}
+
+	// A relay that cannot prove the pinned key is refused
+	otherPrivate, _, _ := DeriveRelayIdentity([]byte("someone else"))
+	impostor := NewDERPServer(otherPrivate, servicePublic)
+	defer impostor.Close()
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go impostor.Serve(l2, certificate)
+
+	nodes, _ := PrivateRelayMap(l2.Addr().String(), relayPublic)
+	if _, err := newDERPClient(ctx, nodes.Regions[PrivateRegionID].Nodes[0], otherPrivate); err == nil {
+		t.Fatalf("connected to a relay with the wrong key")
+	}
+}
+
+func TestDERPServerOnlyRelaysForServer(t *testing.T) {
+	relayPrivate, relayPublic, _ := DeriveRelayIdentity([]byte("relay"))
+	_, servicePublic, _ := DeriveDERPIdentity([]byte("service"))
+
+	certificate, err := SelfSignedCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := NewDERPServer(relayPrivate, servicePublic)
+	defer relay.Close()
+	go relay.Serve(l, certificate)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m, _ := PrivateRelayMap(l.Addr().String(), relayPublic)
+	node := m.Regions[PrivateRegionID].Nodes[0]
+
+	alicePrivate, alicePublic, _ := randomDERPIdentity()
+	bobPrivate, _, _ := randomDERPIdentity()
+
+	alice, err := newDERPClient(ctx, node, alicePrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bob, err := newDERPClient(ctx, node, bobPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// Wait for both to be registered, then try to use the relay between two strangers
+	time.Sleep(100 * time.Millisecond)
+	if err := bob.Send(alicePublic, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan struct{})
+	go func() {
+		if _, err := alice.Recv(); err == nil {
+			close(received)
+		}
+	}()
+
+	select {
+	case <-received:
+		t.Fatalf("relay forwarded a packet that did not involve the server")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestDERPFallsBackToWebSocket(t *testing.T) {
+	relayPrivate, relayPublic, _ := DeriveRelayIdentity([]byte("relay"))
+	servicePrivate, servicePublic, _ := DeriveDERPIdentity([]byte("service"))
+
+	relay := NewDERPServer(relayPrivate, servicePublic)
+	defer relay.Close()
+
+	// Like a proxy that only lets websockets through
+	upgrades := 0
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "DERP") {
+			upgrades++
+			http.Error(w, "blocked", http.StatusForbidden)
+			return
+		}
+		relay.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	m, _ := PrivateRelayMap(proxy.Listener.Addr().String(), relayPublic)
+	node := m.Regions[PrivateRegionID].Nodes[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := newDERPClient(ctx, node, servicePrivate)
+	if err != nil {
+		t.Fatalf("newDERPClient() error = %v", err)
+	}
+	defer client.Close()
+
+	if client.serverPublic != relayPublic {
+		t.Fatal("handshake over websocket did not get the relay's key")
+	}
+	if _, ok := derpWebSocketHosts.Load(node.HostName); !ok {
+		t.Fatal("host should be remembered as needing websockets")
+	}
+
+	// Now it is known, the upgrade is not tried again
+	again, err := newDERPClient(ctx, node, servicePrivate)
+	if err != nil {
+		t.Fatalf("newDERPClient() error = %v", err)
+	}
+	again.Close()
+	if upgrades != 1 {
+		t.Fatalf("DERP upgrade tried %d times, want once", upgrades)
+	}
+	derpWebSocketHosts.Delete(node.HostName)
+}
+
+func TestDERPDialsThroughDialer(t *testing.T) {
+	relayPrivate, relayPublic, _ := DeriveRelayIdentity([]byte("relay"))
+	servicePrivate, servicePublic, _ := DeriveDERPIdentity([]byte("service"))
+
+	relay := NewDERPServer(relayPrivate, servicePublic)
+	defer relay.Close()
+
+	server := httptest.NewTLSServer(relay)
+	defer server.Close()
+
+	m, _ := PrivateRelayMap(server.Listener.Addr().String(), relayPublic)
+	node := m.Regions[PrivateRegionID].Nodes[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var dialed []string
+	ctx = WithDialer(ctx, func(ctx context.Context, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", address)
+	})
+
+	client, err := newDERPClient(ctx, node, servicePrivate)
+	if err != nil {
+		t.Fatalf("newDERPClient() error = %v", err)
+	}
+	client.Close()
+
+	if len(dialed) != 1 || dialed[0] != server.Listener.Addr().String() {
+		t.Fatalf("dialer was used for %q, want the relay once", dialed)
+	}
+}
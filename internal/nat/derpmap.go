@@ -2,10 +2,18 @@ package nat
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,13 +24,113 @@ import (
 const (
 	DefaultDERPMapURL = "https://login.tailscale.com/derpmap/default"
 	DERPMapURLEnvVar  = "RSSH_DERP_MAP_URL"
+
+	// Region of the server's own relay, tailscale leaves 900-999 for custom regions
+	PrivateRegionID = 900
 )
 
+// DefaultDERPMapTTL is how long a fetched map is used before it is fetched again
+const DefaultDERPMapTTL = 24 * time.Hour
+
+type cachedDERPMap struct {
+	URL     string
+	Fetched time.Time
+	Map     json.RawMessage
+}
+
 var (
-	cachedDERPMaps   = make(map[string]*vderp.Map)
+	cachedDERPMaps   = make(map[string]cachedDERPMapEntry)
 	cachedDERPMapsMu sync.Mutex
+
+	// Held while a map is downloaded, so callers wait for one download rather than each making their own. A channel so waiting can be cancelled
+	derpMapFetch = make(chan struct{}, 1)
+
+	// Where fetched maps are kept across restarts, not kept when empty
+	derpMapCacheDir string
+	derpMapTTL      = DefaultDERPMapTTL
 )
 
+type cachedDERPMapEntry struct {
+	m       *vderp.Map
+	fetched time.Time
+}
+
+// SetDERPMapCache keeps fetched maps in dir, and fetches them again after ttl. A stale map is still used if fetching fails
+func SetDERPMapCache(dir string, ttl time.Duration) {
+	cachedDERPMapsMu.Lock()
+	defer cachedDERPMapsMu.Unlock()
+
+	derpMapCacheDir = dir
+	if ttl > 0 {
+		derpMapTTL = ttl
+	}
+}
+
+func derpMapCachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(derpMapCacheDir, "derpmap-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// cachedMap is the last map fetched from url, from memory or the cache directory. Callers hold cachedDERPMapsMu
+func cachedMap(url string) (cachedDERPMapEntry, bool) {
+	if entry, ok := cachedDERPMaps[url]; ok {
+		return entry, true
+	}
+
+	if derpMapCacheDir == "" {
+		return cachedDERPMapEntry{}, false
+	}
+
+	content, err := os.ReadFile(derpMapCachePath(url))
+	if err != nil {
+		return cachedDERPMapEntry{}, false
+	}
+
+	var cached cachedDERPMap
+	if err := json.Unmarshal(content, &cached); err != nil || cached.URL != url {
+		return cachedDERPMapEntry{}, false
+	}
+
+	m, err := vderp.ParseJSON(cached.Map)
+	if err != nil {
+		return cachedDERPMapEntry{}, false
+	}
+
+	entry := cachedDERPMapEntry{m: m, fetched: cached.Fetched}
+	cachedDERPMaps[url] = entry
+	return entry, true
+}
+
+// storeMap keeps a fetched map. Callers hold cachedDERPMapsMu
+func storeMap(url string, m *vderp.Map, raw []byte) {
+	entry := cachedDERPMapEntry{m: m, fetched: time.Now()}
+	cachedDERPMaps[url] = entry
+
+	if derpMapCacheDir == "" {
+		return
+	}
+
+	content, err := json.Marshal(cachedDERPMap{URL: url, Fetched: entry.fetched, Map: raw})
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(derpMapCacheDir, 0700); err != nil {
+		log.Printf("ts: unable to cache derp map: %v", err)
+		return
+	}
+
+	// Written whole then renamed, so a crash never leaves half a map
+	path := derpMapCachePath(url)
+	if err := os.WriteFile(path+".tmp", content, 0600); err != nil {
+		log.Printf("ts: unable to cache derp map: %v", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("ts: unable to cache derp map: %v", err)
+	}
+}
+
 func EffectiveDERPMapURL(explicitURL string) string {
 	if strings.TrimSpace(explicitURL) != "" {
 		return strings.TrimSpace(explicitURL)
@@ -33,45 +141,110 @@ func EffectiveDERPMapURL(explicitURL string) string {
 	return DefaultDERPMapURL
 }
 
+// FetchDERPMap gets the map from explicitURL, or if that isnt set the map pushed by the server or embedded in the client, falling back to the map URL from the environment or the default
 func FetchDERPMap(ctx context.Context, explicitURL string) (*vderp.Map, error) {
+	if strings.TrimSpace(explicitURL) == "" {
+		if m := pushedDERPMap(); m != nil {
+			return m, nil
+		}
+
+		if m := getEmbeddedDERPMap(); m != nil {
+			return m, nil
+		}
+	}
+
 	url := EffectiveDERPMapURL(explicitURL)
 
-	cachedDERPMapsMu.Lock()
-	if m, ok := cachedDERPMaps[url]; ok {
-		cachedDERPMapsMu.Unlock()
-		return m, nil
+	select {
+	case derpMapFetch <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+	defer func() { <-derpMapFetch }()
+
+	cachedDERPMapsMu.Lock()
+	cached, ok := cachedMap(url)
+	ttl := derpMapTTL
 	cachedDERPMapsMu.Unlock()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if ok && time.Since(cached.fetched) < ttl {
+		return cached.m, nil
+	}
+
+	m, raw, err := downloadDERPMap(ctx, url)
 	if err != nil {
+		// The caller gave up, rather than the map being unreachable
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, ctx.Err()
+		}
+
+		if ok {
+			log.Printf("ts: derp map fetch failed, using the copy from %s: %v", cached.fetched.Format(time.RFC3339), err)
+			return cached.m, nil
+		}
 		return nil, err
 	}
 
-	client := &http.Client{
-		Timeout: 8 * time.Second,
+	cachedDERPMapsMu.Lock()
+	storeMap(url, m, raw)
+	cachedDERPMapsMu.Unlock()
+
+	return m, nil
+}
+
+func downloadDERPMap(ctx context.Context, url string) (*vderp.Map, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
 	}
-	resp, err := client.Do(req)
+
+	resp, err := httpClient(ctx, 8*time.Second).Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
 	}
 
 	body, err := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, err := vderp.ParseJSON(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m, body, nil
+}
+
+// PrivateRelayMap is a map with only the server's own relay at address, which must prove it has key
+func PrivateRelayMap(address string, key [32]byte) (*vderp.Map, error) {
+	host, portRaw, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
 
-	parsedMap, err := vderp.ParseJSON(body)
-	if err == nil {
-		cachedDERPMapsMu.Lock()
-		cachedDERPMaps[url] = parsedMap
-		cachedDERPMapsMu.Unlock()
+	port, err := strconv.Atoi(portRaw)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid relay port %q", portRaw)
 	}
 
-	return parsedMap, err
+	return &vderp.Map{Regions: map[int]vderp.Region{
+		PrivateRegionID: {
+			RegionID:   PrivateRegionID,
+			RegionCode: "rssh",
+			RegionName: "rssh server relay",
+			Nodes: []vderp.Node{{
+				Name:      fmt.Sprintf("%da", PrivateRegionID),
+				RegionID:  PrivateRegionID,
+				HostName:  host,
+				DERPPort:  port,
+				PinnedKey: hex.EncodeToString(key[:]),
+			}},
+		},
+	}}, nil
 }
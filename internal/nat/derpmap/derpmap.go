@@ -28,6 +28,9 @@ type Node struct {
 	STUNPort         int
 	DERPPort         int
 	InsecureForTests bool
+
+	// Hex DERP key of a self hosted relay. When set the relay's TLS certificate is not checked, the relay has to prove it holds this key instead
+	PinnedKey string
 }
 
 type rawMap struct {
@@ -51,6 +54,7 @@ type rawNode struct {
 	STUNPort         int    `json:"STUNPort"`
 	DERPPort         int    `json:"DERPPort"`
 	InsecureForTests bool   `json:"InsecureForTests"`
+	PinnedKey        string `json:"PinnedKey,omitempty"`
 }
 
 func ParseJSON(data []byte) (*Map, error) {
@@ -90,6 +94,29 @@ func ParseJSON(data []byte) (*Map, error) {
 	return out, nil
 }
 
+// JSON encodes the map in the same format ParseJSON reads
+func (m *Map) JSON() ([]byte, error) {
+	raw := rawMap{
+		Regions: make(map[string]rawRegion, len(m.Regions)),
+	}
+
+	for id, region := range m.Regions {
+		nodes := make([]rawNode, 0, len(region.Nodes))
+		for _, node := range region.Nodes {
+			nodes = append(nodes, rawNode(node))
+		}
+
+		raw.Regions[strconv.Itoa(id)] = rawRegion{
+			RegionID:   id,
+			RegionCode: region.RegionCode,
+			RegionName: region.RegionName,
+			Nodes:      nodes,
+		}
+	}
+
+	return json.Marshal(raw)
+}
+
 func (m *Map) FirstRegionID() int {
 	if m == nil || len(m.Regions) == 0 {
 		return 0
@@ -0,0 +1,79 @@
+package nat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+)
+
+// A map can be baked into the client when it is built, so it never has to fetch one from tailscale.
+// It is used instead of the map URL, but a map pushed by the server still takes precedence
+
+// Largest map that can be embedded, it is passed to the linker on the command line
+const maxEmbeddedDERPMap = 16 << 10
+
+var (
+	embeddedDERPMapMu sync.Mutex
+	embeddedDERPMap   *vderp.Map
+)
+
+// EncodeEmbeddedDERPMap checks a DERP map in tailscale's json format can be used, and encodes it to be baked into a client
+func EncodeEmbeddedDERPMap(raw []byte) (string, error) {
+	if _, err := parseEmbeddableDERPMap(raw); err != nil {
+		return "", err
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return "", err
+	}
+
+	if compact.Len() > maxEmbeddedDERPMap {
+		return "", fmt.Errorf("derp map is %d bytes, at most %d can be embedded. Only include the regions the client needs", compact.Len(), maxEmbeddedDERPMap)
+	}
+
+	return base64.StdEncoding.EncodeToString(compact.Bytes()), nil
+}
+
+// SetEmbeddedDERPMap uses a map encoded by EncodeEmbeddedDERPMap instead of fetching one
+func SetEmbeddedDERPMap(encoded string) error {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid embedded derp map: %w", err)
+	}
+
+	m, err := parseEmbeddableDERPMap(raw)
+	if err != nil {
+		return err
+	}
+
+	embeddedDERPMapMu.Lock()
+	embeddedDERPMap = m
+	embeddedDERPMapMu.Unlock()
+
+	return nil
+}
+
+func parseEmbeddableDERPMap(raw []byte) (*vderp.Map, error) {
+	m, err := vderp.ParseJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid derp map: %w", err)
+	}
+
+	if _, err := orderedDERPRegionCandidatesStable(m); err != nil {
+		return nil, fmt.Errorf("invalid derp map: %w", err)
+	}
+
+	return m, nil
+}
+
+func getEmbeddedDERPMap() *vderp.Map {
+	embeddedDERPMapMu.Lock()
+	defer embeddedDERPMapMu.Unlock()
+
+	return embeddedDERPMap
+}
@@ -0,0 +1,126 @@
+package nat
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+	"golang.org/x/crypto/ssh"
+)
+
+// SignedDERPMap is pushed by the server to change the relays a client uses, without the client having to trust a map URL
+type SignedDERPMap struct {
+	// Unix nanoseconds, clients ignore anything older than the map they have
+	Issued uint64
+	// In the format of tailscale's derp map, empty to go back to the default map
+	Map string
+	// ssh.Signature over Issued and Map by the server host key
+	Signature []byte
+}
+
+var (
+	derpMapOverrideMu     sync.Mutex
+	derpMapOverride       *vderp.Map
+	derpMapOverrideIssued uint64
+)
+
+func signedDERPMapBytes(issued uint64, m string) []byte {
+	return ssh.Marshal(struct {
+		Purpose string
+		Issued  uint64
+		Map     string
+	}{"rssh-derp-map", issued, m})
+}
+
+// SignDERPMap signs m for distribution to clients, a nil map tells clients to go back to the default
+func SignDERPMap(signer ssh.Signer, m *vderp.Map) (SignedDERPMap, error) {
+	signed := SignedDERPMap{
+		Issued: uint64(time.Now().UnixNano()),
+	}
+
+	if m != nil {
+		if _, err := orderedDERPRegionCandidatesStable(m); err != nil {
+			return signed, err
+		}
+
+		encoded, err := m.JSON()
+		if err != nil {
+			return signed, err
+		}
+		signed.Map = string(encoded)
+	}
+
+	sig, err := signer.Sign(rand.Reader, signedDERPMapBytes(signed.Issued, signed.Map))
+	if err != nil {
+		return signed, err
+	}
+	signed.Signature = ssh.Marshal(sig)
+
+	return signed, nil
+}
+
+// ApplySignedDERPMap checks a pushed map was signed by hostKey, and if so uses it instead of the default map for every new relay connection
+func ApplySignedDERPMap(hostKey ssh.PublicKey, signed SignedDERPMap) error {
+	if hostKey == nil {
+		return errors.New("server host key is unknown")
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(signed.Signature, &sig); err != nil {
+		return fmt.Errorf("invalid derp map signature: %w", err)
+	}
+
+	if err := hostKey.Verify(signedDERPMapBytes(signed.Issued, signed.Map), &sig); err != nil {
+		return fmt.Errorf("derp map signature does not match the server key: %w", err)
+	}
+
+	var m *vderp.Map
+	if signed.Map != "" {
+		var err error
+		m, err = vderp.ParseJSON([]byte(signed.Map))
+		if err != nil {
+			return err
+		}
+
+		if _, err := orderedDERPRegionCandidatesStable(m); err != nil {
+			return err
+		}
+	}
+
+	derpMapOverrideMu.Lock()
+	defer derpMapOverrideMu.Unlock()
+
+	if signed.Issued <= derpMapOverrideIssued {
+		return errors.New("derp map is older than the one in use")
+	}
+
+	derpMapOverride = m
+	derpMapOverrideIssued = signed.Issued
+
+	return nil
+}
+
+func pushedDERPMap() *vderp.Map {
+	derpMapOverrideMu.Lock()
+	defer derpMapOverrideMu.Unlock()
+
+	return derpMapOverride
+}
+
+// DERPMapSource describes where relays are coming from, for the server to show
+func DERPMapSource() string {
+	derpMapOverrideMu.Lock()
+	defer derpMapOverrideMu.Unlock()
+
+	if derpMapOverride == nil {
+		if m := getEmbeddedDERPMap(); m != nil {
+			return fmt.Sprintf("embedded when built (%d regions)", len(m.Regions))
+		}
+		return EffectiveDERPMapURL("")
+	}
+
+	return fmt.Sprintf("pushed by server at %s (%d regions)", time.Unix(0, int64(derpMapOverrideIssued)).Format(time.RFC3339), len(derpMapOverride.Regions))
+}
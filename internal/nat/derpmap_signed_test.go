@@ -0,0 +1,80 @@
+package nat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestSignedDERPMap(t *testing.T) {
+	t.Cleanup(func() {
+		derpMapOverride, derpMapOverrideIssued = nil, 0
+	})
+
+	server, other := newTestSigner(t), newTestSigner(t)
+
+	m := &vderp.Map{Regions: map[int]vderp.Region{
+		900: {RegionID: 900, Nodes: []vderp.Node{{Name: "900a", RegionID: 900, HostName: "relay.example.com", DERPPort: 443}}},
+	}}
+
+	older, err := SignDERPMap(server, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := SignDERPMap(server, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplySignedDERPMap(other.PublicKey(), signed); err == nil {
+		t.Fatal("accepted a map signed by a different key")
+	}
+
+	tampered := signed
+	tampered.Map = `{"Regions":{"1":{"RegionID":1,"Nodes":[{"Name":"1a","RegionID":1,"HostName":"evil.example.com"}]}}}`
+	if err := ApplySignedDERPMap(server.PublicKey(), tampered); err == nil {
+		t.Fatal("accepted a modified map")
+	}
+
+	if err := ApplySignedDERPMap(server.PublicKey(), signed); err != nil {
+		t.Fatalf("rejected a valid map: %v", err)
+	}
+
+	if got := pushedDERPMap(); got == nil || got.Regions[900].Nodes[0].HostName != "relay.example.com" {
+		t.Fatalf("pushed map not in use: %+v", got)
+	}
+
+	if err := ApplySignedDERPMap(server.PublicKey(), older); err == nil {
+		t.Fatal("accepted an older map")
+	}
+
+	reset, err := SignDERPMap(server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplySignedDERPMap(server.PublicKey(), reset); err != nil {
+		t.Fatalf("rejected reset: %v", err)
+	}
+
+	if pushedDERPMap() != nil {
+		t.Fatal("reset did not go back to the default map")
+	}
+}
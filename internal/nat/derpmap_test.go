@@ -0,0 +1,78 @@
+package nat
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+)
+
+func TestDERPMapCacheFallback(t *testing.T) {
+	dir := t.TempDir()
+	SetDERPMapCache(dir, time.Hour)
+	defer SetDERPMapCache("", DefaultDERPMapTTL)
+
+	mapServer := newMapServerForNode(vderp.Node{Name: "1a", HostName: "127.0.0.1", DERPPort: 443})
+	url := mapServer.URL
+
+	if _, err := FetchDERPMap(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(derpMapCachePath(url)); err != nil {
+		t.Fatalf("map was not cached to disk: %v", err)
+	}
+
+	// A restart, with the map endpoint down and the cached copy out of date
+	mapServer.Close()
+	cachedDERPMapsMu.Lock()
+	delete(cachedDERPMaps, url)
+	cachedDERPMapsMu.Unlock()
+	SetDERPMapCache(dir, time.Nanosecond)
+
+	m, err := FetchDERPMap(context.Background(), url)
+	if err != nil {
+		t.Fatalf("stale cached map was not used: %v", err)
+	}
+	if len(m.Regions) != 1 || m.Regions[1].Nodes[0].HostName != "127.0.0.1" {
+		t.Fatalf("cached map = %+v", m)
+	}
+}
+
+func TestEmbeddedDERPMapUsedOffline(t *testing.T) {
+	// Nothing listens here, fetching would fail
+	t.Setenv(DERPMapURLEnvVar, "http://127.0.0.1:1/derpmap")
+
+	raw := []byte(`{
+		"Regions": {
+			"900": {"RegionID": 900, "RegionCode": "own", "Nodes": [{"Name": "900a", "RegionID": 900, "HostName": "derp.example.com", "DERPPort": 443}]}
+		}
+	}`)
+
+	encoded, err := EncodeEmbeddedDERPMap(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetEmbeddedDERPMap(encoded); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		embeddedDERPMapMu.Lock()
+		embeddedDERPMap = nil
+		embeddedDERPMapMu.Unlock()
+	}()
+
+	m, err := FetchDERPMap(context.Background(), "")
+	if err != nil {
+		t.Fatalf("embedded map was not used: %v", err)
+	}
+	if len(m.Regions) != 1 || m.Regions[900].Nodes[0].HostName != "derp.example.com" {
+		t.Fatalf("map = %+v", m)
+	}
+
+	if _, err := EncodeEmbeddedDERPMap([]byte(`{"Regions": {}}`)); err == nil {
+		t.Fatal("a map without regions was accepted")
+	}
+}
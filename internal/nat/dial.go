@@ -3,90 +3,202 @@ package nat
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/chaos"
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+	"github.com/NHAS/reverse_ssh/internal/secure"
 )
 
 var (
 	globalDERPPrivateKey [32]byte
+	globalDERPPublicKey  [32]byte
 	globalDERPKeyOnce    sync.Once
 )
 
 func getGlobalDERPIdentity() ([32]byte, error) {
 	var err error
 	globalDERPKeyOnce.Do(func() {
-		globalDERPPrivateKey, _, err = randomDERPIdentity()
+		globalDERPPrivateKey, globalDERPPublicKey, err = randomDERPIdentity()
 	})
 	return globalDERPPrivateKey, err
 }
 
-func Dial(destination string, timeout time.Duration) (net.Conn, error) {
+const (
+	defaultDialTimeout = 8 * time.Second
+	dialAckTimeout     = 5 * time.Second
+)
+
+// Dial opens a relayed connection to the server in a ts:// destination, giving up after 8 seconds
+func Dial(destination string) (net.Conn, error) {
+	return DialContext(context.Background(), destination)
+}
+
+// DialContext is Dial, cancelling ctx aborts fetching the DERP map, connecting to the relay and waiting for the server to answer.
+// ctx only bounds establishing the connection, without a deadline on ctx it is given up on after 8 seconds
+func DialContext(ctx context.Context, destination string) (net.Conn, error) {
+	ctx, span := tracer.Start(ctx, "nat.dial")
+	conn, err := dialContext(ctx, destination)
+	endSpan(span, err)
+
+	return conn, err
+}
+
+func dialContext(ctx context.Context, destination string) (net.Conn, error) {
 	token, err := ParseDestination(destination)
 	if err != nil {
 		return nil, err
 	}
 
-	if timeout <= 0 {
-		timeout = 8 * time.Second
+	if token.Expired() {
+		return nil, fmt.Errorf("%w: at %s", ErrTokenExpired, token.Expires.Format(time.RFC3339))
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDialTimeout)
+		defer cancel()
+	}
+
+	return dialTransports(ctx, token)
+}
+
+// dialRelay opens a session through the nearest DERP region the server is on, or resumes the last one
+func dialRelay(ctx context.Context, token *Token) (net.Conn, error) {
+	derpPrivate, err := getGlobalDERPIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("ts derp key generation failed: %w", err)
+	}
+
+	if route, ok := resumableRelay(token.ServerDERPPublicKey); ok {
+		resumeCtx, span := tracer.Start(ctx, "nat.resume", derpNodeAttributes(route.node))
+		conn, err := dialRegion(resumeCtx, token, &route, derpPrivate, true)
+		endSpan(span, err)
+		if err == nil {
+			go reportPublic(conn, route.stunServers)
+			go reportNAT(conn, route.stunServers)
+
+			return conn, nil
+		}
 
-	derpMap, err := FetchDERPMap(ctx, "")
+		log.Printf("ts: unable to resume through derp region %d, dialing again: %v", route.regionID, err)
+		forgetRelay(token.ServerDERPPublicKey)
+	}
+
+	var derpMap *vderp.Map
+	if token.Relay != "" {
+		// The server runs its own relay, tailscale's are not needed
+		derpMap, err = PrivateRelayMap(token.Relay, token.RelayKey)
+	} else {
+		mapCtx, span := tracer.Start(ctx, "nat.derp_map")
+		derpMap, err = FetchDERPMap(mapCtx, "")
+		endSpan(span, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("ts derp map fetch failed: %w", err)
 	}
 
-	_, derpNode, err := pickNearestDERPNode(derpMap)
+	// With a v4 token only the regions the server is on, otherwise its nearest region is hoped to be ours too
+	rankCtx, span := tracer.Start(ctx, "nat.rank_regions")
+	candidates, err := rankedDERPRegions(rankCtx, derpMap, token.Regions)
+	endSpan(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("ts derp node selection failed: %w", err)
 	}
 
-	derpPrivate, err := getGlobalDERPIdentity()
-	if err != nil {
-		return nil, fmt.Errorf("ts derp key generation failed: %w", err)
+	// A region that is down or not relaying is given up on for the next nearest
+	var errs []error
+	for _, candidate := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+
+		route := relayRoute{regionID: candidate.regionID, node: candidate.node}
+
+		regionCtx, span := tracer.Start(ctx, "nat.dial_region", derpNodeAttributes(candidate.node))
+		conn, err := dialRegion(regionCtx, token, &route, derpPrivate, false)
+		endSpan(span, err)
+		if err == nil {
+			route.stunServers = token.STUNServers
+			if len(route.stunServers) == 0 {
+				route.stunServers = stunServersFromMap(derpMap)
+			}
+			rememberRelay(token.ServerDERPPublicKey, route)
+
+			go reportPublic(conn, route.stunServers)
+			go reportNAT(conn, route.stunServers)
+
+			return conn, nil
+		}
+
+		log.Printf("ts: derp region %d: %v", candidate.regionID, err)
+		forgetDERPLatency(candidate.node)
+		errs = append(errs, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	return nil, errors.Join(errs...)
+}
+
+// dialRegion opens a relay session to the server through the route's DERP node, and records the window the server gives in route.
+// When resuming it returns without waiting for the server's ack
+func dialRegion(ctx context.Context, token *Token, route *relayRoute, derpPrivate [32]byte, resume bool) (*relayConn, error) {
 	signalCipher := newSignalCipher(derpPrivate, token.ServerDERPPublicKey)
 
-	derpClient, err := newDERPClient(ctx, derpNode, derpPrivate)
+	// The ack may never come, leave time to try another region
+	ctx, cancel := context.WithTimeout(ctx, dialAckTimeout)
+	defer cancel()
+
+	client, err := newDERPClient(ctx, route.node, derpPrivate)
 	if err != nil {
 		return nil, fmt.Errorf("ts derp connect failed: %w", err)
 	}
 
 	var sessionID [16]byte
 	if _, err := rand.Read(sessionID[:]); err != nil {
-		_ = derpClient.Close()
+		_ = client.Close()
 		return nil, err
 	}
 
+	link := newDERPLink(client, route.regionID, route.node)
+
 	var closeOnce sync.Once
 	closeDERP := func() {
-		closeOnce.Do(func() {
-			_ = derpClient.Close()
-		})
+		closeOnce.Do(link.close)
 	}
 
 	sendSignal := func(message signalMessage) error {
+		chaos.Delay(chaos.SignalDelay)
+
 		raw := signalCipher.encode(message)
-		return derpClient.Send(token.ServerDERPPublicKey, raw)
+		return link.send(token.ServerDERPPublicKey, raw)
 	}
 
-	relay := newRelayConn(sessionID, "relay", token.ServerDERPPublicKey, sendSignal, closeDERP)
-	ackCh := make(chan struct{}, 1)
+	relay := newRelayConn(sessionID, "relay", token.ServerDERPPublicKey, sendSignal, func() {
+		closeDERP()
+		touchRelay(token.ServerDERPPublicKey)
+	})
+	// Carries the window the server gave, 0 if it has no flow control
+	ackCh := make(chan int, 1)
 	recvErrCh := make(chan error, 1)
 
-	go func() {
-		defer close(recvErrCh)
+	// Reads one of the session's DERP connections, there are two for a while after it moves region
+	receive := func(client *derpClient) error {
 		for {
-			packet, err := derpClient.Recv()
+			packet, err := client.Recv()
 			if err != nil {
-				relay.markRemoteClosed()
-				recvErrCh <- err
-				return
+				// A connection the session has moved off closing is expected
+				if link.current() == client {
+					relay.relayClosed()
+				}
+				return err
 			}
 			if packet.Source != token.ServerDERPPublicKey {
 				continue
@@ -96,41 +208,121 @@ func Dial(destination string, timeout time.Duration) (net.Conn, error) {
 			if err != nil {
 				continue
 			}
-			if msg.SessionID != sessionID {
+			if !secure.Equal(msg.SessionID[:], sessionID[:]) {
 				continue
 			}
+			link.received()
 
 			switch msg.Type {
 			case signalDialAck:
+				// Servers without flow control send no window
+				window, ok := parseRelayWindow(msg.Payload)
+				if ok {
+					relay.enableFlowControl(window)
+				}
 				select {
-				case ackCh <- struct{}{}:
+				case ackCh <- window:
 				default:
 				}
 			case signalData:
 				relay.pushIncoming(msg.Payload)
+			case signalDataCompressed:
+				payload, err := decompressRelay(msg.Payload)
+				if err != nil {
+					log.Printf("ts: %v", err)
+					relay.relayClosed()
+					continue
+				}
+				relay.pushIncoming(payload)
+			case signalCompression:
+				// The server picked from our offer
+				if len(msg.Payload) == 1 && relayCodec(msg.Payload[0]).supported() {
+					relay.setSendCodec(relayCodec(msg.Payload[0]))
+				}
+			case signalWindow:
+				relay.grantCredit(msg.Payload)
 			case signalClose:
-				relay.markRemoteClosed()
+				relay.relayClosed()
+			case signalCandidates:
+				go upgradeToDirect(relay, withTokenCandidates(parseCandidates(msg.Payload), token), globalDERPPublicKey, signalCipher)
+			case signalPathSwitch:
+				if err := relay.peerSwitch(); err != nil {
+					log.Printf("ts: %v", err)
+				}
 			}
 		}
+	}
+
+	go func() {
+		defer close(recvErrCh)
+		recvErrCh <- receive(client)
 	}()
 
 	if err := sendSignal(signalMessage{
 		Type:      signalDialInit,
 		SessionID: sessionID,
+		Payload:   encodeRelayWindow(relayWindow),
 	}); err != nil {
 		closeDERP()
 		return nil, err
 	}
 
+	// Servers without compression ignore this
+	if err := sendSignal(signalMessage{
+		Type:      signalCompression,
+		SessionID: sessionID,
+		Payload:   relayCodecOffer,
+	}); err != nil {
+		closeDERP()
+		return nil, err
+	}
+
+	if resume {
+		// Anything sent now follows the dial init on the same DERP connection, so the server has the session by the time it arrives
+		if route.window > 0 {
+			relay.enableFlowControl(route.window)
+		}
+
+		go awaitResumeAck(token.ServerDERPPublicKey, *route, relay, ackCh, recvErrCh)
+		go rehomeLoop(token, relay, link, derpPrivate, receive)
+
+		log.Printf("ts: resuming relay session through derp region %d", route.regionID)
+		return relay, nil
+	}
+
 	select {
-	case <-ackCh:
+	case route.window = <-ackCh:
 		log.Println("ts: relay session established")
+		go rehomeLoop(token, relay, link, derpPrivate, receive)
 		return relay, nil
 	case err := <-recvErrCh:
 		closeDERP()
 		return nil, fmt.Errorf("ts derp session failed before ack: %w", err)
-	case <-time.After(5 * time.Second):
+	case <-ctx.Done():
 		closeDERP()
-		return nil, fmt.Errorf("ts derp session acknowledgement timeout")
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("ts derp session acknowledgement timeout: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("ts derp session failed before ack: %w", ctx.Err())
 	}
 }
+
+// awaitResumeAck closes a resumed session the server never acknowledges, and forgets its route so the next dial starts over
+func awaitResumeAck(server [32]byte, route relayRoute, relay *relayConn, ackCh <-chan int, recvErrCh <-chan error) {
+	timer := time.NewTimer(dialAckTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ackCh:
+		touchRelay(server)
+		return
+	case err = <-recvErrCh:
+	case <-timer.C:
+		err = errors.New("no acknowledgement")
+	}
+
+	log.Printf("ts: resumed session=%x through derp region %d failed: %v", relay.sessionID[:4], route.regionID, err)
+	forgetRelay(server)
+	_ = relay.Close()
+}
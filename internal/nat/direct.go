@@ -0,0 +1,511 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/secure"
+)
+
+// Sessions start on the relay, then move to a direct tcp connection if the client can reach the server.
+//
+// The server sends its candidate addresses over the relay once a session is accepted. The client dials them, and proves it owns the
+// session with a hello sealed with the same keys as the relay signals. After the server answers, the client sends signalPathSwitch
+// over the relay and writes everything after it on the direct connection. The server starts reading the direct connection when that
+// switch arrives, so nothing sent on the relay is overtaken, then does the same in the other direction.
+//
+// The server listens and finds its public addresses on both ipv4 and ipv6. Candidates are ranked public before private, with the families
+// interleaved ipv6 first so a network where one family is broken only costs one attempt, and all of them are dialed at once. The first
+// to answer is only taken straight away if nothing ranked above it is still trying, otherwise those get a little longer to answer.
+
+const (
+	directHandshakeTimeout = 5 * time.Second
+	directDialTimeout      = 3 * time.Second
+
+	// How long a session shows as upgrading on the server if the client never finishes
+	directUpgradeTimeout = 15 * time.Second
+
+	maxDirectCandidates = 16
+
+	// How long a direct path that answered waits for better ranked candidates still being dialed
+	directPreferenceWait = 200 * time.Millisecond
+)
+
+type directListener struct {
+	listener net.Listener
+
+	// Grows once the public address is found, see addPublicCandidates
+	mu         sync.Mutex
+	candidates []string
+	public     []string
+}
+
+// tokenCandidates are the candidates worth putting in a token, public ones first. Loopback addresses are left out, as no client would reach them
+func (d *directListener) tokenCandidates() []TokenCandidate {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var stun, lan []TokenCandidate
+	for _, candidate := range rankCandidates(d.candidates) {
+		addr, err := netip.ParseAddrPort(candidate)
+		if err != nil || addr.Addr().IsLoopback() {
+			continue
+		}
+
+		if slices.Contains(d.public, candidate) {
+			stun = append(stun, TokenCandidate{Kind: CandidateSTUN, Addr: addr})
+		} else {
+			lan = append(lan, TokenCandidate{Kind: CandidateLAN, Addr: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())})
+		}
+	}
+
+	candidates := append(stun, lan...)
+	return candidates[:min(len(candidates), maxTokenCandidates)]
+}
+
+// candidateClass is how likely a candidate is to be reachable from wherever the client is, lower first
+func candidateClass(addr netip.Addr) int {
+	switch {
+	case addr.IsLoopback():
+		return 3
+	case addr.IsPrivate() || addr.IsLinkLocalUnicast():
+		return 2
+	case addr.IsGlobalUnicast():
+		return 1
+	}
+	return 4
+}
+
+// rankCandidates orders candidates public first, then private, then loopback. Within each the families alternate starting with ipv6,
+// otherwise keeping the order they were in. Ones that are not addresses go last
+func rankCandidates(candidates []string) []string {
+	type family struct{ v6, v4 []string }
+	classes := map[int]*family{}
+
+	for _, candidate := range candidates {
+		class, v6 := 5, false
+		if addr, err := netip.ParseAddrPort(candidate); err == nil {
+			class, v6 = candidateClass(addr.Addr().Unmap()), addr.Addr().Unmap().Is6()
+		}
+
+		if classes[class] == nil {
+			classes[class] = &family{}
+		}
+		if v6 {
+			classes[class].v6 = append(classes[class].v6, candidate)
+		} else {
+			classes[class].v4 = append(classes[class].v4, candidate)
+		}
+	}
+
+	ranked := make([]string, 0, len(candidates))
+	for class := 1; class <= 5; class++ {
+		f := classes[class]
+		if f == nil {
+			continue
+		}
+
+		for i := 0; i < max(len(f.v6), len(f.v4)); i++ {
+			if i < len(f.v6) {
+				ranked = append(ranked, f.v6[i])
+			}
+			if i < len(f.v4) {
+				ranked = append(ranked, f.v4[i])
+			}
+		}
+	}
+	return ranked
+}
+
+func (d *directListener) getCandidates() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.candidates...)
+}
+
+// listenDirect listens for direct upgrades on an ephemeral port of the relay listen host, and works out which addresses to advertise for it.
+// When the host is unspecified it listens on both ipv4 and ipv6, whichever family it was written in
+func listenDirect(host string) (*directListener, error) {
+	listenHost := host
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		listenHost = ""
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(listenHost, "0"))
+	if err != nil {
+		return nil, err
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ips = append(ips, ip)
+	} else {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() && !ipNet.IP.IsMulticast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+
+	d := &directListener{listener: l}
+	for _, ip := range ips {
+		if len(d.candidates) == maxDirectCandidates {
+			break
+		}
+		d.candidates = append(d.candidates, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+
+	return d, nil
+}
+
+// addPublicCandidates advertises the public address the STUN servers see, so clients outside the server's network can reach it when its port is forwarded
+func (s *Service) addPublicCandidates(stunServers []string) {
+	if len(stunServers) == 0 {
+		return
+	}
+
+	public := discoverPublicAddrs(s.ctx, stunServers)
+	if len(public) == 0 {
+		log.Printf("ts: no public address found with %d stun servers", len(stunServers))
+		return
+	}
+
+	port := s.direct.listener.Addr().(*net.TCPAddr).Port
+
+	s.direct.mu.Lock()
+	defer s.direct.mu.Unlock()
+	for _, addr := range public {
+		candidate := netip.AddrPortFrom(addr, uint16(port)).String()
+		if len(s.direct.candidates) == maxDirectCandidates || slices.Contains(s.direct.candidates, candidate) {
+			continue
+		}
+
+		// Tried first, it is the one that works from outside
+		s.direct.candidates = append([]string{candidate}, s.direct.candidates...)
+		s.direct.public = append(s.direct.public, candidate)
+		log.Printf("ts: public address %s found with stun", addr)
+	}
+}
+
+// reportPublic tells the server the client's public addresses
+func reportPublic(relay *relayConn, stunServers []string) {
+	public := discoverPublicAddrs(context.Background(), stunServers)
+	if len(public) == 0 {
+		return
+	}
+
+	var addrs []string
+	for _, addr := range public {
+		addrs = append(addrs, addr.String())
+	}
+
+	if err := relay.sendSignal(signalMessage{
+		Type:      signalCandidates,
+		SessionID: relay.sessionID,
+		Payload:   []byte(strings.Join(addrs, "\n")),
+	}); err != nil {
+		log.Printf("ts: unable to report public address for session=%x: %v", relay.sessionID[:4], err)
+	}
+}
+
+func parseCandidates(payload []byte) []string {
+	var candidates []string
+	for _, candidate := range strings.Split(string(payload), "\n") {
+		if _, _, err := net.SplitHostPort(candidate); err != nil {
+			continue
+		}
+
+		candidates = append(candidates, candidate)
+		if len(candidates) == maxDirectCandidates {
+			break
+		}
+	}
+	return candidates
+}
+
+// withTokenCandidates adds the candidates baked into the token after the ones the server offered, which are more up to date
+func withTokenCandidates(offered []string, token *Token) []string {
+	candidates := offered
+	for _, candidate := range token.Candidates {
+		if len(candidates) == maxDirectCandidates {
+			break
+		}
+
+		if addr := candidate.Addr.String(); !slices.Contains(candidates, addr) {
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
+
+func writeDirectFrame(w io.Writer, raw []byte) error {
+	frame := make([]byte, 2, 2+len(raw))
+	binary.BigEndian.PutUint16(frame, uint16(len(raw)))
+	_, err := w.Write(append(frame, raw...))
+	return err
+}
+
+func readDirectFrame(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// offerDirect tells the client where it can reach the server directly
+func (s *Service) offerDirect(source [32]byte, conn *relayConn) {
+	if s.direct == nil {
+		return
+	}
+
+	candidates := s.direct.getCandidates()
+	if len(candidates) == 0 {
+		return
+	}
+
+	conn.setUpgrading(true)
+	time.AfterFunc(directUpgradeTimeout, func() {
+		conn.setUpgrading(false)
+	})
+
+	if err := s.sendDERPSignal(source, signalMessage{
+		Type:      signalCandidates,
+		SessionID: conn.sessionID,
+		Payload:   []byte(strings.Join(candidates, "\n")),
+	}); err != nil {
+		log.Printf("ts: unable to offer direct path for session=%x: %v", conn.sessionID[:4], err)
+	}
+}
+
+func (s *Service) acceptDirectLoop() {
+	for {
+		c, err := s.direct.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			if err := s.handleDirect(c); err != nil {
+				log.Printf("ts: direct path from %s refused: %v", c.RemoteAddr(), err)
+				c.Close()
+			}
+		}()
+	}
+}
+
+func (s *Service) handleDirect(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(directHandshakeTimeout))
+
+	var peer [32]byte
+	if _, err := io.ReadFull(c, peer[:]); err != nil {
+		return err
+	}
+
+	raw, err := readDirectFrame(c)
+	if err != nil {
+		return err
+	}
+
+	cipher := s.signalCipherForPeer(peer)
+	hello, err := cipher.decode(raw)
+	if err != nil {
+		return err
+	}
+	if hello.Type == signalDirectDial {
+		return s.acceptLANSession(peer, hello, c, cipher)
+	}
+	if hello.Type != signalDirectHello {
+		return errors.New("not a direct path hello")
+	}
+
+	s.sessionMu.Lock()
+	session := s.sessions[relaySessionKey{Peer: peer, SessionID: hello.SessionID}]
+	s.sessionMu.Unlock()
+	if session == nil || !session.accepted {
+		return fmt.Errorf("no session=%x to upgrade", hello.SessionID[:4])
+	}
+
+	if !session.conn.attachDirect(c) {
+		return fmt.Errorf("session=%x already has a direct path", hello.SessionID[:4])
+	}
+
+	if err := writeDirectFrame(c, cipher.encode(signalMessage{Type: signalDirectHello, SessionID: hello.SessionID})); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+
+	log.Printf("ts: session=%x direct path from %s, waiting for the client to switch", hello.SessionID[:4], c.RemoteAddr())
+
+	return nil
+}
+
+// upgradeToDirect tries the server's candidates at once and moves the session to the best ranked one that answers
+func upgradeToDirect(relay *relayConn, candidates []string, public [32]byte, cipher *signalCipher) {
+	if len(candidates) == 0 {
+		return
+	}
+
+	relay.setUpgrading(true)
+	defer relay.setUpgrading(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), directHandshakeTimeout)
+	defer cancel()
+
+	chosen := dialRanked(ctx, rankCandidates(candidates), func(ctx context.Context, candidate string) (net.Conn, error) {
+		return dialDirect(ctx, candidate, signalDirectHello, relay.sessionID, public, cipher)
+	})
+
+	if chosen == nil {
+		log.Printf("ts: no direct path for session=%x, staying on the relay", relay.sessionID[:4])
+		return
+	}
+
+	if !relay.attachDirect(chosen) {
+		chosen.Close()
+		return
+	}
+
+	if err := relay.switchWrites(); err != nil {
+		log.Printf("ts: unable to switch session=%x to the direct path: %v", relay.sessionID[:4], err)
+		return
+	}
+
+	log.Printf("ts: session=%x moving to direct path %s", relay.sessionID[:4], chosen.RemoteAddr())
+}
+
+// dialRanked dials every candidate at once and returns the best ranked connection, the first in candidates. Once one has answered
+// those ranked above it still dialing get directPreferenceWait longer, the rest are closed
+func dialRanked(ctx context.Context, candidates []string, dial func(context.Context, string) (net.Conn, error)) net.Conn {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		rank int
+		conn net.Conn
+	}
+
+	results := make(chan result, len(candidates))
+	for rank, candidate := range candidates {
+		go func() {
+			c, err := dial(ctx, candidate)
+			if err != nil {
+				c = nil
+			}
+			results <- result{rank, c}
+		}()
+	}
+
+	var (
+		chosen  net.Conn
+		best    = len(candidates)
+		pending = len(candidates)
+		dialing = make([]bool, len(candidates))
+		wait    <-chan time.Time
+	)
+	for i := range dialing {
+		dialing[i] = true
+	}
+
+	for pending > 0 && (chosen == nil || slices.Contains(dialing[:best], true)) {
+		select {
+		case r := <-results:
+			pending--
+			dialing[r.rank] = false
+			if r.conn == nil {
+				continue
+			}
+
+			if r.rank > best {
+				r.conn.Close()
+				continue
+			}
+			if chosen != nil {
+				chosen.Close()
+			}
+			chosen, best = r.conn, r.rank
+
+			if wait == nil {
+				wait = time.After(directPreferenceWait)
+			}
+		case <-wait:
+			dialing = make([]bool, len(candidates))
+		}
+	}
+
+	// Dials still going are cancelled, anything they connected is closed
+	cancel()
+	go func() {
+		for range pending {
+			if r := <-results; r.conn != nil {
+				r.conn.Close()
+			}
+		}
+	}()
+
+	return chosen
+}
+
+// dialDirect connects to a candidate and sends a hello of helloType, signalDirectHello to upgrade a relay session or signalDirectDial to start one
+func dialDirect(ctx context.Context, candidate string, helloType byte, sessionID [16]byte, public [32]byte, cipher *signalCipher) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, directDialTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	c, err := d.DialContext(dialCtx, "tcp", candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+
+	hello := cipher.encode(signalMessage{Type: helloType, SessionID: sessionID})
+	if _, err := c.Write(public[:]); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := writeDirectFrame(c, hello); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	raw, err := readDirectFrame(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	reply, err := cipher.decode(raw)
+	if err != nil || reply.Type != helloType || !secure.Equal(reply.SessionID[:], sessionID[:]) {
+		c.Close()
+		return nil, errors.New("bad direct path reply")
+	}
+
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
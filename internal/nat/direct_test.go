@@ -0,0 +1,66 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRankCandidates(t *testing.T) {
+	got := rankCandidates([]string{
+		"127.0.0.1:1",
+		"192.168.1.2:1",
+		"10.0.0.2:1",
+		"[fd00::2]:1",
+		"203.0.113.7:1",
+		"[2001:db8::7]:1",
+		"[2001:db8::8]:1",
+		"bad",
+	})
+
+	want := []string{
+		"[2001:db8::7]:1", "203.0.113.7:1", "[2001:db8::8]:1",
+		"[fd00::2]:1", "192.168.1.2:1", "10.0.0.2:1",
+		"127.0.0.1:1",
+		"bad",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("rankCandidates() = %v, want %v", got, want)
+	}
+}
+
+func TestDialRankedPrefersBetterCandidate(t *testing.T) {
+	// The best candidate answers after a worse one, but within the wait. The one after never answers
+	delays := map[string]time.Duration{"best": 50 * time.Millisecond, "worse": 0, "never": time.Hour}
+
+	chosen := dialRanked(context.Background(), []string{"best", "worse", "never"}, func(ctx context.Context, candidate string) (net.Conn, error) {
+		select {
+		case <-time.After(delays[candidate]):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		near, far := net.Pipe()
+		far.Close()
+		return &namedConn{Conn: near, name: candidate}, nil
+	})
+
+	if chosen == nil || chosen.(*namedConn).name != "best" {
+		t.Fatalf("dialRanked() = %v, want best", chosen)
+	}
+
+	// Nothing answering gives nothing
+	if c := dialRanked(context.Background(), []string{"a", "b"}, func(context.Context, string) (net.Conn, error) {
+		return nil, errors.New("refused")
+	}); c != nil {
+		t.Fatalf("dialRanked() = %v, want nil", c)
+	}
+}
+
+type namedConn struct {
+	net.Conn
+	name string
+}
@@ -205,8 +205,21 @@ func (c *fakeDERPClient) writeFrame(typ derpFrameType, payload []byte) error {
 }
 
 func newMapServerForNode(node vderp.Node) *httptest.Server {
+	return newMapServerForNodes(node)
+}
+
+// newMapServerForNodes serves a map with each node in the region its RegionID says, region 1 if it has none
+func newMapServerForNodes(nodes ...vderp.Node) *httptest.Server {
+	var regions []string
+	for _, node := range nodes {
+		if node.RegionID == 0 {
+			node.RegionID = 1
+		}
+		regions = append(regions, fmt.Sprintf(`"%d":{"RegionID":%d,"RegionCode":"test","RegionName":"test","Nodes":[{"Name":%q,"RegionID":%d,"HostName":%q,"DERPPort":%d,"InsecureForTests":true}]}`,
+			node.RegionID, node.RegionID, node.Name, node.RegionID, node.HostName, node.DERPPort))
+	}
+
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		_, _ = io.WriteString(w, fmt.Sprintf(`{"Regions":{"1":{"RegionID":1,"RegionCode":"test","RegionName":"test","Nodes":[{"Name":%q,"RegionID":1,"HostName":%q,"DERPPort":%d,"InsecureForTests":true}]}}}`,
-			node.Name, node.HostName, node.DERPPort))
+		_, _ = io.WriteString(w, `{"Regions":{`+strings.Join(regions, ",")+`}}`)
 	}))
 }
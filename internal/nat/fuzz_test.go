@@ -0,0 +1,217 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func FuzzDecodeToken(f *testing.F) {
+	valid := Token{Version: TokenVersionV1}
+	for i := range valid.ServerDERPPublicKey {
+		valid.ServerDERPPublicKey[i] = byte(i + 1)
+	}
+	encoded, err := valid.Encode()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(encoded)
+
+	valid.Version = TokenVersionV3
+	valid.STUNServers = []string{"stun.example.com:3478"}
+	withSTUN, err := valid.Encode()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(withSTUN)
+
+	valid.Version = TokenVersionV5
+	valid.Candidates = []TokenCandidate{{Kind: CandidateSTUN, Addr: netip.MustParseAddrPort("198.51.100.2:40000")}}
+	valid.Expires = time.Unix(1900000000, 0)
+	withCandidates, err := valid.Encode()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(withCandidates)
+
+	f.Add(" " + encoded + "\n")
+	f.Add("")
+	f.Add("AA")
+
+	f.Fuzz(func(t *testing.T, encoded string) {
+		token, err := DecodeToken(encoded)
+		if err != nil {
+			return
+		}
+
+		again, err := token.Encode()
+		if err != nil {
+			t.Fatalf("decoded token does not encode: %v", err)
+		}
+
+		roundTrip, err := DecodeToken(again)
+		if err != nil || !reflect.DeepEqual(roundTrip, token) {
+			t.Fatalf("token changed after encoding: %+v -> %+v (%v)", token, roundTrip, err)
+		}
+	})
+}
+
+func FuzzParseDestination(f *testing.F) {
+	f.Add(DestinationPrefix + "AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAh")
+	f.Add(DestinationPrefix)
+	f.Add(DestinationPrefix + "a/b")
+	f.Add("tcp://host:22")
+
+	f.Fuzz(func(t *testing.T, destination string) {
+		ParseDestination(destination)
+	})
+}
+
+func FuzzDecodeSignalMessage(f *testing.F) {
+	clientPrivate, clientPublic, err := DeriveDERPIdentity([]byte("fuzz client"))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	serverPrivate, serverPublic, err := DeriveDERPIdentity([]byte("fuzz server"))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	// One receiver for every input, as the server keeps one per peer, so each message can only be decoded once
+	sender := newSignalCipher(clientPrivate, serverPublic)
+	receiver := newSignalCipher(serverPrivate, clientPublic)
+
+	f.Add(sender.encode(signalMessage{Type: signalDialInit}))
+	f.Add(sender.encode(signalMessage{Type: signalData, Payload: []byte("hello")}))
+	f.Add(make([]byte, 51))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		message, err := receiver.decode(raw)
+		if err != nil {
+			return
+		}
+
+		if _, err := receiver.decode(raw); !errors.Is(err, errSignalReplay) {
+			t.Fatalf("signal message was accepted twice (%v)", err)
+		}
+
+		again, err := receiver.decode(sender.encode(message))
+		if err != nil || again.Type != message.Type || again.SessionID != message.SessionID || !bytes.Equal(again.Payload, message.Payload) {
+			t.Fatalf("signal message changed after encoding: %+v -> %+v (%v)", message, again, err)
+		}
+	})
+}
+
+// The ciphertext is authenticated, so most inputs above never get as far as the inner message
+func FuzzParseSignalInner(f *testing.F) {
+	f.Add([]byte{17, 0, signalDialInit, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	f.Add([]byte{0xff, 0xff, signalData})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, inner []byte) {
+		message, err := parseSignalInner(inner)
+		if err != nil {
+			return
+		}
+
+		if 2+17+len(message.Payload) > len(inner) {
+			t.Fatalf("payload of %d bytes is larger than the %d byte message", len(message.Payload), len(inner))
+		}
+	})
+}
+
+func FuzzDERPFrames(f *testing.F) {
+	frame := func(typ derpFrameType, payload []byte) []byte {
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		writeDERPFrame(w, typ, payload)
+		return b.Bytes()
+	}
+
+	serverKey := frame(derpFrameServerKey, append([]byte(derpMagic), make([]byte, 32)...))
+
+	f.Add(serverKey)
+	f.Add(append(append([]byte{}, serverKey...), frame(derpFrameRecvPacket, make([]byte, 40))...))
+	f.Add(append(append([]byte{}, serverKey...), frame(derpFramePing, make([]byte, 8))...))
+	f.Add(append(append([]byte{}, serverKey...), byte(derpFrameRecvPacket), 0xff, 0xff, 0xff, 0xff))
+	f.Add([]byte{byte(derpFrameServerKey), 0, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		c := &derpClient{
+			br: bufio.NewReader(bytes.NewReader(stream)),
+			bw: bufio.NewWriter(io.Discard),
+		}
+
+		if err := c.handshake(); err != nil {
+			return
+		}
+
+		for {
+			packet, err := c.Recv()
+			if err != nil {
+				return
+			}
+
+			if len(packet.Payload) > derpMaxFrameSize {
+				t.Fatalf("packet of %d bytes is larger than a frame", len(packet.Payload))
+			}
+		}
+	})
+}
+
+// stunResponse is a binding response carrying attrs, each a type followed by its value
+func stunResponse(transactionID []byte, attrs ...[]byte) []byte {
+	response := make([]byte, 20)
+	binary.BigEndian.PutUint16(response[0:2], stunBindingResponse)
+	binary.BigEndian.PutUint32(response[4:8], stunMagicCookie)
+	copy(response[8:20], transactionID)
+
+	for _, attr := range attrs {
+		response = append(response, attr[:2]...)
+		response = binary.BigEndian.AppendUint16(response, uint16(len(attr)-2))
+		response = append(response, attr[2:]...)
+		for len(response)%4 != 0 {
+			response = append(response, 0)
+		}
+	}
+
+	binary.BigEndian.PutUint16(response[2:4], uint16(len(response)-20))
+	return response
+}
+
+func FuzzParseSTUNResponse(f *testing.F) {
+	transactionID := []byte("0123456789ab")
+
+	f.Add(stunResponse(transactionID, []byte{0x00, 0x20, 0, 0x01, 0x11, 0x2b, 0xe1, 0xba, 0xa5, 0x1f}))
+	f.Add(stunResponse(transactionID, []byte{0x00, 0x01, 0, 0x02, 0x10, 0x00, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}))
+	f.Add(stunResponse(transactionID, []byte{0x00, 0x20, 0, 0x01}, []byte{0x00, 0x01, 0, 0x01, 0, 80, 192, 0, 2, 1}))
+	f.Add(append(stunResponse(transactionID), 0xff, 0xff, 0, 4))
+	f.Add([]byte{0x01, 0x01, 0xff, 0xff})
+	f.Add(stunResponse(transactionID, []byte{0x00, 0x20, 0, 0x01, 0x11, 0x2b, 0xe1, 0xba, 0xa5, 0x1f}, []byte{0x80, 0x2c, 0, 0x01, 0x0d, 0x96, 198, 51, 100, 7}))
+	f.Add(stunResponse(transactionID, []byte{0x00, 0x05, 0, 0x02, 0x0d, 0x96}))
+
+	f.Fuzz(func(t *testing.T, response []byte) {
+		// Read from every response, not only those parseSTUNResponse accepts
+		parseSTUNOtherAddress(response)
+
+		// Use the response's own transaction id, so fuzzing gets past the header
+		id := transactionID
+		if len(response) >= 20 {
+			id = response[8:20]
+		}
+
+		mapped, err := parseSTUNResponse(response, id)
+		if err == nil && !mapped.IsValid() {
+			t.Fatal("accepted a response without a valid mapped address")
+		}
+	})
+}
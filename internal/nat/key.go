@@ -10,14 +10,26 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
-const derpKeyDerivationContext = "reverse_ssh/nat/v1/derp_identity"
+const (
+	derpKeyDerivationContext  = "reverse_ssh/nat/v1/derp_identity"
+	relayKeyDerivationContext = "reverse_ssh/nat/v1/derp_relay_identity"
+)
 
 func DeriveDERPIdentity(hostPrivateKey []byte) (private [32]byte, public [32]byte, err error) {
+	return deriveIdentity(hostPrivateKey, derpKeyDerivationContext)
+}
+
+// DeriveRelayIdentity gives the key of the server's own DERP relay, it stays the same across restarts so baked in tokens keep working
+func DeriveRelayIdentity(hostPrivateKey []byte) (private [32]byte, public [32]byte, err error) {
+	return deriveIdentity(hostPrivateKey, relayKeyDerivationContext)
+}
+
+func deriveIdentity(hostPrivateKey []byte, context string) (private [32]byte, public [32]byte, err error) {
 	if len(hostPrivateKey) == 0 {
 		return private, public, fmt.Errorf("host private key bytes cannot be empty")
 	}
 
-	reader := hkdf.New(sha256.New, hostPrivateKey, nil, []byte(derpKeyDerivationContext))
+	reader := hkdf.New(sha256.New, hostPrivateKey, nil, []byte(context))
 	if _, err := io.ReadFull(reader, private[:]); err != nil {
 		return private, public, fmt.Errorf("failed to derive derp key seed: %w", err)
 	}
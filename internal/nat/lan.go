@@ -0,0 +1,251 @@
+package nat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// When the client shares a network with the server there is no need to go through a DERP relay at all.
+//
+// Before dialing the relay the client broadcasts a probe, sealed with the same keys as the relay signals, to the discovery port of every
+// network it is on. Only the server with the token's key can open it, and it answers with the port of its direct listener. The client
+// then opens a session straight over tcp to whichever address answered, with a signalDirectDial instead of a relay session's hello.
+// Nothing is ever sent on the relay for these sessions, so if the probe goes unanswered the client carries on to the relay as before.
+
+const (
+	// How long a dial waits for the server to answer on the local network before using the relay
+	lanProbeTimeout = 250 * time.Millisecond
+
+	maxLANProbeTargets = 16
+)
+
+// UDP port the server answers discovery probes on
+var lanDiscoveryPort = 41643
+
+// lanProbeTargets are where the probe is sent, the broadcast address of every network the client is on and the LAN candidates in the token
+var lanProbeTargets = func(token *Token) []netip.AddrPort {
+	port := uint16(lanDiscoveryPort)
+	targets := []netip.AddrPort{netip.AddrPortFrom(netip.AddrFrom4([4]byte{255, 255, 255, 255}), port)}
+
+	add := func(addr netip.Addr) {
+		target := netip.AddrPortFrom(addr, port)
+		for _, existing := range targets {
+			if existing == target {
+				return
+			}
+		}
+		if len(targets) < maxLANProbeTargets {
+			targets = append(targets, target)
+		}
+	}
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil || len(ipNet.Mask) != net.IPv4len {
+				continue
+			}
+
+			var broadcast [4]byte
+			for i, b := range ipNet.IP.To4() {
+				broadcast[i] = b | ^ipNet.Mask[i]
+			}
+			add(netip.AddrFrom4(broadcast))
+		}
+	}
+
+	for _, candidate := range token.Candidates {
+		if candidate.Kind == CandidateLAN {
+			add(candidate.Addr.Addr())
+		}
+	}
+
+	return targets
+}
+
+// listenLAN answers discovery probes from clients with this server's key, so they can skip the relay
+func (s *Service) listenLAN() {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: lanDiscoveryPort})
+	if err != nil {
+		log.Printf("ts: local network discovery disabled, unable to listen: %v", err)
+		return
+	}
+
+	context.AfterFunc(s.ctx, func() {
+		conn.Close()
+	})
+
+	port := uint16(s.direct.listener.Addr().(*net.TCPAddr).Port)
+
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+
+		if n < 32 {
+			continue
+		}
+
+		var peer [32]byte
+		copy(peer[:], buf[:32])
+		if s.peerLimits.banned(peer, time.Now()) {
+			continue
+		}
+
+		cipher := s.signalCipherForPeer(peer)
+		probe, err := cipher.decode(buf[32:n])
+		if err != nil || probe.Type != signalLANProbe {
+			continue
+		}
+
+		reply := cipher.encode(signalMessage{
+			Type:      signalLANProbe,
+			SessionID: probe.SessionID,
+			Payload:   binary.BigEndian.AppendUint16(nil, port),
+		})
+		if _, err := conn.WriteToUDPAddrPort(reply, from); err != nil {
+			log.Printf("ts: unable to answer local network probe from %s: %v", from, err)
+		}
+	}
+}
+
+// acceptLANSession starts a session a client opened straight to the direct listener after finding the server on its network
+func (s *Service) acceptLANSession(peer [32]byte, hello signalMessage, c net.Conn, cipher *signalCipher) error {
+	if s.peerLimits.banned(peer, time.Now()) {
+		return errors.New("peer is banned")
+	}
+
+	key := relaySessionKey{Peer: peer, SessionID: hello.SessionID}
+
+	s.sessionMu.Lock()
+	if s.sessions[key] != nil {
+		s.sessionMu.Unlock()
+		return fmt.Errorf("session=%x already exists", hello.SessionID[:4])
+	}
+
+	conn := newRelayConn(hello.SessionID, "direct", peer, noRelay, func() {
+		s.sessionMu.Lock()
+		delete(s.sessions, key)
+		s.sessionMu.Unlock()
+	})
+	s.sessions[key] = &relaySession{
+		conn:         conn,
+		accepted:     true,
+		lastActivity: time.Now(),
+	}
+	s.sessionMu.Unlock()
+
+	if err := writeDirectFrame(c, cipher.encode(signalMessage{Type: signalDirectDial, SessionID: hello.SessionID})); err != nil {
+		conn.Close()
+		return err
+	}
+	c.SetDeadline(time.Time{})
+
+	conn.useDirect(c)
+	if err := s.listener.push(conn); err != nil {
+		conn.markRemoteClosed()
+		_ = conn.Close()
+		return err
+	}
+
+	log.Printf("ts: session=%x opened on the local network from %s", hello.SessionID[:4], c.RemoteAddr())
+	return nil
+}
+
+// noRelay is the relay of a session that never had one
+func noRelay(signalMessage) error {
+	return net.ErrClosed
+}
+
+// dialLAN looks for the server on the client's networks and opens a session straight to it
+func dialLAN(ctx context.Context, token *Token) (*relayConn, error) {
+	derpPrivate, err := getGlobalDERPIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, lanProbeTimeout)
+	defer cancel()
+
+	addr, err := probeLAN(probeCtx, token, newSignalCipher(derpPrivate, token.ServerDERPPublicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessionID [16]byte
+	if _, err := rand.Read(sessionID[:]); err != nil {
+		return nil, err
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, directHandshakeTimeout)
+	defer cancel()
+
+	c, err := dialDirect(dialCtx, addr.String(), signalDirectDial, sessionID, globalDERPPublicKey, newSignalCipher(derpPrivate, token.ServerDERPPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("server found on the local network at %s but not reachable: %w", addr, err)
+	}
+
+	conn := newRelayConn(sessionID, "direct", token.ServerDERPPublicKey, noRelay, nil)
+	conn.useDirect(c)
+
+	log.Printf("ts: session=%x opened on the local network to %s", sessionID[:4], addr)
+	return conn, nil
+}
+
+// probeLAN broadcasts a probe only the server can answer, and returns where its direct listener is
+func probeLAN(ctx context.Context, token *Token, cipher *signalCipher) (netip.AddrPort, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	defer conn.Close()
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	probe := append(append([]byte{}, globalDERPPublicKey[:]...), cipher.encode(signalMessage{Type: signalLANProbe, SessionID: nonce})...)
+	sent := 0
+	for _, target := range lanProbeTargets(token) {
+		if _, err := conn.WriteToUDPAddrPort(probe, target); err == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		return netip.AddrPort{}, errors.New("no local networks to probe")
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("server not found on the local network: %w", err)
+		}
+
+		reply, err := cipher.decode(buf[:n])
+		if err != nil || reply.Type != signalLANProbe || reply.SessionID != nonce || len(reply.Payload) != 2 {
+			continue
+		}
+
+		return netip.AddrPortFrom(from.Addr().Unmap(), binary.BigEndian.Uint16(reply.Payload)), nil
+	}
+}
@@ -0,0 +1,77 @@
+package nat
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDialFindsServerOnLAN(t *testing.T) {
+	derpServer, node := newFakeDERPServer(t)
+	defer derpServer.Close()
+
+	mapServer := newMapServerForNode(node)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	udp.Close()
+
+	oldPort, oldTargets := lanDiscoveryPort, lanProbeTargets
+	defer func() {
+		lanDiscoveryPort, lanProbeTargets = oldPort, oldTargets
+	}()
+	lanDiscoveryPort = port
+	lanProbeTargets = func(*Token) []netip.AddrPort {
+		return []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(port))}
+	}
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:     mustPickTestAddr(t),
+		HostPrivateKey: []byte("test-key-lan"),
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	go echoAcceptedConn(t, service.Listener())
+
+	// The responder starts in the background
+	var conn net.Conn
+	for i := 0; ; i++ {
+		conn, err = DialContext(context.Background(), DestinationPrefix+service.Token())
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		if conn.(interface{ Path() string }).Path() == "direct" {
+			break
+		}
+
+		conn.Close()
+		if i == 10 {
+			t.Fatal("client on the same network as the server used the relay")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	if status := Status(); status.DirectSessions != 1 {
+		t.Fatalf("expected one direct session on the server, got %+v", status)
+	}
+}
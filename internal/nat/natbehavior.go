@@ -0,0 +1,365 @@
+package nat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NAT behaviour discovery, after RFC 5780. Bindings from one socket to servers on two addresses show whether the NAT maps by destination,
+// and servers that answer CHANGE-REQUEST show whether it filters by address or port. Most public STUN servers, DERP nodes included, do not
+// answer CHANGE-REQUEST, so cone NATs are often reported without their filtering.
+// The server finds its own when the ts relay transport starts, clients find theirs after dialing and report it over the relay.
+
+const (
+	stunAttrChangeRequest  = 0x0003
+	stunAttrChangedAddress = 0x0005 // RFC 3489, older servers
+	stunAttrOtherAddress   = 0x802c
+
+	stunChangeIP   = 0x04
+	stunChangePort = 0x02
+
+	natDetectTimeout = 10 * time.Second
+
+	// How long to wait for answers that filtering may drop
+	natFilterTimeout = 1500 * time.Millisecond
+)
+
+type NATType byte
+
+const (
+	NATUnknown NATType = iota
+	NATNone
+	NATFullCone
+	NATRestrictedCone
+	NATPortRestrictedCone
+	// Endpoint independent mapping, with unknown filtering
+	NATCone
+	NATSymmetric
+
+	natTypeCount
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATNone:
+		return "none"
+	case NATFullCone:
+		return "full cone"
+	case NATRestrictedCone:
+		return "restricted cone"
+	case NATPortRestrictedCone:
+		return "port restricted cone"
+	case NATCone:
+		return "cone"
+	case NATSymmetric:
+		return "symmetric"
+	}
+	return "unknown"
+}
+
+// Punchable is whether a direct path through this NAT is worth trying, symmetric NATs give every destination a new port so it rarely is
+func (t NATType) Punchable() bool {
+	switch t {
+	case NATNone, NATFullCone, NATRestrictedCone, NATPortRestrictedCone, NATCone:
+		return true
+	}
+	return false
+}
+
+// NATBehavior is what DetectNAT found
+type NATBehavior struct {
+	Type NATType
+
+	// Where each STUN server saw the requests come from
+	Mapped []netip.AddrPort
+
+	// Zero if detection has not run
+	Detected time.Time
+}
+
+var (
+	localNATMu sync.Mutex
+	localNAT   NATBehavior
+)
+
+// LocalNAT is the NAT in front of this host, as last found by the ts relay transport
+func LocalNAT() NATBehavior {
+	localNATMu.Lock()
+	defer localNATMu.Unlock()
+	return localNAT
+}
+
+func setLocalNAT(b NATBehavior) {
+	localNATMu.Lock()
+	localNAT = b
+	localNATMu.Unlock()
+}
+
+// DetectNAT classifies the NAT in front of this host with the given STUN servers, it takes at most 10 seconds.
+// IPv4 is what is usually behind a NAT, so it is tried first, and IPv6 only when the host has no IPv4 path to the servers
+func DetectNAT(ctx context.Context, servers []string) (b NATBehavior) {
+	defer func() {
+		b.Detected = time.Now()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, natDetectTimeout)
+	defer cancel()
+
+	for _, family := range []string{"4", "6"} {
+		if b = detectNAT(ctx, servers, family); len(b.Mapped) > 0 || ctx.Err() != nil {
+			break
+		}
+	}
+	return b
+}
+
+// detectNAT is DetectNAT over one address family, "4" or "6"
+func detectNAT(ctx context.Context, servers []string, family string) (b NATBehavior) {
+	conn, err := net.ListenUDP("udp"+family, nil)
+	if err != nil {
+		return b
+	}
+	defer conn.Close()
+
+	var (
+		first       netip.AddrPort
+		firstAnswer stunAnswer
+		asked       = map[netip.Addr]bool{}
+	)
+	for _, server := range servers {
+		if len(asked) == 2 || ctx.Err() != nil {
+			break
+		}
+
+		addr, err := resolveSTUNServer(ctx, server, family)
+		if err != nil || asked[addr.Addr()] {
+			continue
+		}
+
+		answer, err := stunExchange(ctx, conn, addr, 0, stunTimeout)
+		if err != nil {
+			continue
+		}
+
+		asked[addr.Addr()] = true
+		b.Mapped = append(b.Mapped, answer.mapped)
+		if !first.IsValid() {
+			first, firstAnswer = addr, answer
+		}
+	}
+
+	if len(b.Mapped) == 0 {
+		return b
+	}
+
+	if isLocalAddrPort(b.Mapped[0], conn) {
+		b.Type = NATNone
+		return b
+	}
+
+	// Filtering is tested before anything is sent to the server's other address, so the NAT has no reason to let its answers in
+	filtering := NATUnknown
+	other := firstAnswer.other
+	if other.IsValid() && other.Addr() != first.Addr() {
+		if _, err := stunExchange(ctx, conn, first, stunChangeIP|stunChangePort, natFilterTimeout); err == nil {
+			filtering = NATFullCone
+		} else if _, err := stunExchange(ctx, conn, first, stunChangePort, natFilterTimeout); err == nil {
+			filtering = NATRestrictedCone
+		} else {
+			filtering = NATPortRestrictedCone
+		}
+
+		// With only one server, its other address tells us about the mapping
+		if len(b.Mapped) == 1 {
+			if answer, err := stunExchange(ctx, conn, netip.AddrPortFrom(other.Addr(), first.Port()), 0, stunTimeout); err == nil {
+				b.Mapped = append(b.Mapped, answer.mapped)
+			}
+		}
+	}
+
+	b.Type = classifyNAT(b.Mapped, filtering)
+	return b
+}
+
+// classifyNAT decides the type from the addresses servers on different IPs saw, and the filtering if it is known
+func classifyNAT(mapped []netip.AddrPort, filtering NATType) NATType {
+	if len(mapped) < 2 {
+		return NATUnknown
+	}
+
+	for _, m := range mapped[1:] {
+		if m != mapped[0] {
+			return NATSymmetric
+		}
+	}
+
+	if filtering == NATUnknown {
+		return NATCone
+	}
+	return filtering
+}
+
+func isLocalAddrPort(mapped netip.AddrPort, conn *net.UDPConn) bool {
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || local.Port != int(mapped.Port()) {
+		return false
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == mapped.Addr() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func resolveSTUNServer(ctx context.Context, server, family string) (netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip"+family, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(ips) == 0 {
+		return netip.AddrPort{}, errors.New("no ipv" + family + " address for stun server")
+	}
+
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(p)), nil
+}
+
+type stunAnswer struct {
+	mapped netip.AddrPort
+
+	// Where the server can answer from instead, if it supports CHANGE-REQUEST
+	other netip.AddrPort
+}
+
+// stunExchange sends a binding request from conn, the answer may come from another address if change asks for it
+func stunExchange(ctx context.Context, conn *net.UDPConn, server netip.AddrPort, change uint32, timeout time.Duration) (stunAnswer, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	request := make([]byte, 20, 28)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	if _, err := rand.Read(request[8:20]); err != nil {
+		return stunAnswer{}, err
+	}
+	if change != 0 {
+		binary.BigEndian.PutUint16(request[2:4], 8)
+		request = binary.BigEndian.AppendUint16(request, stunAttrChangeRequest)
+		request = binary.BigEndian.AppendUint16(request, 4)
+		request = binary.BigEndian.AppendUint32(request, change)
+	}
+
+	response := make([]byte, 1500)
+	for attempt := 0; time.Now().Before(deadline); attempt++ {
+		if _, err := conn.WriteToUDPAddrPort(request, server); err != nil {
+			return stunAnswer{}, err
+		}
+
+		readDeadline := time.Now().Add(500 * time.Millisecond << attempt)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		for {
+			n, _, err := conn.ReadFromUDPAddrPort(response)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					// Ask again, UDP may have lost either way
+					break
+				}
+				return stunAnswer{}, err
+			}
+
+			mapped, err := parseSTUNResponse(response[:n], request[8:20])
+			if err != nil {
+				// A late answer to an earlier request
+				continue
+			}
+
+			return stunAnswer{mapped: mapped, other: parseSTUNOtherAddress(response[:n])}, nil
+		}
+	}
+
+	return stunAnswer{}, os.ErrDeadlineExceeded
+}
+
+// parseSTUNOtherAddress reads OTHER-ADDRESS, or CHANGED-ADDRESS from older servers, from a response. Nothing is returned if it is cut short
+func parseSTUNOtherAddress(response []byte) netip.AddrPort {
+	var other netip.AddrPort
+	if len(response) < 20 {
+		return other
+	}
+
+	length := int(binary.BigEndian.Uint16(response[2:4]))
+	if len(response) < 20+length {
+		return other
+	}
+
+	walkSTUNAttributes(response[20:20+length], func(attrType uint16, value []byte) {
+		if attrType == stunAttrOtherAddress || attrType == stunAttrChangedAddress {
+			if addr, err := parseSTUNAddress(value, nil, false); err == nil {
+				other = addr
+			}
+		}
+	})
+	return other
+}
+
+// detectNAT finds the server's NAT behaviour, for the console to show
+func (s *Service) detectNAT(stunServers []string) {
+	if len(stunServers) == 0 {
+		return
+	}
+
+	b := DetectNAT(s.ctx, stunServers)
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	setLocalNAT(b)
+	log.Printf("ts: nat behaviour is %s", b.Type)
+}
+
+// reportNAT finds the client's NAT behaviour and tells the server, so operators know whether a direct path is worth trying
+func reportNAT(relay *relayConn, stunServers []string) {
+	b := DetectNAT(context.Background(), stunServers)
+	setLocalNAT(b)
+
+	if err := relay.sendSignal(signalMessage{
+		Type:      signalNATType,
+		SessionID: relay.sessionID,
+		Payload:   []byte{byte(b.Type)},
+	}); err != nil {
+		log.Printf("ts: unable to report nat behaviour for session=%x: %v", relay.sessionID[:4], err)
+	}
+}
@@ -0,0 +1,134 @@
+package nat
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits on each peer (DERP key) talking to the service, so one hostile key cannot use up the relay transport for everyone else
+const (
+	maxPendingRelaySessionsPerPeer = 16
+
+	peerBanDuration = 10 * time.Minute
+
+	// Peers not heard from in this long are forgotten, unless they are banned
+	peerIdleExpiry = 10 * time.Minute
+)
+
+// DefaultPeerDataRate is how many bytes a second of relayed data each peer may send, with bursts of twice that
+const DefaultPeerDataRate = 32 << 20
+
+type peerLimit struct {
+	data        *rate.Limiter
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+type peerLimits struct {
+	mu    sync.Mutex
+	peers map[[32]byte]*peerLimit
+
+	dataRate int
+}
+
+func newPeerLimits(dataRate int) *peerLimits {
+	if dataRate <= 0 {
+		dataRate = DefaultPeerDataRate
+	}
+
+	return &peerLimits{
+		peers:    make(map[[32]byte]*peerLimit),
+		dataRate: dataRate,
+	}
+}
+
+func (p *peerLimits) getLocked(peer [32]byte, now time.Time) *peerLimit {
+	l := p.peers[peer]
+	if l == nil {
+		l = &peerLimit{data: rate.NewLimiter(rate.Limit(p.dataRate), 2*p.dataRate)}
+		p.peers[peer] = l
+	}
+	l.lastSeen = now
+	return l
+}
+
+// banned reports whether everything from peer should be dropped
+func (p *peerLimits) banned(peer [32]byte, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.peers[peer]
+	return l != nil && now.Before(l.bannedUntil)
+}
+
+// allowData takes size bytes from peer's data allowance, false if it has sent too much
+func (p *peerLimits) allowData(peer [32]byte, size int, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.getLocked(peer, now).data.AllowN(now, size)
+}
+
+func (p *peerLimits) ban(peer [32]byte, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.getLocked(peer, now).bannedUntil = now.Add(peerBanDuration)
+}
+
+func (p *peerLimits) bannedCount(now time.Time) (count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, l := range p.peers {
+		if now.Before(l.bannedUntil) {
+			count++
+		}
+	}
+	return count
+}
+
+func (p *peerLimits) prune(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for peer, l := range p.peers {
+		if now.After(l.bannedUntil) && now.Sub(l.lastSeen) > peerIdleExpiry {
+			delete(p.peers, peer)
+		}
+	}
+}
+
+func (s *Service) pendingRelaySessionsForPeerLocked(peer [32]byte) int {
+	pending := 0
+	for key, session := range s.sessions {
+		if key.Peer == peer && !session.accepted {
+			pending++
+		}
+	}
+	return pending
+}
+
+// banPeer drops everything from peer for peerBanDuration, and closes its sessions
+func (s *Service) banPeer(peer [32]byte, reason string) {
+	s.peerLimits.ban(peer, time.Now())
+	log.Printf("ts: banning peer %x for %s, %s", peer[:8], peerBanDuration, reason)
+
+	var sessions []*relayConn
+	s.sessionMu.Lock()
+	for key, session := range s.sessions {
+		if key.Peer == peer {
+			delete(s.sessions, key)
+			sessions = append(sessions, session.conn)
+		}
+	}
+	s.sessionMu.Unlock()
+
+	for _, conn := range sessions {
+		conn.relayClosed()
+		_ = conn.Close()
+	}
+}
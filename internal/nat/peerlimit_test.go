@@ -0,0 +1,73 @@
+package nat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerLimitsData(t *testing.T) {
+	limits := newPeerLimits(0)
+	now := time.Now()
+
+	var hostile, other [32]byte
+	hostile[0], other[0] = 1, 2
+
+	sent := 0
+	for limits.allowData(hostile, 64<<10, now) {
+		sent += 64 << 10
+	}
+	if sent != 2*DefaultPeerDataRate {
+		t.Fatalf("peer sent %d bytes at once, burst is %d", sent, 2*DefaultPeerDataRate)
+	}
+
+	if !limits.allowData(other, 64<<10, now) {
+		t.Fatal("one peer used up another's allowance")
+	}
+
+	if !limits.allowData(hostile, 64<<10, now.Add(time.Second)) {
+		t.Fatal("allowance was not refilled")
+	}
+
+	limits.ban(hostile, now)
+	if !limits.banned(hostile, now.Add(time.Minute)) || limits.banned(other, now) {
+		t.Fatal("ban not applied to just the hostile peer")
+	}
+
+	later := now.Add(peerBanDuration + peerIdleExpiry + time.Second)
+	if limits.banned(hostile, later) {
+		t.Fatal("ban did not expire")
+	}
+
+	limits.prune(later)
+	if len(limits.peers) != 0 {
+		t.Fatalf("%d idle peers were kept", len(limits.peers))
+	}
+}
+
+func TestPendingSessionsPerPeer(t *testing.T) {
+	s := &Service{
+		peerHomes:     make(map[[32]byte]*derpHome),
+		sessions:      make(map[relaySessionKey]*relaySession),
+		signalCiphers: make(map[[32]byte]*signalCipher),
+		peerLimits:    newPeerLimits(0),
+	}
+
+	var hostile, other [32]byte
+	hostile[0], other[0] = 1, 2
+
+	for i := 0; i <= maxPendingRelaySessionsPerPeer; i++ {
+		var message signalMessage
+		message.Type = signalDialInit
+		message.SessionID[0] = byte(i)
+		s.handleDialInit(hostile, message)
+	}
+
+	if len(s.sessions) != 0 || !s.peerLimits.banned(hostile, time.Now()) {
+		t.Fatalf("peer over the pending session limit kept %d sessions", len(s.sessions))
+	}
+
+	s.handleDialInit(other, signalMessage{Type: signalDialInit})
+	if len(s.sessions) != 1 {
+		t.Fatal("another peer was refused")
+	}
+}
@@ -0,0 +1,49 @@
+package nat
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Dialer opens a TCP connection to address, e.g through a proxy
+type Dialer func(ctx context.Context, address string) (net.Conn, error)
+
+type dialerKey struct{}
+
+// WithDialer makes the DERP connections, DERP latency probes and DERP map fetches of a dial with ctx go through dial rather than straight out.
+// The direct path and STUN are UDP or go to addresses a proxy will not reach, so they are not affected
+func WithDialer(ctx context.Context, dial Dialer) context.Context {
+	return context.WithValue(ctx, dialerKey{}, dial)
+}
+
+func dialTCP(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	if dial, ok := ctx.Value(dialerKey{}).(Dialer); ok {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		return dial(ctx, address)
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// httpClient fetches through the dialer in ctx if there is one, otherwise through the proxy the environment sets
+func httpClient(ctx context.Context, timeout time.Duration) *http.Client {
+	client := &http.Client{
+		Timeout: timeout,
+	}
+
+	if dial, ok := ctx.Value(dialerKey{}).(Dialer); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+				return dial(ctx, address)
+			},
+			TLSHandshakeTimeout: timeout,
+		}
+	}
+
+	return client
+}
@@ -0,0 +1,187 @@
+package nat
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Relay data can be compressed when the server turns it on. The client offers the codecs it has with signalCompression straight after its dial init,
+// and the server answers with the one it will use, or none. Peers that do not know signalCompression ignore it, so the dial init and ack are unchanged.
+// Each side only sends signalDataCompressed once it knows the other has the codec, and only for payloads that get smaller.
+// What is relayed is mostly the ssh transport, which is encrypted and so rarely shrinks, a session that keeps failing to compress stops trying for a while
+
+type relayCodec byte
+
+const (
+	relayCodecNone   relayCodec = 0
+	relayCodecSnappy relayCodec = 1
+	relayCodecZstd   relayCodec = 2
+)
+
+const (
+	// Smaller payloads are sent as they are
+	relayCompressMin = 512
+
+	// After this many payloads in a row do not shrink, the next relayCompressBackoff are not tried
+	relayCompressFailLimit = 16
+	relayCompressBackoff   = 256
+)
+
+// What clients offer, in order of preference
+var relayCodecOffer = []byte{byte(relayCodecZstd), byte(relayCodecSnappy)}
+
+var errRelayDecompress = errors.New("relay payload could not be decompressed")
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		return e
+	})
+
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(relayChunkSize))
+		return d
+	})
+)
+
+// ValidateRelayCompression checks a codec name for ServiceConfig.RelayCompression
+func ValidateRelayCompression(name string) error {
+	_, err := parseRelayCodec(name)
+	return err
+}
+
+// parseRelayCodec reads a codec name, none or "" turns compression off
+func parseRelayCodec(name string) (relayCodec, error) {
+	switch name {
+	case "", "none":
+		return relayCodecNone, nil
+	case "snappy":
+		return relayCodecSnappy, nil
+	case "zstd":
+		return relayCodecZstd, nil
+	}
+
+	return relayCodecNone, fmt.Errorf("unknown relay compression %q, use none, snappy or zstd", name)
+}
+
+func (codec relayCodec) String() string {
+	switch codec {
+	case relayCodecSnappy:
+		return "snappy"
+	case relayCodecZstd:
+		return "zstd"
+	}
+	return "none"
+}
+
+func (codec relayCodec) supported() bool {
+	return codec == relayCodecSnappy || codec == relayCodecZstd
+}
+
+// chooseRelayCodec picks what the server uses from a client's offer, none if the client does not have it
+func chooseRelayCodec(preferred relayCodec, offer []byte) relayCodec {
+	if preferred == relayCodecNone {
+		return relayCodecNone
+	}
+
+	for _, codec := range offer {
+		if relayCodec(codec) == preferred {
+			return preferred
+		}
+	}
+	return relayCodecNone
+}
+
+// compressRelay returns codec(1) + the compressed payload
+func compressRelay(codec relayCodec, payload []byte) []byte {
+	out := []byte{byte(codec)}
+
+	switch codec {
+	case relayCodecSnappy:
+		return append(out, snappy.Encode(nil, payload)...)
+	case relayCodecZstd:
+		return zstdEncoder().EncodeAll(payload, out)
+	}
+
+	return nil
+}
+
+// decompressRelay reads a signalDataCompressed payload, which decompresses to at most relayChunkSize bytes
+func decompressRelay(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, errRelayDecompress
+	}
+
+	codec, data := relayCodec(payload[0]), payload[1:]
+
+	var (
+		out []byte
+		err error
+	)
+	switch codec {
+	case relayCodecSnappy:
+		var size int
+		size, err = snappy.DecodedLen(data)
+		if err != nil || size > relayChunkSize {
+			return nil, errRelayDecompress
+		}
+		out, err = snappy.Decode(nil, data)
+	case relayCodecZstd:
+		out, err = zstdDecoder().DecodeAll(data, nil)
+	default:
+		return nil, errRelayDecompress
+	}
+
+	if err != nil || len(out) > relayChunkSize {
+		return nil, errRelayDecompress
+	}
+	return out, nil
+}
+
+// setSendCodec is called once the peer has said it has codec
+func (c *relayConn) setSendCodec(codec relayCodec) {
+	c.mu.Lock()
+	c.sendCodec = codec
+	c.mu.Unlock()
+}
+
+// dataMessage makes the message for a chunk of a write, compressed when a codec has been agreed and it helps. Called with writeMu held
+func (c *relayConn) dataMessage(chunk []byte) signalMessage {
+	message := signalMessage{
+		Type:      signalData,
+		SessionID: c.sessionID,
+		Payload:   chunk,
+	}
+
+	c.mu.Lock()
+	codec := c.sendCodec
+	c.mu.Unlock()
+
+	if codec == relayCodecNone || len(chunk) < relayCompressMin {
+		return message
+	}
+
+	if c.compressSkip > 0 {
+		c.compressSkip--
+		return message
+	}
+
+	compressed := compressRelay(codec, chunk)
+	if len(compressed) >= len(chunk) {
+		c.compressFails++
+		if c.compressFails >= relayCompressFailLimit {
+			c.compressFails = 0
+			c.compressSkip = relayCompressBackoff
+		}
+		return message
+	}
+
+	c.compressFails = 0
+	message.Type = signalDataCompressed
+	message.Payload = compressed
+	return message
+}
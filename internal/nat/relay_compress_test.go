@@ -0,0 +1,103 @@
+package nat
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+func TestRelayCompressRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("ssh-ed25519 AAAA "), 1000)
+
+	for _, codec := range []relayCodec{relayCodecSnappy, relayCodecZstd} {
+		compressed := compressRelay(codec, payload)
+		if len(compressed) >= len(payload) {
+			t.Fatalf("%s did not shrink %d bytes", codec, len(payload))
+		}
+
+		out, err := decompressRelay(compressed)
+		if err != nil || !bytes.Equal(out, payload) {
+			t.Fatalf("%s round trip failed: %v", codec, err)
+		}
+	}
+
+	// Nothing may decompress to more than a relay chunk
+	bomb := append([]byte{byte(relayCodecSnappy)}, snappy.Encode(nil, make([]byte, 4*relayChunkSize))...)
+	if _, err := decompressRelay(bomb); err == nil {
+		t.Fatal("oversized snappy payload was decompressed")
+	}
+
+	bomb = compressRelay(relayCodecZstd, make([]byte, 4*relayChunkSize))
+	if _, err := decompressRelay(bomb); err == nil {
+		t.Fatal("oversized zstd payload was decompressed")
+	}
+
+	if chooseRelayCodec(relayCodecZstd, []byte{byte(relayCodecSnappy)}) != relayCodecNone {
+		t.Fatal("server chose a codec the client does not have")
+	}
+}
+
+func TestDialRelayCompressed(t *testing.T) {
+	derpServer, node := newFakeDERPServer(t)
+	defer derpServer.Close()
+
+	mapServer := newMapServerForNode(node)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:       mustPickTestAddr(t),
+		HostPrivateKey:   []byte("test-key-compressed"),
+		DisableDirect:    true,
+		RelayCompression: "zstd",
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	go echoAcceptedConn(t, service.Listener())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, DestinationPrefix+service.Token())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+
+	relay, ok := conn.(*relayConn)
+	if !ok {
+		t.Fatalf("DialContext() returned %T", conn)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		relay.mu.Lock()
+		codec := relay.sendCodec
+		relay.mu.Unlock()
+
+		if codec == relayCodecZstd {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client codec = %s, want zstd", codec)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	payload := bytes.Repeat([]byte("compressible relay data "), 20000)
+	go conn.Write(payload)
+
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if !bytes.Equal(buf, payload) {
+		t.Fatal("echo mismatch")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"sync"
 	"time"
@@ -14,6 +15,8 @@ const RelayAddrNetwork = "ts_relay"
 
 type relayPeerAddr struct {
 	source [32]byte
+
+	conn *relayConn
 }
 
 func (a relayPeerAddr) Network() string {
@@ -24,6 +27,30 @@ func (a relayPeerAddr) String() string {
 	return fmt.Sprintf("%s:%x", RelayAddrNetwork, a.source[:8])
 }
 
+// Path is the path the connection currently uses, so it can be found from an ssh connection's RemoteAddr
+func (a relayPeerAddr) Path() string {
+	if a.conn == nil {
+		return "relay"
+	}
+	return a.conn.Path()
+}
+
+// PublicAddress is where the client says it connects from, found with STUN, empty if it has not said
+func (a relayPeerAddr) PublicAddress() string {
+	if a.conn == nil {
+		return ""
+	}
+	return a.conn.getPeerPublic()
+}
+
+// NAT is the client's NAT behaviour as it reported it, NATUnknown if it has not
+func (a relayPeerAddr) NAT() NATType {
+	if a.conn == nil {
+		return NATUnknown
+	}
+	return a.conn.getPeerNAT()
+}
+
 type relayConn struct {
 	sessionID [16]byte
 	path      string
@@ -32,8 +59,20 @@ type relayConn struct {
 	sendSignal func(signalMessage) error
 	onClosed   func()
 
-	incoming chan []byte
-	closed   chan struct{}
+	closed     chan struct{}
+	remoteDone chan struct{}
+
+	// Signalled when readBuf gains data, when the reader takes from it, when the peer grants more window, and when the write deadline is set
+	readable             chan struct{}
+	drained              chan struct{}
+	creditChanged        chan struct{}
+	writeDeadlineChanged chan struct{}
+
+	// See relay_send.go. queuedBytes and sendErr are guarded by mu
+	sendQueue   chan relaySend
+	senderDone  chan struct{}
+	queuedBytes int
+	sendErr     error
 
 	mu            sync.Mutex
 	readBuf       bytes.Buffer
@@ -41,20 +80,56 @@ type relayConn struct {
 	writeDeadline time.Time
 	remoteClosed  bool
 
+	// Set while a direct path is being tried
+	upgrading bool
+	// The direct path, once its handshake is done. Writes move to it once writeDirect is set, reads once the peer has said it moved
+	direct       net.Conn
+	writeDirect  bool
+	readDirect   bool
+	peerSwitched bool
+
+	peerPublic string
+	peerNAT    NATType
+
+	// See relay_flow.go. sendCredit is what we may still send, recvAllowance what the peer may, and unacked what has been read but not granted back
+	flowControl   bool
+	sendCredit    int
+	recvAllowance int
+	unacked       int
+
+	// See relay_compress.go. sendCodec is guarded by mu, compressFails and compressSkip by writeMu
+	sendCodec     relayCodec
+	compressFails int
+	compressSkip  int
+
+	// Held for each write so nothing is queued on the relay after the switch message
+	writeMu sync.Mutex
+
 	closeOnce sync.Once
 }
 
 func newRelayConn(sessionID [16]byte, path string, source [32]byte, sendSignal func(signalMessage) error, onClosed func()) *relayConn {
-	return &relayConn{
-		sessionID:    sessionID,
-		path:         path,
-		remote:       relayPeerAddr{source: source},
-		sendSignal:   sendSignal,
-		onClosed:     onClosed,
-		incoming:     make(chan []byte, 256),
-		closed:       make(chan struct{}),
-		remoteClosed: false,
+	c := &relayConn{
+		sessionID:     sessionID,
+		path:          path,
+		sendSignal:    sendSignal,
+		onClosed:      onClosed,
+		closed:        make(chan struct{}),
+		remoteDone:    make(chan struct{}),
+		readable:      make(chan struct{}, 1),
+		drained:       make(chan struct{}, 1),
+		creditChanged: make(chan struct{}, 1),
+		remoteClosed:  false,
+
+		writeDeadlineChanged: make(chan struct{}, 1),
+		sendQueue:            make(chan relaySend, relaySendQueue),
+		senderDone:           make(chan struct{}),
 	}
+	c.remote = relayPeerAddr{source: source, conn: c}
+
+	go c.sendLoop()
+
+	return c
 }
 
 func (c *relayConn) Read(b []byte) (int, error) {
@@ -63,12 +138,22 @@ func (c *relayConn) Read(b []byte) (int, error) {
 		if c.readBuf.Len() > 0 {
 			n, _ := c.readBuf.Read(b)
 			c.mu.Unlock()
+
+			notify(c.drained)
+			c.consumed(n)
 			return n, nil
 		}
-		remoteClosed := c.remoteClosed
 		deadline := c.readDeadline
+		remoteClosed := c.remoteClosed
 		c.mu.Unlock()
 
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		default:
+		}
+
+		// Whatever arrived before the close has been returned
 		if remoteClosed {
 			return 0, io.EOF
 		}
@@ -87,27 +172,15 @@ func (c *relayConn) Read(b []byte) (int, error) {
 		}
 
 		select {
-		case payload, ok := <-c.incoming:
-			if timer != nil {
-				timer.Stop()
-			}
-			if !ok {
-				c.mu.Lock()
-				c.remoteClosed = true
-				c.mu.Unlock()
-				continue
-			}
-			c.mu.Lock()
-			c.readBuf.Write(payload)
-			c.mu.Unlock()
+		case <-c.readable:
+		case <-c.remoteDone:
 		case <-c.closed:
-			if timer != nil {
-				timer.Stop()
-			}
-			return 0, net.ErrClosed
 		case <-timerCh:
 			return 0, timeoutErr("read timeout")
 		}
+		if timer != nil {
+			timer.Stop()
+		}
 	}
 }
 
@@ -121,31 +194,46 @@ func (c *relayConn) Write(b []byte) (int, error) {
 	c.mu.Lock()
 	remoteClosed := c.remoteClosed
 	deadline := c.writeDeadline
+	sendErr := c.sendErr
 	c.mu.Unlock()
 	if remoteClosed {
 		return 0, io.EOF
 	}
+	if sendErr != nil {
+		return 0, sendErr
+	}
 	if deadlineExceeded(deadline) {
 		return 0, timeoutErr("write timeout")
 	}
 
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	direct := c.direct
+	writeDirect := c.writeDirect
+	deadline = c.writeDeadline
+	c.mu.Unlock()
+
+	if writeDirect {
+		direct.SetWriteDeadline(deadline)
+		return direct.Write(b)
+	}
+
 	written := 0
 	for written < len(b) {
-		limit := len(b) - written
-		if limit > 65000 {
-			limit = 65000
-		}
-		if err := c.sendSignal(signalMessage{
-			Type:      signalData,
-			SessionID: c.sessionID,
-			Payload:   b[written : written+limit],
-		}); err != nil {
+		limit, err := c.takeCredit(min(len(b)-written, relayChunkSize))
+		if err != nil {
 			return written, err
 		}
-		written += limit
-		if deadlineExceeded(deadline) {
-			return written, timeoutErr("write timeout")
+
+		// The caller may reuse b once Write returns, and the chunk is sent after that
+		chunk := bytes.Clone(b[written : written+limit])
+		if err := c.enqueue(relaySend{message: c.dataMessage(chunk)}); err != nil {
+			c.refundCredit(limit)
+			return written, err
 		}
+		written += limit
 	}
 
 	return written, nil
@@ -155,13 +243,18 @@ func (c *relayConn) Close() error {
 	var retErr error
 	c.closeOnce.Do(func() {
 		close(c.closed)
+
+		c.mu.Lock()
+		direct := c.direct
+		c.mu.Unlock()
+		if direct != nil {
+			direct.Close()
+		}
+
 		if c.onClosed != nil {
 			c.onClosed()
 		}
-		if err := c.sendSignal(signalMessage{
-			Type:      signalClose,
-			SessionID: c.sessionID,
-		}); err != nil && !errors.Is(err, net.ErrClosed) {
+		if err := c.flushAndClose(); err != nil && !errors.Is(err, net.ErrClosed) {
 			retErr = err
 		}
 	})
@@ -195,28 +288,221 @@ func (c *relayConn) SetReadDeadline(t time.Time) error {
 
 func (c *relayConn) SetWriteDeadline(t time.Time) error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	c.writeDeadline = t
+	c.mu.Unlock()
+
+	// A write that is waiting picks up the new deadline
+	notify(c.writeDeadlineChanged)
 	return nil
 }
 
+// Path is "relay", "relay (upgrading)" while a direct path is being set up, or "direct" once both sides have moved to it
 func (c *relayConn) Path() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.writeDirect && c.readDirect:
+		return "direct"
+	case c.upgrading || c.direct != nil:
+		return c.path + " (upgrading)"
+	}
 	return c.path
 }
 
-func (c *relayConn) pushIncoming(payload []byte) bool {
+func (c *relayConn) setPeerPublic(addrs string) {
+	c.mu.Lock()
+	c.peerPublic = addrs
+	c.mu.Unlock()
+}
+
+func (c *relayConn) getPeerPublic() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerPublic
+}
+
+func (c *relayConn) setPeerNAT(t NATType) {
+	c.mu.Lock()
+	c.peerNAT = t
+	c.mu.Unlock()
+}
+
+func (c *relayConn) getPeerNAT() NATType {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerNAT
+}
+
+func (c *relayConn) setUpgrading(upgrading bool) {
+	c.mu.Lock()
+	c.upgrading = upgrading
+	c.mu.Unlock()
+}
+
+// attachDirect records a direct path that has finished its handshake, nothing is sent or read on it until switchWrites or peerSwitch
+func (c *relayConn) attachDirect(direct net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.direct != nil || c.remoteClosed {
+		return false
+	}
+
 	select {
 	case <-c.closed:
 		return false
 	default:
 	}
 
-	select {
-	case c.incoming <- payload:
-		return true
-	case <-c.closed:
+	c.direct = direct
+	return true
+}
+
+// useDirect puts a session that never had a relay straight onto its direct path
+func (c *relayConn) useDirect(direct net.Conn) {
+	c.mu.Lock()
+	c.direct = direct
+	c.writeDirect = true
+	c.readDirect = true
+	c.peerSwitched = true
+	c.mu.Unlock()
+
+	go c.readDirectLoop(direct)
+}
+
+// switchWrites tells the peer over the relay that nothing more will come that way, then sends everything after it on the direct path
+func (c *relayConn) switchWrites() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	ready := c.direct != nil && !c.writeDirect
+	c.mu.Unlock()
+	if !ready {
+		return nil
+	}
+
+	// After everything already queued for the relay
+	if err := c.sendControl(signalMessage{
+		Type:      signalPathSwitch,
+		SessionID: c.sessionID,
+	}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.writeDirect = true
+	c.mu.Unlock()
+
+	return nil
+}
+
+// peerSwitch handles the peer's switch message. Everything it sent on the relay has been queued by now, so reading the direct path can start
+func (c *relayConn) peerSwitch() error {
+	c.mu.Lock()
+	direct := c.direct
+	start := direct != nil && !c.peerSwitched
+	c.peerSwitched = true
+	c.readDirect = start || c.readDirect
+	c.mu.Unlock()
+
+	if direct == nil {
+		return errors.New("peer switched to a direct path that was never set up")
+	}
+
+	if !start {
+		return nil
+	}
+
+	go c.readDirectLoop(direct)
+
+	// The side that accepted the direct path moves its writes once the dialer has
+	return c.switchWrites()
+}
+
+func (c *relayConn) readDirectLoop(direct net.Conn) {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := direct.Read(buf)
+		if n > 0 && !c.pushBuffered(buf[:n]) {
+			return
+		}
+		if err != nil {
+			c.markRemoteClosed()
+			return
+		}
+	}
+}
+
+// pushIncoming queues data that came over the relay. It never waits for the reader when the session is flow controlled
+func (c *relayConn) pushIncoming(payload []byte) bool {
+	c.mu.Lock()
+	if !c.flowControl {
+		c.mu.Unlock()
+		return c.pushBuffered(payload)
+	}
+
+	if c.remoteClosed || len(payload) > c.recvAllowance {
+		remoteClosed := c.remoteClosed
+		c.mu.Unlock()
+
+		if !remoteClosed {
+			log.Printf("ts: session=%x: %v", c.sessionID[:4], errRelayWindowExceeded)
+			c.markRemoteClosed()
+			_ = c.Close()
+		}
 		return false
 	}
+
+	c.recvAllowance -= len(payload)
+	c.readBuf.Write(payload)
+	c.mu.Unlock()
+
+	notify(c.readable)
+	return true
+}
+
+// pushBuffered queues data once the reader has less than a window of it left, for the direct path (which tcp flow controls) and peers without flow control
+func (c *relayConn) pushBuffered(payload []byte) bool {
+	for {
+		select {
+		case <-c.closed:
+			return false
+		case <-c.remoteDone:
+			return false
+		default:
+		}
+
+		c.mu.Lock()
+		if c.readBuf.Len() < relayWindow {
+			c.readBuf.Write(payload)
+			c.mu.Unlock()
+
+			notify(c.readable)
+			return true
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.drained:
+		case <-c.closed:
+			return false
+		case <-c.remoteDone:
+			return false
+		}
+	}
+}
+
+// relayClosed handles the relay going away or the peer closing through it, once reads have moved to the direct path only that path ending closes the connection
+func (c *relayConn) relayClosed() {
+	c.mu.Lock()
+	readDirect := c.readDirect
+	c.mu.Unlock()
+
+	if !readDirect {
+		c.markRemoteClosed()
+	}
 }
 
 func (c *relayConn) markRemoteClosed() {
@@ -227,7 +513,7 @@ func (c *relayConn) markRemoteClosed() {
 	if already {
 		return
 	}
-	close(c.incoming)
+	close(c.remoteDone)
 }
 
 func deadlineExceeded(t time.Time) bool {
@@ -0,0 +1,157 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// Relay sessions are flow controlled when both sides support it, so a fast writer cannot queue more than the reader will take.
+// Each side gives the other a window of bytes in its dial init or ack, and grants it more with signalWindow as its application reads.
+// The DERP receive loop never waits for a reader, a peer that sends past its window is cut off.
+// Sessions with peers that do not send a window in the handshake are not flow controlled, as before.
+
+const (
+	// Bytes each side may have in flight on the relay
+	relayWindow = 1 << 20
+
+	// Largest data payload, DERP packets are at most 64KiB
+	relayChunkSize = 65000
+
+	// Most credit a peer can build up
+	maxRelayCredit = 1 << 30
+)
+
+var errRelayWindowExceeded = errors.New("peer sent more than its relay window")
+
+func encodeRelayWindow(window int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(window))
+}
+
+// parseRelayWindow reads a window from a dial init or ack, peers without flow control send none
+func parseRelayWindow(payload []byte) (int, bool) {
+	if len(payload) != 4 {
+		return 0, false
+	}
+
+	window := int(binary.BigEndian.Uint32(payload))
+	if window <= 0 || window > maxRelayCredit {
+		return 0, false
+	}
+	return window, true
+}
+
+// enableFlowControl is called before any data is sent or received on the session, with the window the peer gave
+func (c *relayConn) enableFlowControl(peerWindow int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A repeated ack must not reset the credit already used
+	if c.flowControl {
+		return
+	}
+
+	c.flowControl = true
+	c.sendCredit = peerWindow
+	c.recvAllowance = relayWindow
+}
+
+// grantCredit handles the peer's signalWindow, it has read n more bytes
+func (c *relayConn) grantCredit(payload []byte) {
+	if len(payload) != 4 {
+		return
+	}
+	n := int(binary.BigEndian.Uint32(payload))
+
+	c.mu.Lock()
+	c.sendCredit = min(c.sendCredit+n, maxRelayCredit)
+	c.mu.Unlock()
+
+	notify(c.creditChanged)
+}
+
+// takeCredit waits until some of want bytes can be sent or the write deadline, and returns how many
+func (c *relayConn) takeCredit(want int) (int, error) {
+	for {
+		c.mu.Lock()
+		if !c.flowControl {
+			c.mu.Unlock()
+			return want, nil
+		}
+		if c.sendCredit > 0 {
+			n := min(want, c.sendCredit)
+			c.sendCredit -= n
+			c.mu.Unlock()
+			return n, nil
+		}
+		c.mu.Unlock()
+
+		timer, stop, expired := c.writeTimer()
+		if expired {
+			return 0, timeoutErr("write timeout")
+		}
+
+		var err error
+		select {
+		case <-c.creditChanged:
+		case <-c.writeDeadlineChanged:
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-c.remoteDone:
+			err = io.EOF
+		case <-timer:
+			err = timeoutErr("write timeout")
+		}
+		stop()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// refundCredit gives back credit taken for a chunk that was never queued
+func (c *relayConn) refundCredit(n int) {
+	c.mu.Lock()
+	if c.flowControl {
+		c.sendCredit = min(c.sendCredit+n, maxRelayCredit)
+	}
+	c.mu.Unlock()
+
+	notify(c.creditChanged)
+}
+
+// consumed records n bytes read by the application, and gives the peer more window once half of it has been read
+func (c *relayConn) consumed(n int) {
+	c.mu.Lock()
+	if !c.flowControl || (c.writeDirect && c.readDirect) {
+		c.mu.Unlock()
+		return
+	}
+
+	c.unacked += n
+	if c.unacked < relayWindow/2 {
+		c.mu.Unlock()
+		return
+	}
+
+	grant := c.unacked
+	c.unacked = 0
+	c.recvAllowance += grant
+	c.mu.Unlock()
+
+	_ = c.sendSignal(signalMessage{
+		Type:      signalWindow,
+		SessionID: c.sessionID,
+		Payload:   binary.BigEndian.AppendUint32(nil, uint32(grant)),
+	})
+}
+
+// notify wakes a waiter on ch without blocking, ch has a buffer of 1
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,92 @@
+package nat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelayFlowControl(t *testing.T) {
+	derpServer, node := newFakeDERPServer(t)
+	defer derpServer.Close()
+
+	mapServer := newMapServerForNode(node)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:     mustPickTestAddr(t),
+		HostPrivateKey: []byte("test-key-flow"),
+		DisableDirect:  true,
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := service.Listener().Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, DestinationPrefix+service.Token())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+
+	payload := make([]byte, 4*relayWindow)
+	rand.Read(payload)
+
+	var written atomic.Int64
+	writeDone := make(chan error, 1)
+	go func() {
+		for off := 0; off < len(payload); off += 64 * 1024 {
+			chunk := payload[off:min(off+64*1024, len(payload))]
+			if _, err := conn.Write(chunk); err != nil {
+				writeDone <- err
+				return
+			}
+			written.Add(int64(len(chunk)))
+		}
+		writeDone <- nil
+	}()
+
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not accept the relay session")
+	}
+	defer server.Close()
+
+	// Nothing is read yet, so the writer should stop at about the server's window
+	time.Sleep(500 * time.Millisecond)
+	if n := written.Load(); n > relayWindow+64*1024 {
+		t.Fatalf("%d bytes were written before the server read anything, the window is %d", n, relayWindow)
+	}
+
+	got := make([]byte, len(payload))
+	server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("data read from the relay does not match what was written")
+	}
+
+	if err := <-writeDone; err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+}
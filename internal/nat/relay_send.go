@@ -0,0 +1,172 @@
+package nat
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Relay writes go through a bounded per session queue, sent in order by a writer goroutine, so a DERP connection that is slow to take a packet
+// holds up the writer goroutine and not the application. Write waits for credit and queue space until its deadline, and a full queue is the
+// backpressure the application sees: writes block, or time out when a deadline is set. The session's control messages (path switch, close) go
+// through the same queue so they stay in order with the data.
+
+const (
+	// Messages queued before writes wait, at most this many chunks are buffered per session
+	relaySendQueue = 16
+
+	// How long Close waits for queued data to go before telling the peer
+	relayCloseFlush = 2 * time.Second
+)
+
+type relaySend struct {
+	message signalMessage
+	// Set for control messages whose sender waits on the result
+	result chan error
+}
+
+// sendLoop sends what is queued until Close has finished with the queue. A send error is kept and returned by later writes
+func (c *relayConn) sendLoop() {
+	for {
+		select {
+		case item := <-c.sendQueue:
+			err := c.sendSignal(item.message)
+
+			c.mu.Lock()
+			c.queuedBytes -= len(item.message.Payload)
+			if err != nil && c.sendErr == nil && item.result == nil {
+				c.sendErr = err
+			}
+			c.mu.Unlock()
+
+			if item.result != nil {
+				item.result <- err
+			}
+		case <-c.senderDone:
+			return
+		}
+	}
+}
+
+// writeTimer fires at the write deadline as it is now, expired is true when it has already passed
+func (c *relayConn) writeTimer() (timer <-chan time.Time, stop func(), expired bool) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	if deadline.IsZero() {
+		return nil, func() {}, false
+	}
+
+	until := time.Until(deadline)
+	if until <= 0 {
+		return nil, func() {}, true
+	}
+
+	t := time.NewTimer(until)
+	return t.C, func() { t.Stop() }, false
+}
+
+// enqueue waits for space in the send queue until the write deadline, which can be moved while it waits
+func (c *relayConn) enqueue(item relaySend) error {
+	for {
+		timer, stop, expired := c.writeTimer()
+		if expired {
+			return timeoutErr("write timeout")
+		}
+
+		c.mu.Lock()
+		c.queuedBytes += len(item.message.Payload)
+		c.mu.Unlock()
+
+		select {
+		case c.sendQueue <- item:
+			stop()
+			return nil
+		default:
+		}
+
+		var err error
+		select {
+		case c.sendQueue <- item:
+		case <-c.writeDeadlineChanged:
+			err = errDeadlineMoved
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-c.remoteDone:
+			err = io.EOF
+		case <-timer:
+			err = timeoutErr("write timeout")
+		}
+		stop()
+
+		if err == nil {
+			return nil
+		}
+
+		c.mu.Lock()
+		c.queuedBytes -= len(item.message.Payload)
+		c.mu.Unlock()
+
+		if err != errDeadlineMoved {
+			return err
+		}
+	}
+}
+
+var errDeadlineMoved = errors.New("write deadline moved")
+
+// sendControl sends a message in order with the data queued before it and waits for it to go
+func (c *relayConn) sendControl(message signalMessage) error {
+	result := make(chan error, 1)
+
+	select {
+	case c.sendQueue <- relaySend{message: message, result: result}:
+	case <-c.closed:
+		return net.ErrClosed
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// sendBacklog is what is queued and not yet sent, and whether writes are waiting on the queue
+func (c *relayConn) sendBacklog() (queued int, full bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.queuedBytes, len(c.sendQueue) == cap(c.sendQueue)
+}
+
+// flushAndClose sends what was written before Close, then the close message, giving up on the queue after relayCloseFlush
+func (c *relayConn) flushAndClose() error {
+	defer close(c.senderDone)
+
+	message := signalMessage{
+		Type:      signalClose,
+		SessionID: c.sessionID,
+	}
+	result := make(chan error, 1)
+
+	timer := time.NewTimer(relayCloseFlush)
+	defer timer.Stop()
+
+	select {
+	case c.sendQueue <- relaySend{message: message, result: result}:
+	case <-timer.C:
+		return c.sendSignal(message)
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		// The writer is stuck, the close is sent past it
+		return c.sendSignal(message)
+	}
+}
@@ -0,0 +1,85 @@
+package nat
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayWriteDeadline(t *testing.T) {
+	// A DERP connection that never takes a packet
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	conn := newRelayConn([16]byte{1}, "relay", [32]byte{}, func(signalMessage) error {
+		<-stuck
+		return nil
+	}, nil)
+
+	conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+
+	start := time.Now()
+	n, err := conn.Write(make([]byte, (relaySendQueue+4)*relayChunkSize))
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("write returned %s after its deadline", elapsed)
+	}
+
+	if n == 0 || n%relayChunkSize != 0 {
+		t.Fatalf("expected the queued chunks to be reported written, got %d", n)
+	}
+
+	if queued, full := conn.sendBacklog(); !full || queued == 0 {
+		t.Fatalf("expected a full send queue, got %d bytes full=%v", queued, full)
+	}
+
+	// Moving the deadline wakes a write that is already waiting
+	conn.SetWriteDeadline(time.Time{})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, relayChunkSize))
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	conn.SetWriteDeadline(time.Now())
+
+	select {
+	case err := <-done:
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write did not notice the deadline moving")
+	}
+}
+
+func TestRelayCloseFlushes(t *testing.T) {
+	sent := make(chan signalMessage, relaySendQueue+2)
+
+	conn := newRelayConn([16]byte{2}, "relay", [32]byte{}, func(m signalMessage) error {
+		sent <- m
+		return nil
+	}, nil)
+
+	if _, err := conn.Write([]byte("last words")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	first := <-sent
+	if first.Type != signalData || string(first.Payload) != "last words" {
+		t.Fatalf("expected the data to be sent first, got %+v", first)
+	}
+
+	if second := <-sent; second.Type != signalClose {
+		t.Fatalf("expected the close after the data, got %+v", second)
+	}
+}
@@ -0,0 +1,61 @@
+package nat
+
+import "sync"
+
+// Counters this far behind the newest one seen are rejected outright, as in WireGuard
+const replayWindowSize = 2048
+
+// replayWindow remembers which signal counters have been received from a peer, so captured relay frames cant be sent again
+type replayWindow struct {
+	mu sync.Mutex
+
+	newest uint64
+	seen   [replayWindowSize / 64]uint64
+}
+
+// accept reports whether counter hasnt been received before, and records it. Only call it for authenticated messages
+func (w *replayWindow) accept(counter uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Senders start at 1
+	if counter == 0 {
+		return false
+	}
+
+	if counter > w.newest {
+		if counter-w.newest >= replayWindowSize {
+			w.seen = [replayWindowSize / 64]uint64{}
+		} else {
+			for c := w.newest + 1; c < counter; c++ {
+				w.clear(c)
+			}
+		}
+
+		w.newest = counter
+		w.set(counter)
+		return true
+	}
+
+	if w.newest-counter >= replayWindowSize || w.isSet(counter) {
+		return false
+	}
+
+	w.set(counter)
+	return true
+}
+
+func (w *replayWindow) set(counter uint64) {
+	i := counter % replayWindowSize
+	w.seen[i/64] |= 1 << (i % 64)
+}
+
+func (w *replayWindow) clear(counter uint64) {
+	i := counter % replayWindowSize
+	w.seen[i/64] &^= 1 << (i % 64)
+}
+
+func (w *replayWindow) isSet(counter uint64) bool {
+	i := counter % replayWindowSize
+	return w.seen[i/64]&(1<<(i%64)) != 0
+}
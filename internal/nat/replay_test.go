@@ -0,0 +1,65 @@
+package nat
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+
+	steps := []struct {
+		counter uint64
+		want    bool
+	}{
+		{0, false},
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{2, false},
+		{3, false},
+		{3 + replayWindowSize, true},
+		{3, false},
+		{4, true},
+		{4, false},
+		{10 * replayWindowSize, true},
+		{5, false},
+		{10*replayWindowSize - 1, true},
+	}
+
+	for i, step := range steps {
+		if got := w.accept(step.counter); got != step.want {
+			t.Fatalf("step %d: accept(%d) = %v, want %v", i, step.counter, got, step.want)
+		}
+	}
+}
+
+func TestSignalReplayRejected(t *testing.T) {
+	clientPrivate, clientPublic, err := DeriveDERPIdentity([]byte("replay client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverPrivate, serverPublic, err := DeriveDERPIdentity([]byte("replay server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := newSignalCipher(clientPrivate, serverPublic)
+	receiver := newSignalCipher(serverPrivate, clientPublic)
+
+	first := sender.encode(signalMessage{Type: signalData, Payload: []byte("one")})
+	second := sender.encode(signalMessage{Type: signalData, Payload: []byte("two")})
+
+	// Out of order is fine, the relay doesnt promise ordering
+	for _, raw := range [][]byte{second, first} {
+		if _, err := receiver.decode(raw); err != nil {
+			t.Fatalf("decode() error = %v", err)
+		}
+	}
+
+	if _, err := receiver.decode(first); !errors.Is(err, errSignalReplay) {
+		t.Fatalf("replayed message decode() error = %v, want %v", err, errSignalReplay)
+	}
+}
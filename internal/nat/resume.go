@@ -0,0 +1,85 @@
+package nat
+
+import (
+	"sync"
+	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+)
+
+// A client that reconnects soon after a working relay session resumes it in a single round trip.
+//
+// The region and node that worked, the window the server gave and the STUN servers are kept for each server. Within the grace window the
+// client goes straight to that node, without fetching the DERP map or ranking regions, and the DERP TLS handshake resumes from a cached
+// session ticket. It then sends its dial init and starts sending data at once, with the remembered window, instead of waiting for the ack.
+// If the ack does not come the session is closed and forgotten, and the next dial goes the long way.
+
+// How long after a relay session was last used it can be resumed
+const relayResumeGrace = 2 * time.Minute
+
+type relayRoute struct {
+	regionID    int
+	node        vderp.Node
+	stunServers []string
+
+	// Window the server gave in its ack, 0 if it has no flow control
+	window int
+
+	used time.Time
+}
+
+var (
+	relayRoutesMu sync.Mutex
+	relayRoutes   = map[[32]byte]relayRoute{}
+)
+
+func rememberRelay(server [32]byte, route relayRoute) {
+	route.used = time.Now()
+
+	relayRoutesMu.Lock()
+	defer relayRoutesMu.Unlock()
+
+	relayRoutes[server] = route
+}
+
+// touchRelay restarts the grace window of the route to server, when a session on it ends
+func touchRelay(server [32]byte) {
+	relayRoutesMu.Lock()
+	defer relayRoutesMu.Unlock()
+
+	if route, ok := relayRoutes[server]; ok {
+		route.used = time.Now()
+		relayRoutes[server] = route
+	}
+}
+
+// moveRelay records that the session to server moved to another region, so a resume goes there
+func moveRelay(server [32]byte, regionID int, node vderp.Node) {
+	relayRoutesMu.Lock()
+	defer relayRoutesMu.Unlock()
+
+	if route, ok := relayRoutes[server]; ok {
+		route.regionID, route.node = regionID, node
+		relayRoutes[server] = route
+	}
+}
+
+func forgetRelay(server [32]byte) {
+	relayRoutesMu.Lock()
+	defer relayRoutesMu.Unlock()
+
+	delete(relayRoutes, server)
+}
+
+// resumableRelay is the route to server if it was used within the grace window
+func resumableRelay(server [32]byte) (relayRoute, bool) {
+	relayRoutesMu.Lock()
+	defer relayRoutesMu.Unlock()
+
+	route, ok := relayRoutes[server]
+	if !ok || time.Since(route.used) > relayResumeGrace {
+		delete(relayRoutes, server)
+		return relayRoute{}, false
+	}
+	return route, true
+}
@@ -0,0 +1,110 @@
+package nat
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func echoOnce(t *testing.T, conn net.Conn, payload string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if string(buf) != payload {
+		t.Fatalf("echo mismatch: got %q, want %q", buf, payload)
+	}
+}
+
+func TestDialResumesRecentRelay(t *testing.T) {
+	derpServer, node := newFakeDERPServer(t)
+	defer derpServer.Close()
+
+	mapServer := newMapServerForNode(node)
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:     mustPickTestAddr(t),
+		HostPrivateKey: []byte("test-key-resume"),
+		DisableDirect:  true,
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	go func() {
+		for {
+			conn, err := service.Listener().Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	destination := DestinationPrefix + service.Token()
+	token, err := ParseDestination(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forgetRelay(token.ServerDERPPublicKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, destination)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	echoOnce(t, conn, "first")
+	conn.Close()
+
+	if _, ok := resumableRelay(token.ServerDERPPublicKey); !ok {
+		t.Fatalf("expected the relay to be remembered after a working session")
+	}
+
+	// Without the map a full dial cannot work, a resumed one does not need it
+	mapServer.Close()
+	cachedDERPMapsMu.Lock()
+	delete(cachedDERPMaps, mapServer.URL)
+	cachedDERPMapsMu.Unlock()
+
+	conn, err = DialContext(ctx, destination)
+	if err != nil {
+		t.Fatalf("resuming DialContext() error = %v", err)
+	}
+	echoOnce(t, conn, "resumed")
+	conn.Close()
+
+	// A remembered node that has gone away is given up on for the full dial
+	mapServer = newMapServerForNode(node)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	route, _ := resumableRelay(token.ServerDERPPublicKey)
+	route.node.HostName = "127.0.0.1"
+	route.node.DERPPort = 1
+	rememberRelay(token.ServerDERPPublicKey, route)
+
+	conn, err = DialContext(ctx, destination)
+	if err != nil {
+		t.Fatalf("DialContext() after a failed resume error = %v", err)
+	}
+	defer conn.Close()
+	echoOnce(t, conn, "full dial")
+
+	if route, ok := resumableRelay(token.ServerDERPPublicKey); !ok || route.node.DERPPort != node.DERPPort {
+		t.Fatalf("expected the working node to be remembered again, got %+v", route)
+	}
+}
@@ -6,18 +6,29 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/NHAS/reverse_ssh/internal/chaos"
 	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+	"github.com/NHAS/reverse_ssh/internal/secure"
 )
 
 const (
 	maxPendingRelaySessions = 256
-	pendingRelaySessionTTL  = 30 * time.Second
-	relaySessionSweepPeriod = 10 * time.Second
+
+	// DefaultPendingSessionTTL is how long a relay session may wait for its first data, when ServiceConfig.PendingSessionTTL is 0
+	DefaultPendingSessionTTL = 30 * time.Second
+
+	// Longest time between looking for pending and idle sessions to drop
+	maxRelaySessionSweepPeriod = 10 * time.Second
+
+	derpConnectTimeout = 10 * time.Second
+	derpRetryPeriod    = 2 * time.Second
 )
 
 type ServiceConfig struct {
@@ -26,6 +37,46 @@ type ServiceConfig struct {
 	HostPrivateKey []byte
 
 	DERPMapURL string
+
+	// Keeps every session on the relay rather than offering clients a direct path
+	DisableDirect bool
+
+	// Use the server's own relay rather than the DERP map, its address and key go in the token
+	PrivateRelay *PrivateRelay
+
+	// host:port of STUN servers to find public addresses with, instead of the DERP map's. They go in the token for clients to use too
+	STUNServers []string
+
+	// How many of the nearest DERP regions to stay connected to, DefaultDERPHomeRegions when 0. Ignored with a private relay
+	DERPHomeRegions int
+
+	// Bytes a second of relayed data each peer may send before it is banned, DefaultPeerDataRate when 0
+	PeerDataRate int
+
+	// Codec relay data is compressed with when the client has it, snappy or zstd. Empty or none leaves it uncompressed
+	RelayCompression string
+
+	// How long a relay session may wait for its first data before it is dropped, DefaultPendingSessionTTL when 0
+	PendingSessionTTL time.Duration
+
+	// Relayed sessions the client has sent nothing on for this long are closed, 0 leaves them open. Sessions on a direct path are left to tcp
+	IdleTimeout time.Duration
+
+	// How often an empty message is sent on each relayed session, so NATs and relays on the way keep it open. 0 sends none
+	Keepalive time.Duration
+
+	// File DERP latency measurements are kept in so they outlive restarts, empty keeps them in memory only
+	LatencyCacheFile string
+}
+
+// PrivateRelay is a relay run by the rssh server itself, see DERPServer
+type PrivateRelay struct {
+	// host:port clients reach the relay on
+	Address string
+	Key     [32]byte
+
+	// Where the server reaches its own relay, if not Address
+	LocalAddress string
 }
 
 type relaySessionKey struct {
@@ -42,13 +93,22 @@ type relaySession struct {
 type Service struct {
 	token string
 
+	// What token was encoded from, IssueToken adds to it
+	baseToken Token
+
 	listener *connListener
+	direct   *directListener
+
+	// For transports to listen with
+	listenHost  string
+	stunServers []string
 
-	derpNode    vderp.Node
 	derpPrivate [32]byte
+	derpHomes   []*derpHome
 
-	derpMu     sync.RWMutex
-	derpClient *derpClient
+	// The home each peer was last heard on
+	peerHomeMu sync.Mutex
+	peerHomes  map[[32]byte]*derpHome
 
 	sessionMu sync.Mutex
 	sessions  map[relaySessionKey]*relaySession
@@ -56,22 +116,85 @@ type Service struct {
 	signalCipherMu sync.RWMutex
 	signalCiphers  map[[32]byte]*signalCipher
 
-	closed    chan struct{}
+	peerLimits *peerLimits
+
+	relayCodec relayCodec
+
+	pendingTTL  time.Duration
+	idleTimeout time.Duration
+	keepalive   time.Duration
+
+	// For nat status
+	started           time.Time
+	bytesIn, bytesOut atomic.Uint64
+
+	// Cancelled by Close, or when the context the service was started with is done
+	ctx       context.Context
+	cancel    context.CancelFunc
 	closeOnce sync.Once
 }
 
-func Start(config ServiceConfig) (*Service, error) {
+// Start connects to the nearest DERP relays and accepts relayed connections until ctx is done or Close is called
+func Start(ctx context.Context, config ServiceConfig) (*Service, error) {
 	if len(config.HostPrivateKey) == 0 {
 		return nil, fmt.Errorf("host private key bytes cannot be empty")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	codec, err := parseRelayCodec(config.RelayCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.PendingSessionTTL < 0 || config.IdleTimeout < 0 || config.Keepalive < 0 {
+		return nil, fmt.Errorf("relay session timeouts and keepalive cannot be negative")
+	}
+
+	pendingTTL := config.PendingSessionTTL
+	if pendingTTL == 0 {
+		pendingTTL = DefaultPendingSessionTTL
+	}
+
+	if config.LatencyCacheFile != "" {
+		if err := useDERPLatencyFile(config.LatencyCacheFile); err != nil {
+			log.Printf("ts: unable to load derp latencies, measuring again: %v", err)
+		}
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, derpConnectTimeout)
 	defer cancel()
 
-	derpMap, err := FetchDERPMap(ctx, config.DERPMapURL)
-	if err != nil {
-		log.Printf("ts: derp map fetch failed: %v", err)
-		return nil, fmt.Errorf("ts derp map fetch failed: %w", err)
+	token := Token{
+		Version: TokenVersionV1,
+	}
+
+	if len(config.STUNServers) > 0 {
+		token.Version = TokenVersionV3
+		token.STUNServers = config.STUNServers
+	}
+
+	var derpMap *vderp.Map
+	if relay := config.PrivateRelay; relay != nil {
+		if token.Version == TokenVersionV1 {
+			token.Version = TokenVersionV2
+		}
+		token.Relay = relay.Address
+		token.RelayKey = relay.Key
+
+		address := relay.Address
+		if relay.LocalAddress != "" {
+			address = relay.LocalAddress
+		}
+
+		derpMap, err = PrivateRelayMap(address, relay.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private relay address: %w", err)
+		}
+	} else {
+		derpMap, err = FetchDERPMap(startCtx, config.DERPMapURL)
+		if err != nil {
+			log.Printf("ts: derp map fetch failed: %v", err)
+			return nil, fmt.Errorf("ts derp map fetch failed: %w", err)
+		}
 	}
 
 	derpPrivate, derpPublic, err := DeriveDERPIdentity(config.HostPrivateKey)
@@ -81,20 +204,41 @@ func Start(config ServiceConfig) (*Service, error) {
 
 	listenHost, listenPort, err := splitHostPort(config.ListenAddr)
 	if err != nil {
+		secure.Zero(derpPrivate[:])
 		return nil, fmt.Errorf("invalid ts listen address: %w", err)
 	}
 
-	_, derpNode, err := pickNearestDERPNode(derpMap)
+	homeRegions := config.DERPHomeRegions
+	if homeRegions <= 0 {
+		homeRegions = DefaultDERPHomeRegions
+	}
+	homeRegions = min(homeRegions, MaxDERPHomeRegions)
+
+	homes, err := connectDERPHomes(startCtx, derpMap, homeRegions, derpPrivate)
 	if err != nil {
+		secure.Zero(derpPrivate[:])
 		return nil, err
 	}
 
-	token := Token{
-		Version:             TokenVersionV1,
-		ServerDERPPublicKey: derpPublic,
+	closeHomes := func() {
+		for _, home := range homes {
+			_ = home.close()
+		}
+	}
+
+	token.ServerDERPPublicKey = derpPublic
+	if config.PrivateRelay == nil {
+		// Clients can only reach the server on a region it is connected to
+		token.Version = TokenVersionV4
+		for _, home := range homes {
+			token.Regions = append(token.Regions, home.regionID)
+		}
 	}
+
 	encodedToken, err := token.Encode()
 	if err != nil {
+		closeHomes()
+		secure.Zero(derpPrivate[:])
 		return nil, err
 	}
 
@@ -104,44 +248,48 @@ func Start(config ServiceConfig) (*Service, error) {
 	}
 	service := &Service{
 		token:         encodedToken,
+		baseToken:     token,
 		listener:      newConnListener(&net.TCPAddr{IP: listenerIP, Port: listenPort}),
-		derpNode:      derpNode,
 		derpPrivate:   derpPrivate,
+		derpHomes:     homes,
+		peerHomes:     make(map[[32]byte]*derpHome),
 		sessions:      make(map[relaySessionKey]*relaySession),
 		signalCiphers: make(map[[32]byte]*signalCipher),
-		closed:        make(chan struct{}),
+		peerLimits:    newPeerLimits(config.PeerDataRate),
+		relayCodec:    codec,
+		pendingTTL:    pendingTTL,
+		idleTimeout:   config.IdleTimeout,
+		keepalive:     config.Keepalive,
+		started:       time.Now(),
 	}
+	service.ctx, service.cancel = context.WithCancel(ctx)
 
-	if err := service.connectDERP(); err != nil {
-		service.Close()
-		return nil, err
+	service.listenHost = listenHost
+	service.stunServers = config.STUNServers
+	if len(service.stunServers) == 0 {
+		service.stunServers = stunServersFromMap(derpMap)
 	}
 
-	go service.recvDERPLoop()
-	go service.cleanupPendingRelaySessionsLoop()
-
-	return service, nil
-}
+	// Before anything is received, offering a direct path needs to know whether there is one
+	service.listenTransports(config.DisableDirect)
 
-func (s *Service) connectDERP() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	context.AfterFunc(service.ctx, func() {
+		service.Close()
+	})
 
-	client, err := newDERPClient(ctx, s.derpNode, s.derpPrivate)
-	if err != nil {
-		return err
+	for _, home := range homes {
+		go service.recvDERPLoop(home)
 	}
-
-	s.derpMu.Lock()
-	old := s.derpClient
-	s.derpClient = client
-	s.derpMu.Unlock()
-
-	if old != nil {
-		_ = old.Close()
+	go service.cleanupRelaySessionsLoop()
+	if config.PrivateRelay == nil {
+		go service.rerankLoop(config.DERPMapURL)
+	}
+	if service.keepalive > 0 {
+		go service.keepaliveLoop()
 	}
+	setRunning(service)
 
-	return nil
+	return service, nil
 }
 
 func (s *Service) Listener() net.Listener {
@@ -152,10 +300,28 @@ func (s *Service) Token() string {
 	return s.token
 }
 
+// IssueToken makes a version 5 token with the server's current direct path candidates, which expires at expires unless it is zero.
+// Candidates use the direct listener's port, which changes when the server restarts, so they suit tokens that expire
+func (s *Service) IssueToken(expires time.Time) (string, error) {
+	token := s.baseToken
+	token.Version = TokenVersionV5
+	token.Expires = expires
+	if !expires.IsZero() {
+		token.Expires = time.Unix(expires.Unix(), 0)
+	}
+
+	if s.direct != nil {
+		token.Candidates = s.direct.tokenCandidates()
+	}
+
+	return token.Encode()
+}
+
 func (s *Service) Close() error {
 	var retErr error
 	s.closeOnce.Do(func() {
-		close(s.closed)
+		s.cancel()
+		clearRunning(s)
 
 		if s.listener != nil {
 			if err := s.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
@@ -163,16 +329,20 @@ func (s *Service) Close() error {
 			}
 		}
 
-		s.derpMu.Lock()
-		dc := s.derpClient
-		s.derpClient = nil
-		s.derpMu.Unlock()
-		if dc != nil {
-			if err := dc.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		if s.direct != nil {
+			s.direct.listener.Close()
+		}
+
+		for _, home := range s.derpHomes {
+			if err := home.close(); err != nil && !errors.Is(err, net.ErrClosed) {
 				retErr = errors.Join(retErr, err)
 			}
 		}
 
+		s.peerHomeMu.Lock()
+		s.peerHomes = make(map[[32]byte]*derpHome)
+		s.peerHomeMu.Unlock()
+
 		s.sessionMu.Lock()
 		all := make([]*relayConn, 0, len(s.sessions))
 		for _, session := range s.sessions {
@@ -193,75 +363,6 @@ func (s *Service) Close() error {
 	return retErr
 }
 
-func (s *Service) recvDERPLoop() {
-	for {
-		select {
-		case <-s.closed:
-			return
-		default:
-		}
-
-		s.derpMu.RLock()
-		client := s.derpClient
-		s.derpMu.RUnlock()
-		if client == nil {
-			if !s.retryDERPConnect() {
-				return
-			}
-			continue
-		}
-
-		packet, err := client.Recv()
-		if err != nil {
-			select {
-			case <-s.closed:
-				return
-			default:
-			}
-			log.Printf("ts: derp receive failed: %v", err)
-
-			s.derpMu.Lock()
-			if s.derpClient == client {
-				s.derpClient = nil
-			}
-			s.derpMu.Unlock()
-			_ = client.Close()
-			continue
-		}
-
-		message, err := s.signalCipherForPeer(packet.Source).decode(packet.Payload)
-		if err != nil {
-			continue
-		}
-
-		switch message.Type {
-		case signalDialInit:
-			s.handleDialInit(packet.Source, message)
-		case signalData:
-			s.routeRelayData(packet.Source, message.SessionID, message.Payload)
-		case signalClose:
-			s.routeRelayClose(packet.Source, message.SessionID)
-		}
-	}
-}
-
-func (s *Service) retryDERPConnect() bool {
-	for {
-		select {
-		case <-s.closed:
-			return false
-		default:
-		}
-
-		if err := s.connectDERP(); err != nil {
-			log.Printf("ts: derp reconnect failed: %v", err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
-		return true
-	}
-}
-
 func (s *Service) handleDialInit(source [32]byte, message signalMessage) {
 	sessionKey := relaySessionKey{
 		Peer:      source,
@@ -275,6 +376,12 @@ func (s *Service) handleDialInit(source [32]byte, message signalMessage) {
 	s.sessionMu.Lock()
 	session := s.sessions[sessionKey]
 	if session == nil {
+		if s.pendingRelaySessionsForPeerLocked(source) >= maxPendingRelaySessionsPerPeer {
+			s.sessionMu.Unlock()
+			s.banPeer(source, "too many pending relay sessions")
+			return
+		}
+
 		if s.pendingRelaySessionsLocked() >= maxPendingRelaySessions {
 			s.sessionMu.Unlock()
 			log.Printf("ts: dropping session=%x, pending relay session limit reached", message.SessionID[:4])
@@ -290,6 +397,9 @@ func (s *Service) handleDialInit(source [32]byte, message signalMessage) {
 			delete(s.sessions, sessionKey)
 			s.sessionMu.Unlock()
 		})
+		if window, ok := parseRelayWindow(message.Payload); ok {
+			relay.enableFlowControl(window)
+		}
 		s.sessions[sessionKey] = &relaySession{
 			conn:         relay,
 			lastActivity: time.Now(),
@@ -299,9 +409,11 @@ func (s *Service) handleDialInit(source [32]byte, message signalMessage) {
 	}
 	s.sessionMu.Unlock()
 
+	// Clients without flow control ignore the window
 	_ = s.sendDERPSignal(source, signalMessage{
 		Type:      signalDialAck,
 		SessionID: message.SessionID,
+		Payload:   encodeRelayWindow(relayWindow),
 	})
 }
 
@@ -333,10 +445,91 @@ func (s *Service) routeRelayData(source [32]byte, sessionID [16]byte, payload []
 			_ = conn.Close()
 			return
 		}
+		s.offerDirect(source, conn)
 	}
 	conn.pushIncoming(payload)
 }
 
+// routeCompression answers a client's codec offer with the codec the server will compress with, none if it has none of them
+func (s *Service) routeCompression(source [32]byte, sessionID [16]byte, offer []byte) {
+	s.sessionMu.Lock()
+	session := s.sessions[relaySessionKey{Peer: source, SessionID: sessionID}]
+	s.sessionMu.Unlock()
+	if session == nil {
+		return
+	}
+
+	codec := chooseRelayCodec(s.relayCodec, offer)
+	session.conn.setSendCodec(codec)
+
+	_ = s.sendDERPSignal(source, signalMessage{
+		Type:      signalCompression,
+		SessionID: sessionID,
+		Payload:   []byte{byte(codec)},
+	})
+}
+
+func (s *Service) routeWindow(source [32]byte, sessionID [16]byte, payload []byte) {
+	s.sessionMu.Lock()
+	session := s.sessions[relaySessionKey{Peer: source, SessionID: sessionID}]
+	s.sessionMu.Unlock()
+	if session == nil {
+		return
+	}
+
+	session.conn.grantCredit(payload)
+}
+
+func (s *Service) routePathSwitch(source [32]byte, sessionID [16]byte) {
+	s.sessionMu.Lock()
+	session := s.sessions[relaySessionKey{Peer: source, SessionID: sessionID}]
+	s.sessionMu.Unlock()
+	if session == nil || !session.accepted {
+		return
+	}
+
+	if err := session.conn.peerSwitch(); err != nil {
+		log.Printf("ts: session=%x: %v", sessionID[:4], err)
+		return
+	}
+	log.Printf("ts: session=%x now on a direct path", sessionID[:4])
+}
+
+// routePeerPublic records the public addresses a client found with STUN, the relay hides where it really connects from
+func (s *Service) routePeerPublic(source [32]byte, sessionID [16]byte, payload []byte) {
+	s.sessionMu.Lock()
+	session := s.sessions[relaySessionKey{Peer: source, SessionID: sessionID}]
+	s.sessionMu.Unlock()
+	if session == nil || !session.accepted {
+		return
+	}
+
+	var addrs []string
+	for _, raw := range strings.Split(string(payload), "\n") {
+		if addr, err := netip.ParseAddr(raw); err == nil && len(addrs) < maxDirectCandidates {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+
+	session.conn.setPeerPublic(strings.Join(addrs, ", "))
+	log.Printf("ts: session=%x client public address %s", sessionID[:4], strings.Join(addrs, ", "))
+}
+
+func (s *Service) routePeerNAT(source [32]byte, sessionID [16]byte, payload []byte) {
+	s.sessionMu.Lock()
+	session := s.sessions[relaySessionKey{Peer: source, SessionID: sessionID}]
+	s.sessionMu.Unlock()
+	if session == nil || !session.accepted || len(payload) != 1 || NATType(payload[0]) >= natTypeCount {
+		return
+	}
+
+	session.conn.setPeerNAT(NATType(payload[0]))
+	log.Printf("ts: session=%x client nat behaviour is %s", sessionID[:4], NATType(payload[0]))
+}
+
 func (s *Service) routeRelayClose(source [32]byte, sessionID [16]byte) {
 	key := relaySessionKey{Peer: source, SessionID: sessionID}
 	s.sessionMu.Lock()
@@ -354,7 +547,7 @@ func (s *Service) routeRelayClose(source [32]byte, sessionID [16]byte) {
 	if conn == nil {
 		return
 	}
-	conn.markRemoteClosed()
+	conn.relayClosed()
 	if !accepted {
 		_ = conn.Close()
 	}
@@ -370,29 +563,48 @@ func (s *Service) pendingRelaySessionsLocked() int {
 	return pending
 }
 
-func (s *Service) cleanupPendingRelaySessionsLoop() {
-	ticker := time.NewTicker(relaySessionSweepPeriod)
+// sweepPeriod is often enough that sessions are dropped within a third of their timeout of it passing
+func (s *Service) sweepPeriod() time.Duration {
+	period := min(maxRelaySessionSweepPeriod, s.pendingTTL/3)
+	if s.idleTimeout > 0 {
+		period = min(period, s.idleTimeout/3)
+	}
+	return max(period, time.Second)
+}
+
+func (s *Service) cleanupRelaySessionsLoop() {
+	ticker := time.NewTicker(s.sweepPeriod())
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-s.closed:
+		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
-			s.prunePendingRelaySessions()
+			s.pruneRelaySessions(time.Now())
+			s.peerLimits.prune(time.Now())
 		}
 	}
 }
 
-func (s *Service) prunePendingRelaySessions() {
-	cutoff := time.Now().Add(-pendingRelaySessionTTL)
+// pruneRelaySessions drops sessions that never got data within the pending ttl, and relayed sessions idle for longer than the idle timeout
+func (s *Service) pruneRelaySessions(now time.Time) {
+	pendingCutoff := now.Add(-s.pendingTTL)
+	idleCutoff := now.Add(-s.idleTimeout)
 
 	var stale []*relayConn
 	s.sessionMu.Lock()
 	for key, session := range s.sessions {
-		if session.accepted || session.lastActivity.After(cutoff) {
+		if !session.accepted {
+			if session.lastActivity.After(pendingCutoff) {
+				continue
+			}
+		} else if s.idleTimeout <= 0 || session.lastActivity.After(idleCutoff) || session.conn.Path() == "direct" {
 			continue
+		} else {
+			log.Printf("ts: session=%x idle for %s, closing", key.SessionID[:4], now.Sub(session.lastActivity).Round(time.Second))
 		}
+
 		delete(s.sessions, key)
 		stale = append(stale, session.conn)
 	}
@@ -404,16 +616,51 @@ func (s *Service) prunePendingRelaySessions() {
 	}
 }
 
+// keepaliveLoop sends an empty window grant on every relayed session, which clients of every version ignore
+func (s *Service) keepaliveLoop() {
+	ticker := time.NewTicker(s.keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.sessionMu.Lock()
+		relayed := make([]relaySessionKey, 0, len(s.sessions))
+		for key, session := range s.sessions {
+			if session.accepted && session.conn.Path() != "direct" {
+				relayed = append(relayed, key)
+			}
+		}
+		s.sessionMu.Unlock()
+
+		for _, key := range relayed {
+			_ = s.sendDERPSignal(key.Peer, signalMessage{
+				Type:      signalWindow,
+				SessionID: key.SessionID,
+				Payload:   encodeRelayWindow(0),
+			})
+		}
+	}
+}
+
 func (s *Service) sendDERPSignal(destination [32]byte, message signalMessage) error {
+	chaos.Delay(chaos.SignalDelay)
+
 	raw := s.signalCipherForPeer(destination).encode(message)
 
-	s.derpMu.RLock()
-	client := s.derpClient
-	s.derpMu.RUnlock()
+	client := s.derpClientForPeer(destination)
 	if client == nil {
 		return fmt.Errorf("derp client unavailable")
 	}
 
+	if message.Type == signalData || message.Type == signalDataCompressed {
+		s.bytesOut.Add(uint64(len(message.Payload)))
+	}
+
 	return client.Send(destination, raw)
 }
 
@@ -1,17 +1,22 @@
 package nat
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
 )
 
 func TestStartFailsWithoutHostPrivateKey(t *testing.T) {
-	_, err := Start(ServiceConfig{
+	_, err := Start(context.Background(), ServiceConfig{
 		ListenAddr: "127.0.0.1:42000",
 	})
 	if err == nil {
@@ -22,7 +27,7 @@ func TestStartFailsWithoutHostPrivateKey(t *testing.T) {
 func TestStartFailsWhenDERPMapUnavailable(t *testing.T) {
 	t.Setenv(DERPMapURLEnvVar, "http://127.0.0.1:1/unreachable")
 
-	_, err := Start(ServiceConfig{
+	_, err := Start(context.Background(), ServiceConfig{
 		ListenAddr:     "127.0.0.1:42000",
 		HostPrivateKey: []byte("test-key"),
 	})
@@ -40,9 +45,10 @@ func TestDialRelayPath(t *testing.T) {
 	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
 
 	listenAddr := mustPickTestAddr(t)
-	service, err := Start(ServiceConfig{
+	service, err := Start(context.Background(), ServiceConfig{
 		ListenAddr:     listenAddr,
 		HostPrivateKey: []byte("test-key-relay"),
+		DisableDirect:  true,
 	})
 	if err != nil {
 		t.Fatalf("Start() error = %v", err)
@@ -51,15 +57,18 @@ func TestDialRelayPath(t *testing.T) {
 
 	go echoAcceptedConn(t, service.Listener())
 
-	conn, err := Dial(DestinationPrefix+service.Token(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, DestinationPrefix+service.Token())
 	if err != nil {
-		t.Fatalf("Dial() error = %v", err)
+		t.Fatalf("DialContext() error = %v", err)
 	}
 	defer conn.Close()
 
 	pathConn, ok := conn.(interface{ Path() string })
 	if !ok {
-		t.Fatalf("Dial() connection does not expose path")
+		t.Fatalf("DialContext() connection does not expose path")
 	}
 	if got := pathConn.Path(); got != "relay" {
 		t.Fatalf("path = %q, want %q", got, "relay")
@@ -78,6 +87,88 @@ func TestDialRelayPath(t *testing.T) {
 	}
 }
 
+func TestDialUpgradesToDirect(t *testing.T) {
+	derpServer, node := newFakeDERPServer(t)
+	defer derpServer.Close()
+
+	mapServer := newMapServerForNode(node)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:     mustPickTestAddr(t),
+		HostPrivateKey: []byte("test-key-direct"),
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	accepted := make(chan net.Conn, 1)
+	echoDone := make(chan struct{})
+	go func() {
+		defer close(echoDone)
+		conn, err := service.Listener().Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, DestinationPrefix+service.Token())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+
+	path := conn.(interface{ Path() string })
+
+	// Keep data moving through the switch, the echo has to come back complete and in order
+	var serverConn net.Conn
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; ; i++ {
+		payload := []byte(fmt.Sprintf("message-%d;", i))
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		buf := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("ReadFull() error = %v", err)
+		}
+		if string(buf) != string(payload) {
+			t.Fatalf("echo mismatch: got %q, want %q", buf, payload)
+		}
+
+		if serverConn == nil {
+			serverConn = <-accepted
+		}
+
+		if path.Path() == "direct" && serverConn.RemoteAddr().(interface{ Path() string }).Path() == "direct" && i > 20 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("still on %q after %d messages", path.Path(), i)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := conn.RemoteAddr().Network(); got != RelayAddrNetwork {
+		t.Fatalf("remote network = %q, want it to stay %q", got, RelayAddrNetwork)
+	}
+
+	conn.Close()
+	select {
+	case <-echoDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server side did not see the direct path close")
+	}
+}
+
 func TestDialOldDestinationAfterRestart(t *testing.T) {
 	derpServer, node := newFakeDERPServer(t)
 	defer derpServer.Close()
@@ -89,7 +180,7 @@ func TestDialOldDestinationAfterRestart(t *testing.T) {
 	listenAddr := mustPickTestAddr(t)
 	hostKey := []byte("test-key-restart")
 
-	serviceOne, err := Start(ServiceConfig{
+	serviceOne, err := Start(context.Background(), ServiceConfig{
 		ListenAddr:     listenAddr,
 		HostPrivateKey: hostKey,
 	})
@@ -101,7 +192,7 @@ func TestDialOldDestinationAfterRestart(t *testing.T) {
 		t.Fatalf("Close() first instance error = %v", err)
 	}
 
-	serviceTwo, err := Start(ServiceConfig{
+	serviceTwo, err := Start(context.Background(), ServiceConfig{
 		ListenAddr:     listenAddr,
 		HostPrivateKey: hostKey,
 	})
@@ -112,9 +203,12 @@ func TestDialOldDestinationAfterRestart(t *testing.T) {
 
 	go echoAcceptedConn(t, serviceTwo.Listener())
 
-	conn, err := Dial(oldDestination, 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, oldDestination)
 	if err != nil {
-		t.Fatalf("Dial() using old destination after restart error = %v", err)
+		t.Fatalf("DialContext() using old destination after restart error = %v", err)
 	}
 	defer conn.Close()
 
@@ -131,6 +225,97 @@ func TestDialOldDestinationAfterRestart(t *testing.T) {
 	}
 }
 
+func TestDialFailsOverToAnotherHomeRegion(t *testing.T) {
+	derpOne, nodeOne := newFakeDERPServer(t)
+	defer derpOne.Close()
+	derpTwo, nodeTwo := newFakeDERPServer(t)
+	defer derpTwo.Close()
+	nodeTwo.RegionID = 2
+
+	mapServer := newMapServerForNodes(nodeOne, nodeTwo)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	// Region one is always the nearest
+	measureDERPNodeLatencyFunc = func(_ context.Context, node vderp.Node, _ time.Duration) time.Duration {
+		return time.Duration(node.RegionID) * time.Millisecond
+	}
+	defer func() { measureDERPNodeLatencyFunc = measureDERPNodeLatency }()
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:     mustPickTestAddr(t),
+		HostPrivateKey: []byte("test-key-homes"),
+		DisableDirect:  true,
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	token, err := DecodeToken(service.Token())
+	if err != nil {
+		t.Fatalf("DecodeToken() error = %v", err)
+	}
+	if token.Version != TokenVersionV4 || len(token.Regions) != 2 || token.Regions[0] != 1 || token.Regions[1] != 2 {
+		t.Fatalf("token = %+v, want version 4 with regions [1 2]", token)
+	}
+
+	// The nearest region goes down, the client should reach the server on the other
+	derpOne.Close()
+
+	go echoAcceptedConn(t, service.Listener())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, DestinationPrefix+service.Token())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+
+	payload := []byte("hello-region-two")
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if string(buf) != string(payload) {
+		t.Fatalf("echo mismatch: got %q, want %q", string(buf), string(payload))
+	}
+}
+
+func TestDialContextCancel(t *testing.T) {
+	derpServer, node := newFakeDERPServer(t)
+	defer derpServer.Close()
+
+	mapServer := newMapServerForNode(node)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	// No server is listening behind this key, so the dial waits for an ack that never comes
+	token := Token{Version: TokenVersionV4, Regions: []int{1}}
+	token.ServerDERPPublicKey[0] = 1
+	encoded, err := token.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = DialContext(ctx, DestinationPrefix+encoded)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("DialContext() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("DialContext() took %s to return after being cancelled", elapsed)
+	}
+}
+
 func mustPickTestAddr(t *testing.T) string {
 	t.Helper()
 	for i := 0; i < 40; i++ {
@@ -178,3 +363,105 @@ func errorsIsNetClosed(err error) bool {
 	}
 	return strings.Contains(strings.ToLower(err.Error()), "use of closed network connection")
 }
+
+func TestIssueToken(t *testing.T) {
+	derpServer, node := newFakeDERPServer(t)
+	defer derpServer.Close()
+
+	mapServer := newMapServerForNode(node)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:     mustPickTestAddr(t),
+		HostPrivateKey: []byte("test-key-issue"),
+		DisableDirect:  true,
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	expires := time.Now().Add(time.Hour)
+	encoded, err := service.IssueToken(expires)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+
+	token, err := DecodeToken(encoded)
+	if err != nil {
+		t.Fatalf("DecodeToken() error = %v", err)
+	}
+	if token.Version != TokenVersionV5 || token.Expires.Unix() != expires.Unix() || len(token.Regions) != 1 {
+		t.Fatalf("token = %+v, want version 5 expiring at %s with the service's region", token, expires)
+	}
+
+	expired, err := service.IssueToken(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+	if _, err := DialContext(context.Background(), DestinationPrefix+expired); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("DialContext() with an expired token error = %v, want ErrTokenExpired", err)
+	}
+
+	d := &directListener{
+		candidates: []string{"203.0.113.1:4000", "10.0.0.2:4000", "127.0.0.1:4000", "[::1]:4000"},
+		public:     []string{"203.0.113.1:4000"},
+	}
+	want := []TokenCandidate{
+		{Kind: CandidateSTUN, Addr: netip.MustParseAddrPort("203.0.113.1:4000")},
+		{Kind: CandidateLAN, Addr: netip.MustParseAddrPort("10.0.0.2:4000")},
+	}
+	if got := d.tokenCandidates(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tokenCandidates() = %v, want %v", got, want)
+	}
+}
+
+func TestPruneRelaySessions(t *testing.T) {
+	now := time.Now()
+
+	s := &Service{
+		sessions:    make(map[relaySessionKey]*relaySession),
+		pendingTTL:  DefaultPendingSessionTTL,
+		idleTimeout: time.Minute,
+	}
+
+	add := func(id byte, accepted bool, idle time.Duration) *relayConn {
+		key := relaySessionKey{SessionID: [16]byte{id}}
+		conn := newRelayConn(key.SessionID, "relay", key.Peer, func(signalMessage) error { return nil }, nil)
+		s.sessions[key] = &relaySession{conn: conn, accepted: accepted, lastActivity: now.Add(-idle)}
+		return conn
+	}
+
+	add(1, false, time.Minute)
+	add(2, false, time.Second)
+	add(3, true, 2*time.Minute)
+	add(4, true, time.Second)
+	direct := add(5, true, 2*time.Minute)
+	direct.writeDirect, direct.readDirect = true, true
+
+	s.pruneRelaySessions(now)
+
+	for id, want := range map[byte]bool{1: false, 2: true, 3: false, 4: true, 5: true} {
+		if _, ok := s.sessions[relaySessionKey{SessionID: [16]byte{id}}]; ok != want {
+			t.Errorf("session %d kept = %v, want %v", id, ok, want)
+		}
+	}
+
+	// Without an idle timeout accepted sessions stay however long they are quiet
+	s.idleTimeout = 0
+	add(6, true, time.Hour)
+	s.pruneRelaySessions(now)
+	if _, ok := s.sessions[relaySessionKey{SessionID: [16]byte{6}}]; !ok {
+		t.Error("idle session closed with no idle timeout")
+	}
+
+	if got := s.sweepPeriod(); got != maxRelaySessionSweepPeriod {
+		t.Errorf("sweep period = %s, want %s", got, maxRelaySessionSweepPeriod)
+	}
+
+	s.idleTimeout = 6 * time.Second
+	if got := s.sweepPeriod(); got != 2*time.Second {
+		t.Errorf("sweep period = %s, want 2s", got)
+	}
+}
@@ -2,9 +2,12 @@ package nat
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync/atomic"
 
+	"github.com/NHAS/reverse_ssh/internal/secure"
+
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 )
@@ -14,6 +17,25 @@ const (
 	signalDialAck  byte = 2
 	signalData     byte = 3
 	signalClose    byte = 4
+
+	// Direct path upgrade, see direct.go
+	signalCandidates  byte = 5
+	signalPathSwitch  byte = 6
+	signalDirectHello byte = 7
+
+	// Relay flow control, see relay_flow.go
+	signalWindow byte = 8
+
+	// Client NAT behaviour, see natbehavior.go
+	signalNATType byte = 9
+
+	// Relay compression, see relay_compress.go
+	signalCompression    byte = 10
+	signalDataCompressed byte = 11
+
+	// Sessions on the local network, see lan.go
+	signalDirectDial byte = 12
+	signalLANProbe   byte = 13
 )
 
 type signalMessage struct {
@@ -22,14 +44,22 @@ type signalMessage struct {
 	Payload   []byte
 }
 
+var errSignalReplay = errors.New("signal message replayed")
+
 var globalWGCounter atomic.Uint64
 var zeroPad [16]byte
 
 type signalCipher struct {
 	sharedKey [32]byte
+
+	// Counters already received from the peer
+	replay replayWindow
 }
 
 func newSignalCipher(privateKey, publicKey [32]byte) *signalCipher {
+	// privateKey is a copy, only the shared key is kept
+	defer secure.Zero(privateKey[:])
+
 	c := &signalCipher{}
 	box.Precompute(&c.sharedKey, &publicKey, &privateKey)
 	return c
@@ -104,6 +134,16 @@ func (c *signalCipher) decode(raw []byte) (signalMessage, error) {
 		return message, fmt.Errorf("signal message decryption failed")
 	}
 
+	// The counter is the nonce, so it has been authenticated by now
+	if !c.replay.accept(binary.LittleEndian.Uint64(raw[8:16])) {
+		return message, errSignalReplay
+	}
+
+	return parseSignalInner(inner)
+}
+
+// parseSignalInner reads a decrypted message, length(2) + type(1) + session id(16) + payload then padding
+func parseSignalInner(inner []byte) (message signalMessage, err error) {
 	if len(inner) < 19 {
 		return message, fmt.Errorf("signal inner message too short")
 	}
@@ -121,11 +161,3 @@ func (c *signalCipher) decode(raw []byte) (signalMessage, error) {
 
 	return message, nil
 }
-
-func encodeSignalMessage(message signalMessage, privateKey, publicKey [32]byte) []byte {
-	return newSignalCipher(privateKey, publicKey).encode(message)
-}
-
-func decodeSignalMessage(raw []byte, privateKey, publicKey [32]byte) (signalMessage, error) {
-	return newSignalCipher(privateKey, publicKey).decode(raw)
-}
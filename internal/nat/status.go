@@ -0,0 +1,133 @@
+package nat
+
+import (
+	"sync"
+	"time"
+)
+
+// ServiceStatus is a snapshot of the server's ts relay transport, for diagnosing slow or disconnected clients
+type ServiceStatus struct {
+	// False until the transport is started
+	Running bool
+	Started time.Time
+
+	ActiveSessions  int
+	PendingSessions int
+	// Active sessions that have moved to a direct path
+	DirectSessions int
+
+	BannedPeers int
+
+	// Written by active sessions and waiting to go to DERP, and the sessions whose writes are waiting because their send queue is full
+	QueuedBytes        uint64
+	BackloggedSessions int
+
+	// Relayed data sent and received over DERP, as it was on the wire so after compression
+	BytesIn, BytesOut uint64
+
+	Regions []RegionStatus
+}
+
+type RegionStatus struct {
+	RegionID  int
+	Connected bool
+	// Times the connection to the region was lost and made again
+	Reconnects uint64
+	// Last measured, 0 when it has not been measured recently
+	Latency time.Duration
+
+	// Empty if nothing has gone wrong
+	LastError   string
+	LastErrorAt time.Time
+}
+
+var (
+	runningMu sync.Mutex
+	running   *Service
+)
+
+// Status describes the running ts relay transport
+func Status() ServiceStatus {
+	runningMu.Lock()
+	s := running
+	runningMu.Unlock()
+
+	if s == nil {
+		return ServiceStatus{}
+	}
+
+	return s.status()
+}
+
+func setRunning(s *Service) {
+	runningMu.Lock()
+	running = s
+	runningMu.Unlock()
+}
+
+func clearRunning(s *Service) {
+	runningMu.Lock()
+	if running == s {
+		running = nil
+	}
+	runningMu.Unlock()
+}
+
+func (s *Service) status() ServiceStatus {
+	status := ServiceStatus{
+		Running:     true,
+		Started:     s.started,
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+		BannedPeers: s.peerLimits.bannedCount(time.Now()),
+	}
+
+	s.sessionMu.Lock()
+	for _, session := range s.sessions {
+		if !session.accepted {
+			status.PendingSessions++
+			continue
+		}
+
+		status.ActiveSessions++
+		if session.conn.Path() == "direct" {
+			status.DirectSessions++
+		}
+
+		queued, full := session.conn.sendBacklog()
+		status.QueuedBytes += uint64(queued)
+		if full {
+			status.BackloggedSessions++
+		}
+	}
+	s.sessionMu.Unlock()
+
+	for _, home := range s.derpHomes {
+		status.Regions = append(status.Regions, home.status())
+	}
+
+	return status
+}
+
+func (h *derpHome) status() RegionStatus {
+	latency, _ := cachedDERPLatency(h.node, derpLatencyTTL)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return RegionStatus{
+		RegionID:    h.regionID,
+		Connected:   h.client != nil,
+		Reconnects:  h.reconnects,
+		Latency:     latency,
+		LastError:   h.lastError,
+		LastErrorAt: h.lastErrorAt,
+	}
+}
+
+func (h *derpHome) recordError(err error) {
+	h.mu.Lock()
+	h.lastError = err.Error()
+	h.lastErrorAt = time.Now()
+	h.mu.Unlock()
+}
@@ -0,0 +1,40 @@
+package nat
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestServiceStatus(t *testing.T) {
+	if Status().Running {
+		t.Fatal("status says a service is running before one was started")
+	}
+
+	home := &derpHome{regionID: 7}
+	s := &Service{
+		derpHomes:     []*derpHome{home},
+		peerHomes:     make(map[[32]byte]*derpHome),
+		sessions:      make(map[relaySessionKey]*relaySession),
+		signalCiphers: make(map[[32]byte]*signalCipher),
+		peerLimits:    newPeerLimits(0),
+		started:       time.Now(),
+	}
+
+	var peer [32]byte
+	s.handleDialInit(peer, signalMessage{Type: signalDialInit})
+	s.bytesIn.Add(100)
+	home.recordError(errors.New("connection reset"))
+
+	setRunning(s)
+	defer clearRunning(s)
+
+	status := Status()
+	if !status.Running || status.PendingSessions != 1 || status.ActiveSessions != 0 || status.BytesIn != 100 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if len(status.Regions) != 1 || status.Regions[0].RegionID != 7 || status.Regions[0].Connected || status.Regions[0].LastError != "connection reset" {
+		t.Fatalf("unexpected region status %+v", status.Regions)
+	}
+}
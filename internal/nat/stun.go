@@ -0,0 +1,272 @@
+package nat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+)
+
+// Public addresses are found with a STUN binding request (RFC 5389) to each server, by default the STUN servers of the DERP map.
+// The server advertises its public address as a direct path candidate, clients report theirs to the server.
+
+const (
+	stunDefaultPort = 3478
+	stunTimeout     = 3 * time.Second
+
+	// Servers asked at once, and the most a token can carry
+	maxSTUNServers = 8
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+)
+
+// ParseSTUNServers reads a comma separated list of host[:port], the port defaults to 3478
+func ParseSTUNServers(list string) ([]string, error) {
+	var servers []string
+	for _, server := range strings.Split(list, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), strconv.Itoa(stunDefaultPort)
+		}
+
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 || host == "" || strings.ContainsAny(host, "/ ") {
+			return nil, fmt.Errorf("stun server %q is not host[:port]", server)
+		}
+
+		server = net.JoinHostPort(host, port)
+		if len(server) > 255 {
+			return nil, fmt.Errorf("stun server %q is too long", server)
+		}
+		servers = append(servers, server)
+	}
+
+	if len(servers) > maxSTUNServers {
+		return nil, fmt.Errorf("at most %d stun servers can be used, got %d", maxSTUNServers, len(servers))
+	}
+
+	return servers, nil
+}
+
+// stunServersFromMap is the STUN server of every DERP node that runs one, capped in region order as the nearest is not known yet
+func stunServersFromMap(m *vderp.Map) []string {
+	if m == nil {
+		return nil
+	}
+
+	var servers []string
+	for _, regionID := range orderedRegionIDs(m) {
+		for _, node := range m.Regions[regionID].Nodes {
+			if node.STUNPort < 0 || node.HostName == "" {
+				continue
+			}
+
+			port := node.STUNPort
+			if port == 0 {
+				port = stunDefaultPort
+			}
+
+			servers = append(servers, net.JoinHostPort(node.HostName, strconv.Itoa(port)))
+			if len(servers) == maxSTUNServers {
+				return servers
+			}
+			// One per region is enough
+			break
+		}
+	}
+	return servers
+}
+
+// discoverPublicAddrs asks every server at once over both ipv4 and ipv6, and returns the distinct public addresses they saw.
+// A server or host without an address of a family fails that half straight away
+func discoverPublicAddrs(ctx context.Context, servers []string) []netip.Addr {
+	ctx, cancel := context.WithTimeout(ctx, stunTimeout)
+	defer cancel()
+
+	networks := []string{"udp4", "udp6"}
+
+	results := make(chan netip.Addr, len(servers)*len(networks))
+	for _, server := range servers {
+		for _, network := range networks {
+			go func(network, server string) {
+				mapped, err := stunBinding(ctx, network, server)
+				if err != nil {
+					results <- netip.Addr{}
+					return
+				}
+				results <- mapped.Addr()
+			}(network, server)
+		}
+	}
+
+	seen := map[netip.Addr]bool{}
+	var addrs []netip.Addr
+	for range len(servers) * len(networks) {
+		addr := <-results
+		if !addr.IsValid() || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Less(addrs[j])
+	})
+	return addrs
+}
+
+// stunBinding sends a binding request to server over network and returns the address it saw the request come from
+func stunBinding(ctx context.Context, network, server string) (netip.AddrPort, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	if _, err := rand.Read(request[8:20]); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	// UDP, so ask again in case the request or answer was lost
+	for attempt := 0; ; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return netip.AddrPort{}, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond << attempt))
+
+		response := make([]byte, 1500)
+		n, err := conn.Read(response)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+				continue
+			}
+			return netip.AddrPort{}, err
+		}
+
+		mapped, err := parseSTUNResponse(response[:n], request[8:20])
+		if err != nil {
+			continue
+		}
+		return mapped, nil
+	}
+}
+
+func parseSTUNResponse(response, transactionID []byte) (netip.AddrPort, error) {
+	if len(response) < 20 || binary.BigEndian.Uint16(response[0:2]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(response[4:8]) != stunMagicCookie || string(response[8:20]) != string(transactionID) {
+		return netip.AddrPort{}, errors.New("not a binding response to our request")
+	}
+
+	length := int(binary.BigEndian.Uint16(response[2:4]))
+	if len(response) < 20+length {
+		return netip.AddrPort{}, errors.New("short stun response")
+	}
+
+	var mapped, xorMapped netip.AddrPort
+	walkSTUNAttributes(response[20:20+length], func(attrType uint16, value []byte) {
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			if addr, err := parseSTUNAddress(value, response[4:20], true); err == nil && !xorMapped.IsValid() {
+				xorMapped = addr
+			}
+		case stunAttrMappedAddress:
+			if addr, err := parseSTUNAddress(value, nil, false); err == nil {
+				mapped = addr
+			}
+		}
+	})
+
+	// Preferred, middleboxes rewrite the plain mapped address
+	if xorMapped.IsValid() {
+		return xorMapped, nil
+	}
+
+	if !mapped.IsValid() {
+		return mapped, errors.New("stun response has no mapped address")
+	}
+	return mapped, nil
+}
+
+// walkSTUNAttributes calls fn with each attribute, stopping at the first that is cut short
+func walkSTUNAttributes(attributes []byte, fn func(attrType uint16, value []byte)) {
+	for len(attributes) >= 4 {
+		attrType := binary.BigEndian.Uint16(attributes[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if len(attributes) < 4+attrLen {
+			return
+		}
+		fn(attrType, attributes[4:4+attrLen])
+
+		// Attributes are padded to 4 bytes
+		next := 4 + (attrLen+3)&^3
+		if next > len(attributes) {
+			return
+		}
+		attributes = attributes[next:]
+	}
+}
+
+// parseSTUNAddress reads a (XOR-)MAPPED-ADDRESS, xorKey is the magic cookie and transaction id
+func parseSTUNAddress(value, xorKey []byte, xored bool) (netip.AddrPort, error) {
+	if len(value) < 4 {
+		return netip.AddrPort{}, errors.New("short address attribute")
+	}
+
+	family := value[1]
+	port := binary.BigEndian.Uint16(value[2:4])
+
+	var ip []byte
+	switch family {
+	case 0x01:
+		ip = append([]byte(nil), value[4:]...)
+		if len(ip) != 4 {
+			return netip.AddrPort{}, errors.New("bad ipv4 address attribute")
+		}
+	case 0x02:
+		ip = append([]byte(nil), value[4:]...)
+		if len(ip) != 16 {
+			return netip.AddrPort{}, errors.New("bad ipv6 address attribute")
+		}
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unknown address family %d", family)
+	}
+
+	if xored {
+		port ^= stunMagicCookie >> 16
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), port), nil
+}
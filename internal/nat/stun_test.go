@@ -0,0 +1,136 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// serveSTUN answers binding requests with the address each one came from, as a XOR-MAPPED-ADDRESS
+func serveSTUN(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return answerSTUN(t, conn)
+}
+
+func answerSTUN(t *testing.T, conn net.PacketConn) string {
+	t.Helper()
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 20 || binary.BigEndian.Uint16(buf[0:2]) != stunBindingRequest {
+				continue
+			}
+
+			source := from.(*net.UDPAddr)
+			ip, family := source.IP.To4(), byte(0x01)
+			if ip == nil {
+				ip, family = source.IP.To16(), 0x02
+			}
+
+			value := make([]byte, 4+len(ip))
+			value[1] = family
+			binary.BigEndian.PutUint16(value[2:4], uint16(source.Port)^(stunMagicCookie>>16))
+			for i, b := range ip {
+				value[4+i] = b ^ buf[4+i]
+			}
+
+			response := make([]byte, 20, 20+4+len(value))
+			binary.BigEndian.PutUint16(response[0:2], stunBindingResponse)
+			binary.BigEndian.PutUint16(response[2:4], uint16(4+len(value)))
+			copy(response[4:20], buf[4:20])
+			response = binary.BigEndian.AppendUint16(response, stunAttrXorMappedAddress)
+			response = binary.BigEndian.AppendUint16(response, uint16(len(value)))
+			response = append(response, value...)
+
+			conn.WriteTo(response, from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestDiscoverPublicAddrs(t *testing.T) {
+	servers := []string{serveSTUN(t), serveSTUN(t)}
+
+	addrs := discoverPublicAddrs(context.Background(), servers)
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("public addresses = %v, want [127.0.0.1] once", addrs)
+	}
+}
+
+func TestDiscoverPublicAddrsBothFamilies(t *testing.T) {
+	v6, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6 loopback: %v", err)
+	}
+
+	servers := []string{serveSTUN(t), answerSTUN(t, v6)}
+
+	addrs := discoverPublicAddrs(context.Background(), servers)
+	want := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}
+	if len(addrs) != 2 || addrs[0] != want[0] || addrs[1] != want[1] {
+		t.Fatalf("public addresses = %v, want %v", addrs, want)
+	}
+}
+
+func TestParseSTUNServers(t *testing.T) {
+	servers, err := ParseSTUNServers("stun.example.com, 192.0.2.1:19302,[2001:db8::1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"stun.example.com:3478", "192.0.2.1:19302", "[2001:db8::1]:3478"}
+	if len(servers) != len(want) {
+		t.Fatalf("servers = %v, want %v", servers, want)
+	}
+	for i := range want {
+		if servers[i] != want[i] {
+			t.Fatalf("servers = %v, want %v", servers, want)
+		}
+	}
+
+	if _, err := ParseSTUNServers("stun.example.com:http"); err == nil {
+		t.Fatal("a non numeric port should be refused")
+	}
+}
+
+func TestDetectNATWithoutNAT(t *testing.T) {
+	b := DetectNAT(context.Background(), []string{serveSTUN(t)})
+	if b.Type != NATNone || len(b.Mapped) != 1 || b.Detected.IsZero() {
+		t.Fatalf("DetectNAT() = %+v, want no NAT from one mapping", b)
+	}
+}
+
+func TestClassifyNAT(t *testing.T) {
+	a := netip.MustParseAddrPort("203.0.113.1:4000")
+	b := netip.MustParseAddrPort("203.0.113.1:4001")
+
+	for _, tc := range []struct {
+		mapped    []netip.AddrPort
+		filtering NATType
+		want      NATType
+	}{
+		{[]netip.AddrPort{a}, NATUnknown, NATUnknown},
+		{[]netip.AddrPort{a, a}, NATUnknown, NATCone},
+		{[]netip.AddrPort{a, a}, NATRestrictedCone, NATRestrictedCone},
+		{[]netip.AddrPort{a, b}, NATFullCone, NATSymmetric},
+	} {
+		if got := classifyNAT(tc.mapped, tc.filtering); got != tc.want {
+			t.Errorf("classifyNAT(%v, %s) = %s, want %s", tc.mapped, tc.filtering, got, tc.want)
+		}
+	}
+}
@@ -2,9 +2,13 @@ package nat
 
 import (
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 	"strings"
+	"time"
 )
 
 const (
@@ -12,29 +16,163 @@ const (
 
 	DestinationPrefix = Scheme + "://"
 	TokenVersionV1    = 1
+	// Adds a self hosted relay the client uses instead of the public DERP map
+	TokenVersionV2 = 2
+	// Adds the STUN servers the client finds its public address with, the relay is optional
+	TokenVersionV3 = 3
+	// Adds the DERP regions the server is connected to, the STUN servers are optional
+	TokenVersionV4 = 4
+	// Adds direct path candidates and an expiry, the regions are optional
+	TokenVersionV5 = 5
+
+	maxTokenCandidates = 8
+)
+
+// CandidateKind is where a token candidate address came from
+type CandidateKind uint8
+
+const (
+	// An address of one of the server's interfaces
+	CandidateLAN CandidateKind = iota + 1
+	// The server's public address as STUN servers saw it
+	CandidateSTUN
+	// A port forward or static mapping set up for the server
+	CandidateMapped
 )
 
+func (k CandidateKind) String() string {
+	switch k {
+	case CandidateLAN:
+		return "lan"
+	case CandidateSTUN:
+		return "stun"
+	case CandidateMapped:
+		return "mapped"
+	}
+	return "unknown"
+}
+
+// TokenCandidate is an address the server may be reached on directly, tried with the ones it offers over the relay
+type TokenCandidate struct {
+	Kind CandidateKind
+	Addr netip.AddrPort
+}
+
 var (
 	ErrInvalidDestination = errors.New("invalid ts destination")
 	ErrInvalidToken       = errors.New("invalid ts token")
+	ErrTokenExpired       = errors.New("ts token has expired")
 )
 
 // Token is the versioned TS destination payload baked into ts:// addresses.
+// Each version adds a section to the one before it
 type Token struct {
 	Version             uint8
 	ServerDERPPublicKey [32]byte
+
+	// V2 and later, host:port and DERP key of the server's own relay
+	Relay    string
+	RelayKey [32]byte
+
+	// V3 and later, host:port of each STUN server
+	STUNServers []string
+
+	// V4 and later, DERP regions the server is connected to, nearest to the server first
+	Regions []int
+
+	// V5, addresses to try for a direct path, most likely to work first
+	Candidates []TokenCandidate
+
+	// V5, zero if the token does not expire. Kept to the second
+	Expires time.Time
 }
 
-func (t *Token) Validate() error {
-	if t.Version != TokenVersionV1 {
-		return fmt.Errorf("%w: unsupported version %d", ErrInvalidToken, t.Version)
-	}
+// Expired is whether the token should no longer be used
+func (t *Token) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
 
+func (t *Token) Validate() error {
 	var zero [32]byte
 	if t.ServerDERPPublicKey == zero {
 		return fmt.Errorf("%w: missing derp server key", ErrInvalidToken)
 	}
 
+	if t.Version < TokenVersionV1 || t.Version > TokenVersionV5 {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidToken, t.Version)
+	}
+
+	switch {
+	case t.Version == TokenVersionV1 && t.Relay != "":
+		return fmt.Errorf("%w: version 1 tokens cannot have a relay", ErrInvalidToken)
+	case t.Version == TokenVersionV2 || t.Relay != "":
+		if err := t.validateRelay(); err != nil {
+			return err
+		}
+	}
+
+	if t.Version < TokenVersionV3 && len(t.STUNServers) != 0 {
+		return fmt.Errorf("%w: version %d tokens cannot have stun servers", ErrInvalidToken, t.Version)
+	}
+	if t.Version == TokenVersionV3 && len(t.STUNServers) == 0 {
+		return fmt.Errorf("%w: version 3 tokens need between 1 and %d stun servers", ErrInvalidToken, maxSTUNServers)
+	}
+	if len(t.STUNServers) > maxSTUNServers {
+		return fmt.Errorf("%w: at most %d stun servers", ErrInvalidToken, maxSTUNServers)
+	}
+	for _, server := range t.STUNServers {
+		if _, _, err := net.SplitHostPort(server); err != nil || len(server) > 255 {
+			return fmt.Errorf("%w: stun server %q is not host:port", ErrInvalidToken, server)
+		}
+	}
+
+	if t.Version < TokenVersionV4 && len(t.Regions) != 0 {
+		return fmt.Errorf("%w: version %d tokens cannot have regions", ErrInvalidToken, t.Version)
+	}
+	if t.Version == TokenVersionV4 && (len(t.Regions) == 0 || len(t.Regions) > MaxDERPHomeRegions) {
+		return fmt.Errorf("%w: version 4 tokens need between 1 and %d regions", ErrInvalidToken, MaxDERPHomeRegions)
+	}
+	if len(t.Regions) > MaxDERPHomeRegions {
+		return fmt.Errorf("%w: at most %d regions", ErrInvalidToken, MaxDERPHomeRegions)
+	}
+	for _, region := range t.Regions {
+		if region <= 0 || region > 0xffff {
+			return fmt.Errorf("%w: region %d out of range", ErrInvalidToken, region)
+		}
+	}
+
+	if t.Version < TokenVersionV5 && (len(t.Candidates) != 0 || !t.Expires.IsZero()) {
+		return fmt.Errorf("%w: version %d tokens cannot have candidates or an expiry", ErrInvalidToken, t.Version)
+	}
+	if len(t.Candidates) > maxTokenCandidates {
+		return fmt.Errorf("%w: at most %d candidates", ErrInvalidToken, maxTokenCandidates)
+	}
+	for _, candidate := range t.Candidates {
+		if candidate.Kind < CandidateLAN || candidate.Kind > CandidateMapped {
+			return fmt.Errorf("%w: candidate kind %d unknown", ErrInvalidToken, candidate.Kind)
+		}
+		if !candidate.Addr.IsValid() || candidate.Addr.Port() == 0 {
+			return fmt.Errorf("%w: candidate %q is not a valid address", ErrInvalidToken, candidate.Addr)
+		}
+	}
+	if !t.Expires.IsZero() && t.Expires.Unix() <= 0 {
+		return fmt.Errorf("%w: expiry before 1970", ErrInvalidToken)
+	}
+
+	return nil
+}
+
+func (t *Token) validateRelay() error {
+	var zero [32]byte
+	if _, _, err := net.SplitHostPort(t.Relay); err != nil {
+		return fmt.Errorf("%w: relay address %q: %v", ErrInvalidToken, t.Relay, err)
+	}
+	if len(t.Relay) > 255 {
+		return fmt.Errorf("%w: relay address too long", ErrInvalidToken)
+	}
+	if t.RelayKey == zero {
+		return fmt.Errorf("%w: missing relay key", ErrInvalidToken)
+	}
 	return nil
 }
 
@@ -44,36 +182,125 @@ func (t *Token) Encode() (string, error) {
 	}
 
 	// version(1) + derp_pub(32)
-	total := 1 + 32
-	buf := make([]byte, total)
-	pos := 0
+	buf := make([]byte, 0, 1+32)
+	buf = append(buf, t.Version)
+	buf = append(buf, t.ServerDERPPublicKey[:]...)
 
-	buf[pos] = t.Version
-	pos++
+	if t.Version >= TokenVersionV2 {
+		// relay_pub(32) + relay_len(1) + relay, from V3 on there may be no relay and the length is 0
+		buf = append(buf, t.RelayKey[:]...)
+		buf = append(buf, byte(len(t.Relay)))
+		buf = append(buf, t.Relay...)
+	}
+
+	if t.Version >= TokenVersionV3 {
+		// stun_count(1) + (stun_len(1) + stun) each
+		buf = append(buf, byte(len(t.STUNServers)))
+		for _, server := range t.STUNServers {
+			buf = append(buf, byte(len(server)))
+			buf = append(buf, server...)
+		}
+	}
 
-	copy(buf[pos:pos+32], t.ServerDERPPublicKey[:])
+	if t.Version >= TokenVersionV4 {
+		// region_count(1) + region(2) each
+		buf = append(buf, byte(len(t.Regions)))
+		for _, region := range t.Regions {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(region))
+		}
+	}
+
+	if t.Version >= TokenVersionV5 {
+		// candidate_count(1) + (kind(1) + ip_len(1) + ip + port(2)) each + expires(8), unix seconds or 0
+		buf = append(buf, byte(len(t.Candidates)))
+		for _, candidate := range t.Candidates {
+			ip := candidate.Addr.Addr().AsSlice()
+			buf = append(buf, byte(candidate.Kind), byte(len(ip)))
+			buf = append(buf, ip...)
+			buf = binary.BigEndian.AppendUint16(buf, candidate.Addr.Port())
+		}
+
+		var expires int64
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Unix()
+		}
+		buf = binary.BigEndian.AppendUint64(buf, uint64(expires))
+	}
 
 	return base64.RawURLEncoding.EncodeToString(buf), nil
 }
 
+// tokenReader reads the sections of a token, any read past the end makes err set
+type tokenReader struct {
+	raw []byte
+	err error
+}
+
+func (r *tokenReader) next(n int) []byte {
+	if r.err != nil || len(r.raw) < n {
+		r.err = fmt.Errorf("%w: payload length mismatch", ErrInvalidToken)
+		return make([]byte, n)
+	}
+
+	b := r.raw[:n]
+	r.raw = r.raw[n:]
+	return b
+}
+
 func DecodeToken(encoded string) (*Token, error) {
 	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(encoded))
 	if err != nil {
 		return nil, fmt.Errorf("%w: decode failed: %v", ErrInvalidToken, err)
 	}
 
-	// version + derp_pub
-	if len(raw) != 33 {
-		return nil, fmt.Errorf("%w: payload length mismatch", ErrInvalidToken)
+	r := &tokenReader{raw: raw}
+	t := &Token{}
+
+	t.Version = r.next(1)[0]
+	copy(t.ServerDERPPublicKey[:], r.next(32))
+
+	if t.Version >= TokenVersionV2 {
+		copy(t.RelayKey[:], r.next(32))
+		t.Relay = string(r.next(int(r.next(1)[0])))
+
+		if t.Relay == "" {
+			t.RelayKey = [32]byte{}
+		}
+	}
+
+	if t.Version >= TokenVersionV3 {
+		count := int(r.next(1)[0])
+		for i := 0; i < count && r.err == nil; i++ {
+			t.STUNServers = append(t.STUNServers, string(r.next(int(r.next(1)[0]))))
+		}
 	}
 
-	t := &Token{}
-	pos := 0
+	if t.Version >= TokenVersionV4 {
+		count := int(r.next(1)[0])
+		for i := 0; i < count && r.err == nil; i++ {
+			t.Regions = append(t.Regions, int(binary.BigEndian.Uint16(r.next(2))))
+		}
+	}
 
-	t.Version = raw[pos]
-	pos++
+	if t.Version >= TokenVersionV5 {
+		count := int(r.next(1)[0])
+		for i := 0; i < count && r.err == nil; i++ {
+			kind := CandidateKind(r.next(1)[0])
+			ip, _ := netip.AddrFromSlice(r.next(int(r.next(1)[0])))
+			t.Candidates = append(t.Candidates, TokenCandidate{Kind: kind, Addr: netip.AddrPortFrom(ip, binary.BigEndian.Uint16(r.next(2)))})
+		}
 
-	copy(t.ServerDERPPublicKey[:], raw[pos:pos+32])
+		if expires := int64(binary.BigEndian.Uint64(r.next(8))); expires != 0 {
+			t.Expires = time.Unix(expires, 0)
+		}
+	}
+
+	if r.err == nil && len(r.raw) != 0 {
+		r.err = fmt.Errorf("%w: payload length mismatch", ErrInvalidToken)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
 
 	if err := t.Validate(); err != nil {
 		return nil, err
@@ -2,7 +2,10 @@ package nat
 
 import (
 	"bytes"
+	"net/netip"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestTokenRoundTrip(t *testing.T) {
@@ -30,3 +33,161 @@ func TestTokenRoundTrip(t *testing.T) {
 		t.Fatalf("decoded derp public key mismatch")
 	}
 }
+
+func TestTokenV2RoundTrip(t *testing.T) {
+	tok := &Token{
+		Version: TokenVersionV2,
+		Relay:   "relay.example.com:8443",
+	}
+	tok.ServerDERPPublicKey[0] = 1
+	tok.RelayKey[0] = 2
+
+	encoded, err := tok.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	decoded, err := DecodeToken(encoded)
+	if err != nil {
+		t.Fatalf("DecodeToken() error = %v", err)
+	}
+	if decoded.Relay != tok.Relay || decoded.RelayKey != tok.RelayKey || decoded.ServerDERPPublicKey != tok.ServerDERPPublicKey {
+		t.Fatalf("decoded token = %+v, want %+v", decoded, tok)
+	}
+
+	tok.Relay = "no-port"
+	if _, err := tok.Encode(); err == nil {
+		t.Fatalf("Encode() should refuse a relay without a port")
+	}
+}
+
+func TestTokenV3RoundTrip(t *testing.T) {
+	tok := &Token{
+		Version:     TokenVersionV3,
+		STUNServers: []string{"stun.example.com:3478", "[2001:db8::1]:3478"},
+	}
+	tok.ServerDERPPublicKey[0] = 1
+
+	encoded, err := tok.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	decoded, err := DecodeToken(encoded)
+	if err != nil {
+		t.Fatalf("DecodeToken() error = %v", err)
+	}
+	if decoded.Relay != "" || len(decoded.STUNServers) != 2 || decoded.STUNServers[1] != tok.STUNServers[1] {
+		t.Fatalf("decoded token = %+v, want %+v", decoded, tok)
+	}
+
+	// With the server's own relay as well
+	tok.Relay = "relay.example.com:8443"
+	tok.RelayKey[0] = 2
+	encoded, err = tok.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if decoded, err = DecodeToken(encoded); err != nil || decoded.Relay != tok.Relay || decoded.RelayKey != tok.RelayKey {
+		t.Fatalf("decoded token = %+v (%v), want %+v", decoded, err, tok)
+	}
+
+	tok.STUNServers = nil
+	if _, err := tok.Encode(); err == nil {
+		t.Fatalf("Encode() should refuse a version 3 token without stun servers")
+	}
+}
+
+func TestTokenV4RoundTrip(t *testing.T) {
+	tok := &Token{
+		Version: TokenVersionV4,
+		Regions: []int{900, 1, 65535},
+	}
+	tok.ServerDERPPublicKey[0] = 1
+
+	encoded, err := tok.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	decoded, err := DecodeToken(encoded)
+	if err != nil {
+		t.Fatalf("DecodeToken() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Regions, tok.Regions) || len(decoded.STUNServers) != 0 {
+		t.Fatalf("decoded token = %+v, want %+v", decoded, tok)
+	}
+
+	for _, regions := range [][]int{nil, {0}, {70000}, {1, 2, 3, 4, 5, 6, 7, 8, 9}} {
+		tok.Regions = regions
+		if _, err := tok.Encode(); err == nil {
+			t.Fatalf("Encode() should refuse regions %v", regions)
+		}
+	}
+}
+
+func TestTokenV5RoundTrip(t *testing.T) {
+	tok := &Token{
+		Version: TokenVersionV5,
+		Regions: []int{1, 2},
+		Candidates: []TokenCandidate{
+			{Kind: CandidateMapped, Addr: netip.MustParseAddrPort("203.0.113.7:4444")},
+			{Kind: CandidateSTUN, Addr: netip.MustParseAddrPort("198.51.100.2:40000")},
+			{Kind: CandidateLAN, Addr: netip.MustParseAddrPort("[fd00::1]:40000")},
+		},
+		Expires: time.Unix(time.Now().Add(time.Hour).Unix(), 0),
+	}
+	tok.ServerDERPPublicKey[0] = 1
+
+	encoded, err := tok.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	decoded, err := DecodeToken(encoded)
+	if err != nil {
+		t.Fatalf("DecodeToken() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded, tok) || decoded.Expired() {
+		t.Fatalf("decoded token = %+v, want %+v", decoded, tok)
+	}
+
+	// Neither candidates nor an expiry are needed, and there may be no regions
+	tok.Regions, tok.Candidates, tok.Expires = nil, nil, time.Time{}
+	if encoded, err = tok.Encode(); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if decoded, err = DecodeToken(encoded); err != nil || !decoded.Expires.IsZero() || decoded.Expired() {
+		t.Fatalf("decoded token = %+v (%v), want no expiry", decoded, err)
+	}
+
+	tok.Expires = time.Now().Add(-time.Minute)
+	if !tok.Expired() {
+		t.Fatal("token past its expiry should be expired")
+	}
+	if _, err := ParseDestination(DestinationPrefix + mustEncode(t, tok)); err != nil {
+		t.Fatalf("expired tokens should still decode, got %v", err)
+	}
+
+	for _, bad := range []Token{
+		{Version: TokenVersionV4, Regions: []int{1}, Expires: time.Now()},
+		{Version: TokenVersionV4, Regions: []int{1}, Candidates: []TokenCandidate{{Kind: CandidateLAN, Addr: netip.MustParseAddrPort("10.0.0.1:1")}}},
+		{Version: TokenVersionV5, Candidates: []TokenCandidate{{Kind: 9, Addr: netip.MustParseAddrPort("10.0.0.1:1")}}},
+		{Version: TokenVersionV5, Candidates: []TokenCandidate{{Kind: CandidateLAN, Addr: netip.MustParseAddrPort("10.0.0.1:0")}}},
+		{Version: TokenVersionV5, Candidates: make([]TokenCandidate, maxTokenCandidates+1)},
+	} {
+		bad.ServerDERPPublicKey[0] = 1
+		if _, err := bad.Encode(); err == nil {
+			t.Errorf("Encode() should refuse %+v", bad)
+		}
+	}
+}
+
+func mustEncode(t *testing.T, tok *Token) string {
+	t.Helper()
+	encoded, err := tok.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
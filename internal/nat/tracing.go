@@ -0,0 +1,40 @@
+package nat
+
+import (
+	"context"
+
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Dials and DERP connections are traced once the server sets a provider, clients never do so their spans cost nothing
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer("")
+
+// SetTracerProvider sends the ts relay transport's spans to provider
+func SetTracerProvider(provider trace.TracerProvider) {
+	tracer = provider.Tracer("github.com/NHAS/reverse_ssh/internal/nat")
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func derpNodeAttributes(node vderp.Node) trace.SpanStartOption {
+	return trace.WithAttributes(attribute.Int("derp.region", node.RegionID), attribute.String("derp.host", node.HostName))
+}
+
+// tracedConnectDERP is connectDERP with a span for the attempt, so slow regions and websocket fallbacks show up
+func tracedConnectDERP(ctx context.Context, node vderp.Node, privateKey [32]byte, webSocket bool) (*derpClient, error) {
+	ctx, span := tracer.Start(ctx, "nat.derp_connect", derpNodeAttributes(node), trace.WithAttributes(attribute.Bool("derp.websocket", webSocket)))
+	client, err := connectDERP(ctx, node, privateKey, webSocket)
+	endSpan(span, err)
+
+	return client, err
+}
@@ -0,0 +1,192 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+)
+
+// A transport is a kind of path between client and server. Dialing tries each transport that dials in turn, the relay last as it reaches the
+// server from anywhere, and the service listens on each that listens. New kinds of path, and fakes in tests, are added with
+// RegisterTransport rather than by changing the dial and service code.
+//
+// The relay is also how the server is found and signalled, so the service connects to its DERP homes whichever transports there are.
+
+type TransportCapabilities uint8
+
+const (
+	// Dial opens a session by itself, transports without it only take over sessions opened on another
+	TransportDials TransportCapabilities = 1 << iota
+
+	// Listen has to be run for the service to be reachable on the transport
+	TransportListens
+
+	// Sessions go straight between client and server, the transport is not used with ServiceConfig.DisableDirect
+	TransportDirect
+
+	// Dials are expected to fail whenever the server is elsewhere, so their errors are not reported
+	TransportOpportunistic
+)
+
+type Transport interface {
+	Name() string
+	Capabilities() TransportCapabilities
+
+	// Dial opens a session to the server token is for
+	Dial(ctx context.Context, token *Token) (net.Conn, error)
+
+	// Listen starts accepting sessions for s and hands them over with s.Accept. It returns once listening, and stops when ctx is done
+	Listen(ctx context.Context, s *Service) error
+}
+
+var (
+	transportsMu sync.RWMutex
+
+	// In the order they are listened on and dialed, direct comes first as the lan transport answers with its listener
+	transports = []Transport{directTransport{}, lanTransport{}, relayTransport{}}
+)
+
+// RegisterTransport adds t before the relay, so dials try it before falling back to the relay
+func RegisterTransport(t Transport) error {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	for _, existing := range transports {
+		if existing.Name() == t.Name() {
+			return fmt.Errorf("a transport named %q is already registered", t.Name())
+		}
+	}
+
+	transports = slices.Insert(transports, len(transports)-1, t)
+	return nil
+}
+
+// Transports lists the registered transports in the order they are tried
+func Transports() []Transport {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+
+	return slices.Clone(transports)
+}
+
+// Accept hands a session a transport opened to the service's listener
+func (s *Service) Accept(conn net.Conn) error {
+	return s.listener.push(conn)
+}
+
+// listenTransports starts every transport that listens, one that cannot only leaves its path unused
+func (s *Service) listenTransports(disableDirect bool) {
+	for _, t := range Transports() {
+		capabilities := t.Capabilities()
+		if capabilities&TransportListens == 0 || (disableDirect && capabilities&TransportDirect != 0) {
+			continue
+		}
+
+		if err := t.Listen(s.ctx, s); err != nil {
+			log.Printf("ts: %s transport disabled, unable to listen: %v", t.Name(), err)
+		}
+	}
+}
+
+// dialTransports tries every transport that dials until one opens a session
+func dialTransports(ctx context.Context, token *Token) (net.Conn, error) {
+	var errs []error
+	for _, t := range Transports() {
+		if t.Capabilities()&TransportDials == 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		dialCtx, span := tracer.Start(ctx, "nat.dial_"+t.Name())
+		conn, err := t.Dial(dialCtx, token)
+		endSpan(span, err)
+		if err == nil {
+			return conn, nil
+		}
+
+		if t.Capabilities()&TransportOpportunistic == 0 {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("ts dial aborted: %w", err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// directTransport is the server's tcp listener that relayed sessions are upgraded onto, and that lan sessions are opened on.
+// Clients only reach it by being offered its candidates, it does not dial
+type directTransport struct{}
+
+func (directTransport) Name() string { return "direct" }
+
+func (directTransport) Capabilities() TransportCapabilities {
+	return TransportListens | TransportDirect
+}
+
+func (directTransport) Dial(context.Context, *Token) (net.Conn, error) {
+	return nil, errors.New("direct paths are only reached by upgrading a relayed session")
+}
+
+func (directTransport) Listen(ctx context.Context, s *Service) error {
+	direct, err := listenDirect(s.listenHost)
+	if err != nil {
+		return err
+	}
+	s.direct = direct
+
+	go s.acceptDirectLoop()
+	go s.addPublicCandidates(s.stunServers)
+	go s.detectNAT(s.stunServers)
+	return nil
+}
+
+// lanTransport finds the server on the client's own networks and dials its direct listener
+type lanTransport struct{}
+
+func (lanTransport) Name() string { return "lan" }
+
+func (lanTransport) Capabilities() TransportCapabilities {
+	return TransportDials | TransportListens | TransportDirect | TransportOpportunistic
+}
+
+func (lanTransport) Dial(ctx context.Context, token *Token) (net.Conn, error) {
+	conn, err := dialLAN(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (lanTransport) Listen(ctx context.Context, s *Service) error {
+	if s.direct == nil {
+		return errors.New("probes are answered with the direct listener, which is not running")
+	}
+
+	go s.listenLAN()
+	return nil
+}
+
+// relayTransport opens sessions through the DERP relays, resuming the last one to the server when it can
+type relayTransport struct{}
+
+func (relayTransport) Name() string { return "relay" }
+
+func (relayTransport) Capabilities() TransportCapabilities {
+	return TransportDials
+}
+
+func (relayTransport) Dial(ctx context.Context, token *Token) (net.Conn, error) {
+	return dialRelay(ctx, token)
+}
+
+func (relayTransport) Listen(context.Context, *Service) error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeTransport connects clients to the service it listens for over in memory pipes
+type pipeTransport struct {
+	service *Service
+	dials   int
+}
+
+func (p *pipeTransport) Name() string { return "pipe" }
+
+func (p *pipeTransport) Capabilities() TransportCapabilities {
+	return TransportDials | TransportListens
+}
+
+func (p *pipeTransport) Dial(ctx context.Context, token *Token) (net.Conn, error) {
+	p.dials++
+	if p.service == nil {
+		return nil, errors.New("not listening")
+	}
+
+	client, server := net.Pipe()
+	if err := p.service.Accept(server); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (p *pipeTransport) Listen(ctx context.Context, s *Service) error {
+	p.service = s
+	return nil
+}
+
+func TestRegisteredTransportIsTriedBeforeRelay(t *testing.T) {
+	previous := Transports()
+	t.Cleanup(func() {
+		transportsMu.Lock()
+		transports = previous
+		transportsMu.Unlock()
+	})
+
+	pipe := &pipeTransport{}
+	if err := RegisterTransport(pipe); err != nil {
+		t.Fatalf("RegisterTransport() error = %v", err)
+	}
+	if err := RegisterTransport(pipe); err == nil {
+		t.Fatal("registered two transports with the same name")
+	}
+
+	if got := Transports(); got[len(got)-1].Name() != "relay" || got[len(got)-2].Name() != "pipe" {
+		t.Fatalf("pipe was not put before the relay")
+	}
+
+	derpServer, node := newFakeDERPServer(t)
+	defer derpServer.Close()
+
+	mapServer := newMapServerForNode(node)
+	defer mapServer.Close()
+	t.Setenv(DERPMapURLEnvVar, mapServer.URL)
+
+	service, err := Start(context.Background(), ServiceConfig{
+		ListenAddr:     mustPickTestAddr(t),
+		HostPrivateKey: []byte("test-key-transport"),
+		DisableDirect:  true,
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer service.Close()
+
+	go echoAcceptedConn(t, service.Listener())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := DialContext(ctx, DestinationPrefix+service.Token())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*relayConn); ok || pipe.dials != 1 {
+		t.Fatalf("dial went to %T after %d pipe dials, want the pipe", conn, pipe.dials)
+	}
+
+	go conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
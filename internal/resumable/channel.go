@@ -0,0 +1,539 @@
+// Package resumable keeps operator sessions alive while a client reconnects.
+//
+// The server opens interactive channels to clients as resumable@rssh, wrapping the real channel type. Both ends frame what they send and keep the last
+// bufferSize bytes of it. When the connection drops the channel waits gracePeriod instead of closing, and when the client connects again the server opens
+// resume@rssh to it. Each side says how much it received and the other replays the rest, so shells and forwards carry on where they stopped.
+// Clients that do not know resumable@rssh get the plain channel, as before.
+package resumable
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	ChannelType       = "resumable@rssh"
+	ResumeChannelType = "resume@rssh"
+
+	// Framed bytes each side keeps to replay, and the most received data waiting to be read
+	bufferSize = 1 << 20
+
+	// Largest data frame, so the replay buffer holds many of them
+	maxFrameData = 32 * 1024
+
+	secretSize = 32
+)
+
+// How long a channel waits to be resumed before it fails
+var gracePeriod = 2 * time.Minute
+
+const (
+	frameData byte = iota
+	frameEOF
+	frameClose
+	framePark
+)
+
+var (
+	errResumeTimeout = errors.New("connection was not resumed in time")
+	errReplayLost    = errors.New("data needed to resume the connection is no longer buffered")
+	errBadFrame      = errors.New("peer sent an invalid frame")
+	errNotParked     = errors.New("the client no longer has the parked session")
+)
+
+// Channel is an ssh.Channel that survives its connection dropping, until gracePeriod passes without it being resumed
+type Channel struct {
+	id     string
+	owner  string
+	secret []byte
+
+	// Held while a frame or replay is written, so they never interleave
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	conn ssh.Conn
+	ch   ssh.Channel // nil while detached
+	gen  int
+
+	sent uint64
+	ring []byte
+
+	received uint64
+	partial  []byte
+	data     []byte
+
+	eof        bool
+	peerClosed bool
+	closed     bool
+	err        error
+
+	// Detached by Park while the connection stays up
+	parked bool
+
+	finishOnce sync.Once
+	done       chan struct{}
+	reqMu      sync.RWMutex
+	requests   chan *ssh.Request
+}
+
+func newChannel(id, owner string, secret []byte, conn ssh.Conn, ch ssh.Channel, reqs <-chan *ssh.Request) *Channel {
+	c := &Channel{
+		id:       id,
+		owner:    owner,
+		secret:   secret,
+		conn:     conn,
+		ch:       ch,
+		done:     make(chan struct{}),
+		requests: make(chan *ssh.Request, 16),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	go c.pump(c.gen, ch)
+	go c.forward(reqs)
+
+	return c
+}
+
+func (c *Channel) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.data) == 0 {
+		switch {
+		case c.eof || c.closed:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		c.cond.Wait()
+	}
+
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	c.cond.Broadcast()
+
+	return n, nil
+}
+
+func (c *Channel) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxFrameData)
+		if err := c.writeFrame(frameData, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (c *Channel) CloseWrite() error {
+	return c.writeFrame(frameEOF, nil)
+}
+
+// Close tells the peer the channel is finished, so it does not wait for a resume
+func (c *Channel) Close() error {
+	c.mu.Lock()
+	parked := c.parked && c.ch == nil && !c.closed
+	c.mu.Unlock()
+
+	if parked {
+		// Attached again only to say it is finished, otherwise the client keeps it until the connection goes
+		c.Unpark()
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	ch := c.ch
+	c.mu.Unlock()
+
+	if ch != nil {
+		c.writeMu.Lock()
+		ch.Write(frame(frameClose, nil))
+		c.writeMu.Unlock()
+		ch.Close()
+	}
+
+	c.finish()
+	return nil
+}
+
+func (c *Channel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	ch, err := c.attached()
+	if err != nil {
+		return false, err
+	}
+
+	return ch.SendRequest(name, wantReply, payload)
+}
+
+// Stderr is merged into the data stream, resumable channels only carry ptys and forwards
+func (c *Channel) Stderr() io.ReadWriter {
+	return stderr{c}
+}
+
+type stderr struct {
+	*Channel
+}
+
+func (stderr) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func frame(t byte, data []byte) []byte {
+	f := make([]byte, 5, 5+len(data))
+	f[0] = t
+	binary.BigEndian.PutUint32(f[1:], uint32(len(data)))
+	return append(f, data...)
+}
+
+// attached waits until the channel has a connection, or will never have one again
+func (c *Channel) attached() (ssh.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		switch {
+		case c.err != nil:
+			return nil, c.err
+		case c.closed || c.peerClosed:
+			return nil, io.EOF
+		case c.ch != nil:
+			return c.ch, nil
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *Channel) writeFrame(t byte, data []byte) error {
+	f := frame(t, data)
+
+	for {
+		ch, err := c.attached()
+		if err != nil {
+			return err
+		}
+
+		c.writeMu.Lock()
+		c.mu.Lock()
+		if c.ch != ch {
+			// Dropped or resumed while we waited for the lock
+			c.mu.Unlock()
+			c.writeMu.Unlock()
+			continue
+		}
+		c.record(f)
+		c.mu.Unlock()
+
+		// A failed write is not an error, the frame is replayed when the channel is resumed
+		ch.Write(f)
+		c.writeMu.Unlock()
+
+		return nil
+	}
+}
+
+// record keeps the last bufferSize bytes sent, c.mu must be held
+func (c *Channel) record(f []byte) {
+	c.ring = append(c.ring, f...)
+	if over := len(c.ring) - bufferSize; over > 0 {
+		c.ring = append(c.ring[:0], c.ring[over:]...)
+	}
+	c.sent += uint64(len(f))
+}
+
+// pump reads from one attachment of the channel until it ends, a read failing without the peer closing the channel means the connection dropped
+func (c *Channel) pump(gen int, ch ssh.Channel) {
+	buf := make([]byte, maxFrameData)
+	for {
+		c.mu.Lock()
+		for len(c.data) >= bufferSize && gen == c.gen && !c.closed {
+			c.cond.Wait()
+		}
+		c.mu.Unlock()
+
+		n, err := ch.Read(buf)
+
+		c.mu.Lock()
+		if gen != c.gen {
+			// Anything read here is counted by neither side, so the peer replays it on the new attachment
+			c.mu.Unlock()
+			return
+		}
+
+		if n > 0 {
+			c.received += uint64(n)
+			c.partial = append(c.partial, buf[:n]...)
+			c.decode()
+			c.cond.Broadcast()
+		}
+
+		ended := c.peerClosed || c.err != nil
+		c.mu.Unlock()
+
+		if ended {
+			ch.Close()
+			c.finish()
+			return
+		}
+
+		if err != nil {
+			c.detach(gen)
+			return
+		}
+	}
+}
+
+// decode moves complete frames out of c.partial, c.mu must be held
+func (c *Channel) decode() {
+	p := c.partial
+	for len(p) >= 5 {
+		n := int(binary.BigEndian.Uint32(p[1:5]))
+		if n > maxFrameData {
+			c.err = errBadFrame
+			break
+		}
+		if len(p) < 5+n {
+			break
+		}
+
+		switch p[0] {
+		case frameData:
+			c.data = append(c.data, p[5:5+n]...)
+		case frameEOF:
+			c.eof = true
+		case frameClose:
+			c.eof = true
+			c.peerClosed = true
+		case framePark:
+			c.parked = true
+		default:
+			c.err = errBadFrame
+		}
+		p = p[5+n:]
+	}
+
+	c.partial = append(c.partial[:0], p...)
+}
+
+// forward passes requests from an attachment on to whoever reads Channel's requests
+func (c *Channel) forward(reqs <-chan *ssh.Request) {
+	for r := range reqs {
+		c.reqMu.RLock()
+		select {
+		case <-c.done:
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+		default:
+			select {
+			case c.requests <- r:
+			case <-c.done:
+				if r.WantReply {
+					r.Reply(false, nil)
+				}
+			}
+		}
+		c.reqMu.RUnlock()
+	}
+}
+
+// detach drops attachment gen, or the current one if gen is -1, and closes its connection. The channel then has gracePeriod to be resumed.
+// A parked channel's connection is fine, so it is left open and the grace period starts once it closes
+func (c *Channel) detach(gen int) (received uint64, ok bool) {
+	c.mu.Lock()
+	if c.closed || c.peerClosed || c.err != nil || (gen >= 0 && gen != c.gen) {
+		c.mu.Unlock()
+		return 0, false
+	}
+
+	if c.ch == nil {
+		// Already detached, e.g parked
+		received = c.received
+		c.mu.Unlock()
+		return received, true
+	}
+
+	// c.partial is kept, it is counted in c.received so the peer replays from where it ends
+	old := c.conn
+	c.ch = nil
+	c.gen++
+
+	detached := c.gen
+	if c.parked {
+		go func(conn ssh.Conn) {
+			conn.Wait()
+			time.AfterFunc(gracePeriod, func() { c.expire(detached) })
+		}(old)
+		old = nil
+	} else {
+		time.AfterFunc(gracePeriod, func() { c.expire(detached) })
+	}
+
+	received = c.received
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return received, true
+}
+
+// expire fails the channel if it has not been attached since it was detached as gen
+func (c *Channel) expire(gen int) {
+	c.mu.Lock()
+	expired := c.gen == gen && c.ch == nil && c.err == nil
+	if expired {
+		c.err = errResumeTimeout
+	}
+	c.mu.Unlock()
+
+	if expired {
+		c.finish()
+	}
+}
+
+// Park detaches the channel from the client while their connection stays up, so nothing is carried for it until Unpark.
+// The client keeps its end, e.g the shell, until it is unparked or gracePeriod after the connection closes
+func (c *Channel) Park() error {
+	if err := c.writeFrame(framePark, nil); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	ch := c.ch
+	if ch == nil || c.closed || c.peerClosed || c.err != nil {
+		c.mu.Unlock()
+		return io.EOF
+	}
+	c.ch = nil
+	c.gen++
+	c.parked = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	return ch.Close()
+}
+
+// Parked is whether the channel is parked and not yet attached again
+func (c *Channel) Parked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.parked && c.ch == nil
+}
+
+// Unpark attaches a parked channel to its connection again, and it carries on where it stopped. It does nothing if the channel is
+// not parked, or was already resumed by the client reconnecting
+func (c *Channel) Unpark() error {
+	c.mu.Lock()
+	parked := c.parked && c.ch == nil
+	conn := c.conn
+	c.mu.Unlock()
+
+	if !parked {
+		return nil
+	}
+
+	resumed, err := c.resumeOn(conn)
+	if err != nil {
+		return err
+	}
+
+	if resumed {
+		return nil
+	}
+
+	c.mu.Lock()
+	if c.ch != nil {
+		// Resumed by the client reconnecting meanwhile
+		c.mu.Unlock()
+		return nil
+	}
+	if c.err == nil {
+		c.err = errNotParked
+	}
+	err = c.err
+	c.mu.Unlock()
+
+	c.finish()
+	return err
+}
+
+// reattach replays what the peer has not received onto ch, and carries on using it
+func (c *Channel) reattach(conn ssh.Conn, ch ssh.Channel, reqs <-chan *ssh.Request, peerReceived uint64) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	start := c.sent - uint64(len(c.ring))
+	if peerReceived < start || peerReceived > c.sent {
+		c.err = errReplayLost
+		c.mu.Unlock()
+		c.finish()
+		return errReplayLost
+	}
+	replay := append([]byte(nil), c.ring[peerReceived-start:]...)
+	c.mu.Unlock()
+
+	if _, err := ch.Write(replay); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed || c.err != nil {
+		c.mu.Unlock()
+		return io.EOF
+	}
+	c.conn = conn
+	c.ch = ch
+	c.parked = false
+	gen := c.gen
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	go c.pump(gen, ch)
+	go c.forward(reqs)
+
+	return nil
+}
+
+func (c *Channel) currentConn() ssh.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+// finish ends the channel for good, it can no longer be resumed
+func (c *Channel) finish() {
+	c.finishOnce.Do(func() {
+		forget(c)
+
+		close(c.done)
+		c.reqMu.Lock()
+		close(c.requests)
+		c.reqMu.Unlock()
+
+		c.mu.Lock()
+		secure.Zero(c.secret)
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
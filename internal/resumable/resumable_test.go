@@ -0,0 +1,260 @@
+package resumable
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// connect returns a server side ssh.Conn, and serves channels on the client side with handlers, the way the rssh client does
+func connect(t *testing.T, handlers map[string]func(ssh.NewChannel, logger.Logger), resumable bool) (ssh.Conn, net.Conn) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	b, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientReady := make(chan struct{})
+	go func() {
+		defer close(clientReady)
+
+		conn, chans, reqs, err := ssh.NewClientConn(b, "", &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		all := map[string]func(ssh.NewChannel, logger.Logger){}
+		for k, v := range handlers {
+			all[k] = v
+		}
+		if resumable {
+			all[ChannelType] = Handler(conn, handlers)
+			all[ResumeChannelType] = Resumer(conn)
+		}
+		go func() {
+			for newChannel := range chans {
+				if h, ok := all[newChannel.ChannelType()]; ok {
+					go h(newChannel, logger.NewLog("client"))
+					continue
+				}
+				newChannel.Reject(ssh.UnknownChannelType, "unknown")
+			}
+		}()
+	}()
+
+	conn, chans, reqs, err := ssh.NewServerConn(a, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for newChannel := range chans {
+			newChannel.Reject(ssh.Prohibited, "")
+		}
+	}()
+	<-clientReady
+
+	return conn, a
+}
+
+func echo(newChannel ssh.NewChannel, log logger.Logger) {
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer ch.Close()
+
+	io.Copy(ch, ch)
+}
+
+func TestResumeAfterDrop(t *testing.T) {
+	handlers := map[string]func(ssh.NewChannel, logger.Logger){"echo": echo}
+
+	first, pipe := connect(t, handlers, true)
+
+	ch, _, err := Open(first, "owner", "echo", nil)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer ch.Close()
+
+	if _, ok := ch.(*Channel); !ok {
+		t.Fatalf("Open() returned %T, want a resumable channel", ch)
+	}
+
+	before := make([]byte, 200*1024)
+	rand.Read(before)
+	go ch.Write(before)
+
+	got := make([]byte, len(before))
+	if _, err := io.ReadFull(ch, got); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if !bytes.Equal(got, before) {
+		t.Fatal("echo before the drop did not match")
+	}
+
+	// The connection drops, and the session is written to while it is down
+	pipe.Close()
+
+	during := []byte("written while the client was away")
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := ch.Write(during)
+		writeDone <- err
+	}()
+
+	second, _ := connect(t, handlers, true)
+	Resume(second, "owner", logger.NewLog("server"))
+
+	select {
+	case err := <-writeDone:
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write during the drop was not resumed")
+	}
+
+	got = make([]byte, len(during))
+	if _, err := io.ReadFull(ch, got); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if !bytes.Equal(got, during) {
+		t.Fatalf("echo after resuming = %q, want %q", got, during)
+	}
+}
+
+func TestOpenFallsBackForOldClients(t *testing.T) {
+	conn, _ := connect(t, map[string]func(ssh.NewChannel, logger.Logger){"echo": echo}, false)
+
+	ch, _, err := Open(conn, "owner", "echo", nil)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer ch.Close()
+
+	if _, ok := ch.(*Channel); ok {
+		t.Fatal("Open() returned a resumable channel to a client that does not support them")
+	}
+
+	if _, err := ch.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(ch, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo = %q, %v", got, err)
+	}
+}
+
+func TestDetachKeepsPartialFrame(t *testing.T) {
+	c := &Channel{done: make(chan struct{}), requests: make(chan *ssh.Request)}
+	c.cond = sync.NewCond(&c.mu)
+
+	f := frame(frameData, []byte("split across connections"))
+
+	c.received = 7
+	c.partial = append(c.partial, f[:7]...)
+	c.decode()
+
+	received, ok := c.detach(-1)
+	if !ok || received != 7 {
+		t.Fatalf("detach() = %d, %v", received, ok)
+	}
+
+	// The peer replays from what was received, which is the rest of the frame
+	c.partial = append(c.partial, f[7:]...)
+	c.decode()
+
+	if c.err != nil || string(c.data) != "split across connections" {
+		t.Fatalf("data after resuming mid frame = %q, %v", c.data, c.err)
+	}
+}
+
+func TestParkAndUnpark(t *testing.T) {
+	conn, _ := connect(t, map[string]func(ssh.NewChannel, logger.Logger){"echo": echo}, true)
+
+	opened, _, err := Open(conn, "owner", "echo", nil)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer opened.Close()
+	ch := opened.(*Channel)
+
+	if _, err := ch.Write([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 6)
+	if _, err := io.ReadFull(ch, got); err != nil || string(got) != "before" {
+		t.Fatalf("echo before parking = %q, %v", got, err)
+	}
+
+	if err := ch.Park(); err != nil {
+		t.Fatalf("Park() error = %v", err)
+	}
+	if !ch.Parked() {
+		t.Fatal("channel should be parked")
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := ch.Write([]byte("after"))
+		written <- err
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("nothing should be sent while parked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := ch.Unpark(); err != nil {
+		t.Fatalf("Unpark() error = %v", err)
+	}
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	got = make([]byte, 5)
+	if _, err := io.ReadFull(ch, got); err != nil || string(got) != "after" {
+		t.Fatalf("echo after unparking = %q, %v", got, err)
+	}
+
+	if ch.currentConn() != conn {
+		t.Fatal("unparking should carry on over the same connection")
+	}
+}
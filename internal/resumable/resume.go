@@ -0,0 +1,252 @@
+package resumable
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+type openMsg struct {
+	ID          string
+	Secret      string
+	ChannelType string
+	ExtraData   string
+}
+
+type resumeMsg struct {
+	ID string
+}
+
+var (
+	registryMu sync.Mutex
+
+	// Channels this side opened, that the server resumes
+	opened = map[string]*Channel{}
+
+	// Channels this side accepted, that the client is asked to resume
+	accepted = map[string]*Channel{}
+)
+
+func forget(c *Channel) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if opened[c.id] == c {
+		delete(opened, c.id)
+	}
+	if accepted[c.id] == c {
+		delete(accepted, c.id)
+	}
+}
+
+// Open opens channelType on a client as a resumable channel, owner is the client's key fingerprint, as only that key may resume it.
+// Clients that do not support resumable channels get a plain one
+func Open(conn ssh.Conn, owner, channelType string, extraData []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	id := make([]byte, 16)
+	secret := make([]byte, secretSize)
+	rand.Read(id)
+	rand.Read(secret)
+
+	msg := openMsg{
+		ID:          hex.EncodeToString(id),
+		Secret:      string(secret),
+		ChannelType: channelType,
+		ExtraData:   string(extraData),
+	}
+
+	ch, reqs, err := conn.OpenChannel(ChannelType, ssh.Marshal(&msg))
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) && openErr.Reason == ssh.UnknownChannelType {
+			return conn.OpenChannel(channelType, extraData)
+		}
+		return nil, nil, err
+	}
+
+	c := newChannel(msg.ID, owner, secret, conn, ch, reqs)
+
+	registryMu.Lock()
+	opened[c.id] = c
+	registryMu.Unlock()
+
+	return c, c.requests, nil
+}
+
+// Resume moves channels owned by owner onto conn, a new connection from that client.
+// Clients that share a key reject channels they did not accept, so each is offered to every connection with the key
+func Resume(conn ssh.Conn, owner string, log logger.Logger) {
+	registryMu.Lock()
+	var candidates []*Channel
+	for _, c := range opened {
+		if c.owner == owner {
+			candidates = append(candidates, c)
+		}
+	}
+	registryMu.Unlock()
+
+	for _, c := range candidates {
+		if c.currentConn() == conn {
+			continue
+		}
+
+		resumed, err := c.resumeOn(conn)
+		if err != nil {
+			log.Warning("Unable to resume session %s: %s", c.id, err)
+			continue
+		}
+
+		if resumed {
+			log.Info("Resumed session %s", c.id)
+		}
+	}
+}
+
+func (c *Channel) resumeOn(conn ssh.Conn) (bool, error) {
+	ch, reqs, err := conn.OpenChannel(ResumeChannelType, ssh.Marshal(&resumeMsg{ID: c.id}))
+	if err != nil {
+		// Not this client's channel, or a client without resumable channels
+		return false, nil
+	}
+
+	hello := make([]byte, secretSize+8)
+	if _, err := io.ReadFull(ch, hello); err != nil {
+		ch.Close()
+		return false, err
+	}
+
+	if !secure.Equal(hello[:secretSize], c.secret) {
+		ch.Close()
+		return false, errors.New("client did not know the session secret")
+	}
+
+	received, ok := c.detach(-1)
+	if !ok {
+		ch.Close()
+		return false, nil
+	}
+
+	if _, err := ch.Write(binary.BigEndian.AppendUint64(nil, received)); err != nil {
+		ch.Close()
+		return false, err
+	}
+
+	if err := c.reattach(conn, ch, reqs, binary.BigEndian.Uint64(hello[secretSize:])); err != nil {
+		ch.Close()
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Handler accepts resumable channels on a client, passing them to the handler for the channel type they wrap
+func Handler(conn ssh.Conn, handlers map[string]func(newChannel ssh.NewChannel, log logger.Logger)) func(newChannel ssh.NewChannel, log logger.Logger) {
+	return func(newChannel ssh.NewChannel, log logger.Logger) {
+		var msg openMsg
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil || len(msg.Secret) != secretSize {
+			newChannel.Reject(ssh.ConnectionFailed, "invalid resumable channel request")
+			return
+		}
+
+		handler, ok := handlers[msg.ChannelType]
+		if !ok {
+			newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unsupported channel type: %s", msg.ChannelType))
+			return
+		}
+
+		handler(&pendingChannel{NewChannel: newChannel, conn: conn, msg: msg}, log)
+	}
+}
+
+// pendingChannel is the wrapped channel as its handler sees it
+type pendingChannel struct {
+	ssh.NewChannel
+	conn ssh.Conn
+	msg  openMsg
+}
+
+func (p *pendingChannel) ChannelType() string {
+	return p.msg.ChannelType
+}
+
+func (p *pendingChannel) ExtraData() []byte {
+	return []byte(p.msg.ExtraData)
+}
+
+func (p *pendingChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := p.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := newChannel(p.msg.ID, "", []byte(p.msg.Secret), p.conn, ch, reqs)
+
+	registryMu.Lock()
+	accepted[c.id] = c
+	registryMu.Unlock()
+
+	return c, c.requests, nil
+}
+
+// Resumer handles the server asking a client to move an accepted channel onto conn
+func Resumer(conn ssh.Conn) func(newChannel ssh.NewChannel, log logger.Logger) {
+	return func(newChannel ssh.NewChannel, log logger.Logger) {
+		var msg resumeMsg
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, "invalid resume request")
+			return
+		}
+
+		registryMu.Lock()
+		c := accepted[msg.ID]
+		registryMu.Unlock()
+
+		if c == nil {
+			newChannel.Reject(ssh.ConnectionFailed, "no such session")
+			return
+		}
+
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		received, ok := c.detach(-1)
+		if !ok {
+			ch.Close()
+			return
+		}
+
+		c.mu.Lock()
+		hello := binary.BigEndian.AppendUint64(append([]byte(nil), c.secret...), received)
+		c.mu.Unlock()
+
+		_, err = ch.Write(hello)
+		secure.Zero(hello)
+		if err != nil {
+			ch.Close()
+			return
+		}
+
+		peerReceived := make([]byte, 8)
+		if _, err := io.ReadFull(ch, peerReceived); err != nil {
+			ch.Close()
+			return
+		}
+
+		if err := c.reattach(conn, ch, reqs, binary.BigEndian.Uint64(peerReceived)); err != nil {
+			log.Warning("Unable to resume session: %s", err)
+			ch.Close()
+			return
+		}
+
+		log.Info("Session resumed")
+	}
+}
@@ -0,0 +1,38 @@
+// Package secure compares and clears key material.
+//
+// Secrets and the fingerprints that stand in for them are compared in constant time, so how long a check takes does not say how much of a guess was right.
+// Copies of keys are cleared once they have been parsed or derived from, long lived keys are kept for as long as they are in use.
+package secure
+
+import (
+	"crypto/subtle"
+	"runtime"
+)
+
+// Equal reports whether a and b are the same, in a time that only depends on their lengths
+func Equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// EqualString is Equal for strings, e.g hex fingerprints
+func EqualString(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// IsZero reports whether every byte of b is zero, without stopping at the first that is not
+func IsZero(b []byte) bool {
+	var acc byte
+	for _, v := range b {
+		acc |= v
+	}
+	return subtle.ConstantTimeByteEq(acc, 0) == 1
+}
+
+// Zero overwrites each of bs with zeros
+func Zero(bs ...[]byte) {
+	for _, b := range bs {
+		clear(b)
+	}
+	// Keep the writes from being optimised away as dead stores
+	runtime.KeepAlive(bs)
+}
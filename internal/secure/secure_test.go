@@ -0,0 +1,24 @@
+package secure
+
+import "testing"
+
+func TestEqual(t *testing.T) {
+	if !Equal([]byte("key"), []byte("key")) || Equal([]byte("key"), []byte("kez")) || Equal([]byte("key"), []byte("keys")) {
+		t.Fatal("Equal gave the wrong answer")
+	}
+	if !EqualString("ab12", "ab12") || EqualString("ab12", "ab13") || EqualString("", "ab12") {
+		t.Fatal("EqualString gave the wrong answer")
+	}
+}
+
+func TestZero(t *testing.T) {
+	a, b := []byte{1, 2, 3}, []byte{4}
+	if IsZero(a) {
+		t.Fatal("IsZero reported a non zero slice as zero")
+	}
+
+	Zero(a, b)
+	if !IsZero(a) || !IsZero(b) || !IsZero(nil) {
+		t.Fatalf("Zero left %v %v", a, b)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+)
+
+// How long a source that has authenticated is given priority for
+const knownSourceLifetime = 24 * time.Hour
+
+// AdmissionConfig limits how many ssh handshakes the main listener will run at once, so a flood of scanners cant starve real clients.
+// Zero values disable that limit
+type AdmissionConfig struct {
+	// Connections allowed to wait on protocol detection in the multiplexer, defaults to 1000 rather than unlimited
+	AcceptQueue int
+
+	MaxHandshakes          int
+	MaxHandshakesPerSource int
+
+	// Handshake slots that only sources which have recently authenticated may use
+	ReservedHandshakes int
+
+	// Maximum time a connection has to complete authentication
+	HandshakeTimeout time.Duration
+}
+
+type admissionController struct {
+	sync.Mutex
+
+	config AdmissionConfig
+
+	active    int
+	perSource map[string]int
+
+	// Addresses that have authenticated before, these are our only hint before the handshake that a connection is legitimate
+	known map[string]time.Time
+
+	lastRejectionLog time.Time
+	rejected         int
+}
+
+func newAdmissionController(config AdmissionConfig) *admissionController {
+	if config.ReservedHandshakes >= config.MaxHandshakes {
+		config.ReservedHandshakes = 0
+	}
+
+	return &admissionController{
+		config:    config,
+		perSource: map[string]int{},
+		known:     map[string]time.Time{},
+	}
+}
+
+// seedKnownSources marks addresses clients have recently connected from as known, so a server restart doesnt lose priority for reconnecting clients
+func (a *admissionController) seedKnownSources() {
+	ips, err := data.RecentClientSourceIPs(time.Now().Add(-knownSourceLifetime))
+	if err != nil {
+		log.Println("unable to load recent client addresses for admission control: ", err)
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	for _, ip := range ips {
+		a.known[ip] = time.Now()
+	}
+}
+
+func (a *admissionController) isKnown(source string) bool {
+	seen, ok := a.known[source]
+	if !ok {
+		return false
+	}
+
+	if time.Since(seen) > knownSourceLifetime {
+		delete(a.known, source)
+		return false
+	}
+
+	return true
+}
+
+// admit reserves a handshake slot for the connection, release must be called once the handshake has finished
+func (a *admissionController) admit(remoteAddr net.Addr) (release func(), ok bool) {
+	source := admissionSource(remoteAddr)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.config.MaxHandshakes > 0 {
+		limit := a.config.MaxHandshakes - a.config.ReservedHandshakes
+		if a.isKnown(source) {
+			limit = a.config.MaxHandshakes
+		}
+
+		if a.active >= limit {
+			a.logRejection("too many concurrent handshakes")
+			return nil, false
+		}
+	}
+
+	// Pivoted and relayed connections all share a fake source, so per source limits dont mean anything for them
+	if a.config.MaxHandshakesPerSource > 0 && isSourceTrusted(remoteAddr.Network()) && a.perSource[source] >= a.config.MaxHandshakesPerSource {
+		a.logRejection("too many concurrent handshakes from " + source)
+		return nil, false
+	}
+
+	a.active++
+	a.perSource[source]++
+
+	return func() {
+		a.Lock()
+		defer a.Unlock()
+
+		a.active--
+		a.perSource[source]--
+		if a.perSource[source] <= 0 {
+			delete(a.perSource, source)
+		}
+	}, true
+}
+
+// authenticated marks a source as known after it has completed a handshake
+func (a *admissionController) authenticated(remoteAddr net.Addr) {
+	if !isSourceTrusted(remoteAddr.Network()) {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.known[admissionSource(remoteAddr)] = time.Now()
+}
+
+// logRejection rate limits rejection messages, otherwise a flood would just become a log flood
+func (a *admissionController) logRejection(reason string) {
+	a.rejected++
+	if time.Since(a.lastRejectionLog) < 10*time.Second {
+		return
+	}
+
+	log.Printf("admission control rejected %d connection(s), most recently: %s", a.rejected, reason)
+	a.lastRejectionLog = time.Now()
+	a.rejected = 0
+}
+
+func admissionSource(remoteAddr net.Addr) string {
+	if !isSourceTrusted(remoteAddr.Network()) {
+		return remoteAddr.Network()
+	}
+
+	ip := getIP(remoteAddr.String())
+	if ip == nil {
+		return remoteAddr.String()
+	}
+
+	return ip.String()
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+type fakeAddr struct {
+	network, addr string
+}
+
+func (f fakeAddr) Network() string { return f.network }
+func (f fakeAddr) String() string  { return f.addr }
+
+func TestAdmissionReservedSlots(t *testing.T) {
+	a := newAdmissionController(AdmissionConfig{MaxHandshakes: 2, ReservedHandshakes: 1})
+
+	stranger := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	known := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+	a.authenticated(known)
+
+	release, ok := a.admit(stranger)
+	if !ok {
+		t.Fatal("first unknown connection should be admitted")
+	}
+
+	if _, ok := a.admit(&net.TCPAddr{IP: net.ParseIP("192.0.2.3"), Port: 1000}); ok {
+		t.Fatal("unknown connection should not be able to use the reserved slot")
+	}
+
+	releaseKnown, ok := a.admit(known)
+	if !ok {
+		t.Fatal("known source should be able to use the reserved slot")
+	}
+
+	if _, ok := a.admit(known); ok {
+		t.Fatal("known sources are still bound by the total limit")
+	}
+
+	release()
+	releaseKnown()
+	if _, ok := a.admit(stranger); !ok {
+		t.Fatal("released slot should be reusable")
+	}
+}
+
+func TestAdmissionPerSource(t *testing.T) {
+	a := newAdmissionController(AdmissionConfig{MaxHandshakesPerSource: 1})
+
+	if _, ok := a.admit(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}); !ok {
+		t.Fatal("first connection should be admitted")
+	}
+
+	if _, ok := a.admit(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1001}); ok {
+		t.Fatal("second concurrent connection from the same address should be rejected")
+	}
+
+	if _, ok := a.admit(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}); !ok {
+		t.Fatal("other addresses should be unaffected")
+	}
+
+	// Pivoted connections all look like the same source, so arent capped
+	pivot := fakeAddr{network: remoteForwardAddrNetwork, addr: "127.0.0.1:1"}
+	for i := 0; i < 3; i++ {
+		if _, ok := a.admit(pivot); !ok {
+			t.Fatal("pivoted connections should not be limited per source")
+		}
+	}
+}
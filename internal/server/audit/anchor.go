@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+)
+
+const DefaultAnchorInterval = time.Hour
+
+var anchorInterval = DefaultAnchorInterval
+
+// SetAnchorInterval changes how often chain heads are anchored
+func SetAnchorInterval(interval time.Duration) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	anchorInterval = interval
+}
+
+// Anchor sends the head of every changed chain to webhooks and records it in anchorLog, at startup and then every anchor interval.
+// A copy held outside the server pins the log up to that point, even against someone able to rewrite both the log and its chain
+func Anchor(ctx context.Context, anchorLog string) {
+	lck.Lock()
+	interval := anchorInterval
+	lck.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	anchored := map[string]string{}
+	for {
+		heads := Heads()
+		sort.Slice(heads, func(i, j int) bool {
+			return heads[i].Path < heads[j].Path
+		})
+
+		for _, head := range heads {
+			// Anchoring the anchor log would make a new anchor every time
+			if head.Path == anchorLog || head.Offset == 0 || anchored[head.Path] == head.SHA256 {
+				continue
+			}
+
+			a := observers.AuditAnchor{
+				File:      filepath.Base(head.Path),
+				Offset:    head.Offset,
+				SHA256:    head.SHA256,
+				Timestamp: time.Now(),
+			}
+
+			line, err := a.Json()
+			if err != nil {
+				log.Println("unable to encode audit anchor:", err)
+				continue
+			}
+
+			if err := Append(anchorLog, append(line, '\n')); err != nil {
+				log.Println("unable to record audit anchor:", err)
+			}
+
+			observers.AuditAnchors.Notify(a)
+			anchored[head.Path] = head.SHA256
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
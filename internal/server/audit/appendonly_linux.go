@@ -0,0 +1,31 @@
+package audit
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// FS_APPEND_FL from linux/fs.h, not exported by x/sys
+const fsAppendFlag = 0x00000020
+
+// appendOnly sets the filesystem append only attribute, so the file cannot be changed or removed without first
+// clearing it, which needs CAP_LINUX_IMMUTABLE
+func appendOnly(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+
+	if flags&fsAppendFlag != 0 {
+		return nil
+	}
+
+	return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags|fsAppendFlag))
+}
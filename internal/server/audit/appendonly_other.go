@@ -0,0 +1,9 @@
+//go:build !linux
+
+package audit
+
+import "errors"
+
+func appendOnly(path string) error {
+	return errors.New("append only files are not supported on this platform")
+}
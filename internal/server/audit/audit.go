@@ -0,0 +1,293 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Under legal hold every write to an audit log is chained with sha256 in a .chain file next to it, record n being
+// "<end offset> <sha256(hash n-1 || bytes since the last record)>". Changing, removing or reordering anything already written breaks the chain,
+// and the chain heads are anchored outside the server (see Anchor) so the chain itself cannot be quietly rewritten either
+
+const chainSuffix = ".chain"
+
+type chain struct {
+	offset int64
+	sum    []byte
+
+	// Set once the log and its chain have been made append only, or that has failed
+	sealed bool
+}
+
+var (
+	lck sync.Mutex
+
+	legalHold bool
+	chains    = map[string]*chain{}
+
+	// Replaced in tests, so the files can be tampered with and cleaned up
+	makeAppendOnly = appendOnly
+)
+
+// EnableLegalHold turns on write once mode for the audit logs at paths, logs that already exist are chained from their current contents
+func EnableLegalHold(paths ...string) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	legalHold = true
+
+	for _, path := range paths {
+		if _, err := loadChain(path); err != nil {
+			return fmt.Errorf("unable to put %s under legal hold: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// LegalHold reports whether audit logs are write once
+func LegalHold() bool {
+	lck.Lock()
+	defer lck.Unlock()
+
+	return legalHold
+}
+
+// Append adds content to the audit log at path, chaining it when under legal hold
+func Append(path string, content []byte) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !legalHold {
+		_, err = f.Write(content)
+		return err
+	}
+
+	c, err := loadChain(path)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Size() < c.offset:
+		log.Printf("[WARNING] audit log %s is shorter than when it was last written (%d < %d bytes), it has been truncated", path, info.Size(), c.offset)
+	case info.Size() > c.offset:
+		// Written by something other than the server, chain it on its own so it is at least pinned from now on
+		log.Printf("[WARNING] audit log %s was written outside the server (%d unchained bytes)", path, info.Size()-c.offset)
+		if err := c.extend(path, c.offset, info.Size()); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.Write(content); err != nil {
+		return err
+	}
+
+	if err := c.add(path, content, info.Size()+int64(len(content))); err != nil {
+		return err
+	}
+
+	c.seal(path)
+	return nil
+}
+
+// loadChain reads the chain for path, starting one over the log's current contents if there is none
+func loadChain(path string) (*chain, error) {
+	if c, ok := chains[path]; ok {
+		return c, nil
+	}
+
+	c := &chain{}
+
+	records, err := readChain(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(records) > 0 {
+		last := records[len(records)-1]
+		c.offset, c.sum = last.offset, last.sum
+	} else if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		if err := c.extend(path, 0, info.Size()); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.offset > 0 {
+		c.seal(path)
+	}
+
+	chains[path] = c
+	return c, nil
+}
+
+// seal makes the log and its chain append only, where the platform and the server's privileges allow
+func (c *chain) seal(path string) {
+	if c.sealed {
+		return
+	}
+	c.sealed = true
+
+	for _, p := range []string{path, path + chainSuffix} {
+		if err := makeAppendOnly(p); err != nil {
+			log.Printf("unable to mark %s append only, it is still chained: %s", p, err)
+		}
+	}
+}
+
+// extend chains bytes [from, to) of the log as one record
+func (c *chain) extend(path string, from, to int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	content := make([]byte, to-from)
+	if _, err := f.ReadAt(content, from); err != nil {
+		return err
+	}
+
+	return c.add(path, content, to)
+}
+
+func (c *chain) add(path string, content []byte, offset int64) error {
+	h := sha256.New()
+	h.Write(c.sum)
+	h.Write(content)
+	sum := h.Sum(nil)
+
+	f, err := os.OpenFile(path+chainSuffix, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%d %s\n", offset, hex.EncodeToString(sum)); err != nil {
+		return err
+	}
+
+	c.offset, c.sum = offset, sum
+	return nil
+}
+
+type record struct {
+	offset int64
+	sum    []byte
+}
+
+func readChain(path string) ([]record, error) {
+	f, err := os.Open(path + chainSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []record
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		offset, sum, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok {
+			return nil, fmt.Errorf("%s%s line %d is malformed", path, chainSuffix, line)
+		}
+
+		r := record{}
+		if r.offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+			return nil, fmt.Errorf("%s%s line %d has a bad offset: %w", path, chainSuffix, line, err)
+		}
+		if r.sum, err = hex.DecodeString(sum); err != nil || len(r.sum) != sha256.Size {
+			return nil, fmt.Errorf("%s%s line %d has a bad hash", path, chainSuffix, line)
+		}
+
+		records = append(records, r)
+	}
+
+	return records, scanner.Err()
+}
+
+// Verify checks the audit log at path against its chain, returning the chain head if everything written is untouched
+func Verify(path string) (head Head, err error) {
+	records, err := readChain(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return head, errors.New("log has no chain, it was not written under legal hold")
+		}
+		return head, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return head, err
+	}
+	defer f.Close()
+
+	var (
+		previous []byte
+		at       int64
+	)
+	for i, r := range records {
+		if r.offset < at {
+			return head, fmt.Errorf("chain record %d goes backwards", i+1)
+		}
+
+		h := sha256.New()
+		h.Write(previous)
+		if _, err := io.CopyN(h, f, r.offset-at); err != nil {
+			return head, fmt.Errorf("log is shorter than chain record %d says (%d bytes), it has been truncated", i+1, r.offset)
+		}
+
+		if !bytes.Equal(h.Sum(nil), r.sum) {
+			return head, fmt.Errorf("bytes %d to %d do not match chain record %d, the log has been changed", at, r.offset, i+1)
+		}
+
+		previous, at = r.sum, r.offset
+	}
+
+	if extra, _ := io.Copy(io.Discard, f); extra > 0 {
+		return head, fmt.Errorf("%d bytes after the last chain record (offset %d) are not chained", extra, at)
+	}
+
+	return Head{Path: path, Offset: at, SHA256: hex.EncodeToString(previous)}, nil
+}
+
+// Head is where an audit log's chain is up to
+type Head struct {
+	Path   string
+	Offset int64
+	SHA256 string
+}
+
+// Heads returns the chain head of every log under legal hold
+func Heads() []Head {
+	lck.Lock()
+	defer lck.Unlock()
+
+	heads := make([]Head, 0, len(chains))
+	for path, c := range chains {
+		heads = append(heads, Head{Path: path, Offset: c.offset, SHA256: hex.EncodeToString(c.sum)})
+	}
+
+	return heads
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLegalHoldChain(t *testing.T) {
+	makeAppendOnly = func(string) error { return nil }
+	t.Cleanup(func() {
+		legalHold, chains, makeAppendOnly = false, map[string]*chain{}, appendOnly
+	})
+
+	path := filepath.Join(t.TempDir(), "watch.log")
+
+	// Written before legal hold was turned on
+	if err := Append(path, []byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EnableLegalHold(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if err := Append(path, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	head, err := Verify(path)
+	if err != nil {
+		t.Fatalf("untouched log failed to verify: %s", err)
+	}
+
+	heads := Heads()
+	if len(heads) != 1 || heads[0] != head || head.Offset != int64(len("before\nfirst\nsecond\n")) {
+		t.Fatalf("chain head %+v does not match the verified head %+v", heads, head)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Replace(string(content), "first", "fir5t", 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(path); err == nil {
+		t.Fatal("changed log verified")
+	}
+
+	if err := os.WriteFile(path, content[:len(content)-3], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(path); err == nil {
+		t.Fatal("truncated log verified")
+	}
+
+	if err := os.WriteFile(path, append(content, "extra\n"...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(path); err == nil {
+		t.Fatal("log with unchained additions verified")
+	}
+}
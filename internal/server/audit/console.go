@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The console log records every console command: who ran it with which key, the clients it named, and whether it worked. Each line is a json
+// object chained to the one before it with sha256, so a line changed, removed or reordered is found by audit verify whether or not the server
+// is under legal hold. Under legal hold the file is chained as a whole as well, like the other audit logs
+
+// ConsoleEntry is one command in the console log
+type ConsoleEntry struct {
+	Time time.Time `json:"time"`
+
+	User        string `json:"user"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Connection  string `json:"connection,omitempty"`
+
+	// console or exec
+	Source  string   `json:"source"`
+	Command string   `json:"command"`
+	Targets []string `json:"targets,omitempty"`
+
+	// ok, or error with Error saying why
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	Previous string `json:"previous"`
+	Hash     string `json:"hash"`
+}
+
+func (e ConsoleEntry) sum() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+var (
+	consoleLck  sync.Mutex
+	consoleLog  string
+	consoleHead string
+)
+
+// SetConsoleLog starts recording commands to the console log at path, carrying on the chain of what is already there
+func SetConsoleLog(path string) error {
+	consoleLck.Lock()
+	defer consoleLck.Unlock()
+
+	entries, err := ReadConsoleLog(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	consoleLog = path
+	consoleHead = ""
+	if len(entries) > 0 {
+		consoleHead = entries[len(entries)-1].Hash
+	}
+
+	return nil
+}
+
+// RecordCommand chains e onto the console log, it does nothing if there is no console log
+func RecordCommand(e ConsoleEntry) error {
+	consoleLck.Lock()
+	defer consoleLck.Unlock()
+
+	if consoleLog == "" {
+		return nil
+	}
+
+	e.Time = e.Time.UTC()
+	e.Previous = consoleHead
+	e.Hash = e.sum()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := Append(consoleLog, append(line, '\n')); err != nil {
+		return err
+	}
+
+	consoleHead = e.Hash
+	return nil
+}
+
+// ConsoleLog is the path of the console log, empty if commands are not being recorded
+func ConsoleLog() string {
+	consoleLck.Lock()
+	defer consoleLck.Unlock()
+
+	return consoleLog
+}
+
+// ReadConsoleLog reads every entry of the console log at path, oldest first
+func ReadConsoleLog(path string) ([]ConsoleEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ConsoleEntry
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e ConsoleEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("line %d of %s is not a console log entry: %w", line, path, err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// VerifyConsoleLog checks every entry of the console log at path is unchanged and in order, returning how many there are
+func VerifyConsoleLog(path string) (int, error) {
+	entries, err := ReadConsoleLog(path)
+	if err != nil {
+		return 0, err
+	}
+
+	previous := ""
+	for i, e := range entries {
+		if e.Previous != previous {
+			return i, fmt.Errorf("entry %d (%s) does not follow the one before it, entries have been removed or reordered", i+1, e.Time.Format(time.RFC3339))
+		}
+
+		if e.sum() != e.Hash {
+			return i, fmt.Errorf("entry %d (%s) has been changed", i+1, e.Time.Format(time.RFC3339))
+		}
+
+		previous = e.Hash
+	}
+
+	return len(entries), nil
+}
@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsoleLogChain(t *testing.T) {
+	t.Cleanup(func() {
+		consoleLog, consoleHead = "", ""
+	})
+
+	path := filepath.Join(t.TempDir(), "console.log")
+	if err := SetConsoleLog(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, command := range []string{"ls", "exec webserver id", "kill webserver"} {
+		if err := RecordCommand(ConsoleEntry{Time: time.Now(), User: "alice", Command: command, Status: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Restarting carries on the same chain
+	if err := SetConsoleLog(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordCommand(ConsoleEntry{Time: time.Now(), User: "bob", Command: "who", Status: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := VerifyConsoleLog(path); err != nil || n != 4 {
+		t.Fatalf("untouched console log failed to verify: %d %v", n, err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+
+	tampered := map[string]string{
+		"changed": strings.Replace(string(content), "exec webserver id", "exec webserver ls", 1),
+		"removed": lines[0] + lines[2] + lines[3],
+	}
+	for name, content := range tampered {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := VerifyConsoleLog(path); err == nil || n != 1 {
+			t.Fatalf("%s entry should fail verification after 1 good entry, got %d %v", name, n, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+// Any of the key files can hold certificate authorities, as with OpenSSH a line with the cert-authority option lets in certificates
+// the key signed rather than the key itself, e.g:
+//
+//	cert-authority,principals="ops" ssh-ed25519 AAAA... operators ca
+//
+// Certificates must be user certificates, inside their validity window, and for one of the principals on the line, or for the username
+// logging in when the line has none. The line's other options (from, expires, owner and so on) apply to every certificate it lets in.
+// source-address is the only critical option understood, certificates with any other are refused as OpenSSH would.
+
+const (
+	certAuthorityOption = "cert-authority"
+
+	// Certificate extensions the link command sets on the client certificates it mints, see webserver/certificates.go
+	certOwnersExtension   = "owner@rssh"
+	certCampaignExtension = "campaign@rssh"
+)
+
+// checkCertificate finds the authority in keys that signed cert and checks the certificate is valid for username from src
+func checkCertificate(keys map[string]Options, cert *ssh.Certificate, username string, src net.IP, sourceTrusted bool) (Options, error) {
+	opt, ok := keys[string(ssh.MarshalAuthorizedKey(cert.SignatureKey))]
+	if !ok || !opt.CertAuthority {
+		return opt, ErrKeyNotInList
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return opt, fmt.Errorf("not authorized: host certificate %q used to log in", cert.KeyId)
+	}
+
+	if internal.StrictCrypto {
+		if err := internal.CheckStrictKey(cert.SignatureKey); err != nil {
+			return opt, fmt.Errorf("not authorized: certificate authority %s with --strict-crypto", err)
+		}
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		return opt, fmt.Errorf("not authorized: certificate %q has no principals", cert.KeyId)
+	}
+
+	// Empty when the username is not known yet, e.g checking a polling transport key, the principal is then checked when the session logs in
+	principal := ""
+	wanted := opt.Principals
+	if len(wanted) == 0 && username != "" {
+		wanted = []string{username}
+	}
+	if len(wanted) > 0 {
+		i := slices.IndexFunc(wanted, func(p string) bool {
+			return slices.Contains(cert.ValidPrincipals, p)
+		})
+		if i == -1 {
+			return opt, fmt.Errorf("not authorized: certificate %q is not valid for %s", cert.KeyId, strings.Join(wanted, " or "))
+		}
+		principal = wanted[i]
+	} else {
+		principal = cert.ValidPrincipals[0]
+	}
+
+	checker := ssh.CertChecker{
+		SupportedCriticalOptions: []string{"source-address"},
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return opt, fmt.Errorf("not authorized: %w", err)
+	}
+
+	if addresses, ok := cert.CriticalOptions["source-address"]; ok {
+		if !sourceTrusted {
+			return opt, fmt.Errorf("not authorized: certificate source-address cannot be evaluated on this transport")
+		}
+
+		allowed, err := sourceAddressAllows(addresses, src)
+		if err != nil {
+			return opt, fmt.Errorf("not authorized: certificate %q has an invalid source-address: %w", cert.KeyId, err)
+		}
+		if !allowed {
+			return opt, fmt.Errorf("not authorized: certificate %q is not valid from %s", cert.KeyId, src)
+		}
+	}
+
+	return opt, nil
+}
+
+// sourceAddressAllows checks src against the comma separated addresses and CIDRs of a source-address critical option
+func sourceAddressAllows(addresses string, src net.IP) (bool, error) {
+	if src == nil {
+		return false, nil
+	}
+
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+
+		if _, network, err := net.ParseCIDR(address); err == nil {
+			if network.Contains(src) {
+				return true, nil
+			}
+			continue
+		}
+
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return false, fmt.Errorf("%q is not an address or CIDR", address)
+		}
+		if ip.Equal(src) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// addCertificateExtensions records what a connection's certificate says about it. The client is identified by the certificate's key,
+// so it keeps its id and listeners when the certificate is renewed
+func addCertificateExtensions(extensions map[string]string, cert *ssh.Certificate, opt *Options) {
+	extensions["pubkey-fp"] = internal.FingerprintSHA1Hex(cert.Key)
+	extensions["comment"] = cert.KeyId
+	extensions["cert-authority"] = internal.FingerprintSHA256Hex(cert.SignatureKey)
+	extensions["cert-serial"] = strconv.FormatUint(cert.Serial, 10)
+
+	// Signed by the authority, so as trustworthy as the authority's own line
+	if len(opt.Owners) == 0 && cert.Extensions[certOwnersExtension] != "" {
+		opt.Owners = strings.Split(cert.Extensions[certOwnersExtension], ",")
+		extensions["owners"] = cert.Extensions[certOwnersExtension]
+	}
+	if opt.Campaign == "" && cert.Extensions[certCampaignExtension] != "" {
+		opt.Campaign = cert.Extensions[certCampaignExtension]
+		extensions["campaign"] = opt.Campaign
+	}
+
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		if opt.Expires.IsZero() || validBefore.Before(opt.Expires) {
+			opt.Expires = validBefore
+		}
+	}
+}
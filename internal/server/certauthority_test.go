@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCheckAuthCertificates(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysPath := filepath.Join(t.TempDir(), "authorized_controllee_keys")
+	line := `cert-authority,principals="rssh-client" ` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey()))) + " test ca\n"
+	if err := os.WriteFile(keysPath, []byte(line), 0600); err != nil {
+		t.Fatalf("failed to write temporary key file: %v", err)
+	}
+
+	key := generateTestPublicKey(t)
+	mint := func(change func(*ssh.Certificate)) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             key,
+			Serial:          7,
+			CertType:        ssh.UserCert,
+			KeyId:           "implant",
+			ValidPrincipals: []string{"rssh-client"},
+			ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+			Permissions: ssh.Permissions{
+				CriticalOptions: map[string]string{},
+				Extensions:      map[string]string{certOwnersExtension: "jsmith"},
+			},
+		}
+		if change != nil {
+			change(cert)
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	perms, err := CheckAuthWithSourceTrust(keysPath, mint(nil), "client", net.ParseIP("10.0.0.1"), false, true)
+	if err != nil {
+		t.Fatalf("valid certificate refused: %v", err)
+	}
+	if perms.Extensions["pubkey-fp"] != internal.FingerprintSHA1Hex(key) {
+		t.Fatalf("client should be identified by the certificate's key, got %q", perms.Extensions["pubkey-fp"])
+	}
+	if perms.Extensions["owners"] != "jsmith" {
+		t.Fatalf("owners should come from the certificate, got %q", perms.Extensions["owners"])
+	}
+
+	if _, err := CheckAuthWithSourceTrust(keysPath, key, "client", net.ParseIP("10.0.0.1"), false, true); err == nil {
+		t.Fatalf("the plain key of a certificate authority line should not be let in")
+	}
+
+	refused := map[string]func(*ssh.Certificate){
+		"wrong principal":  func(c *ssh.Certificate) { c.ValidPrincipals = []string{"someone"} },
+		"expired":          func(c *ssh.Certificate) { c.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix()) },
+		"host certificate": func(c *ssh.Certificate) { c.CertType = ssh.HostCert },
+		"unknown critical option": func(c *ssh.Certificate) {
+			c.CriticalOptions["force-command"] = "id"
+		},
+		"wrong source address": func(c *ssh.Certificate) {
+			c.CriticalOptions["source-address"] = "192.168.0.0/16"
+		},
+	}
+	for name, change := range refused {
+		if _, err := CheckAuthWithSourceTrust(keysPath, mint(change), "client", net.ParseIP("10.0.0.1"), false, true); err == nil {
+			t.Fatalf("%s: certificate should be refused", name)
+		}
+	}
+
+	restricted := mint(func(c *ssh.Certificate) { c.CriticalOptions["source-address"] = "10.0.0.0/8" })
+	if _, err := CheckAuthWithSourceTrust(keysPath, restricted, "client", net.ParseIP("10.0.0.1"), false, true); err != nil {
+		t.Fatalf("certificate from an allowed source refused: %v", err)
+	}
+	if _, err := CheckAuthWithSourceTrust(keysPath, restricted, "client", nil, false, false); err == nil {
+		t.Fatalf("source-address should not be let in when the source cannot be trusted")
+	}
+}
@@ -0,0 +1,266 @@
+package clientlimits
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+)
+
+// Limits on what a client connection may do, so a hijacked client or a runaway job cannot move unbounded data or stay connected forever.
+// Set per key with the max-transfer and max-session options in authorized_controllee_keys, or per campaign and globally with client-limits
+const (
+	TransferOption = "max-transfer"
+	DurationOption = "max-session"
+)
+
+// How often connections are checked against their limits
+const checkInterval = time.Second
+
+type Limits struct {
+	// Bytes read and written in any hour, counted per client (key and hostname) so reconnecting does not start again. Zero is unlimited
+	Transfer int64
+	// How long one connection may last before the client has to reconnect and authenticate again. Zero is unlimited
+	Duration time.Duration
+}
+
+// ParseOption sets the limit named by an authorized_keys option, ok is false if the option is not a client limit
+func (l *Limits) ParseOption(name, value string) (ok bool, err error) {
+	value = strings.Trim(value, "\"")
+
+	switch name {
+	case TransferOption:
+		n, err := users.ParseBandwidth(value)
+		if err != nil {
+			return true, fmt.Errorf("invalid %s %q, expected e.g 500M or 10G", name, value)
+		}
+		l.Transfer = n
+	case DurationOption:
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return true, fmt.Errorf("invalid %s %q, expected e.g 30m or 8h", name, value)
+		}
+		l.Duration = d
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// AddExtensions records the limits in the permissions of a connection
+func (l Limits) AddExtensions(extensions map[string]string) {
+	if l.Transfer > 0 {
+		extensions[TransferOption] = strconv.FormatInt(l.Transfer, 10)
+	}
+	if l.Duration > 0 {
+		extensions[DurationOption] = l.Duration.String()
+	}
+}
+
+func fromExtensions(extensions map[string]string) (l Limits) {
+	l.Transfer, _ = strconv.ParseInt(extensions[TransferOption], 10, 64)
+	l.Duration, _ = time.ParseDuration(extensions[DurationOption])
+	return l
+}
+
+// orElse fills in what l leaves unlimited from fallback
+func (l Limits) orElse(fallback Limits) Limits {
+	if l.Transfer == 0 {
+		l.Transfer = fallback.Transfer
+	}
+	if l.Duration == 0 {
+		l.Duration = fallback.Duration
+	}
+	return l
+}
+
+func (l Limits) Unlimited() bool {
+	return l.Transfer == 0 && l.Duration == 0
+}
+
+func (l Limits) String() string {
+	transfer, duration := "unlimited", "unlimited"
+	if l.Transfer > 0 {
+		transfer = fmt.Sprintf("%d bytes/hour", l.Transfer)
+	}
+	if l.Duration > 0 {
+		duration = l.Duration.String()
+	}
+	return fmt.Sprintf("transfer: %s, session: %s", transfer, duration)
+}
+
+// FromPolicy converts a stored client-limits policy
+func FromPolicy(p data.ClientLimit) Limits {
+	return Limits{
+		Transfer: p.Transfer,
+		Duration: time.Duration(p.Duration) * time.Second,
+	}
+}
+
+// For returns the limits of a client connection, each taken from its key if set there, then its campaign's policy, then the global policy
+func For(extensions map[string]string) (Limits, error) {
+	l := fromExtensions(extensions)
+
+	policies, err := data.GetClientLimits()
+	if err != nil {
+		return l, err
+	}
+
+	var campaign, global Limits
+	for _, p := range policies {
+		switch p.Campaign {
+		case "":
+			global = FromPolicy(p)
+		case extensions["campaign"]:
+			campaign = FromPolicy(p)
+		}
+	}
+
+	return l.orElse(campaign).orElse(global), nil
+}
+
+// usage is how much a client has moved in each of the last 60 minutes
+type usage struct {
+	minutes [60]int64
+	// Which minute (unix time / 60) each slot is counting
+	stamps [60]int64
+}
+
+func (u *usage) add(now time.Time, n int64) {
+	minute := now.Unix() / 60
+	slot := minute % 60
+	if u.stamps[slot] != minute {
+		u.stamps[slot] = minute
+		u.minutes[slot] = 0
+	}
+	u.minutes[slot] += n
+}
+
+func (u *usage) total(now time.Time) (total int64) {
+	minute := now.Unix() / 60
+	for i, stamp := range u.stamps {
+		if minute-stamp < 60 {
+			total += u.minutes[i]
+		}
+	}
+	return total
+}
+
+var (
+	lck    sync.Mutex
+	usages = map[string]*usage{}
+)
+
+// Client is who usage is charged to, clients built with the same key are told apart by hostname
+func Client(fingerprint, hostname string) string {
+	return fingerprint + "/" + hostname
+}
+
+// Admit refuses a client that has already moved its transfer limit in the last hour
+func Admit(client string, l Limits) error {
+	if l.Transfer == 0 {
+		return nil
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	now := time.Now()
+
+	// Clients that have not moved anything in an hour are forgotten
+	for c, u := range usages {
+		if u.total(now) == 0 {
+			delete(usages, c)
+		}
+	}
+
+	u := usages[client]
+	if u == nil {
+		return nil
+	}
+
+	if used := u.total(now); used >= l.Transfer {
+		return fmt.Errorf("%s has moved %d bytes in the last hour, its limit is %d", client, used, l.Transfer)
+	}
+	return nil
+}
+
+// Enforce calls cutoff once, when the connection has lasted longer than l.Duration or the client has moved more than l.Transfer in an hour.
+// Everything read and written through counter is charged to client. stop must be called when the connection ends
+func Enforce(client string, l Limits, counter *traffic.Counter, cutoff func(reason string)) (stop func()) {
+	if l.Unlimited() {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(checkInterval)
+	stopChecks := enforce(client, l, counter, time.Now(), ticker.C, cutoff)
+
+	return func() {
+		stopChecks()
+		ticker.Stop()
+	}
+}
+
+// enforce checks the connection on every tick. Where it started, in time and bytes, is taken before returning so nothing moved
+// between the call and the first check goes uncharged
+func enforce(client string, l Limits, counter *traffic.Counter, started time.Time, ticks <-chan time.Time, cutoff func(reason string)) (stop func()) {
+	last := counter.Bytes()
+
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticks:
+				current := counter.Bytes()
+				moved := int64(current - last)
+				last = current
+
+				if reason := charge(client, l, moved, now); reason != "" {
+					cutoff(reason)
+					return
+				}
+
+				if l.Duration > 0 && now.Sub(started) >= l.Duration {
+					cutoff(fmt.Sprintf("connected for longer than %s", l.Duration))
+					return
+				}
+			}
+		}
+	}()
+
+	return stop
+}
+
+func charge(client string, l Limits, moved int64, now time.Time) (reason string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	u := usages[client]
+	if u == nil {
+		u = &usage{}
+		usages[client] = u
+	}
+	u.add(now, moved)
+
+	if l.Transfer > 0 {
+		if used := u.total(now); used > l.Transfer {
+			return fmt.Sprintf("moved %d bytes in the last hour, over the %d byte limit", used, l.Transfer)
+		}
+	}
+	return ""
+}
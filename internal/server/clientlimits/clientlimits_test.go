@@ -0,0 +1,126 @@
+package clientlimits
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
+)
+
+func TestLimitsPrecedence(t *testing.T) {
+	if err := data.LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := data.SaveClientLimit(data.ClientLimit{Transfer: 1 << 30, Duration: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SaveClientLimit(data.ClientLimit{Campaign: "payroll", Transfer: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	var key Limits
+	if _, err := key.ParseOption(DurationOption, `"30m"`); err != nil {
+		t.Fatal(err)
+	}
+
+	extensions := map[string]string{"campaign": "payroll"}
+	key.AddExtensions(extensions)
+
+	l, err := For(extensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Transfer != 1<<20 || l.Duration != 30*time.Minute {
+		t.Fatalf("expected the campaign's transfer and the key's session limit, got %s", l)
+	}
+
+	l, err = For(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Transfer != 1<<30 || l.Duration != time.Hour {
+		t.Fatalf("expected the global policy, got %s", l)
+	}
+}
+
+// resetUsage forgets what every client has moved, usage is kept between connections so it outlives each test
+func resetUsage(t *testing.T) {
+	reset := func() {
+		lck.Lock()
+		defer lck.Unlock()
+		usages = map[string]*usage{}
+	}
+
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestTransferCutoff(t *testing.T) {
+	resetUsage(t)
+
+	limits := Limits{Transfer: 1024}
+	client := Client("fp", "host")
+
+	server, remote := net.Pipe()
+	defer remote.Close()
+
+	counter := &traffic.Counter{}
+	conn := traffic.NewConn(server, counter)
+	go io.Copy(io.Discard, remote)
+
+	ticks := make(chan time.Time)
+	cutoff := make(chan string, 1)
+	stop := enforce(client, limits, counter, time.Now(), ticks, func(reason string) {
+		cutoff <- reason
+		conn.Close()
+	})
+	defer stop()
+
+	// Moved before the first check, which must still be charged
+	buf := make([]byte, 512)
+	for i := 0; i < 3; i++ {
+		conn.Write(buf)
+	}
+
+	ticks <- time.Now()
+	<-cutoff
+
+	if err := Admit(client, limits); err == nil {
+		t.Fatal("client over its transfer limit was let back in")
+	}
+
+	if err := Admit(Client("fp", "other"), limits); err != nil {
+		t.Fatalf("another host with the same key should have its own limit: %s", err)
+	}
+}
+
+func TestDurationCutoff(t *testing.T) {
+	resetUsage(t)
+
+	started := time.Now()
+	ticks := make(chan time.Time)
+	cutoff := make(chan string, 1)
+	stop := enforce(Client("fp", "host"), Limits{Duration: time.Hour}, &traffic.Counter{}, started, ticks, func(reason string) {
+		cutoff <- reason
+	})
+	defer stop()
+
+	ticks <- started.Add(59 * time.Minute)
+	// Only taken once the first tick has been checked
+	ticks <- started.Add(59 * time.Minute)
+	select {
+	case reason := <-cutoff:
+		t.Fatalf("client was cut off before its session limit: %s", reason)
+	default:
+	}
+
+	ticks <- started.Add(time.Hour)
+	<-cutoff
+}
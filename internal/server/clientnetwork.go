@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+const asnLookupTimeout = 3 * time.Second
+
+// Whether client source addresses are resolved to an ASN and country, this leaks client addresses to public DNS so is opt in
+var clientASNLookup bool
+
+type clientNetwork struct {
+	IP      string
+	Network string
+	ASN     string
+	Country string
+}
+
+// defaultNetwork is used when the announced prefix cant be looked up, a /24 or /48 is roughly what a single site gets
+func defaultNetwork(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// cymruQueryName builds the team cymru IP to ASN DNS name for an address
+// https://www.team-cymru.com/ip-asn-mapping
+func cymruQueryName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.origin.asn.cymru.com", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	const hex = "0123456789abcdef"
+
+	v6 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(v6) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hex[v6[i]&0x0f]), string(hex[v6[i]>>4]))
+	}
+
+	return strings.Join(nibbles, ".") + ".origin6.asn.cymru.com"
+}
+
+// parseCymruRecord parses records of the form "15169 | 8.8.8.0/24 | US | arin | 2023-12-28"
+func parseCymruRecord(record string) (asn, prefix, country string, err error) {
+	parts := strings.Split(record, "|")
+	if len(parts) < 3 {
+		return "", "", "", fmt.Errorf("malformed asn record %q", record)
+	}
+
+	// Prefixes announced by multiple origins list all of them, the first is good enough
+	asns := strings.Fields(parts[0])
+	if len(asns) == 0 {
+		return "", "", "", fmt.Errorf("asn record %q had no origin", record)
+	}
+
+	return asns[0], strings.TrimSpace(parts[1]), strings.ToUpper(strings.TrimSpace(parts[2])), nil
+}
+
+func lookupClientNetwork(ip net.IP, lookupASN bool) (cn clientNetwork, err error) {
+	cn.IP = ip.String()
+	cn.Network = defaultNetwork(ip)
+
+	if !lookupASN || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return cn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), asnLookupTimeout)
+	defer cancel()
+
+	records, err := net.DefaultResolver.LookupTXT(ctx, cymruQueryName(ip))
+	if err != nil {
+		return cn, fmt.Errorf("asn lookup for %s failed: %w", ip, err)
+	}
+
+	for _, record := range records {
+		asn, prefix, country, err := parseCymruRecord(record)
+		if err != nil {
+			continue
+		}
+
+		cn.ASN = asn
+		cn.Country = country
+		if prefix != "" {
+			cn.Network = prefix
+		}
+		break
+	}
+
+	return cn, nil
+}
+
+func networkChanges(previous data.ClientSource, current clientNetwork) (changed []string) {
+	if previous.IP != current.IP {
+		changed = append(changed, "ip")
+	}
+
+	// Announced prefixes and the default /24 arent comparable, so only check networks found the same way
+	if (previous.ASN == "") == (current.ASN == "") && previous.Network != current.Network {
+		changed = append(changed, "network")
+	}
+
+	// Only compare when both sides were resolved, otherwise turning on asn lookups would flag every client
+	if previous.ASN != "" && current.ASN != "" && previous.ASN != current.ASN {
+		changed = append(changed, "asn")
+	}
+
+	if previous.Country != "" && current.Country != "" && previous.Country != current.Country {
+		changed = append(changed, "country")
+	}
+
+	return changed
+}
+
+// checkClientNetwork records where a client key connected from, and raises a network change event if it differs from last time
+func checkClientNetwork(id, hostname, version, fingerprint, campaign string, remoteAddr net.Addr, lookupASN bool, log logger.Logger) {
+	if fingerprint == "" || !isSourceTrusted(remoteAddr.Network()) {
+		// Pivoted and relayed clients dont have a meaningful source address
+		return
+	}
+
+	ip := getIP(remoteAddr.String())
+	if ip == nil {
+		return
+	}
+
+	current, err := lookupClientNetwork(ip, lookupASN)
+	if err != nil {
+		log.Warning("%s", err)
+	}
+
+	previous, found, err := data.RecordClientSource(data.ClientSource{
+		Fingerprint: fingerprint,
+		IP:          current.IP,
+		Network:     current.Network,
+		ASN:         current.ASN,
+		Country:     current.Country,
+		LastSeen:    time.Now(),
+	})
+	if err != nil {
+		log.Error("unable to record client source address: %s", err)
+		return
+	}
+
+	if !found {
+		return
+	}
+
+	changed := networkChanges(previous, current)
+	if len(changed) == 0 {
+		return
+	}
+
+	change := observers.ClientNetworkChange{
+		Status:          "moved",
+		ID:              id,
+		HostName:        hostname,
+		Version:         version,
+		Fingerprint:     fingerprint,
+		PreviousIP:      previous.IP,
+		IP:              current.IP,
+		PreviousNetwork: previous.Network,
+		Network:         current.Network,
+		PreviousASN:     previous.ASN,
+		ASN:             current.ASN,
+		PreviousCountry: previous.Country,
+		Country:         current.Country,
+		Changed:         changed,
+		Campaign:        campaign,
+		Timestamp:       time.Now(),
+	}
+
+	log.Warning("%s", change.Summary())
+
+	observers.NetworkChange.Notify(change)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+)
+
+func TestCymruQueryName(t *testing.T) {
+	if got := cymruQueryName(net.ParseIP("8.8.4.1")); got != "1.4.8.8.origin.asn.cymru.com" {
+		t.Fatalf("unexpected ipv4 query name: %q", got)
+	}
+
+	want := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com"
+	if got := cymruQueryName(net.ParseIP("2001:db8::1")); got != want {
+		t.Fatalf("unexpected ipv6 query name: %q", got)
+	}
+}
+
+func TestParseCymruRecord(t *testing.T) {
+	asn, prefix, country, err := parseCymruRecord("15169 23456 | 8.8.8.0/24 | us | arin | 2023-12-28")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if asn != "15169" || prefix != "8.8.8.0/24" || country != "US" {
+		t.Fatalf("unexpected parse result: %q %q %q", asn, prefix, country)
+	}
+
+	if _, _, _, err := parseCymruRecord("garbage"); err == nil {
+		t.Fatal("expected malformed record to fail")
+	}
+}
+
+func TestNetworkChanges(t *testing.T) {
+	previous := data.ClientSource{IP: "10.0.0.1", Network: "10.0.0.0/24"}
+
+	if changed := networkChanges(previous, clientNetwork{IP: "10.0.0.2", Network: "10.0.0.0/24"}); !reflect.DeepEqual(changed, []string{"ip"}) {
+		t.Fatalf("same network should only change ip, got %v", changed)
+	}
+
+	if changed := networkChanges(previous, clientNetwork{IP: "10.1.0.1", Network: "10.1.0.0/24"}); !reflect.DeepEqual(changed, []string{"ip", "network"}) {
+		t.Fatalf("expected network change, got %v", changed)
+	}
+
+	// Enabling asn lookups between connections should not look like a move
+	if changed := networkChanges(previous, clientNetwork{IP: "10.0.0.1", Network: "10.0.0.0/8", ASN: "64512", Country: "NZ"}); len(changed) != 0 {
+		t.Fatalf("expected no change, got %v", changed)
+	}
+
+	resolved := data.ClientSource{IP: "1.1.1.1", Network: "1.1.1.0/24", ASN: "13335", Country: "US"}
+	if changed := networkChanges(resolved, clientNetwork{IP: "1.1.1.1", Network: "1.1.1.0/24", ASN: "64512", Country: "NZ"}); !reflect.DeepEqual(changed, []string{"asn", "country"}) {
+		t.Fatalf("expected asn and country change, got %v", changed)
+	}
+}
@@ -1,19 +1,45 @@
 package commands
 
 import (
-	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/keyfiles"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
 )
 
+// Key files are read on every login, so keys added here are let in straight away, and sessions using a removed key are disconnected
+
+var accessValueFlags = map[string]bool{
+	"p": true, "pattern": true,
+	"o": true, "owners": true,
+	"pubkey": true, "user": true, "comment": true, "campaign": true, "expires": true,
+}
+
 type access struct {
+	datadir string
+}
+
+func Access(datadir string) *access {
+	return &access{datadir: datadir}
 }
 
 func (s *access) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if _, positional := splitValueFlags(line, accessValueFlags); len(positional) > 0 {
+		return s.manage(user, tty, line, positional)
+	}
 
 	var err error
 
@@ -50,7 +76,7 @@ func (s *access) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLi
 	}
 
 	if spaceMatcher.MatchString(newOwners) {
-		return errors.New("new owners cannot contain spaces")
+		return failure.New(failure.InvalidArgument, "new owners cannot contain spaces")
 	}
 
 	connections, err := user.SearchClients(pattern)
@@ -59,7 +85,7 @@ func (s *access) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLi
 	}
 
 	if len(connections) == 0 {
-		return fmt.Errorf("No clients matched %q", pattern)
+		return failure.New(failure.ClientNotFound, "No clients matched %q", pattern).With("client", pattern)
 	}
 
 	if !line.IsSet("y") {
@@ -82,7 +108,7 @@ func (s *access) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLi
 		}
 
 		if !(b[0] == 'y' || b[0] == 'Y') {
-			return fmt.Errorf("\nUser did not enter y/Y, aborting")
+			return failure.New(failure.Aborted, "\nUser did not enter y/Y, aborting")
 		}
 	}
 
@@ -96,13 +122,191 @@ func (s *access) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLi
 		changes++
 	}
 
-	return fmt.Errorf("\n%d client owners modified", changes)
+	fmt.Fprintf(tty, "\n%d client owners modified\n", changes)
+	return nil
+}
+
+// keyFile is the key file --admin or --user pick, authorized_controllee_keys by default
+func (s *access) keyFile(line terminal.ParsedLine) (path, name string, err error) {
+	if line.IsSet("admin") {
+		return filepath.Join(s.datadir, "authorized_keys"), "authorized_keys", nil
+	}
+
+	if line.IsSet("user") {
+		username, err := line.GetArgString("user")
+		if err != nil || !guestNameMatcher.MatchString(username) {
+			return "", "", failure.New(failure.InvalidArgument, "--user needs a name of letters, numbers, '.', '_' and '-'")
+		}
+		return filepath.Join(s.datadir, "keys", username), "keys/" + username, nil
+	}
+
+	return filepath.Join(s.datadir, "authorized_controllee_keys"), "authorized_controllee_keys", nil
+}
+
+func (s *access) manage(user *users.User, tty io.ReadWriter, line terminal.ParsedLine, positional []string) error {
+	if user.Privilege() != users.AdminPermissions {
+		return failure.New(failure.PermissionDenied, "only admins can change the key files")
+	}
+
+	switch {
+	case positional[0] == "list" && len(positional) == 1:
+		return s.list(tty, line)
+	case positional[0] == "add":
+		return s.add(user, tty, line)
+	case positional[0] == "remove" && len(positional) == 2:
+		path, name, err := s.keyFile(line)
+		if err != nil {
+			return err
+		}
+
+		removed, err := keyfiles.Remove(path, positional[1])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(removed) == 0 {
+			return failure.New(failure.NotFound, "no key in %s matches %q", name, positional[1]).With("key", positional[1])
+		}
+
+		for _, e := range removed {
+			fmt.Fprintf(tty, "Removed %s %s from %s, disconnected %d sessions\n", e.Fingerprint(), e.Comment, name, users.DisconnectKey(internal.FingerprintSHA1Hex(e.Key)))
+		}
+		return nil
+	}
+
+	return failure.New(failure.InvalidArgument, "%s", s.Help(false))
+}
+
+func (s *access) add(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	path, name, err := s.keyFile(line)
+	if err != nil {
+		return err
+	}
+
+	pubkey, ok := line.Flags["pubkey"]
+	if !ok || len(pubkey.Args) == 0 {
+		return failure.New(failure.InvalidArgument, "no public key given, use --pubkey <key>")
+	}
+
+	publicKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(pubkey.ArgValues(), " ")))
+	if err != nil {
+		return failure.Wrap(failure.InvalidArgument, fmt.Errorf("unable to parse public key: %w", err))
+	}
+
+	entry := keyfiles.Entry{Key: publicKey, Comment: comment, Options: options}
+	if c, err := line.GetArgString("comment"); err == nil {
+		entry.Comment = c
+	}
+	if entry.Comment == "" {
+		entry.Comment = "added by " + user.Username()
+	}
+
+	owners, err := line.GetArgString("owners")
+	if err != nil {
+		owners, err = line.GetArgString("o")
+	}
+	if err == nil {
+		if spaceMatcher.MatchString(owners) {
+			return failure.New(failure.InvalidArgument, "owners cannot contain spaces")
+		}
+		entry.Options = append(entry.Options, "owner="+strconv.Quote(owners))
+	}
+
+	if campaign, err := line.GetArgString("campaign"); err == nil {
+		if err := users.ValidCampaign(campaign); err != nil {
+			return err
+		}
+		entry.Options = append(entry.Options, "campaign="+strconv.Quote(campaign))
+	}
+
+	if expires, err := line.GetArgString("expires"); err == nil {
+		duration, err := time.ParseDuration(expires)
+		if err != nil || duration <= 0 {
+			return failure.New(failure.InvalidArgument, "expires %q is not a positive duration, e.g 24h", expires)
+		}
+		entry.Expires = time.Now().Add(duration).Truncate(time.Second)
+		entry.Options = append(entry.Options, keyfiles.ExpiryOption+"=\""+keyfiles.FormatExpiry(entry.Expires)+"\"")
+	}
+
+	if name != "authorized_controllee_keys" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+	}
+
+	if err := keyfiles.Add(path, entry); err != nil {
+		return failure.Wrap(failure.InvalidArgument, err)
+	}
+
+	fmt.Fprintf(tty, "Added %s %s to %s, it can log in now\n", entry.Fingerprint(), entry.Comment, name)
+	return nil
+}
+
+func (s *access) list(tty io.ReadWriter, line terminal.ParsedLine) error {
+	files := map[string]string{}
+	if line.IsSet("admin") || line.IsSet("user") {
+		path, name, err := s.keyFile(line)
+		if err != nil {
+			return err
+		}
+		files[name] = path
+	} else {
+		files["authorized_controllee_keys"] = filepath.Join(s.datadir, "authorized_controllee_keys")
+		files["authorized_keys"] = filepath.Join(s.datadir, "authorized_keys")
+
+		userKeys, err := os.ReadDir(filepath.Join(s.datadir, "keys"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, e := range userKeys {
+			if !e.IsDir() {
+				files["keys/"+e.Name()] = filepath.Join(s.datadir, "keys", e.Name())
+			}
+		}
+	}
+
+	t, err := table.NewTable("Keys", "File", "Key", "Comment", "Options", "Expires")
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entries, err := keyfiles.Entries(files[name])
+		if err != nil {
+			fmt.Fprintf(tty, "unable to read %s: %s\n", name, err)
+			continue
+		}
+
+		for _, e := range entries {
+			expires := "never"
+			if !e.Expires.IsZero() {
+				expires = e.Expires.Format("2006/01/02 15:04:05")
+			}
+			if err := t.AddValues(name, e.Fingerprint(), e.Comment, strings.Join(e.Options, "\n"), expires); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.Fprint(tty)
+	return nil
 }
 
 func (s *access) ValidArgs() map[string]string {
 
 	r := map[string]string{
-		"y": "Auto confirm prompt",
+		"y":        "Auto confirm prompt",
+		"pubkey":   "With add, the public key to add in authorized_keys format, e.g --pubkey ssh-ed25519 AAAA...",
+		"admin":    "With add, remove or list, use authorized_keys (admins) rather than authorized_controllee_keys (clients)",
+		"user":     "With add, remove or list, use keys/<name>, the keys of a normal user",
+		"comment":  "With add, comment to keep with the key, shown in ls for clients",
+		"campaign": "With add, campaign option for the key, see the campaign command",
+		"expires":  "With add, stop letting the key in after this long, e.g 24h",
 	}
 
 	addDuplicateFlags("Clients to act on", r, "p", "pattern")
@@ -130,7 +334,23 @@ func (s *access) Help(explain bool) string {
 
 	return terminal.MakeHelpText(s.ValidArgs(),
 		"access [OPTIONS] -p <FILTER>",
+		"access add --pubkey <key> [--admin | --user <name>] [--comment <text>] [--owners <users>] [--campaign <name>] [--expires <duration>]",
+		"access remove <fingerprint or comment> [--admin | --user <name>]",
+		"access list [--admin | --user <name>]",
 		"Change ownership of client connection, only lasts until restart of rssh server, to make permanent edit authorized_controllee_keys 'owner' option",
 		"Filter uses glob matching against all attributes of a target (id, public key hash, hostname, ip)",
+		"add, remove and list change the key files (admins only). Keys are let in as soon as they are added, and removing a key disconnects everything logged in with it",
 	)
 }
+
+func (s *access) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "access -p webserver --current", Description: "Make the client with hostname webserver only visible to you"},
+		{Command: "access -p 10.* --owners alice,bob", Description: "Give ownership of clients from 10.0.0.0/8 to alice and bob"},
+		{Command: "access -p * --all -y", Description: "Make every client public"},
+		{Command: "access add --pubkey ssh-ed25519 AAAA... --comment fileserver --owners alice --expires 72h", Description: "Let a client key in for three days, owned by alice"},
+		{Command: "access add --user bob --pubkey ssh-ed25519 AAAA...", Description: "Give bob a key as a normal user"},
+		{Command: "access remove SHA256:Qm9i... --admin", Description: "Remove an admin key and disconnect its sessions"},
+		{Command: "access list", Description: "Show every key the server lets in"},
+	}
+}
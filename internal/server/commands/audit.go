@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/server/audit"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+const defaultAuditEntries = 20
+
+type auditCommand struct {
+}
+
+func (a *auditCommand) ValidArgs() map[string]string {
+	r := map[string]string{
+		"user":   "Only show commands run by this operator",
+		"client": "Only show commands that named this client",
+		"failed": "Only show commands that failed",
+		"json":   "Print entries as json, one per line, to feed a SIEM",
+		"all":    "Show every entry rather than the last 20",
+	}
+
+	addDuplicateFlags("How many of the most recent entries to show (default 20)", r, "n", "last")
+	return r
+}
+
+func (a *auditCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if user.Privilege() != users.AdminPermissions {
+		return failure.New(failure.PermissionDenied, "only admins can read the console log")
+	}
+
+	path := audit.ConsoleLog()
+	if path == "" {
+		return failure.New(failure.NotFound, "commands are not being recorded")
+	}
+
+	_, positional := splitValueFlags(line, map[string]bool{"n": true, "last": true, "user": true, "client": true})
+	if len(positional) == 1 && positional[0] == "verify" {
+		n, err := audit.VerifyConsoleLog(path)
+		if err != nil {
+			return failure.New(failure.Unknown, "console log has been tampered with after %d good entries: %s", n, err)
+		}
+		fmt.Fprintf(tty, "console log is intact, %d entries\n", n)
+		return nil
+	} else if len(positional) > 0 {
+		return failure.New(failure.InvalidArgument, "%s", a.Help(false))
+	}
+
+	entries, err := audit.ReadConsoleLog(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	last := defaultAuditEntries
+	if line.IsSet("all") {
+		last = 0
+	}
+	for _, flag := range []string{"n", "last"} {
+		if value, err := line.GetArgString(flag); err == nil {
+			last, err = strconv.Atoi(value)
+			if err != nil || last < 1 {
+				return failure.New(failure.InvalidArgument, "--%s must be a number above 0, got %q", flag, value)
+			}
+		}
+	}
+
+	operator, _ := line.GetArgString("user")
+	client, _ := line.GetArgString("client")
+
+	var shown []audit.ConsoleEntry
+	for _, e := range entries {
+		if operator != "" && e.User != operator {
+			continue
+		}
+		if client != "" && !slices.Contains(e.Targets, client) {
+			continue
+		}
+		if line.IsSet("failed") && e.Status == "ok" {
+			continue
+		}
+		shown = append(shown, e)
+	}
+
+	if last > 0 && len(shown) > last {
+		shown = shown[len(shown)-last:]
+	}
+
+	if line.IsSet("json") {
+		for _, e := range shown {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tty, "%s\n", b)
+		}
+		return nil
+	}
+
+	if len(shown) == 0 {
+		fmt.Fprintln(tty, "No commands recorded")
+		return nil
+	}
+
+	t, err := table.NewTable("Console log", "When", "Operator", "Key", "Command", "Clients", "Status")
+	if err != nil {
+		return err
+	}
+
+	for _, e := range shown {
+		status := e.Status
+		if e.Error != "" {
+			status += ": " + e.Error
+		}
+
+		if err := t.AddValues(e.Time.Local().Format("2006/01/02 15:04:05"), e.User, e.Fingerprint, e.Command, strings.Join(e.Targets, "\n"), status); err != nil {
+			return err
+		}
+	}
+
+	t.Fprint(tty)
+	return nil
+}
+
+func (a *auditCommand) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (a *auditCommand) Help(explain bool) string {
+	if explain {
+		return "Show the console log of every command operators have run"
+	}
+
+	return terminal.MakeHelpText(a.ValidArgs(),
+		"audit [OPTIONS]",
+		"audit verify",
+		"Every console command, and every command run with ssh server <command>, is recorded in <datadir>/console.log with the operator, the key they logged in with, the clients it named and whether it worked.",
+		"Each entry is chained to the one before it with sha256, audit verify finds any entry that has been changed, removed or moved. Only admins can read the log.",
+	)
+}
+
+func (a *auditCommand) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "audit", Description: "Show the last 20 commands"},
+		{Command: "audit --client webserver --failed", Description: "Show commands that named webserver and failed"},
+		{Command: "audit --all --json", Description: "Print the whole log as json lines, e.g ssh server audit --all --json > console.json for a SIEM"},
+		{Command: "audit verify", Description: "Check no entry has been changed, removed or moved"},
+	}
+}
@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type bind struct {
+}
+
+func (b *bind) ValidArgs() map[string]string {
+	return map[string]string{
+		"l":       "List key bindings for the current editing mode, or the keymap given by --keymap",
+		"mode":    "Set the editing mode, emacs or vi",
+		"keymap":  "Keymap to change or list, one of [emacs, vi-insert, vi-command] (default is the current mode)",
+		"remove":  "Remove the binding for a key",
+		"actions": "List all actions keys can be bound to",
+		"reset":   "Reset all bindings to their defaults",
+	}
+}
+
+func (b *bind) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	term, ok := tty.(*terminal.Terminal)
+	if !ok {
+		return failure.New(failure.InvalidArgument, "bind only works in an interactive console")
+	}
+
+	if line.IsSet("actions") {
+		t, err := table.NewTable("Actions", "Action", "Description")
+		if err != nil {
+			return err
+		}
+
+		actions := terminal.Actions()
+
+		names := []string{}
+		for name := range actions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			t.AddValues(name, actions[name])
+		}
+
+		t.Fprint(tty)
+		return nil
+	}
+
+	if line.IsSet("reset") {
+		term.ResetBindings()
+		fmt.Fprintln(tty, "Key bindings reset")
+		return nil
+	}
+
+	if mode, err := line.GetArgString("mode"); err == nil {
+		if err := term.SetEditMode(mode); err != nil {
+			return err
+		}
+		fmt.Fprintf(tty, "Editing mode set to %s\n", mode)
+		return nil
+	} else if err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	keymap, err := line.GetArgString("keymap")
+	if err != nil {
+		if err != terminal.ErrFlagNotSet {
+			return err
+		}
+
+		keymap = terminal.EmacsKeymap
+		if term.EditMode() == terminal.ViMode {
+			keymap = terminal.ViInsertKeymap
+		}
+	}
+
+	if key, err := line.GetArgString("remove"); err == nil {
+		return term.Bind(keymap, key, "")
+	} else if err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	if line.IsSet("l") || len(line.Arguments) == 0 {
+		keymaps := []string{keymap}
+		if !line.IsSet("keymap") && term.EditMode() == terminal.ViMode {
+			keymaps = append(keymaps, terminal.ViCommandKeymap)
+		}
+
+		for _, k := range keymaps {
+			bindings, err := term.Bindings(k)
+			if err != nil {
+				return err
+			}
+
+			t, err := table.NewTable("Keymap "+k, "Key", "Action")
+			if err != nil {
+				return err
+			}
+
+			for _, binding := range bindings {
+				t.AddValues(binding[0], binding[1])
+			}
+
+			t.Fprint(tty)
+		}
+
+		return nil
+	}
+
+	if len(line.Arguments) != 2 {
+		return failure.New(failure.InvalidArgument, "%s", b.Help(false))
+	}
+
+	return term.Bind(keymap, line.Arguments[0].Value(), line.Arguments[1].Value())
+}
+
+func (b *bind) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (b *bind) Help(explain bool) string {
+	if explain {
+		return "Change console editing mode and key bindings"
+	}
+
+	return terminal.MakeHelpText(b.ValidArgs(),
+		"bind [OPTIONS] [<key> <action>]",
+		"Keys are written like ctrl-a, alt-b, up, escape, or a single character (which can be non-ascii).",
+		"Changes last until you disconnect, to always start in vi mode connect with: ssh -o SetEnv=RSSH_EDIT_MODE=vi",
+	)
+}
+
+func (b *bind) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "bind --mode vi", Description: "Use vi style editing"},
+		{Command: "bind ctrl-g kill-whole-line", Description: "Make ctrl-g clear the line"},
+		{Command: "bind --keymap vi-command --remove x", Description: "Stop x deleting characters in vi command mode"},
+		{Command: "bind -l", Description: "Show what every key does"},
+	}
+}
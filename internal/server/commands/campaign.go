@@ -0,0 +1,126 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type campaign struct {
+}
+
+func (c *campaign) ValidArgs() map[string]string {
+	return map[string]string{}
+}
+
+// Prompt is the console prompt for user, showing the campaign they are working in
+func Prompt(user *users.User) string {
+	if campaign := user.Campaign(); campaign != "" {
+		return internal.ConsoleLabel + " (" + campaign + ")$ "
+	}
+	return internal.ConsoleLabel + "$ "
+}
+
+func (c *campaign) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	args := line.ArgumentsAsStrings()
+
+	switch {
+	case len(args) == 0:
+		return c.list(user, tty)
+	case len(args) == 2 && args[0] == "use":
+		if err := user.SetCampaign(args[1]); err != nil {
+			return err
+		}
+	case len(args) == 1 && args[0] == "leave":
+		if err := user.SetCampaign(""); err != nil {
+			return err
+		}
+	default:
+		return failure.New(failure.InvalidArgument, "%s", c.Help(false))
+	}
+
+	if term, ok := tty.(*terminal.Terminal); ok {
+		term.SetPrompt(Prompt(user))
+	}
+
+	if current := user.Campaign(); current != "" {
+		fmt.Fprintf(tty, "Working in campaign %s, %d clients connected\n", current, user.Campaigns()[current])
+	} else {
+		fmt.Fprintln(tty, "Not working in a campaign, every client can be found")
+	}
+	return nil
+}
+
+func (c *campaign) list(user *users.User, tty io.ReadWriter) error {
+	current := user.Campaign()
+	switch {
+	case current == "":
+		fmt.Fprintln(tty, "Not working in a campaign, every client can be found")
+	case user.CampaignPinned():
+		fmt.Fprintf(tty, "Working in campaign %s, your key is only allowed into it\n", current)
+	default:
+		fmt.Fprintf(tty, "Working in campaign %s\n", current)
+	}
+
+	counts := user.Campaigns()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	t, err := table.NewTable("Campaigns", "Campaign", "Clients")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		label := name
+		if name == "" {
+			label = "(none)"
+		}
+		if err := t.AddValues(label, strconv.Itoa(counts[name])); err != nil {
+			return err
+		}
+	}
+
+	t.Fprint(tty)
+	return nil
+}
+
+func (c *campaign) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (c *campaign) Help(explain bool) string {
+	if explain {
+		return "Work in one campaign, so only its clients can be found"
+	}
+
+	return terminal.MakeHelpText(c.ValidArgs(),
+		"campaign",
+		"campaign use <name>",
+		"campaign leave",
+		"Campaigns are set on clients with link --campaign. While working in one, ls, connect and every other command only find that campaign's clients, and sync keeps what it pulls in the campaign's own directory.",
+		"Operators whose key has a campaign option (e.g campaign=\"spring\" in keys/<user>) are always in that campaign and cannot leave it.",
+	)
+}
+
+func (c *campaign) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "campaign", Description: "Show the campaign you are working in, and how many clients each campaign has connected"},
+		{Command: "campaign use spring", Description: "Only find clients built with link --campaign spring"},
+		{Command: "campaign leave", Description: "Find every client again"},
+	}
+}
@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/clientlimits"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type clientLimits struct {
+}
+
+func (c *clientLimits) ValidArgs() map[string]string {
+	return map[string]string{
+		"l":        "List the policies",
+		"campaign": "Set or remove the policy for clients built with link --campaign, instead of the global one",
+		"transfer": "Bytes a client may move in any hour, e.g 500M or 10G, 0 for unlimited",
+		"session":  "How long a connection may last before the client has to reconnect, e.g 8h, 0 for unlimited",
+		"remove":   "Remove the policy",
+	}
+}
+
+func (c *clientLimits) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if line.IsSet("l") {
+		return c.list(tty)
+	}
+
+	if user.Privilege() != users.AdminPermissions {
+		return failure.New(failure.PermissionDenied, "only admins can change client limits")
+	}
+
+	campaign, err := line.GetArgString("campaign")
+	if err != nil && line.IsSet("campaign") {
+		return failure.New(failure.InvalidArgument, "--campaign needs a name")
+	}
+
+	name := "global policy"
+	if campaign != "" {
+		name = "policy for campaign " + campaign
+	}
+
+	if line.IsSet("remove") {
+		removed, err := data.DeleteClientLimit(campaign)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return failure.New(failure.NotFound, "there is no %s", name)
+		}
+
+		fmt.Fprintf(tty, "Removed the %s\n", name)
+		return nil
+	}
+
+	if !line.IsSet("transfer") && !line.IsSet("session") {
+		return failure.New(failure.InvalidArgument, "no actionable argument supplied, please add --transfer, --session, --remove or -l (list)")
+	}
+
+	var limits clientlimits.Limits
+	for flag, option := range map[string]string{"transfer": clientlimits.TransferOption, "session": clientlimits.DurationOption} {
+		if !line.IsSet(flag) {
+			continue
+		}
+
+		value, err := line.GetArgString(flag)
+		if err != nil {
+			return failure.New(failure.InvalidArgument, "--%s needs a value", flag)
+		}
+
+		if _, err := limits.ParseOption(option, value); err != nil {
+			return failure.Wrap(failure.InvalidArgument, err)
+		}
+	}
+
+	err = data.SaveClientLimit(data.ClientLimit{
+		Campaign: campaign,
+		Transfer: limits.Transfer,
+		Duration: int64(limits.Duration / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(tty, "Set the %s to %s, clients get it when they next connect\n", name, limits)
+	return nil
+}
+
+func (c *clientLimits) list(tty io.ReadWriter) error {
+	policies, err := data.GetClientLimits()
+	if err != nil {
+		return err
+	}
+
+	t, _ := table.NewTable("Client Limits", "Campaign", "Transfer/hour", "Session")
+	for _, p := range policies {
+		campaign := p.Campaign
+		if campaign == "" {
+			campaign = "(global)"
+		}
+
+		limits := clientlimits.FromPolicy(p)
+
+		transfer, session := "unlimited", "unlimited"
+		if limits.Transfer > 0 {
+			transfer = fmt.Sprintf("%d", limits.Transfer)
+		}
+		if limits.Duration > 0 {
+			session = limits.Duration.String()
+		}
+
+		t.AddValues(campaign, transfer, session)
+	}
+
+	t.Fprint(tty)
+	return nil
+}
+
+func (c *clientLimits) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (c *clientLimits) Help(explain bool) string {
+	if explain {
+		return "Limit how much data clients move and how long they stay connected"
+	}
+
+	return terminal.MakeHelpText(c.ValidArgs(),
+		"client-limits [OPTIONS]",
+		"Policies are global or per campaign. The max-transfer and max-session options on a key in authorized_controllee_keys take precedence, then the campaign's policy, then the global one.",
+		"A client over its transfer limit, or connected for longer than its session limit, is disconnected. It is refused until it has moved less than its limit in the last hour.",
+	)
+}
+
+func (c *clientLimits) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "client-limits --transfer 10G --session 24h", Description: "Limit every client to 10G an hour and a day per connection"},
+		{Command: "client-limits --campaign payroll --transfer 500M", Description: "Clients built for the payroll campaign may only move 500M an hour"},
+		{Command: "client-limits -l", Description: "Show the policies"},
+		{Command: "client-limits --campaign payroll --remove", Description: "Go back to the global policy for payroll"},
+	}
+}
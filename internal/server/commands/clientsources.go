@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/sourcefilter"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type clientSources struct {
+}
+
+func (c *clientSources) ValidArgs() map[string]string {
+	return map[string]string{}
+}
+
+func (c *clientSources) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	_, positional := splitValueFlags(line, nil)
+	if len(positional) == 0 {
+		return c.list(tty)
+	}
+
+	if user.Privilege() != users.AdminPermissions {
+		return failure.New(failure.PermissionDenied, "only admins can change client sources")
+	}
+
+	action, networks := positional[0], positional[1:]
+	if len(networks) == 0 {
+		return failure.New(failure.InvalidArgument, "%s", c.Help(false))
+	}
+
+	// Parse everything first, so a typo doesn't leave half the networks added
+	for _, network := range networks {
+		if _, err := sourcefilter.ParseNetwork(network); err != nil {
+			return failure.Wrap(failure.InvalidArgument, err)
+		}
+	}
+
+	switch action {
+	case "allow", "deny":
+		for _, network := range networks {
+			if err := sourcefilter.Add(network, action == "deny"); err != nil {
+				return err
+			}
+			if action == "deny" {
+				fmt.Fprintf(tty, "Connections from %s are dropped\n", network)
+			} else {
+				fmt.Fprintf(tty, "Connections from %s are accepted\n", network)
+			}
+		}
+	case "remove":
+		for _, network := range networks {
+			found, err := sourcefilter.Remove(network)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return failure.New(failure.NotFound, "there is no rule for %s added with client-sources, rules from --allow-clients and --deny-clients are only changed by restarting", network)
+			}
+			fmt.Fprintf(tty, "Removed the rule for %s\n", network)
+		}
+	default:
+		return failure.New(failure.InvalidArgument, "%s", c.Help(false))
+	}
+
+	return nil
+}
+
+func (c *clientSources) list(tty io.ReadWriter) error {
+	rules := sourcefilter.Rules()
+	if len(rules) == 0 {
+		fmt.Fprintln(tty, "Connections are accepted from everywhere")
+		return nil
+	}
+
+	t, err := table.NewTable("Client Sources", "Network", "Rule", "From")
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rules {
+		rule, from := "allow", "console"
+		if r.Deny {
+			rule = "deny"
+		}
+		if r.Fixed {
+			from = "flag"
+		}
+
+		if err := t.AddValues(r.Network.String(), rule, from); err != nil {
+			return err
+		}
+	}
+
+	t.Fprint(tty)
+	fmt.Fprintf(tty, "%d connections dropped since the server started\n", sourcefilter.Dropped())
+	return nil
+}
+
+func (c *clientSources) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (c *clientSources) Help(explain bool) string {
+	if explain {
+		return "Drop connections from networks outside an allow list, or inside a deny list"
+	}
+
+	return terminal.MakeHelpText(c.ValidArgs(),
+		"client-sources",
+		"client-sources allow|deny|remove <network>...",
+		"Connections are checked against these networks (CIDRs or addresses) as they are accepted, before the ssh handshake, so out of scope sources are dropped cheaply. Deny wins over allow,",
+		"and once anything is allowed only allowed networks are accepted. Loopback is always accepted. Rules added here are kept in the database, --allow-clients and --deny-clients are fixed until restart.",
+		"Changing rules needs admin, existing connections are not affected.",
+	)
+}
+
+func (c *clientSources) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "client-sources", Description: "Show the rules and how many connections they have dropped"},
+		{Command: "client-sources allow 10.0.0.0/8 203.0.113.7", Description: "Only accept connections from 10.0.0.0/8 and 203.0.113.7"},
+		{Command: "client-sources deny 198.51.100.0/24", Description: "Drop connections from 198.51.100.0/24"},
+		{Command: "client-sources remove 203.0.113.7", Description: "Remove the rule for 203.0.113.7"},
+	}
+}
@@ -3,13 +3,21 @@ package commands
 import (
 	"fmt"
 	"io"
+	"maps"
 	"sync"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/resumable"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/presence"
+	"github.com/NHAS/reverse_ssh/internal/server/suspend"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/fatih/color"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -21,9 +29,12 @@ type connect struct {
 
 func (c *connect) ValidArgs() map[string]string {
 
-	return map[string]string{
-		"shell": "Set the shell (or program) to start on connection, this also takes an http, https or rssh url that be downloaded to disk and executed",
+	r := map[string]string{
+		"shell":        "Set the shell (or program) to start on connection, this also takes an http, https or rssh url that be downloaded to disk and executed",
+		"idle-suspend": "Park the session after no keystrokes or output for this long, e.g 30m, the next key carries on with it. 0 never does (default the server's --idle-suspend)",
 	}
+	maps.Copy(r, processFlags)
+	return r
 }
 
 func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
@@ -34,21 +45,34 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 	}
 
 	if sess.Pty == nil {
-		return fmt.Errorf("Connect requires a pty")
+		return failure.New(failure.InvalidArgument, "Connect requires a pty")
 	}
 
 	term, ok := tty.(*terminal.Terminal)
 	if !ok {
-		return fmt.Errorf("connect can only be called from the terminal, if you want to connect to your clients without connecting to the terminal use jumphost syntax -J")
+		return failure.New(failure.InvalidArgument, "connect can only be called from the terminal, if you want to connect to your clients without connecting to the terminal use jumphost syntax -J")
 	}
 
 	if len(line.Arguments) < 1 {
 
-		return fmt.Errorf("%s", c.Help(false))
+		return failure.New(failure.InvalidArgument, "%s", c.Help(false))
+	}
+
+	process, _, err := parseProcessOptions(line)
+	if err != nil {
+		return err
 	}
 
 	shell, _ := line.GetArgString("shell")
 
+	idle := suspend.After()
+	if value, err := line.GetArgString("idle-suspend"); err == nil {
+		idle, err = time.ParseDuration(value)
+		if err != nil || idle < 0 {
+			return failure.New(failure.InvalidArgument, "--idle-suspend must be a duration, e.g 30m, or 0 to never suspend, got %q", value)
+		}
+	}
+
 	client := line.Arguments[len(line.Arguments)-1].Value()
 
 	foundClients, err := user.SearchClients(client)
@@ -57,20 +81,40 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 	}
 
 	if len(foundClients) == 0 {
-		return fmt.Errorf("No clients matched %q", client)
+		return failure.New(failure.ClientNotFound, "No clients matched %q", client).With("client", client)
 	}
 
 	if len(foundClients) > 1 {
-		return fmt.Errorf("%q matches multiple clients please choose a more specific identifier", client)
+		return failure.New(failure.InvalidArgument, "%q matches multiple clients please choose a more specific identifier", client)
 	}
 
-	var target ssh.Conn
+	var (
+		target   *ssh.ServerConn
+		targetId string
+	)
 	//Horrible way of getting the first element of a map in go
 	for k := range foundClients {
 		target = foundClients[k]
+		targetId = k
 		break
 	}
 
+	defer traffic.Client(targetId).Track()()
+
+	for _, other := range presence.Others(targetId, user.Username()) {
+		fmt.Fprintf(term, "%s %s is also using %s\n", color.YellowString("warning:"), other, targetId)
+	}
+
+	// Shared, so kill is refused while the shell is open
+	unlock, err := lockClient(targetId, "shell", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	present := presence.Open(targetId, user.Username(), presence.Shell)
+	defer present.Close()
+
 	defer func() {
 		c.log.Info("Disconnected from remote host %s (%s)", target.RemoteAddr(), target.ClientVersion())
 		term.DisableRaw(true)
@@ -78,7 +122,7 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 
 	//Attempt to connect to remote host and send inital pty request and screen size
 	// If we cant, report and error to the clients terminal
-	newSession, err := createSession(target, *sess.Pty, shell)
+	newSession, err := createSession(target, *sess.Pty, shell, &process)
 	if err != nil {
 
 		c.log.Error("Creating session failed: %s", err)
@@ -88,7 +132,7 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 	c.log.Info("Connected to %s", target.RemoteAddr().String())
 
 	term.EnableRaw()
-	err = attachSession(newSession, term, sess.ShellRequests)
+	err = attachSession(present.TrackChannel(suspend.Open(newSession, idle)), term, sess.ShellRequests)
 	if err != nil {
 
 		c.log.Error("Client tried to attach session and failed: %s", err)
@@ -129,22 +173,28 @@ func Connect(
 	}
 }
 
-func createSession(sshConn ssh.Conn, ptyReq internal.PtyReq, shell string) (sc ssh.Channel, err error) {
+func createSession(sshConn *ssh.ServerConn, ptyReq internal.PtyReq, shell string, process *processOptions) (sc ssh.Channel, err error) {
 
-	splice, newrequests, err := sshConn.OpenChannel("session", nil)
+	// Resumable, so the shell survives the client reconnecting
+	splice, newrequests, err := resumable.Open(sshConn, sshConn.Permissions.Extensions["pubkey-fp"], "session", nil)
 	if err != nil {
-		return sc, fmt.Errorf("Unable to start remote session on host %s (%s) : %s", sshConn.RemoteAddr(), sshConn.ClientVersion(), err)
+		return sc, failure.New(failure.ClientRefused, "Unable to start remote session on host %s (%s) : %s", sshConn.RemoteAddr(), sshConn.ClientVersion(), err)
 	}
 
 	//Send pty request, pty has been continuously updated with window-change sizes
 	_, err = splice.SendRequest("pty-req", true, ssh.Marshal(ptyReq))
 	if err != nil {
-		return sc, fmt.Errorf("Unable to send PTY request: %s", err)
+		return sc, failure.New(failure.ClientRefused, "Unable to send PTY request: %s", err)
+	}
+
+	if err := process.send(splice); err != nil {
+		splice.Close()
+		return sc, err
 	}
 
 	_, err = splice.SendRequest("shell", true, ssh.Marshal(internal.ShellStruct{Cmd: shell}))
 	if err != nil {
-		return sc, fmt.Errorf("Unable to start shell: %s", err)
+		return sc, failure.New(failure.ClientRefused, "Unable to start shell: %s", err)
 	}
 
 	go ssh.DiscardRequests(newrequests)
@@ -206,3 +256,13 @@ RequestsProxyPasser:
 
 	return nil
 }
+
+func (c *connect) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "connect 0f6ffecb15d75574e5e955e014e0546f6e2851ac", Description: "Open a shell on a client by id"},
+		{Command: "connect --shell /bin/sh webserver", Description: "Open a specific shell on the client with hostname webserver"},
+		{Command: "connect --cwd /srv/app --env HISTFILE=/dev/null webserver", Description: "Open a shell in a directory, without shell history"},
+		{Command: "connect --idle-suspend 10m webserver", Description: "Park the session whenever it has been idle for 10 minutes, pressing a key carries on with it"},
+		{Command: "ssh -J your.rssh.server:3232 webserver", Description: "Connect from your own machine instead of the console"},
+	}
+}
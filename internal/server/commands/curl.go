@@ -0,0 +1,399 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/pivot"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultCurlTimeout = 30 * time.Second
+	defaultCurlMaxSize = 10 << 20
+)
+
+// Flags that take a value, anything after that value is part of the request rather than the flag
+var curlValueFlags = map[string]bool{
+	"H":        true,
+	"header":   true,
+	"d":        true,
+	"data":     true,
+	"proxy":    true,
+	"timeout":  true,
+	"max-size": true,
+}
+
+type curl struct {
+	log logger.Logger
+}
+
+type curlResponse struct {
+	URL        string              `json:"url"`
+	Proto      string              `json:"proto"`
+	Status     string              `json:"status"`
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers"`
+	Body       *string             `json:"body,omitempty"`
+	BodyBase64 *string             `json:"body_base64,omitempty"`
+	Truncated  bool                `json:"truncated"`
+	Proxy      string              `json:"proxy,omitempty"`
+	ElapsedMS  int64               `json:"elapsed_ms"`
+}
+
+func (c *curl) ValidArgs() map[string]string {
+	r := map[string]string{
+		"proxy":    "Send the request through this proxy (http, https or socks5 url) as seen from the client, or 'client' to use the proxy the client itself uses",
+		"timeout":  "Give up after this many seconds (default 30)",
+		"max-size": "Read at most this many bytes of the body (default 10M), takes K, M and G suffixes",
+		"json":     "Print the response as json with the status, headers and body",
+	}
+
+	addDuplicateFlags("Add a header, e.g -H 'Authorization: Bearer abc'. Can be given multiple times", r, "H", "header")
+	addDuplicateFlags("Send this as the body, the method becomes POST unless one is given", r, "d", "data")
+	addDuplicateFlags("Do not check TLS certificates", r, "k", "insecure")
+	addDuplicateFlags("Follow redirects", r, "L", "location")
+	addDuplicateFlags("Print the status line and headers before the body", r, "i", "include")
+
+	return r
+}
+
+// splitValueFlags gives each of the value flags the argument straight after it, the rest (for curl the client, method and url) are positional
+func splitValueFlags(line terminal.ParsedLine, valueFlags map[string]bool) (values map[string][]string, positional []string) {
+	flags := append([]terminal.Flag{}, line.FlagsOrdered...)
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].Start() < flags[j].Start()
+	})
+
+	arguments := append([]terminal.Argument{}, line.Arguments...)
+	sort.Slice(arguments, func(i, j int) bool {
+		return arguments[i].Start() < arguments[j].Start()
+	})
+
+	values = map[string][]string{}
+	consumed := map[int]bool{}
+	for _, a := range arguments {
+		owner := -1
+		for i := range flags {
+			if flags[i].Start() < a.Start() {
+				owner = i
+			}
+		}
+
+		if owner >= 0 && valueFlags[flags[owner].Value()] && !consumed[owner] {
+			consumed[owner] = true
+			values[flags[owner].Value()] = append(values[flags[owner].Value()], a.Value())
+			continue
+		}
+
+		positional = append(positional, a.Value())
+	}
+
+	return values, positional
+}
+
+func firstValue(values map[string][]string, names ...string) (string, bool) {
+	for _, name := range names {
+		if v, ok := values[name]; ok && len(v) > 0 {
+			return v[len(v)-1], true
+		}
+	}
+	return "", false
+}
+
+func clientProxy(sc ssh.Conn) (*url.URL, error) {
+	ok, reply, err := sc.SendRequest("query-proxy@rssh", true, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		if len(reply) == 0 {
+			return nil, failure.New(failure.ClientRefused, "client does not use a proxy, or is too old to say")
+		}
+		return nil, failure.New(failure.ClientRefused, "%s", string(reply))
+	}
+
+	return parseCurlProxy(string(reply))
+}
+
+func parseCurlProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, failure.New(failure.InvalidArgument, "invalid proxy %q, expected e.g http://10.0.0.1:3128", proxy).With("proxy", proxy)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	case "socks":
+		u.Scheme = "socks5"
+	default:
+		return nil, failure.New(failure.InvalidArgument, "unsupported proxy scheme %q, use http, https or socks5", u.Scheme).With("proxy", proxy)
+	}
+
+	return u, nil
+}
+
+func (c *curl) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	values, positional := splitValueFlags(line, curlValueFlags)
+
+	var method, target string
+	switch len(positional) {
+	case 2:
+		target = positional[1]
+	case 3:
+		method = strings.ToUpper(positional[1])
+		target = positional[2]
+	default:
+		return failure.New(failure.InvalidArgument, "%s", c.Help(false))
+	}
+	specifier := positional[0]
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return failure.New(failure.InvalidArgument, "%q is not an http or https url", target).With("url", target)
+	}
+
+	body, hasBody := firstValue(values, "d", "data")
+	if method == "" {
+		method = http.MethodGet
+		if hasBody {
+			method = http.MethodPost
+		}
+	}
+
+	timeout := defaultCurlTimeout
+	if t, ok := firstValue(values, "timeout"); ok {
+		seconds, err := strconv.Atoi(t)
+		if err != nil || seconds <= 0 {
+			return failure.New(failure.InvalidArgument, "invalid timeout %q, expected seconds", t)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	maxSize := int64(defaultCurlMaxSize)
+	if m, ok := firstValue(values, "max-size"); ok {
+		maxSize, err = users.ParseBandwidth(m)
+		if err != nil || maxSize == 0 {
+			return failure.New(failure.InvalidArgument, "invalid max-size %q, expected e.g 512K or 10M", m)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), strings.NewReader(body))
+	if err != nil {
+		return failure.Wrap(failure.InvalidArgument, err)
+	}
+	if !hasBody {
+		req.Body = nil
+	}
+
+	for _, name := range []string{"H", "header"} {
+		for _, h := range values[name] {
+			key, value, ok := strings.Cut(h, ":")
+			if !ok || strings.TrimSpace(key) == "" {
+				return failure.New(failure.InvalidArgument, "header %q is not 'Name: value'", h).With("header", h)
+			}
+
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if strings.EqualFold(key, "Host") {
+				req.Host = value
+				continue
+			}
+			req.Header.Add(key, value)
+		}
+	}
+
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", "curl/8.5.0")
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) == 0 {
+		return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
+	}
+
+	if len(foundClients) > 1 {
+		return failure.New(failure.InvalidArgument, "%q matches multiple clients please choose a more specific identifier", specifier).With("client", specifier)
+	}
+
+	var (
+		id     string
+		client *ssh.ServerConn
+	)
+	for k := range foundClients {
+		id = k
+		client = foundClients[k]
+		break
+	}
+
+	var proxy *url.URL
+	if p, ok := firstValue(values, "proxy"); ok {
+		if p == "client" {
+			proxy, err = clientProxy(client)
+		} else {
+			proxy, err = parseCurlProxy(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	unlock, err := lockClient(id, "curl", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	route, err := pivot.Open(id, client, nil)
+	if err != nil {
+		return failure.Wrap(failure.TransportUnavailable, err)
+	}
+	defer route.Close()
+
+	transport := &http.Transport{
+		DialContext:       route.DialContext,
+		ForceAttemptHTTP2: true,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: line.IsSet("k") || line.IsSet("insecure"),
+		},
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	httpClient := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !line.IsSet("L") && !line.IsSet("location") {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+
+	c.log.Info("%s sent %s %s from %s", user.Username(), method, u.Redacted(), id)
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return failure.New(failure.TransportUnavailable, "request from %s failed: %s", id, err).With("client", id).With("url", u.Redacted())
+	}
+	defer resp.Body.Close()
+
+	// One more than the limit, to tell a body that is exactly the limit from one that is longer
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return failure.New(failure.TransportUnavailable, "reading the response from %s failed: %s", id, err).With("client", id)
+	}
+
+	truncated := int64(len(content)) > maxSize
+	if truncated {
+		content = content[:maxSize]
+	}
+
+	if line.IsSet("json") {
+		out := curlResponse{
+			URL:        resp.Request.URL.Redacted(),
+			Proto:      resp.Proto,
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Headers:    resp.Header,
+			Truncated:  truncated,
+			ElapsedMS:  time.Since(start).Milliseconds(),
+		}
+		if proxy != nil {
+			out.Proxy = proxy.Redacted()
+		}
+
+		if utf8.Valid(content) {
+			s := string(content)
+			out.Body = &s
+		} else {
+			s := base64.StdEncoding.EncodeToString(content)
+			out.BodyBase64 = &s
+		}
+
+		b, err := json.Marshal(out)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tty, "%s\n", b)
+		return nil
+	}
+
+	if line.IsSet("i") || line.IsSet("include") {
+		fmt.Fprintf(tty, "%s %s\n", resp.Proto, resp.Status)
+		resp.Header.Write(tty)
+		fmt.Fprint(tty, "\n")
+	}
+
+	tty.Write(content)
+
+	if truncated {
+		fmt.Fprintf(tty, "\n[body truncated at %d bytes, see --max-size]\n", maxSize)
+	}
+
+	return nil
+}
+
+func (c *curl) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (c *curl) Help(explain bool) string {
+	if explain {
+		return "Make an http request from a client's network, without setting up a socks proxy"
+	}
+
+	return terminal.MakeHelpText(c.ValidArgs(),
+		"curl [OPTIONS] <client> [method] <url>",
+		"The connection is made from the client, TLS is done on the server.",
+		"Put the client, method and url after any flags that take a value, or before all flags.",
+	)
+}
+
+func Curl(log logger.Logger) *curl {
+	return &curl{
+		log: log,
+	}
+}
+
+func (c *curl) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "curl fileserver http://intranet.corp/", Description: "Fetch the intranet home page as fileserver sees it"},
+		{Command: "curl -i --proxy client fileserver https://example.com", Description: "Go out through the same proxy fileserver uses, and show the headers"},
+		{Command: "curl -H 'Content-Type: application/json' -d '{\"a\":1}' fileserver PUT http://10.0.0.5:8080/api", Description: "Send a PUT with a json body"},
+		{Command: "ssh your.rssh.server -p 3232 curl --json fileserver http://10.0.0.5/ | jq .status_code", Description: "Use the response in a script"},
+	}
+}
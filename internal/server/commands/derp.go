@@ -0,0 +1,313 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/nat"
+	vderp "github.com/NHAS/reverse_ssh/internal/nat/derpmap"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// Region id used for maps built from --node, high enough to not collide with tailscale's
+const customDERPRegionID = 900
+
+type autoDERPEntry struct {
+	ObserverID string
+	Source     string
+}
+
+var autoDERPMaps = map[string]autoDERPEntry{}
+
+type derp struct {
+	log     logger.Logger
+	datadir string
+}
+
+func (d *derp) ValidArgs() map[string]string {
+	r := map[string]string{
+		"l":     "Show where clients get their relay map from",
+		"push":  "Push the server's relay map, or one from --file or --node",
+		"file":  "Push the relay map in this file, in tailscale's derp map format (admin only)",
+		"node":  "Push a map of only this relay, host:port. Can be given multiple times",
+		"reset": "Tell clients to go back to their default relay map",
+		"auto":  "Also push to clients that connect later",
+	}
+
+	addDuplicateFlags("Clients to change, takes a pattern, e.g -c *, --client your.hostname.here", r, "client", "c")
+
+	return r
+}
+
+func (d *derp) signer() (ssh.Signer, error) {
+	// An escrowed key is only ever in memory
+	if signer := hostkey.Signer(); signer != nil {
+		return signer, nil
+	}
+
+	privateBytes, err := os.ReadFile(filepath.Join(d.datadir, "id_ed25519"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read server key: %w", err)
+	}
+
+	return ssh.ParsePrivateKey(privateBytes)
+}
+
+func nodesDERPMap(nodes []string) (*vderp.Map, error) {
+	region := vderp.Region{
+		RegionID:   customDERPRegionID,
+		RegionCode: "rssh",
+		RegionName: "rssh pushed relays",
+	}
+
+	for i, n := range nodes {
+		host, port, err := net.SplitHostPort(n)
+		if err != nil {
+			return nil, failure.Wrap(failure.InvalidArgument, fmt.Errorf("relay %q is not host:port: %w", n, err))
+		}
+
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, failure.New(failure.InvalidArgument, "relay %q has an invalid port", n)
+		}
+
+		region.Nodes = append(region.Nodes, vderp.Node{
+			Name:     fmt.Sprintf("%d%c", customDERPRegionID, 'a'+i%26),
+			RegionID: customDERPRegionID,
+			HostName: host,
+			DERPPort: p,
+		})
+	}
+
+	return &vderp.Map{Regions: map[int]vderp.Region{customDERPRegionID: region}}, nil
+}
+
+func sendDERPMap(sc ssh.Conn, signed nat.SignedDERPMap) error {
+	ok, reply, err := sc.SendRequest("derp-map@rssh", true, ssh.Marshal(&signed))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if len(reply) == 0 {
+			return failure.New(failure.ClientRefused, "client does not support pushed relay maps")
+		}
+		return failure.New(failure.ClientRefused, "%s", string(reply))
+	}
+
+	return nil
+}
+
+func (d *derp) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	auto := line.IsSet("auto")
+
+	if line.IsSet("l") && auto {
+		autoLck.Lock()
+		defer autoLck.Unlock()
+
+		criteria := []string{}
+		for c := range autoDERPMaps {
+			criteria = append(criteria, c)
+		}
+		sort.Strings(criteria)
+
+		for _, c := range criteria {
+			fmt.Fprintf(tty, "%s %s\n", c, autoDERPMaps[c].Source)
+		}
+		return nil
+	}
+
+	specifier, err := line.GetArgString("c")
+	if err != nil {
+		specifier, err = line.GetArgString("client")
+		if err != nil {
+			return failure.New(failure.InvalidArgument, "no clients specified, use -c <pattern>")
+		}
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) == 0 && !auto {
+		return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
+	}
+
+	if line.IsSet("l") {
+		for id, sc := range foundClients {
+			ok, source, _ := sc.SendRequest("query-derp-map@rssh", true, nil)
+			if !ok {
+				fmt.Fprintf(tty, "%s does not support pushed relay maps\n", id)
+				continue
+			}
+
+			fmt.Fprintf(tty, "%s (%s %s): %s\n", id, users.NormaliseHostname(sc.User()), sc.RemoteAddr().String(), source)
+		}
+		return nil
+	}
+
+	var (
+		m      *vderp.Map
+		source string
+	)
+
+	switch {
+	case line.IsSet("reset"):
+		source = "default"
+
+	case line.IsSet("push"):
+		if path, err := line.GetArgString("file"); err == nil {
+			if user.Privilege() != users.AdminPermissions {
+				return failure.New(failure.PermissionDenied, "only admins can push relay maps from files on the server")
+			}
+
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			m, err = vderp.ParseJSON(contents)
+			if err != nil {
+				return failure.Wrap(failure.InvalidArgument, fmt.Errorf("unable to parse relay map %s: %w", path, err))
+			}
+			source = path
+		} else if nodes, err := line.GetArgsString("node"); err == nil {
+			m, err = nodesDERPMap(nodes)
+			if err != nil {
+				return err
+			}
+			source = fmt.Sprintf("%v", nodes)
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			m, err = nat.FetchDERPMap(ctx, "")
+			if err != nil {
+				return failure.Wrap(failure.TransportUnavailable, fmt.Errorf("unable to get the server's relay map: %w", err))
+			}
+			source = nat.EffectiveDERPMapURL("")
+		}
+
+	default:
+		return failure.New(failure.InvalidArgument, "no actionable argument supplied, please add --push, --reset or -l (list)")
+	}
+
+	signer, err := d.signer()
+	if err != nil {
+		return err
+	}
+
+	signed, err := nat.SignDERPMap(signer, m)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockClients(clientIDs(foundClients), "derp", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied := len(foundClients)
+	for id, sc := range foundClients {
+		if err := sendDERPMap(sc, signed); err != nil {
+			applied--
+			fmt.Fprintf(tty, "failed to push relay map to %s: %s\n", id, err)
+		}
+	}
+
+	fmt.Fprintf(tty, "pushed %s relay map to %d clients (total %d)\n", source, applied, len(foundClients))
+
+	if !auto {
+		return nil
+	}
+
+	autoLck.Lock()
+	defer autoLck.Unlock()
+
+	if existing, ok := autoDERPMaps[specifier]; ok {
+		observers.ConnectionState.Deregister(existing.ObserverID)
+		delete(autoDERPMaps, specifier)
+	}
+
+	if m == nil {
+		return nil
+	}
+
+	entry := autoDERPEntry{
+		Source: source,
+	}
+
+	entry.ObserverID = observers.ConnectionState.Register(func(c observers.ClientState) {
+		if !user.Matches(specifier, c.ID, c.IP) || c.Status != "connected" {
+			return
+		}
+
+		client, err := user.GetClient(c.ID)
+		if err != nil {
+			return
+		}
+
+		if err := sendDERPMap(client, signed); err != nil {
+			d.log.Warning("failed to push relay map to client %s: %s", c.ID, err)
+		}
+	})
+
+	autoDERPMaps[specifier] = entry
+
+	return nil
+}
+
+func (d *derp) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (d *derp) Help(explain bool) string {
+	if explain {
+		return "Change the relays clients use for ts:// connections"
+	}
+
+	return terminal.MakeHelpText(d.ValidArgs(),
+		"derp [OPTIONS] -c <pattern>",
+		"Maps are signed with the server key, clients only accept them from the server they are connected to and only if newer than the map they have.",
+		"Pushed maps last until the client restarts.",
+	)
+}
+
+func DERP(log logger.Logger, datadir string) *derp {
+	return &derp{
+		log:     log,
+		datadir: datadir,
+	}
+}
+
+func (d *derp) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "derp -c * --push --auto", Description: "Make every client use the same relays as the server, including new ones"},
+		{Command: "derp -c fileserver --push --node relay.example.com:443", Description: "Use only your own relay for fileserver"},
+		{Command: "derp -c fileserver -l", Description: "Show which relay map fileserver is using"},
+		{Command: "derp -c fileserver --reset", Description: "Go back to the default relay map"},
+	}
+}
@@ -3,8 +3,10 @@ package commands
 import (
 	"fmt"
 	"io"
+	"maps"
 	"strings"
 
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -15,25 +17,28 @@ type exec struct {
 }
 
 func (e *exec) ValidArgs() map[string]string {
-	return map[string]string{
+	r := map[string]string{
 		"q":   "Quiet, no output (will also remove confirmation prompt)",
 		"y":   "No confirmation prompt",
 		"raw": "Do not label output blocks with the client they came from",
 	}
+	maps.Copy(r, processFlags)
+	return r
 }
 
 func (e *exec) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
-	if len(line.Arguments) < 2 {
-		return fmt.Errorf("Not enough arguments supplied. Needs at least, host|filter command...")
+	process, args, err := parseProcessOptions(line)
+	if err != nil {
+		return err
 	}
 
-	filter := ""
-	command := ""
-	if len(line.ArgumentsAsStrings()) > 0 {
-		filter = line.ArgumentsAsStrings()[0]
-		command = line.RawLine[line.Arguments[0].End():]
+	if len(args) < 2 {
+		return failure.New(failure.InvalidArgument, "Not enough arguments supplied. Needs at least, host|filter command...")
 	}
 
+	filter := args[0].Value()
+	command := line.RawLine[args[0].End():]
+
 	command = strings.TrimSpace(command)
 
 	matchingClients, err := user.SearchClients(filter)
@@ -42,7 +47,7 @@ func (e *exec) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 	}
 
 	if len(matchingClients) == 0 {
-		return fmt.Errorf("Unable to find match for '" + filter + "'\n")
+		return failure.New(failure.ClientNotFound, "Unable to find match for '%s'\n", filter).With("client", filter)
 	}
 
 	if !(line.IsSet("q") || line.IsSet("raw")) {
@@ -67,7 +72,7 @@ func (e *exec) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 			}
 
 			if !(b[0] == 'y' || b[0] == 'Y') {
-				return fmt.Errorf("\nUser did not enter y/Y, aborting")
+				return failure.New(failure.Aborted, "\nUser did not enter y/Y, aborting")
 			}
 		}
 	}
@@ -86,36 +91,61 @@ func (e *exec) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 			fmt.Fprintf(tty, "%s (%s) output:\n", id, client.User()+"@"+client.RemoteAddr().String())
 		}
 
-		newChan, r, err := client.OpenChannel("session", nil)
-		if err != nil && !line.IsSet("q") {
-			fmt.Fprintf(tty, "Failed: %s\n", err)
+		unlock, err := lockClient(id, "exec", user.Username(), false)
+		if err != nil {
+			if !line.IsSet("q") {
+				fmt.Fprintf(tty, "Failed: %s\n", err)
+			}
 			continue
 		}
-		go ssh.DiscardRequests(r)
+		e.run(client, tty, &process, commandByte, line.IsSet("q"))
+		unlock()
+	}
+
+	fmt.Fprint(tty, "\n")
 
-		response, err := newChan.SendRequest("exec", true, commandByte)
-		if err != nil && !line.IsSet("q") {
+	return nil
+}
+
+func (e *exec) run(client *ssh.ServerConn, tty io.ReadWriter, process *processOptions, commandByte []byte, quiet bool) {
+	newChan, r, err := client.OpenChannel("session", nil)
+	if err != nil {
+		if !quiet {
 			fmt.Fprintf(tty, "Failed: %s\n", err)
-			continue
 		}
+		return
+	}
+	go ssh.DiscardRequests(r)
+	defer newChan.Close()
 
-		if !response && !line.IsSet("q") {
-			fmt.Fprintf(tty, "Failed: client refused\n")
-			continue
+	if err := process.send(newChan); err != nil {
+		if !quiet {
+			fmt.Fprintf(tty, "Failed: %s\n", err)
 		}
+		return
+	}
 
-		if line.IsSet("q") {
-			io.Copy(io.Discard, newChan)
-			continue
+	response, err := newChan.SendRequest("exec", true, commandByte)
+	if err != nil {
+		if !quiet {
+			fmt.Fprintf(tty, "Failed: %s\n", err)
 		}
+		return
+	}
 
-		io.Copy(tty, newChan)
-		newChan.Close()
+	if !response {
+		if !quiet {
+			fmt.Fprintf(tty, "Failed: client refused\n")
+		}
+		return
 	}
 
-	fmt.Fprint(tty, "\n")
+	if quiet {
+		io.Copy(io.Discard, newChan)
+		return
+	}
 
-	return nil
+	io.Copy(tty, newChan)
 }
 
 func (e *exec) Expect(line terminal.ParsedLine) []string {
@@ -132,3 +162,13 @@ func (e *exec) Help(explain bool) string {
 		"Filter uses glob matching against all attributes of a target (hostname, ip, id), allowing you to run a command against multiple machines",
 	)
 }
+
+func (e *exec) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "exec * whoami", Description: "Run whoami on every client, asking for confirmation first"},
+		{Command: "exec -y 192.168.1.* id", Description: "Run id on all clients from 192.168.1.0/24 without a prompt"},
+		{Command: "exec -q *.prod systemctl restart nginx", Description: "Run a command with no output"},
+		{Command: "exec --cwd /var/www --env APP_ENV=staging -y web01 ./deploy.sh", Description: "Run a command in a directory with an extra environment variable"},
+		{Command: "exec --uid 33 -y web* id", Description: "Run a command as www-data on clients running as root"},
+	}
+}
@@ -0,0 +1,202 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/keyfiles"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultGrantDuration = 8 * time.Hour
+
+var guestNameMatcher = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]*$`)
+
+type grantAccess struct {
+	datadir string
+}
+
+func (g *grantAccess) ValidArgs() map[string]string {
+	return map[string]string{
+		"pubkey":  "Public key to let in, in authorized_keys format, e.g --pubkey ssh-ed25519 AAAA...",
+		"name":    "Username the guest logs in with, their key is kept in keys/<name>",
+		"expires": "How long the access lasts, e.g 30m or 8h (default 8h)",
+		"role":    "readonly (default) to only see clients and server status, or user for the same access as a normal user",
+		"l":       "List temporary access that has not expired yet",
+		"r":       "Revoke temporary access for a name now, and disconnect their sessions",
+	}
+}
+
+func (g *grantAccess) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if user.Privilege() != users.AdminPermissions {
+		return failure.New(failure.PermissionDenied, "only admins can grant access")
+	}
+
+	keysDir := filepath.Join(g.datadir, "keys")
+
+	if line.IsSet("l") {
+		return g.list(tty, keysDir)
+	}
+
+	if name, err := line.GetArgString("r"); err == nil {
+		if !guestNameMatcher.MatchString(name) {
+			return failure.New(failure.InvalidArgument, "%q is not a valid name", name)
+		}
+
+		removed, err := keyfiles.RemoveExpiring(filepath.Join(keysDir, name), time.Time{}, true)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if len(removed) == 0 {
+			return failure.New(failure.NotFound, "%s has no temporary access", name).With("name", name)
+		}
+
+		fmt.Fprintf(tty, "Revoked %d temporary keys for %s, disconnected %d sessions\n", len(removed), name, users.DisconnectTemporary(name))
+		return nil
+	}
+
+	pubkey, ok := line.Flags["pubkey"]
+	if !ok || len(pubkey.Args) == 0 {
+		return failure.New(failure.InvalidArgument, "no public key given, use --pubkey <key>")
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(pubkey.ArgValues(), " ")))
+	if err != nil {
+		return failure.Wrap(failure.InvalidArgument, fmt.Errorf("unable to parse public key: %w", err))
+	}
+
+	name, err := line.GetArgString("name")
+	if err != nil {
+		return failure.New(failure.InvalidArgument, "no name given, use --name <username>")
+	}
+	if !guestNameMatcher.MatchString(name) {
+		return failure.New(failure.InvalidArgument, "name %q can only contain letters, numbers, '.', '_' and '-'", name)
+	}
+
+	// Guests share everything that belongs to the username, so a name an operator already logs in with is not handed out
+	existing, err := keyfiles.Entries(filepath.Join(keysDir, name))
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if e.Expires.IsZero() {
+			return failure.New(failure.InvalidArgument, "%s is an existing operator with permanent keys, choose another name", name).With("name", name)
+		}
+	}
+
+	duration := defaultGrantDuration
+	if expires, err := line.GetArgString("expires"); err == nil {
+		duration, err = time.ParseDuration(expires)
+		if err != nil || duration <= 0 {
+			return failure.New(failure.InvalidArgument, "expires %q is not a positive duration, e.g 8h", expires)
+		}
+	}
+
+	role, err := line.GetArgString("role")
+	if err != nil {
+		role = "readonly"
+	}
+
+	expires := time.Now().Add(duration).Truncate(time.Second)
+
+	options := keyfiles.ExpiryOption + "=\"" + keyfiles.FormatExpiry(expires) + "\""
+	switch role {
+	case "readonly":
+		options += "," + keyfiles.ReadOnlyOption
+	case "user":
+	default:
+		return failure.New(failure.InvalidArgument, "role %q is not readonly or user", role)
+	}
+
+	entry := fmt.Sprintf("%s %s granted by %s", options, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), user.Username())
+	if err := keyfiles.Append(filepath.Join(keysDir, name), entry); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(tty, "Granted %s %s access until %s (%s), log in as %q\n", name, role, expires.Format("2006/01/02 15:04:05"), duration, name)
+
+	return nil
+}
+
+func (g *grantAccess) list(tty io.ReadWriter, keysDir string) error {
+	entries, err := os.ReadDir(keysDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	t, _ := table.NewTable("Temporary Access", "Name", "Role", "Expires", "Remaining", "Key", "Comment")
+
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		grants, err := keyfiles.Grants(filepath.Join(keysDir, name))
+		if err != nil {
+			continue
+		}
+
+		for _, grant := range grants {
+			remaining := time.Until(grant.Expires)
+			if remaining <= 0 {
+				continue
+			}
+
+			role := "user"
+			if grant.ReadOnly {
+				role = "readonly"
+			}
+
+			t.AddValues(name, role, grant.Expires.Local().Format("2006/01/02 15:04:05"), remaining.Truncate(time.Minute).String(), grant.Fingerprint, grant.Comment)
+		}
+	}
+
+	t.Fprint(tty)
+
+	return nil
+}
+
+func (g *grantAccess) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (g *grantAccess) Help(explain bool) string {
+	if explain {
+		return "Give someone operator access that expires on its own."
+	}
+
+	return terminal.MakeHelpText(g.ValidArgs(),
+		"grant-access --pubkey <key> --name <username> [--expires 8h] [--role readonly|user]",
+		"The key is added to keys/<username> with an expiry-time option, it stops working when that passes, open sessions are closed and the expired entry is removed.",
+		"readonly guests can list clients and watch the server, but cannot connect to, change or forward through anything.",
+	)
+}
+
+func GrantAccess(datadir string) *grantAccess {
+	return &grantAccess{
+		datadir: datadir,
+	}
+}
+
+func (g *grantAccess) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "grant-access --pubkey ssh-ed25519 AAAA... --name alice --expires 4h", Description: "Let alice look at clients for four hours"},
+		{Command: "grant-access --pubkey ssh-ed25519 AAAA... --name bob --role user", Description: "Give bob normal user access for the default eight hours"},
+		{Command: "grant-access -r alice", Description: "Cut alice off now"},
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"sort"
 
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -15,64 +16,143 @@ type help struct {
 }
 
 func (h *help) ValidArgs() map[string]string {
-	return map[string]string{"l": "List all function names only"}
+	r := map[string]string{"l": "List all function names only"}
+
+	addDuplicateFlags("Search names, descriptions, flags and examples of all commands", r, "search", "s")
+
+	return r
 }
 
-func (h *help) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+func (h *help) table(tty io.Writer, name string, entries []terminal.HelpEntry) error {
+	t, err := table.NewTable(name, "Function", "Module", "Purpose")
+	if err != nil {
+		return err
+	}
 
-	if line.IsSet("l") {
-		funcs := []string{}
-		for funcName := range allCommands {
-			funcs = append(funcs, funcName)
+	for _, e := range entries {
+		err = t.AddValues(e.Name, e.Module, e.Description)
+		if err != nil {
+			return err
 		}
+	}
 
-		sort.Strings(funcs)
+	t.Fprint(tty)
 
-		for _, funcName := range funcs {
-			fmt.Fprintln(tty, funcName)
-		}
+	return nil
+}
 
-		return nil
+func (h *help) describe(tty io.Writer, e terminal.HelpEntry) {
+	fmt.Fprintf(tty, "\n%s - %s\n", e.Name, e.Description)
+
+	fmt.Fprint(tty, "\nusage:\n")
+	for _, s := range e.Synopsis {
+		fmt.Fprintf(tty, "  %s\n", s)
 	}
 
-	if len(line.Arguments) < 1 {
+	if len(e.Details) > 0 {
+		fmt.Fprintln(tty)
+		for _, d := range e.Details {
+			fmt.Fprintf(tty, "  %s\n", d)
+		}
+	}
 
-		t, err := table.NewTable("Commands", "Function", "Purpose")
-		if err != nil {
-			return err
+	if len(e.Flags) > 0 {
+		width := 0
+		for _, f := range e.Flags {
+			width = max(width, len(f.Name))
 		}
 
-		keys := []string{}
-		for funcName := range allCommands {
-			keys = append(keys, funcName)
+		fmt.Fprint(tty, "\nflags:\n")
+		for _, f := range e.Flags {
+			fmt.Fprintf(tty, "  %-*s  %s\n", width, f.Name, f.Description)
 		}
+	}
 
-		sort.Strings(keys)
+	if len(e.Examples) > 0 {
+		fmt.Fprint(tty, "\nexamples:\n")
+		for _, example := range e.Examples {
+			fmt.Fprintf(tty, "  %s\n", example.Command)
+			if example.Description != "" {
+				fmt.Fprintf(tty, "      %s\n", example.Description)
+			}
+		}
+	}
+
+	fmt.Fprintln(tty)
+}
 
-		for _, k := range keys {
-			hf := allCommands[k].Help
+func (h *help) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	entries := HelpEntries()
 
-			err = t.AddValues(k, hf(true))
-			if err != nil {
-				return err
+	if line.IsSet("l") {
+		for _, e := range entries {
+			fmt.Fprintln(tty, e.Name)
+		}
+
+		return nil
+	}
+
+	search, err := line.GetArgString("search")
+	if err != nil {
+		search, err = line.GetArgString("s")
+	}
+
+	if err == nil {
+		relevance := map[string]int{}
+
+		found := []terminal.HelpEntry{}
+		for _, e := range entries {
+			if r := e.Matches(search); r > 0 {
+				relevance[e.Name] = r
+				found = append(found, e)
 			}
 		}
 
-		t.Fprint(tty)
+		if len(found) == 0 {
+			return failure.New(failure.NotFound, "No commands matched %q", search)
+		}
 
-		return nil
+		sort.SliceStable(found, func(i, j int) bool {
+			return relevance[found[i].Name] > relevance[found[j].Name]
+		})
+
+		return h.table(tty, "Matching "+search, found)
+	}
+
+	if line.IsSet("search") || line.IsSet("s") {
+		return failure.New(failure.InvalidArgument, "search requires a term, e.g help --search forward")
 	}
 
-	l, ok := allCommands[line.Arguments[0].Value()]
-	if !ok {
-		return fmt.Errorf("Command %s not found", line.Arguments[0].Value())
+	if len(line.Arguments) < 1 {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Module < entries[j].Module
+		})
+
+		return h.table(tty, "Commands", entries)
 	}
 
-	fmt.Fprintf(tty, "\ndescription:\n%s\n", l.Help(true))
+	target := line.Arguments[0].Value()
 
-	fmt.Fprintf(tty, "\nusage:\n%s\n", l.Help(false))
+	if _, ok := commandModules[target]; ok {
+		inModule := []terminal.HelpEntry{}
+		for _, e := range entries {
+			if e.Module == target {
+				inModule = append(inModule, e)
+			}
+		}
 
-	return nil
+		return h.table(tty, target, inModule)
+	}
+
+	for _, e := range entries {
+		if e.Name == target {
+			h.describe(tty, e)
+			return nil
+		}
+	}
+
+	return failure.New(failure.NotFound, "Command %s not found", target)
 }
 
 func (h *help) Expect(line terminal.ParsedLine) []string {
@@ -91,7 +171,16 @@ func (h *help) Help(explain bool) string {
 
 	return terminal.MakeHelpText(h.ValidArgs(),
 		"help",
-		"help <functions>",
+		"help <function|module>",
 		description,
+		"Modules are: clients, forwarding, monitoring, console",
 	)
 }
+
+func (h *help) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "help connect", Description: "Show usage, flags and examples for connect"},
+		{Command: "help clients", Description: "List the commands for managing clients"},
+		{Command: "help --search forward", Description: "Find commands to do with forwarding"},
+	}
+}
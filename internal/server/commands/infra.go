@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/infra"
+	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/server/webserver"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type infraCommand struct {
+}
+
+func (i *infraCommand) ValidArgs() map[string]string {
+	return map[string]string{
+		"resolver": "Public resolver, host:port, to compare answers with. Can be given multiple times (default 1.1.1.1, 8.8.8.8 and 9.9.9.9)",
+		"no-ct":    "Do not search CT logs, the search tells crt.sh which names and certificate the server uses",
+	}
+}
+
+func (i *infraCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	values, positional := splitValueFlags(line, map[string]bool{"resolver": true})
+	if len(positional) == 0 || positional[0] != "check" {
+		return failure.New(failure.InvalidArgument, "%s", i.Help(false))
+	}
+
+	addresses := positional[1:]
+	if len(addresses) == 0 {
+		if webserver.DefaultConnectBack == "" {
+			return failure.New(failure.InvalidArgument, "the server has no external address, give the addresses to check")
+		}
+		addresses = []string{webserver.DefaultConnectBack}
+	}
+
+	cert, err := multiplexer.ServerMultiplexer.Certificate()
+	if err != nil {
+		fmt.Fprintf(tty, "unable to load the tls certificate, not checking it: %s\n", err)
+	}
+
+	fmt.Fprintln(tty, "Checking, this can take a few seconds...")
+
+	findings := infra.Check(context.Background(), addresses, cert, infra.Options{
+		Resolvers: values["resolver"],
+		SkipCT:    line.IsSet("no-ct"),
+	})
+
+	t, err := table.NewTable("Infrastructure check", "Check", "Target", "Result", "Detail")
+	if err != nil {
+		return err
+	}
+
+	warnings := 0
+	for _, f := range findings {
+		if f.Level == infra.Warning {
+			warnings++
+		}
+
+		if err := t.AddValues(f.Check, f.Target, string(f.Level), f.Detail); err != nil {
+			return err
+		}
+	}
+
+	t.Fprint(tty)
+
+	if warnings > 0 {
+		fmt.Fprintf(tty, "%d warnings, fix them before handing out links\n", warnings)
+	}
+	return nil
+}
+
+func (i *infraCommand) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (i *infraCommand) Help(explain bool) string {
+	if explain {
+		return "Check the server's address and certificate for mistakes that give it away"
+	}
+
+	return terminal.MakeHelpText(i.ValidArgs(),
+		"infra check [OPTIONS] [address...]",
+		"Checks the external address, or the given addresses, before links are handed out. Warns when a name already has certificates in certificate transparency logs, where anyone watching them finds it,",
+		"when it resolves differently with the system resolver and public ones, or to a private address, and when the tls certificate is self signed, expiring, in CT logs, or not valid for the address.",
+		"Lookups go to the public resolvers and, unless --no-ct is given, crt.sh, so run it from somewhere those queries are safe to make.",
+	)
+}
+
+func (i *infraCommand) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "infra check", Description: "Check the server's external address and tls certificate"},
+		{Command: "infra check --no-ct updates.example.com", Description: "Check a name without searching CT logs"},
+		{Command: "infra check --resolver 192.168.1.1:53 updates.example.com", Description: "Compare the system resolver with the target network's resolver"},
+	}
+}
@@ -1,6 +1,8 @@
 package commands
 
 import (
+	"sort"
+
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
@@ -9,45 +11,154 @@ import (
 // This is used for help, so we can generate the nice table
 // I would prefer if we could do some sort of autoregistration process for these
 var allCommands = map[string]terminal.Command{
-	"ls":           &list{},
-	"help":         &help{},
-	"kill":         &kill{},
-	"connect":      &connect{},
-	"exit":         &exit{},
-	"link":         &link{},
-	"exec":         &exec{},
-	"who":          &who{},
-	"watch":        &watch{},
-	"listen":       &listen{},
-	"webhook":      &webhook{},
-	"version":      &version{},
-	"priv":         &privilege{},
-	"access":       &access{},
-	"autocomplete": &shellAutocomplete{},
-	"log":          &logCommand{},
-	"clear":        &clear{},
+	"ls":             &list{},
+	"help":           &help{},
+	"kill":           &kill{},
+	"connect":        &connect{},
+	"exit":           &exit{},
+	"link":           &link{},
+	"exec":           &exec{},
+	"who":            &who{},
+	"watch":          &watch{},
+	"listen":         &listen{},
+	"webhook":        &webhook{},
+	"version":        &version{},
+	"priv":           &privilege{},
+	"access":         &access{},
+	"autocomplete":   &shellAutocomplete{},
+	"log":            &logCommand{},
+	"clear":          &clear{},
+	"stats":          &stats{},
+	"top":            &top{},
+	"bind":           &bind{},
+	"mesh":           &meshCommand{},
+	"qos":            &qos{},
+	"inspect":        &inspect{},
+	"derp":           &derp{},
+	"nat":            &natCommand{},
+	"socks":          &socks{},
+	"nc":             &netcat{},
+	"curl":           &curl{},
+	"grant-access":   &grantAccess{},
+	"client-limits":  &clientLimits{},
+	"client-sources": &clientSources{},
+	"filter":         &contentFilter{},
+	"speedtest":      &speedtest{},
+	"known-hosts":    &knownHostsCommand{},
+	"vault":          &vaultCommand{},
+	"sync":           &syncCommand{},
+	"reap":           &reap{},
+	"campaign":       &campaign{},
+	"audit":          &auditCommand{},
+	"infra":          &infraCommand{},
+}
+
+// Commands that only look, the only ones read only users get
+var readOnlyCommands = map[string]bool{
+	"ls":           true,
+	"help":         true,
+	"exit":         true,
+	"who":          true,
+	"watch":        true,
+	"version":      true,
+	"priv":         true,
+	"autocomplete": true,
+	"clear":        true,
+	"stats":        true,
+	"top":          true,
+	"nat":          true,
+	"campaign":     true,
+}
+
+// Groups of related commands, so help can be asked for a whole area at once
+var commandModules = map[string][]string{
+	"clients":    {"ls", "connect", "exec", "kill", "access", "log", "client-limits", "client-sources", "speedtest", "vault", "sync", "campaign"},
+	"forwarding": {"listen", "link", "inspect", "mesh", "qos", "derp", "nat", "socks", "nc", "curl", "known-hosts", "infra"},
+	"monitoring": {"watch", "webhook", "stats", "top", "who", "filter", "reap", "audit"},
+	"console":    {"help", "exit", "clear", "priv", "version", "autocomplete", "bind", "grant-access"},
+}
+
+func moduleOf(command string) string {
+	for module, commands := range commandModules {
+		for _, c := range commands {
+			if c == command {
+				return module
+			}
+		}
+	}
+	return ""
+}
+
+// HelpEntries returns the structured help for every command, sorted by name
+func HelpEntries() (entries []terminal.HelpEntry) {
+	for name, command := range allCommands {
+		entries = append(entries, terminal.NewHelpEntry(name, moduleOf(name), command))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	return entries
 }
 
 func CreateCommands(session string, user *users.User, log logger.Logger, datadir string) map[string]terminal.Command {
 
 	var o = map[string]terminal.Command{
-		"ls":           &list{},
-		"help":         &help{},
-		"kill":         Kill(log),
-		"connect":      Connect(session, user, log),
-		"exit":         &exit{},
-		"link":         &link{},
-		"exec":         &exec{},
-		"who":          &who{},
-		"watch":        Watch(datadir),
-		"listen":       Listen(log),
-		"webhook":      &webhook{},
-		"version":      &version{},
-		"priv":         &privilege{},
-		"access":       &access{},
-		"autocomplete": &shellAutocomplete{},
-		"log":          Log(log),
-		"clear":        &clear{},
+		"ls":             &list{},
+		"help":           &help{},
+		"kill":           Kill(log),
+		"connect":        Connect(session, user, log),
+		"exit":           &exit{},
+		"link":           &link{},
+		"exec":           &exec{},
+		"who":            &who{},
+		"watch":          Watch(datadir),
+		"listen":         Listen(log),
+		"webhook":        &webhook{},
+		"version":        &version{},
+		"priv":           &privilege{},
+		"access":         Access(datadir),
+		"autocomplete":   &shellAutocomplete{},
+		"log":            Log(log),
+		"clear":          &clear{},
+		"stats":          &stats{},
+		"top":            &top{},
+		"bind":           &bind{},
+		"mesh":           &meshCommand{},
+		"qos":            QoS(log),
+		"inspect":        &inspect{},
+		"derp":           DERP(log, datadir),
+		"nat":            &natCommand{},
+		"socks":          Socks(session, log),
+		"nc":             Netcat(log),
+		"curl":           Curl(log),
+		"grant-access":   GrantAccess(datadir),
+		"client-limits":  &clientLimits{},
+		"client-sources": &clientSources{},
+		"filter":         &contentFilter{},
+		"speedtest":      &speedtest{},
+		"known-hosts":    &knownHostsCommand{},
+		"vault":          &vaultCommand{},
+		"sync":           Sync(datadir),
+		"reap":           &reap{},
+		"campaign":       &campaign{},
+		"audit":          &auditCommand{},
+		"infra":          &infraCommand{},
+	}
+
+	// The session's own key decides, another login with the same username may have used a different one
+	readOnly := user.Privilege() == users.ReadOnlyPermissions
+	if conn, err := user.Session(session); err == nil {
+		readOnly = conn.ReadOnly()
+	}
+
+	if readOnly {
+		for name := range o {
+			if !readOnlyCommands[name] {
+				delete(o, name)
+			}
+		}
 	}
 
 	return o
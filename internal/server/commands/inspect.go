@@ -0,0 +1,294 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/server/webserver"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type inspect struct {
+}
+
+func (i *inspect) ValidArgs() map[string]string {
+	return map[string]string{
+		"file":       "Inspect a client binary at this path on the server instead of a download link (admin only)",
+		"provenance": "Show and verify the signed record of how the client was built, instead of its settings",
+	}
+}
+
+func readerHash(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return readerHash(f)
+}
+
+// downloadHash hashes a build wherever it is stored
+func downloadHash(d data.Download) (string, error) {
+	f, err := data.OpenDownload(d, "")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return readerHash(f)
+}
+
+// findDownload finds the download a file on disk was built as, by its hash
+func findDownload(path string) (data.Download, error) {
+	hash, err := fileHash(path)
+	if err != nil {
+		return data.Download{}, err
+	}
+
+	downloads, err := data.ListDownloads("")
+	if err != nil {
+		return data.Download{}, err
+	}
+
+	for _, d := range downloads {
+		if h, err := downloadHash(d); err == nil && h == hash {
+			return d, nil
+		}
+	}
+
+	return data.Download{}, failure.New(failure.NotFound, "%s (sha256 %s) was not built by this server, or its download link has been removed", path, hash)
+}
+
+func (i *inspect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	var (
+		download data.Download
+		binary   []byte
+	)
+
+	// The download name can be given to --provenance, as the parser takes what follows a flag as its value
+	var names []string
+	for _, argument := range line.Arguments {
+		names = append(names, argument.Value())
+	}
+	if line.IsSet("provenance") {
+		given, _ := line.GetArgsString("provenance")
+		names = append(names, given...)
+	}
+
+	if p, err := line.GetArgString("file"); err == nil {
+		if user.Privilege() != users.AdminPermissions {
+			return failure.New(failure.PermissionDenied, "only admins can inspect files on the server")
+		}
+
+		download, err = findDownload(p)
+		if err != nil {
+			return err
+		}
+
+		if !user.InCampaign(download.Campaign) {
+			return failure.New(failure.PermissionDenied, "%s was built for another campaign", p)
+		}
+
+		binary, err = os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+	} else if err != terminal.ErrFlagNotSet {
+		return err
+	} else {
+		if len(names) != 1 {
+			return failure.New(failure.InvalidArgument, "%s", i.Help(false))
+		}
+
+		downloads, err := data.ListDownloads(names[0])
+		if err != nil {
+			return err
+		}
+
+		d, ok := downloads[names[0]]
+		if !ok || !user.InCampaign(d.Campaign) {
+			return failure.New(failure.NotFound, "no download link named %q", names[0])
+		}
+
+		f, err := data.OpenDownload(d, "")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		download = d
+		binary, err = io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	if line.IsSet("provenance") {
+		return i.provenance(tty, download, binary)
+	}
+
+	settings, err := webserver.DecodeEmbeddedSettings(download)
+	if err != nil {
+		return err
+	}
+
+	t, err := table.NewTable(fmt.Sprintf("%s (%s %s/%s%s)", download.UrlPath, download.FileType, download.Goos, download.Goarch, download.Goarm), "Setting", "Value", "In Binary")
+	if err != nil {
+		return err
+	}
+
+	found, checked := 0, 0
+	for _, setting := range settings {
+		inBinary := "-"
+		if setting.Value != "" && setting.Value != "false" && setting.Value != "true" {
+			// Booleans are too short to find meaningfully
+			checked++
+			inBinary = "no"
+			if bytes.Contains(binary, []byte(setting.Value)) {
+				found++
+				inBinary = "yes"
+			}
+		}
+
+		t.AddValues(setting.Name, setting.Value, inBinary)
+	}
+
+	t.Fprint(tty)
+
+	switch {
+	case found == checked:
+		fmt.Fprintln(tty, "Every recorded setting was found in the binary")
+	case found == 0:
+		fmt.Fprintln(tty, "No recorded settings were found in the binary, it may be packed (upx) or obfuscated (garble)")
+	default:
+		fmt.Fprintf(tty, "Only %d of %d recorded settings were found in the binary, it may have been modified\n", found, checked)
+	}
+
+	return nil
+}
+
+func (i *inspect) provenance(tty io.Writer, download data.Download, binary []byte) error {
+	statement, envelope, err := webserver.VerifyProvenance(download)
+	if envelope.Payload == "" {
+		return failure.New(failure.NotFound, "%s", err)
+	}
+
+	signature := "valid, signed by this server"
+	if err != nil {
+		signature = "INVALID: " + err.Error()
+	}
+
+	sum := sha256.Sum256(binary)
+	artifact := hex.EncodeToString(sum[:])
+	matches := "no, the binary is not what was built"
+	for _, subject := range statement.Subject {
+		if subject.Digest["sha256"] == artifact {
+			matches = "yes"
+		}
+	}
+
+	definition := statement.Predicate.BuildDefinition
+	run := statement.Predicate.RunDetails
+
+	t, err := table.NewTable(fmt.Sprintf("Provenance of %s", download.UrlPath), "Field", "Value")
+	if err != nil {
+		return err
+	}
+
+	t.AddValues("Signature", signature)
+	t.AddValues("Artifact sha256", artifact)
+	t.AddValues("Matches artifact", matches)
+	t.AddValues("Builder", run.Builder.ID)
+	t.AddValues("Builder version", run.Builder.Version["rssh"])
+	t.AddValues("Started", run.Metadata.StartedOn.Format(time.RFC3339))
+	t.AddValues("Finished", run.Metadata.FinishedOn.Format(time.RFC3339))
+	t.AddValues("Target", definition.ExternalParameters.Target+" "+definition.ExternalParameters.Type)
+	t.AddValues("Toolchain", definition.InternalParameters.Toolchain)
+	t.AddValues("Tool", definition.InternalParameters.Tool)
+	t.AddValues("Arguments", strings.Join(definition.InternalParameters.Arguments, " "))
+
+	var environment []string
+	for name, value := range definition.InternalParameters.Environment {
+		environment = append(environment, name+"="+value)
+	}
+	slices.Sort(environment)
+	t.AddValues("Environment", strings.Join(environment, " "))
+
+	for _, dependency := range definition.ResolvedDependencies {
+		for algorithm, digest := range dependency.Digest {
+			t.AddValues(dependency.URI, algorithm+":"+digest)
+		}
+	}
+
+	// The values of embedded settings are only in the provenance as hashes, check them against what was recorded
+	if settings, err := webserver.DecodeEmbeddedSettings(download); err == nil {
+		for _, setting := range settings {
+			recorded := sha256.Sum256([]byte(setting.Value))
+			state := "matches"
+			if definition.InternalParameters.Embedded[setting.Name] != hex.EncodeToString(recorded[:]) {
+				state = "DIFFERS from the recorded setting"
+			}
+			t.AddValues("Embedded "+setting.Name, state)
+		}
+	}
+
+	t.Fprint(tty)
+
+	fmt.Fprintln(tty, "Signed statement (DSSE envelope):")
+	fmt.Fprintln(tty, download.Provenance)
+
+	return nil
+}
+
+func (i *inspect) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.WebServerFileIds}
+	}
+	return nil
+}
+
+func (i *inspect) Help(explain bool) string {
+	if explain {
+		return "Show the configuration a client was built with, and check it is in the binary"
+	}
+
+	return terminal.MakeHelpText(i.ValidArgs(),
+		"inspect <download name>",
+		"inspect --file <path>",
+		"inspect --provenance <download name>",
+		"inspect --file <path> --provenance",
+		"The configuration is recorded by link when the client is built, then each value is looked for in the binary.",
+		"Provenance is an in-toto statement (SLSA v1) of the source commit, toolchain, arguments and builder, signed by the server key when the client was built.",
+	)
+}
+
+func (i *inspect) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "inspect implant", Description: "Show the configuration of the client downloadable as /implant"},
+		{Command: "inspect --file /tmp/suspect.exe", Description: "Find which link a binary came from, and check its configuration"},
+		{Command: "inspect --provenance implant", Description: "Show exactly what the client at /implant was built from, and check the record is signed"},
+		{Command: "inspect --file /tmp/suspect.exe --provenance", Description: "Prove what a binary found deployed was built from"},
+	}
+}
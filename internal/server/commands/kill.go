@@ -1,10 +1,10 @@
 package commands
 
 import (
-	"errors"
 	"fmt"
 	"io"
 
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -16,13 +16,16 @@ type kill struct {
 }
 
 func (k *kill) ValidArgs() map[string]string {
-	return map[string]string{"y": "Do not prompt for confirmation before killing clients"}
+	return map[string]string{
+		"y":     "Do not prompt for confirmation before killing clients",
+		"force": "Kill clients even while an operator has a shell, command, forward or ssh session open on them",
+	}
 }
 
 func (k *kill) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
 
 	if len(line.Arguments) != 1 {
-		return errors.New(k.Help(false))
+		return failure.New(failure.InvalidArgument, "%s", k.Help(false))
 	}
 
 	connections, err := user.SearchClients(line.Arguments[0].Value())
@@ -31,7 +34,7 @@ func (k *kill) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 	}
 
 	if len(connections) == 0 {
-		return fmt.Errorf("No clients matched %q", line.Arguments[0].Value())
+		return failure.New(failure.ClientNotFound, "No clients matched %q", line.Arguments[0].Value()).With("client", line.Arguments[0].Value())
 	}
 
 	if !line.IsSet("y") {
@@ -55,23 +58,33 @@ func (k *kill) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		}
 
 		if !(b[0] == 'y' || b[0] == 'Y') {
-			return fmt.Errorf("\nUser did not enter y/Y, aborting")
+			return failure.New(failure.Aborted, "\nUser did not enter y/Y, aborting")
 		}
 
 		fmt.Fprint(tty, "\n")
 	}
 
+	if !line.IsSet("force") {
+		unlock, err := lockClients(clientIDs(connections), "kill", user.Username(), true)
+		if err != nil {
+			return fmt.Errorf("%w, use --force to kill anyway", err)
+		}
+		defer unlock()
+	}
+
 	killedClients := 0
 	for id, serverConn := range connections {
 		serverConn.SendRequest("kill", false, nil)
 
 		if len(connections) == 1 {
-			return fmt.Errorf("%s killed", id)
+			fmt.Fprintf(tty, "%s killed\n", id)
+			return nil
 		}
 		killedClients++
 	}
 
-	return fmt.Errorf("%d connections killed", killedClients)
+	fmt.Fprintf(tty, "%d connections killed\n", killedClients)
+	return nil
 }
 
 func (k *kill) Expect(line terminal.ParsedLine) []string {
@@ -98,3 +111,11 @@ func Kill(log logger.Logger) *kill {
 		log: log,
 	}
 }
+
+func (k *kill) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "kill webserver", Description: "Stop the client with hostname webserver"},
+		{Command: "kill -y *", Description: "Stop every client you can see without confirming"},
+		{Command: "kill --force webserver", Description: "Stop webserver even while someone is running exec on it"},
+	}
+}
@@ -0,0 +1,262 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type knownHostsCommand struct {
+}
+
+func (k *knownHostsCommand) ValidArgs() map[string]string {
+	r := map[string]string{
+		"l":      "List the pinned host keys, of every client or those matching -c",
+		"add":    "Pin a key for host[:port] (port 22 when left out). Requires --key",
+		"key":    "Key to pin, in authorized_keys format e.g \"ssh-ed25519 AAAA...\"",
+		"remove": "Forget every key pinned for host[:port], the next one seen is recorded again",
+	}
+
+	addDuplicateFlags("Clients to change, takes a pattern, e.g -c *, --client your.hostname.here", r, "client", "c")
+
+	return r
+}
+
+// PushKnownHosts sends a client (identified by its key) the host keys it checks onward ssh connections against
+func PushKnownHosts(sc ssh.Conn, fingerprint string, log logger.Logger) error {
+	known, err := data.GetKnownHosts(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	hosts := []string{}
+	for _, k := range known {
+		hosts = append(hosts, k.Host+" "+k.Key)
+	}
+
+	ok, reply, err := sc.SendRequest("known-hosts@rssh", true, ssh.Marshal(struct{ Hosts []string }{Hosts: hosts}))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if len(reply) == 0 {
+			return failure.New(failure.ClientRefused, "client does not support known hosts")
+		}
+		return failure.New(failure.ClientRefused, "%s", string(reply))
+	}
+
+	log.Info("sent %d known host keys", len(hosts))
+
+	return nil
+}
+
+func (k *knownHostsCommand) list(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	// Keys are stored by client key, the id of a connected client is easier to read
+	names := map[string]string{}
+	fingerprints := []string{""}
+
+	specifier, err := line.GetArgString("c")
+	if err != nil {
+		specifier, err = line.GetArgString("client")
+	}
+
+	if err == nil {
+		foundClients, err := user.SearchClients(specifier)
+		if err != nil {
+			return err
+		}
+
+		if len(foundClients) == 0 {
+			return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
+		}
+
+		fingerprints = fingerprints[:0]
+		for id, sc := range foundClients {
+			fp := sc.Permissions.Extensions["pubkey-fp"]
+			names[fp] = id
+			fingerprints = append(fingerprints, fp)
+		}
+	} else {
+		visible, err := user.SearchClients("")
+		if err != nil {
+			return err
+		}
+
+		// Admins see the keys of clients that are not connected too
+		if user.Privilege() != users.AdminPermissions {
+			fingerprints = fingerprints[:0]
+		}
+
+		for id, sc := range visible {
+			fp := sc.Permissions.Extensions["pubkey-fp"]
+			names[fp] = id
+			if user.Privilege() != users.AdminPermissions {
+				fingerprints = append(fingerprints, fp)
+			}
+		}
+	}
+
+	t, err := table.NewTable("Known Hosts", "Client", "Host", "Key Type", "Fingerprint", "Source")
+	if err != nil {
+		return err
+	}
+
+	for _, fp := range fingerprints {
+		known, err := data.GetKnownHosts(fp)
+		if err != nil {
+			return err
+		}
+
+		for _, h := range known {
+			client := h.Client
+			if id, ok := names[h.Client]; ok {
+				client = id
+			}
+
+			fingerprint := "invalid"
+			if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(h.Key)); err == nil {
+				fingerprint = internal.FingerprintSHA256Hex(pub)
+			}
+
+			source := "added"
+			if h.Learned {
+				source = "learned"
+			}
+
+			t.AddValues(client, h.Host, h.KeyType, fingerprint, source)
+		}
+	}
+
+	t.Fprint(tty)
+
+	return nil
+}
+
+func (k *knownHostsCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if line.IsSet("l") {
+		return k.list(user, tty, line)
+	}
+
+	specifier, err := line.GetArgString("c")
+	if err != nil {
+		specifier, err = line.GetArgString("client")
+		if err != nil {
+			return failure.New(failure.InvalidArgument, "no clients specified, use -c <pattern>")
+		}
+	}
+
+	var (
+		host   string
+		pinned *data.KnownHost
+	)
+	if h, err := line.GetArgString("add"); err == nil {
+		key, err := line.GetArgString("key")
+		if err != nil {
+			return failure.New(failure.InvalidArgument, "--add requires --key")
+		}
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return failure.New(failure.InvalidArgument, "invalid key: %s", err)
+		}
+
+		host = knownhosts.Normalize(h)
+		pinned = &data.KnownHost{
+			Host:    host,
+			KeyType: pub.Type(),
+			Key:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+		}
+	} else if h, err := line.GetArgString("remove"); err == nil {
+		host = knownhosts.Normalize(h)
+	} else {
+		return failure.New(failure.InvalidArgument, "no actionable argument supplied, please add --add, --remove or -l (list)")
+	}
+
+	if strings.ContainsAny(host, " \t\n") {
+		return failure.New(failure.InvalidArgument, "invalid host %q", host)
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) == 0 {
+		return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
+	}
+
+	unlock, err := lockClients(clientIDs(foundClients), "known-hosts", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied := len(foundClients)
+	for id, sc := range foundClients {
+		fp := sc.Permissions.Extensions["pubkey-fp"]
+
+		if pinned != nil {
+			entry := *pinned
+			entry.Client = fp
+			err = data.SaveKnownHost(entry)
+		} else {
+			_, err = data.DeleteKnownHosts(fp, host)
+		}
+
+		if err == nil {
+			err = PushKnownHosts(sc, fp, logger.NewLog(id))
+		}
+
+		if err != nil {
+			applied--
+			fmt.Fprintf(tty, "failed to change known hosts on %s: %s\n", id, err)
+		}
+	}
+
+	fmt.Fprintf(tty, "changed %s on %d clients (total %d)\n", host, applied, len(foundClients))
+
+	return nil
+}
+
+func (k *knownHostsCommand) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (k *knownHostsCommand) Help(explain bool) string {
+	if explain {
+		return "Pin the host keys of ssh servers reached through clients"
+	}
+
+	return terminal.MakeHelpText(k.ValidArgs(),
+		"known-hosts [OPTIONS] -c <pattern>",
+		"Clients check the host key of ssh servers reached with ssh -J or -L against the keys pinned for them here, and cut the connection when it differs.",
+		"Hosts without a pinned key, or seen with a new type of key, are recorded the first time and checked from then on. Mismatches are logged and shown in watch.",
+	)
+}
+
+func (k *knownHostsCommand) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "known-hosts -l", Description: "Show the keys pinned for every client"},
+		{Command: "known-hosts -c fileserver --add 10.0.0.5 --key \"ssh-ed25519 AAAAC3Nz...\"", Description: "Pin the key of 10.0.0.5:22 before jumping to it through fileserver"},
+		{Command: "known-hosts -c fileserver --remove 10.0.0.5", Description: "Accept a new key after 10.0.0.5 was rebuilt"},
+	}
+}
@@ -1,16 +1,22 @@
 package commands
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path"
 	"regexp"
+	"runtime"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal/nat"
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/mesh"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/server/webserver"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
@@ -24,6 +30,9 @@ type link struct {
 
 var spaceMatcher = regexp.MustCompile(`[\s]+`)
 
+// Builds taking longer than this are killed, garble and upx on a slow server can take a few minutes
+const linkTimeout = 15 * time.Minute
+
 type transportSelection struct {
 	flag   string
 	scheme string
@@ -36,6 +45,7 @@ var linkTransports = []transportSelection{
 	{flag: "stdio", scheme: "stdio://"},
 	{flag: "http", scheme: "http://"},
 	{flag: "https", scheme: "https://"},
+	{flag: "smb", scheme: "smb://"},
 	{flag: nat.Scheme, scheme: ""},
 }
 
@@ -61,36 +71,60 @@ func selectedTransportNames(selected []transportSelection) []string {
 func (l *link) ValidArgs() map[string]string {
 
 	r := map[string]string{
-		"s":                 "Set homeserver address, defaults to server --external_address if set, or server listen address if not",
-		"l":                 "List currently active download links",
-		"r":                 "Remove download link",
-		"C":                 "Comment to add as the public key (acts as the name)",
-		"goos":              "Set the target build operating system (default runtime GOOS)",
-		"goarch":            "Set the target build architecture (default runtime GOARCH)",
-		"goarm":             "Set the go arm variable (not set by default)",
-		"name":              "Set the link download url/filename (default random characters)",
-		"proxy":             "Set connect proxy address to bake it",
-		"tls":               "Use TLS as the underlying transport",
-		"ws":                "Use plain http websockets as the underlying transport",
-		"wss":               "Use TLS websockets as the underlying transport",
-		"stdio":             "Use stdin and stdout as transport, will disable logging, destination after stdio:// is ignored",
-		"http":              "Use http polling as the underlying transport",
-		"https":             "Use https polling as the underlying transport",
-		nat.Scheme:          "Use Tailscale relay transport as the underlying transport",
-		"use-host-header":   "Use HTTP Host header as callback address when generating download template (add .sh to your download urls and find out)",
-		"shared-object":     "Generate shared object file",
-		"fingerprint":       "Set RSSH server fingerprint will default to server public key",
-		"garble":            "Use garble to obfuscate the binary (requires garble to be installed)",
-		"upx":               "Use upx to compress the final binary (requires upx to be installed)",
-		"lzma":              "Use lzma compression for smaller binary at the cost of overhead at execution (requires upx flag to be set)",
-		"no-lib-c":          "Compile client without glibc",
-		"sni":               "When TLS is in use, set a custom SNI for the client to connect with",
-		"working-directory": "Set download/working directory for automatic script (i.e doing curl https://<url>.sh)",
-		"raw-download":      "Download over raw TCP, outputs bash downloader rather than http",
-		"use-kerberos":      "Instruct client to try and use kerberos ticket when using a proxy",
-		"log-level":         "Set default output logging levels, [INFO,WARNING,ERROR,FATAL,DISABLED]",
-		"ntlm-proxy-creds":  "Set NTLM proxy credentials in format DOMAIN\\USER:PASS",
-		"version-string":    "Set the SSH version string the client uses, will always be prefixed with SSH-",
+		"s":                     "Set homeserver address, defaults to server --external_address if set, or server listen address if not",
+		"l":                     "List currently active download links",
+		"r":                     "Remove download link",
+		"downloads":             "Show who downloaded links and which client each download became, takes an optional filter on link, source address or client hostname",
+		"pending":               "Show built clients that have never connected, and how many of each campaign have, takes an optional filter on link or campaign",
+		"campaign":              "Label the client with the campaign it is built for, kept with its key in authorized_controllee_keys and shown by --pending",
+		"auto-rebuild":          "Build the link again, with a new key, whenever the go toolchain, client source or templates change. Rebuilds show in watch and are sent to webhooks",
+		"C":                     "Comment to add as the public key (acts as the name)",
+		"goos":                  "Set the target build operating system (default runtime GOOS)",
+		"goarch":                "Set the target build architecture (default runtime GOARCH)",
+		"goarm":                 "Set the go arm variable for --goarch arm, 5, 6 or 7 (not set by default)",
+		"preset":                "Build for a router or embedded device: " + strings.Join(webserver.BuildPresets(), ", ") + ". Static, soft float where needed, and packed with upx --lzma when upx is installed",
+		"gomips":                "Set GOMIPS for --goarch mips or mipsle, softfloat or hardfloat (not set by default)",
+		"size-budget":           "Fail the build if the client is larger than this, e.g 3M or 900K (default unlimited)",
+		"no-integrity":          "Do not sign the client, so it does not check its own binary. For clients you will change after they are built, e.g by signing them",
+		"legacy":                "Build for old targets (Windows 7, old glibc): a static client without libc, built with the server's --legacy-toolchain if set. Windows needs one, go 1.21 and later do not run on Windows 7",
+		"name":                  "Set the link download url/filename (default random characters)",
+		"proxy":                 "Set connect proxy address to bake it",
+		"tls":                   "Use TLS as the underlying transport",
+		"ws":                    "Use plain http websockets as the underlying transport",
+		"wss":                   "Use TLS websockets as the underlying transport",
+		"stdio":                 "Use stdin and stdout as transport, will disable logging, destination after stdio:// is ignored",
+		"http":                  "Use http polling as the underlying transport",
+		"https":                 "Use https polling as the underlying transport",
+		"smb":                   "Connect back through a named pipe on another windows client instead of the server, set -s to <relay host>/<pipe name> (windows only, see listen --on pipe:<name>)",
+		nat.Scheme:              "Use Tailscale relay transport as the underlying transport",
+		"cert":                  "Log in with a certificate from the server's client authority valid for this long, e.g 24h, instead of adding the client key to authorized_controllee_keys. The client is refused once it expires",
+		"ts-expires":            "With --ts, stop the client using its token after this long, e.g 72h. The token also carries the server's current direct path addresses",
+		"use-host-header":       "Use HTTP Host header as callback address when generating download template (add .sh to your download urls and find out)",
+		"shared-object":         "Generate shared object file",
+		"aar":                   "Build the client as an Android library (.aar) with Start, Stop and Status, to embed in a test app (requires gomobile and the Android NDK)",
+		"xcframework":           "Build the client as an iOS library (.xcframework, zipped) with Start, Stop and Status, to embed in a test app (requires gomobile and Xcode, so a macOS server)",
+		"fingerprint":           "Set RSSH server fingerprint will default to server public key",
+		"garble":                "Use garble to obfuscate the binary (requires garble to be installed)",
+		"upx":                   "Use upx to compress the final binary (requires upx to be installed)",
+		"lzma":                  "Use lzma compression for smaller binary at the cost of overhead at execution (requires upx flag to be set)",
+		"no-lib-c":              "Compile client without glibc",
+		"sni":                   "When TLS is in use, set a custom SNI for the client to connect with",
+		"working-directory":     "Set download/working directory for automatic script (i.e doing curl https://<url>.sh)",
+		"raw-download":          "Download over raw TCP, outputs bash downloader rather than http",
+		"use-kerberos":          "Instruct client to try and use kerberos ticket when using a proxy",
+		"log-level":             "Set default output logging levels, [INFO,WARNING,ERROR,FATAL,DISABLED]",
+		"ntlm-proxy-creds":      "Set NTLM proxy credentials in format DOMAIN\\USER:PASS",
+		"version-string":        "Set the SSH version string the client uses, will always be prefixed with SSH-",
+		"fallback":              "Comma separated other addresses of this server (including transport scheme, e.g wss://your.server:443,https://your.server:443) the client moves to when the destination is unreachable or its link is poor, and back from once it answers again",
+		"secondary":             "Set a second server address the client stays connected to at the same time (including transport scheme, e.g wss://other.server:443)",
+		"secondary-fingerprint": "Set the fingerprint of the secondary server",
+		"show-config":           "Print exactly what would be embedded in the client and how it would be built, without building it",
+		"mesh":                  "If the server is unreachable, connect back through a relaying client. Bakes in the currently active relays (see mesh) and falls back to mDNS",
+		"mesh-peers":            "Comma separated relay addresses (host:port) to bake in instead of the currently active relays, implies --mesh",
+		"derp-map":              "Path on the server to a DERP map (tailscale's json format) to bake in, so ts relay clients never fetch one, e.g a map of only your own DERP nodes",
+		"strict-crypto":         "Only use FIPS 140-3 approved ssh algorithms and build with the go FIPS module, cannot be used with --ts (always on if the server has --strict-crypto)",
+		"vanity":                "Generate client keys until the fingerprint, which client ids start with, begins with this hex prefix (up to 6 characters, each is 16x slower). E.g --vanity c0de",
+		"modules":               "Comma separated optional modules to compile into the client, run as subsystems (" + strings.Join(webserver.ClientModules(), ", ") + "). E.g --modules mssql,smb",
 	}
 
 	// Add duplicate flags for owners
@@ -102,7 +136,7 @@ func (l *link) ValidArgs() map[string]string {
 func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
 
 	if toList, ok := line.Flags["l"]; ok {
-		t, _ := table.NewTable("Active Files", "Url", "Client Callback", "Log Level", "GOOS", "GOARCH", "Version", "Type", "Hits", "Size")
+		t, _ := table.NewTable("Active Files", "Url", "Client Callback", "Log Level", "GOOS", "GOARCH", "Version", "Type", "Hits", "Size", "Stored")
 
 		files, err := data.ListDownloads(strings.Join(toList.ArgValues(), " "))
 		if err != nil {
@@ -110,8 +144,10 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		}
 
 		ids := []string{}
-		for id := range files {
-			ids = append(ids, id)
+		for id, file := range files {
+			if user.InCampaign(file.Campaign) {
+				ids = append(ids, id)
+			}
 		}
 
 		sort.Strings(ids)
@@ -119,7 +155,17 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		for _, id := range ids {
 			file := files[id]
 
-			t.AddValues("http://"+path.Join(webserver.DefaultConnectBack, id), file.CallbackAddress, file.LogLevel, file.Goos, file.Goarch+file.Goarm, file.Version, file.FileType, fmt.Sprintf("%d", file.Hits), fmt.Sprintf("%.2f MB", file.FileSize))
+			stored := "local"
+			if file.StorageKey != "" {
+				stored = file.StorageKey
+			}
+
+			version := file.Version
+			if file.AutoRebuild {
+				version += "\n(auto rebuild)"
+			}
+
+			t.AddValues("http://"+path.Join(webserver.DefaultConnectBack, id), file.CallbackAddress, file.LogLevel, file.Goos, file.Goarch+file.Goarm, version, file.FileType, fmt.Sprintf("%d", file.Hits), fmt.Sprintf("%.2f MB", file.FileSize), stored)
 		}
 
 		t.Fprint(tty)
@@ -128,6 +174,74 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 
 	}
 
+	if history, ok := line.Flags["downloads"]; ok {
+		events, err := data.ListDownloadEvents(strings.Join(history.ArgValues(), " "))
+		if err != nil {
+			return failure.Wrap(failure.InvalidArgument, err)
+		}
+
+		// Events only name their link, so an operator working in a campaign sees downloads of its links that still exist
+		var links map[string]data.Download
+		if user.Campaign() != "" {
+			links, err = data.ListDownloads("")
+			if err != nil {
+				return err
+			}
+		}
+
+		t, _ := table.NewTable("Download History", "Time", "Link", "Method", "Source", "User Agent", "Client")
+		for _, event := range events {
+			if links != nil {
+				if link, ok := links[event.UrlPath]; !ok || !user.InCampaign(link.Campaign) {
+					continue
+				}
+			}
+
+			method := event.Method
+			if event.Encoding != "" {
+				method += " (" + event.Encoding + ")"
+			}
+
+			client := ""
+			if event.ClientID != "" {
+				client = event.ClientHostName + " (" + event.ClientID + ")"
+			}
+
+			t.AddValues(event.DownloadedAt.Format("2006/01/02 15:04:05"), event.UrlPath, method, event.IP, event.UserAgent, client)
+		}
+
+		t.Fprint(tty)
+
+		return nil
+	}
+
+	if pending, ok := line.Flags["pending"]; ok {
+		downloads, progress, err := data.PendingDownloads(strings.Join(pending.ArgValues(), " "))
+		if err != nil {
+			return failure.Wrap(failure.InvalidArgument, err)
+		}
+
+		t, _ := table.NewTable("Pending Clients", "Built", "Link", "Campaign", "Target", "Hits", "Fingerprint")
+		for _, d := range downloads {
+			if !user.InCampaign(d.Campaign) {
+				continue
+			}
+			t.AddValues(d.CreatedAt.Format("2006/01/02 15:04:05"), d.UrlPath, d.Campaign, d.Goos+"/"+d.Goarch+d.Goarm, fmt.Sprintf("%d", d.Hits), d.Fingerprint)
+		}
+		t.Fprint(tty)
+
+		c, _ := table.NewTable("Deployment", "Campaign", "Built", "Connected", "Success Rate")
+		for _, p := range progress {
+			if !user.InCampaign(p.Campaign) {
+				continue
+			}
+			c.AddValues(p.Campaign, fmt.Sprintf("%d", p.Built), fmt.Sprintf("%d", p.Connected), fmt.Sprintf("%.0f%%", 100*float64(p.Connected)/float64(p.Built)))
+		}
+		c.Fprint(tty)
+
+		return nil
+	}
+
 	if toRemove, ok := line.Flags["r"]; ok {
 		if len(toRemove.Args) == 0 {
 			fmt.Fprintf(tty, "No argument supplied\n")
@@ -140,8 +254,14 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 			return err
 		}
 
+		for id, file := range files {
+			if !user.InCampaign(file.Campaign) {
+				delete(files, id)
+			}
+		}
+
 		if len(files) == 0 {
-			return errors.New("No links match")
+			return failure.New(failure.NotFound, "No links match")
 		}
 
 		for id := range files {
@@ -196,7 +316,7 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 
 	selectedTransports := selectedTransportFlags(line)
 	if len(selectedTransports) > 1 {
-		return fmt.Errorf("cannot combine transport flags: %s", strings.Join(selectedTransportNames(selectedTransports), ", "))
+		return failure.New(failure.InvalidArgument, "cannot combine transport flags: %s", strings.Join(selectedTransportNames(selectedTransports), ", "))
 	}
 
 	if len(selectedTransports) == 1 {
@@ -208,6 +328,21 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		}
 	}
 
+	if line.IsSet("smb") {
+		goos := buildConfig.GOOS
+		if goos == "" {
+			goos = runtime.GOOS
+		}
+
+		if goos != "windows" {
+			return failure.New(failure.InvalidArgument, "the smb transport is only supported by windows clients, set --goos windows")
+		}
+
+		if !line.IsSet("s") {
+			return failure.New(failure.InvalidArgument, "the smb transport needs the relay client and pipe name, e.g -s fileserver/rssh")
+		}
+	}
+
 	buildConfig.Name, err = line.GetArgString("name")
 	if err != nil && err != terminal.ErrFlagNotSet {
 		return err
@@ -248,7 +383,7 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 	} else {
 		_, err := logger.StrToUrgency(buildConfig.LogLevel)
 		if err != nil {
-			return fmt.Errorf("could not parse log-level %q: %w", buildConfig.LogLevel, err)
+			return failure.Wrap(failure.InvalidArgument, fmt.Errorf("could not parse log-level %q: %w", buildConfig.LogLevel, err))
 		}
 	}
 
@@ -275,24 +410,274 @@ func (l *link) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 		return err
 	}
 
-	if spaceMatcher.MatchString(buildConfig.Owners) {
-		return errors.New("owners flag cannot contain any whitespace")
+	buildConfig.Fallbacks, err = line.GetArgString("fallback")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	if strings.Contains(buildConfig.Fallbacks, "stdio://") || line.IsSet("stdio") && buildConfig.Fallbacks != "" {
+		return failure.New(failure.InvalidArgument, "the stdio transport cannot have or be a fallback")
+	}
+
+	buildConfig.SecondaryConnectBackAddress, err = line.GetArgString("secondary")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	buildConfig.SecondaryFingerprint, err = line.GetArgString("secondary-fingerprint")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	if buildConfig.SecondaryFingerprint != "" && buildConfig.SecondaryConnectBackAddress == "" {
+		return failure.New(failure.InvalidArgument, "secondary-fingerprint requires a secondary server address to be set with --secondary")
+	}
+
+	if strings.HasPrefix(buildConfig.SecondaryConnectBackAddress, "stdio://") {
+		return failure.New(failure.InvalidArgument, "the secondary server cannot use the stdio transport")
 	}
 
-	url, err := webserver.Build(buildConfig)
+	buildConfig.MeshPeers, err = line.GetArgString("mesh-peers")
 	if err != nil {
+		if err != terminal.ErrFlagNotSet {
+			return err
+		}
+
+		if line.IsSet("mesh") {
+			buildConfig.MeshPeers = strings.Join(mesh.RelayAddresses(), ",")
+		}
+	}
+	buildConfig.Mesh = line.IsSet("mesh") || buildConfig.MeshPeers != ""
+
+	if buildConfig.Mesh && (line.IsSet("stdio") || line.IsSet("smb") || line.IsSet(nat.Scheme)) {
+		return failure.New(failure.InvalidArgument, "mesh fallback only works with tcp based transports")
+	}
+
+	buildConfig.StrictCrypto = line.IsSet("strict-crypto")
+
+	derpMapPath, err := line.GetArgString("derp-map")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+	if derpMapPath != "" {
+		// It is read from the server's filesystem
+		if user.Privilege() != users.AdminPermissions {
+			return failure.New(failure.PermissionDenied, "only admins can embed a derp map from a file")
+		}
+
+		raw, err := os.ReadFile(derpMapPath)
+		if err != nil {
+			return failure.Wrap(failure.InvalidArgument, fmt.Errorf("unable to read derp map: %w", err))
+		}
+
+		buildConfig.DERPMap, err = nat.EncodeEmbeddedDERPMap(raw)
+		if err != nil {
+			return failure.Wrap(failure.InvalidArgument, err)
+		}
+	}
+
+	buildConfig.VanityPrefix, err = line.GetArgString("vanity")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	buildConfig.Campaign, err = line.GetArgString("campaign")
+	if err != nil && err != terminal.ErrFlagNotSet {
 		return err
 	}
 
+	// Clients built in a campaign are labelled with it, an operator held to one cannot build for another
+	if campaign := user.Campaign(); campaign != "" {
+		if buildConfig.Campaign != "" && buildConfig.Campaign != campaign && user.CampaignPinned() {
+			return failure.New(failure.PermissionDenied, "your key is only allowed into campaign %s", campaign)
+		}
+		if buildConfig.Campaign == "" || user.CampaignPinned() {
+			buildConfig.Campaign = campaign
+		}
+	}
+
+	buildConfig.AutoRebuild = line.IsSet("auto-rebuild")
+	buildConfig.Legacy = line.IsSet("legacy")
+	buildConfig.NoIntegrity = line.IsSet("no-integrity")
+
+	if line.IsSet("aar") && line.IsSet("xcframework") {
+		return failure.New(failure.InvalidArgument, "cannot combine --aar and --xcframework, build one link for each")
+	}
+	if line.IsSet("aar") {
+		buildConfig.MobileLibrary = "aar"
+	} else if line.IsSet("xcframework") {
+		buildConfig.MobileLibrary = "xcframework"
+	}
+
+	buildConfig.Preset, err = line.GetArgString("preset")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	buildConfig.GOMIPS, err = line.GetArgString("gomips")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	tsExpires, err := line.GetArgString("ts-expires")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+	if tsExpires != "" {
+		lifetime, err := time.ParseDuration(tsExpires)
+		if err != nil || lifetime <= 0 {
+			return failure.New(failure.InvalidArgument, "--ts-expires %q is not a positive duration, e.g 72h", tsExpires)
+		}
+		buildConfig.TSExpires = time.Now().Add(lifetime)
+	}
+
+	certificate, err := line.GetArgString("cert")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+	if certificate != "" {
+		validity, err := time.ParseDuration(certificate)
+		if err != nil || validity <= 0 {
+			return failure.New(failure.InvalidArgument, "--cert %q is not a positive duration, e.g 24h", certificate)
+		}
+		buildConfig.Certificate = validity
+	}
+
+	sizeBudget, err := line.GetArgString("size-budget")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+	if sizeBudget != "" {
+		buildConfig.SizeBudget, err = webserver.ParseSizeBudget(sizeBudget)
+		if err != nil {
+			return failure.Wrap(failure.InvalidArgument, err)
+		}
+	}
+
+	modules, err := line.GetArgString("modules")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+	for _, module := range strings.Split(modules, ",") {
+		if module = strings.TrimSpace(module); module != "" {
+			buildConfig.Modules = append(buildConfig.Modules, strings.ToLower(module))
+		}
+	}
+
+	if spaceMatcher.MatchString(buildConfig.Owners) || spaceMatcher.MatchString(buildConfig.MeshPeers) || spaceMatcher.MatchString(buildConfig.Fallbacks) {
+		return failure.New(failure.InvalidArgument, "owners, mesh-peers and fallback flags cannot contain any whitespace")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkTimeout)
+	defer cancel()
+
+	if line.IsSet("show-config") {
+		return showLinkConfig(ctx, tty, buildConfig)
+	}
+
+	url, err := webserver.Build(ctx, buildConfig)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return failure.New(failure.BuildFailed, "building the client took longer than %s", linkTimeout)
+	}
+	if err != nil {
+		return failure.Wrap(failure.BuildFailed, err)
+	}
+
 	fmt.Fprintln(tty, url)
 
 	return nil
 }
 
+// showLinkConfig prints what link would build, without building it
+func showLinkConfig(ctx context.Context, tty io.ReadWriter, buildConfig webserver.BuildConfig) error {
+	settings, err := webserver.ShowConfig(ctx, &buildConfig)
+	if err != nil {
+		return failure.Wrap(failure.BuildFailed, err)
+	}
+
+	t, err := table.NewTable("Embedded Configuration", "Setting", "Variable", "Value")
+	if err != nil {
+		return err
+	}
+
+	for _, setting := range settings {
+		t.AddValues(setting.Name, setting.Variable, setting.Value)
+	}
+	t.Fprint(tty)
+
+	goos, goarch := buildConfig.GOOS, buildConfig.GOARCH
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+
+	fileType := "executable"
+	if buildConfig.SharedLibrary {
+		fileType = "shared-object"
+	}
+	if buildConfig.MobileLibrary != "" {
+		fileType = buildConfig.MobileLibrary
+		goarch = "all"
+		goos = "android"
+		if buildConfig.MobileLibrary == "xcframework" {
+			goos = "ios"
+		}
+	}
+
+	owners := buildConfig.Owners
+	if owners == "" {
+		owners = "public"
+	}
+
+	b, err := table.NewTable("Build", "Option", "Value")
+	if err != nil {
+		return err
+	}
+
+	target := goos + "/" + goarch + buildConfig.GOARM
+	if buildConfig.GOMIPS != "" {
+		target += " (" + buildConfig.GOMIPS + ")"
+	}
+
+	budget := "unlimited"
+	if buildConfig.SizeBudget > 0 {
+		budget = fmt.Sprintf("%.2fMB", float64(buildConfig.SizeBudget)/1024/1024)
+	}
+
+	b.AddValues("target", target)
+	b.AddValues("preset", buildConfig.Preset)
+	b.AddValues("size budget", budget)
+	if !buildConfig.TSExpires.IsZero() {
+		b.AddValues("ts token expires", buildConfig.TSExpires.Format(time.RFC3339))
+	}
+	if buildConfig.Certificate > 0 {
+		b.AddValues("certificate valid for", buildConfig.Certificate.String())
+	}
+	b.AddValues("type", fileType)
+	b.AddValues("owners", owners)
+	b.AddValues("comment", buildConfig.Comment)
+	b.AddValues("campaign", buildConfig.Campaign)
+	b.AddValues("auto rebuild", fmt.Sprintf("%t", buildConfig.AutoRebuild))
+	b.AddValues("modules", strings.Join(buildConfig.Modules, ","))
+	b.AddValues("vanity prefix", buildConfig.VanityPrefix)
+	b.AddValues("garble", fmt.Sprintf("%t", buildConfig.Garble))
+	b.AddValues("upx", fmt.Sprintf("%t (lzma %t)", buildConfig.UPX, buildConfig.Lzma))
+	b.AddValues("no libc", fmt.Sprintf("%t", buildConfig.DisableLibC))
+	b.AddValues("legacy", fmt.Sprintf("%t", buildConfig.Legacy))
+	b.AddValues("integrity check", fmt.Sprintf("%t", !buildConfig.NoIntegrity && !buildConfig.SharedLibrary && buildConfig.MobileLibrary == ""))
+	b.Fprint(tty)
+
+	fmt.Fprintln(tty, "A new client key is generated when the client is built. Nothing has been built.")
+
+	return nil
+}
+
 func (l *link) Expect(line terminal.ParsedLine) []string {
 	if line.Section != nil {
 		switch line.Section.Value() {
-		case "l", "r":
+		case "l", "r", "downloads", "pending":
 			return []string{autocomplete.WebServerFileIds}
 		}
 	}
@@ -311,3 +696,15 @@ func (e *link) Help(explain bool) string {
 		"This requires the web server component has been enabled.",
 	)
 }
+
+func (l *link) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "link", Description: "Build a client for this platform that connects back to this server"},
+		{Command: "link --goos windows --goarch amd64 --name implant", Description: "Build a windows client downloadable as /implant"},
+		{Command: "link -s your.rssh.server:443 --wss --sni example.com", Description: "Build a client that connects over TLS websockets with a custom SNI"},
+		{Command: "link -l", Description: "List download links that are currently active"},
+		{Command: "link --goos windows --proxy 10.0.0.1:3128 --show-config", Description: "Check what would be baked in before building"},
+		{Command: "link --ts --derp-map /etc/rssh/derpmap.json", Description: "Build a ts relay client that only uses the DERP nodes in the map, without fetching tailscale's"},
+		{Command: "link --cert 24h --campaign spring", Description: "Build a client that logs in with a certificate valid for a day, so it is refused after that without removing its key"},
+	}
+}
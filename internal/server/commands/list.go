@@ -7,6 +7,9 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/mesh"
+	"github.com/NHAS/reverse_ssh/internal/server/presence"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -23,7 +26,36 @@ type displayItem struct {
 	id string
 }
 
-func fancyTable(tty io.ReadWriter, applicable []displayItem) {
+// relayPath describes the clients a client connected back through, hops the user cant see are shown by id only
+func relayPath(user *users.User, id string) string {
+	var hops []string
+	for _, hop := range mesh.Path(id) {
+		if sc, err := user.GetClient(hop); err == nil {
+			hop = users.NormaliseHostname(sc.User())
+		}
+		hops = append(hops, hop)
+	}
+
+	return strings.Join(hops, " -> ")
+}
+
+// transportPath is how a relayed client currently reaches the server, e.g "relay (upgrading)" or "direct"
+func transportPath(sc ssh.ServerConn) string {
+	if p, ok := sc.RemoteAddr().(interface{ Path() string }); ok {
+		return p.Path()
+	}
+	return ""
+}
+
+// publicAddress is where a relayed client says it connects from
+func publicAddress(sc ssh.ServerConn) string {
+	if p, ok := sc.RemoteAddr().(interface{ PublicAddress() string }); ok {
+		return p.PublicAddress()
+	}
+	return ""
+}
+
+func fancyTable(user *users.User, tty io.ReadWriter, applicable []displayItem) {
 
 	t, _ := table.NewTable("Targets", "IDs", "Owners", "Version")
 	for _, a := range applicable {
@@ -40,7 +72,39 @@ func fancyTable(tty io.ReadWriter, applicable []displayItem) {
 			owners = strings.Join(strings.Split(a.sc.Permissions.Extensions["owners"], ","), "\n")
 		}
 
-		if err := t.AddValues(fmt.Sprintf("%s\n%s\n%s\n%s\n", a.id, keyId, users.NormaliseHostname(a.sc.User()), a.sc.RemoteAddr().String()), owners, string(a.sc.ClientVersion())); err != nil {
+		version := string(a.sc.ClientVersion())
+		if link := a.sc.Permissions.Extensions["link"]; link != "" {
+			version += "\n(" + link + " link)"
+		}
+
+		if campaign := a.sc.Permissions.Extensions["campaign"]; campaign != "" {
+			version += "\ncampaign: " + campaign
+		}
+
+		if via := relayPath(user, a.id); via != "" {
+			version += "\nvia " + via
+		}
+
+		if path := transportPath(a.sc); path != "" {
+			version += "\npath: " + path
+		}
+		if public := publicAddress(a.sc); public != "" {
+			version += "\npublic: " + public
+		}
+
+		if original, ok := users.DuplicateOf(a.id); ok {
+			version += "\nduplicate of " + original
+		}
+
+		for _, op := range clientOperations(a.id) {
+			version += "\nbusy: " + op
+		}
+
+		for _, o := range presence.On(a.id) {
+			version += "\noperator: " + o.String()
+		}
+
+		if err := t.AddValues(fmt.Sprintf("%s\n%s\n%s\n%s\n", a.id, keyId, users.NormaliseHostname(a.sc.User()), a.sc.RemoteAddr().String()), owners, version); err != nil {
 			log.Println("Error drawing pretty ls table (THIS IS A BUG): ", err)
 			return
 		}
@@ -76,10 +140,10 @@ func (l *list) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 
 	if len(matchingClients) == 0 {
 		if len(filter) == 0 {
-			return fmt.Errorf("No RSSH clients connected")
+			return failure.New(failure.ClientNotFound, "No RSSH clients connected")
 		}
 
-		return fmt.Errorf("Unable to find match for '" + filter + "'")
+		return failure.New(failure.ClientNotFound, "Unable to find match for '%s'", filter).With("client", filter)
 	}
 
 	ids := []string{}
@@ -94,7 +158,7 @@ func (l *list) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 	}
 
 	if line.IsSet("t") {
-		fancyTable(tty, toReturn)
+		fancyTable(user, tty, toReturn)
 		return nil
 	}
 
@@ -114,6 +178,38 @@ func (l *list) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 
 		fmt.Fprintf(tty, "%s %s %s %s, owners: %s, version: %s", color.YellowString(tr.id), keyId, color.BlueString(users.NormaliseHostname(tr.sc.User())), tr.sc.RemoteAddr().String(), owners, tr.sc.ClientVersion())
 
+		if link := tr.sc.Permissions.Extensions["link"]; link != "" {
+			fmt.Fprintf(tty, ", link: %s", color.MagentaString(link))
+		}
+
+		if campaign := tr.sc.Permissions.Extensions["campaign"]; campaign != "" {
+			fmt.Fprintf(tty, ", campaign: %s", campaign)
+		}
+
+		if via := relayPath(user, tr.id); via != "" {
+			fmt.Fprintf(tty, ", via: %s", color.CyanString(via))
+		}
+
+		if path := transportPath(tr.sc); path != "" {
+			fmt.Fprintf(tty, ", path: %s", path)
+		}
+
+		if original, ok := users.DuplicateOf(tr.id); ok {
+			fmt.Fprintf(tty, ", duplicate of: %s", color.RedString(original))
+		}
+
+		if ops := clientOperations(tr.id); len(ops) > 0 {
+			fmt.Fprintf(tty, ", busy: %s", color.RedString(strings.Join(ops, ", ")))
+		}
+
+		if operators := presence.On(tr.id); len(operators) > 0 {
+			var names []string
+			for _, o := range operators {
+				names = append(names, o.String())
+			}
+			fmt.Fprintf(tty, ", operators: %s", color.GreenString(strings.Join(names, ", ")))
+		}
+
 		if i != len(toReturn)-1 {
 			fmt.Fprint(tty, sep)
 		}
@@ -139,5 +235,14 @@ func (l *list) Help(explain bool) string {
 	return terminal.MakeHelpText(l.ValidArgs(),
 		"ls [OPTION] [FILTER]",
 		"Filter uses glob matching against all attributes of a target (id, public key hash, hostname, ip)",
+		"Clients started twice on the same machine with the same key are marked as a duplicate of the first, start the server with --exit-duplicates to have the second told to exit",
 	)
 }
+
+func (l *list) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "ls", Description: "List all clients you have access to"},
+		{Command: "ls -t", Description: "Show every attribute of each client in a table"},
+		{Command: "ls *.corp.local", Description: "Only show clients with a hostname ending in .corp.local"},
+	}
+}
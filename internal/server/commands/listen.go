@@ -1,19 +1,23 @@
 package commands
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
 	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/namedpipe"
+	"github.com/NHAS/reverse_ssh/pkg/table"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -28,7 +32,21 @@ type listen struct {
 	log logger.Logger
 }
 
-func (l *listen) server(tty io.ReadWriter, line terminal.ParsedLine, onAddrs, offAddrs []string) error {
+// checkForwardQuota stops an operator starting more listeners than their quota allows
+func checkForwardQuota(user *users.User, more int) error {
+	if user.Quota().Forwards == 0 || more == 0 {
+		return nil
+	}
+
+	current, err := data.CountListeners(user.Username())
+	if err != nil {
+		return err
+	}
+
+	return user.CheckForwards(current, more)
+}
+
+func (l *listen) server(user *users.User, tty io.ReadWriter, line terminal.ParsedLine, onAddrs, offAddrs []string) error {
 	if line.IsSet("l") {
 		listeners := multiplexer.ServerMultiplexer.GetListeners()
 
@@ -43,12 +61,20 @@ func (l *listen) server(tty io.ReadWriter, line terminal.ParsedLine, onAddrs, of
 		return nil
 	}
 
+	if err := checkForwardQuota(user, len(onAddrs)); err != nil {
+		return err
+	}
+
 	for _, addr := range onAddrs {
 		err := multiplexer.ServerMultiplexer.StartListener("tcp", addr)
 		if err != nil {
 			return err
 		}
 		fmt.Fprintln(tty, "started listening on: ", addr)
+
+		if err := data.SaveListener(data.Listener{Owner: user.Username(), Address: addr}); err != nil {
+			fmt.Fprintf(tty, "unable to save %s, it will not be restarted with the server: %s\n", addr, err)
+		}
 	}
 
 	for _, addr := range offAddrs {
@@ -57,17 +83,52 @@ func (l *listen) server(tty io.ReadWriter, line terminal.ParsedLine, onAddrs, of
 			return err
 		}
 		fmt.Fprintln(tty, "stopped listening on: ", addr)
+
+		if err := data.DeleteListener("", false, addr); err != nil {
+			fmt.Fprintf(tty, "unable to remove saved listener %s: %s\n", addr, err)
+		}
 	}
 
 	return nil
 }
 
+// forwardRequest parses a client listen address, either host:port or pipe:<name> for a windows named pipe that other clients can connect back through over SMB
+func forwardRequest(addr string) (internal.RemoteForwardRequest, error) {
+	if name, ok := strings.CutPrefix(addr, "pipe:"); ok {
+		if name == "" || strings.ContainsAny(name, `\/`) {
+			return internal.RemoteForwardRequest{}, failure.New(failure.InvalidArgument, "invalid pipe name %q", name)
+		}
+
+		return internal.RemoteForwardRequest{
+			BindAddr: namedpipe.LocalPath(name),
+		}, nil
+	}
+
+	ip, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return internal.RemoteForwardRequest{}, err
+	}
+
+	p, err := strconv.ParseInt(port, 10, 32)
+	if err != nil {
+		return internal.RemoteForwardRequest{}, err
+	}
+
+	return internal.RemoteForwardRequest{
+		BindPort: uint32(p),
+		BindAddr: ip,
+	}, nil
+}
+
 func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.ParsedLine, onAddrs, offAddrs []string) error {
 
 	auto := line.IsSet("auto")
 	if line.IsSet("l") && auto {
+		autoLck.Lock()
+		defer autoLck.Unlock()
+
 		for k, v := range autoStartServerPort {
-			fmt.Fprintf(tty, "%s %s\n", v.Criteria, net.JoinHostPort(k.BindAddr, fmt.Sprintf("%d", k.BindPort)))
+			fmt.Fprintf(tty, "%s %s\n", v.Criteria, k.String())
 		}
 		return nil
 	}
@@ -86,7 +147,7 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 	}
 
 	if len(foundClients) == 0 && !auto {
-		return fmt.Errorf("No clients matched %q", specifier)
+		return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
 	}
 
 	if line.IsSet("l") {
@@ -118,27 +179,33 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 		return nil
 	}
 
-	var fwRequests []internal.RemoteForwardRequest
+	unlock, err := lockClients(clientIDs(foundClients), "listen", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fwRequests := map[string]internal.RemoteForwardRequest{}
 
 	for _, addr := range onAddrs {
-		ip, port, err := net.SplitHostPort(addr)
+		r, err := forwardRequest(addr)
 		if err != nil {
 			return err
 		}
 
-		p, err := strconv.ParseInt(port, 10, 32)
-		if err != nil {
-			return err
-		}
+		fwRequests[addr] = r
+	}
 
-		fwRequests = append(fwRequests, internal.RemoteForwardRequest{
-			BindPort: uint32(p),
-			BindAddr: ip,
-		})
+	more := len(fwRequests) * len(foundClients)
+	if auto {
+		more += len(fwRequests)
+	}
 
+	if err := checkForwardQuota(user, more); err != nil {
+		return err
 	}
 
-	for _, r := range fwRequests {
+	for addr, r := range fwRequests {
 
 		b := ssh.Marshal(&r)
 
@@ -154,70 +221,46 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 			if err != nil {
 				applied--
 				fmt.Fprintln(tty, "error starting port on: ", c, ": ", err)
+				continue
+			}
+
+			if err := data.SaveListener(data.Listener{Owner: user.Username(), Client: sc.Permissions.Extensions["pubkey-fp"], Address: addr}); err != nil {
+				fmt.Fprintf(tty, "unable to save %s on %s, it will not be restarted when the client reconnects: %s\n", addr, c, err)
 			}
 		}
 
-		fmt.Fprintf(tty, "started %s on %d clients (total %d)\n", net.JoinHostPort(r.BindAddr, fmt.Sprintf("%d", r.BindPort)), applied, len(foundClients))
+		fmt.Fprintf(tty, "started %s on %d clients (total %d)\n", r.String(), applied, len(foundClients))
 
 		if auto {
-			var entry autostartEntry
-
-			entry.ObserverID = observers.ConnectionState.Register(func(c observers.ClientState) {
-
-				if !user.Matches(specifier, c.ID, c.IP) || c.Status == "disconnected" {
-					return
-				}
-
-				client, err := user.GetClient(c.ID)
-				if err != nil {
-					return
-				}
-
-				result, message, err := client.SendRequest("tcpip-forward", true, b)
-				if !result {
-					l.log.Warning("failed to start server tcpip-forward on client: %s: %s", c.ID, message)
-					return
-				}
-
-				if err != nil {
-					l.log.Warning("error auto starting port on: %s: %s", c.ID, err)
-					return
-				}
-
-			})
-
-			entry.Criteria = specifier
-
-			autoStartServerPort[r] = entry
+			l.autoStart(user, specifier, r)
 
+			if err := data.SaveListener(data.Listener{Owner: user.Username(), Client: specifier, Auto: true, Address: addr}); err != nil {
+				fmt.Fprintf(tty, "unable to save automatic listener %s, it will not be restored when the server restarts: %s\n", addr, err)
+			}
 		}
 	}
 
-	var cancelFwRequests []internal.RemoteForwardRequest
+	cancelFwRequests := map[string]internal.RemoteForwardRequest{}
 
 	for _, addr := range offAddrs {
-		ip, port, err := net.SplitHostPort(addr)
-		if err != nil {
-			return err
-		}
-
-		p, err := strconv.ParseInt(port, 10, 32)
+		r, err := forwardRequest(addr)
 		if err != nil {
 			return err
 		}
 
-		cancelFwRequests = append(cancelFwRequests, internal.RemoteForwardRequest{
-			BindPort: uint32(p),
-			BindAddr: ip,
-		})
-
+		cancelFwRequests[addr] = r
 	}
 
-	for _, r := range cancelFwRequests {
+	for addr, r := range cancelFwRequests {
 		applied := len(foundClients)
 
 		b := ssh.Marshal(&r)
 		for c, sc := range foundClients {
+			// Forget it even if the client has already stopped it, otherwise it would come back on reconnect
+			if err := data.DeleteListener(sc.Permissions.Extensions["pubkey-fp"], false, addr); err != nil {
+				fmt.Fprintf(tty, "unable to remove saved listener %s on %s: %s\n", addr, c, err)
+			}
+
 			result, message, err := sc.SendRequest("cancel-tcpip-forward", true, b)
 			if !result {
 				applied--
@@ -231,26 +274,142 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 			}
 		}
 
-		fmt.Fprintf(tty, "stopped %s on %d clients\n", net.JoinHostPort(r.BindAddr, fmt.Sprintf("%d", r.BindPort)), applied)
+		fmt.Fprintf(tty, "stopped %s on %d clients\n", r.String(), applied)
 
 		if auto {
-			if _, ok := autoStartServerPort[r]; ok {
-				observers.ConnectionState.Deregister(autoStartServerPort[r].Criteria)
+			autoLck.Lock()
+			if entry, ok := autoStartServerPort[r]; ok {
+				observers.ConnectionState.Deregister(entry.ObserverID)
 			}
 			delete(autoStartServerPort, r)
+			autoLck.Unlock()
+
+			if err := data.DeleteListener(specifier, true, addr); err != nil {
+				fmt.Fprintf(tty, "unable to remove saved automatic listener %s: %s\n", addr, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// autoStart opens r on every client matching specifier that connects from now on
+func (l *listen) autoStart(user *users.User, specifier string, r internal.RemoteForwardRequest) {
+	b := ssh.Marshal(&r)
+
+	var entry autostartEntry
+
+	entry.ObserverID = observers.ConnectionState.Register(func(c observers.ClientState) {
+
+		if !user.Matches(specifier, c.ID, c.IP) || c.Status != "connected" {
+			return
+		}
+
+		client, err := user.GetClient(c.ID)
+		if err != nil {
+			return
+		}
+
+		result, message, err := client.SendRequest("tcpip-forward", true, b)
+		if !result {
+			l.log.Warning("failed to start server tcpip-forward on client: %s: %s", c.ID, message)
+			return
+		}
+
+		if err != nil {
+			l.log.Warning("error auto starting port on: %s: %s", c.ID, err)
+			return
+		}
+
+	})
+
+	entry.Criteria = specifier
+
+	autoLck.Lock()
+	defer autoLck.Unlock()
+
+	if existing, ok := autoStartServerPort[r]; ok {
+		observers.ConnectionState.Deregister(existing.ObserverID)
+	}
+
+	autoStartServerPort[r] = entry
+}
+
+// RestoreListeners starts the server listeners and automatic client listeners saved before the server was last stopped
+func RestoreListeners(log logger.Logger) error {
+	saved, err := data.GetListeners()
+	if err != nil {
+		return err
+	}
+
+	l := Listen(log)
+	for _, s := range saved {
+		switch {
+		case s.Client == "":
+			if err := multiplexer.ServerMultiplexer.StartListener("tcp", s.Address); err != nil {
+				log.Warning("unable to restore listener %s: %s", s.Address, err)
+				continue
+			}
+			log.Info("restored listener %s", s.Address)
+
+		case s.Auto:
+			r, err := forwardRequest(s.Address)
+			if err != nil {
+				log.Warning("saved automatic listener %q is invalid: %s", s.Address, err)
+				continue
+			}
+
+			user, _, err := users.CreateOrGetUser(s.Owner, nil)
+			if err != nil {
+				log.Warning("unable to restore automatic listener %s for %s: %s", s.Address, s.Owner, err)
+				continue
+			}
+
+			l.autoStart(user, s.Client, r)
+			log.Info("restored automatic listener %s on clients matching %q", s.Address, s.Client)
 		}
 	}
 
 	return nil
 }
 
+// RestoreClientListeners reopens the listeners an operator started on this client (identified by its key) before it, or the server, last disconnected
+func RestoreClientListeners(sc ssh.Conn, fingerprint string, log logger.Logger) {
+	if err := data.TouchClientListeners(fingerprint); err != nil {
+		log.Warning("unable to mark saved listeners as in use: %s", err)
+	}
+
+	saved, err := data.GetClientListeners(fingerprint)
+	if err != nil {
+		log.Warning("unable to get saved listeners: %s", err)
+		return
+	}
+
+	for _, s := range saved {
+		r, err := forwardRequest(s.Address)
+		if err != nil {
+			log.Warning("saved listener %q is invalid: %s", s.Address, err)
+			continue
+		}
+
+		result, message, err := sc.SendRequest("tcpip-forward", true, ssh.Marshal(&r))
+		if err != nil || !result {
+			log.Warning("unable to restore listener %s started by %s: %s", r.String(), s.Owner, message)
+			continue
+		}
+
+		log.Info("restored listener %s started by %s", r.String(), s.Owner)
+	}
+}
+
 func (w *listen) ValidArgs() map[string]string {
 
 	r := map[string]string{
-		"on":   "Turn on port, e.g --on :8080 127.0.0.1:4444",
-		"auto": "Automatically turn on server control port on clients that match criteria, (use --off --auto to disable and --l --auto to view)",
-		"off":  "Turn off port, e.g --off :8080 127.0.0.1:4444",
-		"l":    "List all enabled addresses",
+		"on":    "Turn on port, e.g --on :8080 127.0.0.1:4444, windows clients can also listen on a named pipe with --on pipe:<name>",
+		"auto":  "Automatically turn on server control port on clients that match criteria, (use --off --auto to disable and --l --auto to view)",
+		"off":   "Turn off port, e.g --off :8080 127.0.0.1:4444",
+		"l":     "List all enabled addresses",
+		"saved": "List the listeners that are restored when the server restarts or clients reconnect",
 	}
 
 	addDuplicateFlags("Open server port on client/s takes a pattern, e.g -c *, --client your.hostname.here", r, "client", "c")
@@ -261,13 +420,39 @@ func (w *listen) ValidArgs() map[string]string {
 
 func (w *listen) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
 
+	if line.IsSet("saved") {
+		saved, err := data.GetListeners()
+		if err != nil {
+			return err
+		}
+
+		t, err := table.NewTable("Saved Listeners", "Where", "Address", "Owner")
+		if err != nil {
+			return err
+		}
+
+		for _, s := range saved {
+			where := "server"
+			if s.Auto {
+				where = "clients matching " + s.Client
+			} else if s.Client != "" {
+				where = "client key " + s.Client
+			}
+
+			t.AddValues(where, s.Address, s.Owner)
+		}
+
+		t.Fprint(tty)
+		return nil
+	}
+
 	onAddrs, err := line.GetArgsString("on")
 	if err != nil && err != terminal.ErrFlagNotSet {
 		return err
 	}
 
 	if len(onAddrs) == 0 && err != terminal.ErrFlagNotSet {
-		return errors.New("no value specified for --on, requires port e.g --on :4343")
+		return failure.New(failure.InvalidArgument, "no value specified for --on, requires port e.g --on :4343")
 	}
 
 	offAddrs, err := line.GetArgsString("off")
@@ -276,20 +461,20 @@ func (w *listen) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLi
 	}
 
 	if len(offAddrs) == 0 && err != terminal.ErrFlagNotSet {
-		return errors.New("no value specified for --off, requires port e.g --off :4343")
+		return failure.New(failure.InvalidArgument, "no value specified for --off, requires port e.g --off :4343")
 	}
 
 	if onAddrs == nil && offAddrs == nil && !line.IsSet("l") {
-		return errors.New("no actionable argument supplied, please add --on, --off or -l (list)")
+		return failure.New(failure.InvalidArgument, "no actionable argument supplied, please add --on, --off or -l (list)")
 	}
 
 	if line.IsSet("server") || line.IsSet("s") {
-		return w.server(tty, line, onAddrs, offAddrs)
+		return w.server(user, tty, line, onAddrs, offAddrs)
 	} else if line.IsSet("client") || line.IsSet("c") || line.IsSet("auto") {
 		return w.client(user, tty, line, onAddrs, offAddrs)
 	}
 
-	return errors.New("neither server or client were specified, please choose one")
+	return failure.New(failure.InvalidArgument, "neither server or client were specified, please choose one")
 }
 
 func (W *listen) Expect(line terminal.ParsedLine) []string {
@@ -313,6 +498,7 @@ func (w *listen) Help(explain bool) string {
 		"listen [OPTION] [PORT]",
 		"listen starts or stops listening control ports",
 		"it allows you to change the servers listening port, or open the servers control port on an rssh client, so that forwarding is easier",
+		"listeners are saved, so they are started again when the server restarts or the client (identified by its key) reconnects, until turned --off",
 	)
 }
 
@@ -321,3 +507,14 @@ func Listen(log logger.Logger) *listen {
 		log: log,
 	}
 }
+
+func (w *listen) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "listen -l", Description: "List every listening address on the server and clients"},
+		{Command: "listen --server --on :4343", Description: "Start an extra server listener on port 4343"},
+		{Command: "listen --client webserver --on 127.0.0.1:2222", Description: "Open the server control port on a client, so other clients can forward through it"},
+		{Command: "listen --auto --client * --on :2222", Description: "Open the port on every current and future client"},
+		{Command: "listen --client fileserver --on pipe:rssh", Description: "Let clients built with link --smb -s fileserver/rssh connect back through a windows client over SMB"},
+		{Command: "listen --saved", Description: "Show the listeners that come back after a restart"},
+	}
+}
@@ -0,0 +1,199 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/presence"
+	"golang.org/x/crypto/ssh"
+)
+
+// Operators share a server, so two of them can be working on the same client at once.
+// Operations that need the client to stay put (exec, changing forwards) share a client, operations that end it (kill) need it to themselves.
+// Nothing waits, a conflicting operation is refused with who is in the way so the operator can decide what to do.
+
+type clientOperation struct {
+	Name     string
+	Operator string
+	Started  time.Time
+}
+
+func (o clientOperation) String() string {
+	return fmt.Sprintf("%s by %s (started %s ago)", o.Name, o.Operator, time.Since(o.Started).Round(time.Second))
+}
+
+type clientLock struct {
+	shared    map[uint64]clientOperation
+	exclusive *clientOperation
+}
+
+var (
+	clientLocksLck sync.Mutex
+	clientLocks    = map[string]*clientLock{}
+	nextOperation  uint64
+
+	// Guards the --auto entries of listen, qos and derp, as any operator session can change them
+	autoLck sync.Mutex
+)
+
+// ErrClientBusy is returned when a client is in use by a conflicting operation
+type ErrClientBusy struct {
+	ID       string
+	Blocking []clientOperation
+}
+
+func (e *ErrClientBusy) Error() string {
+	blocking := make([]string, 0, len(e.Blocking))
+	for _, o := range e.Blocking {
+		blocking = append(blocking, o.String())
+	}
+	sort.Strings(blocking)
+
+	return fmt.Sprintf("client %s is busy: %s", e.ID, strings.Join(blocking, ", "))
+}
+
+func (e *ErrClientBusy) FailureCode() failure.Code {
+	return failure.ClientBusy
+}
+
+func (l *clientLock) conflicts(exclusive bool) []clientOperation {
+	if l.exclusive != nil {
+		return []clientOperation{*l.exclusive}
+	}
+
+	if !exclusive {
+		return nil
+	}
+
+	out := make([]clientOperation, 0, len(l.shared))
+	for _, o := range l.shared {
+		out = append(out, o)
+	}
+	return out
+}
+
+// lockClients marks operation as running on every client in ids, or none of them if any conflict.
+// Exclusive operations are also refused while an ssh session or forward is open through a client, checked under the same lock so a
+// shell cannot start in between. The returned function must be called once the operation is finished
+func lockClients(ids []string, operation, operator string, exclusive bool) (func(), error) {
+	clientLocksLck.Lock()
+	defer clientLocksLck.Unlock()
+
+	for _, id := range ids {
+		if l, ok := clientLocks[id]; ok {
+			if blocking := l.conflicts(exclusive); len(blocking) > 0 {
+				return nil, &ErrClientBusy{ID: id, Blocking: blocking}
+			}
+		}
+	}
+
+	if exclusive {
+		if err := sessionsThrough(ids); err != nil {
+			return nil, err
+		}
+	}
+
+	op := clientOperation{Name: operation, Operator: operator, Started: time.Now()}
+
+	nextOperation++
+	token := nextOperation
+
+	for _, id := range ids {
+		l, ok := clientLocks[id]
+		if !ok {
+			l = &clientLock{shared: map[uint64]clientOperation{}}
+			clientLocks[id] = l
+		}
+
+		if exclusive {
+			l.exclusive = &op
+		} else {
+			l.shared[token] = op
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			clientLocksLck.Lock()
+			defer clientLocksLck.Unlock()
+
+			for _, id := range ids {
+				l, ok := clientLocks[id]
+				if !ok {
+					continue
+				}
+
+				if exclusive {
+					l.exclusive = nil
+				} else {
+					delete(l.shared, token)
+				}
+
+				if l.exclusive == nil && len(l.shared) == 0 {
+					delete(clientLocks, id)
+				}
+			}
+		})
+	}, nil
+}
+
+func clientIDs(clients map[string]*ssh.ServerConn) []string {
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// sessionsThrough refuses if any operator has an ssh (jump host) session or a forward open through one of ids.
+// They go straight to the client rather than through a command, so they are only known from presence
+func sessionsThrough(ids []string) error {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+
+	for _, id := range sorted {
+		var blocking []clientOperation
+		for _, o := range presence.On(id) {
+			for _, kind := range []presence.Kind{presence.SSH, presence.Forward} {
+				if o.Open[kind] > 0 {
+					blocking = append(blocking, clientOperation{Name: string(kind), Operator: o.Name, Started: o.Since})
+				}
+			}
+		}
+
+		if len(blocking) > 0 {
+			return &ErrClientBusy{ID: id, Blocking: blocking}
+		}
+	}
+
+	return nil
+}
+
+// lockClient is lockClients for a single client
+func lockClient(id, operation, operator string, exclusive bool) (func(), error) {
+	return lockClients([]string{id}, operation, operator, exclusive)
+}
+
+// clientOperations lists what is running on a client, for ls
+func clientOperations(id string) []string {
+	clientLocksLck.Lock()
+	defer clientLocksLck.Unlock()
+
+	l, ok := clientLocks[id]
+	if !ok {
+		return nil
+	}
+
+	out := []string{}
+	for _, o := range l.conflicts(true) {
+		out = append(out, o.String())
+	}
+	sort.Strings(out)
+
+	return out
+}
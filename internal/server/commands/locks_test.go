@@ -0,0 +1,203 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/presence"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+func TestLockClients(t *testing.T) {
+	unlockExec, err := lockClient("a", "exec", "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlockQoS, err := lockClients([]string{"a", "b"}, "qos", "bob", false)
+	if err != nil {
+		t.Fatalf("shared operations should not conflict: %v", err)
+	}
+
+	_, err = lockClients([]string{"c", "a"}, "kill", "carol", true)
+	var busy *ErrClientBusy
+	if !errors.As(err, &busy) || busy.ID != "a" || len(busy.Blocking) != 2 {
+		t.Fatalf("kill should have been refused by exec and qos on a, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "exec by alice") {
+		t.Fatalf("error does not say who is using the client: %s", err)
+	}
+
+	if ops := clientOperations("c"); len(ops) != 0 {
+		t.Fatalf("refused lock was partly taken: %v", ops)
+	}
+
+	unlockExec()
+	unlockExec()
+	unlockQoS()
+
+	unlockKill, err := lockClients([]string{"a", "b"}, "kill", "carol", true)
+	if err != nil {
+		t.Fatalf("kill should succeed once nothing is using the clients: %v", err)
+	}
+
+	if _, err := lockClient("b", "exec", "alice", false); err == nil {
+		t.Fatal("exec should be refused while the client is being killed")
+	}
+
+	unlockKill()
+
+	if len(clientLocks) != 0 {
+		t.Fatalf("locks were not cleaned up: %v", clientLocks)
+	}
+}
+
+func TestKillRefusedWhileShellOpen(t *testing.T) {
+	// What connect holds for as long as the shell is open
+	unlockShell, err := lockClient("shelled", "shell", "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = lockClients([]string{"shelled"}, "kill", "bob", true)
+	if err == nil || !strings.Contains(err.Error(), "shell by alice") {
+		t.Fatalf("kill should have been refused by alice's shell, got %v", err)
+	}
+
+	unlockShell()
+
+	unlockKill, err := lockClients([]string{"shelled"}, "kill", "bob", true)
+	if err != nil {
+		t.Fatalf("kill should succeed once the shell is closed: %v", err)
+	}
+	unlockKill()
+
+	jump := presence.Open("jumped", "carol", presence.SSH)
+
+	_, err = lockClients([]string{"other", "jumped"}, "kill", "bob", true)
+	var busy *ErrClientBusy
+	if !errors.As(err, &busy) || busy.ID != "jumped" || !strings.Contains(err.Error(), "ssh by carol") {
+		t.Fatalf("kill should have been refused by carol's jump host session, got %v", err)
+	}
+
+	if len(clientLocks) != 0 {
+		t.Fatalf("a refused kill should not leave clients locked: %v", clientLocks)
+	}
+
+	// Shared operations do not end the client, so they can run alongside the session
+	unlockExec, err := lockClient("jumped", "exec", "alice", false)
+	if err != nil {
+		t.Fatalf("exec should not be refused by a jump host session: %v", err)
+	}
+	unlockExec()
+
+	jump.Close()
+
+	unlockKill, err = lockClients([]string{"jumped"}, "kill", "bob", true)
+	if err != nil {
+		t.Fatalf("nothing is open through the client any more: %v", err)
+	}
+	unlockKill()
+}
+
+func TestLockClientsConcurrent(t *testing.T) {
+	var (
+		wg     sync.WaitGroup
+		inUse  [4]atomic.Int32
+		failed atomic.Bool
+	)
+
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				id := (worker + i) % len(inUse)
+				exclusive := i%5 == 0
+
+				unlock, err := lockClient(fmt.Sprint(id), "test", "worker", exclusive)
+				if err != nil {
+					continue
+				}
+
+				if exclusive {
+					if !inUse[id].CompareAndSwap(0, -1) {
+						failed.Store(true)
+					}
+					inUse[id].Store(0)
+				} else {
+					if inUse[id].Add(1) <= 0 {
+						failed.Store(true)
+					}
+					inUse[id].Add(-1)
+				}
+
+				unlock()
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+
+	if failed.Load() {
+		t.Fatal("an exclusive operation ran at the same time as another operation on the same client")
+	}
+}
+
+// Operators each have their own console, but --auto state is shared between them. Run with -race
+func TestConcurrentAutoCommands(t *testing.T) {
+	log := logger.NewLog("test")
+
+	lines := []string{
+		"qos -c nothing.matches --auto --set :3389 --class high",
+		"qos -c nothing.matches --auto --remove :3389",
+		"qos --auto -l",
+		"derp -c nothing.matches --auto --reset",
+		"derp --auto -l",
+		"listen --auto -l -c nothing.matches",
+	}
+
+	// derp signs what it pushes with the server key
+	datadir := t.TempDir()
+	key, err := internal.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(datadir, "id_ed25519"), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for operator := 0; operator < 4; operator++ {
+		user, _, err := users.CreateOrGetUser(fmt.Sprintf("operator%d", operator), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Same as running a command with ssh server <command>
+			c := CreateCommands("", user, log, datadir)
+			for i := 0; i < 50; i++ {
+				line := terminal.ParseLine(lines[i%len(lines)], 0)
+				c[line.Command.Value()].Run(user, &bytes.Buffer{}, line)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -47,12 +48,12 @@ func (l *logCommand) Run(user *users.User, tty io.ReadWriter, line terminal.Pars
 
 		_, err := logger.StrToUrgency(logLevel)
 		if err != nil {
-			return fmt.Errorf("invalid log level %q", logLevel)
+			return failure.New(failure.InvalidArgument, "invalid log level %q", logLevel)
 		}
 
 		_, _, err = connection.SendRequest("log-level", false, []byte(logLevel))
 		if err != nil {
-			return fmt.Errorf("failed to send log level request to client (may be outdated): %s", err)
+			return failure.New(failure.ClientRefused, "failed to send log level request to client (may be outdated): %s", err)
 		}
 	}
 
@@ -65,7 +66,7 @@ func (l *logCommand) Run(user *users.User, tty io.ReadWriter, line terminal.Pars
 
 		consoleLog, reqs, err := connection.OpenChannel("log-to-console", nil)
 		if err != nil {
-			return fmt.Errorf("client would not open log to console channel (maybe wrong version): %s", err)
+			return failure.New(failure.ClientRefused, "client would not open log to console channel (maybe wrong version): %s", err)
 		}
 
 		go ssh.DiscardRequests(reqs)
@@ -101,7 +102,7 @@ func (l *logCommand) Run(user *users.User, tty io.ReadWriter, line terminal.Pars
 
 		_, _, err = connection.SendRequest("log-to-file", false, []byte(filepath))
 		if err != nil {
-			return fmt.Errorf("failed to send request to client: %s", err)
+			return failure.New(failure.ClientRefused, "failed to send request to client: %s", err)
 		}
 		fmt.Fprintln(tty, "log to file request sent to client!")
 	}
@@ -136,3 +137,10 @@ func (l *logCommand) Help(explain bool) string {
 func Log(log logger.Logger) *logCommand {
 	return &logCommand{}
 }
+
+func (l *logCommand) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "log -c webserver --to-console", Description: "Show the clients log output in the console until a key is pressed"},
+		{Command: "log -c webserver --log-level INFO", Description: "Change how much a client logs"},
+	}
+}
@@ -0,0 +1,244 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/mesh"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
+)
+
+type meshCommand struct {
+}
+
+func (m *meshCommand) ValidArgs() map[string]string {
+	return map[string]string{
+		"l":           "List clients, the networks they are on, what they are relaying and how they connected (default)",
+		"reach":       "Show which clients share a network with an address, i.e which could relay for a client deployed there",
+		"relay":       "Start relaying connections to the server on matching clients",
+		"stop":        "Stop relaying on matching clients, requires --port",
+		"port":        "Port to relay on (default random)",
+		"no-announce": "Dont answer mDNS queries for the relay, clients will need it baked in with link --mesh",
+	}
+}
+
+func (m *meshCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if addr, err := line.GetArgString("reach"); err == nil {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return failure.New(failure.InvalidArgument, "invalid address %q", addr)
+		}
+
+		var reachable []string
+		for _, id := range mesh.Reachable(ip) {
+			if sc, err := user.GetClient(id); err == nil {
+				reachable = append(reachable, fmt.Sprintf("%s (%s)", id, users.NormaliseHostname(sc.User())))
+			}
+		}
+
+		if len(reachable) == 0 {
+			return failure.New(failure.ClientNotFound, "no clients share a network with %s", ip)
+		}
+
+		fmt.Fprintf(tty, "%s\n", strings.Join(reachable, "\n"))
+		return nil
+	} else if err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	port := uint32(0)
+	if p, err := line.GetArgString("port"); err == nil {
+		parsed, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return failure.Wrap(failure.InvalidArgument, fmt.Errorf("invalid port %q: %w", p, err))
+		}
+		port = uint32(parsed)
+	} else if err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	if filter, err := line.GetArgString("relay"); err == nil {
+		return m.relay(user, tty, filter, port, !line.IsSet("no-announce"))
+	} else if err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	if filter, err := line.GetArgString("stop"); err == nil {
+		if port == 0 {
+			return failure.New(failure.InvalidArgument, "stopping a relay requires --port")
+		}
+		return m.stop(user, tty, filter, port)
+	} else if err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	t, err := table.NewTable("Mesh", "ID", "Hostname", "Via", "Networks", "Relaying")
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range mesh.Peers() {
+		sc, err := user.GetClient(peer.ID)
+		if err != nil {
+			continue
+		}
+
+		networks := "not advertised"
+		if peer.Advertised {
+			var n []string
+			for _, iface := range peer.Interfaces {
+				n = append(n, iface.String())
+			}
+			networks = strings.Join(n, "\n")
+		}
+
+		var ports []string
+		for _, p := range peer.RelayPorts {
+			ports = append(ports, strconv.Itoa(int(p)))
+		}
+
+		via := relayPath(user, peer.ID)
+		if via == "" {
+			via = "direct"
+		}
+
+		if err := t.AddValues(peer.ID, users.NormaliseHostname(sc.User()), via, networks, strings.Join(ports, "\n")); err != nil {
+			return err
+		}
+	}
+
+	t.Fprint(tty)
+
+	return nil
+}
+
+func (m *meshCommand) relay(user *users.User, tty io.ReadWriter, filter string, port uint32, announce bool) error {
+	clients, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(clients) == 0 {
+		return failure.New(failure.ClientNotFound, "no clients matched %q", filter).With("client", filter)
+	}
+
+	unlock, err := lockClients(clientIDs(clients), "mesh", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for id, sc := range clients {
+		ok, reply, err := sc.SendRequest("tcpip-forward", true, ssh.Marshal(&internal.RemoteForwardRequest{BindAddr: "", BindPort: port}))
+		if err != nil || !ok {
+			fmt.Fprintf(tty, "%s failed to start relay: %s\n", id, string(reply))
+			continue
+		}
+
+		relayPort := port
+		if relayPort == 0 {
+			if err := ssh.Unmarshal(reply, &relayPort); err != nil {
+				fmt.Fprintf(tty, "%s did not say which port it is relaying on: %s\n", id, err)
+				continue
+			}
+		}
+
+		mesh.AddRelay(id, relayPort)
+
+		if announce {
+			ok, reply, err := sc.SendRequest("mesh-announce@rssh", true, ssh.Marshal(struct {
+				Port     uint32
+				Announce bool
+			}{relayPort, true}))
+			if err != nil || !ok {
+				fmt.Fprintf(tty, "%s is relaying on %d, but could not announce it with mDNS: %s\n", id, relayPort, string(reply))
+				continue
+			}
+		}
+
+		fmt.Fprintf(tty, "%s is relaying on %d\n", id, relayPort)
+	}
+
+	return nil
+}
+
+func (m *meshCommand) stop(user *users.User, tty io.ReadWriter, filter string, port uint32) error {
+	clients, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(clients) == 0 {
+		return failure.New(failure.ClientNotFound, "no clients matched %q", filter).With("client", filter)
+	}
+
+	unlock, err := lockClients(clientIDs(clients), "mesh", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for id, sc := range clients {
+		// Older clients wont know about announcements, which is fine as they never made any
+		sc.SendRequest("mesh-announce@rssh", true, ssh.Marshal(struct {
+			Port     uint32
+			Announce bool
+		}{port, false}))
+
+		ok, reply, err := sc.SendRequest("cancel-tcpip-forward", true, ssh.Marshal(&internal.RemoteForwardRequest{BindAddr: "", BindPort: port}))
+		if err != nil || !ok {
+			fmt.Fprintf(tty, "%s failed to stop relay: %s\n", id, string(reply))
+			continue
+		}
+
+		mesh.RemoveRelay(id, port)
+
+		fmt.Fprintf(tty, "%s stopped relaying on %d\n", id, port)
+	}
+
+	return nil
+}
+
+func (m *meshCommand) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "relay", "stop":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (m *meshCommand) Help(explain bool) string {
+	if explain {
+		return "Have clients relay for each other so clients without a route to the server can still connect"
+	}
+
+	return terminal.MakeHelpText(m.ValidArgs(),
+		"mesh [OPTIONS]",
+		"Clients tell the server which networks they are on when they connect, so the server can work out who could relay for who.",
+		"A relaying client accepts connections and hands them to the server, and answers mDNS queries so new clients on its network can find it.",
+		"Clients built with link --mesh try relays when they cant reach the server, ls shows the path they connected through.",
+	)
+}
+
+func (m *meshCommand) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "mesh", Description: "Show every client, its networks and what it is relaying"},
+		{Command: "mesh --reach 10.0.4.20", Description: "Find clients that could relay for a host at 10.0.4.20"},
+		{Command: "mesh --relay fileserver --port 8443", Description: "Relay on port 8443 of the client fileserver"},
+		{Command: "mesh --stop fileserver --port 8443", Description: "Stop that relay"},
+		{Command: "link --goos windows --mesh", Description: "Build a client that falls back to the active relays, then mDNS"},
+	}
+}
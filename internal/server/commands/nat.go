@@ -0,0 +1,188 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/nat"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type natCommand struct {
+}
+
+func (n *natCommand) ValidArgs() map[string]string {
+	return map[string]string{}
+}
+
+func (n *natCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	args := line.ArgumentsAsStrings()
+	if len(args) == 1 && args[0] == "status" {
+		return n.status(tty)
+	}
+
+	if len(args) == 0 || args[0] != "info" || len(args) > 2 {
+		return failure.New(failure.InvalidArgument, "%s", n.Help(false))
+	}
+
+	local := nat.LocalNAT()
+	if local.Detected.IsZero() {
+		fmt.Fprintln(tty, "Server: not known, it is found when the ts relay transport starts")
+	} else {
+		var mapped []string
+		for _, m := range local.Mapped {
+			mapped = append(mapped, m.String())
+		}
+		fmt.Fprintf(tty, "Server: %s, seen as %s (%s ago)\n", local.Type, strings.Join(mapped, ", "), time.Since(local.Detected).Round(time.Second))
+	}
+
+	filter := "*"
+	if len(args) == 2 {
+		filter = args[1]
+	}
+
+	clients, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	t, err := table.NewTable("NAT", "ID", "Hostname", "Behaviour", "Direct path")
+	if err != nil {
+		return err
+	}
+
+	relayed := 0
+	for _, id := range ids {
+		sc := clients[id]
+
+		addr, ok := sc.RemoteAddr().(interface{ NAT() nat.NATType })
+		if !ok {
+			// Only ts relay clients have a path to upgrade
+			continue
+		}
+		relayed++
+
+		behaviour := addr.NAT()
+		direct := "unlikely, expect it to stay on the relay"
+		switch {
+		case behaviour == nat.NATUnknown:
+			direct = "not known"
+		case behaviour.Punchable():
+			direct = "worth trying"
+		}
+
+		if err := t.AddValues(id, users.NormaliseHostname(sc.User()), behaviour.String(), direct); err != nil {
+			return err
+		}
+	}
+
+	if relayed == 0 {
+		fmt.Fprintf(tty, "No ts relay clients matched %q\n", filter)
+		return nil
+	}
+
+	t.Fprint(tty)
+	return nil
+}
+
+func humanBytes(bytes uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+
+	size := float64(bytes)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+func (n *natCommand) status(tty io.ReadWriter) error {
+	status := nat.Status()
+	if !status.Running {
+		fmt.Fprintln(tty, "The ts relay transport is not running, it starts when a ts:// client is built or connects")
+		return nil
+	}
+
+	fmt.Fprintf(tty, "Running for %s\n", time.Since(status.Started).Round(time.Second))
+	fmt.Fprintf(tty, "Sessions: %d active (%d on a direct path), %d pending\n", status.ActiveSessions, status.DirectSessions, status.PendingSessions)
+	fmt.Fprintf(tty, "Relayed over DERP: %s in, %s out\n", humanBytes(status.BytesIn), humanBytes(status.BytesOut))
+	if status.BackloggedSessions > 0 {
+		fmt.Fprintf(tty, "Send queues: %s waiting, %d sessions with writes held back\n", humanBytes(status.QueuedBytes), status.BackloggedSessions)
+	}
+	if status.BannedPeers > 0 {
+		fmt.Fprintf(tty, "Banned peers: %d\n", status.BannedPeers)
+	}
+
+	t, err := table.NewTable("DERP regions", "Region", "State", "Latency", "Reconnects", "Last error")
+	if err != nil {
+		return err
+	}
+
+	for _, region := range status.Regions {
+		state := "connected"
+		if !region.Connected {
+			state = "reconnecting"
+		}
+
+		latency := "-"
+		if region.Latency > 0 {
+			latency = region.Latency.Round(time.Millisecond).String()
+		}
+
+		lastError := ""
+		if region.LastError != "" {
+			lastError = fmt.Sprintf("%s (%s ago)", region.LastError, time.Since(region.LastErrorAt).Round(time.Second))
+		}
+
+		if err := t.AddValues(fmt.Sprintf("%d", region.RegionID), state, latency, fmt.Sprintf("%d", region.Reconnects), lastError); err != nil {
+			return err
+		}
+	}
+
+	t.Fprint(tty)
+	return nil
+}
+
+func (n *natCommand) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) == 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (n *natCommand) Help(explain bool) string {
+	const description = "Show the NAT behaviour of the server and ts relay clients, and the state of the ts relay transport"
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(n.ValidArgs(),
+		"nat info [client]",
+		"nat status",
+		"info shows the NAT behaviour of the server and ts relay clients, and whether a direct path is worth trying.",
+		"status shows the relay sessions, how much has been relayed, and the state of each DERP region the server is connected to.",
+	)
+}
+
+func (n *natCommand) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "nat info", Description: "Show the server's NAT and every ts relay client's"},
+		{Command: "nat info webserver", Description: "Show the NAT of the client with hostname webserver"},
+		{Command: "nat status", Description: "Show relay sessions, traffic and DERP region errors"},
+	}
+}
@@ -0,0 +1,279 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/pivot"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long to wait for replies after stdin closes, as udp has no way of saying it is done
+const udpLinger = 3 * time.Second
+
+type netcat struct {
+	log logger.Logger
+}
+
+func (n *netcat) ValidArgs() map[string]string {
+	return map[string]string{
+		"udp":  "Send udp instead of tcp, each line typed (or each read of stdin) is one datagram",
+		"crlf": "End lines typed in the console with \\r\\n, for http, smtp and the like",
+	}
+}
+
+// datagramConn reads and writes whole datagrams on a direct-udp@rssh channel
+type datagramConn struct {
+	ssh.Channel
+	pending []byte
+}
+
+func (d *datagramConn) Read(b []byte) (int, error) {
+	if len(d.pending) == 0 {
+		datagram, err := internal.ReadDatagram(d.Channel)
+		if err != nil {
+			return 0, err
+		}
+		d.pending = datagram
+	}
+
+	n := copy(b, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *datagramConn) Write(b []byte) (int, error) {
+	if err := internal.WriteDatagram(d.Channel, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (n *netcat) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if len(line.Arguments) != 2 {
+		return failure.New(failure.InvalidArgument, "%s", n.Help(false))
+	}
+
+	specifier := line.Arguments[0].Value()
+	target := line.Arguments[1].Value()
+
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return failure.New(failure.InvalidArgument, "target %q is not host:port", target).With("target", target)
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return failure.New(failure.InvalidArgument, "target %q has an invalid port", target).With("target", target)
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) == 0 {
+		return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
+	}
+
+	if len(foundClients) > 1 {
+		return failure.New(failure.InvalidArgument, "%q matches multiple clients please choose a more specific identifier", specifier).With("client", specifier)
+	}
+
+	var (
+		id     string
+		client *ssh.ServerConn
+	)
+	for k := range foundClients {
+		id = k
+		client = foundClients[k]
+		break
+	}
+
+	unlock, err := lockClient(id, "nc", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	route, err := pivot.Open(id, client, nil)
+	if err != nil {
+		return failure.Wrap(failure.TransportUnavailable, err)
+	}
+	defer route.Close()
+
+	destination := ssh.Marshal(&internal.ChannelOpenDirectMsg{
+		Raddr: host,
+		Rport: uint32(port),
+		Laddr: "127.0.0.1",
+	})
+
+	udp := line.IsSet("udp")
+
+	var (
+		channel ssh.Channel
+		reqs    <-chan *ssh.Request
+	)
+	if udp {
+		channel, reqs, err = route.DialUDP(destination)
+	} else {
+		channel, reqs, err = route.Dial(destination)
+	}
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if udp && errors.As(err, &openErr) && openErr.Reason == ssh.UnknownChannelType {
+			return failure.New(failure.ClientRefused, "%s does not support udp, it may need updating", id).With("client", id)
+		}
+		return failure.New(failure.TransportUnavailable, "unable to connect to %s from %s: %s", target, id, err).With("client", id).With("target", target)
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	n.log.Info("%s opened nc to %s through %s", user.Username(), target, id)
+
+	var conn io.ReadWriter = channel
+	if udp {
+		conn = &datagramConn{Channel: channel}
+	}
+
+	term, isTerm := tty.(*terminal.Terminal)
+	if !isTerm {
+		// Run with ssh catcher nc, so stdin and stdout are the connection, e.g for ProxyCommand
+		go func() {
+			io.Copy(conn, tty)
+			if udp {
+				time.Sleep(udpLinger)
+				channel.Close()
+				return
+			}
+			channel.CloseWrite()
+		}()
+
+		io.Copy(tty, conn)
+		return nil
+	}
+
+	lineEnding := []byte("\n")
+	if line.IsSet("crlf") {
+		lineEnding = []byte("\r\n")
+	}
+
+	fmt.Fprintf(term, "connected to %s through %s, ctrl+c or ctrl+d to stop\n", target, id)
+
+	term.EnableRaw()
+	defer term.DisableRaw(true)
+
+	remoteClosed := make(chan struct{})
+	go func() {
+		defer close(remoteClosed)
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				term.Write(bytes.ReplaceAll(buf[:n], []byte("\n"), []byte("\r\n")))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	operatorDone := make(chan struct{})
+	go func() {
+		defer close(operatorDone)
+
+		var (
+			input []byte
+			b     = make([]byte, 256)
+		)
+		for {
+			n, err := term.Read(b)
+			if err != nil {
+				return
+			}
+
+			select {
+			case <-remoteClosed:
+				// This key press was for the console, DisableRaw(true) hands it back
+				return
+			default:
+			}
+
+			for _, c := range b[:n] {
+				switch c {
+				case 3, 4: // Ctrl-C, Ctrl-D
+					return
+				case '\r', '\n':
+					term.Write([]byte("\r\n"))
+					if _, err := conn.Write(append(input, lineEnding...)); err != nil {
+						return
+					}
+					input = input[:0]
+				case 127, '\b':
+					if len(input) > 0 {
+						input = input[:len(input)-1]
+						term.Write([]byte("\b \b"))
+					}
+				default:
+					input = append(input, c)
+					term.Write([]byte{c})
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-remoteClosed:
+		term.Write([]byte("\r\nconnection closed\r\n"))
+	case <-operatorDone:
+		term.Write([]byte("\r\n"))
+	}
+
+	return nil
+}
+
+func (n *netcat) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (n *netcat) Help(explain bool) string {
+	if explain {
+		return "Open a raw tcp or udp connection from a client, for banner grabs and poking at protocols"
+	}
+
+	return terminal.MakeHelpText(n.ValidArgs(),
+		"nc [OPTIONS] <client> <host:port>",
+		"In the console what you type is sent a line at a time. Run with ssh your.rssh.server nc ... stdin and stdout are the connection,",
+		"so it can be used as a ProxyCommand or piped to a local tool.",
+	)
+}
+
+func Netcat(log logger.Logger) *netcat {
+	return &netcat{
+		log: log,
+	}
+}
+
+func (n *netcat) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "nc fileserver 10.0.0.5:22", Description: "Grab the ssh banner of 10.0.0.5 from fileserver"},
+		{Command: "nc --crlf fileserver intranet.corp:80", Description: "Type an http request by hand"},
+		{Command: "nc --udp fileserver 10.0.0.1:53", Description: "Send udp datagrams to 10.0.0.1 port 53"},
+		{Command: "ssh -o ProxyCommand='ssh your.rssh.server -p 3232 nc fileserver %h:%p' 10.0.0.5", Description: "ssh to 10.0.0.5 through fileserver with your own ssh"},
+	}
+}
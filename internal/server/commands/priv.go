@@ -18,6 +18,7 @@ func (p *privilege) ValidArgs() map[string]string {
 func (p *privilege) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
 
 	fmt.Fprintf(tty, "%s\n", user.PrivilegeString())
+	fmt.Fprintf(tty, "quota: %s\n", user.Quota())
 
 	return nil
 }
@@ -28,11 +29,11 @@ func (p *privilege) Expect(line terminal.ParsedLine) []string {
 
 func (p *privilege) Help(explain bool) string {
 	if explain {
-		return "Privilege shows the current user privilege level."
+		return "Privilege shows the current user privilege level and quota."
 	}
 
 	return terminal.MakeHelpText(p.ValidArgs(),
 		"priv ",
-		"Print the currrent user privilege level.",
+		"Print the currrent user privilege level, and the limits on sessions, forwards and bandwidth set on your key.",
 	)
 }
@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"golang.org/x/crypto/ssh"
+)
+
+// Flags that set up the process exec and connect start on the client, each takes one value
+var processFlags = map[string]string{
+	"env": "Set an environment variable, NAME=VALUE, can be given more than once",
+	"cwd": "Working directory to run in",
+	"uid": "Run as this uid, needs the client to be running as root (not on windows)",
+	"gid": "Run as this gid, defaults to the primary group of --uid (not on windows)",
+}
+
+type processOptions struct {
+	env     []internal.EnvRequest
+	options internal.ProcessOptions
+}
+
+// parseProcessOptions reads the process flags that come before the first plain argument, so flags in the command itself are left alone,
+// and returns the arguments from that one on
+func parseProcessOptions(line terminal.ParsedLine) (p processOptions, rest []terminal.Argument, err error) {
+	values := map[int]bool{}
+
+	next := 0
+	for _, flag := range line.FlagsOrdered {
+		for next < len(line.Arguments) && line.Arguments[next].Start() < flag.Start() {
+			if !values[line.Arguments[next].Start()] {
+				return p, line.Arguments[next:], nil
+			}
+			next++
+		}
+
+		if _, ok := processFlags[flag.Value()]; !ok {
+			continue
+		}
+
+		if len(flag.Args) == 0 {
+			return p, nil, failure.New(failure.InvalidArgument, "--%s needs a value", flag.Value())
+		}
+
+		arg := flag.Args[0]
+		values[arg.Start()] = true
+
+		value := arg.Value()
+		switch flag.Value() {
+		case "env":
+			name, v, ok := strings.Cut(value, "=")
+			if !ok || name == "" {
+				return p, nil, failure.New(failure.InvalidArgument, "--env expects NAME=VALUE, not %q", value)
+			}
+			p.env = append(p.env, internal.EnvRequest{Name: name, Value: v})
+		case "cwd":
+			p.options.Dir = value
+		case "uid", "gid":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return p, nil, failure.New(failure.InvalidArgument, "--%s expects a number, not %q", flag.Value(), value)
+			}
+
+			if flag.Value() == "uid" {
+				p.options.SetUid, p.options.Uid = true, uint32(id)
+			} else {
+				p.options.SetGid, p.options.Gid = true, uint32(id)
+			}
+		}
+	}
+
+	for ; next < len(line.Arguments); next++ {
+		if !values[line.Arguments[next].Start()] {
+			return p, line.Arguments[next:], nil
+		}
+	}
+
+	return p, nil, nil
+}
+
+// send asks the client to start the session's process with these options, before exec or shell
+func (p *processOptions) send(channel ssh.Channel) error {
+	for _, env := range p.env {
+		ok, err := channel.SendRequest("env", true, ssh.Marshal(&env))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return failure.New(failure.ClientRefused, "client refused to set %s, it may be too old to support --env", env.Name)
+		}
+	}
+
+	if p.options == (internal.ProcessOptions{}) {
+		return nil
+	}
+
+	ok, err := channel.SendRequest("process-options@rssh", true, ssh.Marshal(&p.options))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return failure.New(failure.ClientRefused, "client refused --cwd, --uid or --gid, it may be too old to support them")
+	}
+
+	return nil
+}
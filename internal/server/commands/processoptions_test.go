@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+)
+
+func TestParseProcessOptions(t *testing.T) {
+	line := terminal.ParseLine("exec --env A=1=2 --cwd /tmp --uid 33 -y web* ls --cwd x", 0)
+
+	process, rest, err := parseProcessOptions(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(process.env) != 1 || process.env[0].Name != "A" || process.env[0].Value != "1=2" {
+		t.Errorf("unexpected env: %+v", process.env)
+	}
+
+	// The --cwd after the filter belongs to the command
+	if process.options.Dir != "/tmp" || !process.options.SetUid || process.options.Uid != 33 || process.options.SetGid {
+		t.Errorf("unexpected options: %+v", process.options)
+	}
+
+	if len(rest) == 0 || rest[0].Value() != "web*" {
+		t.Fatalf("expected the filter to be first of the remaining arguments, got %+v", rest)
+	}
+
+	if command := line.RawLine[rest[0].End():]; command != " ls --cwd x" {
+		t.Errorf("unexpected command: %q", command)
+	}
+
+	if _, _, err := parseProcessOptions(terminal.ParseLine("exec --uid root * id", 0)); err == nil {
+		t.Error("expected a non numeric uid to be rejected")
+	}
+}
@@ -0,0 +1,243 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+var qosClasses = []string{"high", "normal", "bulk"}
+
+type qosRule struct {
+	Match string
+	Class string
+}
+
+type autoQoSEntry struct {
+	ObserverID string
+	Criteria   string
+	Class      string
+}
+
+var autoQoSRules = map[string]autoQoSEntry{}
+
+type qos struct {
+	log logger.Logger
+}
+
+func (q *qos) ValidArgs() map[string]string {
+	r := map[string]string{
+		"l":      "List the rules on clients, or with --auto the rules applied to new clients",
+		"set":    "Set the class of forwards to an address, host:port, :port (any host) or host (any port). Requires --class",
+		"class":  "Class to set, one of [" + strings.Join(qosClasses, ", ") + "]",
+		"remove": "Remove the rule for an address",
+		"auto":   "Also apply --set or --remove to clients that connect later",
+	}
+
+	addDuplicateFlags("Clients to change, takes a pattern, e.g -c *, --client your.hostname.here", r, "client", "c")
+
+	return r
+}
+
+func sendQoSRule(sc ssh.Conn, rule qosRule) error {
+	ok, reply, err := sc.SendRequest("qos-set@rssh", true, ssh.Marshal(&rule))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if len(reply) == 0 {
+			return failure.New(failure.ClientRefused, "client does not support qos")
+		}
+		return failure.New(failure.ClientRefused, "%s", string(reply))
+	}
+
+	return nil
+}
+
+func (q *qos) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	auto := line.IsSet("auto")
+
+	if line.IsSet("l") && auto {
+		autoLck.Lock()
+		defer autoLck.Unlock()
+
+		matches := []string{}
+		for match := range autoQoSRules {
+			matches = append(matches, match)
+		}
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			fmt.Fprintf(tty, "%s %s %s\n", autoQoSRules[match].Criteria, match, autoQoSRules[match].Class)
+		}
+		return nil
+	}
+
+	specifier, err := line.GetArgString("c")
+	if err != nil {
+		specifier, err = line.GetArgString("client")
+		if err != nil {
+			return failure.New(failure.InvalidArgument, "no clients specified, use -c <pattern>")
+		}
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) == 0 && !auto {
+		return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
+	}
+
+	if line.IsSet("l") {
+		for id, sc := range foundClients {
+			ok, payload, _ := sc.SendRequest("query-qos@rssh", true, nil)
+			if !ok {
+				fmt.Fprintf(tty, "%s does not support qos\n", id)
+				continue
+			}
+
+			var rules struct {
+				Rules []string
+			}
+			if err := ssh.Unmarshal(payload, &rules); err != nil {
+				fmt.Fprintf(tty, "%s sent an incompatible message: %s\n", id, err)
+				continue
+			}
+
+			fmt.Fprintf(tty, "%s (%s %s):\n", id, users.NormaliseHostname(sc.User()), sc.RemoteAddr().String())
+			for _, rule := range rules.Rules {
+				fmt.Fprintf(tty, "\t%s\n", rule)
+			}
+		}
+		return nil
+	}
+
+	var rule qosRule
+	if match, err := line.GetArgString("set"); err == nil {
+		rule.Match = match
+		rule.Class, err = line.GetArgString("class")
+		if err != nil {
+			return failure.New(failure.InvalidArgument, "--set requires --class")
+		}
+
+		rule.Class = strings.ToLower(rule.Class)
+		valid := false
+		for _, c := range qosClasses {
+			valid = valid || c == rule.Class
+		}
+		if !valid {
+			return failure.New(failure.InvalidArgument, "unknown class %q, must be one of %s", rule.Class, strings.Join(qosClasses, ", "))
+		}
+	} else if match, err := line.GetArgString("remove"); err == nil {
+		// An empty class removes the rule
+		rule.Match = match
+	} else {
+		return failure.New(failure.InvalidArgument, "no actionable argument supplied, please add --set, --remove or -l (list)")
+	}
+
+	unlock, err := lockClients(clientIDs(foundClients), "qos", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied := len(foundClients)
+	for id, sc := range foundClients {
+		if err := sendQoSRule(sc, rule); err != nil {
+			applied--
+			fmt.Fprintf(tty, "failed to change qos on %s: %s\n", id, err)
+		}
+	}
+
+	fmt.Fprintf(tty, "changed %s on %d clients (total %d)\n", rule.Match, applied, len(foundClients))
+
+	if !auto {
+		return nil
+	}
+
+	autoLck.Lock()
+	defer autoLck.Unlock()
+
+	if existing, ok := autoQoSRules[rule.Match]; ok {
+		observers.ConnectionState.Deregister(existing.ObserverID)
+		delete(autoQoSRules, rule.Match)
+	}
+
+	if rule.Class == "" {
+		return nil
+	}
+
+	entry := autoQoSEntry{
+		Criteria: specifier,
+		Class:    rule.Class,
+	}
+
+	entry.ObserverID = observers.ConnectionState.Register(func(c observers.ClientState) {
+		if !user.Matches(specifier, c.ID, c.IP) || c.Status != "connected" {
+			return
+		}
+
+		client, err := user.GetClient(c.ID)
+		if err != nil {
+			return
+		}
+
+		if err := sendQoSRule(client, rule); err != nil {
+			q.log.Warning("failed to set qos rule %s on client %s: %s", rule.Match, c.ID, err)
+		}
+	})
+
+	autoQoSRules[rule.Match] = entry
+
+	return nil
+}
+
+func (q *qos) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (q *qos) Help(explain bool) string {
+	if explain {
+		return "Prioritise forwards so busy transfers dont starve interactive ones"
+	}
+
+	return terminal.MakeHelpText(q.ValidArgs(),
+		"qos [OPTIONS] -c <pattern>",
+		"Forwards are matched on their destination (ssh -L and -D) or listening address (ssh -R and listen --client).",
+		"When a client is busy, what it sends to the server is shared between classes 16:4:1 (high:normal:bulk). Forwards without a rule are normal.",
+	)
+}
+
+func QoS(log logger.Logger) *qos {
+	return &qos{
+		log: log,
+	}
+}
+
+func (q *qos) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "qos -c fileserver --set :3389 --class high", Description: "Keep RDP through fileserver responsive"},
+		{Command: "qos -c * --auto --set 10.0.0.5:873 --class bulk", Description: "Treat rsync to 10.0.0.5 as bulk on every client, including new ones"},
+		{Command: "qos -c fileserver -l", Description: "Show the rules on fileserver"},
+		{Command: "qos -c fileserver --remove :3389", Description: "Go back to normal priority for RDP"},
+	}
+}
@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/reaper"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type reap struct {
+}
+
+func (r *reap) ValidArgs() map[string]string {
+	return map[string]string{
+		"now":     "Reclaim dead forwards, channels and stale listeners now rather than waiting for the next sweep",
+		"dry-run": "Show what would be reclaimed without closing anything",
+	}
+}
+
+func (r *reap) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if !line.IsSet("now") && !line.IsSet("dry-run") {
+		history := reaper.History()
+		if len(history) == 0 {
+			fmt.Fprintf(tty, "Nothing has been reclaimed, %d forwards and channels are being watched\n", reaper.Tracked())
+			return nil
+		}
+
+		return printReclaimed(tty, "Reclaimed", history)
+	}
+
+	dryRun := line.IsSet("dry-run")
+	if !dryRun && user.Privilege() != users.AdminPermissions {
+		return failure.New(failure.PermissionDenied, "only admins can reclaim now, use --dry-run to see what would be")
+	}
+
+	reclaimed, err := reaper.Sweep(dryRun)
+	if err != nil {
+		fmt.Fprintf(tty, "unable to check saved listeners: %s\n", err)
+	}
+
+	if len(reclaimed) == 0 {
+		fmt.Fprintln(tty, "Nothing to reclaim")
+		return nil
+	}
+
+	title := "Reclaimed"
+	if dryRun {
+		title = "Would reclaim"
+	}
+	return printReclaimed(tty, title, reclaimed)
+}
+
+func printReclaimed(tty io.ReadWriter, title string, reclaimed []observers.Reclaim) error {
+	t, err := table.NewTable(title, "When", "Kind", "What", "Owner", "Age", "Reason")
+	if err != nil {
+		return err
+	}
+
+	for _, r := range reclaimed {
+		if err := t.AddValues(r.Timestamp.Format("2006/01/02 15:04:05"), r.Kind, r.What, r.Owner, r.Age.Round(time.Second).String(), r.Reason); err != nil {
+			return err
+		}
+	}
+
+	t.Fprint(tty)
+	return nil
+}
+
+func (r *reap) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (r *reap) Help(explain bool) string {
+	if explain {
+		return "Show or reclaim forwards, channels and listeners nothing can use any more"
+	}
+
+	return terminal.MakeHelpText(r.ValidArgs(),
+		"reap [OPTIONS]",
+		"The server sweeps every --reap-interval (default 1m) for forwards whose client or operator has gone, channels left half closed by a peer that never finished closing them, and listeners saved for clients not seen in --listener-ttl (default 30 days).",
+		"Without options this shows what recent sweeps reclaimed. Reclaims are also logged and sent to webhooks and the event bus.",
+	)
+}
+
+func (r *reap) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "reap", Description: "Show what has been reclaimed"},
+		{Command: "reap --dry-run", Description: "See what the next sweep would reclaim"},
+		{Command: "reap --now", Description: "Reclaim it now"},
+	}
+}
@@ -0,0 +1,144 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/pivot"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+type socks struct {
+	log     logger.Logger
+	session string
+}
+
+func (s *socks) ValidArgs() map[string]string {
+	r := map[string]string{
+		"l":   "Show which client forwards on this connection go out through",
+		"off": "Go back to treating forward destinations as clients to jump to",
+	}
+
+	addDuplicateFlags("Client to send forwards out through, must match exactly one, e.g -c fileserver", r, "client", "c")
+
+	return r
+}
+
+func (s *socks) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	sess, err := user.Session(s.session)
+	if err != nil {
+		return err
+	}
+
+	if line.IsSet("off") {
+		sess.SetForwardRoute(nil)
+		fmt.Fprintln(tty, "forwards on this connection jump to clients again")
+		return nil
+	}
+
+	specifier, err := line.GetArgString("c")
+	if err != nil {
+		specifier, err = line.GetArgString("client")
+	}
+
+	if err != nil || line.IsSet("l") {
+		if route := sess.ForwardRoute(); route != nil {
+			fmt.Fprintf(tty, "forwards on this connection go out through %s\n", route.ID)
+		} else {
+			fmt.Fprintln(tty, "forwards on this connection jump to clients")
+		}
+		return nil
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) == 0 {
+		return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
+	}
+
+	if len(foundClients) > 1 {
+		return failure.New(failure.InvalidArgument, "%q matches multiple clients please choose a more specific identifier", specifier).With("client", specifier)
+	}
+
+	var (
+		id     string
+		target *ssh.ServerConn
+	)
+	for k := range foundClients {
+		id = k
+		target = foundClients[k]
+		break
+	}
+
+	route, err := pivot.Open(id, target, nil)
+	if err != nil {
+		return failure.Wrap(failure.TransportUnavailable, err)
+	}
+
+	sess.SetForwardRoute(route)
+
+	s.log.Info("%s is sending forwards out through %s", user.Username(), id)
+
+	fmt.Fprintf(tty, "forwards on this connection (ssh -D, -L and -R) now go out through %s\n", id)
+
+	if _, ok := tty.(*terminal.Terminal); ok {
+		return nil
+	}
+
+	// Run with ssh -D 1080 catcher socks -c <client>, so hold the connection open until the operator is done with it
+	fmt.Fprintln(tty, "press ctrl+c to stop")
+	route.Wait()
+
+	if sess.ForwardRoute() == route {
+		sess.SetForwardRoute(nil)
+	}
+
+	return nil
+}
+
+func (s *socks) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (s *socks) Help(explain bool) string {
+	if explain {
+		return "Send this connection's forwards out through a client, so socks listeners can be on your own machine"
+	}
+
+	return terminal.MakeHelpText(s.ValidArgs(),
+		"socks -c <client>",
+		"By default ssh -D and -L treat the destination as a client to jump to. After socks -c, they are dialled from the chosen client instead,",
+		"so ssh -D 1080 opens a socks proxy on your machine that comes out inside the client's network without opening a port on the server.",
+		"ssh -R with no bind address is opened on the chosen client too. The route lasts until --off or you disconnect.",
+	)
+}
+
+func Socks(session string, log logger.Logger) *socks {
+	return &socks{
+		log:     log,
+		session: session,
+	}
+}
+
+func (s *socks) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "ssh -D 1080 catcher socks -c fileserver", Description: "Socks proxy on port 1080 of your machine, coming out of fileserver"},
+		{Command: "ssh -R fileserver:9000 catcher", Description: "Reverse forward from port 9000 on fileserver's loopback back to you, no socks command needed"},
+		{Command: "socks -l", Description: "Show where this connection's forwards go"},
+	}
+}
@@ -0,0 +1,291 @@
+package commands
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSpeedTestDuration = 10 * time.Second
+	maxSpeedTestDuration     = 60 * time.Second
+
+	idleLatencySamples = 5
+	loadedPingInterval = 250 * time.Millisecond
+)
+
+type speedtest struct {
+}
+
+func (s *speedtest) ValidArgs() map[string]string {
+	return map[string]string{
+		"duration": "How long to test each direction for, e.g 30s (default 10s, at most 60s)",
+	}
+}
+
+type speedResult struct {
+	direction string
+	bytes     int64
+	elapsed   time.Duration
+	latency   []time.Duration
+}
+
+func (r speedResult) throughput() string {
+	seconds := r.elapsed.Seconds()
+	if seconds <= 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.2f Mbit/s", float64(r.bytes)*8/seconds/1e6)
+}
+
+func median(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return "-"
+	}
+
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+
+	return sorted[len(sorted)/2].Round(100 * time.Microsecond).String()
+}
+
+// ping is a global request round trip, clients refuse ones they dont know which is all we need
+func ping(sc ssh.Conn) (time.Duration, error) {
+	start := time.Now()
+	_, _, err := sc.SendRequest("ping@rssh", true, nil)
+	return time.Since(start), err
+}
+
+// pingUntil samples latency while a transfer is running
+func pingUntil(sc ssh.Conn, stop <-chan struct{}) <-chan []time.Duration {
+	result := make(chan []time.Duration, 1)
+
+	go func() {
+		var samples []time.Duration
+		defer func() { result <- samples }()
+
+		ticker := time.NewTicker(loadedPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				rtt, err := ping(sc)
+				if err != nil {
+					return
+				}
+				samples = append(samples, rtt)
+			}
+		}
+	}()
+
+	return result
+}
+
+func openSpeedTest(sc ssh.Conn, direction string, duration time.Duration) (ssh.Channel, error) {
+	channel, requests, err := sc.OpenChannel("speedtest@rssh", ssh.Marshal(internal.SpeedTestRequest{
+		Direction: direction,
+		Seconds:   uint32(duration / time.Second),
+	}))
+	if err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok && openErr.Reason == ssh.UnknownChannelType {
+			return nil, failure.New(failure.ClientRefused, "client does not support speedtest")
+		}
+		return nil, failure.New(failure.ClientRefused, "client refused speedtest: %s", err)
+	}
+	go ssh.DiscardRequests(requests)
+
+	return channel, nil
+}
+
+func toClient(sc ssh.Conn, duration time.Duration) (result speedResult, err error) {
+	result.direction = "server -> client"
+
+	channel, err := openSpeedTest(sc, internal.SpeedTestToClient, duration)
+	if err != nil {
+		return result, err
+	}
+	defer channel.Close()
+
+	stop := make(chan struct{})
+	latency := pingUntil(sc, stop)
+
+	start := time.Now()
+	_, err = internal.SpeedTestSend(channel, duration)
+	channel.CloseWrite()
+
+	// The client says how much arrived once it has read everything, that is when the transfer is done
+	var received [8]byte
+	if err == nil {
+		_, err = io.ReadFull(channel, received[:])
+	}
+	result.elapsed = time.Since(start)
+
+	close(stop)
+	result.latency = <-latency
+
+	if err != nil {
+		return result, failure.New(failure.Aborted, "server -> client test failed: %s", err)
+	}
+	result.bytes = int64(binary.BigEndian.Uint64(received[:]))
+
+	return result, nil
+}
+
+func fromClient(sc ssh.Conn, duration time.Duration) (result speedResult, err error) {
+	result.direction = "client -> server"
+
+	// The client starts sending as soon as it accepts, so the clock has to start before that
+	start := time.Now()
+	channel, err := openSpeedTest(sc, internal.SpeedTestFromClient, duration)
+	if err != nil {
+		return result, err
+	}
+	defer channel.Close()
+
+	stop := make(chan struct{})
+	latency := pingUntil(sc, stop)
+
+	result.bytes, err = io.Copy(io.Discard, channel)
+	result.elapsed = time.Since(start)
+
+	close(stop)
+	result.latency = <-latency
+
+	if err != nil {
+		return result, failure.New(failure.Aborted, "client -> server test failed: %s", err)
+	}
+
+	return result, nil
+}
+
+func (s *speedtest) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	duration := defaultSpeedTestDuration
+
+	var durationValue string
+	if d, err := line.GetArgString("duration"); err == nil {
+		durationValue = d
+		duration, err = time.ParseDuration(d)
+		if err != nil {
+			return failure.New(failure.InvalidArgument, "invalid duration %q: %s", d, err)
+		}
+
+		if duration < time.Second || duration > maxSpeedTestDuration {
+			return failure.New(failure.InvalidArgument, "duration must be between 1s and %s", maxSpeedTestDuration)
+		}
+	}
+
+	var client string
+	for _, arg := range line.Arguments {
+		if durationValue != "" && arg.Value() == durationValue {
+			durationValue = ""
+			continue
+		}
+		client = arg.Value()
+		break
+	}
+
+	if client == "" {
+		return failure.New(failure.InvalidArgument, "%s", s.Help(false))
+	}
+
+	foundClients, err := user.SearchClients(client)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) == 0 {
+		return failure.New(failure.ClientNotFound, "No clients matched %q", client).With("client", client)
+	}
+
+	if len(foundClients) > 1 {
+		return failure.New(failure.InvalidArgument, "%q matches multiple clients please choose a more specific identifier", client)
+	}
+
+	var (
+		target   *ssh.ServerConn
+		targetId string
+	)
+	for k := range foundClients {
+		target = foundClients[k]
+		targetId = k
+	}
+
+	unlock, err := lockClient(targetId, "speedtest", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := transportPath(*target)
+	if path == "" {
+		path = "direct"
+	}
+
+	var idle []time.Duration
+	for range idleLatencySamples {
+		rtt, err := ping(target)
+		if err != nil {
+			return failure.New(failure.Aborted, "client did not answer: %s", err)
+		}
+		idle = append(idle, rtt)
+	}
+
+	fmt.Fprintf(tty, "Testing %s over %s (%s), idle latency %s\n", targetId, target.RemoteAddr(), path, median(idle))
+
+	results := []speedResult{}
+	for _, test := range []func(ssh.Conn, time.Duration) (speedResult, error){toClient, fromClient} {
+		result, err := test(target, duration)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+
+	t, _ := table.NewTable("Speedtest", "Direction", "Throughput", "Transferred", "Time", "Latency under load")
+	for _, r := range results {
+		t.AddValues(r.direction, r.throughput(), humanBytes(uint64(r.bytes)), r.elapsed.Round(time.Millisecond).String(), median(r.latency))
+	}
+	t.Fprint(tty)
+
+	return nil
+}
+
+func (s *speedtest) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (s *speedtest) Help(explain bool) string {
+	if explain {
+		return "Measure throughput and latency between the server and a client"
+	}
+
+	return terminal.MakeHelpText(s.ValidArgs(),
+		"speedtest [--duration 10s] <remote_id>",
+		"Sends random data to the client, then has the client send random data back, each for the duration so compression doesnt flatter the result.",
+		"Latency is measured idle and during each transfer. Clients using the ts relay are measured over the path they are currently on, shown as relay or direct.",
+	)
+}
+
+func (s *speedtest) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "speedtest fileserver", Description: "Test both directions for 10 seconds each before copying a large file"},
+		{Command: "speedtest --duration 30s fileserver", Description: "Test for longer on a link with bursty throughput"},
+	}
+}
@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/client/handlers"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// speedTestPair connects a server to a client that runs the speedtest handler, or rejects it when supported is false
+func speedTestPair(t *testing.T, supported bool) ssh.Conn {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// net.Pipe is unbuffered and both sides send their version at once, so use a real socket
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverSide, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, chans, reqs, err := ssh.NewClientConn(clientSide, "", &ssh.ClientConfig{
+			User:            "client",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go ssh.DiscardRequests(reqs)
+
+		for newChannel := range chans {
+			if !supported {
+				newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+				continue
+			}
+			go handlers.SpeedTest(newChannel, logger.NewLog("test"))
+		}
+	}()
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	conn, _, reqs, err := ssh.NewServerConn(serverSide, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(reqs)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestSpeedTestBothDirections(t *testing.T) {
+	conn := speedTestPair(t, true)
+
+	for _, test := range []func(ssh.Conn, time.Duration) (speedResult, error){toClient, fromClient} {
+		result, err := test(conn, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.bytes == 0 {
+			t.Errorf("%s: nothing was transferred", result.direction)
+		}
+
+		if result.elapsed < time.Second {
+			t.Errorf("%s: finished after %s, before the duration", result.direction, result.elapsed)
+		}
+
+		if len(result.latency) == 0 {
+			t.Errorf("%s: no latency samples under load", result.direction)
+		}
+	}
+}
+
+func TestSpeedTestUnsupportedClient(t *testing.T) {
+	conn := speedTestPair(t, false)
+
+	if _, err := toClient(conn, time.Second); err == nil || err.Error() != "client does not support speedtest" {
+		t.Fatalf("expected an unsupported client error, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type stats struct {
+}
+
+func (s *stats) ValidArgs() map[string]string {
+	return map[string]string{}
+}
+
+func (s *stats) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	tlsStats := multiplexer.ServerMultiplexer.TLSStats()
+
+	resumptionRate := 0.0
+	if tlsStats.Handshakes > 0 {
+		resumptionRate = float64(tlsStats.Resumed) / float64(tlsStats.Handshakes) * 100
+	}
+
+	t, _ := table.NewTable("Server Statistics", "Metric", "Value")
+	t.AddValues("TLS handshakes", fmt.Sprintf("%d", tlsStats.Handshakes))
+	t.AddValues("TLS sessions resumed", fmt.Sprintf("%d (%.1f%%)", tlsStats.Resumed, resumptionRate))
+
+	t.Fprint(tty)
+
+	return nil
+}
+
+func (s *stats) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (s *stats) Help(explain bool) string {
+	const description = "Show server transport statistics"
+
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(s.ValidArgs(),
+		"stats",
+		description,
+		"Counters are since the server started",
+	)
+}
@@ -0,0 +1,216 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/dirsync"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
+)
+
+var syncValueFlags = map[string]bool{
+	"exclude":  true,
+	"parallel": true,
+}
+
+type syncCommand struct {
+	datadir string
+}
+
+func (s *syncCommand) ValidArgs() map[string]string {
+	return map[string]string{
+		"exclude":  "Leave out files and directories matching this pattern, e.g '*.log'. Matched against names and paths, can be given multiple times",
+		"parallel": fmt.Sprintf("How many files and chunks to move at once (default %d, at most %d)", dirsync.DefaultParallel, dirsync.MaxParallel),
+	}
+}
+
+// serverPath is where a path on the server is. Relative paths are in the operator's own sync directory, kept under their campaign if they are
+// working in one, and only admins may give absolute ones
+func (s *syncCommand) serverPath(user *users.User, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		if user.Privilege() != users.AdminPermissions {
+			return "", failure.New(failure.PermissionDenied, "only admins can sync outside their sync directory, use a relative path")
+		}
+		return filepath.Clean(p), nil
+	}
+
+	base := filepath.Join(s.datadir, "sync", user.Username())
+	if campaign := user.Campaign(); campaign != "" {
+		base = filepath.Join(s.datadir, "campaigns", campaign, "sync", user.Username())
+	}
+	full := filepath.Join(base, p)
+
+	rel, err := filepath.Rel(base, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", failure.New(failure.InvalidArgument, "%q is outside your sync directory", p)
+	}
+	return full, nil
+}
+
+func openSync(sc ssh.Conn, request dirsync.Request) func() (io.ReadWriteCloser, error) {
+	extraData, _ := json.Marshal(request)
+
+	return func() (io.ReadWriteCloser, error) {
+		channel, requests, err := sc.OpenChannel("sync@rssh", extraData)
+		if err != nil {
+			if openErr, ok := err.(*ssh.OpenChannelError); ok && openErr.Reason == ssh.UnknownChannelType {
+				return nil, failure.New(failure.ClientRefused, "client does not support sync")
+			}
+			return nil, failure.New(failure.ClientRefused, "client refused sync: %s", err)
+		}
+		go ssh.DiscardRequests(requests)
+
+		return channel, nil
+	}
+}
+
+func (s *syncCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	values, positional := splitValueFlags(line, syncValueFlags)
+	if len(positional) != 4 || (positional[0] != "push" && positional[0] != "pull") {
+		return failure.New(failure.InvalidArgument, "%s", s.Help(false))
+	}
+	direction, specifier, from, to := positional[0], positional[1], positional[2], positional[3]
+
+	exclude := values["exclude"]
+	if err := dirsync.CheckPatterns(exclude); err != nil {
+		return failure.New(failure.InvalidArgument, "%s", err)
+	}
+
+	parallel := dirsync.DefaultParallel
+	if p, ok := firstValue(values, "parallel"); ok {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > dirsync.MaxParallel {
+			return failure.New(failure.InvalidArgument, "--parallel must be between 1 and %d", dirsync.MaxParallel)
+		}
+		parallel = n
+	}
+
+	localPath, remotePath := from, to
+	if direction == "pull" {
+		localPath, remotePath = to, from
+	}
+
+	localPath, err := s.serverPath(user, localPath)
+	if err != nil {
+		return err
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) == 0 {
+		return failure.New(failure.ClientNotFound, "No clients matched %q", specifier).With("client", specifier)
+	}
+
+	if len(foundClients) > 1 {
+		return failure.New(failure.InvalidArgument, "%q matches multiple clients please choose a more specific identifier", specifier).With("client", specifier)
+	}
+
+	var (
+		target   *ssh.ServerConn
+		targetId string
+	)
+	for k := range foundClients {
+		target = foundClients[k]
+		targetId = k
+	}
+
+	unlock, err := lockClient(targetId, "sync", user.Username(), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	remote, err := dirsync.NewRemote(openSync(target, dirsync.Request{Root: remotePath, Exclude: exclude}), parallel)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	var src, dst dirsync.Tree = dirsync.NewLocal(localPath, exclude), remote
+	if direction == "pull" {
+		src, dst = remote, dirsync.NewLocal(localPath, exclude)
+	}
+
+	progress := func(path string, err error) {
+		if path == "" {
+			path = "."
+		}
+		if err != nil {
+			fmt.Fprintf(tty, "failed %s: %s\n", path, err)
+			return
+		}
+		fmt.Fprintf(tty, "%s\n", path)
+	}
+
+	start := time.Now()
+	stats, err := dirsync.Sync(src, dst, parallel, progress)
+	if err != nil {
+		return failure.New(failure.Aborted, "sync failed: %s", err)
+	}
+
+	t, _ := table.NewTable(fmt.Sprintf("Sync %s %s", direction, targetId), "Files", "Unchanged", "Updated", "Failed", "Sent", "Reused", "Time")
+	t.AddValues(
+		strconv.Itoa(stats.Files),
+		strconv.Itoa(stats.Unchanged),
+		strconv.Itoa(stats.Updated),
+		strconv.Itoa(stats.Failed),
+		humanBytes(uint64(stats.BytesSent)),
+		humanBytes(uint64(stats.BytesReused)),
+		time.Since(start).Round(time.Millisecond).String(),
+	)
+	t.Fprint(tty)
+
+	if stats.Failed > 0 {
+		return failure.New(failure.Aborted, "%d of %d changed files failed, run the same sync again to retry them", stats.Failed, stats.Files-stats.Unchanged)
+	}
+
+	return nil
+}
+
+func (s *syncCommand) Expect(line terminal.ParsedLine) []string {
+	// The client comes after push or pull
+	if n := len(line.Arguments); n == 1 || n == 2 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (s *syncCommand) Help(explain bool) string {
+	if explain {
+		return "Copy directory trees to or from a client, sending only what changed"
+	}
+
+	return terminal.MakeHelpText(s.ValidArgs(),
+		"sync push <remote_id> <server path> <client path> [--exclude pattern]... [--parallel 4]",
+		"sync pull <remote_id> <client path> <server path> [--exclude pattern]... [--parallel 4]",
+		"Only files whose size or modification time differ are looked at, and only the 1MiB chunks of them that differ are sent. Modes and times are kept.",
+		"Files are written beside their destination and moved into place once complete, running a sync that was cut off again carries on where it stopped.",
+		"Files only at the destination are left alone, symbolic links are skipped.",
+		"Server paths are relative to your own directory in <datadir>/sync, only admins may give absolute paths.",
+	)
+}
+
+func Sync(datadir string) *syncCommand {
+	return &syncCommand{datadir: datadir}
+}
+
+func (s *syncCommand) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "sync push fileserver kit /tmp/.kit", Description: "Put your tool kit on a client, running it again only sends what changed"},
+		{Command: "sync pull fileserver /var/www loot/www --exclude '*.log' --exclude cache", Description: "Pull a web root without logs or the cache directory"},
+		{Command: "sync push fileserver kit C:\\Users\\Public\\kit --parallel 8", Description: "Push to a windows client over a fast link with more transfers at once"},
+	}
+}
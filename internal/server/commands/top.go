@@ -0,0 +1,274 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type top struct {
+}
+
+type topRow struct {
+	name, description string
+
+	rxRate, txRate, opsRate float64
+	active                  int64
+}
+
+func (t *top) ValidArgs() map[string]string {
+	return map[string]string{
+		"n": "Number of clients and forwards to show (default 10)",
+		"i": "Refresh interval in seconds (default 2)",
+		"s": "Sort by, one of [throughput, sessions, ops] (default throughput)",
+	}
+}
+
+func humanRate(bytesPerSecond float64) string {
+	units := []string{"B/s", "KB/s", "MB/s", "GB/s"}
+
+	i := 0
+	for bytesPerSecond >= 1024 && i < len(units)-1 {
+		bytesPerSecond /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", bytesPerSecond, units[i])
+}
+
+// rates works out per second rates between two snapshots, anything the user cant see is dropped
+func rates(previous, current []traffic.Sample, elapsed time.Duration, visible func(name string) (string, bool)) (rows []topRow) {
+	last := map[string]traffic.Sample{}
+	for _, s := range previous {
+		last[s.Name] = s
+	}
+
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	for _, s := range current {
+		description, ok := visible(s.Name)
+		if !ok {
+			continue
+		}
+
+		// Counters only grow, if theres no previous sample this is the first time weve seen it so there is no rate yet
+		p, ok := last[s.Name]
+		if !ok {
+			p = s
+		}
+
+		rows = append(rows, topRow{
+			name:        s.Name,
+			description: description,
+			rxRate:      float64(s.Rx-p.Rx) / seconds,
+			txRate:      float64(s.Tx-p.Tx) / seconds,
+			opsRate:     float64(s.Ops-p.Ops) / seconds,
+			active:      s.Active,
+		})
+	}
+
+	return rows
+}
+
+func sortRows(rows []topRow, by string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		switch by {
+		case "sessions":
+			if rows[i].active != rows[j].active {
+				return rows[i].active > rows[j].active
+			}
+		case "ops":
+			if rows[i].opsRate != rows[j].opsRate {
+				return rows[i].opsRate > rows[j].opsRate
+			}
+		}
+
+		return rows[i].rxRate+rows[i].txRate > rows[j].rxRate+rows[j].txRate
+	})
+}
+
+func (t *top) render(tty io.Writer, clients, forwards []topRow, limit int, lineEnding string) {
+	clientTable, _ := table.NewTable("Clients", "ID", "Host", "Rx", "Tx", "Ops/s", "Sessions")
+	for i, r := range clients {
+		if i >= limit {
+			break
+		}
+		clientTable.AddValues(r.name, r.description, humanRate(r.rxRate), humanRate(r.txRate), fmt.Sprintf("%.0f", r.opsRate), fmt.Sprintf("%d", r.active))
+	}
+
+	forwardTable, _ := table.NewTable("Forwards", "Client", "Address", "Rx", "Tx", "Ops/s", "Connections")
+	for i, r := range forwards {
+		if i >= limit {
+			break
+		}
+		forwardTable.AddValues(r.description, strings.TrimPrefix(r.name, r.description+" "), humanRate(r.rxRate), humanRate(r.txRate), fmt.Sprintf("%.0f", r.opsRate), fmt.Sprintf("%d", r.active))
+	}
+
+	for _, line := range clientTable.OutputStrings() {
+		fmt.Fprint(tty, line+lineEnding)
+	}
+
+	fmt.Fprint(tty, lineEnding)
+
+	for _, line := range forwardTable.OutputStrings() {
+		fmt.Fprint(tty, line+lineEnding)
+	}
+}
+
+func (t *top) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	limit := 10
+	if n, err := line.GetArgString("n"); err == nil {
+		limit, err = strconv.Atoi(n)
+		if err != nil || limit < 1 {
+			return failure.New(failure.InvalidArgument, "invalid number of rows %q", n)
+		}
+	}
+
+	interval := 2 * time.Second
+	if i, err := line.GetArgString("i"); err == nil {
+		seconds, err := strconv.Atoi(i)
+		if err != nil || seconds < 1 {
+			return failure.New(failure.InvalidArgument, "invalid refresh interval %q", i)
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	sortBy, err := line.GetArgString("s")
+	if err != nil {
+		sortBy = "throughput"
+	}
+
+	switch sortBy {
+	case "throughput", "sessions", "ops":
+	default:
+		return failure.New(failure.InvalidArgument, "cannot sort by %q, must be one of [throughput, sessions, ops]", sortBy)
+	}
+
+	sample := func(previousClients, previousForwards []traffic.Sample, elapsed time.Duration) (clientSamples, forwardSamples []traffic.Sample, clients, forwards []topRow, err error) {
+		// Only show what this user is allowed to see
+		visibleClients, err := user.SearchClients("")
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		clientSamples, forwardSamples = traffic.Snapshot()
+
+		clients = rates(previousClients, clientSamples, elapsed, func(name string) (string, bool) {
+			conn, ok := visibleClients[name]
+			if !ok {
+				return "", false
+			}
+			return users.NormaliseHostname(conn.User()), true
+		})
+
+		forwards = rates(previousForwards, forwardSamples, elapsed, func(name string) (string, bool) {
+			id, _, _ := strings.Cut(name, " ")
+			_, ok := visibleClients[id]
+			return id, ok
+		})
+
+		sortRows(clients, sortBy)
+		sortRows(forwards, sortBy)
+
+		return clientSamples, forwardSamples, clients, forwards, nil
+	}
+
+	previousClients, previousForwards, _, _, err := sample(nil, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	term, isTerm := tty.(*terminal.Terminal)
+	if !isTerm {
+		// Cant refresh, so take a single measurement
+		time.Sleep(interval)
+		_, _, clients, forwards, err := sample(previousClients, previousForwards, interval)
+		if err != nil {
+			return err
+		}
+
+		t.render(tty, clients, forwards, limit, "\n")
+		return nil
+	}
+
+	term.EnableRaw()
+	defer term.DisableRaw(false)
+
+	quit := make(chan bool)
+	go func() {
+		defer close(quit)
+
+		b := make([]byte, 1)
+		for {
+			_, err := tty.Read(b)
+			if err != nil {
+				return
+			}
+			if b[0] == 3 || b[0] == 'q' { // Ctrl-C
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSample := time.Now()
+	for {
+		select {
+		case <-quit:
+			return nil
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+
+		var clients, forwards []topRow
+		previousClients, previousForwards, clients, forwards, err = sample(previousClients, previousForwards, now.Sub(lastSample))
+		if err != nil {
+			return err
+		}
+		lastSample = now
+
+		// Erase the screen and move the cursor home
+		fmt.Fprint(tty, "\x1b[2J\x1b[H")
+		fmt.Fprintf(tty, "%s, refreshing every %s, sorted by %s. Press q or Ctrl-C to exit\r\n\r\n", now.Format("15:04:05"), interval, sortBy)
+		t.render(tty, clients, forwards, limit, "\r\n")
+	}
+}
+
+func (t *top) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (t *top) Help(explain bool) string {
+	if explain {
+		return "Live view of the busiest clients and forwards"
+	}
+
+	return terminal.MakeHelpText(t.ValidArgs(),
+		"top [OPTIONS]",
+		"Top shows clients and forwards ranked by current throughput, refreshing until q or Ctrl-C is pressed.",
+		"Ops/s is the number of reads and writes per second, lots of small packets are harder on the relay than a few big ones.",
+	)
+}
+
+func (t *top) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "top", Description: "Show the busiest clients and forwards, refreshing every 2 seconds"},
+		{Command: "top -s sessions -n 5", Description: "Show the 5 clients with the most sessions open"},
+	}
+}
@@ -0,0 +1,141 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/server/vault"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+)
+
+type vaultCommand struct {
+}
+
+func (v *vaultCommand) ValidArgs() map[string]string {
+	return map[string]string{
+		"l":      "List your credentials, secrets are never shown",
+		"set":    "Add or replace a credential, the secret is asked for so it is not echoed or kept in history",
+		"user":   "User name that goes with the secret, e.g CORP\\admin",
+		"kind":   "What the secret is, one of [" + strings.Join(vault.Kinds, ", ") + "] (default password)",
+		"remove": "Remove a credential",
+	}
+}
+
+// readSecret asks for the secret without echoing it, consoles without a terminal give it as the next line
+func readSecret(tty io.ReadWriter) (string, error) {
+	if term, ok := tty.(*terminal.Terminal); ok {
+		return term.ReadPassword("Secret: ")
+	}
+
+	fmt.Fprint(tty, "Secret: ")
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (v *vaultCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if line.IsSet("l") {
+		secrets, err := vault.List(user.Username())
+		if err != nil {
+			return err
+		}
+
+		t, err := table.NewTable("Vault", "Name", "Kind", "User", "Updated")
+		if err != nil {
+			return err
+		}
+
+		for _, s := range secrets {
+			t.AddValues(s.Name, s.Kind, s.User, s.UpdatedAt.Format(time.DateTime))
+		}
+		t.Fprint(tty)
+
+		return nil
+	}
+
+	if name, err := line.GetArgString("remove"); err == nil {
+		removed, err := vault.Remove(user.Username(), name)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return failure.New(failure.NotFound, "you have no credential called %q", name)
+		}
+
+		fmt.Fprintf(tty, "Removed %s\n", name)
+		return nil
+	}
+
+	name, err := line.GetArgString("set")
+	if err != nil {
+		return failure.New(failure.InvalidArgument, "no actionable argument supplied, please add --set, --remove or -l (list)")
+	}
+
+	if strings.ContainsAny(name, " \t\r\n") {
+		return failure.New(failure.InvalidArgument, "credential names cannot contain spaces")
+	}
+
+	kind := "password"
+	if k, err := line.GetArgString("kind"); err == nil {
+		kind = strings.ToLower(k)
+		if !slices.Contains(vault.Kinds, kind) {
+			return failure.New(failure.InvalidArgument, "unknown kind %q, must be one of %s", k, strings.Join(vault.Kinds, ", "))
+		}
+	}
+
+	username, _ := line.GetArgString("user")
+
+	secret, err := readSecret(tty)
+	if err != nil {
+		return err
+	}
+
+	secretBytes := []byte(secret)
+	defer secure.Zero(secretBytes)
+
+	if len(secretBytes) == 0 {
+		return failure.New(failure.InvalidArgument, "the secret cannot be empty")
+	}
+
+	if err := vault.Save(user.Username(), name, kind, username, secretBytes); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(tty, "Saved %s\n", name)
+	return nil
+}
+
+func (v *vaultCommand) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (v *vaultCommand) Help(explain bool) string {
+	if explain {
+		return "Keep credentials for onward systems that client modules can use without you typing them"
+	}
+
+	return terminal.MakeHelpText(v.ValidArgs(),
+		"vault [OPTIONS]",
+		"Credentials are your own, other operators (admins included) cannot list or use them. They are sealed with a key derived from the server key.",
+		"Modules started through ssh -J use them with --cred <name>, the client asks the server for the secret so it is never typed, echoed or written on the target.",
+	)
+}
+
+func (v *vaultCommand) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "vault --set corp-admin --user CORP\\admin", Description: "Save a domain admin password, you are asked for it"},
+		{Command: "vault --set sa --user sa --kind password", Description: "Save a SQL login"},
+		{Command: "vault -l", Description: "List your credentials"},
+		{Command: "vault --remove corp-admin", Description: "Forget a credential"},
+	}
+}
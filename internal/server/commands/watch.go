@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
@@ -28,6 +29,23 @@ func (w *watch) ValidArgs() map[string]string {
 
 func (w *watch) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
 
+	if campaign := user.Campaign(); campaign != "" && (line.IsSet("a") || line.IsSet("l")) {
+		numberOfLines := -1
+		if !line.IsSet("a") {
+			numberOfLinesStr, err := line.GetArgString("l")
+			if err != nil {
+				return err
+			}
+
+			numberOfLines, err = strconv.Atoi(numberOfLinesStr)
+			if err != nil {
+				return err
+			}
+		}
+
+		return w.campaignHistory(tty, campaign, numberOfLines)
+	}
+
 	if line.IsSet("a") {
 
 		f, err := os.Open(filepath.Join(w.datadir, "watch.log"))
@@ -122,17 +140,42 @@ func (w *watch) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLin
 	messages := make(chan string)
 
 	observerId := observers.ConnectionState.Register(func(c observers.ClientState) {
+		if !user.InCampaign(c.Campaign) {
+			return
+		}
 
 		var arrowDirection = "<-"
 		if c.Status == "disconnected" {
 			arrowDirection = "->"
 			messages <- fmt.Sprintf("%s %s %s (%s %s) %s %s", c.Timestamp.Format("2006/01/02 15:04:05"), arrowDirection, color.BlueString(c.HostName), c.IP, color.YellowString(c.ID), c.Version, color.RedString(c.Status))
+		} else if c.Status == "tampered" || c.Status == "hostkey" {
+			messages <- fmt.Sprintf("%s %s %s (%s %s) %s %s: %s", c.Timestamp.Format("2006/01/02 15:04:05"), arrowDirection, color.BlueString(c.HostName), c.IP, color.YellowString(c.ID), c.Version, color.RedString(c.Status), c.Reason)
+		} else if c.Reason != "" {
+			messages <- fmt.Sprintf("%s %s %s (%s %s) %s %s: %s", c.Timestamp.Format("2006/01/02 15:04:05"), arrowDirection, color.BlueString(c.HostName), c.IP, color.YellowString(c.ID), c.Version, color.YellowString(c.Status), c.Reason)
 		} else {
 			messages <- fmt.Sprintf("%s %s %s (%s %s) %s %s", c.Timestamp.Format("2006/01/02 15:04:05"), arrowDirection, color.BlueString(c.HostName), c.IP, color.YellowString(c.ID), c.Version, color.GreenString(c.Status))
 		}
 
 	})
 
+	networkObserverId := observers.NetworkChange.Register(func(nc observers.ClientNetworkChange) {
+		if !user.InCampaign(nc.Campaign) {
+			return
+		}
+		messages <- fmt.Sprintf("%s !! %s", nc.Timestamp.Format("2006/01/02 15:04:05"), color.YellowString(nc.Summary()))
+	})
+
+	buildObserverId := observers.Builds.Register(func(b observers.Build) {
+		if !user.InCampaign(b.Campaign) {
+			return
+		}
+		summary := color.CyanString(b.Summary())
+		if b.Status == "failed" {
+			summary = color.RedString(b.Summary())
+		}
+		messages <- fmt.Sprintf("%s ** %s", b.Timestamp.Format("2006/01/02 15:04:05"), summary)
+	})
+
 	term, isTerm := tty.(*terminal.Terminal)
 	if isTerm {
 		term.EnableRaw()
@@ -151,6 +194,8 @@ func (w *watch) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLin
 			// Ignore all other keys
 		}
 		observers.ConnectionState.Deregister(observerId)
+		observers.NetworkChange.Deregister(networkObserverId)
+		observers.Builds.Deregister(buildObserverId)
 		close(messages)
 	}()
 
@@ -166,6 +211,50 @@ func (w *watch) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLin
 	return nil
 }
 
+// campaignHistory prints the last n, or every when n < 0, connection events of campaign's clients. The whole log is read as other
+// campaigns' events are skipped
+func (w *watch) campaignHistory(tty io.ReadWriter, campaign string, n int) error {
+	f, err := os.Open(filepath.Join(w.datadir, "watch.log"))
+	if err != nil {
+		log.Println("unable to open watch.log:", err)
+		return err
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if watchLogCampaign(sc.Text()) != campaign {
+			continue
+		}
+
+		lines = append(lines, sc.Text())
+		if n >= 0 && len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	for _, l := range lines {
+		fmt.Fprintf(tty, "%s\n\r", l)
+	}
+
+	return nil
+}
+
+// watchLogCampaign is the campaign of the client a watch.log line is about, written last on the line
+func watchLogCampaign(line string) string {
+	i := strings.LastIndex(line, " campaign:")
+	if i == -1 {
+		return ""
+	}
+
+	return line[i+len(" campaign:"):]
+}
+
 func (W *watch) Expect(line terminal.ParsedLine) []string {
 	return nil
 }
@@ -178,7 +267,9 @@ func (w *watch) Help(explain bool) string {
 	return terminal.MakeHelpText(w.ValidArgs(),
 		"watch [OPTIONS]",
 		"Watch shows continuous connection status of clients (prints the joining and leaving of clients)",
+		"Clients reconnecting from a different network than last time are marked with !!",
 		"Defaultly waits for new connection events",
+		"Operators working in a campaign only see events from its clients",
 	)
 }
 
@@ -186,3 +277,10 @@ func Watch(datadir string) *watch {
 
 	return &watch{datadir: datadir}
 }
+
+func (w *watch) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "watch", Description: "Show clients joining and leaving until Ctrl-C"},
+		{Command: "watch -l 10", Description: "Show the last 10 connection events"},
+	}
+}
@@ -1,11 +1,11 @@
 package commands
 
 import (
-	"errors"
 	"fmt"
 	"io"
 
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 )
@@ -49,7 +49,7 @@ func (w *webhook) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 	off := line.IsSet("off")
 
 	if on && off {
-		return errors.New("cannot specify on and off at the same time")
+		return failure.New(failure.InvalidArgument, "cannot specify on and off at the same time")
 	}
 
 	if on {
@@ -110,3 +110,11 @@ func (w *webhook) Help(explain bool) string {
 		"Allows you to set webhooks which currently show the joining and leaving of clients",
 	)
 }
+
+func (w *webhook) Examples() []terminal.Example {
+	return []terminal.Example{
+		{Command: "webhook --on https://hooks.example.com/rssh", Description: "Send join, leave and network change events to a url"},
+		{Command: "webhook -l", Description: "List active webhooks"},
+		{Command: "webhook --off https://hooks.example.com/rssh", Description: "Stop sending events to a url"},
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// The local console is the server's ssh console on a unix socket in the datadir, or a named pipe on Windows, served with --console-socket.
+// It does not go through the network listeners, admission control or authorized_keys, anyone who can open it is an admin. Only the
+// server's user can: the socket is in a 0700 directory, and the pipe's DACL only allows the server's account and refuses remote clients
+
+const consoleAddrNetwork = "console"
+
+// ConsoleUsername is who everyone on the local console is. Keys cannot log in with it, so the console never shares a user with an operator
+const ConsoleUsername = "@console"
+
+// Whether the local console is served
+var consoleSocket bool
+
+// SetConsoleSocket turns serving the local console on
+func SetConsoleSocket(enabled bool) {
+	consoleSocket = enabled
+}
+
+type consoleAddr struct{}
+
+func (consoleAddr) Network() string {
+	return consoleAddrNetwork
+}
+
+func (consoleAddr) String() string {
+	return "local console"
+}
+
+// Socket and pipe peers have no address, and everything after accepting a connection logs one
+type consoleConn struct {
+	net.Conn
+}
+
+func (consoleConn) RemoteAddr() net.Addr {
+	return consoleAddr{}
+}
+
+func exitStatus(err error) (int, error) {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+
+	if err != nil && !errors.Is(err, io.EOF) {
+		var missing *ssh.ExitMissingError
+		if errors.As(err, &missing) {
+			return 0, nil
+		}
+		return 1, err
+	}
+
+	return 0, nil
+}
+
+// StartConsoleSocket serves the local console on path until ctx is done. If another server already has it open it is left alone
+func StartConsoleSocket(ctx context.Context, path string, privateKey ssh.Signer, dataDir string, timeout int) {
+	listener, err := listenConsole(path)
+	if err != nil {
+		log.Printf("Unable to start the local console on %s: %s", path, err)
+		return
+	}
+
+	config := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-OpenSSH_8.0",
+		NoClientAuth:  true,
+		NoClientAuthCallback: func(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+			if conn.User() != ConsoleUsername {
+				return nil, fmt.Errorf("the local console is only logged into as %s", ConsoleUsername)
+			}
+
+			perm := &ssh.Permissions{
+				Extensions: map[string]string{
+					"comment": "local console",
+				},
+			}
+			setUserPermissions(perm, privilegeAdmin)
+			return perm, nil
+		},
+	}
+	config.AddHostKey(privateKey)
+
+	log.Printf("Local console listening on %s\n", path)
+
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isClosedListenerError(err) {
+				return
+			}
+			log.Printf("failed to accept local console connection (%s)", err)
+			continue
+		}
+
+		go acceptConn(ctx, consoleConn{conn}, config, timeout, dataDir, nil, false, nil)
+	}
+}
+
+// AttachConsole opens the local console of the server running in dataDir, running command on it or, when command is empty, a shell on this terminal.
+// It returns the exit status of the command
+func AttachConsole(dataDir string, hostKey ssh.PublicKey, command string) (int, error) {
+	path := ConsoleSocketPath(dataDir)
+
+	conn, err := dialConsole(path)
+	if err != nil {
+		return 1, fmt.Errorf("unable to open the local console (is the server running with --console-socket and --datadir %s?): %w", dataDir, err)
+	}
+	defer conn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, path, &ssh.ClientConfig{
+		User:            ConsoleUsername,
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+	if err != nil {
+		return 1, fmt.Errorf("local console handshake failed: %w", err)
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 1, err
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	if command != "" {
+		return exitStatus(session.Run(command))
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return 1, errors.New("the local console needs a terminal, or a command to run")
+	}
+
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	if err := session.RequestPty(os.Getenv("TERM"), height, width, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+		return 1, err
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return 1, err
+	}
+	defer term.Restore(fd, state)
+
+	go watchConsoleSize(fd, session, width, height)
+
+	if err := session.Shell(); err != nil {
+		return 1, err
+	}
+
+	return exitStatus(session.Wait())
+}
+
+// There is no portable resize signal, so the size is polled
+func watchConsoleSize(fd int, session *ssh.Session, width, height int) {
+	for range time.Tick(500 * time.Millisecond) {
+		w, h, err := term.GetSize(fd)
+		if err != nil || (w == width && h == height) {
+			continue
+		}
+
+		width, height = w, h
+		if err := session.WindowChange(height, width); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// privateConsoleDir makes sure dir is a directory only the server's user can open, so the socket is never reachable by anyone else,
+// not even between being created and having its mode set
+func privateConsoleDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by another user", dir)
+	}
+
+	if info.Mode().Perm() != 0700 {
+		return os.Chmod(dir, 0700)
+	}
+
+	return nil
+}
+
+// ConsoleSocketPath is where the local console listens
+func ConsoleSocketPath(dataDir string) string {
+	return filepath.Join(dataDir, "console", "console.sock")
+}
+
+// listenConsole listens on the console socket, in a directory only the server's user can open
+func listenConsole(path string) (net.Listener, error) {
+	if err := privateConsoleDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, errors.New("it is in use by another server")
+		}
+
+		// Left behind by a server that did not shut down cleanly
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+func dialConsole(path string) (net.Conn, error) {
+	return net.DialTimeout("unix", path, 5*time.Second)
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/namedpipe"
+)
+
+// ConsoleSocketPath is where the local console listens. Windows has no socket files, so it is a named pipe named after the datadir,
+// letting servers with different datadirs run side by side
+func ConsoleSocketPath(dataDir string) string {
+	if abs, err := filepath.Abs(dataDir); err == nil {
+		dataDir = abs
+	}
+
+	sum := sha256.Sum256([]byte(filepath.Clean(dataDir)))
+	return namedpipe.LocalPath("rssh-console-" + hex.EncodeToString(sum[:8]))
+}
+
+// listenConsole creates the console pipe, which only the server's account can open and only from this host. Creating it fails if
+// anyone already has the name, so another user cannot stand in for the server
+func listenConsole(path string) (net.Listener, error) {
+	return namedpipe.ListenPrivate(path)
+}
+
+func dialConsole(path string) (net.Conn, error) {
+	return namedpipe.Dial(path, 5*time.Second)
+}
@@ -0,0 +1,238 @@
+package contentfilter
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+)
+
+// Content filters look for patterns in what the server writes to its audit logs, and in data it relays in the clear (forwards through clients).
+// They either alert, or redact the match by overwriting it with '*' before the line is written. Forwards are only ever alerted on: changing
+// bytes in a live stream breaks anything binary or length framed (TLS, ssh, HTTP bodies), so relayed data is passed on as it is
+
+const (
+	ActionAlert  = "alert"
+	ActionRedact = "redact"
+
+	CreditCard = "credit-card"
+)
+
+// Matches split between two writes are still found if they are no longer than this
+const overlap = 256
+
+// Builtins are the patterns filter --builtin can add by name
+var Builtins = map[string]data.ContentFilter{
+	CreditCard: {Pattern: `\b\d(?:[ -]?\d){12,18}\b`, Luhn: true},
+}
+
+type filter struct {
+	name   string
+	re     *regexp.Regexp
+	luhn   bool
+	redact bool
+}
+
+var (
+	lck     sync.RWMutex
+	filters []filter
+)
+
+func compile(f data.ContentFilter) (filter, error) {
+	if f.Action != ActionAlert && f.Action != ActionRedact {
+		return filter{}, fmt.Errorf("action %q is not %s or %s", f.Action, ActionAlert, ActionRedact)
+	}
+
+	re, err := regexp.Compile(f.Pattern)
+	if err != nil {
+		return filter{}, fmt.Errorf("invalid pattern %q: %w", f.Pattern, err)
+	}
+
+	return filter{
+		name:   f.Name,
+		re:     re,
+		luhn:   f.Luhn,
+		redact: f.Action == ActionRedact,
+	}, nil
+}
+
+// Validate checks a filter can be used before it is saved
+func Validate(f data.ContentFilter) error {
+	_, err := compile(f)
+	return err
+}
+
+// Load replaces the filters in use with those saved in the database. Forwards already open keep the filters they started with
+func Load() error {
+	saved, err := data.GetContentFilters()
+	if err != nil {
+		return err
+	}
+
+	var loaded []filter
+	for _, f := range saved {
+		c, err := compile(f)
+		if err != nil {
+			log.Printf("Ignoring content filter %s: %s", f.Name, err)
+			continue
+		}
+		loaded = append(loaded, c)
+	}
+
+	lck.Lock()
+	filters = loaded
+	lck.Unlock()
+
+	return nil
+}
+
+func active() []filter {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return filters
+}
+
+// luhnValid checks the digits in b have a valid card number check digit
+func luhnValid(b []byte) bool {
+	sum, digits := 0, 0
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < '0' || b[i] > '9' {
+			continue
+		}
+
+		d := int(b[i] - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+
+	return digits >= 13 && sum%10 == 0
+}
+
+func (f filter) matches(b []byte) [][]int {
+	all := f.re.FindAllIndex(b, -1)
+	if !f.luhn {
+		return all
+	}
+
+	valid := all[:0]
+	for _, m := range all {
+		if luhnValid(b[m[0]:m[1]]) {
+			valid = append(valid, m)
+		}
+	}
+	return valid
+}
+
+func notify(f filter, where string) {
+	action := ActionAlert
+	if f.redact {
+		action = ActionRedact
+	}
+
+	log.Printf("Content filter %s matched in %s (%s)", f.name, where, action)
+
+	observers.ContentMatches.Notify(observers.ContentMatch{
+		Filter:    f.name,
+		Action:    action,
+		Where:     where,
+		Timestamp: time.Now(),
+	})
+}
+
+// RedactString applies every filter to s, where names it in alerts
+func RedactString(s, where string) string {
+	fs := active()
+	if len(fs) == 0 {
+		return s
+	}
+
+	b := []byte(s)
+	for _, f := range fs {
+		found := f.matches(b)
+		if len(found) == 0 {
+			continue
+		}
+
+		notify(f, where)
+		if f.redact {
+			for _, m := range found {
+				mask(b[m[0]:m[1]])
+			}
+		}
+	}
+
+	return string(b)
+}
+
+func mask(b []byte) {
+	for i := range b {
+		b[i] = '*'
+	}
+}
+
+type watcher struct {
+	w       io.Writer
+	where   string
+	filters []filter
+
+	// The end of what was last written, so matches split between writes are found
+	tail []byte
+	// Each filter alerts once per stream
+	alerted map[string]bool
+}
+
+// Watch alerts on matches in everything written to w, where names the stream in alerts. What is written is never changed, even for
+// redacting filters. Without filters w is returned as it is
+func Watch(w io.Writer, where string) io.Writer {
+	fs := active()
+	if len(fs) == 0 {
+		return w
+	}
+
+	return &watcher{
+		w:       w,
+		where:   where,
+		filters: fs,
+		alerted: map[string]bool{},
+	}
+}
+
+func (fw *watcher) Write(b []byte) (int, error) {
+	scan := append(fw.tail, b...)
+	start := len(fw.tail)
+
+	for _, f := range fw.filters {
+		if fw.alerted[f.name] {
+			continue
+		}
+
+		for _, m := range f.matches(scan) {
+			// Matches ending in the tail were seen in the last write
+			if m[1] > start {
+				fw.alerted[f.name] = true
+				notify(f, fw.where)
+				break
+			}
+		}
+	}
+
+	n, err := fw.w.Write(b)
+
+	if keep := min(len(scan), overlap); keep > 0 {
+		fw.tail = append(fw.tail[:0], scan[len(scan)-keep:]...)
+	}
+
+	return n, err
+}
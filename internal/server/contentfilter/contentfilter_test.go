@@ -0,0 +1,72 @@
+package contentfilter
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+)
+
+func loadFilters(t *testing.T, filters ...data.ContentFilter) {
+	if err := data.LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range filters {
+		if err := Validate(f); err != nil {
+			t.Fatal(err)
+		}
+		if err := data.SaveContentFilter(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchSplitWrites(t *testing.T) {
+	cards := Builtins[CreditCard]
+	cards.Name, cards.Action = "cards", ActionRedact
+	loadFilters(t, cards, data.ContentFilter{Name: "secret", Pattern: "hunter2", Action: ActionAlert})
+
+	alerts := make(chan string, 10)
+	id := observers.ContentMatches.Register(func(c observers.ContentMatch) {
+		alerts <- c.Filter
+	})
+	defer observers.ContentMatches.Deregister(id)
+
+	var out bytes.Buffer
+	w := Watch(&out, "test forward")
+
+	// A valid card number split between writes, one that fails the check digit, and a secret that is only alerted on
+	for _, chunk := range []string{"pay 4111 1111 ", "1111 1111 now, not 4111 1111 1111 1112, ", "hunter2"} {
+		if n, err := w.Write([]byte(chunk)); err != nil || n != len(chunk) {
+			t.Fatalf("write returned %d, %v", n, err)
+		}
+	}
+
+	// Relayed data is never changed, even by a redacting filter
+	expected := "pay 4111 1111 1111 1111 now, not 4111 1111 1111 1112, hunter2"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		select {
+		case filter := <-alerts:
+			seen[filter] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected an alert for each filter, got %v", seen)
+		}
+	}
+
+	if s := RedactString("card 4111-1111-1111-1111", "watch.log"); s != "card *******************" {
+		t.Fatalf("log line was not redacted: %q", s)
+	}
+}
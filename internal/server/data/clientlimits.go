@@ -0,0 +1,50 @@
+package data
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// ClientLimit is a client-limits policy, for every client or for the clients of one campaign
+type ClientLimit struct {
+	gorm.Model
+
+	// Empty for the policy that applies to every client
+	Campaign string `gorm:"uniqueIndex"`
+
+	// Bytes per hour, zero is unlimited
+	Transfer int64
+	// Seconds a connection may last, zero is unlimited
+	Duration int64
+}
+
+func SaveClientLimit(l ClientLimit) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing ClientLimit
+		err := tx.Where("campaign = ?", l.Campaign).First(&existing).Error
+		if err == nil {
+			return tx.Model(&existing).Updates(map[string]any{"transfer": l.Transfer, "duration": l.Duration}).Error
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return tx.Create(&l).Error
+	})
+}
+
+// DeleteClientLimit removes the policy for campaign, false if there was not one
+func DeleteClientLimit(campaign string) (bool, error) {
+	result := db.Unscoped().Where("campaign = ?", campaign).Delete(&ClientLimit{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func GetClientLimits() ([]ClientLimit, error) {
+	var limits []ClientLimit
+	if err := db.Order("campaign").Find(&limits).Error; err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ClientSource is the last network a client key was seen connecting from
+type ClientSource struct {
+	gorm.Model
+
+	Fingerprint string `gorm:"unique"`
+
+	IP      string
+	Network string
+	ASN     string
+	Country string
+
+	LastSeen time.Time
+}
+
+// RecordClientSource stores the current source of a client key and returns what was previously recorded.
+// If the key has never been seen before found is false
+func RecordClientSource(current ClientSource) (previous ClientSource, found bool, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("fingerprint = ?", current.Fingerprint).First(&previous).Error
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+
+			return tx.Create(&current).Error
+		}
+
+		found = true
+
+		return tx.Model(&ClientSource{}).Where("fingerprint = ?", current.Fingerprint).Updates(map[string]interface{}{
+			"ip":        current.IP,
+			"network":   current.Network,
+			"asn":       current.ASN,
+			"country":   current.Country,
+			"last_seen": current.LastSeen,
+		}).Error
+	})
+
+	return previous, found, err
+}
+
+// RecentClientSourceIPs returns the addresses client keys have connected from since the given time
+func RecentClientSourceIPs(since time.Time) (ips []string, err error) {
+	err = db.Model(&ClientSource{}).Where("last_seen >= ?", since).Distinct().Pluck("ip", &ips).Error
+	return ips, err
+}
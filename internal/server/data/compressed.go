@@ -0,0 +1,86 @@
+package data
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings a download can be served compressed with, most preferred first. The names are the http content codings
+var DownloadEncodings = []string{"zstd", "gzip"}
+
+var downloadExtensions = map[string]string{
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+var compressLock sync.Mutex
+
+// CompressedDownload returns the path of the download compressed with encoding, it is compressed the first time it is asked for and kept next to the original
+func CompressedDownload(f Download, encoding string) (string, error) {
+	extension, ok := downloadExtensions[encoding]
+	if !ok {
+		return "", fmt.Errorf("unsupported download encoding %q", encoding)
+	}
+
+	path := f.FilePath + extension
+
+	// Builds are never changed in place, so an existing compressed copy is always current
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	compressLock.Lock()
+	defer compressLock.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	original, err := os.Open(f.FilePath)
+	if err != nil {
+		return "", err
+	}
+	defer original.Close()
+
+	temp, err := os.CreateTemp(filepath.Dir(f.FilePath), ".compressing-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	var compressor io.WriteCloser
+	switch encoding {
+	case "zstd":
+		compressor, err = zstd.NewWriter(temp, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case "gzip":
+		compressor, err = gzip.NewWriterLevel(temp, gzip.BestCompression)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(compressor, original); err != nil {
+		return "", err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return "", err
+	}
+
+	if err := temp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressedDownload(t *testing.T) {
+	original := bytes.Repeat([]byte("not much of a client binary "), 4096)
+
+	f := Download{FilePath: filepath.Join(t.TempDir(), "client")}
+	if err := os.WriteFile(f.FilePath, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range DownloadEncodings {
+		path, err := CompressedDownload(f, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compressed, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer compressed.Close()
+
+		var r io.Reader
+		switch encoding {
+		case "gzip":
+			r, err = gzip.NewReader(compressed)
+		case "zstd":
+			r, err = zstd.NewReader(compressed)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(content, original) {
+			t.Fatalf("%s download did not decompress to the original", encoding)
+		}
+
+		// Asking again serves the same file rather than compressing it again
+		again, err := CompressedDownload(f, encoding)
+		if err != nil || again != path {
+			t.Fatalf("second %s request gave %q, %v", encoding, again, err)
+		}
+	}
+
+	if _, err := CompressedDownload(f, "br"); err == nil {
+		t.Fatal("unsupported encoding was accepted")
+	}
+}
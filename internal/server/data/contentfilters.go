@@ -0,0 +1,49 @@
+package data
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// ContentFilter is a pattern looked for in forwarded data and audit logs, see the filter command
+type ContentFilter struct {
+	gorm.Model
+
+	Name    string `gorm:"uniqueIndex"`
+	Pattern string
+	// Checks matches are valid card numbers, for the credit-card filter
+	Luhn bool
+	// alert or redact
+	Action string
+}
+
+func SaveContentFilter(f ContentFilter) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing ContentFilter
+		err := tx.Where("name = ?", f.Name).First(&existing).Error
+		if err == nil {
+			return tx.Model(&existing).Updates(map[string]any{"pattern": f.Pattern, "luhn": f.Luhn, "action": f.Action}).Error
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return tx.Create(&f).Error
+	})
+}
+
+// DeleteContentFilter removes the filter called name, false if there was not one
+func DeleteContentFilter(name string) (bool, error) {
+	result := db.Unscoped().Where("name = ?", name).Delete(&ContentFilter{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func GetContentFilters() ([]ContentFilter, error) {
+	var filters []ContentFilter
+	if err := db.Order("name").Find(&filters).Error; err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DownloadEvent is one fetch of a download link, and the client it turned into if one has connected since
+type DownloadEvent struct {
+	gorm.Model
+
+	UrlPath     string `gorm:"index"`
+	Fingerprint string `gorm:"index"`
+
+	// http, raw or the script extension (sh, py, ps1)
+	Method    string
+	Encoding  string
+	IP        string
+	UserAgent string
+
+	DownloadedAt time.Time
+
+	ClientID       string
+	ClientHostName string
+	AttributedAt   *time.Time
+}
+
+func RecordDownloadEvent(event DownloadEvent) error {
+	return db.Create(&event).Error
+}
+
+// AttributeDownload links a client connection to the download it most likely came from, the latest download of a build with
+// the same key from the same address, or failing that the latest one not yet linked to any client
+func AttributeDownload(fingerprint, ip, clientID, hostname string) (event DownloadEvent, found bool, err error) {
+	if fingerprint == "" {
+		return event, false, nil
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("fingerprint = ? AND ip = ?", fingerprint, ip).Order("downloaded_at DESC").First(&event).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = tx.Where("fingerprint = ? AND client_id = ''", fingerprint).Order("downloaded_at DESC").First(&event).Error
+		}
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		found = true
+
+		now := time.Now()
+		event.ClientID = clientID
+		event.ClientHostName = hostname
+		event.AttributedAt = &now
+
+		return tx.Model(&event).Updates(map[string]interface{}{
+			"client_id":        clientID,
+			"client_host_name": hostname,
+			"attributed_at":    now,
+		}).Error
+	})
+
+	return event, found, err
+}
+
+// ListDownloadEvents returns download history, newest first, for links matching filter (a glob, empty for all)
+func ListDownloadEvents(filter string) ([]DownloadEvent, error) {
+	if _, err := filepath.Match(filter, ""); err != nil {
+		return nil, fmt.Errorf("filter is not well formed")
+	}
+
+	var events []DownloadEvent
+	if err := db.Order("downloaded_at DESC").Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	if filter == "" {
+		return events, nil
+	}
+
+	matching := events[:0]
+	for _, event := range events {
+		if match, _ := filepath.Match(filter, event.UrlPath); match {
+			matching = append(matching, event)
+			continue
+		}
+
+		if match, _ := filepath.Match(filter, event.IP); match {
+			matching = append(matching, event)
+			continue
+		}
+
+		if match, _ := filepath.Match(filter, event.ClientHostName); match {
+			matching = append(matching, event)
+		}
+	}
+
+	return matching, nil
+}
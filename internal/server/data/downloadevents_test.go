@@ -0,0 +1,53 @@
+package data
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAttributeDownload(t *testing.T) {
+	if err := LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for i, e := range []DownloadEvent{
+		{UrlPath: "campaign", Fingerprint: "aaaa", Method: "http", IP: "10.0.0.1"},
+		{UrlPath: "campaign", Fingerprint: "aaaa", Method: "raw", IP: "10.0.0.2"},
+		{UrlPath: "other", Fingerprint: "bbbb", Method: "http", IP: "10.0.0.3"},
+	} {
+		e.DownloadedAt = start.Add(time.Duration(i) * time.Minute)
+		if err := RecordDownloadEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Same key and address
+	event, found, err := AttributeDownload("aaaa", "10.0.0.1", "id1", "host1")
+	if err != nil || !found || event.Method != "http" {
+		t.Fatalf("expected the http download from 10.0.0.1, got %+v %v %v", event, found, err)
+	}
+
+	// Connecting through a nat, the latest download of that key nobody has claimed yet
+	event, found, err = AttributeDownload("aaaa", "192.0.2.1", "id2", "host2")
+	if err != nil || !found || event.Method != "raw" {
+		t.Fatalf("expected the raw download, got %+v %v %v", event, found, err)
+	}
+
+	if _, found, _ := AttributeDownload("aaaa", "192.0.2.1", "id3", "host3"); found {
+		t.Fatal("every download of the key was already claimed, nothing should match")
+	}
+
+	if _, found, _ := AttributeDownload("cccc", "10.0.0.3", "id4", "host4"); found {
+		t.Fatal("a client with a key no download has was attributed")
+	}
+
+	events, err := ListDownloadEvents("host*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ClientID != "id2" {
+		t.Fatalf("expected the two attributed downloads newest first, got %+v", events)
+	}
+}
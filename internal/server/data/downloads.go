@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -30,6 +32,30 @@ type Download struct {
 
 	// Where to download the file to
 	WorkingDirectory string
+
+	// JSON of the settings the linker embedded in the binary
+	Embedded string
+
+	// SHA1 fingerprint of the client key built in, so connections can be traced back to downloads
+	Fingerprint string `gorm:"index"`
+
+	// Operator chosen label grouping builds, e.g the engagement or phishing run they were made for
+	Campaign string
+
+	// When a client with the built in key first connected, nil if it never has
+	ConnectedAt *time.Time
+
+	// Set when the build was offloaded to object storage rather than kept at FilePath
+	StorageKey string
+
+	// JSON of the link options it was built with, so it can be built again
+	BuildConfig string
+
+	// Rebuilt when the go toolchain, client source or templates change
+	AutoRebuild bool
+
+	// Signed in-toto statement of how it was built, see webserver.VerifyProvenance
+	Provenance string
 }
 
 func CreateDownload(file Download) error {
@@ -96,5 +122,101 @@ func DeleteDownload(key string) error {
 		return err
 	}
 
+	return removeDownloadFiles(download)
+}
+
+// ReplaceDownload swaps the build behind an existing link for a new one, keeping its hits and history, then removes the old files
+func ReplaceDownload(file Download) error {
+	var old Download
+	if err := db.Where("url_path = ?", file.UrlPath).First(&old).Error; err != nil {
+		return err
+	}
+
+	file.Model = old.Model
+	file.Hits = old.Hits
+	if err := db.Save(&file).Error; err != nil {
+		return err
+	}
+
+	return removeDownloadFiles(old)
+}
+
+// AutoRebuildDownloads lists the links marked to be rebuilt when the client source changes
+func AutoRebuildDownloads() ([]Download, error) {
+	var downloads []Download
+	return downloads, db.Where("auto_rebuild = ?", true).Order("url_path").Find(&downloads).Error
+}
+
+func removeDownloadFiles(download Download) error {
+	if download.StorageKey != "" {
+		return deleteOffloaded(download)
+	}
+
+	for _, extension := range downloadExtensions {
+		os.Remove(download.FilePath + extension)
+	}
+
 	return os.Remove(download.FilePath)
 }
+
+// MarkDownloadConnected records the first connection of a client built with the key fingerprint
+func MarkDownloadConnected(fingerprint string) error {
+	if fingerprint == "" {
+		return nil
+	}
+
+	return db.Model(&Download{}).Where("fingerprint = ? AND connected_at IS NULL", fingerprint).Update("connected_at", time.Now()).Error
+}
+
+// CampaignProgress counts how many builds of a campaign have had a client connect
+type CampaignProgress struct {
+	Campaign         string
+	Built, Connected int
+}
+
+// PendingDownloads returns builds no client has connected from yet, oldest first, matching filter (a glob on link or campaign, empty for all),
+// and the deployment progress of each campaign those builds belong to
+func PendingDownloads(filter string) (pending []Download, progress []CampaignProgress, err error) {
+	if _, err := filepath.Match(filter, ""); err != nil {
+		return nil, nil, fmt.Errorf("filter is not well formed")
+	}
+
+	var downloads []Download
+	if err := db.Order("created_at").Find(&downloads).Error; err != nil {
+		return nil, nil, err
+	}
+
+	campaigns := map[string]*CampaignProgress{}
+	for _, d := range downloads {
+		if filter != "" {
+			linkMatch, _ := filepath.Match(filter, d.UrlPath)
+			campaignMatch, _ := filepath.Match(filter, d.Campaign)
+			if !linkMatch && !campaignMatch {
+				continue
+			}
+		}
+
+		c, ok := campaigns[d.Campaign]
+		if !ok {
+			c = &CampaignProgress{Campaign: d.Campaign}
+			campaigns[d.Campaign] = c
+		}
+
+		c.Built++
+		if d.ConnectedAt != nil {
+			c.Connected++
+			continue
+		}
+
+		pending = append(pending, d)
+	}
+
+	for _, c := range campaigns {
+		progress = append(progress, *c)
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].Campaign < progress[j].Campaign
+	})
+
+	return pending, progress, nil
+}
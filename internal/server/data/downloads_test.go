@@ -0,0 +1,97 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPendingDownloads(t *testing.T) {
+	if err := LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []Download{
+		{UrlPath: "a", Fingerprint: "aaaa", Campaign: "spring"},
+		{UrlPath: "b", Fingerprint: "bbbb", Campaign: "spring"},
+		{UrlPath: "c", Fingerprint: "cccc"},
+	} {
+		if err := CreateDownload(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MarkDownloadConnected("aaaa"); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, progress, err := PendingDownloads("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 2 || pending[0].UrlPath != "b" || pending[1].UrlPath != "c" {
+		t.Fatalf("expected b and c to be pending, got %+v", pending)
+	}
+
+	if len(progress) != 2 || progress[1] != (CampaignProgress{Campaign: "spring", Built: 2, Connected: 1}) {
+		t.Fatalf("unexpected campaign progress %+v", progress)
+	}
+
+	pending, progress, err = PendingDownloads("spring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || len(progress) != 1 {
+		t.Fatalf("filter on campaign did not apply, got %+v %+v", pending, progress)
+	}
+}
+
+func TestReplaceDownload(t *testing.T) {
+	if err := LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	for _, p := range []string{oldPath, newPath} {
+		if err := os.WriteFile(p, []byte(p), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CreateDownload(Download{UrlPath: "a", FilePath: oldPath, Fingerprint: "aaaa", Hits: 3, AutoRebuild: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateDownload(Download{UrlPath: "b", FilePath: filepath.Join(dir, "b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReplaceDownload(Download{UrlPath: "a", FilePath: newPath, Fingerprint: "bbbb", AutoRebuild: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := GetDownload("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.FilePath != newPath || d.Fingerprint != "bbbb" || d.Hits != 3 {
+		t.Fatalf("replacement did not keep hits or take the new build, got %+v", d)
+	}
+
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Fatalf("old build was not removed: %v", err)
+	}
+
+	rebuild, err := AutoRebuildDownloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rebuild) != 1 || rebuild[0].UrlPath != "a" {
+		t.Fatalf("expected only a to be rebuilt, got %+v", rebuild)
+	}
+
+	if err := ReplaceDownload(Download{UrlPath: "missing"}); err == nil {
+		t.Fatal("replacing a link that does not exist should fail")
+	}
+}
@@ -0,0 +1,58 @@
+package data
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// KnownHost is a host key a client checks onward ssh connections against, see the known-hosts command
+type KnownHost struct {
+	gorm.Model
+
+	// Key fingerprint of the client
+	Client  string `gorm:"uniqueIndex:idx_known_host"`
+	Host    string `gorm:"uniqueIndex:idx_known_host"`
+	KeyType string `gorm:"uniqueIndex:idx_known_host"`
+	// Authorized key format
+	Key string
+
+	// Recorded the first time a client saw it rather than added by an operator
+	Learned bool
+}
+
+func SaveKnownHost(k KnownHost) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing KnownHost
+		err := tx.Where("client = ? AND host = ? AND key_type = ?", k.Client, k.Host, k.KeyType).First(&existing).Error
+		if err == nil {
+			return tx.Model(&existing).Updates(map[string]any{"key": k.Key, "learned": k.Learned}).Error
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return tx.Create(&k).Error
+	})
+}
+
+// DeleteKnownHosts removes every key pinned for host on client, false if there were none
+func DeleteKnownHosts(client, host string) (bool, error) {
+	result := db.Unscoped().Where("client = ? AND host = ?", client, host).Delete(&KnownHost{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetKnownHosts returns the keys client checks, an empty client gets every client's
+func GetKnownHosts(client string) ([]KnownHost, error) {
+	query := db.Order("client").Order("host").Order("key_type")
+	if client != "" {
+		query = query.Where("client = ?", client)
+	}
+
+	var hosts []KnownHost
+	if err := query.Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
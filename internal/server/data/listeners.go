@@ -0,0 +1,74 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Listener is a listen --on that is restored when the server restarts or the client reconnects
+type Listener struct {
+	gorm.Model
+
+	// Operator that started the listener
+	Owner string
+
+	// Empty for server listeners, the key fingerprint of the client otherwise, or the client pattern for automatic listeners
+	Client string
+	Auto   bool
+
+	// As given to listen, e.g :8080 or pipe:name
+	Address string
+}
+
+func SaveListener(l Listener) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing Listener
+		err := tx.Where("client = ? AND auto = ? AND address = ?", l.Client, l.Auto, l.Address).First(&existing).Error
+		if err == nil {
+			return tx.Model(&existing).Update("owner", l.Owner).Error
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return tx.Create(&l).Error
+	})
+}
+
+func DeleteListener(client string, auto bool, address string) error {
+	return db.Where("client = ? AND auto = ? AND address = ?", client, auto, address).Delete(&Listener{}).Error
+}
+
+func GetListeners() ([]Listener, error) {
+	var listeners []Listener
+	if err := db.Order("client, address").Find(&listeners).Error; err != nil {
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// CountListeners is how many listeners an operator has saved, for their forward quota
+func CountListeners(owner string) (int, error) {
+	var count int64
+	if err := db.Model(&Listener{}).Where("owner = ?", owner).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// TouchClientListeners marks the listeners of a client as just used, their UpdatedAt is when the client was last seen
+func TouchClientListeners(fingerprint string) error {
+	return db.Model(&Listener{}).Where("client = ? AND auto = ?", fingerprint, false).Update("updated_at", time.Now()).Error
+}
+
+// GetClientListeners returns the listeners to start on a client with the given key fingerprint
+func GetClientListeners(fingerprint string) ([]Listener, error) {
+	var listeners []Listener
+	if err := db.Where("client = ? AND auto = ?", fingerprint, false).Find(&listeners).Error; err != nil {
+		return nil, err
+	}
+	return listeners, nil
+}
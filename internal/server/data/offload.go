@@ -0,0 +1,136 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/storage"
+)
+
+// OffloadDownload moves a build, and its compressed copies, to object storage if offloading is on. The local files are removed
+func OffloadDownload(ctx context.Context, f *Download) error {
+	backend := storage.Offload()
+	if backend == nil {
+		return nil
+	}
+
+	// Compressed now, as there is no local original to compress from later
+	for _, encoding := range DownloadEncodings {
+		if _, err := CompressedDownload(*f, encoding); err != nil {
+			return err
+		}
+	}
+
+	key := path.Join("builds", filepath.Base(f.FilePath))
+
+	extensions := []string{""}
+	for _, encoding := range DownloadEncodings {
+		extensions = append(extensions, downloadExtensions[encoding])
+	}
+
+	for _, extension := range extensions {
+		if err := upload(ctx, backend, key+extension, f.FilePath+extension); err != nil {
+			return fmt.Errorf("unable to offload build to %s: %w", backend, err)
+		}
+	}
+
+	for _, extension := range extensions {
+		os.Remove(f.FilePath + extension)
+	}
+
+	f.StorageKey = key
+
+	return nil
+}
+
+func upload(ctx context.Context, backend storage.Backend, key, localPath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return backend.Put(ctx, key, file, info.Size())
+}
+
+// OpenDownload opens a build for reading, compressed with encoding if it is not empty, wherever it is stored
+func OpenDownload(f Download, encoding string) (io.ReadCloser, error) {
+	if f.StorageKey == "" {
+		path := f.FilePath
+		if encoding != "" {
+			var err error
+			path, err = CompressedDownload(f, encoding)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return os.Open(path)
+	}
+
+	extension := ""
+	if encoding != "" {
+		var ok bool
+		extension, ok = downloadExtensions[encoding]
+		if !ok {
+			return nil, fmt.Errorf("unsupported download encoding %q", encoding)
+		}
+	}
+
+	backend := storage.Offload()
+	if backend == nil {
+		return nil, fmt.Errorf("%s is in object storage (%s) but the server was started without --storage", f.UrlPath, f.StorageKey)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body, err := backend.Get(ctx, f.StorageKey+extension)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &cancelOnClose{ReadCloser: body, cancel: cancel}, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func deleteOffloaded(f Download) error {
+	backend := storage.Offload()
+	if backend == nil {
+		return fmt.Errorf("link removed, but %s is in object storage and the server was started without --storage so it was left there", f.StorageKey)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var errs []error
+	if err := backend.Delete(ctx, f.StorageKey); err != nil {
+		errs = append(errs, err)
+	}
+	for _, extension := range downloadExtensions {
+		if err := backend.Delete(ctx, f.StorageKey+extension); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
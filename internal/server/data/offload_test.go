@@ -0,0 +1,121 @@
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/storage"
+)
+
+type memoryBackend struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memoryBackend) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.objects[key] = content
+	return nil
+}
+
+func (m *memoryBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	content, ok := m.objects[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (m *memoryBackend) Delete(ctx context.Context, key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memoryBackend) SetExpiry(ctx context.Context, days int) error {
+	return nil
+}
+
+func (m *memoryBackend) String() string {
+	return "memory"
+}
+
+func TestOffloadDownload(t *testing.T) {
+	if err := LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &memoryBackend{objects: map[string][]byte{}}
+	storage.SetOffload(backend)
+	t.Cleanup(func() { storage.SetOffload(nil) })
+
+	original := bytes.Repeat([]byte("offloaded client "), 1024)
+
+	f := Download{UrlPath: "offloaded", FilePath: filepath.Join(t.TempDir(), "client")}
+	if err := os.WriteFile(f.FilePath, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := OffloadDownload(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.StorageKey != "builds/client" || len(backend.objects) != 1+len(DownloadEncodings) {
+		t.Fatalf("expected the build and its compressed copies in storage, got key %q and %d objects", f.StorageKey, len(backend.objects))
+	}
+
+	if _, err := os.Stat(f.FilePath); !os.IsNotExist(err) {
+		t.Fatal("local copy was left after offloading")
+	}
+
+	r, err := OpenDownload(f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(content, original) {
+		t.Fatal("offloaded build does not match the original")
+	}
+
+	r, err = OpenDownload(f, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = io.ReadAll(gz)
+	r.Close()
+	if !bytes.Equal(content, original) {
+		t.Fatal("offloaded gzip copy does not decompress to the original")
+	}
+
+	if err := CreateDownload(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteDownload(f.UrlPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.objects) != 0 {
+		t.Fatalf("removing the link left %d objects in storage", len(backend.objects))
+	}
+}
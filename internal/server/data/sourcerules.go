@@ -0,0 +1,45 @@
+package data
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// SourceRule is a network added with client-sources that connections are or are not accepted from
+type SourceRule struct {
+	gorm.Model
+
+	Network string `gorm:"uniqueIndex"`
+	Deny    bool
+}
+
+func SaveSourceRule(r SourceRule) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing SourceRule
+		err := tx.Where("network = ?", r.Network).First(&existing).Error
+		if err == nil {
+			return tx.Model(&existing).Update("deny", r.Deny).Error
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return tx.Create(&r).Error
+	})
+}
+
+// DeleteSourceRule removes the rule for network, false if there was not one
+func DeleteSourceRule(network string) (bool, error) {
+	result := db.Unscoped().Where("network = ?", network).Delete(&SourceRule{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func GetSourceRules() ([]SourceRule, error) {
+	var rules []SourceRule
+	if err := db.Order("network").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
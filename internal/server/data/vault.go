@@ -0,0 +1,58 @@
+package data
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// VaultSecret is an operator's credential for an onward system, sealed with a key only the running server has, see the vault package
+type VaultSecret struct {
+	gorm.Model
+
+	Owner string `gorm:"uniqueIndex:idx_vault_secret"`
+	Name  string `gorm:"uniqueIndex:idx_vault_secret"`
+
+	// password, key or token
+	Kind string
+	User string
+
+	Nonce  []byte
+	Sealed []byte
+}
+
+func SaveVaultSecret(s VaultSecret) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing VaultSecret
+		err := tx.Where("owner = ? AND name = ?", s.Owner, s.Name).First(&existing).Error
+		if err == nil {
+			return tx.Model(&existing).Updates(map[string]any{"kind": s.Kind, "user": s.User, "nonce": s.Nonce, "sealed": s.Sealed}).Error
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return tx.Create(&s).Error
+	})
+}
+
+// DeleteVaultSecret removes owner's secret called name, false if there was not one
+func DeleteVaultSecret(owner, name string) (bool, error) {
+	result := db.Unscoped().Where("owner = ? AND name = ?", owner, name).Delete(&VaultSecret{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func GetVaultSecret(owner, name string) (VaultSecret, error) {
+	var s VaultSecret
+	err := db.Where("owner = ? AND name = ?", owner, name).First(&s).Error
+	return s, err
+}
+
+func GetVaultSecrets(owner string) ([]VaultSecret, error) {
+	var secrets []VaultSecret
+	if err := db.Where("owner = ?", owner).Order("name").Find(&secrets).Error; err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/NHAS/reverse_ssh/internal/nat"
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
+)
+
+// DERPRelayConfig runs a DERP relay inside the server, so ts clients do not depend on tailscale's relays
+type DERPRelayConfig struct {
+	Listen string
+
+	// Already open listener to use instead of listening on Listen, e.g one passed in by systemd
+	Listener net.Listener
+
+	// host:port clients reach the relay on
+	Address string
+
+	// Without these the relay uses a self signed certificate, clients check it by its key instead
+	TLSCertPath, TLSKeyPath string
+}
+
+var derpRelayConfig *DERPRelayConfig
+
+// EnableDERPRelay starts the embedded relay when the server runs, ts tokens then point at it instead of the public DERP map
+func EnableDERPRelay(config DERPRelayConfig) {
+	derpRelayConfig = &config
+}
+
+func startDERPRelay(ctx context.Context, config DERPRelayConfig) (*nat.PrivateRelay, error) {
+	privateKeyBytes := hostkey.PrivateBytes()
+	if privateKeyBytes == nil {
+		return nil, errors.New("server private key is not loaded")
+	}
+
+	relayPrivate, relayPublic, err := nat.DeriveRelayIdentity(privateKeyBytes)
+	if err != nil {
+		secure.Zero(privateKeyBytes)
+		return nil, err
+	}
+	defer secure.Zero(relayPrivate[:])
+
+	servicePrivate, servicePublic, err := nat.DeriveDERPIdentity(privateKeyBytes)
+	secure.Zero(privateKeyBytes, servicePrivate[:])
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address %q: %w", config.Address, err)
+	}
+
+	var certificate tls.Certificate
+	if config.TLSCertPath != "" {
+		certificate, err = tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath)
+	} else {
+		certificate, err = nat.SelfSignedCertificate(host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load relay certificate: %w", err)
+	}
+
+	l := config.Listener
+	if l == nil {
+		l, err = net.Listen("tcp", config.Listen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	relay := nat.NewDERPServer(relayPrivate, servicePublic)
+	context.AfterFunc(ctx, relay.Close)
+
+	go func() {
+		if err := relay.Serve(l, certificate); err != nil {
+			log.Printf("derp relay stopped: %s", err)
+		}
+	}()
+
+	// The server reaches its own relay locally, it may not be able to reach its external address
+	localHost, _, _ := net.SplitHostPort(config.Listen)
+	if ip := net.ParseIP(localHost); localHost == "" || (ip != nil && ip.IsUnspecified()) {
+		localHost = "127.0.0.1"
+		// An IPv6 only host may have no IPv4 listener to reach
+		if ip != nil && ip.To4() == nil {
+			localHost = "::1"
+		}
+	}
+	_, listenPort, _ := net.SplitHostPort(l.Addr().String())
+
+	log.Printf("DERP relay listening on %s, advertised to clients as %s", l.Addr(), net.JoinHostPort(host, port))
+
+	return &nat.PrivateRelay{
+		Address:      config.Address,
+		Key:          relayPublic,
+		LocalAddress: net.JoinHostPort(localHost, listenPort),
+	}, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"log"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/audit"
+	"github.com/NHAS/reverse_ssh/internal/server/contentfilter"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+// recordDownload writes a download event to the access log, one json object per line, and keeps downloads in the database for attribution
+func recordDownload(dataDir string, d observers.Download) {
+	// The only part the downloader chooses
+	d.UserAgent = contentfilter.RedactString(d.UserAgent, "access.log")
+
+	line, err := d.Json()
+	if err != nil {
+		log.Println("unable to encode download event:", err)
+		return
+	}
+
+	if err := audit.Append(filepath.Join(dataDir, "access.log"), append(line, '\n')); err != nil {
+		log.Println("unable to write to access log:", err)
+	}
+
+	if d.Status != "downloaded" {
+		return
+	}
+
+	err = data.RecordDownloadEvent(data.DownloadEvent{
+		UrlPath:      d.Link,
+		Fingerprint:  d.Fingerprint,
+		Method:       d.Method,
+		Encoding:     d.Encoding,
+		IP:           d.IP,
+		UserAgent:    d.UserAgent,
+		DownloadedAt: d.Timestamp,
+	})
+	if err != nil {
+		log.Println("unable to record download:", err)
+	}
+}
+
+// attributeDownload works out which download a newly connected client came from
+func attributeDownload(id, hostname, fingerprint string, remoteAddr net.Addr, log logger.Logger) {
+	if err := data.MarkDownloadConnected(fingerprint); err != nil {
+		log.Error("unable to mark build as connected: %s", err)
+	}
+
+	var ip string
+	if isSourceTrusted(remoteAddr.Network()) {
+		// Pivoted and relayed clients can only be matched on their key
+		if addr := getIP(remoteAddr.String()); addr != nil {
+			ip = addr.String()
+		}
+	}
+
+	event, found, err := data.AttributeDownload(fingerprint, ip, id, hostname)
+	if err != nil {
+		log.Error("unable to attribute client to a download: %s", err)
+		return
+	}
+
+	if !found {
+		return
+	}
+
+	d := observers.Download{
+		Status:      "attributed",
+		Link:        event.UrlPath,
+		Fingerprint: event.Fingerprint,
+		Method:      event.Method,
+		Encoding:    event.Encoding,
+		IP:          event.IP,
+		UserAgent:   event.UserAgent,
+		ID:          id,
+		HostName:    hostname,
+		Timestamp:   time.Now(),
+	}
+
+	log.Info("%s", d.Summary())
+
+	observers.Downloads.Notify(d)
+}
@@ -0,0 +1,344 @@
+package eventbus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+)
+
+// Publisher sends events to a message bus, Publish is never called concurrently
+type Publisher interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Close() error
+
+	String() string
+}
+
+// How events are serialised
+const (
+	// {"type", "summary", "time", "event"} with event being the same json webhooks get
+	SchemaJSON = "json"
+	// A CloudEvents 1.0 structured mode envelope around the event
+	SchemaCloudEvents = "cloudevents"
+	// Just the event
+	SchemaRaw = "raw"
+)
+
+// DefaultTopic is where events go when no topic is given, {type} is replaced with the event type
+const DefaultTopic = "rssh.{type}"
+
+// Event types, what {type} is replaced with
+var eventTypes = []string{"connection", "network", "download", "anchor", "build", "command", "content", "reclaim"}
+
+// Safe as both a kafka topic and a nats subject
+var validTopic = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+const publishTimeout = 5 * time.Second
+
+var (
+	lck sync.Mutex
+
+	publisher Publisher
+	topic     = DefaultTopic
+	schema    = SchemaJSON
+)
+
+type event interface {
+	Json() ([]byte, error)
+	Summary() string
+}
+
+// Parse reads a publisher from a uri, nats://[user:pass@|token@]host[:port] or kafka://[user:pass@]broker[:port][,broker...].
+// Both take a tls parameter to connect with TLS, kafka credentials are sent with SASL PLAIN
+func Parse(uri string) (Publisher, error) {
+	// url.Parse does not take a list of hosts, so kafka brokers are taken out first
+	var brokers string
+	if rest, ok := strings.CutPrefix(uri, "kafka://"); ok {
+		end := strings.IndexAny(rest, "/?")
+		if end == -1 {
+			end = len(rest)
+		}
+
+		authority := rest[:end]
+		userinfo := authority[:strings.LastIndex(authority, "@")+1]
+		brokers = authority[len(userinfo):]
+
+		uri = "kafka://" + userinfo + "brokers" + rest[end:]
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("event bus %q is not a url: %w", uri, err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("event bus %q has no host", uri)
+	}
+
+	useTLS := u.Query().Has("tls")
+
+	switch u.Scheme {
+	case "nats":
+		n := &NATS{
+			addr: withDefaultPort(u.Host, "4222"),
+			tls:  useTLS,
+		}
+
+		if u.User != nil {
+			password, hasPassword := u.User.Password()
+			if hasPassword {
+				n.user, n.pass = u.User.Username(), password
+			} else {
+				n.token = u.User.Username()
+			}
+		}
+
+		return n, nil
+	case "kafka":
+		k := &Kafka{
+			tls: useTLS,
+		}
+
+		for _, broker := range strings.Split(brokers, ",") {
+			if broker == "" {
+				continue
+			}
+			k.brokers = append(k.brokers, withDefaultPort(broker, "9092"))
+		}
+
+		if u.User != nil {
+			k.user = u.User.Username()
+			k.pass, _ = u.User.Password()
+		}
+
+		if len(k.brokers) == 0 {
+			return nil, errors.New("kafka event bus needs at least one broker, e.g kafka://broker:9092")
+		}
+
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("unsupported event bus %q, use nats:// or kafka://", u.Scheme)
+}
+
+func withDefaultPort(host, port string) string {
+	// A bare IPv6 address is all colons, so it needs brackets before the port can be told apart
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.LastIndex(host, ":") > strings.LastIndex(host, "]") {
+		return host
+	}
+	return host + ":" + port
+}
+
+// Configure makes Start publish to p, topicTemplate may contain {type} to put each type of event on its own topic
+func Configure(p Publisher, topicTemplate, schemaName string) error {
+	if topicTemplate == "" {
+		topicTemplate = DefaultTopic
+	}
+
+	for _, t := range eventTypes {
+		if name := topicName(topicTemplate, t); !validTopic.MatchString(name) {
+			return fmt.Errorf("event topic %q is not valid, topics may only have letters, numbers, '.', '_' and '-'", name)
+		}
+	}
+
+	if schemaName == "" {
+		schemaName = SchemaJSON
+	}
+
+	switch schemaName {
+	case SchemaJSON, SchemaCloudEvents, SchemaRaw:
+	default:
+		return fmt.Errorf("unknown event schema %q, use json, cloudevents or raw", schemaName)
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	publisher = p
+	topic = topicTemplate
+	schema = schemaName
+
+	return nil
+}
+
+func topicName(template, eventType string) string {
+	return strings.ReplaceAll(template, "{type}", eventType)
+}
+
+func typeOf(e event) string {
+	switch e.(type) {
+	case observers.ClientState:
+		return "connection"
+	case observers.ClientNetworkChange:
+		return "network"
+	case observers.Download:
+		return "download"
+	case observers.AuditAnchor:
+		return "anchor"
+	case observers.Build:
+		return "build"
+	case observers.Command:
+		return "command"
+	case observers.ContentMatch:
+		return "content"
+	case observers.Reclaim:
+		return "reclaim"
+	}
+
+	return "unknown"
+}
+
+func encode(schemaName, eventType string, e event, now time.Time) ([]byte, error) {
+	full, err := e.Json()
+	if err != nil {
+		return nil, err
+	}
+
+	switch schemaName {
+	case SchemaRaw:
+		return full, nil
+	case SchemaCloudEvents:
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(struct {
+			SpecVersion     string          `json:"specversion"`
+			ID              string          `json:"id"`
+			Source          string          `json:"source"`
+			Type            string          `json:"type"`
+			Time            time.Time       `json:"time"`
+			Subject         string          `json:"subject"`
+			DataContentType string          `json:"datacontenttype"`
+			Data            json.RawMessage `json:"data"`
+		}{
+			SpecVersion:     "1.0",
+			ID:              hex.EncodeToString(id),
+			Source:          "rssh",
+			Type:            "rssh." + eventType,
+			Time:            now.UTC(),
+			Subject:         e.Summary(),
+			DataContentType: "application/json",
+			Data:            full,
+		})
+	}
+
+	return json.Marshal(struct {
+		Type    string          `json:"type"`
+		Summary string          `json:"summary"`
+		Time    time.Time       `json:"time"`
+		Event   json.RawMessage `json:"event"`
+	}{
+		Type:    eventType,
+		Summary: e.Summary(),
+		Time:    now.UTC(),
+		Event:   full,
+	})
+}
+
+// Start publishes server events (connections, network changes, downloads, audit anchors, builds and console commands) until ctx is done, it does nothing if no publisher is configured
+func Start(ctx context.Context) {
+	lck.Lock()
+	p, topicTemplate, schemaName := publisher, topic, schema
+	lck.Unlock()
+
+	if p == nil {
+		return
+	}
+
+	// Events are published one at a time so a slow bus does not open a connection per event
+	messages := make(chan event, 256)
+
+	send := func(message event) {
+		select {
+		case messages <- message:
+		case <-ctx.Done():
+		}
+	}
+
+	connectionID := observers.ConnectionState.Register(func(message observers.ClientState) {
+		send(message)
+	})
+
+	networkID := observers.NetworkChange.Register(func(message observers.ClientNetworkChange) {
+		send(message)
+	})
+
+	downloadID := observers.Downloads.Register(func(message observers.Download) {
+		send(message)
+	})
+
+	anchorID := observers.AuditAnchors.Register(func(message observers.AuditAnchor) {
+		send(message)
+	})
+
+	buildID := observers.Builds.Register(func(message observers.Build) {
+		send(message)
+	})
+
+	commandID := observers.Commands.Register(func(message observers.Command) {
+		send(message)
+	})
+
+	contentID := observers.ContentMatches.Register(func(message observers.ContentMatch) {
+		send(message)
+	})
+
+	reclaimID := observers.Reclaims.Register(func(message observers.Reclaim) {
+		send(message)
+	})
+
+	defer observers.ConnectionState.Deregister(connectionID)
+	defer observers.NetworkChange.Deregister(networkID)
+	defer observers.Downloads.Deregister(downloadID)
+	defer observers.AuditAnchors.Deregister(anchorID)
+	defer observers.Builds.Deregister(buildID)
+	defer observers.Commands.Deregister(commandID)
+	defer observers.ContentMatches.Deregister(contentID)
+	defer observers.Reclaims.Deregister(reclaimID)
+
+	defer p.Close()
+
+	log.Printf("Publishing events to %s (topic %s, schema %s)", p, topicTemplate, schemaName)
+
+	for {
+		var msg event
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-messages:
+		}
+
+		eventType := typeOf(msg)
+
+		payload, err := encode(schemaName, eventType, msg, time.Now())
+		if err != nil {
+			log.Println("Bad event bus message: ", err)
+			continue
+		}
+
+		publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		err = p.Publish(publishCtx, topicName(topicTemplate, eventType), payload)
+		cancel()
+
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Error publishing %s event to %s: %s\n", eventType, p, err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package eventbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+)
+
+func TestParse(t *testing.T) {
+	p, err := Parse("kafka://user:pass@a:9093,b?tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := p.(*Kafka)
+	if strings.Join(k.brokers, " ") != "a:9093 b:9092" || !k.tls || k.user != "user" || k.pass != "pass" {
+		t.Fatalf("kafka uri parsed as %+v", k)
+	}
+
+	p, err = Parse("nats://secret@localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := p.(*NATS)
+	if n.addr != "localhost:4222" || n.token != "secret" || n.user != "" {
+		t.Fatalf("nats uri parsed as %+v", n)
+	}
+
+	if err := Configure(p, "rssh events", SchemaJSON); err == nil {
+		t.Fatal("topic with a space was accepted")
+	}
+
+	for host, want := range map[string]string{"::1": "[::1]:4222", "[::1]": "[::1]:4222", "[::1]:4223": "[::1]:4223", "10.0.0.1": "10.0.0.1:4222"} {
+		if got := withDefaultPort(host, "4222"); got != want {
+			t.Fatalf("%s with the default port added is %s, expected %s", host, got, want)
+		}
+	}
+}
+
+func TestNATSPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	published := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"auth_required\":true}\r\n")
+
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch {
+			case strings.HasPrefix(line, "CONNECT "):
+				if !strings.Contains(line, `"auth_token":"secret"`) {
+					fmt.Fprint(conn, "-ERR 'Authorization Violation'\r\n")
+					return
+				}
+			case line == "PING\r\n":
+				fmt.Fprint(conn, "PONG\r\n")
+			case strings.HasPrefix(line, "PUB "):
+				fields := strings.Fields(line)
+				size, _ := strconv.Atoi(fields[2])
+
+				payload := make([]byte, size+2)
+				io.ReadFull(r, payload)
+
+				published <- fields[1] + " " + string(payload[:size])
+			}
+		}
+	}()
+
+	p, err := Parse("nats://secret@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := p.Publish(ctx, "rssh.connection", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-published:
+		if got != `rssh.connection {"a":1}` {
+			t.Fatalf("server got %q", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("nothing was published")
+	}
+}
+
+// fakeKafka answers metadata with itself as the leader of partitions 0 and 1 and sends back the partition and value of each produced record
+func fakeKafka(t *testing.T, l net.Listener, records chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go fakeKafkaConn(t, l, conn, records)
+	}
+}
+
+func fakeKafkaConn(t *testing.T, l net.Listener, conn net.Conn, records chan<- string) {
+	defer conn.Close()
+
+	host, portString, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+
+		r := kafkaReader{b: request}
+		apiKey := r.int16()
+		r.int16() // Version
+		correlation := r.int32()
+		r.string() // Client id
+
+		var response kafkaWriter
+		response.int32(correlation)
+
+		switch apiKey {
+		case kafkaMetadata:
+			r.int32()
+			topic := r.string()
+
+			response.int32(1)
+			response.int32(7)
+			response.string(host)
+			response.int32(int32(port))
+			response.int16(-1)
+			response.int32(7)
+			response.int32(1)
+			response.int16(0)
+			response.string(topic)
+			response.int8(0)
+			response.int32(2)
+			for partition := int32(0); partition < 2; partition++ {
+				response.int16(0)
+				response.int32(partition)
+				response.int32(7)
+				response.int32(0)
+				response.int32(0)
+			}
+		case kafkaProduce:
+			r.int16() // Transactional id
+			r.int16() // Acks
+			r.int32() // Timeout
+			r.int32()
+			topic := r.string()
+			r.int32()
+			partition := r.int32()
+			batch := r.next(int(r.int32()))
+
+			b := kafkaReader{b: batch}
+			b.int64()
+			b.int32()
+			b.int32()
+			if magic := b.int8(); magic != 2 {
+				t.Errorf("record batch magic %d", magic)
+			}
+			crc := uint32(b.int32())
+			if crc != crc32.Checksum(b.b, crc32.MakeTable(crc32.Castagnoli)) {
+				t.Error("record batch crc does not match")
+			}
+
+			// The value is the end of the batch but for the record's header count
+			body := b.b[len(b.b)-1-len(`{"n":0}`) : len(b.b)-1]
+			records <- fmt.Sprintf("%s/%d %s", topic, partition, body)
+
+			response.int32(1)
+			response.string(topic)
+			response.int32(1)
+			response.int32(partition)
+			response.int16(0)
+			response.int64(0)
+			response.int64(-1)
+			response.int32(0)
+		default:
+			t.Errorf("unexpected kafka api %d", apiKey)
+			return
+		}
+
+		frame := response.Bytes()
+		conn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame))))
+		conn.Write(frame)
+	}
+}
+
+func TestKafkaPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	records := make(chan string, 2)
+	go fakeKafka(t, l, records)
+
+	p, err := Parse("kafka://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		if err := p.Publish(ctx, "rssh.build", []byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := <-records, fmt.Sprintf(`rssh.build/%d {"n":%d}`, i, i); got != want {
+			t.Fatalf("broker got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestEncodeSchemas(t *testing.T) {
+	event := observers.Command{User: "alice", Line: "ls", Source: "console"}
+
+	for _, schemaName := range []string{SchemaJSON, SchemaCloudEvents, SchemaRaw} {
+		payload, err := encode(schemaName, typeOf(event), event, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded map[string]any
+		if err := json.Unmarshal(payload, &decoded); err != nil {
+			t.Fatalf("%s: %s", schemaName, err)
+		}
+
+		var user any
+		switch schemaName {
+		case SchemaJSON:
+			user = decoded["event"].(map[string]any)["User"]
+		case SchemaCloudEvents:
+			if decoded["type"] != "rssh.command" {
+				t.Errorf("cloudevents type %v", decoded["type"])
+			}
+			user = decoded["data"].(map[string]any)["User"]
+		case SchemaRaw:
+			user = decoded["User"]
+		}
+
+		if user != "alice" {
+			t.Errorf("%s: event not in payload %s", schemaName, payload)
+		}
+	}
+}
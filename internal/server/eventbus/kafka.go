@@ -0,0 +1,599 @@
+package eventbus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kafka is a minimal producer, it finds partition leaders with Metadata v1 and sends one record per Produce v3 (kafka 0.11 and later) with acks from the leader.
+// Events are spread over a topic's partitions round robin
+type Kafka struct {
+	brokers []string
+	tls     bool
+
+	// SASL PLAIN when set
+	user, pass string
+
+	mu          sync.Mutex
+	correlation int32
+
+	// By node id, bootstrapNode is whichever broker from the uri answered
+	conns   map[int32]*kafkaConn
+	nodes   map[int32]string
+	leaders map[string][]kafkaPartition
+	next    map[string]int
+}
+
+const bootstrapNode = -1
+
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSASLHandshake    = 17
+	kafkaSASLAuthenticate = 36
+)
+
+// How many times a record is tried, with fresh metadata each time, before it is dropped
+const kafkaAttempts = 3
+
+// Records are small, anything claiming to be bigger than this is not a kafka response
+const maxKafkaResponse = 16 << 20
+
+type kafkaPartition struct {
+	id     int32
+	leader int32
+}
+
+type kafkaConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	switch e {
+	case 3:
+		return "kafka: unknown topic or partition"
+	case 5:
+		return "kafka: leader not available"
+	case 6:
+		return "kafka: not leader for partition"
+	case 7:
+		return "kafka: request timed out"
+	case 10:
+		return "kafka: message too large"
+	case 29:
+		return "kafka: topic authorization failed"
+	case 33:
+		return "kafka: unsupported sasl mechanism"
+	case 58:
+		return "kafka: sasl authentication failed"
+	}
+	return "kafka: error code " + strconv.Itoa(int(e))
+}
+
+func (k *Kafka) String() string {
+	return "kafka://" + strings.Join(k.brokers, ",")
+}
+
+func (k *Kafka) Publish(ctx context.Context, topic string, payload []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < kafkaAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(250 * time.Millisecond):
+			}
+		}
+
+		if err = k.produce(ctx, topic, payload); err == nil {
+			return nil
+		}
+
+		// Leaders move and topics take a moment to be auto created, anything else will not be fixed by trying again
+		var kerr kafkaError
+		if errors.As(err, &kerr) && kerr != 3 && kerr != 5 && kerr != 6 && kerr != 7 {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (k *Kafka) produce(ctx context.Context, topic string, payload []byte) error {
+	partitions, err := k.partitions(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	if k.next == nil {
+		k.next = map[string]int{}
+	}
+	partition := partitions[k.next[topic]%len(partitions)]
+	k.next[topic]++
+
+	conn, err := k.broker(ctx, partition.leader)
+	if err != nil {
+		delete(k.leaders, topic)
+		return err
+	}
+
+	response, err := k.roundTrip(ctx, conn, kafkaProduce, 3, produceRequest(topic, partition.id, payload, time.Now()))
+	if err != nil {
+		k.drop(partition.leader)
+		delete(k.leaders, topic)
+		return err
+	}
+
+	if err := parseProduceResponse(response); err != nil {
+		delete(k.leaders, topic)
+		return err
+	}
+
+	return nil
+}
+
+func (k *Kafka) partitions(ctx context.Context, topic string) ([]kafkaPartition, error) {
+	if p, ok := k.leaders[topic]; ok {
+		return p, nil
+	}
+
+	conn, node, err := k.anyBroker(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var request kafkaWriter
+	request.int32(1)
+	request.string(topic)
+
+	response, err := k.roundTrip(ctx, conn, kafkaMetadata, 1, request.Bytes())
+	if err != nil {
+		k.drop(node)
+		return nil, err
+	}
+
+	nodes, partitions, err := parseMetadataResponse(response, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.nodes == nil {
+		k.nodes = map[int32]string{}
+	}
+	for id, addr := range nodes {
+		k.nodes[id] = addr
+	}
+
+	if k.leaders == nil {
+		k.leaders = map[string][]kafkaPartition{}
+	}
+	k.leaders[topic] = partitions
+
+	return partitions, nil
+}
+
+// anyBroker is a connection to ask for metadata on, an existing one if there is one
+func (k *Kafka) anyBroker(ctx context.Context) (*kafkaConn, int32, error) {
+	for id, conn := range k.conns {
+		return conn, id, nil
+	}
+
+	var errs []error
+	for _, addr := range k.brokers {
+		conn, err := k.dial(ctx, addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		k.conns[bootstrapNode] = conn
+		return conn, bootstrapNode, nil
+	}
+
+	return nil, 0, fmt.Errorf("no kafka broker could be reached: %w", errors.Join(errs...))
+}
+
+func (k *Kafka) broker(ctx context.Context, id int32) (*kafkaConn, error) {
+	if conn, ok := k.conns[id]; ok {
+		return conn, nil
+	}
+
+	addr, ok := k.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("kafka broker %d is not in the cluster metadata", id)
+	}
+
+	conn, err := k.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	k.conns[id] = conn
+	return conn, nil
+}
+
+func (k *Kafka) dial(ctx context.Context, addr string) (*kafkaConn, error) {
+	if k.conns == nil {
+		k.conns = map[int32]*kafkaConn{}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.tls {
+		host, _, _ := net.SplitHostPort(addr)
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c := &kafkaConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	if k.user != "" {
+		if err := k.authenticate(ctx, c); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (k *Kafka) authenticate(ctx context.Context, conn *kafkaConn) error {
+	var handshake kafkaWriter
+	handshake.string("PLAIN")
+
+	response, err := k.roundTrip(ctx, conn, kafkaSASLHandshake, 1, handshake.Bytes())
+	if err != nil {
+		return err
+	}
+
+	r := kafkaReader{b: response}
+	if code := r.int16(); r.err == nil && code != 0 {
+		return kafkaError(code)
+	}
+
+	var authenticate kafkaWriter
+	authenticate.bytes([]byte("\x00" + k.user + "\x00" + k.pass))
+
+	response, err = k.roundTrip(ctx, conn, kafkaSASLAuthenticate, 0, authenticate.Bytes())
+	if err != nil {
+		return err
+	}
+
+	r = kafkaReader{b: response}
+	code := r.int16()
+	message := r.nullableString()
+	if r.err != nil {
+		return r.err
+	}
+
+	if code != 0 {
+		if message != "" {
+			return fmt.Errorf("%w: %s", kafkaError(code), message)
+		}
+		return kafkaError(code)
+	}
+
+	return nil
+}
+
+func (k *Kafka) roundTrip(ctx context.Context, conn *kafkaConn, apiKey, version int16, body []byte) ([]byte, error) {
+	k.correlation++
+	correlation := k.correlation
+
+	var request kafkaWriter
+	request.int32(0) // Length, filled in below
+	request.int16(apiKey)
+	request.int16(version)
+	request.int32(correlation)
+	request.string("rssh")
+	request.Write(body)
+
+	frame := request.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := conn.Write(frame); err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(conn.r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > maxKafkaResponse {
+		return nil, fmt.Errorf("kafka response of %d bytes is not valid", size)
+	}
+
+	if got := int32(binary.BigEndian.Uint32(header[4:])); got != correlation {
+		return nil, fmt.Errorf("kafka response was for request %d not %d", got, correlation)
+	}
+
+	response := make([]byte, size-4)
+	if _, err := io.ReadFull(conn.r, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (k *Kafka) drop(id int32) {
+	if conn, ok := k.conns[id]; ok {
+		conn.Close()
+		delete(k.conns, id)
+	}
+}
+
+func (k *Kafka) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for id := range k.conns {
+		k.drop(id)
+	}
+
+	return nil
+}
+
+func produceRequest(topic string, partition int32, payload []byte, now time.Time) []byte {
+	var request kafkaWriter
+	request.int16(-1) // No transactional id
+	request.int16(1)  // Acknowledged by the leader
+	request.int32(int32(publishTimeout / time.Millisecond))
+	request.int32(1)
+	request.string(topic)
+	request.int32(1)
+	request.int32(partition)
+	request.bytes(recordBatch(payload, now))
+
+	return request.Bytes()
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// recordBatch is a v2 (magic 2) batch holding a single record with no key
+func recordBatch(payload []byte, now time.Time) []byte {
+	var record kafkaWriter
+	record.int8(0)    // Attributes
+	record.varint(0)  // Timestamp delta
+	record.varint(0)  // Offset delta
+	record.varint(-1) // No key
+	record.varint(int64(len(payload)))
+	record.Write(payload)
+	record.varint(0) // No headers
+
+	timestamp := now.UnixMilli()
+
+	// Everything the crc covers
+	var body kafkaWriter
+	body.int16(0) // Attributes, no compression
+	body.int32(0) // Last offset delta
+	body.int64(timestamp)
+	body.int64(timestamp)
+	body.int64(-1) // No producer id
+	body.int16(-1) // or epoch
+	body.int32(-1) // or sequence
+	body.int32(1)
+	body.varint(int64(record.Len()))
+	body.Write(record.Bytes())
+
+	var batch kafkaWriter
+	batch.int64(0) // Base offset, assigned by the broker
+	batch.int32(int32(4 + 1 + 4 + body.Len()))
+	batch.int32(-1) // Partition leader epoch
+	batch.int8(2)   // Magic
+	batch.int32(int32(crc32.Checksum(body.Bytes(), castagnoli)))
+	batch.Write(body.Bytes())
+
+	return batch.Bytes()
+}
+
+func parseMetadataResponse(response []byte, topic string) (map[int32]string, []kafkaPartition, error) {
+	r := kafkaReader{b: response}
+
+	nodes := map[int32]string{}
+	for i := r.int32(); i > 0 && r.err == nil; i-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.nullableString() // Rack
+
+		nodes[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	r.int32() // Controller
+
+	var partitions []kafkaPartition
+	for i := r.int32(); i > 0 && r.err == nil; i-- {
+		code := r.int16()
+		name := r.string()
+		r.int8() // Internal
+
+		for j := r.int32(); j > 0 && r.err == nil; j-- {
+			partitionCode := r.int16()
+			id := r.int32()
+			leader := r.int32()
+			r.int32s() // Replicas
+			r.int32s() // In sync replicas
+
+			if name == topic && partitionCode == 0 && leader >= 0 {
+				partitions = append(partitions, kafkaPartition{id: id, leader: leader})
+			}
+		}
+
+		if name == topic && code != 0 && r.err == nil {
+			return nil, nil, kafkaError(code)
+		}
+	}
+
+	if r.err != nil {
+		return nil, nil, fmt.Errorf("bad kafka metadata response: %w", r.err)
+	}
+
+	if len(partitions) == 0 {
+		return nil, nil, kafkaError(5)
+	}
+
+	return nodes, partitions, nil
+}
+
+func parseProduceResponse(response []byte) error {
+	r := kafkaReader{b: response}
+
+	for i := r.int32(); i > 0 && r.err == nil; i-- {
+		r.string() // Topic
+		for j := r.int32(); j > 0 && r.err == nil; j-- {
+			r.int32() // Partition
+			code := r.int16()
+			r.int64() // Base offset
+			r.int64() // Log append time
+
+			if code != 0 && r.err == nil {
+				return kafkaError(code)
+			}
+		}
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("bad kafka produce response: %w", r.err)
+	}
+
+	return nil
+}
+
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8) {
+	w.WriteByte(byte(v))
+}
+
+func (w *kafkaWriter) int16(v int16) {
+	w.Write(binary.BigEndian.AppendUint16(nil, uint16(v)))
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	w.Write(binary.BigEndian.AppendUint32(nil, uint32(v)))
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	w.Write(binary.BigEndian.AppendUint64(nil, uint64(v)))
+}
+
+// varint is zigzag encoded, as records use
+func (w *kafkaWriter) varint(v int64) {
+	w.Write(binary.AppendVarint(nil, v))
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.Write(b)
+}
+
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32s() {
+	for i := r.int32(); i > 0 && r.err == nil; i-- {
+		r.int32()
+	}
+}
+
+func (r *kafkaReader) string() string {
+	return string(r.next(int(r.int16())))
+}
+
+func (r *kafkaReader) nullableString() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
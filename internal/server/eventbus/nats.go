@@ -0,0 +1,210 @@
+package eventbus
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+// NATS publishes with the core nats text protocol, there are no acknowledgements so an event is delivered once it is written
+type NATS struct {
+	addr string
+	tls  bool
+
+	user, pass string
+	token      string
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func (n *NATS) String() string {
+	return "nats://" + n.addr
+}
+
+func (n *NATS) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("no INFO from nats server: %w", err)
+	}
+
+	infoJSON, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO ")
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("nats server sent %q instead of INFO", strings.TrimSpace(line))
+	}
+
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("bad INFO from nats server: %w", err)
+	}
+
+	if n.tls || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(n.addr)
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	connect, err := json.Marshal(struct {
+		Verbose   bool   `json:"verbose"`
+		Pedantic  bool   `json:"pedantic"`
+		Name      string `json:"name"`
+		Lang      string `json:"lang"`
+		Version   string `json:"version"`
+		User      string `json:"user,omitempty"`
+		Pass      string `json:"pass,omitempty"`
+		AuthToken string `json:"auth_token,omitempty"`
+	}{
+		Name:      "rssh",
+		Lang:      "go",
+		Version:   internal.Version,
+		User:      n.user,
+		Pass:      n.pass,
+		AuthToken: n.token,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// The PONG means the CONNECT was accepted, a rejected one gets -ERR
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return err
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			conn.SetDeadline(time.Time{})
+
+			n.conn = conn
+			n.w = bufio.NewWriter(conn)
+
+			go n.read(conn, r)
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			conn.Close()
+			return fmt.Errorf("nats server refused connection: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// read answers the server's keepalive PINGs, the connection is dropped on -ERR or when it closes and the next Publish reconnects
+func (n *NATS) read(conn net.Conn, r *bufio.Reader) {
+	defer func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		conn.Close()
+		if n.conn == conn {
+			n.conn = nil
+		}
+	}()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			n.mu.Lock()
+			if n.conn == conn {
+				n.w.WriteString("PONG\r\n")
+				n.w.Flush()
+			}
+			n.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("nats server %s: %s", n.addr, line)
+			return
+		}
+	}
+}
+
+func (n *NATS) Publish(ctx context.Context, topic string, payload []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		n.conn.SetWriteDeadline(deadline)
+	}
+
+	fmt.Fprintf(n.w, "PUB %s %d\r\n", topic, len(payload))
+	n.w.Write(payload)
+	n.w.WriteString("\r\n")
+
+	if err := n.w.Flush(); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (n *NATS) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		return nil
+	}
+
+	err := n.conn.Close()
+	n.conn = nil
+
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package failure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Code is a stable name for why a console command failed, so automation can branch on it instead of the message.
+// Codes and their exit statuses are never renamed or reused, only added to
+type Code string
+
+const (
+	// The error has not been given a code yet
+	Unknown Code = "unknown"
+
+	InvalidArgument      Code = "invalid-argument"
+	ClientNotFound       Code = "client-not-found"
+	PermissionDenied     Code = "permission-denied"
+	TransportUnavailable Code = "transport-unavailable"
+	BuildFailed          Code = "build-failed"
+	ClientBusy           Code = "client-busy"
+	QuotaExceeded        Code = "quota-exceeded"
+	// The client was reached but refused or does not support the request
+	ClientRefused Code = "client-refused"
+	NotFound      Code = "not-found"
+	// The operator said no at a confirmation prompt
+	Aborted Code = "aborted"
+)
+
+// Exit statuses for ssh server <command>, 1 is left for errors without a code
+var exitStatuses = map[Code]uint32{
+	Unknown:              1,
+	InvalidArgument:      2,
+	ClientNotFound:       3,
+	PermissionDenied:     4,
+	TransportUnavailable: 5,
+	BuildFailed:          6,
+	ClientBusy:           7,
+	QuotaExceeded:        8,
+	ClientRefused:        9,
+	NotFound:             10,
+	Aborted:              11,
+}
+
+func (c Code) ExitStatus() uint32 {
+	if status, ok := exitStatuses[c]; ok {
+		return status
+	}
+	return 1
+}
+
+// Codes lists every code, for documentation
+func Codes() []Code {
+	return []Code{Unknown, InvalidArgument, ClientNotFound, PermissionDenied, TransportUnavailable, BuildFailed, ClientBusy, QuotaExceeded, ClientRefused, NotFound, Aborted}
+}
+
+type Error struct {
+	Code    Code
+	Message string
+	// Anything automation might need to act on the failure, e.g the client or flag involved
+	Details map[string]string
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// With adds a detail to the error
+func (e *Error) With(key, value string) *Error {
+	if e.Details == nil {
+		e.Details = map[string]string{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+func New(code Code, format string, args ...any) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Wrap gives err a code, keeping its message. If err already has a code it is kept
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if CodeOf(err) != Unknown {
+		return err
+	}
+
+	return &Error{
+		Code:    code,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
+
+// Coded is implemented by errors that have a code without being an *Error
+type Coded interface {
+	FailureCode() Code
+}
+
+// CodeOf finds the code of err, errors without one are Unknown
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	var c Coded
+	if errors.As(err, &c) {
+		return c.FailureCode()
+	}
+
+	return Unknown
+}
+
+// JSON describes err for machines, e.g {"code":"client-not-found","message":"No clients matched \"web\"","details":{"client":"web"}}
+func JSON(err error) []byte {
+	out := struct {
+		Code    Code              `json:"code"`
+		Message string            `json:"message"`
+		Details map[string]string `json:"details,omitempty"`
+	}{
+		Code:    CodeOf(err),
+		Message: err.Error(),
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		out.Details = e.Details
+	}
+
+	b, _ := json.Marshal(out)
+	return b
+}
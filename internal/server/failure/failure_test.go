@@ -0,0 +1,80 @@
+package failure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type busy struct{}
+
+func (busy) Error() string     { return "busy" }
+func (busy) FailureCode() Code { return ClientBusy }
+
+func TestCodeOf(t *testing.T) {
+	notFound := New(ClientNotFound, "No clients matched %q", "web").With("client", "web")
+
+	tests := []struct {
+		err  error
+		want Code
+	}{
+		{notFound, ClientNotFound},
+		{fmt.Errorf("exec: %w", notFound), ClientNotFound},
+		{busy{}, ClientBusy},
+		{errors.New("plain"), Unknown},
+		{Wrap(BuildFailed, errors.New("build failed: exit status 1")), BuildFailed},
+		// Wrap keeps codes that are already there
+		{Wrap(BuildFailed, notFound), ClientNotFound},
+		{Wrap(BuildFailed, busy{}), ClientBusy},
+	}
+
+	for _, tt := range tests {
+		if got := CodeOf(tt.err); got != tt.want {
+			t.Errorf("CodeOf(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+
+	if Wrap(BuildFailed, nil) != nil {
+		t.Error("Wrap of nil should be nil")
+	}
+}
+
+func TestExitStatuses(t *testing.T) {
+	seen := map[uint32]Code{}
+	for _, c := range Codes() {
+		status := c.ExitStatus()
+		if other, ok := seen[status]; ok {
+			t.Fatalf("%s and %s share exit status %d", c, other, status)
+		}
+		seen[status] = c
+	}
+
+	if len(Codes()) != len(exitStatuses) {
+		t.Fatal("Codes() does not list every code")
+	}
+
+	if Unknown.ExitStatus() != 1 || Code("made-up").ExitStatus() != 1 {
+		t.Fatal("errors without a known code should exit with 1")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var out struct {
+		Code    Code
+		Message string
+		Details map[string]string
+	}
+
+	if err := json.Unmarshal(JSON(New(ClientNotFound, "No clients matched %q", "web").With("client", "web")), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Code != ClientNotFound || out.Message != `No clients matched "web"` || out.Details["client"] != "web" {
+		t.Fatalf("unexpected json: %+v", out)
+	}
+
+	if got := string(JSON(errors.New("plain"))); got != `{"code":"unknown","message":"plain"}` {
+		t.Fatalf("unexpected json for an error without a code: %s", got)
+	}
+}
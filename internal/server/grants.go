@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/keyfiles"
+)
+
+const expiredKeySweepInterval = time.Minute
+
+// sweepExpiredKeys removes temporary operator keys from the key files once they expire, so they do not pile up
+func sweepExpiredKeys(ctx context.Context, dataDir string) {
+	ticker := time.NewTicker(expiredKeySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		paths := []string{filepath.Join(dataDir, "authorized_keys")}
+
+		usersKeysDir := filepath.Join(dataDir, "keys")
+		if entries, err := os.ReadDir(usersKeysDir); err == nil {
+			for _, e := range entries {
+				if !e.IsDir() {
+					paths = append(paths, filepath.Join(usersKeysDir, e.Name()))
+				}
+			}
+		}
+
+		for _, path := range paths {
+			removed, err := keyfiles.RemoveExpiring(path, time.Now(), false)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("unable to remove expired keys from %s: %s", path, err)
+				continue
+			}
+
+			for _, comment := range removed {
+				log.Printf("Removed expired key %q from %s", comment, path)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
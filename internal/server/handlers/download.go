@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"io"
 	"os"
 	"path"
 
+	"github.com/NHAS/reverse_ssh/internal/server/storage"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
@@ -12,24 +14,38 @@ import (
 
 func Download(dataDir string) func(_ string, _ *users.User, newChannel ssh.NewChannel, log logger.Logger) {
 	return func(_ string, _ *users.User, newChannel ssh.NewChannel, log logger.Logger) {
-		downloadPath := path.Join("/", string(newChannel.ExtraData()))
+		requested := path.Join("/", string(newChannel.ExtraData()))
 		//Has to be done in two steps, doing Join("./downloads/", path) leads to path traversal (thanks go)
-		downloadPath = path.Join(dataDir, "downloads", downloadPath)
+		downloadPath := path.Join(dataDir, "downloads", requested)
 
+		var f io.ReadCloser
 		if stats, err := os.Stat(downloadPath); err != nil && (os.IsNotExist(err) || !stats.IsDir()) {
-			log.Warning("remote client requested non-existant path: %q", downloadPath)
-			newChannel.Reject(ssh.Prohibited, "file not found")
-			return
-		}
+			// Large files can be kept in object storage under files/ instead
+			backend := storage.Offload()
+			if backend == nil {
+				log.Warning("remote client requested non-existant path: %q", downloadPath)
+				newChannel.Reject(ssh.Prohibited, "file not found")
+				return
+			}
 
-		log.Info("client downloading %s", downloadPath)
+			f, err = backend.Get(context.Background(), path.Join("files", requested))
+			if err != nil {
+				log.Warning("remote client requested %q, which is not in the downloads directory or %s: %s", requested, backend, err)
+				newChannel.Reject(ssh.Prohibited, "file not found")
+				return
+			}
 
-		f, err := os.Open(downloadPath)
-		if err != nil {
-			log.Warning("unable to open requested path: %q: %s", downloadPath, err)
+			log.Info("client downloading %s from %s", requested, backend)
+		} else {
+			log.Info("client downloading %s", downloadPath)
 
-			newChannel.Reject(ssh.Prohibited, "cannot open file")
-			return
+			f, err = os.Open(downloadPath)
+			if err != nil {
+				log.Warning("unable to open requested path: %q: %s", downloadPath, err)
+
+				newChannel.Reject(ssh.Prohibited, "cannot open file")
+				return
+			}
 		}
 		defer f.Close()
 
@@ -9,6 +9,7 @@ import (
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
@@ -23,6 +24,8 @@ var (
 type chanAddress struct {
 	Port uint32
 	IP   string
+	// The client that relayed this connection to the server
+	Relay string
 }
 
 func (c *chanAddress) Network() string {
@@ -33,6 +36,14 @@ func (c *chanAddress) String() string {
 	return net.JoinHostPort(c.IP, fmt.Sprintf("%d", c.Port))
 }
 
+// RelayedBy returns the id of the client that relayed a connection to the server, or empty if addr didnt come from a client
+func RelayedBy(addr net.Addr) string {
+	if c, ok := addr.(*chanAddress); ok {
+		return c.Relay
+	}
+	return ""
+}
+
 type chanConn struct {
 	channel    ssh.Channel
 	localAddr  chanAddress
@@ -73,7 +84,7 @@ func (c *chanConn) SetWriteDeadline(t time.Time) error {
 
 }
 
-func channelToConn(channel ssh.Channel, drtMsg internal.ChannelOpenDirectMsg) net.Conn {
+func channelToConn(channel ssh.Channel, drtMsg internal.ChannelOpenDirectMsg, relay string) net.Conn {
 
 	return &chanConn{
 		channel: channel,
@@ -82,8 +93,9 @@ func channelToConn(channel ssh.Channel, drtMsg internal.ChannelOpenDirectMsg) ne
 			IP:   drtMsg.Raddr,
 		},
 		remoteAddr: chanAddress{
-			Port: drtMsg.Rport,
-			IP:   drtMsg.Raddr,
+			Port:  drtMsg.Rport,
+			IP:    drtMsg.Raddr,
+			Relay: relay,
 		},
 	}
 }
@@ -122,7 +134,13 @@ func ServerPortForward(clientId string) func(_ string, _ *users.User, newChannel
 		currentRemoteForwards[clientId] = net.JoinHostPort(drtMsg.Raddr, fmt.Sprintf("%d", drtMsg.Rport))
 		currentRemoteForwardsLck.Unlock()
 
-		multiplexer.ServerMultiplexer.QueueConn(channelToConn(connection, drtMsg))
+		forwardName := fmt.Sprintf("%s %s", clientId, net.JoinHostPort(drtMsg.Raddr, fmt.Sprintf("%d", drtMsg.Rport)))
+
+		conn := traffic.ForwardConn(forwardName, channelToConn(connection, drtMsg, clientId))
+		if err := multiplexer.ServerMultiplexer.QueueConn(conn); err != nil {
+			log.Warning("Unable to queue forwarded connection: %s", err)
+			conn.Close()
+		}
 
 	}
 }
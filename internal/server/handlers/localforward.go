@@ -1,19 +1,38 @@
 package handlers
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/resumable"
+	"github.com/NHAS/reverse_ssh/internal/server/contentfilter"
+	"github.com/NHAS/reverse_ssh/internal/server/presence"
+	"github.com/NHAS/reverse_ssh/internal/server/reaper"
+	"github.com/NHAS/reverse_ssh/internal/server/tracing"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/server/vault"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
-func LocalForward(_ string, user *users.User, newChannel ssh.NewChannel, log logger.Logger) {
+func LocalForward(connectionDetails string, user *users.User, newChannel ssh.NewChannel, log logger.Logger) {
+	if sess, err := user.Session(connectionDetails); err == nil {
+		if route := sess.ForwardRoute(); route != nil {
+			routedForward(user.Username(), route, newChannel, log)
+			return
+		}
+	}
+
 	proxyTarget := newChannel.ExtraData()
 
 	var drtMsg internal.ChannelOpenDirectMsg
@@ -51,14 +70,29 @@ func LocalForward(_ string, user *users.User, newChannel ssh.NewChannel, log log
 		return
 	}
 
-	var target ssh.Conn
+	var (
+		target   *ssh.ServerConn
+		targetId string
+	)
 	//Horrible way of getting the first element of a map in go
 	for k := range foundClients {
 		target = foundClients[k]
+		targetId = k
 		break
 	}
 
-	targetConnection, targetRequests, err := target.OpenChannel("jump", nil)
+	defer traffic.Client(targetId).Track()()
+
+	ctx := tracing.Context(newChannel)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("rssh.client_id", targetId))
+
+	_, openSpan := tracing.Tracer().Start(ctx, "rssh.forward.open")
+	// Modules in this session can ask for the operator's vault credentials until it ends
+	grant, revoke := vault.Grant(user.Username(), target.Permissions.Extensions["pubkey-fp"])
+	defer revoke()
+
+	targetConnection, targetRequests, err := resumable.Open(target, target.Permissions.Extensions["pubkey-fp"], "jump", []byte(grant))
+	tracing.End(openSpan, err)
 	if err != nil {
 		newChannel.Reject(ssh.ConnectionFailed, err.Error())
 		return
@@ -74,9 +108,64 @@ func LocalForward(_ string, user *users.User, newChannel ssh.NewChannel, log log
 	defer connection.Close()
 	go ssh.DiscardRequests(requests)
 
+	present := presence.Open(targetId, user.Username(), presence.SSH)
+	defer present.Close()
+
+	// The operator's ssh to the client, encrypted so there is nothing to filter
+	splice(ctx, connection, present.Track(targetConnection), user.Username(), targetId, "")
+}
+
+// splice copies between an operator's channel and the target until either side closes, counting the bytes each way in a span.
+// Content filters watch the copy when where, which names the forward in alerts, is set. owner and client are who the forward is for
+// in reclaim reports
+func splice(ctx context.Context, connection, target io.ReadWriteCloser, owner, client, where string) {
+	_, span := tracing.Tracer().Start(ctx, "rssh.forward.copy")
+	defer span.End()
+
+	var toConnection, toTargetWriter io.Writer = connection, target
+	if where != "" {
+		toConnection = contentfilter.Watch(connection, where)
+		toTargetWriter = contentfilter.Watch(target, where)
+	}
+
+	var fromTarget, toTarget atomic.Int64
+	done := make(chan struct{}, 2)
 	go func() {
-		io.Copy(connection, targetConnection)
+		n, _ := io.Copy(toConnection, target)
+		fromTarget.Store(n)
 		connection.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(toTargetWriter, connection)
+		toTarget.Store(n)
+		target.Close()
+		done <- struct{}{}
 	}()
-	io.Copy(targetConnection, connection)
+
+	<-done
+
+	// Both ends have been closed so the other way should finish straight away, unless a peer never answers the close.
+	// Then the reaper lets this return, so the forward stops counting as open, and the copy goes when its connection does
+	select {
+	case <-done:
+	default:
+		what := where
+		if what == "" {
+			what = "jump to " + client
+		}
+
+		abandoned := make(chan struct{})
+		reaped := reaper.Track(reaper.Channel, owner, client, what, reaper.HalfClosed(time.Now()), func() {
+			close(abandoned)
+		})
+
+		select {
+		case <-done:
+		case <-abandoned:
+		}
+		reaped.Release()
+	}
+
+	span.SetAttributes(attribute.Int64("rssh.bytes_to_target", toTarget.Load()), attribute.Int64("rssh.bytes_from_target", fromTarget.Load()))
 }
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/contentfilter"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/pivot"
+	"github.com/NHAS/reverse_ssh/internal/server/presence"
+	"github.com/NHAS/reverse_ssh/internal/server/reaper"
+	"github.com/NHAS/reverse_ssh/internal/server/tracing"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// routedForward sends an operator's direct-tcpip out through the client chosen with the socks command, rather than jumping to a client
+func routedForward(operator string, route *pivot.Route, newChannel ssh.NewChannel, log logger.Logger) {
+	defer traffic.Client(route.ID).Track()()
+
+	ctx := tracing.Context(newChannel)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("rssh.client_id", route.ID))
+
+	_, openSpan := tracing.Tracer().Start(ctx, "rssh.forward.open")
+	target, targetRequests, err := route.Dial(newChannel.ExtraData())
+	tracing.End(openSpan, err)
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			newChannel.Reject(openErr.Reason, openErr.Message)
+			return
+		}
+
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer target.Close()
+	go ssh.DiscardRequests(targetRequests)
+
+	connection, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Warning("Unable to accept routed forward: %s", err)
+		return
+	}
+	defer connection.Close()
+	go ssh.DiscardRequests(requests)
+
+	where := "routed forward through " + route.ID
+	var drtMsg internal.ChannelOpenDirectMsg
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &drtMsg); err == nil {
+		where = fmt.Sprintf("routed forward to %s:%d through %s", drtMsg.Raddr, drtMsg.Rport, route.ID)
+	}
+
+	present := presence.Open(route.ID, operator, presence.Forward)
+	defer present.Close()
+
+	splice(ctx, connection, present.Track(target), operator, route.ID, where)
+}
+
+// operatorForward is one ssh -R an operator has open on a client
+type operatorForward struct {
+	route   *pivot.Route
+	present *presence.Handle
+	reaped  *reaper.Resource
+}
+
+func (f *operatorForward) close() {
+	f.reaped.Release()
+	f.route.Close()
+	f.present.Close()
+}
+
+// OperatorRemoteForward handles ssh -R from operators. The bind address picks the client to listen on, e.g ssh -R fileserver:1080 catcher,
+// or without one the client chosen with the socks command is used. The port is opened on that client's loopback, never on the server.
+// Connections to it come back to the operator's ssh, so with -R 1080 their ssh is the socks proxy
+func OperatorRemoteForward(connectionDetails string, user *users.User, sshConn ssh.Conn, reqs <-chan *ssh.Request, log logger.Logger) {
+	var forwardsLck sync.Mutex
+	forwards := map[internal.RemoteForwardRequest]*operatorForward{}
+	defer func() {
+		forwardsLck.Lock()
+		defer forwardsLck.Unlock()
+
+		for _, f := range forwards {
+			f.close()
+		}
+	}()
+
+	for r := range reqs {
+		switch r.Type {
+		case "tcpip-forward":
+			var rf internal.RemoteForwardRequest
+			if err := ssh.Unmarshal(r.Payload, &rf); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+
+			forwardsLck.Lock()
+			current := len(forwards)
+			forwardsLck.Unlock()
+
+			route, port, err := startOperatorRemoteForward(connectionDetails, user, sshConn, rf, current, log)
+			if err != nil {
+				log.Warning("Refused remote forward %s for %s: %s", rf.String(), user.Username(), err)
+				r.Reply(false, []byte(err.Error()))
+				continue
+			}
+
+			var reply []byte
+			if rf.BindPort == 0 {
+				reply = ssh.Marshal(struct{ Port uint32 }{port})
+			}
+
+			rf.BindPort = port
+			f := &operatorForward{
+				route:   route,
+				present: presence.Open(route.ID, user.Username(), presence.Forward),
+			}
+
+			// The forward stays in the map until it is cancelled, so the client leaving or the operator's connection going
+			// stale without closing would otherwise keep it forever
+			key := rf
+			f.reaped = reaper.Track(reaper.Forward, user.Username(), route.ID, fmt.Sprintf("remote forward on %s port %d", route.ID, port), func() string {
+				if route.Closed() {
+					return "client " + route.ID + " went away"
+				}
+				if _, err := user.Session(connectionDetails); err != nil {
+					return "operator disconnected"
+				}
+				return ""
+			}, func() {
+				forwardsLck.Lock()
+				if forwards[key] == f {
+					delete(forwards, key)
+				}
+				forwardsLck.Unlock()
+
+				f.close()
+			})
+
+			forwardsLck.Lock()
+			forwards[rf] = f
+			forwardsLck.Unlock()
+			r.Reply(true, reply)
+
+			log.Info("%s opened remote forward on %s port %d", user.Username(), route.ID, port)
+
+		case "cancel-tcpip-forward":
+			var rf internal.RemoteForwardRequest
+			if err := ssh.Unmarshal(r.Payload, &rf); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+
+			forwardsLck.Lock()
+			f, ok := forwards[rf]
+			delete(forwards, rf)
+			forwardsLck.Unlock()
+
+			if !ok {
+				r.Reply(false, []byte("no such forward"))
+				continue
+			}
+
+			f.close()
+			r.Reply(true, nil)
+
+		default:
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func startOperatorRemoteForward(connectionDetails string, user *users.User, sshConn ssh.Conn, rf internal.RemoteForwardRequest, current int, log logger.Logger) (*pivot.Route, uint32, error) {
+	selector := rf.BindAddr
+
+	// ssh -R 1080 sends localhost, and -R *:1080 sends nothing
+	if selector == "" || selector == "*" || strings.EqualFold(selector, "localhost") {
+		sess, err := user.Session(connectionDetails)
+		if err != nil || sess.ForwardRoute() == nil {
+			return nil, 0, fmt.Errorf("remote forwards are opened on a client, not the server. Choose one with the bind address, e.g ssh -R <client>:%d, or with socks -c <client>", rf.BindPort)
+		}
+		selector = sess.ForwardRoute().ID
+	}
+
+	if user.Quota().Forwards > 0 {
+		listeners, err := data.CountListeners(user.Username())
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err := user.CheckForwards(listeners+current, 1); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	foundClients, err := user.SearchClients(selector)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(foundClients) != 1 {
+		return nil, 0, fmt.Errorf("%q matched %d clients, it must match exactly one", selector, len(foundClients))
+	}
+
+	var (
+		id     string
+		client *ssh.ServerConn
+	)
+	for k := range foundClients {
+		id = k
+		client = foundClients[k]
+		break
+	}
+
+	route, err := pivot.Open(id, client, func(nc ssh.NewChannel) {
+		relayForwarded(id, rf.BindAddr, sshConn, nc, log)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ok, reply, err := route.SendRequest("tcpip-forward", true, ssh.Marshal(&internal.RemoteForwardRequest{BindAddr: "127.0.0.1", BindPort: rf.BindPort}))
+	if err != nil || !ok {
+		route.Close()
+		if err == nil {
+			err = fmt.Errorf("client refused: %s", reply)
+		}
+		return nil, 0, err
+	}
+
+	port := rf.BindPort
+	if port == 0 {
+		var allocated struct{ Port uint32 }
+		if err := ssh.Unmarshal(reply, &allocated); err != nil {
+			route.Close()
+			return nil, 0, fmt.Errorf("client did not say which port it opened: %w", err)
+		}
+		port = allocated.Port
+	}
+
+	return route, port, nil
+}
+
+// relayForwarded passes a connection the client accepted back to the operator, under the address they asked for so their ssh can match it to the forward
+func relayForwarded(id, bindAddr string, sshConn ssh.Conn, nc ssh.NewChannel, log logger.Logger) {
+	defer traffic.Client(id).Track()()
+
+	var drtMsg internal.ChannelOpenDirectMsg
+	if err := ssh.Unmarshal(nc.ExtraData(), &drtMsg); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "malformed forwarded-tcpip")
+		return
+	}
+	drtMsg.Raddr = bindAddr
+
+	operator, operatorRequests, err := sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&drtMsg))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer operator.Close()
+	go ssh.DiscardRequests(operatorRequests)
+
+	connection, requests, err := nc.Accept()
+	if err != nil {
+		log.Warning("Unable to accept forwarded connection from %s: %s", id, err)
+		return
+	}
+	defer connection.Close()
+	go ssh.DiscardRequests(requests)
+
+	where := fmt.Sprintf("forward %s on %s", bindAddr, id)
+
+	go func() {
+		io.Copy(contentfilter.Watch(operator, where), connection)
+		operator.Close()
+	}()
+	io.Copy(contentfilter.Watch(connection, where), operator)
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/contentfilter"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
 )
@@ -118,17 +119,19 @@ func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh
 
 	go ssh.DiscardRequests(reqs)
 
+	where := fmt.Sprintf("proxy forward %s:%d from %s", rf.BindAddr, rf.BindPort, sshConn.RemoteAddr())
+
 	go func() {
 		defer destination.Close()
 		defer proxyCon.Close()
 
-		io.Copy(destination, proxyCon)
+		io.Copy(contentfilter.Watch(destination, where), proxyCon)
 	}()
 	go func() {
 		defer destination.Close()
 		defer proxyCon.Close()
 
-		io.Copy(proxyCon, destination)
+		io.Copy(contentfilter.Watch(proxyCon, where), destination)
 
 	}()
 
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"io"
 	"runtime/debug"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server/commands"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/server/webserver"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
@@ -28,6 +31,17 @@ func sendExitCode(code uint32, channel ssh.Channel) {
 	channel.SendRequest("exit-status", false, b)
 }
 
+// sendFailure reports why a command run with ssh server <command> failed, the exit status comes from the error code
+func sendFailure(err error, format string, channel ssh.Channel) {
+	if format == "json" {
+		channel.Stderr().Write(append(failure.JSON(err), '\n'))
+	} else {
+		fmt.Fprintf(channel, "%s", err.Error())
+	}
+
+	sendExitCode(failure.CodeOf(err).ExitStatus(), channel)
+}
+
 func Session(datadir string) ChannelHandler {
 	return func(connectionDetails string, user *users.User, newChannel ssh.NewChannel, log logger.Logger) {
 
@@ -78,10 +92,20 @@ func Session(datadir string) ChannelHandler {
 					if m, ok := c[line.Command.Value()]; ok {
 
 						req.Reply(true, nil)
+
+						observers.Commands.Notify(observers.Command{
+							User:       user.Username(),
+							Connection: sess.ConnectionDetails,
+							Source:     "exec",
+							Line:       command.Cmd,
+							Timestamp:  time.Now(),
+						})
+
+						started := time.Now()
 						err := m.Run(user, connection, line)
+						terminal.RecordCommand(user, sess, "exec", line, started, err)
 						if err != nil {
-							sendExitCode(1, connection)
-							fmt.Fprintf(connection, "%s", err.Error())
+							sendFailure(err, sess.ErrorFormat, connection)
 							return
 						}
 						sendExitCode(0, connection)
@@ -90,17 +114,23 @@ func Session(datadir string) ChannelHandler {
 					}
 				}
 				req.Reply(false, []byte("Unknown RSSH command"))
-				sendExitCode(1, connection)
+				sendFailure(failure.New(failure.InvalidArgument, "Unknown RSSH command").With("command", command.Cmd), sess.ErrorFormat, connection)
 				return
 			case "shell":
 				// We only accept the default shell
 				// (i.e. no command in the Payload)
 				req.Reply(len(req.Payload) == 0, nil)
 
-				term := terminal.NewAdvancedTerminal(connection, user, sess, internal.ConsoleLabel+"$ ")
+				term := terminal.NewAdvancedTerminal(connection, user, sess, commands.Prompt(user))
 
 				term.SetSize(int(sess.Pty.Columns), int(sess.Pty.Rows))
 
+				if sess.EditMode != "" {
+					if err := term.SetEditMode(sess.EditMode); err != nil {
+						fmt.Fprintf(term, "%s\n", err)
+					}
+				}
+
 				term.AddValueAutoComplete(autocomplete.RemoteId, user.Autocomplete(), users.PublicClientsAutoComplete)
 				term.AddValueAutoComplete(autocomplete.WebServerFileIds, webserver.Autocomplete)
 
@@ -126,6 +156,27 @@ func Session(datadir string) ChannelHandler {
 				}
 				sess.Pty = &pty
 
+				req.Reply(true, nil)
+			case "env":
+				var env struct {
+					Name  string
+					Value string
+				}
+
+				if err := ssh.Unmarshal(req.Payload, &env); err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+
+				switch env.Name {
+				case "RSSH_EDIT_MODE":
+					sess.EditMode = env.Value
+				case "RSSH_ERRORS":
+					sess.ErrorFormat = env.Value
+				default:
+					req.Reply(false, nil)
+					continue
+				}
 				req.Reply(true, nil)
 			default:
 				log.Warning("Unsupported request %s", req.Type)
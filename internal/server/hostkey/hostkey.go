@@ -0,0 +1,412 @@
+package hostkey
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"golang.org/x/crypto/ssh"
+)
+
+// An escrowed server key is only on disk encrypted, with the encryption key split into shamir shares held by operators.
+// k of the n shares are needed to start the server, so no single operator or copy of the disk can impersonate it
+
+const sharePrefix = "rssh-share"
+
+var (
+	mu sync.Mutex
+
+	loadedPath    string
+	loadedPrivate []byte
+	loadedSigner  ssh.Signer
+)
+
+type escrow struct {
+	Threshold int `json:"threshold"`
+	Shares    int `json:"shares"`
+
+	// authorized_keys format, so the fingerprint is known without unlocking
+	PublicKey string `json:"public_key"`
+
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// EscrowPath is where the encrypted key is kept for the key at privateKeyPath
+func EscrowPath(privateKeyPath string) string {
+	return privateKeyPath + ".escrow"
+}
+
+// Escrowed reports whether the key at privateKeyPath is only kept split
+func Escrowed(privateKeyPath string) bool {
+	_, err := os.Stat(EscrowPath(privateKeyPath))
+	return err == nil
+}
+
+// Signer is the loaded server key, nil if Load has not been called
+func Signer() ssh.Signer {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return loadedSigner
+}
+
+// PrivateBytes is a copy of the PEM of the loaded server key for the caller to secure.Zero when done, nil if Load has not been called
+func PrivateBytes() []byte {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if loadedPrivate == nil {
+		return nil
+	}
+	return bytes.Clone(loadedPrivate)
+}
+
+// Load reads, unlocks or creates the server key. Escrowed keys are unlocked with the share files, then if there
+// are not enough of those and prompt is set, with shares typed on stdin
+func Load(privateKeyPath string, shareFiles []string, prompt bool) (ssh.Signer, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if loadedSigner != nil && loadedPath == privateKeyPath {
+		return loadedSigner, nil
+	}
+
+	var (
+		privateBytes []byte
+		err          error
+	)
+
+	switch {
+	case Escrowed(privateKeyPath):
+		privateBytes, err = unlock(privateKeyPath, shareFiles, prompt)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		//If we have already created a private key (or there is one in the current directory) dont overwrite/create another one
+		if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
+			privateKeyPem, err := internal.GeneratePrivateKey()
+			if err != nil {
+				return nil, fmt.Errorf("unable to generate private key, and no private key specified: %s", err)
+			}
+
+			err = os.WriteFile(privateKeyPath, privateKeyPem, 0600)
+			secure.Zero(privateKeyPem)
+			if err != nil {
+				return nil, fmt.Errorf("unable to write private key to disk: %s", err)
+			}
+		}
+
+		privateBytes, err = os.ReadFile(privateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load private key (%s): %s", privateKeyPath, err)
+		}
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		secure.Zero(privateBytes)
+		return nil, fmt.Errorf("failed to parse private key: %s", err)
+	}
+
+	// Replaced by another key, the old one is no longer needed
+	if loadedPrivate != nil {
+		secure.Zero(loadedPrivate)
+	}
+
+	loadedPath = privateKeyPath
+	loadedPrivate = privateBytes
+	loadedSigner = private
+
+	return private, nil
+}
+
+// PublicKey gives the server public key without unlocking it, creating the key if there is none
+func PublicKey(privateKeyPath string) (ssh.PublicKey, error) {
+	if !Escrowed(privateKeyPath) {
+		private, err := Load(privateKeyPath, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		return private.PublicKey(), nil
+	}
+
+	e, err := readEscrow(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(e.PublicKey))
+	return publicKey, err
+}
+
+// Split escrows the server key as count shares, threshold of which unlock it. The plain key file is removed.
+// The loaded key is split if there is one, otherwise the key on disk, otherwise a new key that never touches the disk
+func Split(privateKeyPath string, threshold, count int) ([]string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	privateBytes := loadedPrivate
+	if loadedPath != privateKeyPath {
+		privateBytes = nil
+	}
+	alreadyLoaded := privateBytes != nil
+
+	if privateBytes == nil {
+		if Escrowed(privateKeyPath) {
+			return nil, errors.New("the server key is already escrowed, it must be unlocked before it can be split again")
+		}
+
+		var err error
+		privateBytes, err = os.ReadFile(privateKeyPath)
+		if os.IsNotExist(err) {
+			privateBytes, err = internal.GeneratePrivateKey()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %s", err)
+	}
+
+	dataKey := make([]byte, 32)
+	defer secure.Zero(dataKey)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	e := escrow{
+		Threshold: threshold,
+		Shares:    count,
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(private.PublicKey()))),
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	e.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Ciphertext = aead.Seal(nil, e.Nonce, privateBytes, []byte(e.PublicKey))
+
+	parts, err := split(dataKey, threshold, count)
+	if err != nil {
+		return nil, err
+	}
+	defer secure.Zero(parts...)
+
+	id := escrowID(private.PublicKey())
+	shares := make([]string, len(parts))
+	for i, part := range parts {
+		shares[i] = fmt.Sprintf("%s-%s-%d-%d-%s", sharePrefix, id, threshold, i+1, hex.EncodeToString(part))
+	}
+
+	// Make sure the shares actually open what is about to be written before the plain key is gone
+	check := map[byte][]byte{}
+	for i := count - threshold; i < count; i++ {
+		check[byte(i+1)] = parts[i]
+	}
+	recovered, err := e.open(check)
+	matches := err == nil && secure.Equal(recovered, privateBytes)
+	secure.Zero(recovered)
+	if !matches {
+		return nil, errors.New("split shares did not recover the key, nothing was changed")
+	}
+
+	encoded, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	escrowPath := EscrowPath(privateKeyPath)
+	if err := os.WriteFile(escrowPath+".tmp", encoded, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(escrowPath+".tmp", escrowPath); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(privateKeyPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("key was escrowed but the plain key could not be removed, delete %s by hand: %w", privateKeyPath, err)
+	}
+
+	if !alreadyLoaded && loadedPrivate != nil {
+		secure.Zero(loadedPrivate)
+	}
+
+	loadedPath = privateKeyPath
+	loadedPrivate = privateBytes
+	loadedSigner = private
+
+	return shares, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func escrowID(publicKey ssh.PublicKey) string {
+	sum := sha256.Sum256(publicKey.Marshal())
+	return hex.EncodeToString(sum[:4])
+}
+
+func (e *escrow) open(shares map[byte][]byte) ([]byte, error) {
+	dataKey, err := combine(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer secure.Zero(dataKey)
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, e.Nonce, e.Ciphertext, []byte(e.PublicKey))
+}
+
+func readEscrow(privateKeyPath string) (*escrow, error) {
+	encoded, err := os.ReadFile(EscrowPath(privateKeyPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var e escrow
+	if err := json.Unmarshal(encoded, &e); err != nil {
+		return nil, fmt.Errorf("escrowed key %s is corrupt: %w", EscrowPath(privateKeyPath), err)
+	}
+
+	if e.Threshold < 1 || e.Threshold > e.Shares {
+		return nil, fmt.Errorf("escrowed key %s has an invalid threshold %d of %d", EscrowPath(privateKeyPath), e.Threshold, e.Shares)
+	}
+
+	return &e, nil
+}
+
+// parseShare checks a share belongs to this escrow and returns its index and value
+func (e *escrow) parseShare(share string) (byte, []byte, error) {
+	parts := strings.Split(strings.TrimSpace(share), "-")
+	if len(parts) != 6 || parts[0]+"-"+parts[1] != sharePrefix {
+		return 0, nil, errors.New("not a key share, they look like " + sharePrefix + "-<id>-<threshold>-<index>-<hex>")
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(e.PublicKey))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if parts[2] != escrowID(publicKey) {
+		return 0, nil, fmt.Errorf("share is for a different key (%s)", parts[2])
+	}
+
+	index, err := strconv.Atoi(parts[4])
+	if err != nil || index < 1 || index > e.Shares {
+		return 0, nil, fmt.Errorf("share index %q is not between 1 and %d", parts[4], e.Shares)
+	}
+
+	value, err := hex.DecodeString(parts[5])
+	if err != nil {
+		return 0, nil, fmt.Errorf("share value is not hex: %w", err)
+	}
+
+	return byte(index), value, nil
+}
+
+func unlock(privateKeyPath string, shareFiles []string, prompt bool) ([]byte, error) {
+	e, err := readEscrow(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := map[byte][]byte{}
+	defer func() {
+		for _, value := range shares {
+			secure.Zero(value)
+		}
+	}()
+
+	for _, path := range shareFiles {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key share: %w", err)
+		}
+
+		index, value, err := e.parseShare(string(content))
+		secure.Zero(content)
+		if err != nil {
+			return nil, fmt.Errorf("key share %s: %w", path, err)
+		}
+		shares[index] = value
+	}
+
+	if len(shares) < e.Threshold && prompt {
+		fmt.Fprintf(os.Stderr, "Server key is escrowed, %d of %d key shares are needed to start (%d given)\n", e.Threshold, e.Shares, len(shares))
+
+		input := bufio.NewReader(os.Stdin)
+		for len(shares) < e.Threshold {
+			fmt.Fprintf(os.Stderr, "Key share %d/%d: ", len(shares)+1, e.Threshold)
+
+			line, err := readSecretLine(input)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return nil, err
+			}
+
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			index, value, err := e.parseShare(line)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Rejected: %s\n", err)
+				continue
+			}
+
+			if _, ok := shares[index]; ok {
+				fmt.Fprintf(os.Stderr, "Share %d was already given\n", index)
+				secure.Zero(value)
+				continue
+			}
+			shares[index] = value
+		}
+	}
+
+	if len(shares) < e.Threshold {
+		return nil, fmt.Errorf("server key is escrowed and needs %d key shares, only %d were given (see --key-shares)", e.Threshold, len(shares))
+	}
+
+	privateBytes, err := e.open(shares)
+	if err != nil {
+		return nil, errors.New("key shares did not unlock the server key, one or more of them is wrong")
+	}
+
+	return privateBytes, nil
+}
@@ -0,0 +1,110 @@
+package hostkey
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShamirAnyThreshold(t *testing.T) {
+	secret := []byte("a secret that is not only one byte long")
+
+	shares, err := split(secret, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for a := 0; a < 5; a++ {
+		for b := a + 1; b < 5; b++ {
+			for c := b + 1; c < 5; c++ {
+				recovered, err := combine(map[byte][]byte{byte(a + 1): shares[a], byte(b + 1): shares[b], byte(c + 1): shares[c]})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(recovered, secret) {
+					t.Fatalf("shares %d %d %d did not recover the secret", a+1, b+1, c+1)
+				}
+			}
+		}
+	}
+
+	recovered, _ := combine(map[byte][]byte{1: shares[0], 2: shares[1]})
+	if bytes.Equal(recovered, secret) {
+		t.Fatal("two shares recovered a secret that needs three")
+	}
+}
+
+func reset() {
+	loadedPath, loadedPrivate, loadedSigner = "", nil, nil
+}
+
+func writeShares(t *testing.T, shares []string) []string {
+	var paths []string
+	for _, share := range shares {
+		path := filepath.Join(t.TempDir(), "share")
+		if err := os.WriteFile(path, []byte(share+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestSplitAndUnlock(t *testing.T) {
+	t.Cleanup(reset)
+
+	privateKeyPath := filepath.Join(t.TempDir(), "id_ed25519")
+
+	original, err := Load(privateKeyPath, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := Split(privateKeyPath, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(privateKeyPath); !os.IsNotExist(err) {
+		t.Fatal("plain key was left on disk after splitting")
+	}
+
+	publicKey, err := PublicKey(privateKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(publicKey.Marshal(), original.PublicKey().Marshal()) {
+		t.Fatal("escrowed public key does not match")
+	}
+
+	files := writeShares(t, shares)
+
+	reset()
+	if _, err := Load(privateKeyPath, files[:1], false); err == nil {
+		t.Fatal("one share unlocked a key that needs two")
+	}
+
+	reset()
+	unlocked, err := Load(privateKeyPath, files[1:], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unlocked.PublicKey().Marshal(), original.PublicKey().Marshal()) {
+		t.Fatal("unlocked key does not match the original")
+	}
+
+	// A share from another escrow is refused rather than silently giving the wrong key
+	otherPath := filepath.Join(t.TempDir(), "id_ed25519")
+	reset()
+	otherShares, err := Split(otherPath, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset()
+	if _, err := Load(privateKeyPath, writeShares(t, []string{shares[0], otherShares[1]}), false); err == nil {
+		t.Fatal("shares from different keys unlocked the server key")
+	}
+}
@@ -0,0 +1,35 @@
+package hostkey
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readSecretLine reads a line from stdin without echoing it, if stdin is a terminal
+func readSecretLine(input *bufio.Reader) (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err == nil {
+		noEcho := *old
+		noEcho.Lflag &^= unix.ECHO
+		noEcho.Lflag |= unix.ICANON
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err == nil {
+			defer func() {
+				unix.IoctlSetTermios(fd, unix.TCSETS, old)
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+
+	line, err := input.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package hostkey
+
+import (
+	"bufio"
+	"strings"
+)
+
+// readSecretLine reads a line from stdin, it is echoed on platforms other than linux
+func readSecretLine(input *bufio.Reader) (string, error) {
+	line, err := input.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,113 @@
+package hostkey
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Shamir secret sharing over GF(2^8), each byte of the secret is shared with its own random polynomial
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	// 3 generates the multiplicative group of GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		expTable[i+255] = x
+		logTable[x] = byte(i)
+
+		// x *= 3
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+		x ^= double
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// split returns count shares of secret, any threshold of them recover it. Share i is evaluated at x = i+1
+func split(secret []byte, threshold, count int) ([][]byte, error) {
+	if threshold < 1 || threshold > count || count > 255 {
+		return nil, errors.New("shares must satisfy 1 <= threshold <= count <= 255")
+	}
+
+	shares := make([][]byte, count)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+
+	coefficients := make([]byte, threshold)
+	for i, b := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = b
+
+		for s := range shares {
+			x := byte(s + 1)
+
+			// Horner's method
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			shares[s][i] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// combine recovers the secret from shares keyed by their x coordinate with lagrange interpolation at 0
+func combine(shares map[byte][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares given")
+	}
+
+	var length = -1
+	for x, share := range shares {
+		if x == 0 {
+			return nil, errors.New("share index cannot be 0")
+		}
+		if length != -1 && len(share) != length {
+			return nil, errors.New("shares are different lengths")
+		}
+		length = len(share)
+	}
+
+	secret := make([]byte, length)
+	for xi, share := range shares {
+		// basis polynomial for xi evaluated at 0
+		basis := byte(1)
+		for xj := range shares {
+			if xj == xi {
+				continue
+			}
+			basis = gfMul(basis, gfDiv(xj, xj^xi))
+		}
+
+		for i := range secret {
+			secret[i] ^= gfMul(share[i], basis)
+		}
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,304 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pre-flight checks for infrastructure mistakes that give the server away before links are handed out: a name or certificate already in
+// certificate transparency logs, where anyone watching them finds it, a name that resolves differently depending on who asks, and a
+// certificate that does not match the address or is the server's self signed default.
+
+type Level string
+
+const (
+	OK      Level = "ok"
+	Warning Level = "warning"
+	// The check could not be done, e.g the CT search was unreachable
+	Unknown Level = "unknown"
+)
+
+type Finding struct {
+	Check  string
+	Target string
+	Level  Level
+	Detail string
+}
+
+type Options struct {
+	// Public resolvers, host:port, whose answers are compared with the system resolver's. DefaultResolvers when empty
+	Resolvers []string
+
+	// Do not search CT logs, searching tells the search service which names and certificates the server uses
+	SkipCT bool
+}
+
+var DefaultResolvers = []string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"}
+
+// Certificates expiring sooner than this are warned about
+const expiryWarning = 14 * 24 * time.Hour
+
+const lookupTimeout = 5 * time.Second
+
+// CT log search, crt.sh's json api. Replaced in tests
+var ctSearchURL = "https://crt.sh/"
+
+// Check looks at every host in addresses (host or host:port), and at cert if the server serves TLS with one
+func Check(ctx context.Context, addresses []string, cert *x509.Certificate, opts Options) (findings []Finding) {
+	resolvers := opts.Resolvers
+	if len(resolvers) == 0 {
+		resolvers = DefaultResolvers
+	}
+
+	var hosts []string
+	for _, address := range addresses {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		host = strings.Trim(host, "[]")
+		if host != "" && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			findings = append(findings, checkAddress(host, ip))
+			continue
+		}
+
+		findings = append(findings, judgeResolution(host, resolve(ctx, host, resolvers)))
+
+		if !opts.SkipCT {
+			findings = append(findings, checkNameInCT(ctx, host))
+		}
+	}
+
+	if cert != nil {
+		findings = append(findings, checkCertificate(cert, hosts)...)
+
+		if !opts.SkipCT && !selfSigned(cert) {
+			findings = append(findings, checkCertificateInCT(ctx, cert))
+		}
+	}
+
+	return findings
+}
+
+func checkAddress(host string, ip net.IP) Finding {
+	f := Finding{Check: "address", Target: host, Level: OK, Detail: "bare IP address, nothing to resolve or find in CT logs"}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		f.Level = Warning
+		f.Detail = "not a public address, clients outside this network cannot reach it and it shows your internal addressing"
+	}
+	return f
+}
+
+type answer struct {
+	Resolver string
+	Addrs    []string
+	Err      error
+}
+
+func resolve(ctx context.Context, host string, resolvers []string) []answer {
+	lookup := func(name string, r *net.Resolver) answer {
+		ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+		defer cancel()
+
+		addrs, err := r.LookupHost(ctx, host)
+		sort.Strings(addrs)
+		return answer{Resolver: name, Addrs: addrs, Err: err}
+	}
+
+	answers := []answer{lookup("system", net.DefaultResolver)}
+	for _, server := range resolvers {
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+		answers = append(answers, lookup(server, r))
+	}
+
+	return answers
+}
+
+// judgeResolution warns when host does not resolve the same everywhere, or resolves to an address clients cannot reach
+func judgeResolution(host string, answers []answer) Finding {
+	f := Finding{Check: "dns", Target: host}
+
+	var resolved, failed []string
+	var first []string
+	consistent := true
+	for _, a := range answers {
+		if a.Err != nil {
+			failed = append(failed, a.Resolver)
+			continue
+		}
+
+		resolved = append(resolved, a.Resolver)
+		if first == nil {
+			first = a.Addrs
+		} else if !slices.Equal(first, a.Addrs) {
+			consistent = false
+		}
+
+		for _, addr := range a.Addrs {
+			if ip := net.ParseIP(addr); ip != nil && (ip.IsPrivate() || ip.IsLoopback()) {
+				f.Level = Warning
+				f.Detail = fmt.Sprintf("resolves to %s with %s, a private address clients outside this network cannot reach", addr, a.Resolver)
+				return f
+			}
+		}
+	}
+
+	switch {
+	case len(resolved) == 0:
+		f.Level = Warning
+		f.Detail = "does not resolve with any resolver"
+	case len(failed) > 0:
+		f.Level = Warning
+		f.Detail = fmt.Sprintf("resolves with %s but not %s, records may not have propagated or are split horizon", strings.Join(resolved, ", "), strings.Join(failed, ", "))
+	case !consistent:
+		var seen []string
+		for _, a := range answers {
+			seen = append(seen, a.Resolver+" "+strings.Join(a.Addrs, ","))
+		}
+		f.Level = Warning
+		f.Detail = "resolves differently depending on the resolver (" + strings.Join(seen, "; ") + "), clients may reach something else"
+	default:
+		f.Level = OK
+		f.Detail = "resolves to " + strings.Join(first, ", ") + " with every resolver"
+	}
+
+	return f
+}
+
+func selfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+func checkCertificate(cert *x509.Certificate, hosts []string) (findings []Finding) {
+	target := cert.Subject.CommonName
+	if target == "" {
+		target = "tls certificate"
+	}
+
+	switch {
+	case selfSigned(cert) && slices.Contains(cert.Subject.Organization, "Cloudflare, Inc"):
+		findings = append(findings, Finding{Check: "certificate", Target: target, Level: Warning, Detail: "the server's generated certificate, self signed and claiming to be Cloudflare, TLS scanners pick it out. Use --tlscert with a certificate for the external address"})
+	case selfSigned(cert):
+		findings = append(findings, Finding{Check: "certificate", Target: target, Level: Warning, Detail: "self signed, TLS scanners and proxies flag it"})
+	default:
+		findings = append(findings, Finding{Check: "certificate", Target: target, Level: OK, Detail: "issued by " + cert.Issuer.String()})
+	}
+
+	if remaining := time.Until(cert.NotAfter); remaining <= 0 {
+		findings = append(findings, Finding{Check: "certificate expiry", Target: target, Level: Warning, Detail: "expired " + cert.NotAfter.Format(time.DateOnly)})
+	} else if remaining < expiryWarning {
+		findings = append(findings, Finding{Check: "certificate expiry", Target: target, Level: Warning, Detail: "expires " + cert.NotAfter.Format(time.DateOnly)})
+	}
+
+	for _, host := range hosts {
+		if err := cert.VerifyHostname(host); err != nil {
+			findings = append(findings, Finding{Check: "certificate name", Target: host, Level: Warning, Detail: "the certificate is not valid for it, clients checking the name will refuse it"})
+		}
+	}
+
+	return findings
+}
+
+type ctEntry struct {
+	IssuerName string `json:"issuer_name"`
+	NameValue  string `json:"name_value"`
+	NotBefore  string `json:"not_before"`
+}
+
+func ctSearch(ctx context.Context, query string) ([]ctEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ctSearchURL+"?output=json&q="+url.QueryEscape(query), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CT search answered %s", resp.Status)
+	}
+
+	var entries []ctEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("CT search answered with something other than results: %w", err)
+	}
+
+	return entries, nil
+}
+
+func checkNameInCT(ctx context.Context, host string) Finding {
+	f := Finding{Check: "ct logs", Target: host}
+
+	entries, err := ctSearch(ctx, host)
+	if err != nil {
+		f.Level = Unknown
+		f.Detail = "unable to search CT logs: " + err.Error()
+		return f
+	}
+
+	if len(entries) == 0 {
+		f.Level = OK
+		f.Detail = "no certificates for it in CT logs"
+		return f
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].NotBefore > entries[j].NotBefore
+	})
+
+	f.Level = Warning
+	f.Detail = fmt.Sprintf("%d certificates for it are in CT logs, the newest issued %s by %s. Anyone watching CT logs knows the name", len(entries), entries[0].NotBefore, entries[0].IssuerName)
+	return f
+}
+
+func checkCertificateInCT(ctx context.Context, cert *x509.Certificate) Finding {
+	sum := sha256.Sum256(cert.Raw)
+	f := Finding{Check: "ct logs", Target: "tls certificate"}
+
+	entries, err := ctSearch(ctx, hex.EncodeToString(sum[:]))
+	if err != nil {
+		f.Level = Unknown
+		f.Detail = "unable to search CT logs: " + err.Error()
+		return f
+	}
+
+	if len(entries) == 0 {
+		f.Level = OK
+		f.Detail = "the certificate is not in CT logs"
+		return f
+	}
+
+	f.Level = Warning
+	f.Detail = "the certificate is in CT logs, naming " + strings.ReplaceAll(entries[0].NameValue, "\n", ", ")
+	return f
+}
@@ -0,0 +1,87 @@
+package infra
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJudgeResolution(t *testing.T) {
+	cases := map[string]struct {
+		answers []answer
+		level   Level
+	}{
+		"consistent": {[]answer{{Resolver: "system", Addrs: []string{"203.0.113.1"}}, {Resolver: "1.1.1.1:53", Addrs: []string{"203.0.113.1"}}}, OK},
+		"different":  {[]answer{{Resolver: "system", Addrs: []string{"203.0.113.1"}}, {Resolver: "1.1.1.1:53", Addrs: []string{"203.0.113.2"}}}, Warning},
+		"partial":    {[]answer{{Resolver: "system", Addrs: []string{"203.0.113.1"}}, {Resolver: "1.1.1.1:53", Err: errors.New("no such host")}}, Warning},
+		"private":    {[]answer{{Resolver: "system", Addrs: []string{"10.0.0.5"}}, {Resolver: "1.1.1.1:53", Addrs: []string{"10.0.0.5"}}}, Warning},
+	}
+
+	for name, c := range cases {
+		if f := judgeResolution("c2.example.com", c.answers); f.Level != c.level {
+			t.Fatalf("%s: expected %s, got %s (%s)", name, c.level, f.Level, f.Detail)
+		}
+	}
+}
+
+func TestCertificateChecks(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "203.0.113.1:3232", Organization: []string{"Cloudflare, Inc"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(0, 0, 7),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctQueries []string
+	ct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctQueries = append(ctQueries, r.URL.Query().Get("q"))
+		w.Write([]byte(`[{"issuer_name":"C=US, O=Let's Encrypt, CN=R3","name_value":"c2.example.com","not_before":"2026-01-01T00:00:00"}]`))
+	}))
+	defer ct.Close()
+	defer func(url string) { ctSearchURL = url }(ctSearchURL)
+	ctSearchURL = ct.URL + "/"
+
+	checks := map[string]Level{}
+	for _, f := range Check(context.Background(), []string{"203.0.113.1:3232"}, cert, Options{}) {
+		checks[f.Check] = f.Level
+	}
+
+	for _, check := range []string{"certificate", "certificate expiry", "certificate name"} {
+		if checks[check] != Warning {
+			t.Fatalf("%s should warn about the generated certificate, got %v", check, checks)
+		}
+	}
+	if checks["address"] != OK {
+		t.Fatalf("a public address should pass, got %v", checks)
+	}
+	if len(ctQueries) != 0 {
+		t.Fatalf("a bare address and a self signed certificate should not be searched for in CT logs, searched %v", ctQueries)
+	}
+
+	if f := checkNameInCT(context.Background(), "c2.example.com"); f.Level != Warning || !strings.Contains(f.Detail, "Let's Encrypt") {
+		t.Fatalf("name in CT logs should warn, got %+v", f)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/vault"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// The longest keepalive interval, in seconds, a client may negotiate. If this is not above the server timeout clients are stuck with the timeout
+var keepaliveMax int
+
+// negotiateKeepalive clamps a clients requested keepalive interval between the server timeout and keepaliveMax
+func negotiateKeepalive(requested, timeout, limit int) (accepted int, ok bool) {
+	if timeout <= 0 || limit <= timeout {
+		return 0, false
+	}
+
+	return min(max(requested, timeout), limit), true
+}
+
+// handleClientRequests deals with global requests from controllable clients, keepalive negotiation and tamper and transport change reports
+func handleClientRequests(reqs <-chan *ssh.Request, realConn *internal.TimeoutConn, timeout int, keepaliveInterval *atomic.Int64, fingerprint string, log logger.Logger, notify func(status, reason string)) {
+	for req := range reqs {
+		switch req.Type {
+		case "keepalive-interval@rssh":
+			requested, err := strconv.Atoi(string(req.Payload))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			accepted, ok := negotiateKeepalive(requested, timeout, keepaliveMax)
+			if !ok {
+				req.Reply(false, nil)
+				continue
+			}
+
+			if accepted != int(keepaliveInterval.Load()) {
+				log.Info("Client keepalive interval changed to %d seconds", accepted)
+			}
+
+			keepaliveInterval.Store(int64(accepted))
+			realConn.Timeout = time.Duration(accepted*2) * time.Second
+
+			req.Reply(true, []byte(strconv.Itoa(accepted)))
+
+		case "time@rssh":
+			// The client corrects its clock with ours, its own is sent so we can say how far out it was
+			now := time.Now()
+			if clientTime, err := strconv.ParseInt(string(req.Payload), 10, 64); err == nil {
+				if skew := time.Unix(0, clientTime).Sub(now); skew.Abs() > time.Minute {
+					log.Warning("Client clock is %s out, it will use the server's time", skew.Round(time.Second))
+				}
+			}
+			req.Reply(true, []byte(strconv.FormatInt(now.UnixNano(), 10)))
+
+		case "tamper@rssh":
+			// The client binary no longer matches the signature it was built with
+			reason := string(req.Payload)
+			if len(reason) > 256 {
+				reason = reason[:256]
+			}
+			log.Error("Client binary failed its integrity check: %s", reason)
+			notify("tampered", reason)
+
+		case "transport-change@rssh":
+			// The client moved to one of its fallback transports, or back
+			var change struct {
+				From   string
+				To     string
+				Reason string
+			}
+			if err := ssh.Unmarshal(req.Payload, &change); err != nil {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				continue
+			}
+
+			reason := fmt.Sprintf("%s -> %s, %s", change.From, change.To, change.Reason)
+			if len(reason) > 512 {
+				reason = reason[:512]
+			}
+			log.Info("Client changed transport %s", reason)
+			notify("transport", reason)
+
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+
+		case "known-host@rssh":
+			// An onward ssh server the client connected to presented a key it had not seen, or one that differs from the pinned key
+			var report struct {
+				Host   string
+				Key    string
+				Status string
+			}
+			if err := ssh.Unmarshal(req.Payload, &report); err != nil || len(report.Host) > 512 || strings.ContainsAny(report.Host, " \t\n") {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				continue
+			}
+
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(report.Key))
+			if err != nil {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				continue
+			}
+
+			switch report.Status {
+			case "new":
+				log.Info("Client recorded host key of %s, %s %s", report.Host, key.Type(), internal.FingerprintSHA256Hex(key))
+				err := data.SaveKnownHost(data.KnownHost{
+					Client:  fingerprint,
+					Host:    report.Host,
+					KeyType: key.Type(),
+					Key:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+					Learned: true,
+				})
+				if err != nil {
+					log.Warning("Unable to save known host %s: %s", report.Host, err)
+				}
+			case "mismatch":
+				reason := fmt.Sprintf("%s presented %s %s which does not match the pinned key", report.Host, key.Type(), internal.FingerprintSHA256Hex(key))
+				log.Error("Onward connection refused, %s", reason)
+				notify("hostkey", reason)
+			}
+
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+
+		case "vault@rssh":
+			// A module in an operator's jump session wants one of their credentials
+			var request struct {
+				Grant string
+				Name  string
+			}
+			if err := ssh.Unmarshal(req.Payload, &request); err != nil {
+				req.Reply(false, []byte("invalid request"))
+				continue
+			}
+
+			owner, credential, err := vault.Redeem(request.Grant, fingerprint, request.Name)
+			if err != nil {
+				if owner == "" {
+					log.Warning("Client asked for vault credential %q without a valid grant", request.Name)
+				}
+				req.Reply(false, []byte(err.Error()))
+				continue
+			}
+
+			log.Info("Gave %s's vault credential %q to a module", owner, request.Name)
+			req.Reply(true, ssh.Marshal(&credential))
+
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package keyfiles
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+// Temporary operator keys are kept in the normal key files with the openssh expiry-time option, so they work like any other key until they run out
+
+const (
+	ExpiryOption   = "expiry-time"
+	ReadOnlyOption = "readonly"
+)
+
+// Held while a key file is rewritten, so appends are not lost
+var lck sync.Mutex
+
+// FormatExpiry gives the expiry-time option value for t, in UTC
+func FormatExpiry(t time.Time) string {
+	return t.UTC().Format("20060102150405") + "Z"
+}
+
+// ParseExpiry reads an expiry-time value, YYYYMMDD[HHMM[SS]] with a Z suffix for UTC, otherwise local time, as openssh does
+func ParseExpiry(value string) (time.Time, error) {
+	value, err := strconv.Unquote(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expiry-time must be quoted")
+	}
+
+	location := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value = strings.TrimSuffix(value, "Z")
+		location = time.UTC
+	}
+
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("expiry-time %q is not YYYYMMDD[HHMM[SS]][Z]", value)
+	}
+
+	return time.ParseInLocation(layout, value, location)
+}
+
+// Expiry returns when a key with these authorized_keys options expires, ok is false if it never does
+func Expiry(options []string) (expires time.Time, ok bool, err error) {
+	for _, o := range options {
+		name, value, found := strings.Cut(o, "=")
+		if !found || name != ExpiryOption {
+			continue
+		}
+
+		expires, err = ParseExpiry(value)
+		return expires, err == nil, err
+	}
+
+	return time.Time{}, false, nil
+}
+
+// Append adds an authorized_keys line to path, creating the file if needed
+func Append(path, line string) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(strings.TrimSpace(line) + "\n")
+	return err
+}
+
+// RemoveExpiring drops the keys in path that expire before the cutoff, or every expiring key if all is set.
+// The file is removed if nothing is left in it
+func RemoveExpiring(path string, cutoff time.Time, all bool) (removed []string, err error) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept [][]byte
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		}
+
+		_, comment, options, _, err := ssh.ParseAuthorizedKey(trimmed)
+		if err == nil {
+			expires, ok, err := Expiry(options)
+			if err == nil && ok && (all || expires.Before(cutoff)) {
+				removed = append(removed, comment)
+				continue
+			}
+		}
+
+		kept = append(kept, line)
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	if len(kept) == 0 {
+		return removed, os.Remove(path)
+	}
+
+	if err := os.WriteFile(path+".tmp", append(bytes.Join(kept, []byte("\n")), '\n'), 0600); err != nil {
+		return nil, err
+	}
+
+	return removed, os.Rename(path+".tmp", path)
+}
+
+// Grant is a temporary key found in a key file
+type Grant struct {
+	Comment     string
+	Fingerprint string
+	ReadOnly    bool
+	Expires     time.Time
+}
+
+// Grants lists the expiring keys in path
+func Grants(path string) ([]Grant, error) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []Grant
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		publicKey, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			continue
+		}
+
+		expires, ok, err := Expiry(options)
+		if err != nil || !ok {
+			continue
+		}
+
+		g := Grant{
+			Comment:     comment,
+			Fingerprint: ssh.FingerprintSHA256(publicKey),
+			Expires:     expires,
+		}
+		for _, o := range options {
+			if o == ReadOnlyOption {
+				g.ReadOnly = true
+			}
+		}
+
+		grants = append(grants, g)
+	}
+
+	return grants, nil
+}
+
+// Entry is a key in a key file
+type Entry struct {
+	Key     ssh.PublicKey
+	Comment string
+	Options []string
+	Expires time.Time
+}
+
+// Fingerprint is the key's openssh SHA256 fingerprint
+func (e Entry) Fingerprint() string {
+	return ssh.FingerprintSHA256(e.Key)
+}
+
+// Matches is whether identifier is the key's comment, its SHA256 fingerprint, or the SHA1 hex fingerprint clients are shown with
+func (e Entry) Matches(identifier string) bool {
+	return identifier != "" && (identifier == e.Comment || identifier == e.Fingerprint() || identifier == internal.FingerprintSHA1Hex(e.Key))
+}
+
+// Line is the authorized_keys line for the entry
+func (e Entry) Line() string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(e.Key)))
+	if len(e.Options) > 0 {
+		line = strings.Join(e.Options, ",") + " " + line
+	}
+	if e.Comment != "" {
+		line += " " + e.Comment
+	}
+	return line
+}
+
+func parseEntry(line []byte) (Entry, bool) {
+	publicKey, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return Entry{}, false
+	}
+
+	e := Entry{Key: publicKey, Comment: comment, Options: options}
+	e.Expires, _, _ = Expiry(options)
+	return e, true
+}
+
+// Entries lists the keys in path, a missing file has none
+func Entries(path string) ([]Entry, error) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if e, ok := parseEntry(bytes.TrimSpace(line)); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// Add puts e in path, creating the file if needed. The file is replaced in one step, so a login never reads it half written
+func Add(path string, e Entry) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	marshalled := ssh.MarshalAuthorizedKey(e.Key)
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if existing, ok := parseEntry(bytes.TrimSpace(line)); ok && bytes.Equal(ssh.MarshalAuthorizedKey(existing.Key), marshalled) {
+			return fmt.Errorf("%s is already in %s", e.Fingerprint(), path)
+		}
+	}
+
+	content = bytes.TrimRight(content, "\n")
+	if len(content) > 0 {
+		content = append(content, '\n')
+	}
+
+	return replace(path, append(content, e.Line()+"\n"...))
+}
+
+// Remove drops the keys in path that match identifier, see Entry.Matches
+func Remove(path, identifier string) (removed []Entry, err error) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept [][]byte
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		}
+
+		if e, ok := parseEntry(trimmed); ok && e.Matches(identifier) {
+			removed = append(removed, e)
+			continue
+		}
+
+		kept = append(kept, line)
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	var rewritten []byte
+	if len(kept) > 0 {
+		rewritten = append(bytes.Join(kept, []byte("\n")), '\n')
+	}
+	return removed, replace(path, rewritten)
+}
+
+func replace(path string, content []byte) error {
+	if err := os.WriteFile(path+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,140 @@
+package keyfiles
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseExpiry(t *testing.T) {
+	for value, want := range map[string]time.Time{
+		`"20261017Z"`:       time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC),
+		`"202610171530Z"`:   time.Date(2026, 10, 17, 15, 30, 0, 0, time.UTC),
+		`"20261017153045Z"`: time.Date(2026, 10, 17, 15, 30, 45, 0, time.UTC),
+		`"20261017"`:        time.Date(2026, 10, 17, 0, 0, 0, 0, time.Local),
+	} {
+		got, err := ParseExpiry(value)
+		if err != nil || !got.Equal(want) {
+			t.Fatalf("%s: expected %s got %s (%v)", value, want, got, err)
+		}
+	}
+
+	for _, bad := range []string{`20261017`, `"2026"`, `"2026101715"`} {
+		if _, err := ParseExpiry(bad); err == nil {
+			t.Fatalf("%s should not parse", bad)
+		}
+	}
+
+	now := time.Now().Truncate(time.Second)
+	if got, err := ParseExpiry(`"` + FormatExpiry(now) + `"`); err != nil || !got.Equal(now) {
+		t.Fatalf("formatted expiry did not round trip, %s != %s (%v)", got, now, err)
+	}
+}
+
+func testKey(t *testing.T) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+}
+
+func TestRemoveExpiring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guest")
+
+	lines := []string{
+		testKey(t) + " permanent",
+		ExpiryOption + `="` + FormatExpiry(time.Now().Add(-time.Minute)) + `" ` + testKey(t) + " expired",
+		ExpiryOption + `="` + FormatExpiry(time.Now().Add(time.Hour)) + `",` + ReadOnlyOption + " " + testKey(t) + " current",
+	}
+	for _, line := range lines {
+		if err := Append(path, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := RemoveExpiring(path, time.Now(), false)
+	if err != nil || len(removed) != 1 || removed[0] != "expired" {
+		t.Fatalf("expected only the expired key to be removed, got %v %v", removed, err)
+	}
+
+	grants, err := Grants(path)
+	if err != nil || len(grants) != 1 || grants[0].Comment != "current" || !grants[0].ReadOnly {
+		t.Fatalf("expected the current read only grant, got %+v %v", grants, err)
+	}
+
+	removed, err = RemoveExpiring(path, time.Time{}, true)
+	if err != nil || len(removed) != 1 {
+		t.Fatalf("expected the current grant to be revoked, got %v %v", removed, err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(content)) != lines[0] {
+		t.Fatalf("permanent key was not kept: %q %v", content, err)
+	}
+
+	// A file with only temporary keys is removed once they are
+	if err := os.WriteFile(path, []byte(lines[1]+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RemoveExpiring(path, time.Now(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("empty key file was left behind")
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorized_controllee_keys")
+
+	// Comments and lines that are not keys are left alone
+	if err := os.WriteFile(path, []byte("# clients\n"+testKey(t)+" first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := Entry{Key: key, Comment: "second", Options: []string{`owner="alice"`, ExpiryOption + `="` + FormatExpiry(time.Now().Add(time.Hour)) + `"`}}
+	if err := Add(path, added); err != nil {
+		t.Fatal(err)
+	}
+	if err := Add(path, Entry{Key: key, Comment: "again"}); err == nil {
+		t.Fatal("the same key should not be added twice")
+	}
+
+	entries, err := Entries(path)
+	if err != nil || len(entries) != 2 || entries[1].Comment != "second" || entries[1].Expires.IsZero() || entries[1].Options[0] != `owner="alice"` {
+		t.Fatalf("expected the first key and the added one with its options, got %+v %v", entries, err)
+	}
+
+	removed, err := Remove(path, entries[1].Fingerprint())
+	if err != nil || len(removed) != 1 || removed[0].Comment != "second" {
+		t.Fatalf("expected the added key to be removed by fingerprint, got %+v %v", removed, err)
+	}
+
+	removed, err = Remove(path, "nothing")
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("nothing should match, got %+v %v", removed, err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || !strings.HasPrefix(string(content), "# clients\n") || strings.Count(string(content), "\n") != 2 {
+		t.Fatalf("unexpected file after removal: %q %v", content, err)
+	}
+}
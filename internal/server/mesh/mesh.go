@@ -0,0 +1,185 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Advertisement is sent by clients when they connect, it lists the interface addresses (in CIDR form) other clients could reach them on
+type Advertisement struct {
+	Networks []string
+}
+
+type Peer struct {
+	ID string
+	// The client this one connected back through, empty if it connected to the server directly
+	Parent string
+	// Whether the client has said it can relay, older clients dont advertise anything
+	Advertised bool
+	Interfaces []*net.IPNet
+	// Ports the client is currently relaying connections to the server on
+	RelayPorts []uint32
+}
+
+var (
+	lck   sync.RWMutex
+	peers = map[string]*Peer{}
+)
+
+// Connected records a new client, parent is the id of the client it was relayed through (if any)
+func Connected(id, parent string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	peers[id] = &Peer{ID: id, Parent: parent}
+}
+
+func Disconnected(id string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	delete(peers, id)
+}
+
+func Advertised(id string, adv Advertisement) error {
+	var interfaces []*net.IPNet
+	for _, n := range adv.Networks {
+		ip, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return fmt.Errorf("invalid network %q: %w", n, err)
+		}
+
+		network.IP = ip
+		interfaces = append(interfaces, network)
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	p, ok := peers[id]
+	if !ok {
+		// Disconnected before it answered
+		return nil
+	}
+
+	p.Advertised = true
+	p.Interfaces = interfaces
+
+	return nil
+}
+
+func AddRelay(id string, port uint32) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	p, ok := peers[id]
+	if !ok {
+		return
+	}
+
+	for _, existing := range p.RelayPorts {
+		if existing == port {
+			return
+		}
+	}
+	p.RelayPorts = append(p.RelayPorts, port)
+}
+
+func RemoveRelay(id string, port uint32) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	p, ok := peers[id]
+	if !ok {
+		return
+	}
+
+	for i, existing := range p.RelayPorts {
+		if existing == port {
+			p.RelayPorts = append(p.RelayPorts[:i], p.RelayPorts[i+1:]...)
+			return
+		}
+	}
+}
+
+// Path returns the relays a client connected back through, starting from the one directly connected to the server
+func Path(id string) []string {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	var path []string
+	seen := map[string]bool{id: true}
+	for p, ok := peers[id]; ok && p.Parent != ""; p, ok = peers[p.Parent] {
+		if seen[p.Parent] {
+			// Shouldnt be possible, but a loop would hang the console
+			break
+		}
+		seen[p.Parent] = true
+
+		path = append([]string{p.Parent}, path...)
+	}
+
+	return path
+}
+
+// Reachable returns the ids of clients with an interface on the same network as ip
+func Reachable(ip net.IP) []string {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	var ids []string
+	for id, p := range peers {
+		for _, iface := range p.Interfaces {
+			if iface.Contains(ip) {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// RelayAddresses lists every address:port a client without a route to the server could try to connect back through
+func RelayAddresses() []string {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	var addresses []string
+	for _, p := range peers {
+		for _, port := range p.RelayPorts {
+			for _, iface := range p.Interfaces {
+				addresses = append(addresses, net.JoinHostPort(iface.IP.String(), strconv.Itoa(int(port))))
+			}
+		}
+	}
+
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// Peers returns a copy of everything known about the mesh, sorted by id
+func Peers() []Peer {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	var out []Peer
+	for _, p := range peers {
+		c := *p
+		c.Interfaces = append([]*net.IPNet(nil), p.Interfaces...)
+		c.RelayPorts = append([]uint32(nil), p.RelayPorts...)
+		out = append(out, c)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+
+	return out
+}
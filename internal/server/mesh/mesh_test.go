@@ -0,0 +1,52 @@
+package mesh
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPathAndReachability(t *testing.T) {
+	Connected("a", "")
+	Connected("b", "a")
+	Connected("c", "b")
+	defer func() {
+		Disconnected("a")
+		Disconnected("b")
+		Disconnected("c")
+	}()
+
+	if path := Path("c"); !reflect.DeepEqual(path, []string{"a", "b"}) {
+		t.Fatalf("expected path [a b] got %v", path)
+	}
+
+	if path := Path("a"); len(path) != 0 {
+		t.Fatalf("directly connected client should have an empty path, got %v", path)
+	}
+
+	if err := Advertised("a", Advertisement{Networks: []string{"10.1.2.3/24", "192.168.0.7/16"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Advertised("b", Advertisement{Networks: []string{"not a network"}}); err == nil {
+		t.Fatal("expected invalid network to be rejected")
+	}
+
+	if ids := Reachable(net.ParseIP("10.1.2.200")); !reflect.DeepEqual(ids, []string{"a"}) {
+		t.Fatalf("expected a to reach 10.1.2.200 got %v", ids)
+	}
+
+	if ids := Reachable(net.ParseIP("10.1.3.1")); len(ids) != 0 {
+		t.Fatalf("nothing should reach 10.1.3.1 got %v", ids)
+	}
+
+	AddRelay("a", 2222)
+	if addresses := RelayAddresses(); !reflect.DeepEqual(addresses, []string{"10.1.2.3:2222", "192.168.0.7:2222"}) {
+		t.Fatalf("unexpected relay addresses %v", addresses)
+	}
+
+	RemoveRelay("a", 2222)
+	if addresses := RelayAddresses(); len(addresses) != 0 {
+		t.Fatalf("expected no relays got %v", addresses)
+	}
+}
@@ -0,0 +1,28 @@
+package observers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/observer"
+)
+
+// AuditAnchor is the chain head of an audit log under legal hold, sent out so the log can later be shown to be unchanged
+type AuditAnchor struct {
+	File   string
+	Offset int64
+	SHA256 string
+
+	Timestamp time.Time
+}
+
+func (a AuditAnchor) Summary() string {
+	return fmt.Sprintf("audit log %s anchored at %d bytes, sha256 %s", a.File, a.Offset, a.SHA256)
+}
+
+func (a AuditAnchor) Json() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+var AuditAnchors = observer.New[AuditAnchor]()
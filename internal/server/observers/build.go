@@ -0,0 +1,43 @@
+package observers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/observer"
+)
+
+// Build is a link rebuilt by the server on its own, e.g after the go toolchain or client source changed
+type Build struct {
+	// rebuilt or failed
+	Status string
+
+	Link   string
+	Reason string
+
+	// Of the new build, empty if it failed
+	Fingerprint string
+	SHA256      string
+
+	Error string
+
+	// Of the link, set by link --campaign
+	Campaign string `json:",omitempty"`
+
+	Timestamp time.Time
+}
+
+func (b Build) Summary() string {
+	if b.Status == "failed" {
+		return fmt.Sprintf("rebuilding %s after %s failed: %s", b.Link, b.Reason, b.Error)
+	}
+
+	return fmt.Sprintf("%s rebuilt after %s, new key %s, sha256 %s", b.Link, b.Reason, b.Fingerprint, b.SHA256)
+}
+
+func (b Build) Json() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+var Builds = observer.New[Build]()
@@ -9,15 +9,25 @@ import (
 )
 
 type ClientState struct {
-	Status    string
-	ID        string
-	IP        string
-	HostName  string
-	Version   string
+	// connected, disconnected, tampered when the client binary failed its integrity check, transport when the client moved to a fallback transport or back,
+	// or hostkey when an ssh server reached through the client presented a key that does not match the pinned one
+	Status string
+	// Why, for tampered, transport and hostkey
+	Reason string `json:",omitempty"`
+
+	ID       string
+	IP       string
+	HostName string
+	Version  string
+	// Set by link --campaign
+	Campaign  string `json:",omitempty"`
 	Timestamp time.Time
 }
 
 func (cs ClientState) Summary() string {
+	if cs.Reason != "" {
+		return fmt.Sprintf("%s (%s) %s %s: %s", cs.HostName, cs.ID, cs.Version, cs.Status, cs.Reason)
+	}
 	return fmt.Sprintf("%s (%s) %s %s", cs.HostName, cs.ID, cs.Version, cs.Status)
 }
 
@@ -0,0 +1,31 @@
+package observers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/observer"
+)
+
+// Command is a console command run by a user, either typed into the console or with ssh server <command>
+type Command struct {
+	User       string
+	Connection string
+
+	// console or exec
+	Source string
+	Line   string
+
+	Timestamp time.Time
+}
+
+func (c Command) Summary() string {
+	return fmt.Sprintf("%s ran %q (%s)", c.User, c.Line, c.Source)
+}
+
+func (c Command) Json() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+var Commands = observer.New[Command]()
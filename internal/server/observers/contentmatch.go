@@ -0,0 +1,34 @@
+package observers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/observer"
+)
+
+// ContentMatch is a content filter matching data passing through the server. What matched is never included
+type ContentMatch struct {
+	Filter string
+	// alert or redact
+	Action string
+
+	// The forward or log the data was in
+	Where string
+
+	Timestamp time.Time
+}
+
+func (c ContentMatch) Summary() string {
+	if c.Action == "redact" {
+		return fmt.Sprintf("content filter %s redacted data in %s", c.Filter, c.Where)
+	}
+	return fmt.Sprintf("content filter %s matched data in %s", c.Filter, c.Where)
+}
+
+func (c ContentMatch) Json() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+var ContentMatches = observer.New[ContentMatch]()
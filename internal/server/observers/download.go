@@ -0,0 +1,41 @@
+package observers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/observer"
+)
+
+type Download struct {
+	// downloaded when a link is fetched, attributed when a client connects that came from it
+	Status string
+
+	Link        string
+	Fingerprint string
+	Method      string
+	Encoding    string
+	IP          string
+	UserAgent   string
+
+	// Set once attributed
+	ID       string
+	HostName string
+
+	Timestamp time.Time
+}
+
+func (d Download) Summary() string {
+	if d.Status == "attributed" {
+		return fmt.Sprintf("%s (%s) came from download of %s by %s", d.HostName, d.ID, d.Link, d.IP)
+	}
+
+	return fmt.Sprintf("%s downloaded by %s over %s (%s)", d.Link, d.IP, d.Method, d.UserAgent)
+}
+
+func (d Download) Json() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+var Downloads = observer.New[Download]()
@@ -0,0 +1,59 @@
+package observers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/observer"
+)
+
+type ClientNetworkChange struct {
+	Status   string
+	ID       string
+	HostName string
+	Version  string
+
+	Fingerprint string
+
+	PreviousIP, IP           string
+	PreviousNetwork, Network string
+	PreviousASN, ASN         string
+	PreviousCountry, Country string
+
+	// Which of ip, network, asn or country differ from the last connection
+	Changed []string
+
+	// Set by link --campaign
+	Campaign string `json:",omitempty"`
+
+	Timestamp time.Time
+}
+
+func (nc ClientNetworkChange) Summary() string {
+	return fmt.Sprintf("%s (%s) %s moved networks (%s): %s -> %s", nc.HostName, nc.ID, nc.Version, strings.Join(nc.Changed, ", "), nc.describe(nc.PreviousIP, nc.PreviousASN, nc.PreviousCountry), nc.describe(nc.IP, nc.ASN, nc.Country))
+}
+
+func (nc ClientNetworkChange) describe(ip, asn, country string) string {
+	var extra []string
+	if asn != "" {
+		extra = append(extra, "AS"+asn)
+	}
+
+	if country != "" {
+		extra = append(extra, country)
+	}
+
+	if len(extra) == 0 {
+		return ip
+	}
+
+	return fmt.Sprintf("%s [%s]", ip, strings.Join(extra, " "))
+}
+
+func (nc ClientNetworkChange) Json() ([]byte, error) {
+	return json.Marshal(nc)
+}
+
+var NetworkChange = observer.New[ClientNetworkChange]()
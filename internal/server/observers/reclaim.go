@@ -0,0 +1,39 @@
+package observers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/observer"
+)
+
+// Reclaim is a forward, channel or listener the server closed because nothing would use it again
+type Reclaim struct {
+	// forward, channel or listener
+	Kind string
+	// The operator that opened it, if known
+	Owner  string
+	Client string
+	What   string
+	Reason string
+
+	// How long it was open, or for listeners since its client was last seen
+	Age time.Duration
+
+	Timestamp time.Time
+}
+
+func (r Reclaim) Summary() string {
+	summary := fmt.Sprintf("reclaimed %s %s", r.Kind, r.What)
+	if r.Owner != "" {
+		summary += " owned by " + r.Owner
+	}
+	return summary + ": " + r.Reason
+}
+
+func (r Reclaim) Json() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+var Reclaims = observer.New[Reclaim]()
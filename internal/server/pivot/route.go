@@ -0,0 +1,201 @@
+package pivot
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"golang.org/x/crypto/ssh"
+)
+
+// Route is an ssh connection the server makes to a client's jump server, the same one operators reach with -J.
+// It lets the server open forwards on the client for an operator, so the operator's end of the forward can be on their own machine
+// and nothing has to listen on the shared server
+type Route struct {
+	ID string
+
+	conn ssh.Conn
+	// Closed when the route is closed, or the client goes away
+	done chan struct{}
+}
+
+// Open connects to the jump server of target, forwarded is given the forwarded-tcpip channels the client opens for reverse forwards
+// requested over the route. If forwarded is nil they are rejected
+func Open(id string, target *ssh.ServerConn, forwarded func(ssh.NewChannel)) (*Route, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client accepts any key on its jump server, as it can only be reached through the server
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	jump, reqs, err := target.OpenChannel("jump", nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open jump channel to %s: %w", id, err)
+	}
+	go ssh.DiscardRequests(reqs)
+
+	config := &ssh.ClientConfig{
+		User: "rssh",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			// The client uses the same key for its jump server as it logs in to us with
+			if !secure.EqualString(internal.FingerprintSHA1Hex(key), target.Permissions.Extensions["pubkey-fp"]) {
+				return errors.New("client jump server key does not match the key it connected with")
+			}
+			return nil
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	conn, chans, globalReqs, err := ssh.NewClientConn(&channelConn{Channel: jump, remote: target.RemoteAddr()}, id, config)
+	if err != nil {
+		jump.Close()
+		return nil, fmt.Errorf("unable to connect to %s jump server: %w", id, err)
+	}
+	go ssh.DiscardRequests(globalReqs)
+
+	go func() {
+		for nc := range chans {
+			if nc.ChannelType() != "forwarded-tcpip" || forwarded == nil {
+				nc.Reject(ssh.UnknownChannelType, "unexpected channel")
+				continue
+			}
+
+			go forwarded(nc)
+		}
+	}()
+
+	r := &Route{
+		ID:   id,
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		conn.Wait()
+		close(r.done)
+	}()
+
+	return r, nil
+}
+
+// Dial opens a direct-tcpip channel from the client, extraData is the payload of the operator's direct-tcpip request
+func (r *Route) Dial(extraData []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return r.conn.OpenChannel("direct-tcpip", extraData)
+}
+
+// DialContext connects to addr from the client, so it can be used as the dialer of an http.Transport
+func (r *Route) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+
+	type result struct {
+		channel ssh.Channel
+		err     error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		channel, reqs, err := r.Dial(ssh.Marshal(&internal.ChannelOpenDirectMsg{
+			Raddr: host,
+			Rport: uint32(port),
+			Laddr: "127.0.0.1",
+		}))
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+		}
+		done <- result{channel, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return &channelConn{Channel: res.channel, remote: r.conn.RemoteAddr()}, nil
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.err == nil {
+				res.channel.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// DialUDP opens a direct-udp@rssh channel from the client, datagrams on it are framed with internal.WriteDatagram
+func (r *Route) DialUDP(extraData []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return r.conn.OpenChannel("direct-udp@rssh", extraData)
+}
+
+// SendRequest sends a global request (e.g tcpip-forward) to the client's jump server
+func (r *Route) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	return r.conn.SendRequest(name, wantReply, payload)
+}
+
+func (r *Route) Close() error {
+	return r.conn.Close()
+}
+
+// Wait blocks until the route is closed, or the client goes away
+func (r *Route) Wait() error {
+	return r.conn.Wait()
+}
+
+// Closed reports whether the route has been closed, or the client has gone away
+func (r *Route) Closed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type channelConn struct {
+	ssh.Channel
+	remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *channelConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *channelConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *channelConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
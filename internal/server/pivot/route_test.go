@@ -0,0 +1,292 @@
+package pivot_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/handlers"
+	"github.com/NHAS/reverse_ssh/internal/server/pivot"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// connectClient connects an rssh client with key to a stand in for the server, returning the server's side of the connection.
+// The server records recordedKey as the client's key, which is the key the client actually used unless a test is lying
+func connectClient(t *testing.T, key ssh.Signer, recordedKey ssh.PublicKey) *ssh.ServerConn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+
+		conn, chans, reqs, err := ssh.NewClientConn(c, "server", &ssh.ClientConfig{
+			User:            "client",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		jump := handlers.JumpHandler(key, conn)
+		for nc := range chans {
+			go jump(nc, logger.NewLog("client"))
+		}
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": internal.FingerprintSHA1Hex(recordedKey)}}, nil
+		},
+	}
+	config.AddHostKey(newSigner(t))
+
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for nc := range chans {
+			nc.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	return conn
+}
+
+func echoServer(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr)
+}
+
+func roundTrip(t *testing.T, rw io.ReadWriter) {
+	if _, err := rw.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(rw, b); err != nil || string(b) != "ping" {
+		t.Fatalf("did not get ping back: %q %v", b, err)
+	}
+}
+
+func TestRouteDial(t *testing.T) {
+	key := newSigner(t)
+	target := connectClient(t, key, key.PublicKey())
+
+	route, err := pivot.Open("client", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer route.Close()
+
+	echo := echoServer(t)
+
+	// What ssh -D sends for each socks connection
+	channel, reqs, err := route.Dial(ssh.Marshal(&internal.ChannelOpenDirectMsg{
+		Raddr: echo.IP.String(),
+		Rport: uint32(echo.Port),
+		Laddr: "127.0.0.1",
+		Lport: 1234,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	roundTrip(t, channel)
+}
+
+func TestRouteReverseForward(t *testing.T) {
+	key := newSigner(t)
+	target := connectClient(t, key, key.PublicKey())
+
+	forwarded := make(chan ssh.NewChannel, 1)
+	route, err := pivot.Open("client", target, func(nc ssh.NewChannel) {
+		forwarded <- nc
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer route.Close()
+
+	ok, reply, err := route.SendRequest("tcpip-forward", true, ssh.Marshal(&internal.RemoteForwardRequest{BindAddr: "127.0.0.1"}))
+	if err != nil || !ok {
+		t.Fatalf("client did not open the forward: %s %v", reply, err)
+	}
+
+	var allocated struct{ Port uint32 }
+	if err := ssh.Unmarshal(reply, &allocated); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(allocated.Port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	nc := <-forwarded
+	channel, reqs, err := nc.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	go io.Copy(channel, channel)
+
+	roundTrip(t, c)
+
+	// Closing the route stops the listener on the client
+	route.Close()
+	route.Wait()
+}
+
+func TestRouteChecksClientKey(t *testing.T) {
+	key := newSigner(t)
+	target := connectClient(t, key, newSigner(t).PublicKey())
+
+	if _, err := pivot.Open("client", target, nil); err == nil {
+		t.Fatal("route connected to a jump server whose key is not the one the client logged in with")
+	}
+}
+
+func TestRouteDialUDP(t *testing.T) {
+	key := newSigner(t)
+	target := connectClient(t, key, key.PublicKey())
+
+	route, err := pivot.Open("client", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer route.Close()
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], from)
+		}
+	}()
+
+	addr := echo.LocalAddr().(*net.UDPAddr)
+	channel, reqs, err := route.DialUDP(ssh.Marshal(&internal.ChannelOpenDirectMsg{
+		Raddr: addr.IP.String(),
+		Rport: uint32(addr.Port),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	// Datagram boundaries are kept, even when written back to back
+	for _, datagram := range []string{"first", "second"} {
+		if err := internal.WriteDatagram(channel, []byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"first", "second"} {
+		got, err := internal.ReadDatagram(channel)
+		if err != nil || string(got) != want {
+			t.Fatalf("got datagram %q (%v), want %q", got, err, want)
+		}
+	}
+}
+
+func TestRouteDialContextHTTP(t *testing.T) {
+	key := newSigner(t)
+	target := connectClient(t, key, key.PublicKey())
+
+	route, err := pivot.Open("client", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer route.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Test"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: route.DialContext}}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("X-Test", "through the client")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "through the client" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
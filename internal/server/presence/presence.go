@@ -0,0 +1,208 @@
+package presence
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Operators sharing an engagement can end up on the same client at once, typing over each other or killing each other's processes.
+// This keeps which operators have sessions or forwards open on each client, and when anything last went through them, so ls can show
+// who is there and connect can warn before an operator starts on a client someone else is working on.
+
+// ActiveWithin is how recently a session must have carried something for its operator to count as actively using the client
+const ActiveWithin = 2 * time.Minute
+
+type Kind string
+
+const (
+	// A shell opened with connect
+	Shell Kind = "shell"
+	// ssh through the server as a jump host, whether it is a shell or forwards cannot be seen
+	SSH Kind = "ssh"
+	// Forwards going out through the client, from the socks command or ssh -R
+	Forward Kind = "forward"
+)
+
+type entry struct {
+	client   string
+	operator string
+	kind     Kind
+	started  time.Time
+
+	// Unix nanoseconds
+	last atomic.Int64
+}
+
+var (
+	mu      sync.Mutex
+	entries = map[*entry]bool{}
+)
+
+// Handle is one session or forward, its operator is on the client until Close is called
+type Handle struct {
+	e    *entry
+	once sync.Once
+}
+
+// Open marks operator as having a kind of session open on client
+func Open(client, operator string, kind Kind) *Handle {
+	e := &entry{client: client, operator: operator, kind: kind, started: time.Now()}
+	e.last.Store(e.started.UnixNano())
+
+	mu.Lock()
+	entries[e] = true
+	mu.Unlock()
+
+	return &Handle{e: e}
+}
+
+// Touch records that the session carried something. Safe to call on nil
+func (h *Handle) Touch() {
+	if h == nil {
+		return
+	}
+	h.e.last.Store(time.Now().UnixNano())
+}
+
+// Close ends the session, it is safe to call more than once
+func (h *Handle) Close() {
+	if h == nil {
+		return
+	}
+
+	h.once.Do(func() {
+		mu.Lock()
+		delete(entries, h.e)
+		mu.Unlock()
+	})
+}
+
+type tracked struct {
+	io.ReadWriteCloser
+	h *Handle
+}
+
+func (t *tracked) Read(b []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(b)
+	if n > 0 {
+		t.h.Touch()
+	}
+	return n, err
+}
+
+func (t *tracked) Write(b []byte) (int, error) {
+	t.h.Touch()
+	return t.ReadWriteCloser.Write(b)
+}
+
+// Track returns rwc with every read and write counted as activity on the session
+func (h *Handle) Track(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &tracked{ReadWriteCloser: rwc, h: h}
+}
+
+type trackedChannel struct {
+	ssh.Channel
+	h *Handle
+}
+
+func (t *trackedChannel) Read(b []byte) (int, error) {
+	n, err := t.Channel.Read(b)
+	if n > 0 {
+		t.h.Touch()
+	}
+	return n, err
+}
+
+func (t *trackedChannel) Write(b []byte) (int, error) {
+	t.h.Touch()
+	return t.Channel.Write(b)
+}
+
+// TrackChannel is Track for an ssh channel, so its requests still go through
+func (h *Handle) TrackChannel(c ssh.Channel) ssh.Channel {
+	return &trackedChannel{Channel: c, h: h}
+}
+
+// Operator is everything one operator has open on a client
+type Operator struct {
+	Name       string
+	Open       map[Kind]int
+	Since      time.Time
+	LastActive time.Time
+}
+
+// Active is whether anything the operator has open on the client carried something recently
+func (o Operator) Active() bool {
+	return time.Since(o.LastActive) < ActiveWithin
+}
+
+func (o Operator) String() string {
+	var open []string
+	for _, kind := range []Kind{Shell, SSH, Forward} {
+		if n := o.Open[kind]; n > 0 {
+			open = append(open, fmt.Sprintf("%d %s", n, kind))
+		}
+	}
+
+	state := "idle " + time.Since(o.LastActive).Round(time.Second).String()
+	if o.Active() {
+		state = "active " + time.Since(o.LastActive).Round(time.Second).String() + " ago"
+	}
+
+	return fmt.Sprintf("%s (%s, %s)", o.Name, strings.Join(open, ", "), state)
+}
+
+// On lists the operators with something open on client, by name
+func On(client string) []Operator {
+	mu.Lock()
+	defer mu.Unlock()
+
+	byName := map[string]*Operator{}
+	for e := range entries {
+		if e.client != client {
+			continue
+		}
+
+		o, ok := byName[e.operator]
+		if !ok {
+			o = &Operator{Name: e.operator, Open: map[Kind]int{}, Since: e.started}
+			byName[e.operator] = o
+		}
+
+		o.Open[e.kind]++
+		if e.started.Before(o.Since) {
+			o.Since = e.started
+		}
+		if last := time.Unix(0, e.last.Load()); last.After(o.LastActive) {
+			o.LastActive = last
+		}
+	}
+
+	operators := make([]Operator, 0, len(byName))
+	for _, o := range byName {
+		operators = append(operators, *o)
+	}
+	sort.Slice(operators, func(i, j int) bool {
+		return operators[i].Name < operators[j].Name
+	})
+
+	return operators
+}
+
+// Others lists who other than operator is actively using client
+func Others(client, operator string) []Operator {
+	var others []Operator
+	for _, o := range On(client) {
+		if o.Name != operator && o.Active() {
+			others = append(others, o)
+		}
+	}
+	return others
+}
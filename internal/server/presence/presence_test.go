@@ -0,0 +1,42 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOperatorsOnClient(t *testing.T) {
+	shell := Open("client", "alice", Shell)
+	forward := Open("client", "alice", Forward)
+	idle := Open("client", "bob", SSH)
+	Open("elsewhere", "carol", Shell).Close()
+
+	// bob has not sent anything for a while
+	idle.e.last.Store(time.Now().Add(-2 * ActiveWithin).UnixNano())
+
+	on := On("client")
+	if len(on) != 2 || on[0].Name != "alice" || on[1].Name != "bob" {
+		t.Fatalf("expected alice and bob on client, got %+v", on)
+	}
+
+	if on[0].Open[Shell] != 1 || on[0].Open[Forward] != 1 || !on[0].Active() || on[1].Active() {
+		t.Fatalf("unexpected sessions or activity: %+v", on)
+	}
+
+	if others := Others("client", "bob"); len(others) != 1 || others[0].Name != "alice" {
+		t.Fatalf("bob should be warned about alice only, got %+v", others)
+	}
+
+	if others := Others("client", "alice"); len(others) != 0 {
+		t.Fatalf("idle operators should not be warned about, got %+v", others)
+	}
+
+	shell.Close()
+	shell.Close()
+	forward.Close()
+	idle.Close()
+
+	if on := On("client"); len(on) != 0 {
+		t.Fatalf("expected nobody left on client, got %+v", on)
+	}
+}
@@ -0,0 +1,307 @@
+package reaper
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+)
+
+// Long running servers collect things nothing will use again: a forward left open after the client it goes through or the operator
+// that opened it went away, a copy stuck waiting on a peer that never answered a close, a listener saved for a client that never came back.
+// Forwards and channels are tracked here with a check that says why they are dead and a way to close them, saved client listeners are
+// checked against when their client was last seen. Sweep closes whatever is dead and reports what it reclaimed.
+
+type Kind string
+
+const (
+	Forward  Kind = "forward"
+	Channel  Kind = "channel"
+	Listener Kind = "listener"
+)
+
+// HalfClosedGrace is how long a copy may keep going one way after the other way has finished and both ends were closed
+const HalfClosedGrace = time.Minute
+
+// Reclaims kept for the reap command
+const historyLength = 100
+
+// Resource is a forward or channel that is tracked until it is released, or reclaimed by a sweep
+type Resource struct {
+	kind   Kind
+	owner  string
+	client string
+	what   string
+	opened time.Time
+
+	// dead says why the resource can be reclaimed, or "" while it may still be used
+	dead  func() string
+	close func()
+}
+
+var (
+	mu        sync.Mutex
+	resources = map[*Resource]bool{}
+	history   []observers.Reclaim
+
+	// Saved client listeners are removed once their client has not been seen for this long, 0 keeps them
+	listenerTTL = defaultListenerTTL
+
+	connected = notConnected
+)
+
+const defaultListenerTTL = 30 * 24 * time.Hour
+
+func notConnected(fingerprint string) bool {
+	return false
+}
+
+// reset forgets everything tracked and reclaimed, and puts the settings back, for tests
+func reset() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	resources = map[*Resource]bool{}
+	history = nil
+	listenerTTL = defaultListenerTTL
+	connected = notConnected
+}
+
+// SetListenerTTL sets how long a client can be gone before the listeners saved for it are removed, 0 keeps them forever
+func SetListenerTTL(ttl time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	listenerTTL = ttl
+}
+
+// SetConnected sets how a sweep finds out whether a client key is connected, its saved listeners are never removed while it is
+func SetConnected(f func(fingerprint string) bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	connected = f
+}
+
+// Track starts tracking a resource. dead is called on every sweep and must not block, close is called once if it returns a reason
+func Track(kind Kind, owner, client, what string, dead func() string, close func()) *Resource {
+	r := &Resource{
+		kind:   kind,
+		owner:  owner,
+		client: client,
+		what:   what,
+		opened: time.Now(),
+		dead:   dead,
+		close:  close,
+	}
+
+	mu.Lock()
+	resources[r] = true
+	mu.Unlock()
+
+	return r
+}
+
+// Release stops tracking r, for when it was closed the normal way. Safe to call on nil
+func (r *Resource) Release() {
+	if r == nil {
+		return
+	}
+
+	mu.Lock()
+	delete(resources, r)
+	mu.Unlock()
+}
+
+// HalfClosed is the dead check of a copy whose other way finished at since
+func HalfClosed(since time.Time) func() string {
+	return func() string {
+		if time.Since(since) < HalfClosedGrace {
+			return ""
+		}
+		return "half closed for " + time.Since(since).Round(time.Second).String() + ", the peer never finished closing it"
+	}
+}
+
+// Sweep reclaims every dead resource and stale listener, with dryRun it only reports what it would reclaim
+func Sweep(dryRun bool) ([]observers.Reclaim, error) {
+	now := time.Now()
+
+	// Dead checks can take locks that are held while releasing, so they are run without holding mu
+	mu.Lock()
+	tracked := make([]*Resource, 0, len(resources))
+	for r := range resources {
+		tracked = append(tracked, r)
+	}
+	ttl, isConnected := listenerTTL, connected
+	mu.Unlock()
+
+	var (
+		dead      []*Resource
+		reclaimed []observers.Reclaim
+	)
+	for _, r := range tracked {
+		reason := r.dead()
+		if reason == "" {
+			continue
+		}
+
+		if !dryRun {
+			mu.Lock()
+			stillTracked := resources[r]
+			delete(resources, r)
+			mu.Unlock()
+
+			if !stillTracked {
+				// Released while it was being checked
+				continue
+			}
+		}
+
+		dead = append(dead, r)
+		reclaimed = append(reclaimed, observers.Reclaim{
+			Kind:      string(r.kind),
+			Owner:     r.owner,
+			Client:    r.client,
+			What:      r.what,
+			Reason:    reason,
+			Age:       now.Sub(r.opened),
+			Timestamp: now,
+		})
+	}
+
+	if !dryRun {
+		for _, r := range dead {
+			r.close()
+		}
+	}
+
+	stale, err := staleListeners(now, ttl, isConnected, dryRun)
+	reclaimed = append(reclaimed, stale...)
+
+	sort.Slice(reclaimed, func(i, j int) bool {
+		if reclaimed[i].Kind != reclaimed[j].Kind {
+			return reclaimed[i].Kind < reclaimed[j].Kind
+		}
+		return reclaimed[i].What < reclaimed[j].What
+	})
+
+	if !dryRun {
+		report(reclaimed)
+	}
+
+	return reclaimed, err
+}
+
+// staleListeners finds the saved client listeners whose client has been gone longer than ttl, and removes them unless dryRun is set
+func staleListeners(now time.Time, ttl time.Duration, isConnected func(string) bool, dryRun bool) ([]observers.Reclaim, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+
+	listeners, err := data.GetListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		reclaimed []observers.Reclaim
+		touched   = map[string]bool{}
+	)
+	for _, l := range listeners {
+		if l.Client == "" || l.Auto {
+			continue
+		}
+
+		if isConnected(l.Client) {
+			// Listeners only record when their client was last seen, so keep that up to date while it is here
+			if !touched[l.Client] && !dryRun {
+				touched[l.Client] = true
+				if err := data.TouchClientListeners(l.Client); err != nil {
+					log.Printf("unable to mark saved listeners of %s as in use: %s", l.Client, err)
+				}
+			}
+			continue
+		}
+
+		gone := now.Sub(l.UpdatedAt)
+		if gone < ttl {
+			continue
+		}
+
+		if !dryRun {
+			if err := data.DeleteListener(l.Client, false, l.Address); err != nil {
+				log.Printf("unable to remove stale listener %s on %s: %s", l.Address, l.Client, err)
+				continue
+			}
+		}
+
+		reclaimed = append(reclaimed, observers.Reclaim{
+			Kind:      string(Listener),
+			Owner:     l.Owner,
+			Client:    l.Client,
+			What:      l.Address,
+			Reason:    "client not seen for " + gone.Round(time.Minute).String(),
+			Age:       gone,
+			Timestamp: now,
+		})
+	}
+
+	return reclaimed, nil
+}
+
+func report(reclaimed []observers.Reclaim) {
+	if len(reclaimed) == 0 {
+		return
+	}
+
+	mu.Lock()
+	history = append(history, reclaimed...)
+	if len(history) > historyLength {
+		history = history[len(history)-historyLength:]
+	}
+	mu.Unlock()
+
+	for _, r := range reclaimed {
+		log.Println(r.Summary())
+		observers.Reclaims.Notify(r)
+	}
+}
+
+// History returns what recent sweeps reclaimed, oldest first
+func History() []observers.Reclaim {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return append([]observers.Reclaim(nil), history...)
+}
+
+// Tracked is how many forwards and channels are being tracked
+func Tracked() int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return len(resources)
+}
+
+// Run sweeps every interval until ctx is done
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := Sweep(false); err != nil {
+			log.Printf("unable to check for stale listeners: %s", err)
+		}
+	}
+}
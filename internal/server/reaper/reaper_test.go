@@ -0,0 +1,80 @@
+package reaper
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+)
+
+func TestSweep(t *testing.T) {
+	reset()
+	t.Cleanup(reset)
+
+	if err := data.LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, l := range []data.Listener{
+		{Owner: "alice", Client: "gone", Address: ":8080"},
+		{Owner: "alice", Client: "here", Address: ":8080"},
+		{Owner: "alice", Client: "gone*", Auto: true, Address: ":8080"},
+	} {
+		if err := data.SaveListener(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SetListenerTTL(time.Nanosecond)
+	SetConnected(func(fingerprint string) bool { return fingerprint == "here" })
+
+	closed := 0
+	Track(Forward, "alice", "client", "dead forward", func() string { return "client went away" }, func() { closed++ })
+	alive := Track(Forward, "bob", "client", "live forward", func() string { return "" }, func() { t.Fatal("live forward was closed") })
+	Track(Channel, "bob", "client", "released", func() string { return "stuck" }, func() { t.Fatal("released channel was closed") }).Release()
+	defer alive.Release()
+
+	time.Sleep(time.Millisecond)
+
+	reclaimed, err := Sweep(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reclaimed) != 2 || closed != 0 || len(History()) != 0 {
+		t.Fatalf("dry run should report the dead forward and listener without closing them, got %+v", reclaimed)
+	}
+
+	reclaimed, err = Sweep(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reclaimed) != 2 || reclaimed[0].What != "dead forward" || reclaimed[1].Kind != string(Listener) || reclaimed[1].Client != "gone" {
+		t.Fatalf("unexpected reclaims %+v", reclaimed)
+	}
+	if closed != 1 || len(History()) != 2 || Tracked() != 1 {
+		t.Fatalf("dead forward should be closed once and recorded, closed %d, tracking %d", closed, Tracked())
+	}
+
+	listeners, err := data.GetListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("only the listener of the client that is gone should be removed, left %+v", listeners)
+	}
+
+	if reclaimed, _ := Sweep(false); len(reclaimed) != 0 {
+		t.Fatalf("nothing should be left to reclaim, got %+v", reclaimed)
+	}
+}
+
+func TestHalfClosed(t *testing.T) {
+	if reason := HalfClosed(time.Now())(); reason != "" {
+		t.Fatalf("copy that just half closed should be left alone, got %q", reason)
+	}
+
+	if reason := HalfClosed(time.Now().Add(-2 * HalfClosedGrace))(); reason == "" {
+		t.Fatal("copy half closed past the grace period should be reclaimed")
+	}
+}
@@ -0,0 +1,477 @@
+package research
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type TLSFingerprint struct {
+	// Highest version offered, e.g 1.3
+	Version string
+	SNI     string
+	ALPN    []string
+
+	JA3     string
+	JA3Hash string
+	JA4     string
+}
+
+type SSHFingerprint struct {
+	Banner string
+
+	// md5 of the client's key exchange, cipher, mac and compression choices, as hassh does
+	HASSH           string `json:",omitempty"`
+	HASSHAlgorithms string `json:",omitempty"`
+}
+
+type HTTPFingerprint struct {
+	Method    string
+	Path      string
+	Host      string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+}
+
+var errShort = errors.New("not enough data")
+
+type reader struct {
+	b []byte
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || len(r.b) < n {
+		return nil, errShort
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out, nil
+}
+
+func (r *reader) uint8() (int, error) {
+	b, err := r.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return int(b[0]), nil
+}
+
+func (r *reader) uint16() (int, error) {
+	b, err := r.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(b)), nil
+}
+
+func (r *reader) uint24() (int, error) {
+	b, err := r.bytes(3)
+	if err != nil {
+		return 0, err
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2]), nil
+}
+
+func (r *reader) uint32() (int, error) {
+	b, err := r.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// vector reads a length prefixed block of lengthSize bytes
+func (r *reader) vector(lengthSize int) (*reader, error) {
+	var (
+		n   int
+		err error
+	)
+	switch lengthSize {
+	case 1:
+		n, err = r.uint8()
+	case 2:
+		n, err = r.uint16()
+	case 4:
+		n, err = r.uint32()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := r.bytes(n)
+	return &reader{b: b}, err
+}
+
+func (r *reader) uint16s() []int {
+	var out []int
+	for len(r.b) >= 2 {
+		v, _ := r.uint16()
+		out = append(out, v)
+	}
+	return out
+}
+
+func isGREASE(v int) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []int) []int {
+	var out []int
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+type clientHello struct {
+	version    int
+	ciphers    []int
+	extensions []int
+	groups     []int
+	points     []int
+	sigAlgs    []int
+	versions   []int
+	sni        string
+	alpn       []string
+}
+
+// handshakeMessage joins the fragments of the first handshake message from the tls records in b
+func handshakeMessage(b []byte) ([]byte, error) {
+	var message []byte
+	r := &reader{b: b}
+	for {
+		contentType, err := r.uint8()
+		if err != nil {
+			return nil, err
+		}
+		if contentType != 0x16 {
+			return nil, errors.New("not a tls handshake record")
+		}
+
+		if _, err := r.bytes(2); err != nil {
+			return nil, err
+		}
+
+		fragment, err := r.vector(2)
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, fragment.b...)
+
+		if len(message) >= 4 {
+			length := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if len(message) >= 4+length {
+				return message[:4+length], nil
+			}
+		}
+	}
+}
+
+func parseClientHello(b []byte) (*clientHello, error) {
+	message, err := handshakeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{b: message}
+	if messageType, _ := r.uint8(); messageType != 1 {
+		return nil, errors.New("not a client hello")
+	}
+	if _, err := r.uint24(); err != nil {
+		return nil, err
+	}
+
+	hello := &clientHello{}
+	if hello.version, err = r.uint16(); err != nil {
+		return nil, err
+	}
+
+	// Random and session id
+	if _, err := r.bytes(32); err != nil {
+		return nil, err
+	}
+	if _, err := r.vector(1); err != nil {
+		return nil, err
+	}
+
+	ciphers, err := r.vector(2)
+	if err != nil {
+		return nil, err
+	}
+	hello.ciphers = ciphers.uint16s()
+
+	if _, err := r.vector(1); err != nil {
+		return nil, err
+	}
+
+	// Very old clients send no extensions at all
+	if len(r.b) == 0 {
+		return hello, nil
+	}
+
+	extensions, err := r.vector(2)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(extensions.b) > 0 {
+		extType, err := extensions.uint16()
+		if err != nil {
+			return nil, err
+		}
+		data, err := extensions.vector(2)
+		if err != nil {
+			return nil, err
+		}
+		hello.extensions = append(hello.extensions, extType)
+
+		switch extType {
+		case 0x0000:
+			if list, err := data.vector(2); err == nil {
+				if nameType, _ := list.uint8(); nameType == 0 {
+					if name, err := list.vector(2); err == nil {
+						hello.sni = string(name.b)
+					}
+				}
+			}
+		case 0x000a:
+			if list, err := data.vector(2); err == nil {
+				hello.groups = list.uint16s()
+			}
+		case 0x000b:
+			if list, err := data.vector(1); err == nil {
+				for _, p := range list.b {
+					hello.points = append(hello.points, int(p))
+				}
+			}
+		case 0x000d:
+			if list, err := data.vector(2); err == nil {
+				hello.sigAlgs = list.uint16s()
+			}
+		case 0x0010:
+			if list, err := data.vector(2); err == nil {
+				for len(list.b) > 0 {
+					protocol, err := list.vector(1)
+					if err != nil {
+						break
+					}
+					hello.alpn = append(hello.alpn, string(protocol.b))
+				}
+			}
+		case 0x002b:
+			if list, err := data.vector(1); err == nil {
+				hello.versions = list.uint16s()
+			}
+		}
+	}
+
+	return hello, nil
+}
+
+func joinInts(values []int, sep string, format func(int) string) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, format(v))
+	}
+	return strings.Join(parts, sep)
+}
+
+func decimal(v int) string {
+	return strconv.Itoa(v)
+}
+
+func hex4(v int) string {
+	return fmt.Sprintf("%04x", v)
+}
+
+// ja3 is the salesforce JA3 string of the hello, and its md5
+func (h *clientHello) ja3() (string, string) {
+	s := strings.Join([]string{
+		decimal(h.version),
+		joinInts(withoutGREASE(h.ciphers), "-", decimal),
+		joinInts(withoutGREASE(h.extensions), "-", decimal),
+		joinInts(withoutGREASE(h.groups), "-", decimal),
+		joinInts(h.points, "-", decimal),
+	}, ",")
+
+	sum := md5.Sum([]byte(s))
+	return s, hex.EncodeToString(sum[:])
+}
+
+func (h *clientHello) highestVersion() int {
+	highest := h.version
+	if versions := withoutGREASE(h.versions); len(versions) > 0 {
+		highest = 0
+		for _, v := range versions {
+			highest = max(highest, v)
+		}
+	}
+	return highest
+}
+
+func versionName(v int) (ja4, name string) {
+	switch v {
+	case 0x0304:
+		return "13", "1.3"
+	case 0x0303:
+		return "12", "1.2"
+	case 0x0302:
+		return "11", "1.1"
+	case 0x0301:
+		return "10", "1.0"
+	case 0x0300:
+		return "s3", "ssl3"
+	}
+	return "00", fmt.Sprintf("0x%04x", v)
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func truncatedSHA256(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func sortedHex(values []int) string {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	return joinInts(sorted, ",", hex4)
+}
+
+// ja4 is the FoxIO JA4 fingerprint of the hello, over tcp
+func (h *clientHello) ja4() string {
+	version, _ := versionName(h.highestVersion())
+
+	sni := "i"
+	if h.sni != "" {
+		sni = "d"
+	}
+
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAlnum(first) && isAlnum(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", version, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	// SNI and ALPN are already in the first part
+	var hashed []int
+	for _, ext := range extensions {
+		if ext != 0x0000 && ext != 0x0010 {
+			hashed = append(hashed, ext)
+		}
+	}
+
+	c := sortedHex(hashed)
+	if len(h.sigAlgs) > 0 && c != "" {
+		c += "_" + joinInts(withoutGREASE(h.sigAlgs), ",", hex4)
+	}
+
+	return a + "_" + truncatedSHA256(sortedHex(ciphers)) + "_" + truncatedSHA256(c)
+}
+
+func fingerprintTLS(b []byte) (*TLSFingerprint, error) {
+	hello, err := parseClientHello(b)
+	if err != nil {
+		return nil, err
+	}
+
+	_, version := versionName(hello.highestVersion())
+	ja3, ja3Hash := hello.ja3()
+
+	return &TLSFingerprint{
+		Version: version,
+		SNI:     hello.sni,
+		ALPN:    hello.alpn,
+		JA3:     ja3,
+		JA3Hash: ja3Hash,
+		JA4:     hello.ja4(),
+	}, nil
+}
+
+func fingerprintSSH(b []byte) *SSHFingerprint {
+	end := bytes.IndexByte(b, '\n')
+	if end == -1 {
+		// A banner without its line ending yet, as much as arrived
+		return &SSHFingerprint{Banner: strings.TrimSpace(string(b[:min(len(b), 255)]))}
+	}
+
+	fp := &SSHFingerprint{Banner: strings.TrimRight(string(b[:end]), "\r")}
+
+	// The client's KEXINIT follows in the clear
+	r := &reader{b: b[end+1:]}
+	packet, err := r.vector(4)
+	if err != nil {
+		return fp
+	}
+
+	padding, err := packet.uint8()
+	if err != nil || padding > len(packet.b) {
+		return fp
+	}
+	payload := &reader{b: packet.b[:len(packet.b)-padding]}
+
+	if msg, _ := payload.uint8(); msg != 20 {
+		return fp
+	}
+	if _, err := payload.bytes(16); err != nil {
+		return fp
+	}
+
+	var lists []string
+	for i := 0; i < 10; i++ {
+		list, err := payload.vector(4)
+		if err != nil {
+			return fp
+		}
+		lists = append(lists, string(list.b))
+	}
+
+	// kex, ciphers, macs and compression from client to server
+	fp.HASSHAlgorithms = strings.Join([]string{lists[0], lists[2], lists[4], lists[6]}, ";")
+	sum := md5.Sum([]byte(fp.HASSHAlgorithms))
+	fp.HASSH = hex.EncodeToString(sum[:])
+
+	return fp
+}
+
+func fingerprintHTTP(b []byte) *HTTPFingerprint {
+	// Whatever headers arrived, even if the request is incomplete
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		line, _, _ := bytes.Cut(b, []byte("\n"))
+		method, rest, _ := strings.Cut(strings.TrimSpace(string(line)), " ")
+		path, _, _ := strings.Cut(rest, " ")
+		return &HTTPFingerprint{Method: method, Path: path}
+	}
+
+	return &HTTPFingerprint{
+		Method:    req.Method,
+		Path:      req.URL.RequestURI(),
+		Host:      req.Host,
+		UserAgent: req.UserAgent(),
+	}
+}
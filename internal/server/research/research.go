@@ -0,0 +1,233 @@
+package research
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Research mode records how everything that connects to the server's listener introduces itself, before and whether or not it authenticates.
+// The first bytes of each connection are kept, and once the connection closes, authenticates or has been open for a while they are turned
+// into fingerprints (JA3/JA4 for TLS, the banner and hassh for SSH, the request line for HTTP) and written to a log as a json line
+
+const (
+	// Enough for a TLS client hello or an SSH banner and key exchange
+	recordLimit = 16 << 10
+
+	// Connections still open after this are recorded as they are
+	observeWindow = 10 * time.Second
+)
+
+var (
+	lck     sync.Mutex
+	logPath string
+
+	// Open connections by remote address, so the ssh server can say how they ended
+	open = map[string]*recorder{}
+
+	writeLck sync.Mutex
+)
+
+// Record is a line of the research log
+type Record struct {
+	Time     time.Time
+	Remote   string
+	Local    string
+	Protocol string
+
+	// Bytes received while observing, up to recordLimit
+	Bytes    int
+	Duration string
+	// How the connection ended or what it authenticated as, empty if it closed or went quiet before that
+	Outcome string `json:",omitempty"`
+
+	TLS  *TLSFingerprint  `json:",omitempty"`
+	SSH  *SSHFingerprint  `json:",omitempty"`
+	HTTP *HTTPFingerprint `json:",omitempty"`
+
+	// The first bytes of anything else, hex encoded
+	Preview string `json:",omitempty"`
+}
+
+// Enable records every connection the listener accepts to the log at path
+func Enable(path string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	logPath = path
+}
+
+// Enabled is whether connections are being recorded
+func Enabled() bool {
+	lck.Lock()
+	defer lck.Unlock()
+
+	return logPath != ""
+}
+
+type recorder struct {
+	net.Conn
+
+	started time.Time
+	timer   *time.Timer
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	outcome  string
+	recorded bool
+}
+
+// Wrap records what conn sends when research mode is enabled, otherwise conn is returned as it is
+func Wrap(conn net.Conn) net.Conn {
+	if !Enabled() {
+		return conn
+	}
+
+	r := &recorder{
+		Conn:    conn,
+		started: time.Now(),
+	}
+	r.timer = time.AfterFunc(observeWindow, r.record)
+
+	lck.Lock()
+	open[conn.RemoteAddr().String()] = r
+	lck.Unlock()
+
+	return r
+}
+
+func (r *recorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		r.mu.Lock()
+		if !r.recorded && r.buf.Len() < recordLimit {
+			r.buf.Write(b[:min(n, recordLimit-r.buf.Len())])
+		}
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+func (r *recorder) Close() error {
+	r.record()
+	return r.Conn.Close()
+}
+
+// Outcome notes how the connection from addr got on, e.g whether it authenticated, and records it
+func Outcome(addr net.Addr, outcome string) {
+	lck.Lock()
+	r := open[addr.String()]
+	lck.Unlock()
+
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.outcome = outcome
+	r.mu.Unlock()
+
+	r.record()
+}
+
+func (r *recorder) record() {
+	r.mu.Lock()
+	if r.recorded {
+		r.mu.Unlock()
+		return
+	}
+	r.recorded = true
+
+	data := r.buf.Bytes()
+	record := Record{
+		Time:     r.started,
+		Remote:   r.RemoteAddr().String(),
+		Local:    r.LocalAddr().String(),
+		Bytes:    len(data),
+		Duration: time.Since(r.started).Round(time.Millisecond).String(),
+		Outcome:  r.outcome,
+	}
+	fingerprint(&record, data)
+	r.buf = bytes.Buffer{}
+	r.mu.Unlock()
+
+	r.timer.Stop()
+
+	lck.Lock()
+	if open[record.Remote] == r {
+		delete(open, record.Remote)
+	}
+	path := logPath
+	lck.Unlock()
+
+	if path == "" {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("Unable to encode research record: ", err)
+		return
+	}
+
+	if err := appendLine(path, line); err != nil {
+		log.Println("Unable to write research log: ", err)
+	}
+}
+
+func appendLine(path string, line []byte) error {
+	writeLck.Lock()
+	defer writeLck.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func fingerprint(record *Record, data []byte) {
+	switch {
+	case len(data) == 0:
+		record.Protocol = "none"
+	case data[0] == 0x16:
+		record.Protocol = "tls"
+		if fp, err := fingerprintTLS(data); err == nil {
+			record.TLS = fp
+		} else {
+			record.Preview = preview(data)
+		}
+	case bytes.HasPrefix(data, []byte("SSH-")):
+		record.Protocol = "ssh"
+		record.SSH = fingerprintSSH(data)
+	case bytes.HasPrefix(data, []byte("RAW")):
+		record.Protocol = "raw download"
+	case isHTTP(data):
+		record.Protocol = "http"
+		record.HTTP = fingerprintHTTP(data)
+	default:
+		record.Protocol = "unknown"
+		record.Preview = preview(data)
+	}
+}
+
+func isHTTP(b []byte) bool {
+	for _, method := range []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH "} {
+		if bytes.HasPrefix(b, []byte(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+func preview(b []byte) string {
+	return hex.EncodeToString(b[:min(len(b), 64)])
+}
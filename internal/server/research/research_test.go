@@ -0,0 +1,65 @@
+package research
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureClientHello(t *testing.T, config *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, recordLimit)
+	n, err := io.ReadAtLeast(server, buf, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestFingerprintTLS(t *testing.T) {
+	hello := captureClientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+
+	var record Record
+	fingerprint(&record, hello)
+	if record.Protocol != "tls" || record.TLS == nil {
+		t.Fatalf("expected a tls fingerprint, got %+v", record)
+	}
+
+	if record.TLS.SNI != "example.com" || record.TLS.Version != "1.3" {
+		t.Errorf("unexpected hello details: %+v", record.TLS)
+	}
+
+	if !strings.HasPrefix(record.TLS.JA4, "t13d") || !strings.Contains(record.TLS.JA4, "h2_") {
+		t.Errorf("unexpected ja4: %q", record.TLS.JA4)
+	}
+
+	if len(record.TLS.JA3Hash) != 32 || strings.Count(record.TLS.JA3, ",") != 4 {
+		t.Errorf("unexpected ja3: %q %q", record.TLS.JA3, record.TLS.JA3Hash)
+	}
+}
+
+func TestFingerprintSSHAndHTTP(t *testing.T) {
+	var record Record
+	fingerprint(&record, []byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	if record.Protocol != "ssh" || record.SSH.Banner != "SSH-2.0-OpenSSH_9.6" {
+		t.Errorf("unexpected ssh fingerprint: %+v", record.SSH)
+	}
+
+	record = Record{}
+	fingerprint(&record, []byte("GET /favicon.ico HTTP/1.1\r\nHost: target\r\nUser-Agent: zgrab/0.x\r\n\r\n"))
+	if record.Protocol != "http" || record.HTTP.Path != "/favicon.ico" || record.HTTP.UserAgent != "zgrab/0.x" {
+		t.Errorf("unexpected http fingerprint: %+v", record.HTTP)
+	}
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -13,73 +15,142 @@ import (
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/nat"
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"github.com/NHAS/reverse_ssh/internal/server/audit"
+	"github.com/NHAS/reverse_ssh/internal/server/commands"
+	"github.com/NHAS/reverse_ssh/internal/server/contentfilter"
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/eventbus"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
 	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/reaper"
+	"github.com/NHAS/reverse_ssh/internal/server/research"
+	"github.com/NHAS/reverse_ssh/internal/server/sourcefilter"
+	"github.com/NHAS/reverse_ssh/internal/server/systemd"
 	"github.com/NHAS/reverse_ssh/internal/server/tcp"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/server/webhooks"
 	"github.com/NHAS/reverse_ssh/internal/server/webserver"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"github.com/NHAS/reverse_ssh/pkg/mux"
 	"golang.org/x/crypto/ssh"
 )
 
+// CreateOrLoadServerKeys loads the server key, creating it if there is none. An escrowed key has to have been unlocked with hostkey.Load first
 func CreateOrLoadServerKeys(privateKeyPath string) (ssh.Signer, error) {
+	return hostkey.Load(privateKeyPath, nil, false)
+}
 
-	//If we have already created a private key (or there is one in the current directory) dont overwrite/create another one
-	if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
+func tsAllowedRoles() map[string]bool {
+	return map[string]bool{
+		roleClient: true,
+	}
+}
 
-		privateKeyPem, err := internal.GeneratePrivateKey()
-		if err != nil {
-			return nil, fmt.Errorf("unable to generate private key, and no private key specified: %s", err)
-		}
+// STUN servers the ts relay transport finds public addresses with, the DERP map's when empty
+var stunServers []string
 
-		err = os.WriteFile(privateKeyPath, privateKeyPem, 0600)
-		if err != nil {
-			return nil, fmt.Errorf("unable to write private key to disk: %s", err)
-		}
-	}
+// SetSTUNServers sets the STUN servers used by the ts relay transport, they are also put in client tokens
+func SetSTUNServers(servers []string) {
+	stunServers = servers
+}
 
-	privateBytes, err := os.ReadFile(privateKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load private key (%s): %s", privateKeyPath, err)
-	}
+// How many DERP regions the ts relay transport stays connected to, nat.DefaultDERPHomeRegions when 0
+var derpHomeRegions int
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %s", err)
-	}
+// SetDERPHomeRegions sets how many of the nearest DERP regions the ts relay transport stays connected to and puts in client tokens
+func SetDERPHomeRegions(regions int) {
+	derpHomeRegions = regions
+}
 
-	return private, nil
+// Bytes a second of relayed data each ts relay peer may send, nat.DefaultPeerDataRate when 0
+var relayPeerRate int
+
+// SetRelayPeerRate sets how much relayed data a ts relay peer may send before it is banned
+func SetRelayPeerRate(bytesPerSecond int) {
+	relayPeerRate = bytesPerSecond
 }
 
-func tsAllowedRoles() map[string]bool {
-	return map[string]bool{
-		roleClient: true,
+// Codec ts relay data is compressed with, see nat.ServiceConfig.RelayCompression
+var relayCompression string
+
+// SetRelayCompression sets the codec ts relay data is compressed with for clients that have it, none to turn compression off
+func SetRelayCompression(codec string) {
+	relayCompression = codec
+}
+
+// Idle timeout and keepalive interval of ts relay sessions, see nat.ServiceConfig. 0 turns either off
+var relayIdleTimeout, relayKeepalive time.Duration
+
+// SetRelaySessionTimers sets how long a relayed ts session may go without the client sending anything, and how often the server sends on it to keep it open
+func SetRelaySessionTimers(idleTimeout, keepalive time.Duration) {
+	relayIdleTimeout = idleTimeout
+	relayKeepalive = keepalive
+}
+
+// Whether a client started twice on the same machine is told to exit, see users.DuplicateOf
+var exitDuplicates bool
+
+// SetExitDuplicates sets whether the newer of two clients running on the same machine with the same key is told to exit, rather than only shown in ls
+func SetExitDuplicates(exit bool) {
+	exitDuplicates = exit
+}
+
+// How often dead forwards, half closed channels and stale listeners are reclaimed, never when 0
+var reapInterval = time.Minute
+
+// SetReapInterval sets how often the reaper sweeps, 0 turns it off
+func SetReapInterval(interval time.Duration) {
+	reapInterval = interval
+}
+
+// Listeners systemd opened for the server (socket activation), the first replaces listening on the listen address
+var activatedListeners []net.Listener
+
+// SetActivatedListeners makes the server take connections from listeners passed in by systemd rather than opening its own
+func SetActivatedListeners(listeners []net.Listener) {
+	activatedListeners = listeners
+}
+
+// responsive fails if every listener has stopped. It takes the same locks as the console, so a deadlocked server stops answering the watchdog
+func responsive() error {
+	if len(multiplexer.ServerMultiplexer.GetListeners()) == 0 {
+		return errors.New("no listeners are open")
 	}
+
+	users.ListUsers()
+	return nil
 }
 
 type tsRelayBootstrap struct {
 	mu sync.Mutex
 
-	privateKeyPath string
-	listenAddr     string
-	private        ssh.Signer
-	insecure       bool
-	openproxy      bool
-	dataDir        string
-	timeout        int
+	// The relay and its ssh listener stop when this is done
+	ctx context.Context
+
+	listenAddr string
+	private    ssh.Signer
+	insecure   bool
+	openproxy  bool
+	dataDir    string
+	timeout    int
+
+	// Set when the server runs its own DERP relay
+	privateRelay *nat.PrivateRelay
 
 	service *nat.Service
 }
 
-func newTSRelayBootstrap(privateKeyPath, listenAddr string, private ssh.Signer, insecure, openproxy bool, dataDir string, timeout int) *tsRelayBootstrap {
+func newTSRelayBootstrap(ctx context.Context, listenAddr string, private ssh.Signer, insecure, openproxy bool, dataDir string, timeout int) *tsRelayBootstrap {
 	return &tsRelayBootstrap{
-		privateKeyPath: privateKeyPath,
-		listenAddr:     listenAddr,
-		private:        private,
-		insecure:       insecure,
-		openproxy:      openproxy,
-		dataDir:        dataDir,
-		timeout:        timeout,
+		ctx:        ctx,
+		listenAddr: listenAddr,
+		private:    private,
+		insecure:   insecure,
+		openproxy:  openproxy,
+		dataDir:    dataDir,
+		timeout:    timeout,
 	}
 }
 
@@ -91,14 +162,27 @@ func (t *tsRelayBootstrap) EnsureToken() (string, error) {
 		return t.service.Token(), nil
 	}
 
-	privateKeyBytes, err := os.ReadFile(t.privateKeyPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read server private key for ts relay initialisation: %w", err)
+	if internal.StrictCrypto {
+		return "", errors.New("the ts relay transport is disabled by --strict-crypto")
 	}
 
-	service, err := nat.Start(nat.ServiceConfig{
-		ListenAddr:     t.listenAddr,
-		HostPrivateKey: privateKeyBytes,
+	privateKeyBytes := hostkey.PrivateBytes()
+	if privateKeyBytes == nil {
+		return "", errors.New("server private key is not loaded, cannot initialise ts relay")
+	}
+	defer secure.Zero(privateKeyBytes)
+
+	service, err := nat.Start(t.ctx, nat.ServiceConfig{
+		ListenAddr:       t.listenAddr,
+		HostPrivateKey:   privateKeyBytes,
+		PrivateRelay:     t.privateRelay,
+		STUNServers:      stunServers,
+		DERPHomeRegions:  derpHomeRegions,
+		PeerDataRate:     relayPeerRate,
+		RelayCompression: relayCompression,
+		IdleTimeout:      relayIdleTimeout,
+		Keepalive:        relayKeepalive,
+		LatencyCacheFile: filepath.Join(t.dataDir, "derp_latency.json"),
 	})
 	if err != nil {
 		return "", fmt.Errorf("failed to start ts relay transport: %w", err)
@@ -108,6 +192,7 @@ func (t *tsRelayBootstrap) EnsureToken() (string, error) {
 
 	log.Printf("ts relay transport enabled, callback token initialised")
 	go StartSSHServerRestricted(
+		t.ctx,
 		service.Listener(),
 		t.private,
 		t.insecure,
@@ -121,6 +206,21 @@ func (t *tsRelayBootstrap) EnsureToken() (string, error) {
 	return service.Token(), nil
 }
 
+// IssueToken starts the relay if it is not running, and makes a token with its direct path candidates that expires at expires
+func (t *tsRelayBootstrap) IssueToken(expires time.Time) (string, error) {
+	if _, err := t.EnsureToken(); err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.service == nil {
+		return "", errors.New("ts relay transport was closed")
+	}
+	return t.service.IssueToken(expires)
+}
+
 func (t *tsRelayBootstrap) Close() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -151,14 +251,20 @@ func hasPersistedTSCallbackDownloads() (bool, error) {
 	return false, nil
 }
 
-func bootstrapTSRelayWithRetry(relayBootstrap *tsRelayBootstrap, reason string) {
+func bootstrapTSRelayWithRetry(ctx context.Context, relayBootstrap *tsRelayBootstrap, reason string) {
 	if _, err := relayBootstrap.EnsureToken(); err != nil {
 		log.Printf("failed to initialise ts relay transport (%s), retrying in background: %v", reason, err)
 		go func() {
 			ticker := time.NewTicker(15 * time.Second)
 			defer ticker.Stop()
 
-			for range ticker.C {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+
 				if _, err := relayBootstrap.EnsureToken(); err != nil {
 					log.Printf("ts relay retry failed (%s): %v", reason, err)
 					continue
@@ -174,15 +280,59 @@ func bootstrapTSRelayWithRetry(relayBootstrap *tsRelayBootstrap, reason string)
 	log.Printf("ts relay transport initialised (%s)", reason)
 }
 
-func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool, TLSCertPath, TLSKeyPath string, insecure, enabledDownloads, enableTLS, openproxy, forceTSRelay bool, timeout int) {
+func firstListener(listeners []net.Listener) net.Listener {
+	if len(listeners) == 0 {
+		return nil
+	}
+	return listeners[0]
+}
+
+// sessionTicketSecret derives the TLS session ticket secret from the server private key, so it is stable across restarts but not guessable
+func sessionTicketSecret() []byte {
+	privateKeyBytes := hostkey.PrivateBytes()
+	if privateKeyBytes == nil {
+		log.Printf("server private key is not loaded for tls session tickets, sessions will not resume across restarts")
+		return nil
+	}
+
+	defer secure.Zero(privateKeyBytes)
+
+	h := sha256.New()
+	h.Write([]byte("rssh tls session ticket secret"))
+	h.Write(privateKeyBytes)
+	return h.Sum(nil)
+}
+
+// Run starts the server and blocks until ctx is done, or the control listener fails
+func Run(ctx context.Context, addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool, TLSCertPath, TLSKeyPath string, insecure, enabledDownloads, enableTLS, openproxy, forceTSRelay, lookupASN bool, timeout, maxKeepalive int, admission AdmissionConfig) {
+	keepaliveMax = maxKeepalive
+
+	privateKeyPath := filepath.Join(dataDir, "id_ed25519")
+
+	private, err := CreateOrLoadServerKeys(privateKeyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if internal.StrictCrypto {
+		if err := internal.CheckStrictKey(private.PublicKey()); err != nil {
+			log.Fatalf("server key %s cannot be used with --strict-crypto: %s", privateKeyPath, err)
+		}
+	}
+
 	c := mux.MultiplexerConfig{
-		Control:           true,
-		Downloads:         enabledDownloads,
-		TLS:               enableTLS,
-		TLSCertPath:       TLSCertPath,
-		TLSKeyPath:        TLSKeyPath,
-		AutoTLSCommonName: connectBackAddress,
-		TcpKeepAlive:      timeout,
+		Control:                true,
+		MaxWaitingConnections:  admission.AcceptQueue,
+		Downloads:              enabledDownloads,
+		TLS:                    enableTLS,
+		TLSCertPath:            TLSCertPath,
+		TLSKeyPath:             TLSKeyPath,
+		TLSSessionTicketSecret: sessionTicketSecret(),
+		AutoTLSCommonName:      connectBackAddress,
+		TcpKeepAlive:           timeout,
+		WrapConn:               research.Wrap,
+		AcceptFilter:           sourcefilter.Allowed,
+		Listener:               firstListener(activatedListeners),
 		PollingAuthChecker: func(key string, addr net.Addr) bool {
 
 			authorizedKey, err := hex.DecodeString(key)
@@ -201,10 +351,7 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 		},
 	}
 
-	privateKeyPath := filepath.Join(dataDir, "id_ed25519")
-
 	log.Println("Version: ", internal.Version)
-	var err error
 	multiplexer.ServerMultiplexer, err = mux.ListenWithConfig("tcp", addr, c)
 	if err != nil {
 		log.Fatalf("Failed to listen on %s (%s)", addr, err)
@@ -213,18 +360,36 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 
 	log.Printf("Listening on %s\n", addr)
 
-	private, err := CreateOrLoadServerKeys(privateKeyPath)
-	if err != nil {
-		log.Fatal(err)
+	if len(activatedListeners) > 1 {
+		for _, l := range activatedListeners[1:] {
+			if err := multiplexer.ServerMultiplexer.AddListener(l.Addr().String(), l); err != nil {
+				log.Printf("unable to listen on %s passed by systemd: %s", l.Addr(), err)
+				continue
+			}
+			log.Printf("Listening on %s\n", l.Addr())
+		}
 	}
 
-	log.Printf("Loading private key from: %s\n", privateKeyPath)
+	if hostkey.Escrowed(privateKeyPath) {
+		log.Printf("Loaded escrowed private key from: %s\n", hostkey.EscrowPath(privateKeyPath))
+	} else {
+		log.Printf("Loading private key from: %s\n", privateKeyPath)
+	}
 
 	log.Println("Server key fingerprint: ", internal.FingerprintSHA256Hex(private.PublicKey()))
 
+	webserver.SetInsecure(insecure)
+
 	webserver.ResetTSRelay()
-	relayBootstrap := newTSRelayBootstrap(privateKeyPath, addr, private, insecure, openproxy, dataDir, timeout)
+	relayBootstrap := newTSRelayBootstrap(ctx, addr, private, insecure, openproxy, dataDir, timeout)
+	if derpRelayConfig != nil {
+		relayBootstrap.privateRelay, err = startDERPRelay(ctx, *derpRelayConfig)
+		if err != nil {
+			log.Fatalf("Failed to start the DERP relay on %s: %s", derpRelayConfig.Listen, err)
+		}
+	}
 	webserver.SetTSBootstrap(relayBootstrap.EnsureToken)
+	webserver.SetTSTokenIssuer(relayBootstrap.IssueToken)
 	defer func() {
 		webserver.ResetTSRelay()
 		if err := relayBootstrap.Close(); err != nil {
@@ -236,8 +401,8 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 		if len(connectBackAddress) == 0 {
 			connectBackAddress = addr
 		}
-		go webserver.Start(multiplexer.ServerMultiplexer.HTTPDownloadRequests(), connectBackAddress, autogeneratedConnectBack, "../", dataDir, private.PublicKey())
-		go tcp.Start(multiplexer.ServerMultiplexer.TCPDownloadRequests())
+		go webserver.Start(ctx, multiplexer.ServerMultiplexer.HTTPDownloadRequests(), connectBackAddress, autogeneratedConnectBack, "../", dataDir, private.PublicKey())
+		go tcp.Start(ctx, multiplexer.ServerMultiplexer.TCPDownloadRequests())
 	}
 
 	err = data.LoadDatabase(filepath.Join(dataDir, "data.db"))
@@ -245,18 +410,78 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 		log.Fatal(err)
 	}
 
+	if err := sourcefilter.Load(); err != nil {
+		log.Printf("unable to load client sources: %s", err)
+	}
+
+	if err := audit.SetConsoleLog(filepath.Join(dataDir, "console.log")); err != nil {
+		log.Printf("unable to record console commands: %s", err)
+	}
+
+	if err := contentfilter.Load(); err != nil {
+		log.Printf("unable to load content filters: %s", err)
+	}
+
+	if err := commands.RestoreListeners(logger.NewLog("listeners")); err != nil {
+		log.Printf("unable to restore saved listeners: %s", err)
+	}
+
 	if forceTSRelay {
-		bootstrapTSRelayWithRetry(relayBootstrap, "forced startup")
+		bootstrapTSRelayWithRetry(ctx, relayBootstrap, "forced startup")
 	} else {
 		hasTSDownloads, err := hasPersistedTSCallbackDownloads()
 		if err != nil {
 			log.Printf("unable to inspect downloads for ts callback bootstrap: %v", err)
+		} else if hasTSDownloads && internal.StrictCrypto {
+			log.Printf("not starting ts relay transport for persisted ts callbacks, --strict-crypto is set")
 		} else if hasTSDownloads {
-			bootstrapTSRelayWithRetry(relayBootstrap, "persisted ts callbacks")
+			bootstrapTSRelayWithRetry(ctx, relayBootstrap, "persisted ts callbacks")
 		}
 	}
 
-	go webhooks.StartWebhooks()
+	clientASNLookup = lookupASN
+	observers.NetworkChange.Register(func(nc observers.ClientNetworkChange) {
+		appendWatchLog(dataDir, fmt.Sprintf("%s !! %s\n", nc.Timestamp.Format("2006/01/02 15:04:05"), nc.Summary()))
+	})
+
+	observers.Downloads.Register(func(d observers.Download) {
+		recordDownload(dataDir, d)
+	})
+
+	observers.Builds.Register(func(b observers.Build) {
+		appendWatchLog(dataDir, fmt.Sprintf("%s ** %s\n", b.Timestamp.Format("2006/01/02 15:04:05"), b.Summary()))
+	})
+
+	go webhooks.StartWebhooks(ctx)
+
+	go eventbus.Start(ctx)
+
+	go sweepExpiredKeys(ctx, dataDir)
+
+	reaper.SetConnected(users.FingerprintConnected)
+	if reapInterval > 0 {
+		go reaper.Run(ctx, reapInterval)
+	}
+
+	if consoleSocket {
+		go StartConsoleSocket(ctx, ConsoleSocketPath(dataDir), private, dataDir, timeout)
+	}
+
+	if audit.LegalHold() {
+		go audit.Anchor(ctx, filepath.Join(dataDir, "anchors.log"))
+	}
 
-	StartSSHServer(multiplexer.ServerMultiplexer.ControlRequests(), private, insecure, openproxy, dataDir, timeout)
+	if err := systemd.Notify("READY=1\nSTATUS=Listening on " + addr); err != nil {
+		log.Printf("unable to tell systemd the server is ready: %s", err)
+	}
+	context.AfterFunc(ctx, func() {
+		systemd.Notify("STOPPING=1")
+	})
+	go systemd.Watchdog(ctx, responsive)
+
+	StartSSHServer(ctx, multiplexer.ServerMultiplexer.ControlRequests(), private, insecure, openproxy, dataDir, timeout, admission)
+
+	if ctx.Err() != nil {
+		log.Println("Shutting down")
+	}
 }
@@ -0,0 +1,225 @@
+package sourcefilter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+)
+
+// Server wide lists of networks connections are (--allow-clients) and are not (--deny-clients) accepted from. They are checked as each connection
+// is accepted, before anything is read from it, so out of scope sources cost nothing more than the accept. Deny wins over allow, and with no allow
+// list every source that is not denied is accepted. Loopback is always accepted, so the server can still be reached locally.
+// Networks given on the command line are fixed for the run, those added with client-sources are kept in the database
+
+type Rule struct {
+	Network *net.IPNet
+	Deny    bool
+
+	// Given on the command line, rather than added with client-sources
+	Fixed bool
+}
+
+var (
+	lck   sync.RWMutex
+	rules []Rule
+
+	dropped atomic.Uint64
+)
+
+// ParseNetwork parses a CIDR, or a single address as a network of just that address
+func ParseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not a network (CIDR) or address", s)
+	}
+
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func parseNetworks(list []string, deny bool) ([]Rule, error) {
+	var parsed []Rule
+	for _, s := range list {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		network, err := ParseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, Rule{Network: network, Deny: deny, Fixed: true})
+	}
+	return parsed, nil
+}
+
+// SetFixed sets the networks given on the command line
+func SetFixed(allow, deny []string) error {
+	allowed, err := parseNetworks(allow, false)
+	if err != nil {
+		return err
+	}
+
+	denied, err := parseNetworks(deny, true)
+	if err != nil {
+		return err
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	var kept []Rule
+	for _, r := range rules {
+		if !r.Fixed {
+			kept = append(kept, r)
+		}
+	}
+	rules = append(append(kept, allowed...), denied...)
+
+	return nil
+}
+
+// Load adds the networks kept in the database to the fixed ones
+func Load() error {
+	stored, err := data.GetSourceRules()
+	if err != nil {
+		return err
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	for _, s := range stored {
+		network, err := ParseNetwork(s.Network)
+		if err != nil {
+			return fmt.Errorf("stored client source: %w", err)
+		}
+		rules = append(rules, Rule{Network: network, Deny: s.Deny})
+	}
+
+	return nil
+}
+
+// Add allows, or denies, connections from network, and keeps the rule in the database
+func Add(network string, deny bool) error {
+	parsed, err := ParseNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	if err := data.SaveSourceRule(data.SourceRule{Network: parsed.String(), Deny: deny}); err != nil {
+		return err
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	for i, r := range rules {
+		if !r.Fixed && r.Network.String() == parsed.String() {
+			rules[i].Deny = deny
+			return nil
+		}
+	}
+	rules = append(rules, Rule{Network: parsed, Deny: deny})
+
+	return nil
+}
+
+// Remove removes a rule added with Add, false if there is none for network. Fixed rules cannot be removed
+func Remove(network string) (bool, error) {
+	parsed, err := ParseNetwork(network)
+	if err != nil {
+		return false, err
+	}
+
+	found, err := data.DeleteSourceRule(parsed.String())
+	if err != nil {
+		return false, err
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	for i, r := range rules {
+		if !r.Fixed && r.Network.String() == parsed.String() {
+			rules = append(rules[:i], rules[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return found, nil
+}
+
+// Rules returns every allow and deny rule
+func Rules() []Rule {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return append([]Rule(nil), rules...)
+}
+
+// Dropped is how many connections have been refused since the server started
+func Dropped() uint64 {
+	return dropped.Load()
+}
+
+// Allowed reports whether a connection from addr should be accepted, counting it if not
+func Allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			// Not from the network, e.g a named pipe
+			return true
+		}
+		ip = net.ParseIP(host)
+	}
+
+	if ip == nil || ip.IsLoopback() {
+		return true
+	}
+
+	lck.RLock()
+	defer lck.RUnlock()
+
+	allowList := false
+	allowed := false
+	for _, r := range rules {
+		if r.Deny {
+			if r.Network.Contains(ip) {
+				dropped.Add(1)
+				return false
+			}
+			continue
+		}
+
+		allowList = true
+		if r.Network.Contains(ip) {
+			allowed = true
+		}
+	}
+
+	if allowList && !allowed {
+		dropped.Add(1)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,54 @@
+package sourcefilter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	defer SetFixed(nil, nil)
+
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 4321}
+	}
+
+	if err := SetFixed(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !Allowed(addr("198.51.100.1")) {
+		t.Fatal("with no rules every source should be accepted")
+	}
+
+	if err := SetFixed([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "203.0.113.7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := Dropped()
+
+	for ip, want := range map[string]bool{
+		"10.2.3.4":        true,
+		"2001:db8::1":     true,
+		"10.1.2.3":        false, // deny wins over allow
+		"203.0.113.7":     false,
+		"198.51.100.1":    false, // not in the allow list
+		"127.0.0.1":       true,  // loopback is always accepted
+		"::1":             true,
+		"::ffff:10.2.3.4": true,
+	} {
+		if got := Allowed(addr(ip)); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	if dropped := Dropped() - before; dropped != 3 {
+		t.Errorf("expected 3 dropped connections, got %d", dropped)
+	}
+
+	if !Allowed(&net.UnixAddr{Name: "/run/rssh.sock", Net: "unix"}) {
+		t.Error("sources that are not addresses should be accepted")
+	}
+
+	if err := SetFixed([]string{"not a network"}, nil); err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+}
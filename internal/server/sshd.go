@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,15 +12,29 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/chaos"
 	"github.com/NHAS/reverse_ssh/internal/nat"
+	"github.com/NHAS/reverse_ssh/internal/resumable"
+	"github.com/NHAS/reverse_ssh/internal/server/audit"
+	"github.com/NHAS/reverse_ssh/internal/server/clientlimits"
+	"github.com/NHAS/reverse_ssh/internal/server/commands"
+	"github.com/NHAS/reverse_ssh/internal/server/contentfilter"
 	"github.com/NHAS/reverse_ssh/internal/server/handlers"
+	"github.com/NHAS/reverse_ssh/internal/server/keyfiles"
+	"github.com/NHAS/reverse_ssh/internal/server/mesh"
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/research"
+	"github.com/NHAS/reverse_ssh/internal/server/tracing"
+	"github.com/NHAS/reverse_ssh/internal/server/traffic"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"github.com/fatih/color"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -31,6 +46,8 @@ const (
 	privilegeAdmin = "5"
 	privilegeUser  = "0"
 
+	privilegeReadOnly = "-1"
+
 	remoteForwardAddrNetwork = "remote_forward_tcp"
 )
 
@@ -40,6 +57,23 @@ type Options struct {
 	Comment   string
 
 	Owners []string
+
+	// Set by link --campaign
+	Campaign string
+
+	// Set by grant-access, zero if the key does not expire
+	Expires  time.Time
+	ReadOnly bool
+
+	Quota users.Quota
+
+	// Only used for controllee keys
+	Limits clientlimits.Limits
+
+	// The key is a certificate authority, it lets in certificates it signed rather than itself. See certauthority.go
+	CertAuthority bool
+	// Certificates must be for one of these principals, or for the username logging in when empty
+	Principals []string
 }
 
 func readPubKeys(path string) (m map[string]Options, err error) {
@@ -66,6 +100,16 @@ func readPubKeys(path string) (m map[string]Options, err error) {
 		opts.Comment = comment
 
 		for _, o := range options {
+			if o == keyfiles.ReadOnlyOption {
+				opts.ReadOnly = true
+				continue
+			}
+
+			if o == certAuthorityOption {
+				opts.CertAuthority = true
+				continue
+			}
+
 			parts := strings.Split(o, "=")
 			if len(parts) >= 2 {
 				switch parts[0] {
@@ -75,6 +119,25 @@ func readPubKeys(path string) (m map[string]Options, err error) {
 					opts.DenyList = append(opts.DenyList, deny...)
 				case "owner":
 					opts.Owners = ParseOwnerDirective(parts[1])
+				case "campaign":
+					opts.Campaign, _ = strconv.Unquote(parts[1])
+				case "principals":
+					opts.Principals = ParseOwnerDirective(parts[1])
+				case keyfiles.ExpiryOption:
+					opts.Expires, err = keyfiles.ParseExpiry(parts[1])
+					if err != nil {
+						// Better to refuse a key than let it in forever
+						log.Printf("Key on %s line %d has an unreadable %s, treating it as expired: %s", path, i+1, keyfiles.ExpiryOption, err)
+						opts.Expires = time.Unix(0, 0)
+					}
+				default:
+					ok, err := opts.Limits.ParseOption(parts[0], parts[1])
+					if !ok {
+						_, err = opts.Quota.ParseQuotaOption(parts[0], parts[1])
+					}
+					if err != nil {
+						log.Printf("Ignoring %s on %s line %d: %s", parts[0], path, i+1, err)
+					}
 				}
 
 			}
@@ -181,22 +244,36 @@ func ParseAddress(address string) (cidr []*net.IPNet, err error) {
 
 var ErrKeyNotInList = errors.New("key not found")
 
+// CheckAuth checks a key before its connection logs in, so certificates are not checked against the username, only everything else
 func CheckAuth(keysPath string, publicKey ssh.PublicKey, src net.IP, insecure bool) (*ssh.Permissions, error) {
-	return CheckAuthWithSourceTrust(keysPath, publicKey, src, insecure, true)
+	return CheckAuthWithSourceTrust(keysPath, publicKey, "", src, insecure, true)
 }
 
-func CheckAuthWithSourceTrust(keysPath string, publicKey ssh.PublicKey, src net.IP, insecure bool, sourceTrusted bool) (*ssh.Permissions, error) {
+func CheckAuthWithSourceTrust(keysPath string, publicKey ssh.PublicKey, username string, src net.IP, insecure bool, sourceTrusted bool) (*ssh.Permissions, error) {
 	keys, err := readPubKeys(keysPath)
 	if err != nil {
 		return nil, ErrKeyNotInList
 	}
 
+	cert, isCert := publicKey.(*ssh.Certificate)
+
 	var opt Options
 	if !insecure {
-		var ok bool
-		opt, ok = keys[string(ssh.MarshalAuthorizedKey(publicKey))]
-		if !ok {
-			return nil, ErrKeyNotInList
+		if isCert {
+			opt, err = checkCertificate(keys, cert, username, src, sourceTrusted)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			var ok bool
+			opt, ok = keys[string(ssh.MarshalAuthorizedKey(publicKey))]
+			if !ok || opt.CertAuthority {
+				return nil, ErrKeyNotInList
+			}
+		}
+
+		if !opt.Expires.IsZero() && time.Now().After(opt.Expires) {
+			return nil, fmt.Errorf("not authorized key expired at %s", opt.Expires.Format(time.RFC3339))
 		}
 
 		hasSourceRestrictions := len(opt.DenyList) > 0 || len(opt.AllowList) > 0
@@ -229,24 +306,70 @@ func CheckAuthWithSourceTrust(keysPath string, publicKey ssh.PublicKey, src net.
 		}
 	}
 
-	return &ssh.Permissions{
+	perm := &ssh.Permissions{
 		// Record the public key used for authentication.
 		Extensions: map[string]string{
 			"comment":   opt.Comment,
 			"pubkey-fp": internal.FingerprintSHA1Hex(publicKey),
 			"owners":    strings.Join(opt.Owners, ","),
+			"campaign":  opt.Campaign,
 		},
-	}, nil
+	}
+	if isCert {
+		addCertificateExtensions(perm.Extensions, cert, &opt)
+	}
+	if !opt.Expires.IsZero() {
+		perm.Extensions["expires"] = strconv.FormatInt(opt.Expires.Unix(), 10)
+	}
+	if opt.ReadOnly {
+		perm.Extensions["readonly"] = "true"
+	}
+	opt.Quota.AddExtensions(perm.Extensions)
+	opt.Limits.AddExtensions(perm.Extensions)
+
+	return perm, nil
 
 }
 
-func registerChannelCallbacks(connectionDetails string, user *users.User, chans <-chan ssh.NewChannel, log logger.Logger, handlers map[string]func(connectionDetails string, user *users.User, newChannel ssh.NewChannel, log logger.Logger)) error {
+// registerChannelCallbacks runs handlers for the channels a connection opens, each channel is traced in its own span linked to the connection's (in connCtx)
+func registerChannelCallbacks(connCtx context.Context, connectionDetails string, user *users.User, chans <-chan ssh.NewChannel, log logger.Logger, handlers map[string]func(connectionDetails string, user *users.User, newChannel ssh.NewChannel, log logger.Logger)) error {
 	// Service the incoming Channel channel in go routine
 	for newChannel := range chans {
 		t := newChannel.ChannelType()
 		log.Info("Handling channel: %s", t)
 		if callBack, ok := handlers[t]; ok {
-			go callBack(connectionDetails, user, newChannel, log)
+			// Channels can outlive the connection setup by hours, so they are their own traces
+			ctx, span := tracing.Tracer().Start(context.Background(), "rssh.channel",
+				trace.WithNewRoot(),
+				trace.WithLinks(trace.LinkFromContext(connCtx)),
+				trace.WithAttributes(attribute.String("ssh.channel_type", t)),
+			)
+
+			if user == nil {
+				go func() {
+					defer span.End()
+					callBack(connectionDetails, user, tracing.Channel(ctx, newChannel), log)
+				}()
+				continue
+			}
+
+			release := func() {}
+			if t == "session" {
+				var err error
+				release, err = user.OpenSession()
+				if err != nil {
+					newChannel.Reject(ssh.ResourceShortage, err.Error())
+					log.Info("Rejected session: %s", err)
+					tracing.End(span, err)
+					continue
+				}
+			}
+
+			go func() {
+				defer span.End()
+				defer release()
+				callBack(connectionDetails, user, tracing.Channel(ctx, user.LimitBandwidth(newChannel)), log)
+			}()
 			continue
 		}
 
@@ -271,12 +394,16 @@ func isDirEmpty(name string) bool {
 	return false
 }
 
-func StartSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, openproxy bool, dataDir string, timeout int) {
-	startSSHServer(sshListener, privateKey, insecure, openproxy, dataDir, timeout, nil, false)
+// StartSSHServer accepts connections on sshListener until ctx is done, then closes the listener and every connection made through it
+func StartSSHServer(ctx context.Context, sshListener net.Listener, privateKey ssh.Signer, insecure, openproxy bool, dataDir string, timeout int, admission AdmissionConfig) {
+	controller := newAdmissionController(admission)
+	controller.seedKnownSources()
+
+	startSSHServer(ctx, sshListener, privateKey, insecure, openproxy, dataDir, timeout, nil, false, controller)
 }
 
-func StartSSHServerRestricted(sshListener net.Listener, privateKey ssh.Signer, insecure, openproxy bool, dataDir string, timeout int, allowedRoles map[string]bool, restrictedSource bool) {
-	startSSHServer(sshListener, privateKey, insecure, openproxy, dataDir, timeout, allowedRoles, restrictedSource)
+func StartSSHServerRestricted(ctx context.Context, sshListener net.Listener, privateKey ssh.Signer, insecure, openproxy bool, dataDir string, timeout int, allowedRoles map[string]bool, restrictedSource bool) {
+	startSSHServer(ctx, sshListener, privateKey, insecure, openproxy, dataDir, timeout, allowedRoles, restrictedSource, nil)
 }
 
 func isSourceTrusted(remoteNetwork string) bool {
@@ -284,6 +411,10 @@ func isSourceTrusted(remoteNetwork string) bool {
 }
 
 func setUserPermissions(perm *ssh.Permissions, privilege string) {
+	if perm.Extensions["readonly"] == "true" {
+		privilege = privilegeReadOnly
+	}
+
 	perm.Extensions["type"] = roleUser
 	perm.Extensions["privilege"] = privilege
 }
@@ -303,7 +434,7 @@ func roleAllowed(allowedRoles map[string]bool, role string) bool {
 	return allowedRoles[role]
 }
 
-func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, openproxy bool, dataDir string, timeout int, allowedRoles map[string]bool, restrictedSource bool) {
+func startSSHServer(ctx context.Context, sshListener net.Listener, privateKey ssh.Signer, insecure, openproxy bool, dataDir string, timeout int, allowedRoles map[string]bool, restrictedSource bool, admission *admissionController) {
 	//Taken from the server example, authorized keys are required for controllers
 	adminAuthorizedKeysPath := filepath.Join(dataDir, "authorized_keys")
 	authorizedControlleeKeysPath := filepath.Join(dataDir, "authorized_controllee_keys")
@@ -330,6 +461,17 @@ func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 			remoteAddr := conn.RemoteAddr()
 			remoteNetwork := remoteAddr.Network()
+
+			if conn.User() == ConsoleUsername {
+				return nil, fmt.Errorf("not authorized %q, reserved for the local console", conn.User())
+			}
+
+			if internal.StrictCrypto {
+				if err := internal.CheckStrictKey(key); err != nil {
+					return nil, fmt.Errorf("not authorized %q, %s with --strict-crypto", conn.User(), err)
+				}
+			}
+
 			// from forwradserverport.go, effectively when pivoting and exposing the server port we have to just trust whatever structure the client gives us for our remote/local addresses,
 			// we dont want someone being able to bypass ip allow lists, so mark it as untrusted
 			sourceTrusted := isSourceTrusted(remoteNetwork)
@@ -343,7 +485,7 @@ func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 			}
 
 			// Check administrator keys first, they can impersonate users
-			perm, err := CheckAuthWithSourceTrust(adminAuthorizedKeysPath, key, remoteIp, false, sourceTrusted)
+			perm, err := CheckAuthWithSourceTrust(adminAuthorizedKeysPath, key, conn.User(), remoteIp, false, sourceTrusted)
 			if err == nil {
 				if !sourceTrusted {
 					return nil, untrustedUserLoginError("admin", conn.User(), remoteNetwork)
@@ -357,7 +499,7 @@ func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 
 			// Stop path traversal
 			authorisedKeysPath := filepath.Join(usersKeysDir, filepath.Join("/", filepath.Clean(conn.User())))
-			perm, err = CheckAuthWithSourceTrust(authorisedKeysPath, key, remoteIp, false, sourceTrusted)
+			perm, err = CheckAuthWithSourceTrust(authorisedKeysPath, key, conn.User(), remoteIp, false, sourceTrusted)
 			if err == nil {
 				if !sourceTrusted {
 					return nil, untrustedUserLoginError("user", conn.User(), remoteNetwork)
@@ -374,7 +516,7 @@ func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 
 			//If insecure mode, then any unknown client will be connected as a controllable client.
 			//The server effectively ignores channel requests from controllable clients.
-			perms, err := CheckAuthWithSourceTrust(authorizedControlleeKeysPath, key, remoteIp, insecure, sourceTrusted)
+			perms, err := CheckAuthWithSourceTrust(authorizedControlleeKeysPath, key, conn.User(), remoteIp, insecure, sourceTrusted)
 			if err == nil {
 				perms.Extensions["type"] = roleClient
 				return perms, err
@@ -385,7 +527,7 @@ func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 				return nil, fmt.Errorf("client was denied login: %s", err)
 			}
 
-			perms, err = CheckAuthWithSourceTrust(authorizedProxyKeysPath, key, remoteIp, insecure || openproxy, sourceTrusted)
+			perms, err = CheckAuthWithSourceTrust(authorizedProxyKeysPath, key, conn.User(), remoteIp, insecure || openproxy, sourceTrusted)
 			if err == nil {
 
 				perms.Extensions["type"] = roleProxy
@@ -400,6 +542,11 @@ func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 		},
 	}
 
+	if internal.StrictCrypto {
+		internal.RestrictAlgorithms(&config.Config)
+		config.PublicKeyAuthAlgorithms = append(internal.StrictKeyAlgorithms(), internal.StrictCertAlgorithms()...)
+	}
+
 	config.AddHostKey(privateKey)
 
 	observers.ConnectionState.Register(func(c observers.ClientState) {
@@ -408,18 +555,24 @@ func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 			arrowDirection = "->"
 		}
 
-		f, err := os.OpenFile(filepath.Join(dataDir, "watch.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			log.Println("unable to open watch log for writing:", err)
+		status := c.Status
+		if c.Reason != "" {
+			status += ": " + c.Reason
 		}
-		defer f.Close()
 
-		if _, err := f.WriteString(fmt.Sprintf("%s %s %s (%s %s) %s %s\n", c.Timestamp.Format("2006/01/02 15:04:05"), arrowDirection, c.HostName, c.IP, c.ID, c.Version, c.Status)); err != nil {
-			log.Println(err)
+		// Last on the line, so watch can show operators held to a campaign only its clients
+		if c.Campaign != "" {
+			status += " campaign:" + c.Campaign
 		}
 
+		appendWatchLog(dataDir, fmt.Sprintf("%s %s %s (%s %s) %s %s\n", c.Timestamp.Format("2006/01/02 15:04:05"), arrowDirection, c.HostName, c.IP, c.ID, c.Version, status))
 	})
 
+	stop := context.AfterFunc(ctx, func() {
+		sshListener.Close()
+	})
+	defer stop()
+
 	// Accept all connections
 	for {
 		conn, err := sshListener.Accept()
@@ -431,7 +584,75 @@ func startSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 			continue
 		}
 
-		go acceptConn(conn, config, timeout, dataDir, allowedRoles, restrictedSource)
+		chaos.Delay(chaos.ListenerStall)
+
+		go acceptConn(ctx, conn, config, timeout, dataDir, allowedRoles, restrictedSource, admission)
+	}
+}
+
+func appendWatchLog(dataDir, line string) {
+	line = contentfilter.RedactString(line, "watch.log")
+	if err := audit.Append(filepath.Join(dataDir, "watch.log"), []byte(line)); err != nil {
+		log.Println("unable to write to watch log:", err)
+	}
+}
+
+// queryLinkRole asks a client which of its links this connection is if it is connected to multiple servers, older or single homed clients just say no
+func queryLinkRole(sshConn ssh.Conn) string {
+	ok, payload, err := sshConn.SendRequest("query-link-role", true, nil)
+	if err != nil || !ok {
+		return ""
+	}
+
+	var link struct {
+		Role string
+	}
+	if err := ssh.Unmarshal(payload, &link); err != nil {
+		return ""
+	}
+
+	switch link.Role {
+	case "primary", "secondary":
+		return link.Role
+	}
+
+	return ""
+}
+
+// queryInstance asks a client which machine it is running on and which process it is, so the same binary started twice can be spotted. Older clients just say no
+func queryInstance(sshConn *ssh.ServerConn) {
+	ok, payload, err := sshConn.SendRequest("query-instance@rssh", true, nil)
+	if err != nil || !ok {
+		return
+	}
+
+	var instance struct {
+		Machine  string
+		Instance string
+	}
+	if err := ssh.Unmarshal(payload, &instance); err != nil {
+		return
+	}
+
+	sshConn.Permissions.Extensions[users.MachineExtension] = instance.Machine
+	sshConn.Permissions.Extensions[users.InstanceExtension] = instance.Instance
+}
+
+// queryMesh asks a client which networks it could relay for, clients that predate the mesh just say no
+func queryMesh(id string, sshConn ssh.Conn, log logger.Logger) {
+	ok, payload, err := sshConn.SendRequest("query-mesh@rssh", true, nil)
+	if err != nil || !ok {
+		return
+	}
+
+	var adv mesh.Advertisement
+	if err := ssh.Unmarshal(payload, &adv); err != nil {
+		log.Warning("Client sent invalid mesh advertisement: %s", err)
+		return
+	}
+
+	if err := mesh.Advertised(id, adv); err != nil {
+		log.Warning("Client sent invalid mesh advertisement: %s", err)
 	}
 }
 
@@ -457,22 +678,84 @@ func getIP(ip string) net.IP {
 	return nil
 }
 
-func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir string, allowedRoles map[string]bool, restrictedSource bool) {
+func acceptConn(ctx context.Context, c net.Conn, config *ssh.ServerConfig, timeout int, dataDir string, allowedRoles map[string]bool, restrictedSource bool, admission *admissionController) {
+
+	// Covers getting the connection to where it is usable, not how long it is up for
+	spanCtx, span := tracing.Tracer().Start(ctx, "rssh.accept", trace.WithAttributes(attribute.String("net.peer.address", c.RemoteAddr().String())))
+	var spanErr error
+	defer func() {
+		tracing.End(span, spanErr)
+	}()
+
+	handshakeDone := func() {}
+	if admission != nil {
+		release, ok := admission.admit(c.RemoteAddr())
+		if !ok {
+			spanErr = errors.New("admission control rejected the connection")
+			research.Outcome(c.RemoteAddr(), "rejected by admission control")
+			c.Close()
+			return
+		}
+
+		handshakeDone = release
+		if admission.config.HandshakeTimeout > 0 {
+			// The per read timeout below doesnt stop a client dribbling bytes, so cap the whole handshake
+			handshakeTimer := time.AfterFunc(admission.config.HandshakeTimeout, func() {
+				c.Close()
+			})
+
+			handshakeDone = func() {
+				handshakeTimer.Stop()
+				release()
+			}
+		}
+	}
+
+	counter := &traffic.Counter{}
 
 	//Initially set the timeout high, so people who type in their ssh key password can actually use rssh
-	realConn := &internal.TimeoutConn{Conn: c, Timeout: time.Duration(timeout) * time.Minute}
+	realConn := &internal.TimeoutConn{Conn: traffic.NewConn(c, counter), Timeout: time.Duration(timeout) * time.Minute}
+
+	// Drop the connection when the server shuts down
+	stopOnShutdown := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
 
 	// Before use, a handshake must be performed on the incoming net.Conn.
+	_, handshakeSpan := tracing.Tracer().Start(spanCtx, "rssh.handshake")
 	sshConn, chans, reqs, err := ssh.NewServerConn(realConn, config)
+	tracing.End(handshakeSpan, err)
+	handshakeDone()
 	if err != nil {
+		spanErr = err
+		stopOnShutdown()
 		log.Printf("Failed to handshake (%s)", err.Error())
+		research.Outcome(c.RemoteAddr(), "handshake failed: "+err.Error())
 		return
 	}
 
+	research.Outcome(c.RemoteAddr(), fmt.Sprintf("authenticated as %s %s", sshConn.Permissions.Extensions["type"], sshConn.User()))
+
+	span.SetAttributes(
+		attribute.String("ssh.user", sshConn.User()),
+		attribute.String("ssh.client_version", string(sshConn.ClientVersion())),
+		attribute.String("rssh.role", sshConn.Permissions.Extensions["type"]),
+	)
+
+	go func() {
+		sshConn.Wait()
+		stopOnShutdown()
+	}()
+
+	if admission != nil {
+		admission.authenticated(c.RemoteAddr())
+	}
+
 	clientLog := logger.NewLog(sshConn.RemoteAddr().String())
 
 	role := sshConn.Permissions.Extensions["type"]
 	if !roleAllowed(allowedRoles, role) {
+		spanErr = fmt.Errorf("role %q is not allowed on this listener", role)
 		if restrictedSource {
 			log.Printf("ts relay: rejected non-client role on ts relay listener (%s)", role)
 		}
@@ -480,6 +763,10 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 		return
 	}
 
+	// Clients can negotiate this up if their NAT keeps idle connections alive for longer
+	var keepaliveInterval atomic.Int64
+	keepaliveInterval.Store(int64(timeout))
+
 	if timeout > 0 {
 		//If we are using timeouts
 		//Set the actual timeout much lower to whatever the user specifies it as (defaults to 5 second keepalive, 10 second timeout)
@@ -487,13 +774,21 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 
 		go func() {
 			for {
-				_, _, err = sshConn.SendRequest("keepalive-rssh@golang.org", true, []byte(fmt.Sprintf("%d", timeout)))
-				if err != nil {
-					clientLog.Info("Failed to send keepalive, assuming client has disconnected")
-					sshConn.Close()
+				interval := keepaliveInterval.Load()
+				if !chaos.Fail(chaos.KeepaliveDrop) {
+					_, _, err = sshConn.SendRequest("keepalive-rssh@golang.org", true, []byte(fmt.Sprintf("%d", interval)))
+					if err != nil {
+						clientLog.Info("Failed to send keepalive, assuming client has disconnected")
+						sshConn.Close()
+						return
+					}
+				}
+
+				select {
+				case <-ctx.Done():
 					return
+				case <-time.After(time.Duration(interval) * time.Second):
 				}
-				time.Sleep(time.Duration(timeout) * time.Second)
 			}
 		}()
 	}
@@ -509,44 +804,118 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 			return
 		}
 
+		conn, err := user.Session(connectionDetails)
+		if err != nil {
+			sshConn.Close()
+			log.Println(err)
+			return
+		}
+		readOnly := conn.ReadOnly()
+
+		channelHandlers := map[string]func(connectionDetails string, user *users.User, newChannel ssh.NewChannel, log logger.Logger){
+			"session": handlers.Session(dataDir),
+		}
+		if !readOnly {
+			channelHandlers["direct-tcpip"] = handlers.LocalForward
+		}
+
+		// Temporary keys are cut off when they expire, not just refused at the next login
+		stopExpiry := func() bool { return false }
+		if expires, err := strconv.ParseInt(sshConn.Permissions.Extensions["expires"], 10, 64); err == nil {
+			stopExpiry = time.AfterFunc(time.Until(time.Unix(expires, 0)), func() {
+				clientLog.Info("Temporary access for %s expired, disconnecting", sshConn.User())
+				sshConn.Close()
+			}).Stop
+		}
+
 		// Since we're handling a shell, local and remote forward, so we expect
 		// channel type of "session" or "direct-tcpip"
 		go func() {
 
-			err = registerChannelCallbacks(connectionDetails, user, chans, clientLog, map[string]func(connectionDetails string, user *users.User, newChannel ssh.NewChannel, log logger.Logger){
-				"session":      handlers.Session(dataDir),
-				"direct-tcpip": handlers.LocalForward,
-			})
+			err = registerChannelCallbacks(spanCtx, connectionDetails, user, chans, clientLog, channelHandlers)
 			clientLog.Info("User disconnected: %s", err.Error())
 
+			stopExpiry()
 			users.DisconnectUser(sshConn)
 		}()
 
 		clientLog.Info("New User SSH connection, version %s", sshConn.ClientVersion())
 
-		// Discard all global out-of-band Requests, except for the tcpip-forward
-		go ssh.DiscardRequests(reqs)
+		if readOnly {
+			// No remote forwards either
+			go ssh.DiscardRequests(reqs)
+		} else {
+			// ssh -R is opened on a client chosen by the bind address, never on the server
+			go handlers.OperatorRemoteForward(connectionDetails, user, sshConn, reqs, clientLog)
+		}
 
 	case roleClient:
 
+		// Set before the client is visible to anyone, so listings never see it change
+		if link := queryLinkRole(sshConn); link != "" {
+			sshConn.Permissions.Extensions["link"] = link
+		}
+
+		queryInstance(sshConn)
+
+		limits, err := clientlimits.For(sshConn.Permissions.Extensions)
+		if err != nil {
+			clientLog.Warning("Unable to load client-limits policy, only the key's limits apply: %s", err)
+		}
+
+		limitedClient := clientlimits.Client(sshConn.Permissions.Extensions["pubkey-fp"], users.NormaliseHostname(sshConn.User()))
+		if err := clientlimits.Admit(limitedClient, limits); err != nil {
+			spanErr = err
+			clientLog.Warning("Refusing client: %s", err)
+
+			sshConn.Close()
+			return
+		}
+
 		id, username, err := users.AssociateClient(sshConn)
 		if err != nil {
+			spanErr = err
 			clientLog.Error("Unable to add new client %s", err)
 
 			sshConn.Close()
 			return
 		}
 
+		span.SetAttributes(attribute.String("rssh.client_id", id))
+
+		traffic.RegisterClient(id, counter)
+		mesh.Connected(id, handlers.RelayedBy(sshConn.RemoteAddr()))
+
+		// The client reconnects and authenticates again after being cut off, and is refused until it is back under its transfer limit
+		stopLimits := clientlimits.Enforce(limitedClient, limits, counter, func(reason string) {
+			clientLog.Warning("Disconnecting client %s (%s), %s", id, username, reason)
+			sshConn.Close()
+		})
+
 		go func() {
-			go ssh.DiscardRequests(reqs)
+			go handleClientRequests(reqs, realConn, timeout, &keepaliveInterval, sshConn.Permissions.Extensions["pubkey-fp"], clientLog, func(status, reason string) {
+				observers.ConnectionState.Notify(observers.ClientState{
+					Status:    status,
+					Reason:    reason,
+					ID:        id,
+					IP:        sshConn.RemoteAddr().String(),
+					HostName:  username,
+					Version:   string(sshConn.ClientVersion()),
+					Campaign:  sshConn.Permissions.Extensions["campaign"],
+					Timestamp: time.Now(),
+				})
+			})
 
-			err = registerChannelCallbacks("", nil, chans, clientLog, map[string]func(_ string, user *users.User, newChannel ssh.NewChannel, log logger.Logger){
+			err = registerChannelCallbacks(spanCtx, "", nil, chans, clientLog, map[string]func(_ string, user *users.User, newChannel ssh.NewChannel, log logger.Logger){
 				"rssh-download":   handlers.Download(dataDir),
 				"forwarded-tcpip": handlers.ServerPortForward(id),
 			})
 
 			clientLog.Info("SSH client disconnected")
+			stopLimits()
 			users.DisassociateClient(id, sshConn)
+			traffic.RemoveClient(id)
+			mesh.Disconnected(id)
 
 			observers.ConnectionState.Notify(observers.ClientState{
 				Status:    "disconnected",
@@ -554,11 +923,23 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 				IP:        sshConn.RemoteAddr().String(),
 				HostName:  username,
 				Version:   string(sshConn.ClientVersion()),
+				Campaign:  sshConn.Permissions.Extensions["campaign"],
 				Timestamp: time.Now(),
 			})
 		}()
 
 		clientLog.Info("New controllable connection from %s with id %s", color.BlueString(username), color.YellowString(id))
+		if original, ok := users.DuplicateOf(id); ok {
+			if exitDuplicates {
+				clientLog.Warning("Client is a second instance of %s on the same machine, telling it to exit", original)
+				sshConn.SendRequest("kill", false, nil)
+			} else {
+				clientLog.Warning("Client is a second instance of %s on the same machine", original)
+			}
+		}
+		if campaign := sshConn.Permissions.Extensions["campaign"]; campaign != "" {
+			clientLog.Info("Client was built for campaign %s", campaign)
+		}
 
 		observers.ConnectionState.Notify(observers.ClientState{
 			Status:    "connected",
@@ -566,9 +947,26 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 			IP:        sshConn.RemoteAddr().String(),
 			HostName:  username,
 			Version:   string(sshConn.ClientVersion()),
+			Campaign:  sshConn.Permissions.Extensions["campaign"],
 			Timestamp: time.Now(),
 		})
 
+		go queryMesh(id, sshConn, clientLog)
+
+		go commands.RestoreClientListeners(sshConn, sshConn.Permissions.Extensions["pubkey-fp"], clientLog)
+
+		go func() {
+			if err := commands.PushKnownHosts(sshConn, sshConn.Permissions.Extensions["pubkey-fp"], clientLog); err != nil {
+				clientLog.Info("Unable to send known hosts: %s", err)
+			}
+		}()
+
+		go resumable.Resume(sshConn, sshConn.Permissions.Extensions["pubkey-fp"], clientLog)
+
+		go checkClientNetwork(id, username, string(sshConn.ClientVersion()), sshConn.Permissions.Extensions["pubkey-fp"], sshConn.Permissions.Extensions["campaign"], sshConn.RemoteAddr(), clientASNLookup, clientLog)
+
+		go attributeDownload(id, username, sshConn.Permissions.Extensions["pubkey-fp"], sshConn.RemoteAddr(), clientLog)
+
 	case roleProxy:
 		clientLog.Info("New remote dynamic forward connected: %s", sshConn.ClientVersion())
 
@@ -1,15 +1,19 @@
 package server
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"errors"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/NHAS/reverse_ssh/internal/server/keyfiles"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -53,7 +57,7 @@ func TestCheckAuthWithSourceTrustRejectsSourceRestrictedKeyWhenSourceUntrusted(t
 		t.Fatalf("failed to write temporary key file: %v", err)
 	}
 
-	_, err := CheckAuthWithSourceTrust(keysPath, pub, nil, false, false)
+	_, err := CheckAuthWithSourceTrust(keysPath, pub, "test", nil, false, false)
 	if err == nil {
 		t.Fatalf("expected source-trust validation error")
 	}
@@ -71,12 +75,62 @@ func TestCheckAuthWithSourceTrustAllowsUnrestrictedKeyWhenSourceUntrusted(t *tes
 		t.Fatalf("failed to write temporary key file: %v", err)
 	}
 
-	_, err := CheckAuthWithSourceTrust(keysPath, pub, nil, false, false)
+	_, err := CheckAuthWithSourceTrust(keysPath, pub, "test", nil, false, false)
 	if err != nil {
 		t.Fatalf("unexpected auth failure: %v", err)
 	}
 }
 
+func TestCheckAuthRecordsQuota(t *testing.T) {
+	pub := generateTestPublicKey(t)
+
+	keysPath := filepath.Join(t.TempDir(), "authorized_keys")
+	line := "max-sessions=2,max-forwards=\"5\",max-bandwidth=1M " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " jim\n"
+	if err := os.WriteFile(keysPath, []byte(line), 0600); err != nil {
+		t.Fatalf("failed to write temporary key file: %v", err)
+	}
+
+	perm, err := CheckAuthWithSourceTrust(keysPath, pub, "test", net.ParseIP("127.0.0.1"), false, true)
+	if err != nil {
+		t.Fatalf("unexpected auth failure: %v", err)
+	}
+
+	if perm.Extensions["max-sessions"] != "2" || perm.Extensions["max-forwards"] != "5" || perm.Extensions["max-bandwidth"] != "1048576" {
+		t.Fatalf("quota not recorded: %v", perm.Extensions)
+	}
+}
+
+func TestCheckAuthTemporaryKeys(t *testing.T) {
+	pub := generateTestPublicKey(t)
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+
+	keysPath := filepath.Join(t.TempDir(), "guest")
+
+	valid := "expiry-time=\"" + keyfiles.FormatExpiry(time.Now().Add(time.Hour)) + "\",readonly " + key + " guest\n"
+	if err := os.WriteFile(keysPath, []byte(valid), 0600); err != nil {
+		t.Fatalf("failed to write temporary key file: %v", err)
+	}
+
+	perm, err := CheckAuthWithSourceTrust(keysPath, pub, "test", net.ParseIP("127.0.0.1"), false, true)
+	if err != nil {
+		t.Fatalf("unexpected auth failure: %v", err)
+	}
+
+	setUserPermissions(perm, privilegeUser)
+	if perm.Extensions["privilege"] != privilegeReadOnly || perm.Extensions["expires"] == "" {
+		t.Fatalf("read only temporary key was not recorded: %v", perm.Extensions)
+	}
+
+	expired := "expiry-time=\"" + keyfiles.FormatExpiry(time.Now().Add(-time.Minute)) + "\" " + key + " guest\n"
+	if err := os.WriteFile(keysPath, []byte(expired), 0600); err != nil {
+		t.Fatalf("failed to write temporary key file: %v", err)
+	}
+
+	if _, err := CheckAuthWithSourceTrust(keysPath, pub, "test", net.ParseIP("127.0.0.1"), false, true); err == nil || err == ErrKeyNotInList {
+		t.Fatalf("expected an expired key error, got %v", err)
+	}
+}
+
 func TestParseAddressIPv4Literal(t *testing.T) {
 	cidrs, err := ParseAddress("10.12.13.14")
 	if err != nil {
@@ -132,3 +186,84 @@ func generateTestPublicKey(t *testing.T) ssh.PublicKey {
 
 	return signer.PublicKey()
 }
+
+func TestLocalConsole(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the console is a named pipe on Windows, without a directory to check")
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir := t.TempDir()
+	path := ConsoleSocketPath(dataDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go StartConsoleSocket(ctx, path, signer, dataDir, 0)
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("console socket is not in a private directory: %v %v", info.Mode(), err)
+	}
+
+	// Any other username is refused, so the console cannot be mistaken for an operator
+	other, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if _, _, _, err := ssh.NewClientConn(other, path, &ssh.ClientConfig{
+		User:            "operator",
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	}); err == nil {
+		t.Fatal("the local console accepted a username other than " + ConsoleUsername)
+	}
+
+	// No key is needed, having access to the socket is enough
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, path, &ssh.ClientConfig{
+		User:            ConsoleUsername,
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	output, err := session.Output("who")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(output), ConsoleUsername) {
+		t.Fatalf("who on the console printed %q", output)
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Backend stores large artifacts (client builds, transferred files) somewhere other than the data directory
+type Backend interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+
+	// Objects under the backend's prefix are removed after this many days
+	SetExpiry(ctx context.Context, days int) error
+
+	String() string
+}
+
+var ErrNotFound = errors.New("object not found")
+
+var (
+	lck     sync.RWMutex
+	offload Backend
+)
+
+// SetOffload makes new artifacts go to b instead of the data directory, nil keeps them local
+func SetOffload(b Backend) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	offload = b
+}
+
+// Offload is where artifacts are offloaded to, nil if they are kept in the data directory
+func Offload() Backend {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return offload
+}
+
+// Parse reads a backend from a uri, s3://bucket/prefix with optional endpoint=host[:port], region= and insecure (plain http) parameters.
+// Credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func Parse(uri string) (Backend, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("storage %q is not a url: %w", uri, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		s := &S3{
+			Bucket:       u.Host,
+			Prefix:       strings.Trim(u.Path, "/"),
+			Region:       u.Query().Get("region"),
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+
+		if s.Bucket == "" {
+			return nil, errors.New("s3 storage needs a bucket, e.g s3://bucket/prefix")
+		}
+
+		if s.Region == "" {
+			s.Region = os.Getenv("AWS_REGION")
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+
+		scheme := "https"
+		if u.Query().Has("insecure") {
+			scheme = "http"
+		}
+
+		if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+			// S3 compatible stores (minio, ceph) generally want the bucket in the path
+			s.Endpoint = scheme + "://" + endpoint
+			s.PathStyle = true
+		} else {
+			s.Endpoint = fmt.Sprintf("%s://%s.s3.%s.amazonaws.com", scheme, s.Bucket, s.Region)
+		}
+
+		if s.AccessKey == "" || s.SecretKey == "" {
+			return nil, errors.New("s3 storage needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY set")
+		}
+
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("unsupported storage %q, only s3:// is supported", u.Scheme)
+}
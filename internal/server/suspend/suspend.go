@@ -0,0 +1,298 @@
+package suspend
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Interactive shells opened with connect that carry nothing either way, no keystrokes and no output, for a while are suspended: the session is
+// parked, its channel to the client is closed while the client keeps the shell waiting, so nothing flows for it until the operator, who stays
+// attached, presses a key and it is picked up where it stopped. A shell is only parked when the client says it is sat at its prompt, with no
+// children running, and the operator has no half typed command in it
+
+// How long a shell may be idle before it is suspended, never when 0
+var after time.Duration
+
+// SetAfter sets how long shells may be idle before they are suspended, 0 turns suspending off
+func SetAfter(d time.Duration) {
+	after = d
+}
+
+// After is how long shells may be idle before they are suspended, 0 if they never are
+func After() time.Duration {
+	return after
+}
+
+// Parker is a channel that can be detached from the client while the connection stays up, and attached again, e.g a resumable channel
+type Parker interface {
+	ssh.Channel
+	Park() error
+	Unpark() error
+}
+
+// Most output held for the operator before the shell is no longer read from
+const bufferSize = 32 * 1024
+
+// Shell is an ssh.Channel to an interactive shell that is parked when idle, and unparked by the next keystroke
+type Shell struct {
+	ch   ssh.Channel
+	idle time.Duration
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	parked bool
+
+	// Whether the operator typed something that has not been run yet
+	pending bool
+
+	// The last window change while parked, sent on once unparked
+	resize []byte
+
+	// Shown to the operator before anything else the shell sends
+	notice []byte
+	output []byte
+
+	last   time.Time
+	closed bool
+	err    error
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Open watches ch, parking it whenever it has been idle for idle. Channels that cannot be parked, and 0, are never suspended
+func Open(ch ssh.Channel, idle time.Duration) *Shell {
+	s := &Shell{
+		ch:   ch,
+		idle: idle,
+		last: time.Now(),
+		done: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	go s.read()
+
+	if _, ok := ch.(Parker); ok && idle > 0 {
+		go s.watch()
+	}
+
+	return s
+}
+
+// Suspended is whether the shell is parked, waiting for a keystroke
+func (s *Shell) Suspended() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.parked
+}
+
+func (s *Shell) watch() {
+	for {
+		s.mu.Lock()
+		if s.closed || s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+
+		idle := s.idle
+		wait := idle
+		if !s.parked {
+			wait -= time.Since(s.last)
+		}
+		s.mu.Unlock()
+
+		if wait <= 0 {
+			s.suspend()
+			wait = idle
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// suspend parks the shell if nothing is running in it and nothing is waiting to be run
+func (s *Shell) suspend() {
+	s.mu.Lock()
+	pending, last := s.pending, s.last
+	s.mu.Unlock()
+
+	if pending {
+		return
+	}
+
+	if idle, err := s.ch.SendRequest("idle@rssh", true, nil); err != nil || !idle {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Used while the client was asked
+	if s.closed || !s.last.Equal(last) || s.pending {
+		return
+	}
+
+	if err := s.ch.(Parker).Park(); err != nil {
+		return
+	}
+
+	s.parked = true
+	s.notice = append(s.notice, fmt.Sprintf("\r\n[rssh: idle for %s, the session has been parked on the client. Press any key to carry on]\r\n", s.idle)...)
+	s.cond.Broadcast()
+}
+
+// resume unparks the shell, s.mu must be held
+func (s *Shell) resume() error {
+	if err := s.ch.(Parker).Unpark(); err != nil {
+		s.err = err
+		s.notice = append(s.notice, fmt.Sprintf("[rssh: unable to carry on with the parked session: %s]\r\n", err)...)
+		s.cond.Broadcast()
+		return err
+	}
+
+	s.parked = false
+	s.last = time.Now()
+
+	if s.resize != nil {
+		go s.ch.SendRequest("window-change", false, s.resize)
+		s.resize = nil
+	}
+
+	return nil
+}
+
+// read copies the shell's output so notices can be shown while a read from the parked shell waits
+func (s *Shell) read() {
+	b := make([]byte, bufferSize)
+	for {
+		s.mu.Lock()
+		for len(s.output) >= bufferSize && !s.closed {
+			s.cond.Wait()
+		}
+		s.mu.Unlock()
+
+		n, err := s.ch.Read(b)
+
+		s.mu.Lock()
+		if n > 0 {
+			s.output = append(s.output, b[:n]...)
+			s.last = time.Now()
+		}
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Shell) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.notice) == 0 && len(s.output) == 0 && !s.closed && s.err == nil {
+		s.cond.Wait()
+	}
+
+	switch {
+	case len(s.notice) > 0:
+		n := copy(b, s.notice)
+		s.notice = s.notice[n:]
+		return n, nil
+	case len(s.output) > 0:
+		n := copy(b, s.output)
+		s.output = s.output[n:]
+		s.cond.Broadcast()
+		return n, nil
+	case s.closed:
+		return 0, io.EOF
+	}
+
+	return 0, s.err
+}
+
+func (s *Shell) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	switch {
+	case s.closed:
+		s.mu.Unlock()
+		return 0, io.EOF
+	case s.err != nil:
+		err := s.err
+		s.mu.Unlock()
+		return 0, err
+	case s.parked:
+		// The key is passed on, the shell was at its prompt with nothing typed
+		if err := s.resume(); err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+	}
+
+	s.last = time.Now()
+	for _, c := range b {
+		switch c {
+		case '\r', '\n', 0x03, 0x15: // Enter, Ctrl-C and Ctrl-U leave nothing typed
+			s.pending = false
+		default:
+			s.pending = true
+		}
+	}
+	s.mu.Unlock()
+
+	return s.ch.Write(b)
+}
+
+// SendRequest passes requests on to the shell. While parked window changes are kept until it is unparked, other requests are refused
+func (s *Shell) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	s.mu.Lock()
+	if s.parked {
+		defer s.mu.Unlock()
+
+		if name == "window-change" {
+			s.resize = append([]byte(nil), payload...)
+			return true, nil
+		}
+		return false, nil
+	}
+	s.mu.Unlock()
+
+	return s.ch.SendRequest(name, wantReply, payload)
+}
+
+func (s *Shell) CloseWrite() error {
+	return s.ch.CloseWrite()
+}
+
+func (s *Shell) Stderr() io.ReadWriter {
+	return s.ch.Stderr()
+}
+
+// Close closes the shell, a parked one is unparked first so the client ends it rather than waiting for it to carry on
+func (s *Shell) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+
+	s.mu.Lock()
+	s.closed = true
+	s.parked = false
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	return s.ch.Close()
+}
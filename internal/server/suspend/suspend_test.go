@@ -0,0 +1,225 @@
+package suspend
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeShell is a parkable channel to a shell that is idle when busy is false
+type fakeShell struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written bytes.Buffer
+	output  []byte
+	parked  bool
+	busy    bool
+	resized []byte
+	closed  bool
+}
+
+func newFakeShell() *fakeShell {
+	f := &fakeShell{}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *fakeShell) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for (f.parked || len(f.output) == 0) && !f.closed {
+		f.cond.Wait()
+	}
+	if f.closed {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.output)
+	f.output = f.output[n:]
+	return n, nil
+}
+
+func (f *fakeShell) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.parked {
+		panic("written to while parked")
+	}
+	return f.written.Write(b)
+}
+
+func (f *fakeShell) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	f.cond.Broadcast()
+	return nil
+}
+
+func (f *fakeShell) CloseWrite() error { return nil }
+
+func (f *fakeShell) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch name {
+	case "idle@rssh":
+		return !f.busy, nil
+	case "window-change":
+		f.resized = payload
+	}
+	return true, nil
+}
+
+func (f *fakeShell) Stderr() io.ReadWriter { return nil }
+
+func (f *fakeShell) Park() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.parked = true
+	return nil
+}
+
+func (f *fakeShell) Unpark() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.parked = false
+	f.cond.Broadcast()
+	return nil
+}
+
+func (f *fakeShell) isParked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.parked
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParkAndCarryOn(t *testing.T) {
+	f := newFakeShell()
+	s := Open(f, 50*time.Millisecond)
+	defer s.Close()
+
+	output := make(chan string, 16)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, err := s.Read(b)
+			if err != nil {
+				close(output)
+				return
+			}
+			output <- string(b[:n])
+		}
+	}()
+
+	waitFor(t, "the idle shell to be parked", s.Suspended)
+
+	if !f.isParked() {
+		t.Fatal("the session should be parked on the client, not closed")
+	}
+
+	if notice := <-output; !strings.Contains(notice, "Press any key") {
+		t.Fatalf("expected the operator to be told the session was parked, got %q", notice)
+	}
+
+	size := []byte{0, 0, 0, 132, 0, 0, 0, 50, 0, 0, 0, 0, 0, 0, 0, 0}
+	if ok, err := s.SendRequest("window-change", false, size); !ok || err != nil {
+		t.Fatalf("window changes while parked should be kept, got %v %v", ok, err)
+	}
+
+	// So it is not parked again while the test runs
+	s.mu.Lock()
+	s.idle = time.Hour
+	s.mu.Unlock()
+
+	if _, err := s.Write([]byte("l")); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.isParked() || s.Suspended() {
+		t.Fatal("a keystroke should carry on with the parked session")
+	}
+
+	if f.written.String() != "l" {
+		t.Errorf("the key that carried on should reach the same shell, got %q", f.written.String())
+	}
+
+	waitFor(t, "the window change to be sent on", func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return bytes.Equal(f.resized, size)
+	})
+
+	f.Close()
+	for range output {
+	}
+}
+
+func TestNotParkedWhileBusy(t *testing.T) {
+	f := newFakeShell()
+	f.busy = true
+
+	s := Open(f, 20*time.Millisecond)
+	defer s.Close()
+
+	time.Sleep(80 * time.Millisecond)
+	if s.Suspended() || f.isParked() {
+		t.Fatal("a shell with children running should not be parked")
+	}
+
+	f.mu.Lock()
+	f.busy = false
+	f.mu.Unlock()
+
+	// Typed but not run
+	if _, err := s.Write([]byte("rm -rf build")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if s.Suspended() {
+		t.Fatal("a shell with a command waiting to be run should not be parked")
+	}
+
+	if _, err := s.Write([]byte("\r")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the shell to be parked once the command was run", s.Suspended)
+}
+
+func TestNeverSuspended(t *testing.T) {
+	f := newFakeShell()
+	s := Open(f, 0)
+
+	time.Sleep(20 * time.Millisecond)
+	if s.Suspended() || f.isParked() {
+		t.Fatal("a shell with no idle period should never be parked")
+	}
+
+	s.Close()
+	if !f.closed {
+		t.Fatal("closing the shell should close it on the client")
+	}
+}
@@ -0,0 +1,133 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Under systemd the server can take its listening sockets from a .socket unit (socket activation), and tells systemd when it is
+// ready, when it is stopping, and that it is still alive for the watchdog (sd_notify). Outside of systemd none of the environment
+// below is set and all of this does nothing.
+
+// First file descriptor systemd passes sockets on, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// Socket is a listening socket passed in by systemd, Name is its FileDescriptorName= or the .socket unit's name
+type Socket struct {
+	Name     string
+	Listener net.Listener
+}
+
+// Sockets takes the listening sockets systemd passed to this process. The environment describing them is cleared, so processes the
+// server starts do not think the sockets are theirs
+func Sockets() ([]Socket, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("systemd passed an invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var sockets []Socket
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, s := range sockets {
+				s.Listener.Close()
+			}
+			return nil, fmt.Errorf("socket %d (%s) passed by systemd is not a listening stream socket: %w", i, name, err)
+		}
+
+		sockets = append(sockets, Socket{Name: name, Listener: l})
+	}
+
+	return sockets, nil
+}
+
+// Notify sends state, e.g READY=1, to systemd. It does nothing unless systemd gave the server a notify socket (Type=notify)
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Abstract sockets are written with a leading @
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("unable to reach systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval is how often systemd expects to hear the server is alive (WatchdogSec=), 0 when it is not watching
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog tells systemd the server is alive twice every watchdog interval until ctx is done, as long as alive returns nil.
+// If alive fails, or hangs on a deadlock, systemd stops hearing from the server and restarts it
+func Watchdog(ctx context.Context, alive func() error) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := alive(); err != nil {
+			log.Printf("not answering the systemd watchdog, server is unhealthy: %s", err)
+			continue
+		}
+
+		if err := Notify("WATCHDOG=1"); err != nil {
+			log.Printf("unable to answer the systemd watchdog: %s", err)
+		}
+	}
+}
@@ -1,20 +1,32 @@
 package tcp
 
 import (
+	"context"
 	"io"
 	"log"
 	"net"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/webserver"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 )
 
-func handleBashConn(conn net.Conn) {
+var rawEncodings = map[string]string{
+	".gz":  "gzip",
+	".zst": "zstd",
+}
+
+func handleBashConn(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
 	downloadLog := logger.NewLog(conn.RemoteAddr().String())
 
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
@@ -36,34 +48,74 @@ func handleBashConn(conn net.Conn) {
 
 	filename := strings.TrimSpace(string(fileID[3:n]))
 
+	if !webserver.AllowDownload(conn.RemoteAddr().String(), nil) {
+		return
+	}
+
+	// RAW<name>.gz or RAW<name>.zst asks for the download compressed
+	var encoding string
 	f, err := data.GetDownload(filename)
+	if err != nil {
+		for extension, e := range rawEncodings {
+			if name, ok := strings.CutSuffix(filename, extension); ok {
+				f, err = data.GetDownload(name)
+				filename, encoding = name, e
+				break
+			}
+		}
+	}
 	if err != nil {
 		downloadLog.Warning("failed to get file %q: err %s", filename, err)
 		return
 	}
 
-	file, err := os.Open(f.FilePath)
+	file, err := data.OpenDownload(f, encoding)
 	if err != nil {
-		downloadLog.Warning("failed to open file %q for download: %s", f.FilePath, err)
+		downloadLog.Warning("failed to open %q for download: %s", filename, err)
 		return
 	}
 	defer file.Close()
 
-	downloadLog.Info("downloaded %q using RAW tcp method", filename)
+	downloadLog.Info("downloaded %q using RAW tcp method %s", filename, encoding)
+
+	if _, err := io.Copy(conn, file); err != nil {
+		downloadLog.Warning("download of %q did not finish: %s", filename, err)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
 
-	io.Copy(conn, file)
+	observers.Downloads.Notify(observers.Download{
+		Status:      "downloaded",
+		Link:        f.UrlPath,
+		Fingerprint: f.Fingerprint,
+		Method:      "raw",
+		Encoding:    encoding,
+		IP:          ip,
+		Timestamp:   time.Now(),
+	})
 }
 
-func Start(listener net.Listener) {
+// Start serves raw tcp downloads until ctx is done, which also drops downloads in progress
+func Start(ctx context.Context, listener net.Listener) {
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
 
 	log.Println("Started Raw Download Server")
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("failed to accept raw download connection: %s", err)
+			if ctx.Err() == nil {
+				log.Printf("failed to accept raw download connection: %s", err)
+			}
 			return
 		}
 
-		go handleBashConn(conn)
+		go handleBashConn(ctx, conn)
 	}
 }
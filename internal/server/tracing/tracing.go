@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/nat"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// Spans cover accepting a connection (admission, the ssh handshake and authentication), each channel a connection opens, and what the channel does
+// (forwarding to a client, downloads), as well as client builds and the ts relay transport's DERP connections. Until Start is called they are no-ops
+
+// Tracer is what the server's spans are started with
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/NHAS/reverse_ssh/internal/server")
+}
+
+// Start exports spans over OTLP/HTTP to endpoint, e.g http://collector:4318, keeping sampleRatio (0 to 1) of traces.
+// The returned function flushes spans that have not been sent yet and stops exporting
+func Start(ctx context.Context, endpoint string, sampleRatio float64) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("otlp endpoint %q must be a http:// or https:// url", endpoint)
+	}
+
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return nil, errors.New("otlp sample ratio must be between 0 and 1")
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "rssh-server"),
+			attribute.String("service.version", internal.Version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	nat.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// End records err on span, if there is one, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Channel carries ctx, the span of the channel being opened, to the channel's handler. Rejecting the channel marks the span as failed
+func Channel(ctx context.Context, newChannel ssh.NewChannel) ssh.NewChannel {
+	return &tracedNewChannel{NewChannel: newChannel, ctx: ctx}
+}
+
+// Context is the span context a channel was opened in, see Channel
+func Context(newChannel ssh.NewChannel) context.Context {
+	if t, ok := newChannel.(*tracedNewChannel); ok {
+		return t.ctx
+	}
+	return context.Background()
+}
+
+type tracedNewChannel struct {
+	ssh.NewChannel
+	ctx context.Context
+}
+
+func (t *tracedNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	c, reqs, err := t.NewChannel.Accept()
+
+	span := trace.SpanFromContext(t.ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.AddEvent("accepted")
+	}
+
+	return c, reqs, err
+}
+
+func (t *tracedNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	span := trace.SpanFromContext(t.ctx)
+	span.SetAttributes(attribute.String("ssh.reject_reason", reason.String()))
+	span.SetStatus(codes.Error, message)
+
+	return t.NewChannel.Reject(reason, message)
+}
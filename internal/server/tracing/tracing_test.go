@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStartExports(t *testing.T) {
+	if _, err := Start(context.Background(), "collector:4318", 1); err == nil {
+		t.Fatal("endpoint without a scheme was accepted")
+	}
+
+	exported := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exported <- r.URL.Path
+	}))
+	defer collector.Close()
+
+	stop, err := Start(context.Background(), collector.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := Tracer().Start(context.Background(), "test")
+	End(span, nil)
+
+	if err := stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case path := <-exported:
+		if path != "/v1/traces" {
+			t.Fatalf("spans were sent to %s", path)
+		}
+	default:
+		t.Fatal("no spans were exported")
+	}
+}
@@ -0,0 +1,171 @@
+package traffic
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter tracks bytes and reads/writes through a client connection or forward, and how many sessions or connections are currently using it
+type Counter struct {
+	rx, tx atomic.Uint64
+	// Every read and write, lots of tiny packets cost more cpu to relay than a few large ones
+	ops atomic.Uint64
+
+	active atomic.Int64
+}
+
+// Track marks a session or connection as using the counter until done is called. Safe to call on nil
+func (c *Counter) Track() (done func()) {
+	if c == nil {
+		return func() {}
+	}
+
+	c.active.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.active.Add(-1)
+		})
+	}
+}
+
+// Bytes is everything read and written so far. Safe to call on nil
+func (c *Counter) Bytes() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.rx.Load() + c.tx.Load()
+}
+
+type Sample struct {
+	Name   string
+	Rx, Tx uint64
+	Ops    uint64
+	Active int64
+}
+
+func (c *Counter) sample(name string) Sample {
+	return Sample{
+		Name:   name,
+		Rx:     c.rx.Load(),
+		Tx:     c.tx.Load(),
+		Ops:    c.ops.Load(),
+		Active: c.active.Load(),
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	counter *Counter
+	done    func()
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counter.rx.Add(uint64(n))
+	c.counter.ops.Add(1)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counter.tx.Add(uint64(n))
+	c.counter.ops.Add(1)
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	if c.done != nil {
+		c.done()
+	}
+	return c.Conn.Close()
+}
+
+// NewConn counts everything read from or written to conn
+func NewConn(conn net.Conn, counter *Counter) net.Conn {
+	return &countingConn{Conn: conn, counter: counter}
+}
+
+var (
+	lck      sync.RWMutex
+	clients  = map[string]*Counter{}
+	forwards = map[string]*Counter{}
+)
+
+// RegisterClient makes a clients counter visible under its id
+func RegisterClient(id string, counter *Counter) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	clients[id] = counter
+}
+
+func RemoveClient(id string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	delete(clients, id)
+}
+
+// Client returns the counter for a connected client, or nil if there isnt one
+func Client(id string) *Counter {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return clients[id]
+}
+
+// ForwardConn counts traffic through a forwarded connection, forwards with the same name are grouped and the group is removed once its last connection closes
+func ForwardConn(name string, conn net.Conn) net.Conn {
+	lck.Lock()
+	defer lck.Unlock()
+
+	counter, ok := forwards[name]
+	if !ok {
+		counter = &Counter{}
+		forwards[name] = counter
+	}
+
+	done := counter.Track()
+
+	return &countingConn{
+		Conn:    conn,
+		counter: counter,
+		done: func() {
+			done()
+
+			lck.Lock()
+			defer lck.Unlock()
+
+			if counter.active.Load() <= 0 && forwards[name] == counter {
+				delete(forwards, name)
+			}
+		},
+	}
+}
+
+// Snapshot returns the current totals for all clients and forwards, sorted by name
+func Snapshot() (clientSamples, forwardSamples []Sample) {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	for id, counter := range clients {
+		clientSamples = append(clientSamples, counter.sample(id))
+	}
+
+	for name, counter := range forwards {
+		forwardSamples = append(forwardSamples, counter.sample(name))
+	}
+
+	byName := func(s []Sample) func(i, j int) bool {
+		return func(i, j int) bool { return s[i].Name < s[j].Name }
+	}
+
+	sort.Slice(clientSamples, byName(clientSamples))
+	sort.Slice(forwardSamples, byName(forwardSamples))
+
+	return clientSamples, forwardSamples
+}
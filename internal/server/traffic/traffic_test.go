@@ -0,0 +1,41 @@
+package traffic
+
+import (
+	"net"
+	"testing"
+)
+
+func TestForwardGrouping(t *testing.T) {
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	defer a2.Close()
+	defer b2.Close()
+
+	first := ForwardConn("0 127.0.0.1:80", a1)
+	second := ForwardConn("0 127.0.0.1:80", b1)
+
+	go a2.Read(make([]byte, 5))
+	if _, err := first.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, forwardSamples := Snapshot()
+	if len(forwardSamples) != 1 || forwardSamples[0].Active != 2 || forwardSamples[0].Tx != 5 || forwardSamples[0].Ops != 1 {
+		t.Fatalf("expected one forward with two connections and 5 bytes sent, got %+v", forwardSamples)
+	}
+
+	first.Close()
+	first.Close()
+
+	_, forwardSamples = Snapshot()
+	if len(forwardSamples) != 1 || forwardSamples[0].Active != 1 {
+		t.Fatalf("closing twice should only remove one connection, got %+v", forwardSamples)
+	}
+
+	second.Close()
+
+	_, forwardSamples = Snapshot()
+	if len(forwardSamples) != 0 {
+		t.Fatalf("forward should be removed after its last connection closed, got %+v", forwardSamples)
+	}
+}
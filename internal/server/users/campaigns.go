@@ -0,0 +1,89 @@
+package users
+
+import (
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"golang.org/x/crypto/ssh"
+)
+
+// Engagements sharing a server are kept apart by campaign, the label link --campaign builds clients with. An operator working in a
+// campaign (campaign use) only finds that campaign's clients, so a filter or alias cannot reach a client from another engagement,
+// and what they pull off clients is kept under the campaign. An operator key with a campaign option is held to that campaign.
+
+// ValidCampaign checks name can label a campaign, it names a directory and is kept as a key option
+func ValidCampaign(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, ",=\"\\/ \t\n") {
+		return failure.New(failure.InvalidArgument, "campaign %q cannot be empty, . or .., or contain whitespace, commas, equals signs, quotes, slashes or backslashes", name)
+	}
+	return nil
+}
+
+// SetCampaign scopes what the operator can find to the clients of campaign, "" lifts the scope
+func (u *User) SetCampaign(campaign string) error {
+	if campaign != "" {
+		if err := ValidCampaign(campaign); err != nil {
+			return err
+		}
+	}
+
+	if u.conn == nil {
+		return failure.New(failure.InvalidArgument, "only an operator's session can change campaign")
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	if u.conn.campaignPinned && campaign != u.conn.campaign {
+		return failure.New(failure.PermissionDenied, "your key is only allowed into campaign %s", u.conn.campaign)
+	}
+
+	u.conn.campaign = campaign
+	return nil
+}
+
+// Campaign is the campaign the operator's session is working in, "" when they can find every client
+func (u *User) Campaign() string {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return u._campaign()
+}
+
+func (u *User) _campaign() string {
+	if u.conn == nil {
+		return ""
+	}
+	return u.conn.campaign
+}
+
+// CampaignPinned is whether the key the operator's session logged in with holds it to its campaign
+func (u *User) CampaignPinned() bool {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return u.conn != nil && u.conn.campaignPinned
+}
+
+// _inCampaign is whether the operator's campaign, if any, lets them find conn
+func (u *User) _inCampaign(conn *ssh.ServerConn) bool {
+	campaign := u._campaign()
+	return campaign == "" || conn.Permissions.Extensions["campaign"] == campaign
+}
+
+// InCampaign is whether something labelled with campaign is in the operator's campaign, e.g a download or an event
+func (u *User) InCampaign(campaign string) bool {
+	current := u.Campaign()
+	return current == "" || campaign == current
+}
+
+// Campaigns counts the connected clients of each campaign the operator can find, clients without one are counted under ""
+func (u *User) Campaigns() map[string]int {
+	clients, _ := u.SearchClients("")
+
+	counts := map[string]int{}
+	for _, conn := range clients {
+		counts[conn.Permissions.Extensions["campaign"]]++
+	}
+	return counts
+}
@@ -0,0 +1,66 @@
+package users
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type addressedConn struct {
+	ssh.Conn
+}
+
+func (addressedConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+}
+
+func TestCampaignScope(t *testing.T) {
+	client := func(id, campaign string) {
+		allClients[id] = &ssh.ServerConn{Conn: addressedConn{}, Permissions: &ssh.Permissions{Extensions: map[string]string{"campaign": campaign}}}
+		addAlias(id, "shared-host")
+	}
+
+	defer func() {
+		for _, id := range []string{"spring1", "autumn1"} {
+			delete(allClients, id)
+			delete(uniqueIdToAllAliases, id)
+		}
+		delete(aliases, "shared-host")
+	}()
+
+	client("spring1", "spring")
+	client("autumn1", "autumn")
+
+	admin := AdminPermissions
+	u := &User{account: &account{username: "op", clients: map[string]*ssh.ServerConn{}}, conn: &Connection{privilege: &admin}}
+
+	if err := u.SetCampaign("spring"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := u.SearchClients("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found["spring1"] == nil {
+		t.Fatalf("only the spring client should be found, got %v", found)
+	}
+
+	if c, err := u.GetClient("shared-host"); err != nil || c != allClients["spring1"] {
+		t.Fatalf("alias shared with another campaign's client should resolve to spring1, got %v %v", c, err)
+	}
+
+	if _, err := u.GetClient("autumn1"); err == nil {
+		t.Fatalf("autumn client should not be found from the spring campaign")
+	}
+
+	if err := u.SetCampaign("../x"); err == nil {
+		t.Fatalf("campaign names must not be paths")
+	}
+
+	u.conn.campaignPinned = true
+	if err := u.SetCampaign(""); err == nil {
+		t.Fatalf("an operator pinned to a campaign should not be able to leave it")
+	}
+}
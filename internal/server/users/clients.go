@@ -34,11 +34,40 @@ func NormaliseHostname(hostname string) string {
 	return hostname
 }
 
+// Client ids start with this many characters of the key fingerprint, so clients built from the same link (and any --vanity prefix) share a prefix
+const idFingerprintLength = 8
+
+func clientID(fingerprint string) (string, error) {
+	if len(fingerprint) < idFingerprintLength {
+		return internal.RandomString(20)
+	}
+
+	unique, err := internal.RandomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	return fingerprint[:idFingerprintLength] + unique, nil
+}
+
+// FingerprintConnected reports whether a client with this key fingerprint is connected
+func FingerprintConnected(fingerprint string) bool {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	for _, conn := range allClients {
+		if conn.Permissions.Extensions["pubkey-fp"] == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
 func AssociateClient(conn *ssh.ServerConn) (string, string, error) {
 	lck.Lock()
 	defer lck.Unlock()
 
-	idString, err := internal.RandomString(20)
+	idString, err := clientID(conn.Permissions.Extensions["pubkey-fp"])
 	if err != nil {
 		return "", "", err
 	}
@@ -52,6 +81,8 @@ func AssociateClient(conn *ssh.ServerConn) (string, string, error) {
 		addAlias(idString, conn.Permissions.Extensions["comment"])
 	}
 	allClients[idString] = conn
+	associations++
+	associationOrder[idString] = associations
 
 	globalAutoComplete.AddMultiple(idString, username, conn.RemoteAddr().String(), conn.Permissions.Extensions["pubkey-fp"])
 	if conn.Permissions.Extensions["comment"] != "" {
@@ -127,6 +158,7 @@ func DisassociateClient(uniqueId string, conn *ssh.ServerConn) {
 	_disassociateFromOwners(uniqueId, conn.Permissions.Extensions["owners"])
 
 	delete(allClients, uniqueId)
+	delete(associationOrder, uniqueId)
 	delete(uniqueIdToAllAliases, uniqueId)
 
 }
@@ -0,0 +1,38 @@
+package users
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVanityClientID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	key, err := internal.GenerateVanityPrivateKey(ctx, "C0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint := internal.FingerprintSHA1Hex(signer.PublicKey())
+	first, _ := clientID(fingerprint)
+	second, _ := clientID(fingerprint)
+
+	if !strings.HasPrefix(first, "c0") || first[:idFingerprintLength] != fingerprint[:idFingerprintLength] {
+		t.Fatalf("client id %s does not start with its key fingerprint %s", first, fingerprint)
+	}
+
+	if first == second || len(first) != 40 {
+		t.Fatalf("ids from the same key should be unique and 40 characters, got %s and %s", first, second)
+	}
+}
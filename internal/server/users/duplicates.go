@@ -0,0 +1,66 @@
+package users
+
+import "golang.org/x/crypto/ssh"
+
+// The same client binary started twice on one machine, e.g by persistence firing twice, connects twice with the same key and machine id but from different processes.
+// Clients report their machine and instance (process) ids when they connect, older clients do not and are never treated as duplicates
+
+const (
+	MachineExtension  = "machine"
+	InstanceExtension = "instance"
+)
+
+var (
+	// Order clients were associated in, so the first of a set of duplicates is known
+	associationOrder = map[string]uint64{}
+	associations     uint64
+)
+
+func duplicateKey(conn *ssh.ServerConn) string {
+	machine := conn.Permissions.Extensions[MachineExtension]
+	if machine == "" || conn.Permissions.Extensions[InstanceExtension] == "" {
+		return ""
+	}
+	return conn.Permissions.Extensions["pubkey-fp"] + "/" + machine
+}
+
+// DuplicateOf returns the id of the earliest connected client running the same binary on the same machine as the client id, but in another process
+func DuplicateOf(id string) (string, bool) {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	conn, ok := allClients[id]
+	if !ok {
+		return "", false
+	}
+
+	key := duplicateKey(conn)
+	if key == "" {
+		return "", false
+	}
+
+	// A process connected more than once (e.g over several links) is ordered by its first connection
+	instance := conn.Permissions.Extensions[InstanceExtension]
+	firstSeen := map[string]uint64{}
+	firstID := map[string]string{}
+	for otherID, other := range allClients {
+		if duplicateKey(other) != key {
+			continue
+		}
+
+		otherInstance := other.Permissions.Extensions[InstanceExtension]
+		if seen, ok := firstSeen[otherInstance]; !ok || associationOrder[otherID] < seen {
+			firstSeen[otherInstance] = associationOrder[otherID]
+			firstID[otherInstance] = otherID
+		}
+	}
+
+	original, first := "", firstSeen[instance]
+	for otherInstance, seen := range firstSeen {
+		if otherInstance != instance && seen < first {
+			original, first = firstID[otherInstance], seen
+		}
+	}
+
+	return original, original != ""
+}
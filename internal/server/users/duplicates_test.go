@@ -0,0 +1,43 @@
+package users
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDuplicateOf(t *testing.T) {
+	client := func(id, machine, instance string) {
+		allClients[id] = &ssh.ServerConn{Permissions: &ssh.Permissions{Extensions: map[string]string{
+			"pubkey-fp":       "fp",
+			MachineExtension:  machine,
+			InstanceExtension: instance,
+		}}}
+		associations++
+		associationOrder[id] = associations
+	}
+
+	defer func() {
+		for _, id := range []string{"first", "second", "reconnect", "elsewhere", "old"} {
+			delete(allClients, id)
+			delete(associationOrder, id)
+		}
+	}()
+
+	client("first", "m1", "a")
+	client("second", "m1", "b")
+	// The same process connected again, e.g over a second link
+	client("reconnect", "m1", "a")
+	client("elsewhere", "m2", "c")
+	client("old", "", "")
+
+	if original, ok := DuplicateOf("second"); !ok || original != "first" {
+		t.Fatalf("expected second to be a duplicate of first, got %q %v", original, ok)
+	}
+
+	for _, id := range []string{"first", "reconnect", "elsewhere", "old"} {
+		if original, ok := DuplicateOf(id); ok {
+			t.Fatalf("%s should not be a duplicate, got duplicate of %s", id, original)
+		}
+	}
+}
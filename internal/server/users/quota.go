@@ -0,0 +1,252 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+const (
+	QuotaSessionsOption  = "max-sessions"
+	QuotaForwardsOption  = "max-forwards"
+	QuotaBandwidthOption = "max-bandwidth"
+)
+
+// Quota limits what one operator can use at once, so they cannot exhaust a shared server. Zero is unlimited.
+// Set with the max-sessions, max-forwards and max-bandwidth options on the operator's key in authorized_keys
+type Quota struct {
+	// Interactive sessions and commands run with ssh server <command>
+	Sessions int
+	// Listeners started with listen, on the server or on clients
+	Forwards int
+	// Bytes per second, shared between all of the operator's sessions and forwards
+	Bandwidth int64
+}
+
+// ParseBandwidth reads a rate in bytes per second, with an optional K, M or G suffix (powers of 1024)
+func ParseBandwidth(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected e.g 512K or 10M", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// ParseQuotaOption sets the part of the quota named by an authorized_keys option, ok is false if the option is not a quota
+func (q *Quota) ParseQuotaOption(name, value string) (ok bool, err error) {
+	value = strings.Trim(value, "\"")
+
+	switch name {
+	case QuotaSessionsOption, QuotaForwardsOption:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return true, fmt.Errorf("invalid %s %q", name, value)
+		}
+
+		if name == QuotaSessionsOption {
+			q.Sessions = n
+		} else {
+			q.Forwards = n
+		}
+	case QuotaBandwidthOption:
+		n, err := ParseBandwidth(value)
+		if err != nil {
+			return true, err
+		}
+		q.Bandwidth = n
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// AddExtensions records the quota in the permissions of a connection
+func (q Quota) AddExtensions(extensions map[string]string) {
+	if q.Sessions > 0 {
+		extensions[QuotaSessionsOption] = strconv.Itoa(q.Sessions)
+	}
+	if q.Forwards > 0 {
+		extensions[QuotaForwardsOption] = strconv.Itoa(q.Forwards)
+	}
+	if q.Bandwidth > 0 {
+		extensions[QuotaBandwidthOption] = strconv.FormatInt(q.Bandwidth, 10)
+	}
+}
+
+func quotaFromExtensions(extensions map[string]string) (q Quota) {
+	q.Sessions, _ = strconv.Atoi(extensions[QuotaSessionsOption])
+	q.Forwards, _ = strconv.Atoi(extensions[QuotaForwardsOption])
+	q.Bandwidth, _ = strconv.ParseInt(extensions[QuotaBandwidthOption], 10, 64)
+	return q
+}
+
+func (q Quota) String() string {
+	limit := func(n int64) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+
+	bandwidth := "unlimited"
+	if q.Bandwidth > 0 {
+		bandwidth = fmt.Sprintf("%d bytes/s", q.Bandwidth)
+	}
+
+	return fmt.Sprintf("sessions: %s, forwards: %s, bandwidth: %s", limit(int64(q.Sessions)), limit(int64(q.Forwards)), bandwidth)
+}
+
+type quotaState struct {
+	sync.Mutex
+
+	quota        Quota
+	openSessions int
+	limiter      *rate.Limiter
+}
+
+// setQuota is called with the quota of the key the operator last logged in with
+func (u *User) setQuota(q Quota) {
+	u.quotaState.Lock()
+	defer u.quotaState.Unlock()
+
+	u.quotaState.quota = q
+
+	if q.Bandwidth == 0 {
+		u.quotaState.limiter = nil
+		return
+	}
+
+	// Allow a second worth of burst, but not so little that every read has to wait
+	burst := int(min(max(q.Bandwidth, 4096), 1<<20))
+	if u.quotaState.limiter == nil {
+		u.quotaState.limiter = rate.NewLimiter(rate.Limit(q.Bandwidth), burst)
+		return
+	}
+
+	u.quotaState.limiter.SetLimit(rate.Limit(q.Bandwidth))
+	u.quotaState.limiter.SetBurst(burst)
+}
+
+func (u *User) Quota() Quota {
+	u.quotaState.Lock()
+	defer u.quotaState.Unlock()
+
+	return u.quotaState.quota
+}
+
+// OpenSession counts a new session against the operator's quota, the returned function must be called when it closes
+func (u *User) OpenSession() (func(), error) {
+	u.quotaState.Lock()
+	defer u.quotaState.Unlock()
+
+	if u.quotaState.quota.Sessions > 0 && u.quotaState.openSessions >= u.quotaState.quota.Sessions {
+		return nil, failure.New(failure.QuotaExceeded, "session quota reached, %s can have %d sessions open at once. Close one and try again", u.username, u.quotaState.quota.Sessions).With("quota", QuotaSessionsOption)
+	}
+
+	u.quotaState.openSessions++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			u.quotaState.Lock()
+			defer u.quotaState.Unlock()
+
+			u.quotaState.openSessions--
+		})
+	}, nil
+}
+
+// CheckForwards returns an error if starting more listeners would take the operator over quota, current is how many they have now
+func (u *User) CheckForwards(current, more int) error {
+	q := u.Quota()
+	if q.Forwards > 0 && current+more > q.Forwards {
+		return failure.New(failure.QuotaExceeded, "forward quota reached, %s has %d of %d listeners and asked for %d more. Stop some with listen --off", u.username, current, q.Forwards, more).With("quota", QuotaForwardsOption)
+	}
+
+	return nil
+}
+
+// LimitBandwidth applies the operator's bandwidth quota to a channel once it is accepted
+func (u *User) LimitBandwidth(newChannel ssh.NewChannel) ssh.NewChannel {
+	return &limitedNewChannel{NewChannel: newChannel, user: u}
+}
+
+type limitedNewChannel struct {
+	ssh.NewChannel
+	user *User
+}
+
+func (l *limitedNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	c, reqs, err := l.NewChannel.Accept()
+	if err != nil {
+		return c, reqs, err
+	}
+
+	l.user.quotaState.Lock()
+	limiter := l.user.quotaState.limiter
+	l.user.quotaState.Unlock()
+
+	if limiter == nil {
+		return c, reqs, nil
+	}
+
+	return &limitedChannel{Channel: c, limiter: limiter}, reqs, nil
+}
+
+type limitedChannel struct {
+	ssh.Channel
+	limiter *rate.Limiter
+}
+
+func (l *limitedChannel) Read(b []byte) (int, error) {
+	if burst := l.limiter.Burst(); len(b) > burst {
+		b = b[:burst]
+	}
+
+	n, err := l.Channel.Read(b)
+	if n > 0 {
+		l.limiter.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+func (l *limitedChannel) Write(b []byte) (written int, err error) {
+	for len(b) > 0 {
+		chunk := min(len(b), l.limiter.Burst())
+		if err := l.limiter.WaitN(context.Background(), chunk); err != nil {
+			return written, err
+		}
+
+		n, err := l.Channel.Write(b[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[chunk:]
+	}
+
+	return written, nil
+}
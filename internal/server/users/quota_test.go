@@ -0,0 +1,101 @@
+package users
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for in, want := range map[string]int64{
+		"100":  100,
+		"512K": 512 << 10,
+		"10m":  10 << 20,
+		"1GB":  1 << 30,
+		" 2M ": 2 << 20,
+		"0":    0,
+		"-1":   -1,
+		"fast": -1,
+		"1.5M": -1,
+		"":     -1,
+	} {
+		got, err := ParseBandwidth(in)
+		if want < 0 {
+			if err == nil {
+				t.Errorf("ParseBandwidth(%q) should fail, got %d", in, got)
+			}
+			continue
+		}
+
+		if err != nil || got != want {
+			t.Errorf("ParseBandwidth(%q) = %d, %v expected %d", in, got, err, want)
+		}
+	}
+}
+
+func TestSessionQuota(t *testing.T) {
+	u := &User{account: &account{username: "jim"}}
+	u.setQuota(Quota{Sessions: 2})
+
+	first, err := u.OpenSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := u.OpenSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := u.OpenSession(); err == nil {
+		t.Fatal("third session should be over quota")
+	}
+
+	first()
+	first()
+
+	if _, err := u.OpenSession(); err != nil {
+		t.Fatalf("closing a session should make room for another: %v", err)
+	}
+
+	if _, err := u.OpenSession(); err == nil {
+		t.Fatal("releasing a session twice should only free one slot")
+	}
+}
+
+type discardChannel struct {
+	ssh.Channel
+	written int
+}
+
+func (d *discardChannel) Write(b []byte) (int, error) {
+	d.written += len(b)
+	return len(b), nil
+}
+
+func (d *discardChannel) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func TestBandwidthQuota(t *testing.T) {
+	const bandwidth = 64 << 10
+
+	c := &discardChannel{}
+	limited := &limitedChannel{Channel: c, limiter: rate.NewLimiter(bandwidth, 8<<10)}
+
+	start := time.Now()
+	if _, err := limited.Write(make([]byte, bandwidth/4+8<<10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The burst is free, the rest should take a quarter of a second
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("wrote %d bytes in %s, faster than the quota", c.written, elapsed)
+	}
+
+	if c.written != bandwidth/4+8<<10 {
+		t.Fatalf("wrote %d bytes", c.written)
+	}
+}
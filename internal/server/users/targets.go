@@ -0,0 +1,61 @@
+package users
+
+import (
+	"sort"
+	"strings"
+)
+
+// Targets are the clients the operator can find that tokens of a command line name, by id or alias, or by filter for tokens with wildcards.
+// They are what the command may have acted on, for the console log
+func (u *User) Targets(tokens []string) []string {
+	found := map[string]bool{}
+
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+
+		if strings.ContainsAny(token, "*?[") {
+			clients, err := u.SearchClients(token)
+			if err != nil {
+				continue
+			}
+			for id := range clients {
+				found[id] = true
+			}
+			continue
+		}
+
+		lck.RLock()
+		if u._canFind(token) {
+			found[token] = true
+		}
+		for id := range aliases[token] {
+			if u._canFind(id) {
+				found[id] = true
+			}
+		}
+		lck.RUnlock()
+	}
+
+	targets := make([]string, 0, len(found))
+	for id := range found {
+		targets = append(targets, id)
+	}
+	sort.Strings(targets)
+
+	return targets
+}
+
+// _canFind is whether the client with id is one the operator can find
+func (u *User) _canFind(id string) bool {
+	conn, ok := u.clients[id]
+	if !ok {
+		conn, ok = ownedByAll[id]
+	}
+	if !ok && u.Privilege() == AdminPermissions {
+		conn, ok = allClients[id]
+	}
+
+	return ok && u._inCampaign(conn)
+}
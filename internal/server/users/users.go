@@ -10,11 +10,17 @@ import (
 	"sync"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/pivot"
+	"github.com/NHAS/reverse_ssh/internal/server/reaper"
 	"github.com/NHAS/reverse_ssh/pkg/trie"
 	"golang.org/x/crypto/ssh"
 )
 
 const (
+	// Granted temporarily with grant-access --role readonly, can look but not touch
+	ReadOnlyPermissions = -1
+
 	UserPermissions  = 0
 	AdminPermissions = 5
 )
@@ -39,18 +45,114 @@ type Connection struct {
 
 	// So we can capture details about who is currently using the rssh server
 	ConnectionDetails string
+
+	// Console editing mode requested with the RSSH_EDIT_MODE environment variable, empty for the default
+	EditMode string
+
+	// Set to json with the RSSH_ERRORS environment variable to get failures of ssh server <command> as JSON on stderr
+	ErrorFormat string
+
+	routeLck sync.Mutex
+	// Set with the socks command, direct-tcpip forwards (ssh -D/-L) on this connection go out through this client
+	route *pivot.Route
+	// So the route is reclaimed if its client goes away while it is set
+	reaped *reaper.Resource
+
+	// From the key this connection logged in with. Operators sharing a username can log in with keys of different privileges, so it is kept here rather than on the User
+	privilege *int
+
+	// Set with campaign use, or by a campaign option on the key which pins the connection to it, see campaigns.go. Guarded by lck
+	campaign       string
+	campaignPinned bool
+}
+
+// Privilege is the privilege of the key this connection logged in with
+func (c *Connection) Privilege() int {
+	if c.privilege == nil {
+		return UserPermissions
+	}
+	return *c.privilege
+}
+
+// ReadOnly is whether this connection logged in with a read only key, e.g one from grant-access --role readonly
+func (c *Connection) ReadOnly() bool {
+	return c.Privilege() == ReadOnlyPermissions
+}
+
+// SetForwardRoute changes which client this connection's forwards go out through, closing the previous route. nil goes back to treating forward destinations as clients to jump to
+func (c *Connection) SetForwardRoute(r *pivot.Route) {
+	c.routeLck.Lock()
+	defer c.routeLck.Unlock()
+
+	if c.route == r {
+		return
+	}
+
+	if c.route != nil {
+		c.route.Close()
+	}
+	c.reaped.Release()
+
+	c.route = r
+	c.reaped = nil
+	if r == nil {
+		return
+	}
+
+	owner := ""
+	if c.serverConnection != nil {
+		owner = c.serverConnection.User()
+	}
+
+	c.reaped = reaper.Track(reaper.Forward, owner, r.ID, "socks route through "+r.ID, func() string {
+		if r.Closed() {
+			return "client " + r.ID + " went away"
+		}
+		return ""
+	}, func() {
+		c.routeLck.Lock()
+		defer c.routeLck.Unlock()
+
+		r.Close()
+		if c.route == r {
+			c.route = nil
+			c.reaped = nil
+		}
+	})
+}
+
+func (c *Connection) ForwardRoute() *pivot.Route {
+	c.routeLck.Lock()
+	defer c.routeLck.Unlock()
+
+	return c.route
 }
 
+// Fingerprint is the sha1 fingerprint of the key the operator logged in with, as ls shows for clients
+func (c *Connection) Fingerprint() string {
+	if sc, ok := c.serverConnection.(*ssh.ServerConn); ok && sc.Permissions != nil {
+		return sc.Permissions.Extensions["pubkey-fp"]
+	}
+	return ""
+}
+
+// User is an operator as one of their connections sees them. What belongs to the username (clients, sessions, quota) is shared by every connection,
+// what comes from the key they logged in with (privilege, campaign) is the connection's own
 type User struct {
-	sync.RWMutex
+	*account
 
+	// nil when acting for the operator without a connection, e.g restoring their listeners
+	conn *Connection
+}
+
+type account struct {
 	userConnections map[string]*Connection
 	username        string
 
 	clients      map[string]*ssh.ServerConn
 	autocomplete *trie.Trie
 
-	privilege *int
+	quotaState quotaState
 }
 
 func (u *User) SetOwnership(uniqueID, newOwners string) error {
@@ -89,7 +191,7 @@ func (u *User) SearchClients(filter string) (out map[string]*ssh.ServerConn, err
 	filter = filter + "*"
 	_, err = filepath.Match(filter, "")
 	if err != nil {
-		return nil, fmt.Errorf("filter is not well formed")
+		return nil, failure.New(failure.InvalidArgument, "filter is not well formed")
 	}
 
 	out = make(map[string]*ssh.ServerConn)
@@ -104,6 +206,10 @@ func (u *User) SearchClients(filter string) (out map[string]*ssh.ServerConn, err
 	}
 
 	for id, conn := range searchClients {
+		if !u._inCampaign(conn) {
+			continue
+		}
+
 		if filter == "" {
 			out[id] = conn
 			continue
@@ -118,6 +224,10 @@ func (u *User) SearchClients(filter string) (out map[string]*ssh.ServerConn, err
 
 	if u.Privilege() != AdminPermissions {
 		for id, conn := range ownedByAll {
+			if !u._inCampaign(conn) {
+				continue
+			}
+
 			if filter == "" {
 				out[id] = conn
 				continue
@@ -163,17 +273,23 @@ func (u *User) GetClient(identifier string) (*ssh.ServerConn, error) {
 	lck.RLock()
 	defer lck.RUnlock()
 
-	if m, ok := u.clients[identifier]; ok {
+	if m, ok := u.clients[identifier]; ok && u._inCampaign(m) {
 		return m, nil
 	}
 
-	if m, ok := ownedByAll[identifier]; ok {
+	if m, ok := ownedByAll[identifier]; ok && u._inCampaign(m) {
 		return m, nil
 	}
 
-	matchingUniqueIDs, ok := aliases[identifier]
-	if !ok {
-		return nil, fmt.Errorf("%s not found", identifier)
+	// Aliases of clients outside the operator's campaign are not matched, as if those clients were not connected
+	matchingUniqueIDs := map[string]bool{}
+	for k := range aliases[identifier] {
+		if m, ok := allClients[k]; ok && u._inCampaign(m) {
+			matchingUniqueIDs[k] = true
+		}
+	}
+	if len(matchingUniqueIDs) == 0 {
+		return nil, failure.New(failure.ClientNotFound, "%s not found", identifier).With("client", identifier)
 	}
 
 	if len(matchingUniqueIDs) == 1 {
@@ -215,12 +331,12 @@ func (u *User) GetClient(identifier string) (*ssh.ServerConn, error) {
 	if len(matchingHosts) > 0 {
 		matchingHosts = matchingHosts[:len(matchingHosts)-1]
 	}
-	return nil, fmt.Errorf("%d connections match alias %q\n%s", matches, identifier, matchingHosts)
+	return nil, failure.New(failure.InvalidArgument, "%d connections match alias %q\n%s", matches, identifier, matchingHosts).With("client", identifier)
 
 }
 
 func (u *User) Autocomplete() *trie.Trie {
-	if u.privilege != nil && *u.privilege == AdminPermissions {
+	if u.Privilege() == AdminPermissions {
 		return globalAutoComplete
 	}
 
@@ -241,26 +357,26 @@ func (u *User) Username() string {
 
 func (u *User) Privilege() int {
 
-	if u.privilege == nil {
-		log.Println("was unable to get privs of", u.username, "defaulting to 0 (no priv)")
-
+	if u.conn == nil || u.conn.privilege == nil {
 		return 0
 	}
 
-	return *u.privilege
+	return *u.conn.privilege
 }
 
 func (u *User) PrivilegeString() string {
 
-	if u.privilege == nil {
+	if u.conn == nil || u.conn.privilege == nil {
 		return "0 (default)"
 	}
 
-	switch *u.privilege {
+	switch *u.conn.privilege {
 	case AdminPermissions:
 		return fmt.Sprintf("%d admin", AdminPermissions)
 	case UserPermissions:
 		return fmt.Sprintf("%d user", UserPermissions)
+	case ReadOnlyPermissions:
+		return fmt.Sprintf("%d read only", ReadOnlyPermissions)
 	default:
 		return "0 (default)"
 	}
@@ -286,12 +402,12 @@ func CreateOrGetUser(username string, serverConnection *ssh.ServerConn) (us *Use
 func _createOrGetUser(username string, serverConnection *ssh.ServerConn) (us *User, connectionDetails string, err error) {
 	u, ok := users[username]
 	if !ok {
-		newUser := &User{
+		newUser := &User{account: &account{
 			username:        username,
 			userConnections: map[string]*Connection{},
 			autocomplete:    trie.NewTrie(),
 			clients:         make(map[string]*ssh.ServerConn),
-		}
+		}}
 
 		users[username] = newUser
 		u = newUser
@@ -304,11 +420,18 @@ func _createOrGetUser(username string, serverConnection *ssh.ServerConn) (us *Us
 			ConnectionDetails: makeConnectionDetailsString(serverConnection),
 		}
 
+		u.setQuota(quotaFromExtensions(serverConnection.Permissions.Extensions))
+
+		if campaign := serverConnection.Permissions.Extensions["campaign"]; campaign != "" {
+			newConnection.campaign = campaign
+			newConnection.campaignPinned = true
+		}
+
 		priv, err := strconv.Atoi(serverConnection.Permissions.Extensions["privilege"])
 		if err != nil {
 			log.Println("could not parse privileges: ", err)
 		} else {
-			u.privilege = &priv
+			newConnection.privilege = &priv
 		}
 
 		if _, ok := u.userConnections[newConnection.ConnectionDetails]; ok {
@@ -318,7 +441,7 @@ func _createOrGetUser(username string, serverConnection *ssh.ServerConn) (us *Us
 		u.userConnections[newConnection.ConnectionDetails] = newConnection
 		activeConnections[newConnection.ConnectionDetails] = true
 
-		return u, newConnection.ConnectionDetails, nil
+		return &User{account: u.account, conn: newConnection}, newConnection.ConnectionDetails, nil
 	}
 
 	return u, "", nil
@@ -340,6 +463,53 @@ func ListUsers() (userList []string) {
 	return
 }
 
+// DisconnectTemporary closes the sessions username opened with a key that expires, returning how many there were
+func DisconnectTemporary(username string) int {
+	lck.RLock()
+	var temporary []ssh.Conn
+	if u, ok := users[username]; ok {
+		for _, c := range u.userConnections {
+			if sc, ok := c.serverConnection.(*ssh.ServerConn); ok && sc.Permissions != nil && sc.Permissions.Extensions["expires"] != "" {
+				temporary = append(temporary, sc)
+			}
+		}
+	}
+	lck.RUnlock()
+
+	// Closing takes the lock to remove the session
+	for _, sc := range temporary {
+		sc.Close()
+	}
+
+	return len(temporary)
+}
+
+// DisconnectKey closes every client and operator session that logged in with the key whose SHA1 hex fingerprint is given, returning how many there were
+func DisconnectKey(fingerprint string) int {
+	lck.RLock()
+	var matching []ssh.Conn
+	for _, conn := range allClients {
+		if conn.Permissions != nil && conn.Permissions.Extensions["pubkey-fp"] == fingerprint {
+			matching = append(matching, conn)
+		}
+	}
+	for _, u := range users {
+		for _, c := range u.userConnections {
+			if sc, ok := c.serverConnection.(*ssh.ServerConn); ok && sc.Permissions != nil && sc.Permissions.Extensions["pubkey-fp"] == fingerprint {
+				matching = append(matching, sc)
+			}
+		}
+	}
+	lck.RUnlock()
+
+	// Closing takes the lock to remove the session
+	for _, sc := range matching {
+		sc.Close()
+	}
+
+	return len(matching)
+}
+
 func DisconnectUser(ServerConnection *ssh.ServerConn) {
 	if ServerConnection != nil {
 		lck.Lock()
@@ -353,6 +523,10 @@ func DisconnectUser(ServerConnection *ssh.ServerConn) {
 			return
 		}
 
+		if c, ok := user.userConnections[details]; ok {
+			c.SetForwardRoute(nil)
+		}
+
 		delete(user.userConnections, details)
 		delete(activeConnections, details)
 
@@ -0,0 +1,84 @@
+package users
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type loginConn struct {
+	ssh.Conn
+	user string
+	port int
+}
+
+func (c loginConn) User() string {
+	return c.user
+}
+
+func (c loginConn) Close() error {
+	return nil
+}
+
+func (c loginConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: c.port}
+}
+
+func login(t *testing.T, username, privilege string, port int, extensions ...string) (*User, *ssh.ServerConn) {
+	t.Helper()
+
+	sc := &ssh.ServerConn{Conn: loginConn{user: username, port: port}, Permissions: &ssh.Permissions{Extensions: map[string]string{"privilege": privilege}}}
+	for i := 0; i+1 < len(extensions); i += 2 {
+		sc.Permissions.Extensions[extensions[i]] = extensions[i+1]
+	}
+	u, _, err := CreateOrGetUser(username, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, sc
+}
+
+func TestPrivilegeIsPerConnection(t *testing.T) {
+	admin, adminConn := login(t, "shared", "5", 1001)
+	defer DisconnectUser(adminConn)
+
+	guest, guestConn := login(t, "shared", "-1", 1002)
+	defer DisconnectUser(guestConn)
+
+	if admin.Privilege() != AdminPermissions {
+		t.Errorf("a read only login with the same username changed the admin's privilege to %d", admin.Privilege())
+	}
+
+	if guest.Privilege() != ReadOnlyPermissions {
+		t.Errorf("the read only login got privilege %d", guest.Privilege())
+	}
+
+	if admin.Username() != guest.Username() || admin.account != guest.account {
+		t.Error("logins with the same username should share the user's clients and sessions")
+	}
+}
+
+func TestCampaignIsPerConnection(t *testing.T) {
+	pinned, pinnedConn := login(t, "shared", "5", 1003, "campaign", "spring")
+	defer DisconnectUser(pinnedConn)
+
+	free, freeConn := login(t, "shared", "5", 1004)
+	defer DisconnectUser(freeConn)
+
+	if err := free.SetCampaign("autumn"); err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned.Campaign() != "spring" || !pinned.CampaignPinned() {
+		t.Errorf("another login with the same username moved the pinned login to %q (pinned %v)", pinned.Campaign(), pinned.CampaignPinned())
+	}
+
+	if free.CampaignPinned() {
+		t.Error("the pin from one key should not hold another login")
+	}
+
+	if pinned.InCampaign("autumn") || !pinned.InCampaign("spring") {
+		t.Error("the pinned login should only see spring")
+	}
+}
@@ -0,0 +1,163 @@
+// Package vault keeps operators' credentials for onward systems (passwords, keys, tokens) and hands them to client modules when they are used.
+//
+// Secrets are sealed with a key derived from the server's private key and the operator's name, so they are only readable while the server runs
+// and one operator's secrets can not be opened as another's. They reach a client only when a module in one of the operator's jump sessions asks
+// for them by name, over the client's own connection, so they are never typed into the target, shown, or written to its disk.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal/secure"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
+	"golang.org/x/crypto/hkdf"
+)
+
+const keyDerivationContext = "rssh vault v1 "
+
+var Kinds = []string{"password", "key", "token"}
+
+var ErrNoGrant = errors.New("no vault access for this session")
+
+type Credential struct {
+	User   string
+	Secret string
+}
+
+func sealingKey(owner string) ([]byte, error) {
+	privateKeyBytes := hostkey.PrivateBytes()
+	if privateKeyBytes == nil {
+		return nil, errors.New("server private key is not loaded")
+	}
+	defer secure.Zero(privateKeyBytes)
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, privateKeyBytes, nil, []byte(keyDerivationContext+owner)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func aead(owner string) (cipher.AEAD, error) {
+	key, err := sealingKey(owner)
+	if err != nil {
+		return nil, err
+	}
+	defer secure.Zero(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData ties a sealed secret to its name, so swapping secrets around in the database does not get them opened under another name
+func additionalData(owner, name, user string) []byte {
+	return []byte(owner + "\x00" + name + "\x00" + user)
+}
+
+// Save seals secret and stores it as owner's credential called name, replacing any there was
+func Save(owner, name, kind, user string, secret []byte) error {
+	gcm, err := aead(owner)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	return data.SaveVaultSecret(data.VaultSecret{
+		Owner:  owner,
+		Name:   name,
+		Kind:   kind,
+		User:   user,
+		Nonce:  nonce,
+		Sealed: gcm.Seal(nil, nonce, secret, additionalData(owner, name, user)),
+	})
+}
+
+// Remove deletes owner's credential called name, false if there was not one
+func Remove(owner, name string) (bool, error) {
+	return data.DeleteVaultSecret(owner, name)
+}
+
+// List is owner's credentials, still sealed
+func List(owner string) ([]data.VaultSecret, error) {
+	return data.GetVaultSecrets(owner)
+}
+
+// Get opens owner's credential called name
+func Get(owner, name string) (Credential, error) {
+	s, err := data.GetVaultSecret(owner, name)
+	if err != nil {
+		return Credential{}, fmt.Errorf("no credential called %q", name)
+	}
+
+	gcm, err := aead(owner)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	secret, err := gcm.Open(nil, s.Nonce, s.Sealed, additionalData(owner, s.Name, s.User))
+	if err != nil {
+		return Credential{}, fmt.Errorf("credential %q could not be opened, was the server key changed?", name)
+	}
+	defer secure.Zero(secret)
+
+	return Credential{User: s.User, Secret: string(secret)}, nil
+}
+
+type grant struct {
+	owner  string
+	client string
+}
+
+var (
+	grantsMu sync.Mutex
+	grants   = map[string]grant{}
+)
+
+// Grant lets the client (identified by its key) ask for owner's credentials until revoke is called, for the life of one jump session.
+// The token goes to the client with the session and is the only way it can ask
+func Grant(owner, client string) (token string, revoke func()) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token = hex.EncodeToString(b)
+
+	grantsMu.Lock()
+	grants[token] = grant{owner: owner, client: client}
+	grantsMu.Unlock()
+
+	return token, func() {
+		grantsMu.Lock()
+		delete(grants, token)
+		grantsMu.Unlock()
+	}
+}
+
+// Redeem opens the credential called name for the client holding token, and says whose it was
+func Redeem(token, client, name string) (owner string, c Credential, err error) {
+	grantsMu.Lock()
+	g, ok := grants[token]
+	grantsMu.Unlock()
+
+	// A token seen on another client's connection is not honoured
+	if !ok || !secure.EqualString(g.client, client) {
+		return "", Credential{}, ErrNoGrant
+	}
+
+	c, err = Get(g.owner, name)
+	return g.owner, c, err
+}
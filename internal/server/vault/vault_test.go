@@ -0,0 +1,53 @@
+package vault
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
+)
+
+func TestVault(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := hostkey.Load(filepath.Join(dir, "id_ed25519"), nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := data.LoadDatabase(filepath.Join(dir, "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Save("alice", "corp-admin", "password", `CORP\admin`, []byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := List("alice")
+	if err != nil || len(secrets) != 1 || string(secrets[0].Sealed) == "hunter2" {
+		t.Fatalf("expected one sealed secret, got %v %v", secrets, err)
+	}
+
+	if _, err := Get("bob", "corp-admin"); err == nil {
+		t.Fatal("expected another operator not to be able to get the credential")
+	}
+
+	token, revoke := Grant("alice", "clientkey")
+
+	if _, _, err := Redeem(token, "otherclient", "corp-admin"); !errors.Is(err, ErrNoGrant) {
+		t.Fatalf("expected the grant to be refused on another client, got %v", err)
+	}
+
+	owner, credential, err := Redeem(token, "clientkey", "corp-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "alice" || credential.User != `CORP\admin` || credential.Secret != "hunter2" {
+		t.Fatalf("unexpected credential %s %+v", owner, credential)
+	}
+
+	revoke()
+	if _, _, err := Redeem(token, "clientkey", "corp-admin"); !errors.Is(err, ErrNoGrant) {
+		t.Fatalf("expected the grant to end with the session, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package webhooks
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"log"
@@ -13,18 +14,71 @@ import (
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
 )
 
-func StartWebhooks() {
+type event interface {
+	Json() ([]byte, error)
+	Summary() string
+}
+
+const sendTimeout = 2 * time.Second
+
+// StartWebhooks sends client events to every webhook until ctx is done
+func StartWebhooks(ctx context.Context) {
+
+	messages := make(chan event)
+
+	send := func(message event) {
+		select {
+		case messages <- message:
+		case <-ctx.Done():
+		}
+	}
 
-	messages := make(chan observers.ClientState)
+	connectionID := observers.ConnectionState.Register(func(message observers.ClientState) {
+		send(message)
+	})
 
-	observers.ConnectionState.Register(func(message observers.ClientState) {
-		messages <- message
+	networkID := observers.NetworkChange.Register(func(message observers.ClientNetworkChange) {
+		send(message)
 	})
 
-	go func() {
-		for msg := range messages {
+	downloadID := observers.Downloads.Register(func(message observers.Download) {
+		send(message)
+	})
+
+	anchorID := observers.AuditAnchors.Register(func(message observers.AuditAnchor) {
+		send(message)
+	})
+
+	buildID := observers.Builds.Register(func(message observers.Build) {
+		send(message)
+	})
+
+	contentID := observers.ContentMatches.Register(func(message observers.ContentMatch) {
+		send(message)
+	})
 
-			go func(msg observers.ClientState) {
+	reclaimID := observers.Reclaims.Register(func(message observers.Reclaim) {
+		send(message)
+	})
+
+	go func() {
+		defer observers.ConnectionState.Deregister(connectionID)
+		defer observers.NetworkChange.Deregister(networkID)
+		defer observers.Downloads.Deregister(downloadID)
+		defer observers.AuditAnchors.Deregister(anchorID)
+		defer observers.Builds.Deregister(buildID)
+		defer observers.ContentMatches.Deregister(contentID)
+		defer observers.Reclaims.Deregister(reclaimID)
+
+		for {
+			var msg event
+			select {
+			case <-ctx.Done():
+				return
+			case msg = <-messages:
+			}
+
+			go func(msg event) {
 
 				fullBytes, err := msg.Json()
 				if err != nil {
@@ -55,13 +109,10 @@ func StartWebhooks() {
 					}
 
 					client := http.Client{
-						Timeout:   2 * time.Second,
 						Transport: tr,
 					}
 
-					buff := bytes.NewBuffer(webhookMessage)
-					_, err := client.Post(webhook.URL, "application/json", buff)
-					if err != nil {
+					if err := post(ctx, client, webhook.URL, webhookMessage); err != nil {
 						log.Printf("Error sending webhook %q: %s\n", webhook.URL, err)
 					}
 				}
@@ -70,3 +121,20 @@ func StartWebhooks() {
 		}
 	}()
 }
+
+func post(ctx context.Context, client http.Client, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
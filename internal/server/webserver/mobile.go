@@ -0,0 +1,168 @@
+package webserver
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Package gomobile binds, it is the client's connection core with Start, Stop and Status
+const mobilePackage = "github.com/NHAS/reverse_ssh/pkg/mobile"
+
+type mobileLibrary struct {
+	// gomobile -target
+	target string
+
+	// What the download is recorded as
+	goos string
+
+	extension string
+}
+
+// MobileLibrary values, link --aar and --xcframework
+var mobileLibraries = map[string]mobileLibrary{
+	"aar":         {target: "android", goos: "android", extension: ".aar"},
+	"xcframework": {target: "ios,iossimulator", goos: "ios", extension: ".xcframework.zip"},
+}
+
+// validateMobile checks a gomobile library build is not combined with options that only apply to go build
+func (config *BuildConfig) validateMobile() error {
+	if config.MobileLibrary == "" {
+		return nil
+	}
+
+	if _, ok := mobileLibraries[config.MobileLibrary]; !ok {
+		return fmt.Errorf("unknown mobile library type %q, use aar or xcframework", config.MobileLibrary)
+	}
+
+	if config.GOOS != "" || config.GOARCH != "" || config.GOARM != "" || config.GOMIPS != "" || config.Preset != "" {
+		return errors.New("--aar and --xcframework build every architecture of their platform, and cannot be used with --goos, --goarch, --goarm, --gomips or --preset")
+	}
+
+	if config.SharedLibrary || config.UPX || config.Garble || config.Legacy || config.DisableLibC || config.RawDownload {
+		return errors.New("--aar and --xcframework cannot be used with --shared-object, --upx, --garble, --legacy, --no-lib-c or --raw-download")
+	}
+
+	if strings.HasPrefix(config.ConnectBackAdress, "stdio://") || strings.HasPrefix(config.ConnectBackAdress, "smb://") {
+		return errors.New("mobile libraries cannot use the stdio or smb transports")
+	}
+
+	if config.MobileLibrary == "xcframework" && runtime.GOOS != "darwin" {
+		return errors.New("--xcframework needs Xcode, so the server must run on macOS")
+	}
+
+	return nil
+}
+
+// buildMobile binds pkg/mobile with gomobile and writes the library to output, xcframeworks are directories so they are zipped
+func buildMobile(ctx context.Context, config BuildConfig, output string, tags []string, embedded []EmbeddedSetting) error {
+	library := mobileLibraries[config.MobileLibrary]
+
+	goMod, err := os.ReadFile(filepath.Join(projectRoot, "go.mod"))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(goMod), "golang.org/x/mobile") {
+		return fmt.Errorf("gomobile needs golang.org/x/mobile in the client's module, run go get golang.org/x/mobile/bind in %s first", projectRoot)
+	}
+
+	// pkg/mobile names its settings as cmd/client does
+	ldflags := "-ldflags=-s -w"
+	for _, setting := range embedded {
+		ldflags += fmt.Sprintf(" -X %s=%s", strings.Replace(setting.Variable, "main.", mobilePackage+".", 1), setting.Value)
+	}
+
+	work, err := os.MkdirTemp(cachePath, "mobile")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	// gomobile picks the output type from the name
+	built := filepath.Join(work, "Rssh"+strings.TrimSuffix(library.extension, ".zip"))
+
+	arguments := []string{"bind", "-target=" + library.target, "-trimpath", "-o", built}
+	if library.goos == "android" {
+		// Older api levels are not supported by current NDKs
+		arguments = append(arguments, "-androidapi=21")
+	}
+	if len(tags) > 0 {
+		arguments = append(arguments, "-tags="+strings.Join(tags, ","))
+	}
+	arguments = append(arguments, ldflags, mobilePackage)
+
+	cmd := exec.CommandContext(ctx, "gomobile", arguments...)
+	cmd.Dir = projectRoot
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("gomobile bind failed: %w\n%s", err, string(output))
+	}
+
+	if library.goos != "ios" {
+		return os.Rename(built, output)
+	}
+
+	return zipDirectory(built, output)
+}
+
+func zipDirectory(dir, output string) error {
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+
+	base := filepath.Dir(dir)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		if d.IsDir() {
+			_, err := w.Create(name + "/")
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", name)
+		}
+
+		entry, err := w.Create(name)
+		if err != nil {
+			return err
+		}
+
+		content, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+
+		_, err = io.Copy(entry, content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
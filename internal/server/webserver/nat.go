@@ -4,12 +4,14 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	tsRelayMu        sync.Mutex
 	tsRelayToken     string
 	tsRelayBootstrap func() (string, error)
+	tsTokenIssuer    func(expires time.Time) (string, error)
 )
 
 func SetTSBootstrap(bootstrap func() (string, error)) {
@@ -18,6 +20,25 @@ func SetTSBootstrap(bootstrap func() (string, error)) {
 	tsRelayBootstrap = bootstrap
 }
 
+func SetTSTokenIssuer(issuer func(expires time.Time) (string, error)) {
+	tsRelayMu.Lock()
+	defer tsRelayMu.Unlock()
+	tsTokenIssuer = issuer
+}
+
+// IssueTSToken makes a token just for one build, with the relay's direct path candidates and an expiry
+func IssueTSToken(expires time.Time) (string, error) {
+	tsRelayMu.Lock()
+	issuer := tsTokenIssuer
+	tsRelayMu.Unlock()
+
+	if issuer == nil {
+		return "", errors.New("ts relay bootstrap is not configured on this server")
+	}
+
+	return issuer(expires)
+}
+
 func EnsureTSToken() (string, error) {
 	tsRelayMu.Lock()
 	defer tsRelayMu.Unlock()
@@ -50,4 +71,5 @@ func ResetTSRelay() {
 
 	tsRelayToken = ""
 	tsRelayBootstrap = nil
+	tsTokenIssuer = nil
 }
@@ -0,0 +1,123 @@
+package webserver
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// buildPreset is a target for routers and other embedded devices, which often have only a few megabytes of flash free
+type buildPreset struct {
+	Description string
+
+	// Empty GOARCH keeps the one given with --goarch
+	GOOS, GOARCH, GOARM, GOMIPS string
+}
+
+var buildPresets = map[string]buildPreset{
+	"mips": {
+		Description: "Big endian MIPS routers (e.g Atheros and Qualcomm based), soft float",
+		GOOS:        "linux", GOARCH: "mips", GOMIPS: "softfloat",
+	},
+	"mipsle": {
+		Description: "Little endian MIPS routers (e.g MediaTek and Broadcom based), soft float",
+		GOOS:        "linux", GOARCH: "mipsle", GOMIPS: "softfloat",
+	},
+	"arm5": {
+		Description: "ARMv5 devices without an FPU (e.g older NAS and Kirkwood boards), soft float",
+		GOOS:        "linux", GOARCH: "arm", GOARM: "5",
+	},
+	"musl": {
+		Description: "Static linux client for musl or uClibc systems (e.g OpenWrt, Alpine), for any --goarch",
+		GOOS:        "linux",
+	},
+}
+
+// BuildPresets describes each preset, for link's help
+func BuildPresets() []string {
+	var presets []string
+	for name, preset := range buildPresets {
+		presets = append(presets, name+": "+preset.Description)
+	}
+	sort.Strings(presets)
+	return presets
+}
+
+// applyPreset sets the target of a preset, and makes the client as small as it can be
+func (config *BuildConfig) applyPreset() error {
+	if config.Preset == "" {
+		return nil
+	}
+
+	preset, ok := buildPresets[config.Preset]
+	if !ok {
+		var names []string
+		for name := range buildPresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown preset %q, valid presets are: %s", config.Preset, strings.Join(names, ", "))
+	}
+
+	if config.SharedLibrary {
+		return fmt.Errorf("preset %q builds a static executable, it cannot be used with --shared-object", config.Preset)
+	}
+
+	for _, setting := range []struct{ flag, given, preset string }{
+		{"goos", config.GOOS, preset.GOOS},
+		{"goarch", config.GOARCH, preset.GOARCH},
+		{"goarm", config.GOARM, preset.GOARM},
+		{"gomips", config.GOMIPS, preset.GOMIPS},
+	} {
+		if setting.preset != "" && setting.given != "" && setting.given != setting.preset {
+			return fmt.Errorf("preset %q sets --%s %s, it cannot be %s", config.Preset, setting.flag, setting.preset, setting.given)
+		}
+	}
+
+	config.GOOS = preset.GOOS
+	if preset.GOARCH != "" {
+		config.GOARCH = preset.GOARCH
+	}
+	if preset.GOARM != "" {
+		config.GOARM = preset.GOARM
+	}
+	if preset.GOMIPS != "" {
+		config.GOMIPS = preset.GOMIPS
+	}
+
+	// No libc, so it runs on whatever the device has
+	config.DisableLibC = true
+
+	// upx packs mips and arm, use it when it is installed
+	if _, err := exec.LookPath("upx"); err == nil {
+		config.UPX = true
+		config.Lzma = true
+	}
+
+	return nil
+}
+
+// ParseSizeBudget reads a size in bytes, with an optional K or M suffix (powers of 1024)
+func ParseSizeBudget(s string) (int64, error) {
+	size := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(size, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(size, "M"):
+		multiplier = 1 << 20
+	}
+	if multiplier != 1 {
+		size = size[:len(size)-1]
+	}
+
+	n, err := strconv.ParseFloat(size, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size budget %q, expected e.g 3.5M or 900K", s)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,327 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
+	"golang.org/x/crypto/ssh"
+)
+
+// Every build gets a provenance document in the shape of an in-toto statement with a SLSA v1 predicate: what was built (the artifact's
+// sha256), what from (the git commit and a digest of the client source), with what (toolchain, arguments, environment) and by whom (this
+// server, by its key). It is signed with the server key in a DSSE envelope and kept with the download, so a binary found deployed can be
+// matched to exactly how it was made. Embedded settings such as the destination and proxy credentials are recorded only as hashes.
+
+const (
+	provenancePayloadType = "application/vnd.in-toto+json"
+	provenanceBuildType   = "https://github.com/NHAS/reverse_ssh/client-build@v1"
+)
+
+type ProvenanceDigest map[string]string
+
+type ProvenanceSubject struct {
+	Name   string           `json:"name"`
+	Digest ProvenanceDigest `json:"digest"`
+}
+
+type ProvenanceDependency struct {
+	URI    string           `json:"uri"`
+	Digest ProvenanceDigest `json:"digest"`
+}
+
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     struct {
+		BuildDefinition struct {
+			BuildType          string `json:"buildType"`
+			ExternalParameters struct {
+				Target  string   `json:"target"`
+				Type    string   `json:"type"`
+				Modules []string `json:"modules,omitempty"`
+				Garble  bool     `json:"garble,omitempty"`
+				UPX     bool     `json:"upx,omitempty"`
+				Legacy  bool     `json:"legacy,omitempty"`
+				Strict  bool     `json:"strictCrypto,omitempty"`
+				Signed  bool     `json:"integritySigned"`
+			} `json:"externalParameters"`
+			InternalParameters struct {
+				Toolchain   string            `json:"toolchain"`
+				Tool        string            `json:"tool"`
+				Arguments   []string          `json:"arguments,omitempty"`
+				Environment map[string]string `json:"environment,omitempty"`
+				// Name of each setting the linker embedded and the sha256 of its value
+				Embedded map[string]string `json:"embedded"`
+			} `json:"internalParameters"`
+			ResolvedDependencies []ProvenanceDependency `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+		RunDetails struct {
+			Builder struct {
+				ID      string            `json:"id"`
+				Version map[string]string `json:"version"`
+			} `json:"builder"`
+			Metadata struct {
+				InvocationID string    `json:"invocationId"`
+				StartedOn    time.Time `json:"startedOn"`
+				FinishedOn   time.Time `json:"finishedOn"`
+			} `json:"metadata"`
+		} `json:"runDetails"`
+	} `json:"predicate"`
+}
+
+type ProvenanceSignature struct {
+	KeyID string `json:"keyid"`
+	// base64 of an ssh signature, in wire format, of the envelope's pre-authentication encoding
+	Sig string `json:"sig"`
+}
+
+// ProvenanceEnvelope is a DSSE envelope, Payload is the base64 of the statement
+type ProvenanceEnvelope struct {
+	PayloadType string                `json:"payloadType"`
+	Payload     string                `json:"payload"`
+	Signatures  []ProvenanceSignature `json:"signatures"`
+}
+
+// buildRecord is what buildClient knows about a build that goes in its provenance
+type buildRecord struct {
+	config    BuildConfig
+	download  data.Download
+	tool      string
+	arguments []string
+	env       []string
+	embedded  []EmbeddedSetting
+	started   time.Time
+}
+
+// Variables the build sets that change what it makes
+var provenanceEnvironment = []string{"GOOS", "GOARCH", "GOARM", "GOMIPS", "CGO_ENABLED", "GOFIPS140", "CC"}
+
+// dssePAE is the pre-authentication encoding DSSE signs
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+func sourceCommit(ctx context.Context) (commit string, dirty bool) {
+	output, err := exec.CommandContext(ctx, "git", "-C", projectRoot, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", false
+	}
+
+	// The client key is written into the tree for each build, it is not a change to the source
+	status, err := exec.CommandContext(ctx, "git", "-C", projectRoot, "status", "--porcelain", "--", ".", ":!internal/client/keys").Output()
+	return strings.TrimSpace(string(output)), err != nil || len(bytes.TrimSpace(status)) > 0
+}
+
+// redactArguments drops the values from the linker flags, they are in the embedded settings as hashes
+func redactArguments(arguments []string) []string {
+	redacted := make([]string, 0, len(arguments))
+	for _, argument := range arguments {
+		if !strings.HasPrefix(argument, "-ldflags=") {
+			redacted = append(redacted, argument)
+			continue
+		}
+
+		var (
+			fields   []string
+			previous string
+		)
+		for _, field := range strings.Fields(strings.TrimPrefix(argument, "-ldflags=")) {
+			switch {
+			case previous == "-X":
+				name, _, _ := strings.Cut(field, "=")
+				fields = append(fields, name+"=<embedded>")
+			case strings.HasPrefix(field, "-"):
+				fields = append(fields, field)
+			default:
+				// The rest of a value with spaces in it
+				continue
+			}
+			previous = field
+		}
+		redacted = append(redacted, "-ldflags="+strings.Join(fields, " "))
+	}
+	return redacted
+}
+
+func fileSHA256(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// recordProvenance makes the signed provenance of a finished build, while its artifact is still at FilePath
+func recordProvenance(ctx context.Context, record buildRecord) (string, error) {
+	signer := hostkey.Signer()
+	if signer == nil {
+		return "", errors.New("server private key is not loaded")
+	}
+
+	artifact, err := fileSHA256(record.download.FilePath)
+	if err != nil {
+		return "", err
+	}
+
+	var statement ProvenanceStatement
+	statement.Type = "https://in-toto.io/Statement/v1"
+	statement.PredicateType = "https://slsa.dev/provenance/v1"
+	statement.Subject = []ProvenanceSubject{{Name: record.config.Name, Digest: ProvenanceDigest{"sha256": artifact}}}
+
+	definition := &statement.Predicate.BuildDefinition
+	definition.BuildType = provenanceBuildType
+
+	parameters := &definition.ExternalParameters
+	parameters.Target = record.download.Goos + "/" + record.download.Goarch + record.download.Goarm
+	parameters.Type = record.download.FileType
+	parameters.Modules = record.config.Modules
+	parameters.Garble = record.config.Garble
+	parameters.UPX = record.config.UPX
+	parameters.Legacy = record.config.Legacy
+	parameters.Strict = record.config.StrictCrypto
+	parameters.Signed = integrityKey(record.config) != ""
+
+	internalParameters := &definition.InternalParameters
+	internalParameters.Tool = record.tool
+	internalParameters.Arguments = redactArguments(record.arguments)
+
+	internalParameters.Environment = map[string]string{}
+	for _, variable := range record.env {
+		name, value, _ := strings.Cut(variable, "=")
+		for _, wanted := range provenanceEnvironment {
+			if name == wanted {
+				// Later entries win, as they do for the build
+				internalParameters.Environment[name] = value
+			}
+		}
+	}
+
+	internalParameters.Embedded = map[string]string{}
+	for _, setting := range record.embedded {
+		sum := sha256.Sum256([]byte(setting.Value))
+		internalParameters.Embedded[setting.Name] = hex.EncodeToString(sum[:])
+	}
+
+	state, err := readSourceState(ctx)
+	if err != nil {
+		return "", err
+	}
+	internalParameters.Toolchain = state.Toolchain
+	definition.ResolvedDependencies = append(definition.ResolvedDependencies, ProvenanceDependency{
+		URI:    "file:cmd/client",
+		Digest: ProvenanceDigest{"sha256": state.Source},
+	})
+
+	if commit, dirty := sourceCommit(ctx); commit != "" {
+		uri := "git+https://github.com/NHAS/reverse_ssh"
+		if dirty {
+			uri += "#dirty"
+		}
+		definition.ResolvedDependencies = append(definition.ResolvedDependencies, ProvenanceDependency{
+			URI:    uri,
+			Digest: ProvenanceDigest{"gitCommit": commit},
+		})
+	}
+
+	run := &statement.Predicate.RunDetails
+	run.Builder.ID = "rssh-server:" + internal.FingerprintSHA256Hex(signer.PublicKey())
+	run.Builder.Version = map[string]string{"rssh": internal.Version}
+	run.Metadata.InvocationID = record.download.Fingerprint
+	run.Metadata.StartedOn = record.started.UTC()
+	run.Metadata.FinishedOn = time.Now().UTC()
+
+	return signProvenance(signer, statement)
+}
+
+// signProvenance wraps statement in a DSSE envelope signed by signer
+func signProvenance(signer ssh.Signer, statement ProvenanceStatement) (string, error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := signer.Sign(rand.Reader, dssePAE(provenancePayloadType, payload))
+	if err != nil {
+		return "", err
+	}
+
+	envelope, err := json.Marshal(ProvenanceEnvelope{
+		PayloadType: provenancePayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []ProvenanceSignature{{
+			KeyID: internal.FingerprintSHA256Hex(signer.PublicKey()),
+			Sig:   base64.StdEncoding.EncodeToString(ssh.Marshal(signature)),
+		}},
+	})
+	return string(envelope), err
+}
+
+// VerifyProvenance checks the provenance of a download was signed by this server's key, and returns what it says
+func VerifyProvenance(f data.Download) (ProvenanceStatement, ProvenanceEnvelope, error) {
+	var (
+		statement ProvenanceStatement
+		envelope  ProvenanceEnvelope
+	)
+
+	if f.Provenance == "" {
+		return statement, envelope, errors.New("no provenance was recorded for this download, it was built by an older server")
+	}
+
+	if err := json.Unmarshal([]byte(f.Provenance), &envelope); err != nil {
+		return statement, envelope, err
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return statement, envelope, err
+	}
+
+	signer := hostkey.Signer()
+	if signer == nil {
+		return statement, envelope, errors.New("server private key is not loaded")
+	}
+
+	verified := false
+	for _, s := range envelope.Signatures {
+		raw, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+
+		var signature ssh.Signature
+		if ssh.Unmarshal(raw, &signature) != nil {
+			continue
+		}
+
+		if signer.PublicKey().Verify(dssePAE(envelope.PayloadType, payload), &signature) == nil {
+			verified = true
+			break
+		}
+	}
+
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return statement, envelope, err
+	}
+
+	if !verified {
+		return statement, envelope, errors.New("provenance is not signed by this server's key")
+	}
+
+	return statement, envelope, nil
+}
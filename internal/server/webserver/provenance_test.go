@@ -0,0 +1,51 @@
+package webserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkey"
+)
+
+func TestProvenanceSignedAndRedacted(t *testing.T) {
+	if _, err := hostkey.Load(filepath.Join(t.TempDir(), "id_ed25519"), nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	arguments := redactArguments([]string{"build", "-trimpath", "-ldflags=-s -w -X main.ntlmProxyCreds=DOMAIN\\user:hunter2 -X main.versionString=SSH-2.0-OpenSSH secret words -X main.destination=10.0.0.1:22"})
+	if got := strings.Join(arguments, " "); strings.Contains(got, "hunter2") || strings.Contains(got, "secret") || !strings.Contains(got, "-X main.ntlmProxyCreds=<embedded>") {
+		t.Fatalf("redacted arguments = %q", got)
+	}
+
+	var statement ProvenanceStatement
+	statement.Subject = []ProvenanceSubject{{Name: "implant", Digest: ProvenanceDigest{"sha256": "abc"}}}
+	statement.Predicate.BuildDefinition.InternalParameters.Arguments = arguments
+
+	envelope, err := signProvenance(hostkey.Signer(), statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := VerifyProvenance(data.Download{Provenance: envelope})
+	if err != nil {
+		t.Fatalf("VerifyProvenance() error = %v", err)
+	}
+	if got.Subject[0].Digest["sha256"] != "abc" {
+		t.Fatalf("subject = %+v", got.Subject)
+	}
+
+	// Changing the statement breaks the signature
+	var tampered ProvenanceEnvelope
+	json.Unmarshal([]byte(envelope), &tampered)
+	payload, _ := base64.StdEncoding.DecodeString(tampered.Payload)
+	tampered.Payload = base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(payload), "abc", "abd", 1)))
+	encoded, _ := json.Marshal(tampered)
+
+	if _, _, err := VerifyProvenance(data.Download{Provenance: string(encoded)}); err == nil {
+		t.Fatal("tampered provenance verified")
+	}
+}
@@ -0,0 +1,295 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+)
+
+const (
+	rebuildCheckInterval = time.Minute
+	rebuildTimeout       = 10 * time.Minute
+)
+
+// sourceState is what a client build depends on, if any of it changes links marked with --auto-rebuild are built again
+type sourceState struct {
+	Toolchain string
+	Source    string
+	Templates string
+}
+
+// changes describes what differs between two states, e.g "go toolchain change (go1.22.1 -> go1.22.2)"
+func (s sourceState) changes(previous sourceState) string {
+	var reasons []string
+	if s.Toolchain != previous.Toolchain {
+		reasons = append(reasons, fmt.Sprintf("go toolchain change (%s -> %s)", previous.Toolchain, s.Toolchain))
+	}
+	if s.Source != previous.Source {
+		reasons = append(reasons, "client source change")
+	}
+	if s.Templates != previous.Templates {
+		reasons = append(reasons, "template change")
+	}
+	return strings.Join(reasons, ", ")
+}
+
+func readSourceState(ctx context.Context) (sourceState, error) {
+	var state sourceState
+
+	toolchain, err := exec.CommandContext(ctx, "go", "env", "GOVERSION").Output()
+	if err != nil {
+		return state, fmt.Errorf("unable to get go version: %w", err)
+	}
+	state.Toolchain = strings.TrimSpace(string(toolchain))
+
+	legacy, err := legacyToolchainVersion(ctx)
+	if err != nil {
+		return state, err
+	}
+	if legacy != "" {
+		state.Toolchain += " (legacy " + legacy + ")"
+	}
+
+	root, err := filepath.Abs(projectRoot)
+	if err != nil {
+		return state, err
+	}
+
+	// Every package the client can be built from, with all the optional modules in
+	var tags []string
+	for _, tag := range clientModules {
+		tags = append(tags, tag)
+	}
+
+	cmd := exec.CommandContext(ctx, "go", "list", "-deps", "-tags="+strings.Join(tags, ","), "-f", "{{if not .Standard}}{{.Dir}}{{end}}", "./cmd/client")
+	cmd.Dir = root
+	output, err := cmd.Output()
+	if err != nil {
+		return state, fmt.Errorf("unable to list client packages: %w", err)
+	}
+
+	files := []string{filepath.Join(root, "go.mod"), filepath.Join(root, "go.sum")}
+	for _, dir := range strings.Fields(string(output)) {
+		// Dependencies outside the tree are pinned by go.sum
+		if !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			return state, err
+		}
+		files = append(files, matches...)
+	}
+
+	state.Source, err = hashFiles(root, files)
+	if err != nil {
+		return state, err
+	}
+
+	var templates []string
+	err = filepath.WalkDir(filepath.Join(root, "internal/server/webserver/shellscripts/templates"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			templates = append(templates, path)
+		}
+		return err
+	})
+	if err != nil {
+		return state, err
+	}
+
+	state.Templates, err = hashFiles(root, templates)
+	return state, err
+}
+
+// hashFiles hashes the names and contents of files, in a stable order
+func hashFiles(root string, files []string) (string, error) {
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+
+		name, _ := filepath.Rel(root, path)
+		fmt.Fprintf(h, "%s\x00", name)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sourceStatePath() string {
+	return filepath.Join(cachePath, "../build_state.json")
+}
+
+// watchForRebuilds checks the toolchain and client source every minute, and rebuilds links marked with --auto-rebuild when they change
+func watchForRebuilds(ctx context.Context) {
+	ticker := time.NewTicker(rebuildCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		checkForRebuilds(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkForRebuilds(ctx context.Context) {
+	current, err := readSourceState(ctx)
+	if err != nil {
+		log.Printf("unable to check client source for changes: %s", err)
+		return
+	}
+
+	var previous sourceState
+	content, err := os.ReadFile(sourceStatePath())
+	if err == nil {
+		err = json.Unmarshal(content, &previous)
+	}
+
+	// Nothing to compare against the first time
+	if err == nil && current != previous {
+		reason := current.changes(previous)
+		log.Printf("Client builds are out of date after %s, rebuilding", reason)
+
+		prewarmBuildCache(ctx)
+		rebuildLinks(ctx, reason)
+	}
+
+	content, _ = json.Marshal(current)
+	if err := os.WriteFile(sourceStatePath(), content, 0600); err != nil {
+		log.Printf("unable to save client source state: %s", err)
+	}
+}
+
+// prewarmBuildCache compiles the client once for every target links have been built for, so the next link is quick
+func prewarmBuildCache(ctx context.Context) {
+	downloads, err := data.ListDownloads("")
+	if err != nil {
+		log.Printf("unable to list downloads to warm the build cache: %s", err)
+		return
+	}
+
+	targets := map[[3]string]bool{}
+	for _, d := range downloads {
+		if d.FileType == "executable" {
+			targets[[3]string{d.Goos, d.Goarch, d.Goarm}] = true
+		}
+	}
+
+	for target := range targets {
+		if ctx.Err() != nil {
+			return
+		}
+
+		cmd := exec.CommandContext(ctx, "go", "build", "-trimpath", "-o", os.DevNull, "./cmd/client")
+		cmd.Dir = projectRoot
+		cmd.Env = append(os.Environ(), "GOOS="+target[0], "GOARCH="+target[1], "CGO_ENABLED=0")
+		if target[2] != "" {
+			cmd.Env = append(cmd.Env, "GOARM="+target[2])
+		}
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("warming the build cache for %s/%s failed: %s\n%s", target[0], target[1], err, bytes.TrimSpace(output))
+		}
+	}
+}
+
+func rebuildLinks(ctx context.Context, reason string) {
+	downloads, err := data.AutoRebuildDownloads()
+	if err != nil {
+		log.Printf("unable to list links to rebuild: %s", err)
+		return
+	}
+
+	for _, d := range downloads {
+		if ctx.Err() != nil {
+			return
+		}
+
+		event := observers.Build{
+			Link:     d.UrlPath,
+			Reason:   reason,
+			Campaign: d.Campaign,
+		}
+
+		rebuilt, err := rebuildLink(ctx, d)
+		if err != nil {
+			event.Status = "failed"
+			event.Error = err.Error()
+		} else {
+			event.Status = "rebuilt"
+			event.Fingerprint = rebuilt.Fingerprint
+			event.SHA256, err = downloadSHA256(rebuilt)
+			if err != nil {
+				log.Printf("unable to hash rebuilt link %s: %s", d.UrlPath, err)
+			}
+		}
+
+		event.Timestamp = time.Now()
+		log.Println(event.Summary())
+		observers.Builds.Notify(event)
+	}
+}
+
+func rebuildLink(ctx context.Context, d data.Download) (data.Download, error) {
+	if d.BuildConfig == "" {
+		return d, fmt.Errorf("no build options were saved for it")
+	}
+
+	var config BuildConfig
+	if err := json.Unmarshal([]byte(d.BuildConfig), &config); err != nil {
+		return d, fmt.Errorf("saved build options are invalid: %w", err)
+	}
+	config.Name = d.UrlPath
+
+	ctx, cancel := context.WithTimeout(ctx, rebuildTimeout)
+	defer cancel()
+
+	_, rebuilt, err := build(ctx, config, true)
+	return rebuilt, err
+}
+
+func downloadSHA256(d data.Download) (string, error) {
+	f, err := data.OpenDownload(d, "")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
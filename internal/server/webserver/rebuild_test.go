@@ -0,0 +1,38 @@
+package webserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceStateChanges(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	os.WriteFile(a, []byte("package a"), 0600)
+	os.WriteFile(b, []byte("package b"), 0600)
+
+	first, err := hashFiles(dir, []string{a, b, filepath.Join(dir, "missing.go")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Order does not matter, content does
+	again, _ := hashFiles(dir, []string{b, a})
+	if first != again {
+		t.Fatal("hash depends on file order")
+	}
+
+	os.WriteFile(b, []byte("package b // changed"), 0600)
+	changed, _ := hashFiles(dir, []string{a, b})
+	if changed == first {
+		t.Fatal("hash did not change with the source")
+	}
+
+	previous := sourceState{Toolchain: "go1.22.1", Source: first, Templates: "x"}
+	current := sourceState{Toolchain: "go1.22.2", Source: changed, Templates: "x"}
+
+	if got, want := current.changes(previous), "go toolchain change (go1.22.1 -> go1.22.2), client source change"; got != want {
+		t.Fatalf("changes = %q, want %q", got, want)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"embed"
 	"io"
+	"net"
 	"text/template"
 )
 
@@ -20,6 +21,11 @@ type Args struct {
 	WorkingDirectory string
 }
 
+// Address is where the scripts download from, with IPv6 hosts bracketed
+func (a Args) Address() string {
+	return net.JoinHostPort(a.Host, a.Port)
+}
+
 func MakeTemplate(attributes Args, extension string) ([]byte, error) {
 
 	file, err := shellTemplates.Open("templates/" + extension)
@@ -0,0 +1,181 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	// goos/goarch pairs the go toolchain can build, from go tool dist list
+	validTargets = make(map[string]bool)
+
+	// GOARM is 5, 6 or 7, optionally with the float abi, e.g 7,softfloat
+	validGOARM = regexp.MustCompile(`^[567](,(softfloat|hardfloat))?$`)
+
+	legacyToolchainLock sync.RWMutex
+	legacyToolchain     string
+)
+
+// target is the goos/goarch a config builds for, filling in the server's own when unset
+func (config *BuildConfig) target() (goos, goarch string) {
+	goos, goarch = runtime.GOOS, runtime.GOARCH
+	if config.GOOS != "" {
+		goos = config.GOOS
+	}
+	if config.GOARCH != "" {
+		goarch = config.GOARCH
+	}
+	return goos, goarch
+}
+
+// SetLegacyToolchain sets the GOROOT of the go toolchain --legacy builds use, e.g a build of go patched to still run on Windows 7
+func SetLegacyToolchain(goroot string) error {
+	if goroot != "" {
+		goroot, err := filepath.Abs(goroot)
+		if err != nil {
+			return err
+		}
+
+		if _, err := exec.Command(legacyGoBinary(goroot), "version").Output(); err != nil {
+			return fmt.Errorf("legacy toolchain %q does not have a working bin/go: %w", goroot, err)
+		}
+	}
+
+	legacyToolchainLock.Lock()
+	defer legacyToolchainLock.Unlock()
+	legacyToolchain = goroot
+
+	return nil
+}
+
+func getLegacyToolchain() string {
+	legacyToolchainLock.RLock()
+	defer legacyToolchainLock.RUnlock()
+	return legacyToolchain
+}
+
+func legacyGoBinary(goroot string) string {
+	name := "go"
+	if runtime.GOOS == "windows" {
+		name = "go.exe"
+	}
+	return filepath.Join(goroot, "bin", name)
+}
+
+// legacyToolchainVersion is empty when no legacy toolchain is set
+func legacyToolchainVersion(ctx context.Context) (string, error) {
+	goroot := getLegacyToolchain()
+	if goroot == "" {
+		return "", nil
+	}
+
+	cmd := exec.CommandContext(ctx, legacyGoBinary(goroot), "env", "GOVERSION")
+	cmd.Env = legacyEnv(os.Environ(), goroot)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to get legacy toolchain version: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// legacyEnv puts the legacy toolchain first, so garble also uses it, and stops go.mod switching to another toolchain
+func legacyEnv(env []string, goroot string) []string {
+	return append(env,
+		"GOROOT="+goroot,
+		"PATH="+filepath.Join(goroot, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"GOTOOLCHAIN=local",
+	)
+}
+
+// validateTarget checks the goos/goarch pair, GOARM and GOMIPS, and what --legacy can be used with
+func (config *BuildConfig) validateTarget() error {
+	goos, goarch := config.target()
+
+	if len(validTargets) != 0 && !validTargets[goos+"/"+goarch] {
+		return fmt.Errorf("%s/%s is not a target the go toolchain can build", goos, goarch)
+	}
+
+	if config.GOARM != "" {
+		if goarch != "arm" {
+			return fmt.Errorf("GOARM can only be set when building for arm, not %s", goarch)
+		}
+
+		if !validGOARM.MatchString(config.GOARM) {
+			return fmt.Errorf("GOARM %q is not valid, use 5, 6 or 7 (optionally with ,softfloat or ,hardfloat)", config.GOARM)
+		}
+	}
+
+	if config.GOMIPS != "" {
+		if goarch != "mips" && goarch != "mipsle" {
+			return fmt.Errorf("GOMIPS can only be set when building for mips or mipsle, not %s", goarch)
+		}
+
+		if config.GOMIPS != "softfloat" && config.GOMIPS != "hardfloat" {
+			return fmt.Errorf("GOMIPS %q is not valid, use softfloat or hardfloat", config.GOMIPS)
+		}
+	}
+
+	if config.Legacy {
+		if config.SharedLibrary {
+			return fmt.Errorf("--legacy builds are static executables, shared objects need the target's own libc")
+		}
+
+		// go 1.21 and later do not start on Windows 7 or 8
+		if goos == "windows" && getLegacyToolchain() == "" {
+			return fmt.Errorf("--legacy windows clients need a go toolchain that still supports Windows 7, set one with the server's --legacy-toolchain")
+		}
+
+		// Static, so the client does not depend on the target's glibc version
+		config.DisableLibC = true
+	}
+
+	return nil
+}
+
+// crossCompiler is the C compiler to build a shared object for goos/goarch on this host, empty if the default one will do
+func crossCompiler(goos, goarch, goarm string) string {
+	switch goos {
+	case "windows":
+		if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+			return ""
+		}
+
+		switch goarch {
+		case "386":
+			return "i686-w64-mingw32-gcc"
+		case "arm64":
+			// llvm-mingw
+			return "aarch64-w64-mingw32-gcc"
+		default:
+			return "x86_64-w64-mingw32-gcc"
+		}
+	case "linux":
+		if runtime.GOOS == "linux" && runtime.GOARCH == goarch {
+			return ""
+		}
+
+		switch goarch {
+		case "amd64":
+			return "x86_64-linux-gnu-gcc"
+		case "386":
+			return "i686-linux-gnu-gcc"
+		case "arm64":
+			return "aarch64-linux-gnu-gcc"
+		case "arm":
+			// Before armv7 debian's hard float toolchain will not work
+			if strings.HasPrefix(goarm, "5") || strings.HasPrefix(goarm, "6") {
+				return "arm-linux-gnueabi-gcc"
+			}
+			return "arm-linux-gnueabihf-gcc"
+		}
+	}
+
+	return ""
+}
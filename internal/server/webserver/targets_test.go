@@ -0,0 +1,136 @@
+package webserver
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestValidateTargets(t *testing.T) {
+	for _, target := range []string{"linux/amd64", "linux/386", "linux/arm", "linux/arm64", "windows/amd64", "windows/386", "windows/arm64"} {
+		validTargets[target] = true
+	}
+	defer clear(validTargets)
+
+	valid := []BuildConfig{
+		{GOOS: "windows", GOARCH: "arm64"},
+		{GOOS: "linux", GOARCH: "386"},
+		{GOOS: "linux", GOARCH: "arm", GOARM: "5"},
+		{GOOS: "linux", GOARCH: "arm", GOARM: "6"},
+		{GOOS: "linux", GOARCH: "arm", GOARM: "7,softfloat"},
+		{GOOS: "linux", GOARCH: "386", Legacy: true},
+	}
+	for _, config := range valid {
+		if err := config.validateTarget(); err != nil {
+			t.Errorf("%s/%s GOARM=%q legacy=%t: %v", config.GOOS, config.GOARCH, config.GOARM, config.Legacy, err)
+		}
+	}
+
+	invalid := []BuildConfig{
+		{GOOS: "windows", GOARCH: "mips"},
+		{GOOS: "linux", GOARCH: "arm", GOARM: "8"},
+		{GOOS: "linux", GOARCH: "amd64", GOARM: "7"},
+		{GOOS: "windows", GOARCH: "amd64", Legacy: true},
+		{GOOS: "linux", GOARCH: "amd64", Legacy: true, SharedLibrary: true},
+	}
+	for _, config := range invalid {
+		if err := config.validateTarget(); err == nil {
+			t.Errorf("%s/%s GOARM=%q legacy=%t should not be valid", config.GOOS, config.GOARCH, config.GOARM, config.Legacy)
+		}
+	}
+
+	legacy := BuildConfig{GOOS: "linux", GOARCH: "amd64", Legacy: true}
+	if err := legacy.validateTarget(); err != nil || !legacy.DisableLibC {
+		t.Fatalf("legacy builds should be built without libc, err: %v", err)
+	}
+}
+
+func TestCrossCompiler(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("cross compilers are chosen for a linux/amd64 host")
+	}
+
+	for _, tc := range []struct{ goos, goarch, goarm, want string }{
+		{"windows", "amd64", "", "x86_64-w64-mingw32-gcc"},
+		{"windows", "386", "", "i686-w64-mingw32-gcc"},
+		{"windows", "arm64", "", "aarch64-w64-mingw32-gcc"},
+		{"linux", "amd64", "", ""},
+		{"linux", "386", "", "i686-linux-gnu-gcc"},
+		{"linux", "arm", "5", "arm-linux-gnueabi-gcc"},
+		{"linux", "arm", "7", "arm-linux-gnueabihf-gcc"},
+	} {
+		if got := crossCompiler(tc.goos, tc.goarch, tc.goarm); got != tc.want {
+			t.Errorf("crossCompiler(%s, %s, %q) = %q, want %q", tc.goos, tc.goarch, tc.goarm, got, tc.want)
+		}
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+	config := BuildConfig{Preset: "mipsle"}
+	if err := config.applyPreset(); err != nil {
+		t.Fatal(err)
+	}
+	if config.GOOS != "linux" || config.GOARCH != "mipsle" || config.GOMIPS != "softfloat" || !config.DisableLibC {
+		t.Fatalf("mipsle preset gave %+v", config)
+	}
+
+	// musl keeps the architecture it is given
+	config = BuildConfig{Preset: "musl", GOARCH: "arm64"}
+	if err := config.applyPreset(); err != nil || config.GOOS != "linux" || config.GOARCH != "arm64" {
+		t.Fatalf("musl preset gave %+v (%v)", config, err)
+	}
+
+	for _, config := range []BuildConfig{
+		{Preset: "mips", GOARCH: "arm"},
+		{Preset: "arm5", GOARM: "7"},
+		{Preset: "mips", SharedLibrary: true},
+		{Preset: "toaster"},
+	} {
+		if err := config.applyPreset(); err == nil {
+			t.Errorf("preset %q with %+v should not be valid", config.Preset, config)
+		}
+	}
+}
+
+func TestParseSizeBudget(t *testing.T) {
+	for input, want := range map[string]int64{
+		"3M":      3 << 20,
+		"1.5mb":   3 << 19,
+		"900K":    900 << 10,
+		"1048576": 1 << 20,
+	} {
+		if got, err := ParseSizeBudget(input); err != nil || got != want {
+			t.Errorf("ParseSizeBudget(%q) = %d, %v, want %d", input, got, err, want)
+		}
+	}
+
+	for _, input := range []string{"", "-1M", "lots"} {
+		if _, err := ParseSizeBudget(input); err == nil {
+			t.Errorf("ParseSizeBudget(%q) should fail", input)
+		}
+	}
+}
+
+func TestValidateMobile(t *testing.T) {
+	for _, config := range []BuildConfig{
+		{},
+		{MobileLibrary: "aar"},
+		{MobileLibrary: "aar", ConnectBackAdress: "wss://rssh.example.com:443", Modules: []string{"smb"}},
+	} {
+		if err := config.validateMobile(); err != nil {
+			t.Errorf("%+v: %v", config, err)
+		}
+	}
+
+	for _, config := range []BuildConfig{
+		{MobileLibrary: "apk"},
+		{MobileLibrary: "aar", GOOS: "android"},
+		{MobileLibrary: "aar", Preset: "musl"},
+		{MobileLibrary: "aar", SharedLibrary: true},
+		{MobileLibrary: "aar", UPX: true},
+		{MobileLibrary: "aar", ConnectBackAdress: "stdio://"},
+	} {
+		if err := config.validateMobile(); err == nil {
+			t.Errorf("%+v should not be valid", config)
+		}
+	}
+}
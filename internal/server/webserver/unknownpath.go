@@ -0,0 +1,136 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+const (
+	// Tarpitted responses finish just before the server write timeout
+	tarpitDuration = 55 * time.Second
+
+	// Past this many tarpits at once, unknown paths get a plain 404 so a scanner cannot use up the server
+	maxTarpits = 64
+)
+
+// UnknownPathPolicy is what the web server answers for paths that are not download links
+type UnknownPathPolicy struct {
+	// 404, redirect or tarpit
+	Mode string
+
+	// Where redirect sends requests
+	Redirect string
+}
+
+var (
+	unknownPathLock sync.RWMutex
+	unknownPath     = UnknownPathPolicy{Mode: "404"}
+
+	tarpits = make(chan struct{}, maxTarpits)
+)
+
+// ParseUnknownPathPolicy reads 404, tarpit or redirect:<url>
+func ParseUnknownPathPolicy(policy string) (UnknownPathPolicy, error) {
+	mode, target, _ := strings.Cut(strings.TrimSpace(policy), ":")
+
+	switch strings.ToLower(mode) {
+	case "", "404":
+		return UnknownPathPolicy{Mode: "404"}, nil
+	case "tarpit":
+		return UnknownPathPolicy{Mode: "tarpit"}, nil
+	case "redirect":
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return UnknownPathPolicy{}, fmt.Errorf("redirect needs an http(s) url to send requests to, e.g redirect:https://example.com")
+		}
+		return UnknownPathPolicy{Mode: "redirect", Redirect: target}, nil
+	}
+
+	return UnknownPathPolicy{}, fmt.Errorf("unknown path policy %q is not one of 404, tarpit or redirect:<url>", policy)
+}
+
+func SetUnknownPathPolicy(policy UnknownPathPolicy) {
+	unknownPathLock.Lock()
+	defer unknownPathLock.Unlock()
+
+	unknownPath = policy
+}
+
+func serveUnknownPath(w http.ResponseWriter, req *http.Request, log logger.Logger) {
+	mode := answerUnknownPath(w, req)
+	log.Info("unknown path %q (%s), answered with %s", req.URL.Path, req.UserAgent(), mode)
+}
+
+// answerUnknownPath responds as the unknown path policy says, and returns how it answered
+func answerUnknownPath(w http.ResponseWriter, req *http.Request) string {
+	unknownPathLock.RLock()
+	policy := unknownPath
+	unknownPathLock.RUnlock()
+
+	switch policy.Mode {
+	case "redirect":
+		w.Header().Set("server", "nginx")
+		http.Redirect(w, req, policy.Redirect, http.StatusFound)
+		return policy.Mode
+
+	case "tarpit":
+		select {
+		case tarpits <- struct{}{}:
+			defer func() { <-tarpits }()
+
+			tarpit(w, req)
+			return policy.Mode
+		default:
+			// Too many tarpits already, fall back to a plain 404
+		}
+	}
+
+	writeNotFound(w)
+	return "404"
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	w.Header().Set("content-type", "text/html")
+	w.Header().Set("server", "nginx")
+	w.Header().Set("Connection", "keep-alive")
+
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(notFound))
+}
+
+// tarpit sends the usual 404 a byte at a time, spread over tarpitDuration
+func tarpit(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("content-type", "text/html")
+	w.Header().Set("server", "nginx")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusNotFound)
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	ticker := time.NewTicker(tarpitDuration / time.Duration(len(notFound)))
+	defer ticker.Stop()
+
+	for i := 0; i < len(notFound); i++ {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := w.Write([]byte{notFound[i]}); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
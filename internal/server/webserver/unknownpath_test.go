@@ -0,0 +1,48 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+func TestUnknownPathPolicy(t *testing.T) {
+	for _, bad := range []string{"teapot", "redirect:", "redirect:/local", "redirect:ftp://example.com"} {
+		if _, err := ParseUnknownPathPolicy(bad); err == nil {
+			t.Errorf("%q should not parse", bad)
+		}
+	}
+
+	policy, err := ParseUnknownPathPolicy("redirect:https://example.com/decoy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetUnknownPathPolicy(policy)
+	defer SetUnknownPathPolicy(UnknownPathPolicy{Mode: "404"})
+
+	w := httptest.NewRecorder()
+	serveUnknownPath(w, httptest.NewRequest("GET", "/wp-admin", nil), logger.NewLog("test"))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/decoy" {
+		t.Fatalf("expected a redirect to the decoy, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// With every tarpit in use, requests get an immediate 404 instead of waiting
+	SetUnknownPathPolicy(UnknownPathPolicy{Mode: "tarpit"})
+	for i := 0; i < maxTarpits; i++ {
+		tarpits <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < maxTarpits; i++ {
+			<-tarpits
+		}
+	}()
+
+	w = httptest.NewRecorder()
+	serveUnknownPath(w, httptest.NewRequest("GET", "/wp-admin", nil), logger.NewLog("test"))
+	if w.Code != http.StatusNotFound || w.Body.String() != notFound {
+		t.Fatalf("expected a plain 404, got %d", w.Code)
+	}
+}
@@ -1,18 +1,22 @@
 package webserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
 	"github.com/NHAS/reverse_ssh/internal/server/webserver/shellscripts"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
@@ -25,9 +29,20 @@ var (
 	webserverOn        bool
 )
 
-func Start(webListener net.Listener, connectBackAddress string, autogeneratedConnectBack bool, projRoot, dataDir string, publicKey ssh.PublicKey) {
+const shutdownTimeout = 5 * time.Second
+
+// bracketIPv6 brackets a bare IPv6 address, so it can be used in download urls and have a port added
+func bracketIPv6(address string) string {
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		return "[" + address + "]"
+	}
+	return address
+}
+
+// Start serves client downloads until ctx is done, requests in progress are given a few seconds to finish and then cancelled
+func Start(ctx context.Context, webListener net.Listener, connectBackAddress string, autogeneratedConnectBack bool, projRoot, dataDir string, publicKey ssh.PublicKey) {
 	projectRoot = projRoot
-	DefaultConnectBack = connectBackAddress
+	DefaultConnectBack = bracketIPv6(connectBackAddress)
 	defaultFingerPrint = internal.FingerprintSHA256Hex(publicKey)
 
 	err := startBuildManager(filepath.Join(dataDir, "cache"))
@@ -39,13 +54,30 @@ func Start(webListener net.Listener, connectBackAddress string, autogeneratedCon
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		Handler:      buildAndServe(autogeneratedConnectBack),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
 	}
 
+	context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("web server did not shut down cleanly: %s", err)
+		}
+	})
+
 	log.Println("Started Web Server")
 	webserverOn = true
 
-	log.Fatal(srv.Serve(webListener))
+	go watchForRebuilds(ctx)
 
+	if err := srv.Serve(webListener); err != nil && !errors.Is(err, http.ErrServerClosed) && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+
+	webserverOn = false
 }
 
 const notFound = `<html>
@@ -59,6 +91,12 @@ const notFound = `<html>
 func buildAndServe(autogeneratedConnectBack bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 
+		// Refusals are summarised by the filter, not logged per request
+		if !AllowDownload(req.RemoteAddr, req.Header) {
+			answerUnknownPath(w, req)
+			return
+		}
+
 		httpDownloadLog := logger.NewLog(fmt.Sprintf("%s:%q", req.RemoteAddr, req.Host))
 
 		httpDownloadLog.Info("Web Server got hit:  %q", req.URL.Path)
@@ -74,12 +112,7 @@ func buildAndServe(autogeneratedConnectBack bool) http.HandlerFunc {
 			if err != nil {
 				log.Println("could not get: ", filenameWithoutExtension, " err: ", err)
 
-				w.Header().Set("content-type", "text/html")
-				w.Header().Set("server", "nginx")
-				w.Header().Set("Connection", "keep-alive")
-
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(notFound))
+				serveUnknownPath(w, req, httpDownloadLog)
 				return
 			}
 
@@ -92,10 +125,10 @@ func buildAndServe(autogeneratedConnectBack bool) http.HandlerFunc {
 
 				host, port, err := net.SplitHostPort(host)
 				if err != nil {
-					host = DefaultConnectBack
+					host = strings.Trim(DefaultConnectBack, "[]")
 					port = "80"
 
-					httpDownloadLog.Info("no port specified in external_address: %s defaulting to: %s", DefaultConnectBack, DefaultConnectBack+":80")
+					httpDownloadLog.Info("no port specified in external_address: %s defaulting to: %s", DefaultConnectBack, net.JoinHostPort(host, port))
 				}
 
 				output, err := shellscripts.MakeTemplate(shellscripts.Args{
@@ -108,25 +141,27 @@ func buildAndServe(autogeneratedConnectBack bool) http.HandlerFunc {
 					WorkingDirectory: f.WorkingDirectory,
 				}, linkExtension[1:])
 				if err != nil {
-
-					w.Header().Set("content-type", "text/html")
-					w.Header().Set("server", "nginx")
-					w.Header().Set("Connection", "keep-alive")
-
-					w.WriteHeader(http.StatusNotFound)
-					w.Write([]byte(notFound))
+					serveUnknownPath(w, req, httpDownloadLog)
 					return
 				}
 
-				w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+				w.Header().Set("Content-Disposition", attachment(filename))
 				w.Header().Set("Content-Type", "application/octet-stream")
 
 				w.Write(output)
+
+				notifyDownload(req, f, linkExtension[1:], "")
 				return
 			}
 		}
 
-		file, err := os.Open(f.FilePath)
+		encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+		file, err := data.OpenDownload(f, encoding)
+		if err != nil && encoding != "" {
+			httpDownloadLog.Warning("failed to compress download with %s, sending it uncompressed: %s", encoding, err)
+			encoding = ""
+			file, err = data.OpenDownload(f, "")
+		}
 		if err != nil {
 			httpDownloadLog.Error("failed to open file for http download: %s", err)
 			http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
@@ -134,6 +169,11 @@ func buildAndServe(autogeneratedConnectBack bool) http.HandlerFunc {
 		}
 		defer file.Close()
 
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("Vary", "Accept-Encoding")
+
 		var extension string
 
 		switch f.FileType {
@@ -147,13 +187,71 @@ func buildAndServe(autogeneratedConnectBack bool) http.HandlerFunc {
 			if f.Goos == "windows" {
 				extension = ".exe"
 			}
+		case "aar", "xcframework":
+			extension = mobileLibraries[f.FileType].extension
 		default:
 
 		}
 
-		w.Header().Set("Content-Disposition", "attachment; filename="+strings.TrimSuffix(filename, extension)+extension)
+		w.Header().Set("Content-Disposition", attachment(strings.TrimSuffix(filename, extension)+extension))
 		w.Header().Set("Content-Type", "application/octet-stream")
 
-		io.Copy(w, file)
+		if _, err := io.Copy(w, file); err != nil {
+			httpDownloadLog.Warning("download of %q did not finish: %s", filename, err)
+			return
+		}
+
+		notifyDownload(req, f, "http", encoding)
+	}
+}
+
+// attachment is the Content-Disposition of a download, names outside of ascii are sent as RFC 5987 utf-8
+func attachment(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+func notifyDownload(req *http.Request, f data.Download, method, encoding string) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	observers.Downloads.Notify(observers.Download{
+		Status:      "downloaded",
+		Link:        f.UrlPath,
+		Fingerprint: f.Fingerprint,
+		Method:      method,
+		Encoding:    encoding,
+		IP:          ip,
+		UserAgent:   req.UserAgent(),
+		Timestamp:   time.Now(),
+	})
+}
+
+// negotiateEncoding picks the download encoding to use from an Accept-Encoding header, or "" to send it as is
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.TrimSpace(name) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		accepted[coding] = q > 0
 	}
+
+	for _, encoding := range data.DownloadEncodings {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+
+	return ""
 }
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"crypto/fips140"
+	"crypto/rsa"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// StrictCrypto limits ssh to algorithms approved under FIPS 140-3, and turns off transports using anything else (the ts relay)
+var StrictCrypto bool
+
+var (
+	strictCiphers = []string{
+		ssh.CipherAES256GCM,
+		ssh.CipherAES128GCM,
+		ssh.CipherAES256CTR,
+		ssh.CipherAES192CTR,
+		ssh.CipherAES128CTR,
+	}
+
+	strictKeyExchanges = []string{
+		ssh.KeyExchangeECDHP384,
+		ssh.KeyExchangeECDHP256,
+		ssh.KeyExchangeECDHP521,
+		ssh.KeyExchangeDH16SHA512,
+		ssh.KeyExchangeDH14SHA256,
+	}
+
+	strictMACs = []string{
+		ssh.HMACSHA256ETM,
+		ssh.HMACSHA512ETM,
+		ssh.HMACSHA256,
+		ssh.HMACSHA512,
+	}
+
+	// Ed25519 is approved by FIPS 186-5, which is lucky as every key rssh generates is one
+	strictKeyAlgorithms = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoRSASHA256,
+	}
+
+	// Certificates of the approved key types, for logging in with a certificate from a certificate authority
+	strictCertAlgorithms = []string{
+		ssh.CertAlgoED25519v01,
+		ssh.CertAlgoECDSA256v01,
+		ssh.CertAlgoECDSA384v01,
+		ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSASHA512v01,
+		ssh.CertAlgoRSASHA256v01,
+	}
+)
+
+// RestrictAlgorithms sets the ciphers, key exchanges and MACs of an ssh config to the strict crypto set
+func RestrictAlgorithms(c *ssh.Config) {
+	c.Ciphers = append([]string{}, strictCiphers...)
+	c.KeyExchanges = append([]string{}, strictKeyExchanges...)
+	c.MACs = append([]string{}, strictMACs...)
+}
+
+// StrictKeyAlgorithms are the signature algorithms allowed for host and user keys in strict crypto mode
+func StrictKeyAlgorithms() []string {
+	return append([]string{}, strictKeyAlgorithms...)
+}
+
+// StrictCertAlgorithms are the certificate algorithms allowed for user keys in strict crypto mode
+func StrictCertAlgorithms() []string {
+	return append([]string{}, strictCertAlgorithms...)
+}
+
+// CheckStrictKey returns an error if the key cannot be used in strict crypto mode, for certificates the certified key is checked
+func CheckStrictKey(key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	switch key.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return nil
+	case ssh.KeyAlgoRSA:
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return fmt.Errorf("unable to read rsa key size")
+		}
+
+		rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok || rsaKey.Size()*8 < 2048 {
+			return fmt.Errorf("rsa keys must be at least 2048 bits")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%s keys are not allowed", key.Type())
+}
+
+// FIPSModuleEnabled reports whether the go cryptography module is running in FIPS 140-3 mode (GODEBUG=fips140=on, or built with GOFIPS140)
+func FIPSModuleEnabled() bool {
+	return fips140.Enabled()
+}
@@ -0,0 +1,42 @@
+package terminal
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/audit"
+	"github.com/NHAS/reverse_ssh/internal/server/contentfilter"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+)
+
+// RecordCommand writes a command started at started that has finished to the console log, with the operator's key, the clients it named and
+// whether it worked
+func RecordCommand(user *users.User, session *users.Connection, source string, line ParsedLine, started time.Time, err error) {
+	entry := audit.ConsoleEntry{
+		Time:    started,
+		Source:  source,
+		Command: contentfilter.RedactString(line.RawLine, "console.log"),
+		Status:  "ok",
+	}
+
+	if user != nil {
+		entry.User = user.Username()
+		entry.Targets = user.Targets(line.ArgumentsAsStrings())
+	}
+
+	if session != nil {
+		entry.Fingerprint = session.Fingerprint()
+		entry.Connection = session.ConnectionDetails
+	}
+
+	// exit ends the console with io.EOF, which is not a failure
+	if err != nil && err != io.EOF {
+		entry.Status = "error"
+		entry.Error = err.Error()
+	}
+
+	if err := audit.RecordCommand(entry); err != nil {
+		log.Println("unable to write to console log:", err)
+	}
+}
@@ -0,0 +1,38 @@
+package terminal
+
+import "testing"
+
+func FuzzParseLine(f *testing.F) {
+	f.Add("toaster --long_arg test -t a", 0)
+	f.Add("link --name 'a b' -s \"host:22\" --", 7)
+	f.Add("exec -c * -- ls \\", 100)
+	f.Add("-aft 'unterminated", -1)
+	f.Add("", 0)
+
+	f.Fuzz(func(t *testing.T, line string, cursor int) {
+		pl := ParseLine(line, cursor)
+
+		if pl.RawLine != line {
+			t.Fatalf("raw line changed: %q -> %q", line, pl.RawLine)
+		}
+
+		// Autocomplete slices the line with these
+		nodes := []Node{}
+		if pl.Command != nil {
+			nodes = append(nodes, pl.Command)
+		}
+		for i := range pl.Arguments {
+			nodes = append(nodes, &pl.Arguments[i])
+		}
+		for i := range pl.FlagsOrdered {
+			nodes = append(nodes, &pl.FlagsOrdered[i])
+			pl.GetArgsString(pl.FlagsOrdered[i].Value())
+		}
+
+		for _, n := range nodes {
+			if n.Start() < 0 || n.Start() > n.End() || n.End() > len(line) {
+				t.Fatalf("%s %q has bounds %d:%d outside of %q", n.Type(), n.Value(), n.Start(), n.End(), line)
+			}
+		}
+	})
+}
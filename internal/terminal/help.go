@@ -0,0 +1,118 @@
+package terminal
+
+import (
+	"sort"
+	"strings"
+)
+
+// Example is a worked example of using a command, shown in its help
+type Example struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// Exampler is optionally implemented by commands that have worked examples
+type Exampler interface {
+	Examples() []Example
+}
+
+type FlagHelp struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// HelpEntry is the structured help for a single command, generated from the commands own metadata so the console and anything else (e.g the web ui) show the same thing
+type HelpEntry struct {
+	Name        string     `json:"name"`
+	Module      string     `json:"module"`
+	Description string     `json:"description"`
+	Synopsis    []string   `json:"synopsis"`
+	Details     []string   `json:"details"`
+	Flags       []FlagHelp `json:"flags"`
+	Examples    []Example  `json:"examples"`
+}
+
+func NewHelpEntry(name, module string, c Command) HelpEntry {
+	h := HelpEntry{
+		Name:        name,
+		Module:      module,
+		Description: c.Help(true),
+	}
+
+	// Usage text is the lines given to MakeHelpText followed by the flags, which are tab indented. Leading lines that start with the command name are the synopsis
+	for _, line := range strings.Split(c.Help(false), "\n") {
+		if strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" || line == h.Description {
+			continue
+		}
+
+		if len(h.Details) == 0 && (line == name || strings.HasPrefix(line, name+" ")) {
+			h.Synopsis = append(h.Synopsis, line)
+			continue
+		}
+
+		h.Details = append(h.Details, line)
+	}
+
+	for flag, description := range c.ValidArgs() {
+		prefix := "--"
+		if len(flag) == 1 {
+			prefix = "-"
+		}
+
+		h.Flags = append(h.Flags, FlagHelp{Name: prefix + flag, Description: description})
+	}
+
+	sort.Slice(h.Flags, func(i, j int) bool {
+		return strings.TrimLeft(h.Flags[i].Name, "-") < strings.TrimLeft(h.Flags[j].Name, "-")
+	})
+
+	if e, ok := c.(Exampler); ok {
+		h.Examples = e.Examples()
+	}
+
+	return h
+}
+
+// Matches returns how relevant the entry is to the search term, 0 means it doesnt match at all
+func (h HelpEntry) Matches(term string) int {
+	term = strings.ToLower(strings.TrimSpace(term))
+	if term == "" {
+		return 0
+	}
+
+	contains := func(s string) bool {
+		return strings.Contains(strings.ToLower(s), term)
+	}
+
+	switch {
+	case contains(h.Name):
+		return 4
+	case contains(h.Description) || contains(h.Module):
+		return 3
+	}
+
+	for _, s := range append(h.Synopsis, h.Details...) {
+		if contains(s) {
+			return 2
+		}
+	}
+
+	for _, f := range h.Flags {
+		if contains(f.Name) || contains(f.Description) {
+			return 1
+		}
+	}
+
+	for _, e := range h.Examples {
+		if contains(e.Command) || contains(e.Description) {
+			return 1
+		}
+	}
+
+	return 0
+}
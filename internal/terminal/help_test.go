@@ -0,0 +1,65 @@
+package terminal
+
+import (
+	"io"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+)
+
+type helpTestCommand struct{}
+
+func (h *helpTestCommand) Expect(line ParsedLine) []string { return nil }
+
+func (h *helpTestCommand) Run(user *users.User, output io.ReadWriter, line ParsedLine) error {
+	return nil
+}
+
+func (h *helpTestCommand) Help(explain bool) string {
+	if explain {
+		return "Forward a port"
+	}
+
+	return MakeHelpText(h.ValidArgs(),
+		"fwd <remote_id>",
+		"fwd -l",
+		"Forward a port",
+		"Ports are closed when the client disconnects",
+	)
+}
+
+func (h *helpTestCommand) ValidArgs() map[string]string {
+	return map[string]string{"l": "List forwards", "port": "Port to open"}
+}
+
+func (h *helpTestCommand) Examples() []Example {
+	return []Example{{Command: "fwd --port 80 web", Description: "Open 80 on web"}}
+}
+
+func TestHelpEntry(t *testing.T) {
+	e := NewHelpEntry("fwd", "forwarding", &helpTestCommand{})
+
+	if len(e.Synopsis) != 2 || e.Synopsis[0] != "fwd <remote_id>" || e.Synopsis[1] != "fwd -l" {
+		t.Fatalf("unexpected synopsis: %q", e.Synopsis)
+	}
+
+	if len(e.Details) != 1 || e.Details[0] != "Ports are closed when the client disconnects" {
+		t.Fatalf("unexpected details: %q", e.Details)
+	}
+
+	if len(e.Flags) != 2 || e.Flags[0].Name != "-l" || e.Flags[1].Name != "--port" {
+		t.Fatalf("unexpected flags: %+v", e.Flags)
+	}
+
+	if len(e.Examples) != 1 {
+		t.Fatalf("examples were not collected: %+v", e.Examples)
+	}
+
+	if e.Matches("FWD") <= e.Matches("closed") || e.Matches("closed") <= e.Matches("port 80") || e.Matches("port 80") == 0 {
+		t.Fatal("name matches should rank above details, which rank above examples")
+	}
+
+	if e.Matches("nothing like this") != 0 {
+		t.Fatal("unrelated search term matched")
+	}
+}
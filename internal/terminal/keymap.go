@@ -0,0 +1,383 @@
+package terminal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Editing modes for the line editor
+const (
+	EmacsMode = "emacs"
+	ViMode    = "vi"
+)
+
+// Keymaps that bindings can be changed in, vi has separate maps for insert and command mode
+const (
+	EmacsKeymap     = "emacs"
+	ViInsertKeymap  = "vi-insert"
+	ViCommandKeymap = "vi-command"
+)
+
+// Line editing actions, named after their readline equivalents where there is one
+const (
+	actionBeginningOfLine    = "beginning-of-line"
+	actionEndOfLine          = "end-of-line"
+	actionBackwardChar       = "backward-char"
+	actionForwardChar        = "forward-char"
+	actionBackwardWord       = "backward-word"
+	actionForwardWord        = "forward-word"
+	actionEndOfWord          = "end-of-word"
+	actionDeleteChar         = "delete-char"
+	actionBackwardDeleteChar = "backward-delete-char"
+	actionKillLine           = "kill-line"
+	actionKillWholeLine      = "kill-whole-line"
+	actionUnixLineDiscard    = "unix-line-discard"
+	actionBackwardKillWord   = "backward-kill-word"
+	actionKillWord           = "kill-word"
+	actionYank               = "yank"
+	actionTransposeChars     = "transpose-chars"
+	actionPreviousHistory    = "previous-history"
+	actionNextHistory        = "next-history"
+	actionClearScreen        = "clear-screen"
+	actionAcceptLine         = "accept-line"
+	actionInterrupt          = "interrupt"
+	actionSelfInsert         = "self-insert"
+
+	actionViCommandMode     = "vi-command-mode"
+	actionViInsert          = "vi-insert"
+	actionViInsertBeginning = "vi-insert-beginning"
+	actionViAppend          = "vi-append"
+	actionViAppendEnd       = "vi-append-end"
+	actionViDelete          = "vi-delete"
+	actionViChange          = "vi-change"
+	actionViChangeToEnd     = "vi-change-to-end"
+)
+
+var actionDescriptions = map[string]string{
+	actionBeginningOfLine:    "Move to the start of the line",
+	actionEndOfLine:          "Move to the end of the line",
+	actionBackwardChar:       "Move back one character",
+	actionForwardChar:        "Move forward one character",
+	actionBackwardWord:       "Move to the start of the previous word",
+	actionForwardWord:        "Move to the start of the next word",
+	actionEndOfWord:          "Move to the end of the current word",
+	actionDeleteChar:         "Delete the character under the cursor",
+	actionBackwardDeleteChar: "Delete the character before the cursor",
+	actionKillLine:           "Cut from the cursor to the end of the line",
+	actionKillWholeLine:      "Cut the whole line",
+	actionUnixLineDiscard:    "Cut from the start of the line to the cursor",
+	actionBackwardKillWord:   "Cut the word before the cursor",
+	actionKillWord:           "Cut from the cursor to the end of the word",
+	actionYank:               "Paste the last cut text",
+	actionTransposeChars:     "Swap the character before the cursor with the one under it",
+	actionPreviousHistory:    "Previous command in history",
+	actionNextHistory:        "Next command in history",
+	actionClearScreen:        "Clear the screen",
+	actionAcceptLine:         "Run the current line",
+	actionInterrupt:          "Abandon the current line",
+	actionSelfInsert:         "Insert the key as typed",
+	actionViCommandMode:      "Switch to vi command mode",
+	actionViInsert:           "Switch to vi insert mode",
+	actionViInsertBeginning:  "Switch to vi insert mode at the start of the line",
+	actionViAppend:           "Switch to vi insert mode after the cursor",
+	actionViAppendEnd:        "Switch to vi insert mode at the end of the line",
+	actionViDelete:           "Delete up to the next motion (dd deletes the line)",
+	actionViChange:           "Delete up to the next motion and switch to insert mode (cc changes the line)",
+	actionViChangeToEnd:      "Delete to the end of the line and switch to insert mode",
+}
+
+// Alt (meta) combinations are the key with this bit set, it is above the largest valid rune so cant collide with typed characters
+const keyAlt rune = 1 << 22
+
+type keyMap map[rune]string
+
+func (k keyMap) clone() keyMap {
+	c := keyMap{}
+	for key, action := range k {
+		c[key] = action
+	}
+	return c
+}
+
+// Bindings both modes share
+var commonKeys = keyMap{
+	keyEnter:        actionAcceptLine,
+	keyCtrlC:        actionInterrupt,
+	keyBackspace:    actionBackwardDeleteChar,
+	'h' & 0x1f:      actionBackwardDeleteChar,
+	keyDel:          actionDeleteChar,
+	keyLeft:         actionBackwardChar,
+	keyRight:        actionForwardChar,
+	keyUp:           actionPreviousHistory,
+	keyDown:         actionNextHistory,
+	keyHome:         actionBeginningOfLine,
+	keyEnd:          actionEndOfLine,
+	keyAltLeft:      actionBackwardWord,
+	keyAltRight:     actionForwardWord,
+	keyCtrlLeft:     actionBackwardWord,
+	keyCtrlRight:    actionForwardWord,
+	'l' & 0x1f:      actionClearScreen,
+	'w' & 0x1f:      actionBackwardKillWord,
+	keyCtrlU:        actionUnixLineDiscard,
+	keyCtrlD:        actionDeleteChar,
+	'n' & 0x1f:      actionNextHistory,
+	'p' & 0x1f:      actionPreviousHistory,
+	'y' & 0x1f:      actionYank,
+	keyAlt | keyDel: actionKillWord,
+}
+
+func defaultEmacsKeys() keyMap {
+	k := commonKeys.clone()
+
+	k['a'&0x1f] = actionBeginningOfLine
+	k['e'&0x1f] = actionEndOfLine
+	k['b'&0x1f] = actionBackwardChar
+	k['f'&0x1f] = actionForwardChar
+	k['k'&0x1f] = actionKillLine
+	k['t'&0x1f] = actionTransposeChars
+	k[keyAlt|'b'] = actionBackwardWord
+	k[keyAlt|'f'] = actionForwardWord
+	k[keyAlt|'d'] = actionKillWord
+	k[keyAlt|keyBackspace] = actionBackwardKillWord
+
+	return k
+}
+
+func defaultViInsertKeys() keyMap {
+	k := commonKeys.clone()
+
+	k[keyEscape] = actionViCommandMode
+
+	return k
+}
+
+func defaultViCommandKeys() keyMap {
+	k := commonKeys.clone()
+
+	// Backspace and friends only move in command mode
+	k[keyBackspace] = actionBackwardChar
+	k['h'&0x1f] = actionBackwardChar
+
+	for key, action := range map[rune]string{
+		'h': actionBackwardChar,
+		'l': actionForwardChar,
+		' ': actionForwardChar,
+		'0': actionBeginningOfLine,
+		'^': actionBeginningOfLine,
+		'$': actionEndOfLine,
+		'w': actionForwardWord,
+		'b': actionBackwardWord,
+		'e': actionEndOfWord,
+		'x': actionDeleteChar,
+		'X': actionBackwardDeleteChar,
+		'D': actionKillLine,
+		'C': actionViChangeToEnd,
+		'S': actionKillWholeLine,
+		'p': actionYank,
+		'j': actionNextHistory,
+		'k': actionPreviousHistory,
+		'i': actionViInsert,
+		'I': actionViInsertBeginning,
+		'a': actionViAppend,
+		'A': actionViAppendEnd,
+		'd': actionViDelete,
+		'c': actionViChange,
+	} {
+		k[key] = action
+	}
+
+	return k
+}
+
+type keyBindings struct {
+	mode string
+
+	maps map[string]keyMap
+}
+
+func defaultKeyBindings() keyBindings {
+	return keyBindings{
+		mode: EmacsMode,
+		maps: map[string]keyMap{
+			EmacsKeymap:     defaultEmacsKeys(),
+			ViInsertKeymap:  defaultViInsertKeys(),
+			ViCommandKeymap: defaultViCommandKeys(),
+		},
+	}
+}
+
+var namedKeys = map[string]rune{
+	"enter":      keyEnter,
+	"tab":        '\t',
+	"escape":     keyEscape,
+	"backspace":  keyBackspace,
+	"delete":     keyDel,
+	"up":         keyUp,
+	"down":       keyDown,
+	"left":       keyLeft,
+	"right":      keyRight,
+	"home":       keyHome,
+	"end":        keyEnd,
+	"space":      ' ',
+	"alt-left":   keyAltLeft,
+	"alt-right":  keyAltRight,
+	"ctrl-left":  keyCtrlLeft,
+	"ctrl-right": keyCtrlRight,
+}
+
+// ParseKey turns a key description such as ctrl-a, alt-b, up, or a single (possibly non ascii) character into the key the line editor sees
+func ParseKey(name string) (rune, error) {
+	if k, ok := namedKeys[strings.ToLower(name)]; ok {
+		return k, nil
+	}
+
+	if len(name) > len("alt-") && strings.EqualFold(name[:len("alt-")], "alt-") {
+		k, err := ParseKey(name[len("alt-"):])
+		if err != nil || k&keyAlt != 0 {
+			return 0, fmt.Errorf("unknown key %q", name)
+		}
+		return keyAlt | k, nil
+	}
+
+	if len(name) == len("ctrl-a") && strings.EqualFold(name[:len("ctrl-")], "ctrl-") {
+		c := name[len("ctrl-")] | 0x20
+		if c >= 'a' && c <= 'z' {
+			return rune(c & 0x1f), nil
+		}
+	}
+
+	r, size := utf8.DecodeRuneInString(name)
+	if r != utf8.RuneError && size == len(name) && isPrintable(r) {
+		return r, nil
+	}
+
+	return 0, fmt.Errorf("unknown key %q, expected something like ctrl-a, alt-b, up, or a single character", name)
+}
+
+// KeyName is the inverse of ParseKey
+func KeyName(key rune) string {
+	for name, k := range namedKeys {
+		if k == key {
+			return name
+		}
+	}
+
+	if key&keyAlt != 0 {
+		return "alt-" + KeyName(key&^keyAlt)
+	}
+
+	if key >= 1 && key <= 26 {
+		return "ctrl-" + string(rune('a'+key-1))
+	}
+
+	return string(key)
+}
+
+// Actions returns every action keys can be bound to, with a description of each
+func Actions() map[string]string {
+	r := map[string]string{}
+	for action, description := range actionDescriptions {
+		r[action] = description
+	}
+	return r
+}
+
+// SetEditMode switches between emacs and vi editing
+func (t *Terminal) SetEditMode(mode string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	switch mode {
+	case EmacsMode, ViMode:
+	default:
+		return fmt.Errorf("unknown editing mode %q, must be %s or %s", mode, EmacsMode, ViMode)
+	}
+
+	t.bindings.mode = mode
+	t.viCommand = false
+	t.viPending = ""
+
+	return nil
+}
+
+func (t *Terminal) EditMode() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.bindings.mode
+}
+
+// Bind sets the action for a key in a keymap, binding to an empty action removes the binding
+func (t *Terminal) Bind(keymap, key, action string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	m, ok := t.bindings.maps[keymap]
+	if !ok {
+		return fmt.Errorf("unknown keymap %q, must be one of %s, %s or %s", keymap, EmacsKeymap, ViInsertKeymap, ViCommandKeymap)
+	}
+
+	k, err := ParseKey(key)
+	if err != nil {
+		return err
+	}
+
+	if action == "" {
+		delete(m, k)
+		return nil
+	}
+
+	if _, ok := actionDescriptions[action]; !ok {
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	m[k] = action
+
+	return nil
+}
+
+// Bindings lists key name to action for a keymap, sorted by key name
+func (t *Terminal) Bindings(keymap string) ([][2]string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	m, ok := t.bindings.maps[keymap]
+	if !ok {
+		return nil, fmt.Errorf("unknown keymap %q", keymap)
+	}
+
+	var out [][2]string
+	for k, action := range m {
+		out = append(out, [2]string{KeyName(k), action})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i][0] < out[j][0]
+	})
+
+	return out, nil
+}
+
+// ResetBindings puts every keymap back to the defaults, the editing mode is kept
+func (t *Terminal) ResetBindings() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	mode := t.bindings.mode
+	t.bindings = defaultKeyBindings()
+	t.bindings.mode = mode
+}
+
+// currentKeymap must be called with t.lock held
+func (t *Terminal) currentKeymap() keyMap {
+	if t.bindings.mode == ViMode {
+		if t.viCommand {
+			return t.bindings.maps[ViCommandKeymap]
+		}
+		return t.bindings.maps[ViInsertKeymap]
+	}
+
+	return t.bindings.maps[EmacsKeymap]
+}
@@ -14,9 +14,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
 	"github.com/NHAS/reverse_ssh/pkg/trie"
@@ -126,6 +129,16 @@ type Terminal struct {
 	raw bool
 
 	rawOverflow chan []byte
+
+	bindings keyBindings
+	// metaPending is set after a lone escape in emacs mode, the next key is treated as alt+key
+	metaPending bool
+	// viCommand is true when in vi command mode, viPending holds a delete or change waiting for its motion
+	viCommand bool
+	viPending string
+
+	// killed is the last text cut from the line, for yank
+	killed []rune
 }
 
 func (t *Terminal) EnableRaw() {
@@ -166,6 +179,7 @@ func NewTerminal(c io.ReadWriter, prompt string) *Terminal {
 		termHeight:   24,
 		echo:         true,
 		historyIndex: -1,
+		bindings:     defaultKeyBindings(),
 	}
 }
 
@@ -185,6 +199,7 @@ func NewAdvancedTerminal(c io.ReadWriter, user *users.User, session *users.Conne
 		functionsAutoComplete: trie.NewTrie(),
 		functions:             make(map[string]Command),
 		autoCompleteValues:    make(map[string][]*trie.Trie),
+		bindings:              defaultKeyBindings(),
 	}
 
 	t.AddValueAutoComplete(autocomplete.Functions, t.functionsAutoComplete)
@@ -367,12 +382,11 @@ const (
 	keyRight
 	keyAltLeft
 	keyAltRight
+	keyCtrlLeft
+	keyCtrlRight
 	keyHome
 	keyDel
 	keyEnd
-	keyDeleteWord
-	keyDeleteLine
-	keyClearScreen
 	keyPasteStart
 	keyPasteEnd
 )
@@ -385,45 +399,46 @@ var (
 
 // bytesToKey tries to parse a key sequence from b. If successful, it returns
 // the key and the remainder of the input. Otherwise it returns utf8.RuneError.
+// Control characters are returned as is, what they do is up to the keymap
 func bytesToKey(b []byte, pasteActive bool) (rune, []byte) {
 	if len(b) == 0 {
 		return utf8.RuneError, nil
 	}
 
-	if !pasteActive {
-		switch b[0] {
-		case 1: // ^A
-			return keyHome, b[1:]
-		case 2: // ^B
-			return keyLeft, b[1:]
-		case 5: // ^E
-			return keyEnd, b[1:]
-		case 6: // ^F
-			return keyRight, b[1:]
-		case 8: // ^H
-			return keyBackspace, b[1:]
-		case 11: // ^K
-			return keyDeleteLine, b[1:]
-		case 12: // ^L
-			return keyClearScreen, b[1:]
-		case 23: // ^W
-			return keyDeleteWord, b[1:]
-		case 14: // ^N
-			return keyDown, b[1:]
-		case 16: // ^P
-			return keyUp, b[1:]
-		}
-	}
-
 	if b[0] != keyEscape {
 		if !utf8.FullRune(b) {
 			return utf8.RuneError, b
 		}
 		r, l := utf8.DecodeRune(b)
+		if r == utf8.RuneError {
+			// Not utf8, most likely a terminal set to a legacy encoding. Skip it rather than stalling the input on it
+			return keyUnknown, b[l:]
+		}
 		return r, b[l:]
 	}
 
-	if !pasteActive && len(b) >= 3 && b[0] == keyEscape && b[1] == '[' {
+	if pasteActive {
+		if len(b) >= 6 && bytes.Equal(b[:6], pasteEnd) {
+			return keyPasteEnd, b[6:]
+		}
+
+		return skipSequence(b)
+	}
+
+	if len(b) == 1 {
+		// Sequences arrive in a single read, so an escape on its own is the escape key
+		return keyEscape, nil
+	}
+
+	switch b[1] {
+	case '[':
+		return csiToKey(b)
+	case 'O':
+		// Application cursor mode, some terminals send these for the arrow keys
+		if len(b) < 3 {
+			return utf8.RuneError, b
+		}
+
 		switch b[2] {
 		case 'A':
 			return keyUp, b[3:]
@@ -437,32 +452,108 @@ func bytesToKey(b []byte, pasteActive bool) (rune, []byte) {
 			return keyHome, b[3:]
 		case 'F':
 			return keyEnd, b[3:]
-		case 51:
-			return keyDel, b[4:]
 		}
+
+		return keyUnknown, b[3:]
+	case keyEscape:
+		return keyEscape, b[1:]
 	}
 
-	if !pasteActive && len(b) >= 6 && b[0] == keyEscape && b[1] == '[' && b[2] == '1' && b[3] == ';' && b[4] == '3' {
-		switch b[5] {
-		case 'C':
-			return keyAltRight, b[6:]
-		case 'D':
-			return keyAltLeft, b[6:]
+	// Escape followed by a key is how most terminals send alt (meta) combinations, including non ascii characters
+	if !utf8.FullRune(b[1:]) {
+		return utf8.RuneError, b
+	}
+
+	r, l := utf8.DecodeRune(b[1:])
+	if r == utf8.RuneError {
+		return keyUnknown, b[1+l:]
+	}
+
+	return keyAlt | r, b[1+l:]
+}
+
+// csiToKey parses ESC [ <parameters> <final byte> sequences
+func csiToKey(b []byte) (rune, []byte) {
+	end := -1
+	for i := 2; i < len(b); i++ {
+		if b[i] >= 0x40 && b[i] <= 0x7e {
+			end = i
+			break
+		}
+
+		if b[i] < 0x20 || b[i] > 0x3f {
+			// Not a valid sequence, drop what we have looked at so far
+			return keyUnknown, b[i:]
 		}
 	}
 
-	if !pasteActive && len(b) >= 6 && bytes.Equal(b[:6], pasteStart) {
-		return keyPasteStart, b[6:]
+	if end == -1 {
+		return utf8.RuneError, b
+	}
+
+	params := string(b[2:end])
+	rest := b[end+1:]
+
+	// Modifiers are sent as 1;<modifier>, 3 (and 9 on some mac terminals) are alt, 5 is ctrl
+	modifier := ""
+	if _, m, ok := strings.Cut(params, ";"); ok {
+		modifier = m
 	}
 
-	if pasteActive && len(b) >= 6 && bytes.Equal(b[:6], pasteEnd) {
-		return keyPasteEnd, b[6:]
+	switch b[end] {
+	case 'A':
+		if modifier == "3" || modifier == "9" {
+			return keyAlt | keyUp, rest
+		}
+		return keyUp, rest
+	case 'B':
+		if modifier == "3" || modifier == "9" {
+			return keyAlt | keyDown, rest
+		}
+		return keyDown, rest
+	case 'C':
+		switch modifier {
+		case "3", "9":
+			return keyAltRight, rest
+		case "5":
+			return keyCtrlRight, rest
+		}
+		return keyRight, rest
+	case 'D':
+		switch modifier {
+		case "3", "9":
+			return keyAltLeft, rest
+		case "5":
+			return keyCtrlLeft, rest
+		}
+		return keyLeft, rest
+	case 'H':
+		return keyHome, rest
+	case 'F':
+		return keyEnd, rest
+	case '~':
+		key, _, _ := strings.Cut(params, ";")
+		switch key {
+		case "1", "7":
+			return keyHome, rest
+		case "4", "8":
+			return keyEnd, rest
+		case "3":
+			if modifier == "3" || modifier == "5" {
+				return keyAlt | keyDel, rest
+			}
+			return keyDel, rest
+		case "200":
+			return keyPasteStart, rest
+		}
 	}
 
-	// If we get here then we have a key that we don't recognise, or a
-	// partial sequence. It's not clear how one should find the end of a
-	// sequence without knowing them all, but it seems that [a-zA-Z~] only
-	// appears at the end of a sequence.
+	return keyUnknown, rest
+}
+
+// skipSequence drops an escape sequence we dont understand. It's not clear how one should find the end of a
+// sequence without knowing them all, but it seems that [a-zA-Z~] only appears at the end of a sequence.
+func skipSequence(b []byte) (rune, []byte) {
 	for i, c := range b[0:] {
 		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '~' {
 			return keyUnknown, b[i+1:]
@@ -545,7 +636,11 @@ func (t *Terminal) Run() error {
 				continue
 			}
 
+			t.notifyCommand(parsedLine)
+
+			started := time.Now()
 			err = f.Run(t.user, t, parsedLine)
+			RecordCommand(t.user, t.session, "console", parsedLine, started, err)
 			if err != nil {
 				if err == io.EOF {
 					return err
@@ -557,6 +652,24 @@ func (t *Terminal) Run() error {
 	}
 }
 
+func (t *Terminal) notifyCommand(line ParsedLine) {
+	command := observers.Command{
+		Source:    "console",
+		Line:      line.RawLine,
+		Timestamp: time.Now(),
+	}
+
+	if t.user != nil {
+		command.User = t.user.Username()
+	}
+
+	if t.session != nil {
+		command.Connection = t.session.ConnectionDetails
+	}
+
+	observers.Commands.Notify(command)
+}
+
 // queue appends data to the end of t.outBuf
 func (t *Terminal) queue(data []rune) {
 	t.outBuf = append(t.outBuf, []byte(string(data))...)
@@ -566,7 +679,7 @@ var space = []rune{' '}
 
 func isPrintable(key rune) bool {
 	isInSurrogateArea := key >= 0xd800 && key <= 0xdbff
-	return key >= 32 && !isInSurrogateArea
+	return key >= 32 && key != keyBackspace && !isInSurrogateArea && key <= unicode.MaxRune
 }
 
 // moveCursorToPos appends data to t.outBuf which will move the cursor to the
@@ -576,7 +689,7 @@ func (t *Terminal) moveCursorToPos(pos int) {
 		return
 	}
 
-	x := visualLength(t.prompt) + pos
+	x := visualLength(t.prompt) + visualLength(t.line[:pos])
 	y := x / t.termWidth
 	x = x % t.termWidth
 
@@ -678,9 +791,10 @@ func (t *Terminal) setLine(newLine []rune, newPos int) {
 	if t.echo {
 		t.moveCursorToPos(0)
 		t.writeLine(newLine)
-		for i := len(newLine); i < len(t.line); i++ {
+		for i := visualLength(newLine); i < visualLength(t.line); i++ {
 			t.writeLine(space)
 		}
+		t.line = newLine
 		t.moveCursorToPos(newPos)
 	}
 	t.line = newLine
@@ -731,14 +845,16 @@ func (t *Terminal) eraseNPreviousChars(n int) {
 	t.pos -= n
 	t.moveCursorToPos(t.pos)
 
+	erasedWidth := visualLength(t.line[t.pos : t.pos+n])
+
 	copy(t.line[t.pos:], t.line[n+t.pos:])
 	t.line = t.line[:len(t.line)-n]
 	if t.echo {
 		t.writeLine(t.line[t.pos:])
-		for i := 0; i < n; i++ {
+		for i := 0; i < erasedWidth; i++ {
 			t.queue(space)
 		}
-		t.advanceCursor(n)
+		t.advanceCursor(erasedWidth)
 		t.moveCursorToPos(t.pos)
 	}
 }
@@ -787,7 +903,7 @@ func (t *Terminal) countToRightWord() int {
 	return pos - t.pos
 }
 
-// visualLength returns the number of visible glyphs in s.
+// visualLength returns the number of columns the visible glyphs in s take up.
 func visualLength(runes []rune) int {
 	inEscapeSeq := false
 	length := 0
@@ -801,13 +917,38 @@ func visualLength(runes []rune) int {
 		case r == '\x1b':
 			inEscapeSeq = true
 		default:
-			length++
+			length += runeWidth(r)
 		}
 	}
 
 	return length
 }
 
+// runeWidth returns how many columns a terminal uses to display r, combining marks take none and east asian wide characters take two.
+// Ranges are from Markus Kuhn's wcwidth
+func runeWidth(r rune) int {
+	switch {
+	case r < 32 || r == keyBackspace:
+		return 0
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r >= 0x1100 && (r <= 0x115f || r == 0x2329 || r == 0x232a ||
+		(r >= 0x2e80 && r <= 0xa4cf && r != 0x303f) ||
+		(r >= 0xac00 && r <= 0xd7a3) ||
+		(r >= 0xf900 && r <= 0xfaff) ||
+		(r >= 0xfe10 && r <= 0xfe19) ||
+		(r >= 0xfe30 && r <= 0xfe6f) ||
+		(r >= 0xff00 && r <= 0xff60) ||
+		(r >= 0xffe0 && r <= 0xffe6) ||
+		(r >= 0x1f300 && r <= 0x1f64f) ||
+		(r >= 0x1f900 && r <= 0x1f9ff) ||
+		(r >= 0x20000 && r <= 0x3fffd)):
+		return 2
+	}
+
+	return 1
+}
+
 // handleKey processes the given key and, optionally, returns a line of text
 // that the user has entered.
 func (t *Terminal) handleKey(key rune) (line string, ok bool) {
@@ -817,56 +958,83 @@ func (t *Terminal) handleKey(key rune) (line string, ok bool) {
 		return
 	}
 
-	switch key {
-	case keyBackspace, keyAltLeft, keyAltRight, keyLeft, keyRight, keyHome, keyEnd, keyDel, keyUp, keyDown, keyEnter, keyDeleteWord, keyDeleteLine, keyCtrlD, keyCtrlU, keyClearScreen:
-		t.resetAutoComplete()
+	if t.metaPending {
+		// Escape then a key is the same as alt and the key, for terminals that dont send alt themselves
+		t.metaPending = false
+		key |= keyAlt
 	}
 
-	switch key {
-	case keyDel:
-		if t.pos >= len(t.line) || len(t.line) == 0 {
+	action, bound := t.currentKeymap()[key]
+	if !bound {
+		if t.bindings.mode == EmacsMode && key == keyEscape {
+			t.metaPending = true
 			return
 		}
-		t.pos += 1
-		t.eraseNPreviousChars(1)
-	case keyBackspace:
-		if t.pos == 0 {
+
+		if t.viCommand {
+			// Typing in command mode does nothing rather than inserting text
+			t.viPending = ""
 			return
 		}
-		t.eraseNPreviousChars(1)
-	case keyAltLeft:
-		// move left by a word.
-		t.pos -= t.countToLeftWord()
-		t.moveCursorToPos(t.pos)
-	case keyAltRight:
-		// move right by a word.
-		t.pos += t.countToRightWord()
-		t.moveCursorToPos(t.pos)
-	case keyLeft:
-		if t.pos == 0 {
-			return
+
+		action = actionSelfInsert
+	}
+
+	if action != actionSelfInsert {
+		t.resetAutoComplete()
+	}
+
+	if t.viPending != "" {
+		operator := t.viPending
+		t.viPending = ""
+
+		if action == operator {
+			// dd and cc work on the whole line
+			t.killRange(0, len(t.line))
+		} else {
+			target, isMotion := t.motion(action)
+			if !isMotion {
+				return
+			}
+
+			if action == actionEndOfWord {
+				// e is inclusive
+				target = min(target+1, len(t.line))
+			}
+
+			t.killRange(min(t.pos, target), max(t.pos, target))
 		}
-		t.pos--
-		t.moveCursorToPos(t.pos)
-	case keyRight:
-		if t.pos == len(t.line) {
-			return
+
+		if operator == actionViChange {
+			t.viCommand = false
 		}
-		t.pos++
-		t.moveCursorToPos(t.pos)
-	case keyHome:
-		if t.pos == 0 {
-			return
+
+		return
+	}
+
+	if target, isMotion := t.motion(action); isMotion {
+		if target != t.pos {
+			t.pos = target
+			t.moveCursorToPos(t.pos)
 		}
-		t.pos = 0
-		t.moveCursorToPos(t.pos)
-	case keyEnd:
-		if t.pos == len(t.line) {
+		return
+	}
+
+	switch action {
+	case actionDeleteChar:
+		// Erase the character under the current position.
+		// The EOF case when the line is empty is handled in
+		// readLine().
+		if t.pos < len(t.line) {
+			t.pos++
+			t.eraseNPreviousChars(1)
+		}
+	case actionBackwardDeleteChar:
+		if t.pos == 0 {
 			return
 		}
-		t.pos = len(t.line)
-		t.moveCursorToPos(t.pos)
-	case keyUp:
+		t.eraseNPreviousChars(1)
+	case actionPreviousHistory:
 		entry, ok := t.history.NthPreviousEntry(t.historyIndex + 1)
 		if !ok {
 			return "", false
@@ -877,7 +1045,7 @@ func (t *Terminal) handleKey(key rune) (line string, ok bool) {
 		t.historyIndex++
 		runes := []rune(entry)
 		t.setLine(runes, len(runes))
-	case keyDown:
+	case actionNextHistory:
 		switch t.historyIndex {
 		case -1:
 			return
@@ -893,7 +1061,7 @@ func (t *Terminal) handleKey(key rune) (line string, ok bool) {
 				t.setLine(runes, len(runes))
 			}
 		}
-	case keyEnter:
+	case actionAcceptLine:
 		t.moveCursorToPos(len(t.line))
 		t.queue([]rune("\r\n"))
 		line = string(t.line)
@@ -903,42 +1071,81 @@ func (t *Terminal) handleKey(key rune) (line string, ok bool) {
 		t.cursorX = 0
 		t.cursorY = 0
 		t.maxLine = 0
-	case keyDeleteWord:
+		t.viCommand = false
+	case actionBackwardKillWord:
 		// Delete zero or more spaces and then one or more characters.
-		t.eraseNPreviousChars(t.countToLeftWord())
-	case keyDeleteLine:
+		t.killRange(t.pos-t.countToLeftWord(), t.pos)
+	case actionKillWord:
+		t.killRange(t.pos, t.endOfNextWord())
+	case actionKillLine:
 		// Delete everything from the current cursor position to the
 		// end of line.
-		for i := t.pos; i < len(t.line); i++ {
-			t.queue(space)
-			t.advanceCursor(1)
+		t.killRange(t.pos, len(t.line))
+	case actionKillWholeLine:
+		t.killRange(0, len(t.line))
+	case actionUnixLineDiscard:
+		t.killRange(0, t.pos)
+	case actionYank:
+		if len(t.killed) == 0 || len(t.line)+len(t.killed) > maxLineLength {
+			return
 		}
-		t.line = t.line[:t.pos]
-		t.moveCursorToPos(t.pos)
-	case keyCtrlD:
-		// Erase the character under the current position.
-		// The EOF case when the line is empty is handled in
-		// readLine().
-		if t.pos < len(t.line) {
-			t.pos++
-			t.eraseNPreviousChars(1)
+
+		newLine := append([]rune{}, t.line[:t.pos]...)
+		newLine = append(newLine, t.killed...)
+		newLine = append(newLine, t.line[t.pos:]...)
+		t.setLine(newLine, t.pos+len(t.killed))
+	case actionTransposeChars:
+		if len(t.line) < 2 || t.pos == 0 {
+			return
 		}
-	case keyCtrlU:
-		t.eraseNPreviousChars(t.pos)
-	case keyClearScreen:
+
+		pos := min(t.pos, len(t.line)-1)
+
+		newLine := append([]rune{}, t.line...)
+		newLine[pos-1], newLine[pos] = newLine[pos], newLine[pos-1]
+		t.setLine(newLine, pos+1)
+	case actionClearScreen:
 		// Erases the screen and moves the cursor to the home position.
 		t.queue([]rune("\x1b[2J\x1b[H"))
 		t.queue(t.prompt)
 		t.cursorX, t.cursorY = 0, 0
 		t.advanceCursor(visualLength(t.prompt))
 		t.setLine(t.line, t.pos)
-	case keyCtrlC:
+	case actionInterrupt:
 		t.queue([]rune("^C\r\n"))
 		t.queue(t.prompt)
 		t.cursorX = 0
 		t.advanceCursor(visualLength(t.prompt))
 		t.setLine([]rune{}, 0)
-	default:
+		t.viCommand = false
+	case actionViCommandMode:
+		t.viCommand = true
+		if t.pos > 0 {
+			t.pos--
+			t.moveCursorToPos(t.pos)
+		}
+	case actionViInsert:
+		t.viCommand = false
+	case actionViInsertBeginning:
+		t.viCommand = false
+		t.pos = 0
+		t.moveCursorToPos(t.pos)
+	case actionViAppend:
+		t.viCommand = false
+		if t.pos < len(t.line) {
+			t.pos++
+			t.moveCursorToPos(t.pos)
+		}
+	case actionViAppendEnd:
+		t.viCommand = false
+		t.pos = len(t.line)
+		t.moveCursorToPos(t.pos)
+	case actionViChangeToEnd:
+		t.killRange(t.pos, len(t.line))
+		t.viCommand = false
+	case actionViDelete, actionViChange:
+		t.viPending = action
+	case actionSelfInsert:
 		if t.AutoCompleteCallback != nil {
 			prefix := string(t.line[:t.pos])
 			suffix := string(t.line[t.pos:])
@@ -963,6 +1170,63 @@ func (t *Terminal) handleKey(key rune) (line string, ok bool) {
 	return
 }
 
+// motion returns where the cursor would end up after a movement action, ok is false if the action doesnt move the cursor
+func (t *Terminal) motion(action string) (pos int, ok bool) {
+	switch action {
+	case actionBackwardChar:
+		return max(t.pos-1, 0), true
+	case actionForwardChar:
+		return min(t.pos+1, len(t.line)), true
+	case actionBeginningOfLine:
+		return 0, true
+	case actionEndOfLine:
+		return len(t.line), true
+	case actionBackwardWord:
+		return t.pos - t.countToLeftWord(), true
+	case actionForwardWord:
+		return t.pos + t.countToRightWord(), true
+	case actionEndOfWord:
+		// Last character of the word under the cursor, or of the next word if already at the end of one
+		pos := t.pos + 1
+		for pos < len(t.line) && t.line[pos] == ' ' {
+			pos++
+		}
+		for pos+1 < len(t.line) && t.line[pos+1] != ' ' {
+			pos++
+		}
+		return min(pos, len(t.line)), true
+	}
+
+	return t.pos, false
+}
+
+// endOfNextWord returns the position just after the end of the word under or after the cursor
+func (t *Terminal) endOfNextWord() int {
+	pos := t.pos
+	for pos < len(t.line) && t.line[pos] == ' ' {
+		pos++
+	}
+	for pos < len(t.line) && t.line[pos] != ' ' {
+		pos++
+	}
+	return pos
+}
+
+// killRange removes line[from:to] and keeps it so that it can be yanked back
+func (t *Terminal) killRange(from, to int) {
+	from = max(from, 0)
+	to = min(to, len(t.line))
+	if from >= to {
+		return
+	}
+
+	t.killed = append([]rune{}, t.line[from:to]...)
+
+	newLine := append([]rune{}, t.line[:from]...)
+	newLine = append(newLine, t.line[to:]...)
+	t.setLine(newLine, from)
+}
+
 func (t *Terminal) Clear() {
 
 	t.lock.Lock()
@@ -995,14 +1259,38 @@ func (t *Terminal) addKeyToLine(key rune) {
 }
 
 func (t *Terminal) writeLine(line []rune) {
+	inEscapeSeq := false
 	for len(line) != 0 {
 		remainingOnLine := t.termWidth - t.cursorX
-		todo := len(line)
-		if todo > remainingOnLine {
-			todo = remainingOnLine
+
+		// Fill the rest of the terminal line by columns rather than characters, as wide characters take two
+		todo, width := 0, 0
+		for ; todo < len(line); todo++ {
+			r := line[todo]
+			if inEscapeSeq {
+				inEscapeSeq = !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'))
+				continue
+			}
+			if r == '\x1b' {
+				inEscapeSeq = true
+				continue
+			}
+
+			w := runeWidth(r)
+			if width+w > remainingOnLine {
+				break
+			}
+			width += w
+		}
+
+		if todo == 0 {
+			// A wide character in the last column, the terminal will wrap it
+			todo = 1
+			width = runeWidth(line[0])
 		}
+
 		t.queue(line[:todo])
-		t.advanceCursor(visualLength(line[:todo]))
+		t.advanceCursor(width)
 		line = line[todo:]
 	}
 }
@@ -0,0 +1,143 @@
+package terminal
+
+import (
+	"io"
+	"testing"
+)
+
+type mockTerminal struct {
+	toSend       []byte
+	bytesPerRead int
+	received     []byte
+}
+
+func (c *mockTerminal) Read(data []byte) (n int, err error) {
+	n = len(data)
+	if n == 0 {
+		return
+	}
+	if n > len(c.toSend) {
+		n = len(c.toSend)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	if c.bytesPerRead > 0 && n > c.bytesPerRead {
+		n = c.bytesPerRead
+	}
+	copy(data, c.toSend[:n])
+	c.toSend = c.toSend[n:]
+	return
+}
+
+func (c *mockTerminal) Write(data []byte) (n int, err error) {
+	c.received = append(c.received, data...)
+	return len(data), nil
+}
+
+func TestBytesToKey(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		key  rune
+		rest string
+	}{
+		{"a", 'a', ""},
+		{"é", 'é', ""},
+		{"\xe9x", keyUnknown, "x"},
+		{"\x1b[A", keyUp, ""},
+		{"\x1bOD", keyLeft, ""},
+		{"\x1b[1;5C", keyCtrlRight, ""},
+		{"\x1b[1;3D", keyAltLeft, ""},
+		{"\x1b[3~x", keyDel, "x"},
+		{"\x1b[7~", keyHome, ""},
+		{"\x1b[4~", keyEnd, ""},
+		{"\x1b[200~", keyPasteStart, ""},
+		{"\x1bb", keyAlt | 'b', ""},
+		{"\x1bä", keyAlt | 'ä', ""},
+		{"\x1b\x7f", keyAlt | keyBackspace, ""},
+		{"\x1b", keyEscape, ""},
+		{"\x01", 1, ""},
+	} {
+		key, rest := bytesToKey([]byte(test.in), false)
+		if key != test.key || string(rest) != test.rest {
+			t.Errorf("bytesToKey(%q) = %s, %q expected %s, %q", test.in, KeyName(key), rest, KeyName(test.key), test.rest)
+		}
+	}
+
+	// Partial sequences and characters wait for more input
+	for _, partial := range []string{"\x1b[1;", "\xc3", "\x1b\xc3"} {
+		if key, _ := bytesToKey([]byte(partial), false); key != 0xfffd {
+			t.Errorf("partial input %q should wait for more, got %s", partial, KeyName(key))
+		}
+	}
+}
+
+func TestEditing(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		mode string
+		in   string
+		line string
+	}{
+		{"emacs kill and yank", EmacsMode, "foo bar\x17\x01\x19 \r", "bar foo "},
+		{"emacs meta via escape", EmacsMode, "one two\x1bb\x0b\r", "one "},
+		{"emacs transpose", EmacsMode, "ab\x14\r", "ba"},
+		{"non ascii", EmacsMode, "héllo wörld\x02\x02\x7f\r", "héllo wöld"},
+		{"vi dw", ViMode, "one two three\x1b0dw\r", "two three"},
+		{"vi cw", ViMode, "one two\x1b0cwthree \r", "three two"},
+		{"vi dd", ViMode, "one two\x1bdd\r", ""},
+		{"vi x and append", ViMode, "abc\x1bxa!\r", "ab!"},
+		{"vi ignores typing in command mode", ViMode, "abc\x1bzzA!\r", "abc!"},
+	} {
+		c := &mockTerminal{toSend: []byte(test.in)}
+		term := NewTerminal(c, "> ")
+		if err := term.SetEditMode(test.mode); err != nil {
+			t.Fatal(err)
+		}
+
+		// The escape key is only recognised when it arrives on its own, as it does when typed
+		c.bytesPerRead = 1
+
+		line, err := term.ReadLine()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if line != test.line {
+			t.Errorf("%s: got %q expected %q", test.name, line, test.line)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	c := &mockTerminal{toSend: []byte("abc\x07\r")}
+	term := NewTerminal(c, "> ")
+
+	if err := term.Bind(EmacsKeymap, "ctrl-g", "kill-whole-line"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := term.Bind(EmacsKeymap, "ctrl-g", "not-an-action"); err == nil {
+		t.Fatal("binding an unknown action should fail")
+	}
+
+	line, err := term.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != "" {
+		t.Fatalf("ctrl-g should have cleared the line, got %q", line)
+	}
+
+	for _, name := range []string{"ctrl-a", "alt-b", "alt-backspace", "up", "ctrl-left", "ü", "alt-ü"} {
+		k, err := ParseKey(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if KeyName(k) != name {
+			t.Errorf("%q did not round trip, got %q", name, KeyName(k))
+		}
+	}
+}
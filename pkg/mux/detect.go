@@ -0,0 +1,149 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/NHAS/reverse_ssh/pkg/mux/protocols"
+)
+
+// The protocol on a connection is found by running its first bytes through a chain of detectors, the first that matches decides it.
+// Detectors registered with Register run before the built in ones, in the order they were registered.
+
+const (
+	// Bytes read before the chain is run, more are only waited for when a detector needs them
+	defaultHeaderLength = 14
+	maxHeaderLength     = 512
+)
+
+// Detector recognises a protocol from the first bytes of a connection
+type Detector struct {
+	Name     string
+	Protocol protocols.Type
+
+	// Bytes Match needs to decide, it is not asked about shorter headers
+	Length int
+
+	// Match reports whether a connection starting with header is Protocol
+	Match func(header []byte) bool
+}
+
+// MagicBytes is a detector for connections that start with magic
+func MagicBytes(name string, proto protocols.Type, magic []byte) Detector {
+	magic = bytes.Clone(magic)
+	return Detector{
+		Name:     name,
+		Protocol: proto,
+		Length:   len(magic),
+		Match: func(header []byte) bool {
+			return bytes.HasPrefix(header, magic)
+		},
+	}
+}
+
+func isHttp(b []byte) bool {
+
+	validMethods := [][]byte{
+		[]byte("GET"), []byte("HEA"), []byte("POS"),
+		[]byte("PUT"), []byte("DEL"), []byte("CON"),
+		[]byte("OPT"), []byte("TRA"), []byte("PAT"),
+	}
+
+	for _, vm := range validMethods {
+		if bytes.HasPrefix(b, vm) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var builtinDetectors = []Detector{
+	MagicBytes("raw download", protocols.TCPDownload, []byte("RAW")),
+	MagicBytes("tls", protocols.TLS, []byte{0x16}),
+	MagicBytes("ssh", protocols.C2, []byte("SSH")),
+	MagicBytes("websockets", protocols.Websockets, []byte("GET /ws")),
+	{
+		Name:     "polling",
+		Protocol: protocols.HTTP,
+		Length:   len("GET /push"),
+		Match: func(header []byte) bool {
+			return bytes.HasPrefix(header, []byte("HEAD /push")) || bytes.HasPrefix(header, []byte("GET /push")) || bytes.HasPrefix(header, []byte("POST /push"))
+		},
+	},
+	{
+		Name:     "http download",
+		Protocol: protocols.HTTPDownload,
+		Length:   3,
+		Match:    isHttp,
+	},
+}
+
+// detect runs header through chain. more is set when nothing matched but a detector wanted a longer header than it got
+func detect(chain []Detector, header []byte) (proto protocols.Type, more bool) {
+	for _, d := range chain {
+		if len(header) < d.Length {
+			more = true
+			continue
+		}
+
+		if d.Match(header) {
+			return d.Protocol, false
+		}
+	}
+	return "", more
+}
+
+// Register adds a detector, and returns the listener connections it matches are accepted on. Detectors for a protocol the
+// multiplexer already has, e.g another way of spotting ssh, share its listener. Connections are matched inside TLS and websockets too,
+// and are handed over with the bytes that were looked at still to be read
+func (m *Multiplexer) Register(d Detector) (net.Listener, error) {
+	if d.Match == nil || d.Protocol == "" || d.Protocol == protocols.Invalid {
+		return nil, errors.New("detector needs a protocol and match function")
+	}
+
+	if d.Protocol == protocols.TLS || d.Protocol == protocols.Websockets {
+		return nil, fmt.Errorf("%s is a transport the multiplexer unwraps, it has no listener", d.Protocol)
+	}
+
+	if d.Length > maxHeaderLength {
+		return nil, fmt.Errorf("detector %q needs %d bytes, at most %d can be looked at", d.Name, d.Length, maxHeaderLength)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, existing := range m.detectors {
+		if existing.Name == d.Name {
+			return nil, fmt.Errorf("a detector named %q is already registered", d.Name)
+		}
+	}
+
+	listener, ok := m.result[d.Protocol]
+	if !ok {
+		listener = newMultiplexerListener(m.addr, d.Protocol)
+		m.result[d.Protocol] = listener
+	}
+
+	m.detectors = slices.Insert(m.detectors, len(m.detectors)-len(builtinDetectors), d)
+	return listener, nil
+}
+
+// Detectors lists the detector chain in the order it is run
+func (m *Multiplexer) Detectors() []Detector {
+	m.RLock()
+	defer m.RUnlock()
+
+	return slices.Clone(m.detectors)
+}
+
+// listener is where connections of proto go, nil when nothing accepts them
+func (m *Multiplexer) listener(proto protocols.Type) *multiplexerListener {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.result[proto]
+}
@@ -0,0 +1,63 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRegisteredDetectorGetsItsConnections(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{
+		Control:            true,
+		PollingAuthChecker: func(string, net.Addr) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	custom, err := m.Register(MagicBytes("knock", "knock", []byte("KNOCK-KNOCK")))
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	if _, err := m.Register(MagicBytes("knock", "knock", []byte("again"))); err == nil {
+		t.Fatal("registered two detectors with the same name")
+	}
+
+	accepted := func(l net.Listener, first, rest string) string {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", m.addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// Sent in two parts, so the header has to be waited on
+		conn.Write([]byte(first))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte(rest))
+
+		got, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer got.Close()
+
+		buffer := make([]byte, len(first)+len(rest))
+		if _, err := io.ReadFull(got, buffer); err != nil {
+			t.Fatal(err)
+		}
+		return string(buffer)
+	}
+
+	if got := accepted(custom, "KNOCK-", "KNOCK hello"); got != "KNOCK-KNOCK hello" {
+		t.Fatalf("custom listener read %q", got)
+	}
+
+	if got := accepted(m.ControlRequests(), "SS", "H-2.0-test\r\n"); got != "SSH-2.0-test\r\n" {
+		t.Fatalf("control listener read %q", got)
+	}
+}
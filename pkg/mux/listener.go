@@ -1,8 +1,8 @@
 package mux
 
 import (
-	"errors"
 	"net"
+	"sync"
 
 	"github.com/NHAS/reverse_ssh/pkg/mux/protocols"
 )
@@ -10,36 +10,42 @@ import (
 type multiplexerListener struct {
 	addr        net.Addr
 	connections chan net.Conn
-	closed      bool
 	protocol    protocols.Type
+
+	// Closed when the listener is, connections is never closed so late senders cannot panic
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func newMultiplexerListener(addr net.Addr, protocol protocols.Type) *multiplexerListener {
-	return &multiplexerListener{addr: addr, connections: make(chan net.Conn), protocol: protocol}
+	return &multiplexerListener{addr: addr, connections: make(chan net.Conn), protocol: protocol, done: make(chan struct{})}
 }
 
 func (ml *multiplexerListener) Accept() (net.Conn, error) {
-	if ml.closed {
-		return nil, errors.New("Accept on closed listener")
+	select {
+	case conn := <-ml.connections:
+		return conn, nil
+	case <-ml.done:
+		return nil, net.ErrClosed
 	}
-	return <-ml.connections, nil
 }
 
 // Close closes the listener.
 // Any blocked Accept operations will be unblocked and return errors.
 func (ml *multiplexerListener) Close() error {
-	if !ml.closed {
-		ml.closed = true
-		close(ml.connections)
-	}
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+	})
 
 	return nil
 }
 
 // Addr returns the listener's network address.
 func (ml *multiplexerListener) Addr() net.Addr {
-	if ml.closed {
+	select {
+	case <-ml.done:
 		return nil
+	default:
+		return ml.addr
 	}
-	return ml.addr
 }
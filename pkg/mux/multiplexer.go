@@ -1,13 +1,15 @@
 package mux
 
 import (
-	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +17,7 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -35,10 +38,28 @@ type MultiplexerConfig struct {
 	TLSCertPath string
 	TLSKeyPath  string
 
+	// Secret to derive daily rotating TLS session ticket keys from, so clients can resume sessions across server restarts.
+	// If unset go's default random per process keys are used
+	TLSSessionTicketSecret []byte
+
 	TcpKeepAlive int
 
+	// Already open listener to use instead of listening on the address, e.g one passed in by systemd socket activation
+	Listener net.Listener
+
+	// Maximum number of connections waiting on protocol detection before new ones are dropped, defaults to 1000
+	MaxWaitingConnections int
+	// How long a connection waits to be picked up by the protocol listener before it is closed, defaults to 2 seconds
+	AcceptTimeout time.Duration
+
 	PollingAuthChecker func(key string, addr net.Addr) bool
 
+	// Optionally wraps each raw connection as it is accepted, before anything is read from it
+	WrapConn func(net.Conn) net.Conn
+
+	// Optionally decides whether to keep a connection by its source as soon as it is accepted, those it refuses are closed straight away
+	AcceptFilter func(net.Addr) bool
+
 	tlsConfig *tls.Config
 }
 
@@ -83,11 +104,107 @@ func genX509KeyPair(AutoTLSCommonName string) (tls.Certificate, error) {
 type Multiplexer struct {
 	sync.RWMutex
 	result         map[protocols.Type]*multiplexerListener
-	done           bool
 	listeners      map[string]net.Listener
 	newConnections chan net.Conn
 
+	// Closed by Close, newConnections is never closed so late senders cannot panic
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Address of the first listener, which custom protocol listeners report as theirs
+	addr      net.Addr
+	detectors []Detector
+
 	config MultiplexerConfig
+
+	tlsLock       sync.Mutex
+	ticketKeysDay int64
+	tlsHandshakes atomic.Uint64
+	tlsResumed    atomic.Uint64
+}
+
+type TLSStats struct {
+	Handshakes uint64
+	Resumed    uint64
+}
+
+// TLSStats returns how many TLS handshakes the multiplexer has done, and how many of those resumed a previous session
+func (m *Multiplexer) TLSStats() TLSStats {
+	return TLSStats{
+		Handshakes: m.tlsHandshakes.Load(),
+		Resumed:    m.tlsResumed.Load(),
+	}
+}
+
+func deriveSessionTicketKey(secret []byte, day int64) (key [32]byte) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("rssh tls session ticket key"))
+	binary.Write(mac, binary.BigEndian, day)
+
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+func (m *Multiplexer) getTLSConfig() (*tls.Config, error) {
+	m.tlsLock.Lock()
+	defer m.tlsLock.Unlock()
+
+	if m.config.tlsConfig == nil {
+
+		tlsConfig := &tls.Config{
+			PreferServerCipherSuites: true,
+			CurvePreferences: []tls.CurveID{
+				tls.CurveP256,
+				tls.X25519, // Go 1.8 only
+			},
+			MinVersion: tls.VersionTLS12,
+		}
+
+		if m.config.TLSCertPath != "" {
+			cert, err := tls.LoadX509KeyPair(m.config.TLSCertPath, m.config.TLSKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("TLS is enabled but loading certs/key failed: %s, err: %s", m.config.TLSCertPath, err)
+			}
+
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		} else {
+			cert, err := genX509KeyPair(m.config.AutoTLSCommonName)
+			if err != nil {
+				return nil, fmt.Errorf("TLS is enabled but generating certs/key failed: %s", err)
+			}
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		}
+
+		m.config.tlsConfig = tlsConfig
+	}
+
+	if len(m.config.TLSSessionTicketSecret) > 0 {
+		// Keep yesterdays key around for decrypting so tickets issued just before midnight are still useful
+		day := time.Now().Unix() / int64((24 * time.Hour).Seconds())
+		if day != m.ticketKeysDay {
+			m.config.tlsConfig.SetSessionTicketKeys([][32]byte{
+				deriveSessionTicketKey(m.config.TLSSessionTicketSecret, day),
+				deriveSessionTicketKey(m.config.TLSSessionTicketSecret, day-1),
+			})
+			m.ticketKeysDay = day
+		}
+	}
+
+	return m.config.tlsConfig, nil
+}
+
+// Certificate is the certificate TLS connections are served with, nil when TLS is off
+func (m *Multiplexer) Certificate() (*x509.Certificate, error) {
+	if !m.config.TLS {
+		return nil, nil
+	}
+
+	config, err := m.getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(config.Certificates[0].Certificate[0])
 }
 
 func (m *Multiplexer) StartListener(network, address string) error {
@@ -112,6 +229,24 @@ func (m *Multiplexer) StartListener(network, address string) error {
 		return err
 	}
 
+	m.serve(address, listener)
+	return nil
+}
+
+// AddListener multiplexes connections from an already open listener, which is then stopped by address like any other
+func (m *Multiplexer) AddListener(address string, listener net.Listener) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.listeners[address]; ok {
+		return errors.New("Address " + address + " already listening")
+	}
+
+	m.serve(address, listener)
+	return nil
+}
+
+func (m *Multiplexer) serve(address string, listener net.Listener) {
 	m.listeners[address] = listener
 
 	go func(listen net.Listener) {
@@ -130,10 +265,22 @@ func (m *Multiplexer) StartListener(network, address string) error {
 				continue
 
 			}
+
+			if m.config.AcceptFilter != nil && !m.config.AcceptFilter(conn.RemoteAddr()) {
+				conn.Close()
+				continue
+			}
+
+			if m.config.WrapConn != nil {
+				conn = m.config.WrapConn(conn)
+			}
+
 			go func() {
 				select {
 				case m.newConnections <- conn:
-				case <-time.After(2 * time.Second):
+				case <-m.done:
+					conn.Close()
+				case <-time.After(m.config.AcceptTimeout):
 					log.Println("Accepting new connection timed out")
 					conn.Close()
 				}
@@ -141,8 +288,6 @@ func (m *Multiplexer) StartListener(network, address string) error {
 		}
 
 	}(listener)
-
-	return nil
 }
 
 type ConnContextKey string
@@ -247,9 +392,14 @@ func (m *Multiplexer) collector(localAddr net.Addr) http.HandlerFunc {
 				select {
 				//Allow whatever we're multiplexing to apply backpressure if it cant accept things
 				case l.connections <- c:
-				case <-time.After(2 * time.Second):
+				case <-l.done:
+					c.Close()
+					delete(connections, id)
+					http.Error(w, "Server Error", http.StatusInternalServerError)
+					return
+				case <-time.After(m.config.AcceptTimeout):
 
-					log.Println(l.protocol, "Failed to accept new http connection within 2 seconds, closing connection (may indicate high resource usage)")
+					log.Println(l.protocol, "Failed to accept new http connection within", m.config.AcceptTimeout, "closing connection (may indicate high resource usage)")
 					c.Close()
 					delete(connections, id)
 					http.Error(w, "Server Error", http.StatusInternalServerError)
@@ -330,6 +480,8 @@ func (m *Multiplexer) QueueConn(c net.Conn) error {
 	select {
 	case m.newConnections <- c:
 		return nil
+	case <-m.done:
+		return net.ErrClosed
 	case <-time.After(250 * time.Millisecond):
 		return errors.New("too busy to queue connection")
 	}
@@ -340,18 +492,34 @@ func ListenWithConfig(network, address string, _c MultiplexerConfig) (*Multiplex
 	var m Multiplexer
 
 	m.newConnections = make(chan net.Conn)
+	m.done = make(chan struct{})
 	m.listeners = make(map[string]net.Listener)
 	m.result = map[protocols.Type]*multiplexerListener{}
+	m.detectors = slices.Clone(builtinDetectors)
 	m.config = _c
 
+	if m.config.MaxWaitingConnections <= 0 {
+		m.config.MaxWaitingConnections = 1000
+	}
+
+	if m.config.AcceptTimeout <= 0 {
+		m.config.AcceptTimeout = 2 * time.Second
+	}
+
 	if _c.PollingAuthChecker == nil {
 		return nil, errors.New("no authentication method supplied for polling muxing, this may lead to extreme dos if not set. Must set it")
 	}
 
-	err := m.StartListener(network, address)
+	var err error
+	if m.config.Listener != nil {
+		err = m.AddListener(address, m.config.Listener)
+	} else {
+		err = m.StartListener(network, address)
+	}
 	if err != nil {
 		return nil, err
 	}
+	m.addr = m.listeners[address].Addr()
 
 	if m.config.Control {
 		m.result[protocols.C2] = newMultiplexerListener(m.listeners[address].Addr(), protocols.C2)
@@ -369,9 +537,15 @@ func ListenWithConfig(network, address string, _c MultiplexerConfig) (*Multiplex
 
 	var waitingConnections int32
 	go func() {
-		for conn := range m.newConnections {
+		for {
+			var conn net.Conn
+			select {
+			case conn = <-m.newConnections:
+			case <-m.done:
+				return
+			}
 
-			if atomic.LoadInt32(&waitingConnections) > 1000 {
+			if atomic.LoadInt32(&waitingConnections) > int32(m.config.MaxWaitingConnections) {
 				conn.Close()
 				continue
 			}
@@ -388,8 +562,8 @@ func ListenWithConfig(network, address string, _c MultiplexerConfig) (*Multiplex
 					return
 				}
 
-				l, ok := m.result[proto]
-				if !ok {
+				l := m.listener(proto)
+				if l == nil {
 					newConnection.Close()
 					log.Println("Multiplexing failed (final determination): ", proto)
 					return
@@ -398,9 +572,11 @@ func ListenWithConfig(network, address string, _c MultiplexerConfig) (*Multiplex
 				select {
 				//Allow whatever we're multiplexing to apply backpressure if it cant accept things
 				case l.connections <- newConnection:
-				case <-time.After(2 * time.Second):
+				case <-l.done:
+					newConnection.Close()
+				case <-time.After(m.config.AcceptTimeout):
 
-					log.Println(l.protocol, "Failed to accept new connection within 2 seconds, closing connection (may indicate high resource usage)")
+					log.Println(l.protocol, "Failed to accept new connection within", m.config.AcceptTimeout, "closing connection (may indicate high resource usage)")
 					newConnection.Close()
 				}
 
@@ -423,9 +599,12 @@ func Listen(network, address string) (*Multiplexer, error) {
 }
 
 func (m *Multiplexer) Close() {
-	m.done = true
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
 
-	for address := range m.listeners {
+	// Listeners remove themselves from m.listeners as they stop, so stop a copy of them
+	for _, address := range m.GetListeners() {
 		m.StopListener(address)
 	}
 
@@ -433,70 +612,54 @@ func (m *Multiplexer) Close() {
 		v.Close()
 	}
 
-	close(m.newConnections)
-
-}
-
-func isHttp(b []byte) bool {
-
-	validMethods := [][]byte{
-		[]byte("GET"), []byte("HEA"), []byte("POS"),
-		[]byte("PUT"), []byte("DEL"), []byte("CON"),
-		[]byte("OPT"), []byte("TRA"), []byte("PAT"),
-	}
-
-	for _, vm := range validMethods {
-		if bytes.HasPrefix(b, vm) {
-			return true
-		}
-	}
-
-	return false
 }
 
 func (m *Multiplexer) determineProtocol(conn net.Conn) (net.Conn, protocols.Type, error) {
+	chain := m.Detectors()
 
-	header := make([]byte, 14)
-	n, err := conn.Read(header)
-	if err != nil {
-		conn.Close()
-		return nil, "", fmt.Errorf("failed to read header: %s", err)
-	}
-
-	c := &bufferedConn{prefix: header[:n], conn: conn}
-
-	if bytes.HasPrefix(header, []byte{'R', 'A', 'W'}) {
-		return c, protocols.TCPDownload, nil
-	}
-
-	if bytes.HasPrefix(header, []byte{0x16}) {
-		return c, protocols.TLS, nil
-	}
-
-	if bytes.HasPrefix(header, []byte{'S', 'S', 'H'}) {
-		return c, protocols.C2, nil
+	need := defaultHeaderLength
+	for _, d := range chain {
+		need = max(need, d.Length)
 	}
 
-	if isHttp(header) {
+	header := make([]byte, need)
+	n, err := conn.Read(header[:defaultHeaderLength])
+	for {
+		if err != nil {
+			conn.Close()
+			return nil, "", fmt.Errorf("failed to read header: %s", err)
+		}
 
-		if bytes.HasPrefix(header, []byte("GET /ws")) {
-			return c, protocols.Websockets, nil
+		proto, more := detect(chain, header[:n])
+		if proto != "" {
+			return &bufferedConn{prefix: header[:n], conn: conn}, proto, nil
 		}
 
-		if bytes.HasPrefix(header, []byte("HEAD /push")) || bytes.HasPrefix(header, []byte("GET /push")) || bytes.HasPrefix(header, []byte("POST /push")) {
-			return c, protocols.HTTP, nil
+		if !more || n == len(header) {
+			break
 		}
 
-		return c, protocols.HTTPDownload, nil
+		var read int
+		read, err = conn.Read(header[n:])
+		n += read
 	}
 
 	conn.Close()
 	return nil, "", errors.New("unknown protocol: " + string(header[:n]))
 }
 
+// fullyUnwrapped is whether proto is ready to be handed to its listener, protocols added with Register always are
+func (m *Multiplexer) fullyUnwrapped(proto protocols.Type) bool {
+	if protocols.FullyUnwrapped(proto) {
+		return true
+	}
+
+	return proto != protocols.HTTP && m.listener(proto) != nil
+}
+
 func (m *Multiplexer) getProtoListener(proto protocols.Type) net.Listener {
-	ml, ok := m.result[proto]
-	if !ok {
+	ml := m.listener(proto)
+	if ml == nil {
 		panic("Unknown protocol passed: " + proto)
 	}
 
@@ -517,43 +680,24 @@ func (m *Multiplexer) unwrapTransports(conn net.Conn) (net.Conn, protocols.Type,
 	// Unwrap any outer tls if required
 	if m.config.TLS && proto == "tls" {
 
-		if m.config.tlsConfig == nil {
-
-			tlsConfig := &tls.Config{
-				PreferServerCipherSuites: true,
-				CurvePreferences: []tls.CurveID{
-					tls.CurveP256,
-					tls.X25519, // Go 1.8 only
-				},
-				MinVersion: tls.VersionTLS12,
-			}
-
-			if m.config.TLSCertPath != "" {
-				cert, err := tls.LoadX509KeyPair(m.config.TLSCertPath, m.config.TLSKeyPath)
-				if err != nil {
-					return nil, protocols.Invalid, fmt.Errorf("TLS is enabled but loading certs/key failed: %s, err: %s", m.config.TLSCertPath, err)
-				}
-
-				tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
-			} else {
-				cert, err := genX509KeyPair(m.config.AutoTLSCommonName)
-				if err != nil {
-					return nil, protocols.Invalid, fmt.Errorf("TLS is enabled but generating certs/key failed: %s", err)
-				}
-				tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
-			}
-
-			m.config.tlsConfig = tlsConfig
+		tlsConfig, err := m.getTLSConfig()
+		if err != nil {
+			return nil, protocols.Invalid, err
 		}
 
 		// this is TLS so replace the connection
-		c := tls.Server(conn, m.config.tlsConfig)
-		err := c.Handshake()
+		c := tls.Server(conn, tlsConfig)
+		err = c.Handshake()
 		if err != nil {
 			conn.Close()
 			return nil, protocols.Invalid, fmt.Errorf("multiplexing failed (tls handshake): err: %s", err)
 		}
 
+		m.tlsHandshakes.Add(1)
+		if c.ConnectionState().DidResume {
+			m.tlsResumed.Add(1)
+		}
+
 		// If we did unwrap tls, we now peek into the inner protocol to see whats there
 		conn, proto, err = m.determineProtocol(c)
 		if err != nil {
@@ -571,7 +715,7 @@ func (m *Multiplexer) unwrapTransports(conn net.Conn) (net.Conn, protocols.Type,
 		return conn, protocols.HTTP, nil
 	default:
 		// If the initial unwrapping was enough and left us with download or ssh, we can just quit
-		if protocols.FullyUnwrapped(proto) {
+		if m.fullyUnwrapped(proto) {
 			return conn, proto, nil
 		}
 	}
@@ -617,7 +761,7 @@ func (m *Multiplexer) unwrapWebsockets(conn net.Conn) (net.Conn, protocols.Type,
 			return nil, protocols.Invalid, fmt.Errorf("failed to determine protocol being carried by ws: %s", err)
 		}
 
-		if !protocols.FullyUnwrapped(proto) {
+		if !m.fullyUnwrapped(proto) {
 			conn.Close()
 			return nil, protocols.Invalid, errors.New("after unwrapping websockets found another protocol to unwrap (not control channel or download), does not support infinite protocol nesting")
 		}
@@ -0,0 +1,38 @@
+// Package namedpipe provides net.Conn and net.Listener wrappers around windows named pipes, which are reachable from other hosts over SMB (port 445)
+package namedpipe
+
+import (
+	"errors"
+	"strings"
+)
+
+const localPrefix = `\\.\pipe\`
+
+var ErrNotSupported = errors.New("named pipes are only supported on windows")
+
+// Addr is the full path of a pipe, e.g \\.\pipe\name or \\host\pipe\name
+type Addr string
+
+func (a Addr) Network() string {
+	return "pipe"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+// IsPipe reports whether addr is a named pipe path rather than a network address
+func IsPipe(addr string) bool {
+	parts := strings.Split(strings.TrimPrefix(addr, `\\`), `\`)
+	return strings.HasPrefix(addr, `\\`) && len(parts) >= 3 && strings.EqualFold(parts[1], "pipe") && parts[0] != "" && parts[2] != ""
+}
+
+// LocalPath returns the path to listen on for a pipe name
+func LocalPath(name string) string {
+	return localPrefix + name
+}
+
+// RemotePath returns the path another host uses to reach a pipe over SMB
+func RemotePath(host, name string) string {
+	return `\\` + host + `\pipe\` + name
+}
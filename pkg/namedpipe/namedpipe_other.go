@@ -0,0 +1,20 @@
+//go:build !windows
+
+package namedpipe
+
+import (
+	"net"
+	"time"
+)
+
+func Listen(path string) (net.Listener, error) {
+	return nil, ErrNotSupported
+}
+
+func ListenPrivate(path string) (net.Listener, error) {
+	return nil, ErrNotSupported
+}
+
+func Dial(path string, timeout time.Duration) (net.Conn, error) {
+	return nil, ErrNotSupported
+}
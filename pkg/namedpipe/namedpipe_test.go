@@ -0,0 +1,23 @@
+package namedpipe
+
+import "testing"
+
+func TestIsPipe(t *testing.T) {
+	for path, expected := range map[string]bool{
+		`\\.\pipe\rssh`:            true,
+		`\\fileserver\pipe\rssh`:   true,
+		`\\fileserver\PIPE\rssh`:   true,
+		RemotePath("host", "name"): true,
+		LocalPath("name"):          true,
+		`\\fileserver\share\file`:  false,
+		`\\.\pipe\`:                false,
+		`127.0.0.1`:                false,
+		`[::1]:22`:                 false,
+		`\pipe\rssh`:               false,
+		`\\\pipe\rssh`:             false,
+	} {
+		if IsPipe(path) != expected {
+			t.Errorf("IsPipe(%q) should be %t", path, expected)
+		}
+	}
+}
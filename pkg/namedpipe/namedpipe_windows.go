@@ -0,0 +1,234 @@
+//go:build windows
+
+package namedpipe
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	pipeBufferSize = 64 * 1024
+
+	// Authenticated users (which includes the machine accounts of other domain joined hosts), SYSTEM and administrators can read and write.
+	// The default pipe DACL only gives everyone read, which isnt enough for a relay
+	pipeSecurity = "D:P(A;;GA;;;AU)(A;;GA;;;SY)(A;;GA;;;BA)"
+)
+
+type conn struct {
+	*os.File
+	local, remote Addr
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func newConn(h windows.Handle, local, remote string) *conn {
+	// Handles opened for overlapped io are attached to the runtimes completion port, so reads and writes dont block each other (or a thread)
+	return &conn{
+		File:   os.NewFile(uintptr(h), remote),
+		local:  Addr(local),
+		remote: Addr(remote),
+	}
+}
+
+type listener struct {
+	path string
+	sa   *windows.SecurityAttributes
+	// Refuse connections over SMB, only processes on this host can connect
+	localOnly bool
+
+	// Signalled when the listener is closed, so a pending accept can give up
+	closed    windows.Handle
+	closeOnce sync.Once
+
+	lck sync.Mutex
+	// The pipe instance waiting for the next connection
+	next windows.Handle
+}
+
+func (l *listener) createInstance(first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(l.path)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		// Fail rather than share a name someone else is already listening on
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT)
+	if l.localOnly {
+		mode |= windows.PIPE_REJECT_REMOTE_CLIENTS
+	}
+
+	return windows.CreateNamedPipe(name, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, pipeBufferSize, pipeBufferSize, 0, l.sa)
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	if l.next == windows.InvalidHandle {
+		return nil, net.ErrClosed
+	}
+
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(event)
+
+	h := l.next
+
+	for {
+		ov := windows.Overlapped{HEvent: event}
+		err = windows.ConnectNamedPipe(h, &ov)
+		if err == windows.ERROR_IO_PENDING {
+			which, err := windows.WaitForMultipleObjects([]windows.Handle{event, l.closed}, false, windows.INFINITE)
+			if err != nil {
+				return nil, err
+			}
+
+			if which != windows.WAIT_OBJECT_0 {
+				windows.CancelIoEx(h, &ov)
+				return nil, net.ErrClosed
+			}
+
+			var done uint32
+			err = windows.GetOverlappedResult(h, &ov, &done, true)
+		}
+
+		if err == nil || err == windows.ERROR_PIPE_CONNECTED {
+			break
+		}
+
+		if err != windows.ERROR_NO_DATA && err != windows.ERROR_BROKEN_PIPE {
+			return nil, err
+		}
+
+		// The client went away before we got to it, reset the instance and wait for the next one
+		windows.DisconnectNamedPipe(h)
+	}
+
+	// Have the next instance ready before handing this one over, otherwise clients get file not found in between
+	l.next, err = l.createInstance(false)
+	if err != nil {
+		l.next = windows.InvalidHandle
+		windows.CloseHandle(h)
+		return nil, err
+	}
+
+	return newConn(h, l.path, l.path), nil
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		windows.SetEvent(l.closed)
+
+		l.lck.Lock()
+		defer l.lck.Unlock()
+
+		if l.next != windows.InvalidHandle {
+			windows.CloseHandle(l.next)
+			l.next = windows.InvalidHandle
+		}
+
+		windows.CloseHandle(l.closed)
+	})
+
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return Addr(l.path)
+}
+
+// Listen creates a named pipe at path (e.g \\.\pipe\name) that accepts connections from this host and, over SMB, from others
+func Listen(path string) (net.Listener, error) {
+	return listen(path, pipeSecurity, false)
+}
+
+// ListenPrivate creates a named pipe at path that only the user this process runs as can open, and only from this host
+func ListenPrivate(path string) (net.Listener, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+
+	return listen(path, "D:P(A;;GA;;;"+user.User.Sid.String()+")", true)
+}
+
+func listen(path, security string, localOnly bool) (net.Listener, error) {
+	if !IsPipe(path) {
+		return nil, errors.New("not a named pipe path: " + path)
+	}
+
+	sd, err := windows.SecurityDescriptorFromString(security)
+	if err != nil {
+		return nil, err
+	}
+
+	closed, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{
+		path: path,
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+		localOnly: localOnly,
+		closed:    closed,
+	}
+
+	l.next, err = l.createInstance(true)
+	if err != nil {
+		windows.CloseHandle(closed)
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Dial connects to a named pipe, on another host if path is \\host\pipe\name. Busy or not yet created pipes are retried until timeout
+func Dial(path string, timeout time.Duration) (net.Conn, error) {
+	if !IsPipe(path) {
+		return nil, errors.New("not a named pipe path: " + path)
+	}
+
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		// Only allow the pipe server to identify us, not impersonate us
+		h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			return newConn(h, path, path), nil
+		}
+
+		if (err != windows.ERROR_PIPE_BUSY && err != windows.ERROR_FILE_NOT_FOUND) || time.Now().After(deadline) {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: Addr(path), Err: err}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"io"
 	"os"
 	"strings"
+	"unicode"
+
+	"golang.org/x/text/width"
 )
 
 type value struct {
@@ -21,12 +24,32 @@ type Table struct {
 	lineMaxHeight []int
 }
 
+// runeWidth is how many terminal columns r takes, CJK and emoji take two and combining marks none
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+func displayWidth(s string) (n int) {
+	for _, r := range s {
+		n += runeWidth(r)
+	}
+	return
+}
+
 func makeValue(rn string) (val value) {
 	rn = strings.TrimSpace(rn)
 	val.parts = strings.Split(rn, "\n")
 	for _, n := range val.parts {
-		if len(n) > val.longest {
-			val.longest = len(n)
+		if w := displayWidth(n); w > val.longest {
+			val.longest = w
 		}
 	}
 	return
@@ -104,8 +127,13 @@ func (t *Table) FprintWidth(w io.Writer, width int) {
 	lines := t.OutputStrings()
 
 	for _, line := range lines {
-		for i := 0; i < len(line) && i < width-1; i++ {
-			fmt.Fprintf(w, "%c", line[i])
+		used := 0
+		for _, r := range line {
+			used += runeWidth(r)
+			if used > width-1 {
+				break
+			}
+			fmt.Fprintf(w, "%c", r)
 		}
 		fmt.Fprint(w, "\n")
 	}
@@ -130,7 +158,7 @@ func (t *Table) OutputStrings() (output []string) {
 				if len(values[x]) > y {
 					val = values[x][y]
 				}
-				m += fmt.Sprintf(" %-"+fmt.Sprintf("%d", t.cellMaxWidth[x])+"s |", val)
+				m += " " + val + strings.Repeat(" ", t.cellMaxWidth[x]-displayWidth(val)) + " |"
 			}
 
 			output = append(output, m)
@@ -140,7 +168,7 @@ func (t *Table) OutputStrings() (output []string) {
 		output = append(output, seperator)
 	}
 
-	output = append([]string{fmt.Sprintf("%"+fmt.Sprintf("%d", len(output[0])/2)+"s", t.name), seperator}, output...)
+	output = append([]string{strings.Repeat(" ", max(displayWidth(output[0])/2-displayWidth(t.name), 0)) + t.name, seperator}, output...)
 
 	return
 
@@ -0,0 +1,34 @@
+package table
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWideCharactersAlign(t *testing.T) {
+	tab, err := NewTable("Files", "Name", "Size")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"readme.txt", "報告書.docx", "😀 party.png", "café.txt"} {
+		if err := tab.AddValues(name, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := tab.OutputStrings()[1:]
+	for _, line := range lines {
+		if displayWidth(line) != displayWidth(lines[0]) {
+			t.Errorf("rows do not line up:\n%s", strings.Join(lines, "\n"))
+			break
+		}
+	}
+
+	var out bytes.Buffer
+	tab.FprintWidth(&out, 12)
+	if !strings.Contains(out.String(), "| 報告書") {
+		t.Errorf("cut output mangled the names:\n%s", out.String())
+	}
+}